@@ -0,0 +1,150 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// DefaultBatchParallelism is the number of buckets created concurrently by BatchCreateBuckets,
+	// if the request doesn't specify a parallelism.
+	DefaultBatchParallelism = 4
+	// MaxBatchParallelism caps the number of buckets created concurrently by BatchCreateBuckets.
+	MaxBatchParallelism = 16
+)
+
+type adminServer struct {
+	a Administrable
+}
+
+// NewAdminServer creates an implementation of the QuotaServiceAdmin gRPC service, that administers
+// an Administrable.
+func NewAdminServer(a Administrable) qspb.QuotaServiceAdminServer {
+	return &adminServer{a}
+}
+
+// BatchCreateBuckets creates named buckets in existing namespaces, using a pool of workers. A
+// failure to create one bucket doesn't affect the others; the outcome of each is reported in the
+// response, in the same order as the request.
+func (s *adminServer) BatchCreateBuckets(ctx context.Context, req *qspb.BatchCreateRequest) (*qspb.BatchCreateResponse, error) {
+	container := s.a.BucketContainer()
+	if container == nil {
+		return nil, grpc.Errorf(codes.Unavailable, "quota service not started")
+	}
+
+	specs := req.GetSpecs()
+	results := make([]*qspb.CreateResult, len(specs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < batchParallelism(req.GetMaxParallelism(), len(specs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				spec := specs[i]
+				result := &qspb.CreateResult{
+					Namespace: proto.String(spec.GetNamespace()),
+					Name:      proto.String(spec.GetName()),
+					Success:   proto.Bool(true)}
+
+				err := container.CreateBucket(spec.GetNamespace(), spec.GetName(), toBucketConfig(spec.GetConfig()))
+				if err != nil {
+					result.Success = proto.Bool(false)
+					result.Error = proto.String(err.Error())
+				}
+
+				results[i] = result
+			}
+		}()
+	}
+
+	for i := range specs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	return &qspb.BatchCreateResponse{Results: results}, nil
+}
+
+// DrainBucket removes all tokens accumulated in an existing bucket. Default and aggregate buckets
+// are drained using their reserved names.
+func (s *adminServer) DrainBucket(ctx context.Context, req *qspb.DrainRequest) (*qspb.DrainResponse, error) {
+	container := s.a.BucketContainer()
+	if container == nil {
+		return nil, grpc.Errorf(codes.Unavailable, "quota service not started")
+	}
+
+	removed, err := container.Drain(req.GetNamespace(), req.GetName())
+	if err == buckets.ErrNoSuchBucket {
+		return nil, grpc.Errorf(codes.NotFound, "no such bucket %v:%v", req.GetNamespace(), req.GetName())
+	}
+
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "unable to drain %v:%v: %v", req.GetNamespace(), req.GetName(), err)
+	}
+
+	return &qspb.DrainResponse{TokensRemoved: proto.Int64(removed)}, nil
+}
+
+// BackfillBucket adds tokens to an existing bucket, up to its size. Buckets are named as for
+// DrainBucket.
+func (s *adminServer) BackfillBucket(ctx context.Context, req *qspb.BackfillRequest) (*qspb.BackfillResponse, error) {
+	container := s.a.BucketContainer()
+	if container == nil {
+		return nil, grpc.Errorf(codes.Unavailable, "quota service not started")
+	}
+
+	err := container.Backfill(req.GetNamespace(), req.GetName(), req.GetTokens())
+	switch err {
+	case nil:
+		return &qspb.BackfillResponse{}, nil
+	case buckets.ErrNonPositiveTokens:
+		return nil, grpc.Errorf(codes.InvalidArgument, "tokens must be positive, was %v", req.GetTokens())
+	case buckets.ErrNoSuchBucket:
+		return nil, grpc.Errorf(codes.NotFound, "no such bucket %v:%v", req.GetNamespace(), req.GetName())
+	default:
+		return nil, grpc.Errorf(codes.Internal, "unable to backfill %v:%v: %v", req.GetNamespace(), req.GetName(), err)
+	}
+}
+
+// batchParallelism returns the number of workers to use to create numSpecs buckets, given the
+// parallelism requested.
+func batchParallelism(requested int32, numSpecs int) int {
+	n := int(requested)
+	if n <= 0 {
+		n = DefaultBatchParallelism
+	}
+
+	if n > MaxBatchParallelism {
+		n = MaxBatchParallelism
+	}
+
+	if n > numSpecs {
+		n = numSpecs
+	}
+
+	return n
+}
+
+// toBucketConfig converts a bucket config from its wire format. Unset fields are left at zero, to
+// take defaults when the bucket is created.
+func toBucketConfig(pb *qspb.BucketConfig) *configs.BucketConfig {
+	return &configs.BucketConfig{
+		Size:              pb.GetSize(),
+		FillRate:          pb.GetFillRate(),
+		WaitTimeoutMillis: pb.GetWaitTimeoutMillis(),
+		MaxIdleMillis:     pb.GetMaxIdleMillis(),
+		MaxDebtMillis:     pb.GetMaxDebtMillis()}
+}
@@ -0,0 +1,193 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/metrics"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type mockAdministrable struct {
+	cfg       *configs.ServiceConfig
+	container *buckets.BucketContainer
+}
+
+func (m *mockAdministrable) Metrics() metrics.Metrics {
+	return nil
+}
+
+func (m *mockAdministrable) Configs() *configs.ServiceConfig {
+	return m.cfg
+}
+
+func (m *mockAdministrable) BucketContainer() *buckets.BucketContainer {
+	return m.container
+}
+
+func newAdminServer() (*mockAdministrable, qspb.QuotaServiceAdminServer) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["existing"] = configs.NewDefaultBucketConfig()
+	bf := memory.NewBucketFactory()
+	bf.Init(cfg)
+
+	a := &mockAdministrable{cfg: cfg, container: buckets.NewBucketContainer(cfg, bf)}
+	return a, NewAdminServer(a)
+}
+
+func spec(namespace, name string, size int64) *qspb.CreateSpec {
+	return &qspb.CreateSpec{
+		Namespace: proto.String(namespace),
+		Name:      proto.String(name),
+		Config:    &qspb.BucketConfig{Size: proto.Int64(size)}}
+}
+
+func TestBatchCreateBuckets(t *testing.T) {
+	a, s := newAdminServer()
+	req := &qspb.BatchCreateRequest{MaxParallelism: proto.Int32(3)}
+	for i := 0; i < 20; i++ {
+		req.Specs = append(req.Specs, spec("n", fmt.Sprint("b", i), int64(i + 1)))
+	}
+
+	rsp, err := s.BatchCreateBuckets(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expecting no error. Was %v", err)
+	}
+
+	if len(rsp.Results) != len(req.Specs) {
+		t.Fatalf("Expecting %v results. Was %v", len(req.Specs), len(rsp.Results))
+	}
+
+	for i, result := range rsp.Results {
+		if !result.GetSuccess() || result.GetName() != req.Specs[i].GetName() {
+			t.Fatalf("Expecting bucket %v to be created. Was %v", req.Specs[i].GetName(), result)
+		}
+
+		b, _ := a.container.FindBucket("n", result.GetName())
+		if b == nil || b.Config().Size != int64(i + 1) {
+			t.Fatalf("Expecting bucket %v with size %v. Was %v", result.GetName(), i + 1, b)
+		}
+	}
+}
+
+func TestBatchCreateBucketsPartialFailure(t *testing.T) {
+	a, s := newAdminServer()
+	req := &qspb.BatchCreateRequest{Specs: []*qspb.CreateSpec{
+		spec("n", "new", 10),
+		spec("n", "existing", 10),
+		spec("nonexistent", "new", 10),
+		spec("n", "invalid", -1)}}
+
+	rsp, err := s.BatchCreateBuckets(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expecting no error. Was %v", err)
+	}
+
+	expected := []bool{true, false, false, false}
+	for i, result := range rsp.Results {
+		if result.GetSuccess() != expected[i] || (result.GetError() == "") != expected[i] {
+			t.Fatalf("Expecting success=%v for %v. Was %v", expected[i], req.Specs[i], result)
+		}
+	}
+
+	if b, _ := a.container.FindBucket("n", "new"); b == nil {
+		t.Fatal("Expecting successful creations not to be affected by failures")
+	}
+}
+
+func TestBatchCreateBucketsParallelismClamped(t *testing.T) {
+	_, s := newAdminServer()
+	req := &qspb.BatchCreateRequest{MaxParallelism: proto.Int32(1000)}
+	for i := 0; i < 50; i++ {
+		req.Specs = append(req.Specs, spec("n", fmt.Sprint("b", i), 10))
+	}
+
+	rsp, err := s.BatchCreateBuckets(context.Background(), req)
+	if err != nil || len(rsp.Results) != len(req.Specs) {
+		t.Fatalf("Expecting all buckets to be created. Was %v, %v", rsp, err)
+	}
+
+	cases := []struct {
+		requested int32
+		numSpecs  int
+		expected  int
+	}{
+		{1000, 50, MaxBatchParallelism},
+		{0, 50, DefaultBatchParallelism},
+		{-1, 50, DefaultBatchParallelism},
+		{8, 50, 8},
+		{8, 2, 2},
+		{8, 0, 0}}
+
+	for _, c := range cases {
+		if p := batchParallelism(c.requested, c.numSpecs); p != c.expected {
+			t.Fatalf("Expecting parallelism %v for %v requested and %v specs. Was %v",
+				c.expected, c.requested, c.numSpecs, p)
+		}
+	}
+}
+
+func TestDrainBucket(t *testing.T) {
+	a, s := newAdminServer()
+	b, _ := a.container.FindBucket("n", "existing")
+	b.Take(40, 0)
+
+	rsp, err := s.DrainBucket(context.TODO(), &qspb.DrainRequest{
+		Namespace: proto.String("n"),
+		Name:      proto.String("existing")})
+	if err != nil || rsp.GetTokensRemoved() != 60 {
+		t.Fatalf("Expecting 60 tokens removed. Was %v, %v", rsp, err)
+	}
+
+	_, err = s.DrainBucket(context.TODO(), &qspb.DrainRequest{
+		Namespace: proto.String("n"),
+		Name:      proto.String("nonexistent")})
+	if grpc.Code(err) != codes.NotFound {
+		t.Fatalf("Expecting NotFound. Was %v", err)
+	}
+}
+
+func TestBackfillBucket(t *testing.T) {
+	a, s := newAdminServer()
+	b, _ := a.container.FindBucket("n", "existing")
+	b.Take(40, 0)
+
+	_, err := s.BackfillBucket(context.TODO(), &qspb.BackfillRequest{
+		Namespace: proto.String("n"),
+		Name:      proto.String("existing"),
+		Tokens:    proto.Int64(25)})
+	if err != nil {
+		t.Fatalf("Expecting no error. Was %v", err)
+	}
+
+	if tokens := b.(buckets.TokenCounter).AvailableTokens(); tokens != 85 {
+		t.Fatalf("Expecting 85 tokens. Was %v", tokens)
+	}
+
+	_, err = s.BackfillBucket(context.TODO(), &qspb.BackfillRequest{
+		Namespace: proto.String("n"),
+		Name:      proto.String("existing"),
+		Tokens:    proto.Int64(-5)})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expecting InvalidArgument. Was %v", err)
+	}
+
+	_, err = s.BackfillBucket(context.TODO(), &qspb.BackfillRequest{
+		Namespace: proto.String("n"),
+		Name:      proto.String("nonexistent"),
+		Tokens:    proto.Int64(5)})
+	if grpc.Code(err) != codes.NotFound {
+		t.Fatalf("Expecting NotFound. Was %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// DefaultAuditBufferSize is how many decisions are buffered for a namespace's AuditWriter, unless
+// it sets AuditBufferSize.
+const DefaultAuditBufferSize = 1000
+
+// auditLog writes the quota decisions of a namespace to its AuditWriter, on a goroutine of its
+// own, so that requests never wait for the writer.
+type auditLog struct {
+	overflows int64 // Decisions dropped. First, so atomic operations on it are aligned.
+	writer    io.Writer
+	lines     chan []byte
+	stopper   <-chan struct{} // Closed to stop writing.
+}
+
+// auditRecord is the JSON written for each decision.
+type auditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Namespace string    `json:"namespace"`
+	Bucket    string    `json:"bucket"`
+	Tokens    int64     `json:"tokens"`
+	Status    string    `json:"status"`
+}
+
+func newAuditLog(writer io.Writer, bufferSize int, stopper <-chan struct{}) *auditLog {
+	if bufferSize <= 0 {
+		bufferSize = DefaultAuditBufferSize
+	}
+
+	a := &auditLog{writer: writer, lines: make(chan []byte, bufferSize), stopper: stopper}
+	go a.run()
+	return a
+}
+
+// record queues a decision to be written, dropping it if the buffer is full.
+func (a *auditLog) record(e QuotaEvent) {
+	line, err := json.Marshal(auditRecord{e.Timestamp, e.Namespace, e.BucketName, e.Tokens, e.Status.String()})
+	if err != nil {
+		logging.Printf("Unable to audit quota decision %+v. Error %v", e, err)
+		return
+	}
+
+	select {
+	case a.lines <- append(line, '\n'):
+	default:
+		atomic.AddInt64(&a.overflows, 1)
+	}
+}
+
+// run writes decisions until the container is stopped. Decisions still buffered then are dropped.
+func (a *auditLog) run() {
+	for {
+		select {
+		case line := <-a.lines:
+			if _, err := a.writer.Write(line); err != nil {
+				logging.Printf("Unable to write audit log. Error %v", err)
+			}
+		case <-a.stopper:
+			return
+		}
+	}
+}
+
+// AuditOverflows returns the number of decisions in a namespace that weren't written to its
+// AuditWriter because its buffer was full, or 0 if the namespace doesn't exist or isn't audited.
+func (bc *BucketContainer) AuditOverflows(namespace string) int64 {
+	ns := bc.namespace(namespace)
+	if ns == nil || ns.audit == nil {
+		return 0
+	}
+
+	return atomic.LoadInt64(&ns.audit.overflows)
+}
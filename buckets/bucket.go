@@ -5,28 +5,78 @@
 package buckets
 
 import (
+	"context"
 	"github.com/maniksurtani/quotaservice/configs"
 	"time"
 	"sync"
+	"sync/atomic"
 	"fmt"
 	"bytes"
 	"sort"
+	"strings"
+	"errors"
 	"github.com/maniksurtani/quotaservice/logging"
 )
 
 const (
 	GLOBAL_NAMESPACE = "___GLOBAL___"
 	DEFAULT_BUCKET_NAME = "___DEFAULT_BUCKET___"
+	AGGREGATE_BUCKET_NAME = "___AGGREGATE_BUCKET___"
+	// OPERATION_BUCKET_PREFIX prefixes the operation type in the names of operation buckets.
+	OPERATION_BUCKET_PREFIX = "___OPERATION___"
+)
+
+// ReadyPollInterval is how often WaitUntilReady() checks whether bucket factories are ready.
+const ReadyPollInterval = 50 * time.Millisecond
+
+var (
+	ErrDonationNotAccepted   = errors.New("Donation not accepted")
+	ErrInsufficientTokens    = errors.New("Insufficient tokens")
+	ErrNamespaceLocked       = errors.New("Namespace locked")
+	ErrNoSuchNamespace       = errors.New("No such namespace")
+	ErrNoSuchBucket          = errors.New("No such bucket")
+	ErrFactoryNotInitialized = errors.New("Bucket factory not initialized")
+	ErrBucketExists          = errors.New("Bucket already exists")
+	ErrAlreadyQuiesced       = errors.New("Already quiesced")
+	ErrNotQuiesced           = errors.New("Not quiesced")
+	ErrMaxConcurrency        = errors.New("Too many concurrent requests")
+	ErrCircularAlias         = errors.New("Circular alias")
+	ErrNamespaceExists       = errors.New("Namespace already exists")
+	ErrNonPositiveTokens     = errors.New("Tokens must be positive")
+	ErrNotPeekingBucket      = errors.New("Bucket doesn't support dry runs")
+	ErrNoDefaultBucket       = errors.New("No default bucket")
+	ErrCircuitOpen           = errors.New("Circuit open")
+	ErrNotReady              = errors.New("Bucket factory not ready")
+	ErrBucketDestroyed       = errors.New("Bucket destroyed")
 )
 
 // BucketContainer is a holder for configurations and bucket factories.
 type BucketContainer struct {
 	cfg           *configs.ServiceConfig
 	bf            BucketFactory
-	namespaces    map[string]*namespace
+	namespaces    atomic.Value // Of registryRef, replaced rather than modified once populated.
 	defaultBucket Bucket
+	eventLog      *eventLog
+	hierarchyLock sync.Mutex
+	costFunction  CostFunction
+	health        *healthTracker
+	pressure      *memoryPressure
+	rates         *rateTracker
+	consumption   atomic.Value // Of *consumptionTracker, once rate tracking is started.
+	replicator    atomic.Value // Of *replicator, once standby replication is configured.
+	aliases       atomic.Value // Of map[string]string, replaced rather than modified.
+	nsConfigs     atomic.Value // Of map[string]*configs.NamespaceConfig, replaced rather than modified.
+	aliasLock     sync.Mutex   // Serializes changes to aliases and namespace names.
+	quiesced      int32
+	ready         int32 // Set once the bucket factory is first ready.
+	recovery      recoveryHooks
+	stopper       chan struct{} // Closed by Stop(), to stop background goroutines.
+	stopOnce      sync.Once
 }
 
+// CostFunction computes the number of tokens a request costs, from the request's metadata.
+type CostFunction func(namespace, bucketName string, metadata map[string]string) int64
+
 // Bucket is an abstraction of a token bucket.
 type Bucket interface {
 	ActivityReporter
@@ -35,6 +85,19 @@ type Bucket interface {
 	// necessary, and a wait time that is less than 0 would mean that no tokens would be available
 	// within the max time limit specified.
 	Take(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration)
+	// AddTokens adds tokens to a token bucket, first paying off any tokens that have been borrowed
+	// from the future. The number of accumulated tokens never exceeds the size of the bucket.
+	AddTokens(numTokens int64)
+	// Tune adjusts the parameters of a live bucket, such as its fill rate and size, without
+	// discarding its state. Tokens accumulated are scaled in proportion to the new size.
+	Tune(cfg *configs.BucketConfig) error
+	// Drain removes all tokens accumulated in a bucket, which could otherwise be taken without
+	// waiting, and returns the number removed. Tokens borrowed from the future are still owed.
+	Drain() (tokensRemoved int64, err error)
+	// TokenLevelHistory returns the token levels recorded since a point in time, oldest first, at
+	// no finer a resolution than requested. Token levels are only recorded if HistoryResolutionMs
+	// is configured, and by buckets that support it; others return nil.
+	TokenLevelHistory(since time.Time, resolution time.Duration) []TokenSnapshot
 	Config() *configs.BucketConfig
 	// Dynamic indicates whether a bucket is a dynamic one, or one that is statically defined in
 	// configuration.
@@ -44,25 +107,117 @@ type Bucket interface {
 	Destroy()
 }
 
+// TokenSnapshot is the number of tokens held by a bucket at a point in time.
+type TokenSnapshot struct {
+	Time   time.Time
+	Tokens int64
+}
+
+// DownsampleHistory returns the snapshots taken at or after since, keeping only the first snapshot
+// in each interval of the given resolution.
+func DownsampleHistory(snapshots []TokenSnapshot, since time.Time, resolution time.Duration) []TokenSnapshot {
+	var downsampled []TokenSnapshot
+	for _, s := range snapshots {
+		if s.Time.Before(since) {
+			continue
+		}
+
+		if len(downsampled) > 0 && s.Time.Sub(downsampled[len(downsampled)-1].Time) < resolution {
+			continue
+		}
+
+		downsampled = append(downsampled, s)
+	}
+
+	return downsampled
+}
+
+// ScheduledGrant is a portion of a grant of tokens, and the time to wait before using it.
+type ScheduledGrant struct {
+	Tokens   int64
+	WaitTime time.Duration
+}
+
+// TrafficShapingBucket is a Bucket that is able to spread a grant of tokens evenly over time.
+type TrafficShapingBucket interface {
+	Bucket
+	// TakeShaped retrieves tokens from a token bucket like Take, but returns a schedule of
+	// sub-batches the tokens should be used in. If the first sub-batch is not available within the
+	// max time limit specified, nil is returned and no tokens are taken.
+	TakeShaped(numTokens int64, maxWaitTime time.Duration) []ScheduledGrant
+}
+
+// BurstAccountingBucket is a Bucket that keeps track of how many of the tokens it grants were
+// accumulated before a request, as opposed to refilled since the last request.
+type BurstAccountingBucket interface {
+	Bucket
+	// TakeWithBurst retrieves tokens like Take, but also returns how many of the tokens taken were
+	// burst tokens, accumulated before the last request. It returns 0 burst tokens if no tokens are
+	// taken.
+	TakeWithBurst(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration, burstTokens int64)
+}
+
+// PeekingBucket is a Bucket that can tell you what Take would return, without taking tokens.
+type PeekingBucket interface {
+	Bucket
+	// Peek returns the wait time Take would return for the same arguments, without changing the
+	// bucket's state.
+	Peek(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration)
+}
+
+// VariableCostBucket is a Bucket whose size and fill rate are in units of cost, such as bytes,
+// rather than requests, so that requests take as many tokens as they cost.
+type VariableCostBucket interface {
+	Bucket
+	// TakeCost retrieves costUnits tokens, returning the time to wait for them as Take does.
+	TakeCost(costUnits int64, maxWaitTime time.Duration) (waitTime time.Duration)
+}
+
+// ValidateTunedConfig checks that a configuration can be applied to a live bucket using Tune.
+func ValidateTunedConfig(cfg *configs.BucketConfig) error {
+	switch {
+	case cfg == nil:
+		return errors.New("Bucket config should not be nil")
+	case cfg.Size < 1:
+		return fmt.Errorf("Size should be positive, but is %v", cfg.Size)
+	case cfg.FillRate < 1:
+		return fmt.Errorf("Fill rate should be positive, but is %v", cfg.FillRate)
+	}
+
+	return nil
+}
+
 type ActivityReporter interface {
 	ActivityDetected() bool
 	ReportActivity()
 }
 
+// ActivityCounter is implemented by ActivityReporters that count the activity reported, rather
+// than only noting that there was some.
+type ActivityCounter interface {
+	// ActivityCount returns the number of times activity was reported since the last time this
+	// method was called.
+	ActivityCount() int64
+}
+
 // ActivityChannel is a channel that should be embedded into all bucket implementations. It should
 // be constructed using NewActivityChannel(), and activity should be reported on the bucket instance
 // using ActivityChannel.ReportActivity(), to ensure it isn't assumed to be inactive and removed
-// after a period of time.
-type ActivityChannel chan bool
+// after a period of time. Copies of an ActivityChannel share the activity reported.
+type ActivityChannel struct {
+	ch    chan bool
+	count *int64 // Activity reported since ActivityCount() was last called.
+}
 
 func NewActivityChannel() ActivityChannel {
-	return ActivityChannel(make(chan bool, 1))
+	return ActivityChannel{ch: make(chan bool, 1), count: new(int64)}
 }
 
 // ReportActivity indicates that an ActivityChannel is active. This method doesn't block.
 func (m ActivityChannel) ReportActivity() {
+	atomic.AddInt64(m.count, 1)
 	select {
-	case m <- true:
+	case m.ch <- true:
 	// reported activity
 	default:
 	// Already reported
@@ -73,20 +228,77 @@ func (m ActivityChannel) ReportActivity() {
 // called.
 func (m ActivityChannel) ActivityDetected() bool {
 	select {
-	case <-m:
+	case <-m.ch:
 		return true
 	default:
 		return false
 	}
 }
 
+// ActivityCount tells you how many times activity was reported since the last time this method was
+// called. It is independent of ActivityDetected().
+func (m ActivityChannel) ActivityCount() int64 {
+	return atomic.SwapInt64(m.count, 0)
+}
+
 type namespace struct {
-	cfg           *configs.NamespaceConfig
-	buckets       map[string]Bucket
-	defaultBucket Bucket
+	concurrency     int64 // Requests in flight. First, so atomic operations on it are aligned.
+	cfg             *configs.NamespaceConfig
+	buckets         map[string]Bucket
+	defaultBucket   Bucket
+	aggregateBucket Bucket
+	operationBuckets map[string]Bucket
+	locked          bool
+	dryRun          bool // Whether requests only peek at buckets. Starts as cfg.DryRun.
+	watchers        map[string]Bucket // The bucket each running watch goroutine is watching.
+	cfgCache        configCache
+	coldStarts      *coldStarts // nil unless the namespace has an OnColdStart hook.
+	dynamicPool     *dynamicPool // nil unless the namespace has a MaxDynamicBucketMemoryBytes.
+	audit           *auditLog // nil unless the namespace has an AuditWriter.
+	circuit         *circuitBreaker // nil unless the namespace has a CircuitBreakerThreshold.
+	grace           *gracePeriod // nil unless the namespace is in a grace period.
+	modifiers       fillRateModifiers // Factors multiplying the fill rates of its buckets.
+	parentName      string // Starts as cfg.Parent, which is left alone when the parent changes.
+	recoveryCaughtUp int // How many OnBucketRecovered() callbacks its buckets are registered with.
 	sync.RWMutex // Embedded mutex
 }
 
+// bucketConfig returns the config to create a bucket with, and whether the bucket is dynamic. The
+// config is nil if the bucket isn't named, and the namespace doesn't allow dynamic buckets.
+func (ns *namespace) bucketConfig(bucketName string) (*configs.BucketConfig, bool) {
+	cc := ns.cfgCache.get(bucketName, func() cachedConfig {
+		if bCfg := ns.cfg.Buckets[bucketName]; bCfg != nil {
+			return cachedConfig{bCfg, false}
+		}
+
+		return cachedConfig{ns.cfg.DynamicBucketTemplate, true}
+	})
+
+	return cc.cfg, cc.dyn
+}
+
+func (ns *namespace) isLocked() bool {
+	ns.RLock()
+	defer ns.RUnlock()
+	return ns.locked
+}
+
+// parent returns the name of this namespace's parent, or an empty string if it has none.
+func (ns *namespace) parent() string {
+	ns.RLock()
+	defer ns.RUnlock()
+	return ns.parentName
+}
+
+func (ns *namespace) acceptsDonationsFrom(namespace string) bool {
+	for _, n := range ns.cfg.AcceptDonationsFrom {
+		if n == namespace {
+			return true
+		}
+	}
+	return false
+}
+
 // watch watches a bucket for activity, deleting the bucket if no activity has been detected after
 // a given duration.
 func (ns *namespace) watch(bucketName string, bucket Bucket, freq time.Duration) {
@@ -107,7 +319,33 @@ func (ns *namespace) watch(bucketName string, bucket Bucket, freq time.Duration)
 	// Remove this bucket.
 	ns.Lock()
 	defer ns.Unlock()
+	if ns.watchers[bucketName] == bucket {
+		delete(ns.watchers, bucketName)
+	}
+
+	if ns.buckets[bucketName] != bucket {
+		// Already removed, such as when evicted to make room for another dynamic bucket.
+		return
+	}
+
 	delete(ns.buckets, bucketName)
+	if ns.dynamicPool != nil {
+		ns.dynamicPool.remove(bucketName)
+	}
+	bucket.Destroy()
+}
+
+// evict removes a dynamic bucket to free memory. Should be called with the namespace locked.
+func (ns *namespace) evict(bucketName string) {
+	bucket := ns.buckets[bucketName]
+	if bucket == nil {
+		return
+	}
+
+	delete(ns.buckets, bucketName)
+	if ns.watchers[bucketName] == bucket {
+		delete(ns.watchers, bucketName)
+	}
 	bucket.Destroy()
 }
 
@@ -116,6 +354,12 @@ type BucketFactory interface {
 	// Init initializes the bucket factory.
 	Init(cfg *configs.ServiceConfig)
 
+	// Ready returns true only once the bucket factory has been successfully initialized.
+	Ready() bool
+
+	// ReadyErr returns the reason the bucket factory isn't ready, or nil if it is.
+	ReadyErr() error
+
 	// NewBucket creates a new bucket.
 	NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) Bucket
 }
@@ -126,23 +370,76 @@ func FullyQualifiedName(namespace, bucketName string) string {
 
 // NewBucketContainer creates a new bucket container.
 func NewBucketContainer(cfg *configs.ServiceConfig, bf BucketFactory) (bc *BucketContainer) {
-	bc = &BucketContainer{cfg: cfg, bf: bf, namespaces: make(map[string]*namespace)}
+	bc = &BucketContainer{
+		cfg:     cfg,
+		bf:      bf,
+		health:  newHealthTracker(),
+		rates:   newRateTracker(),
+		stopper: make(chan struct{})}
+	registry := make(mapRegistry)
+
+	aliases := make(map[string]string, len(cfg.NamespaceAliases))
+	for alias, target := range cfg.NamespaceAliases {
+		aliases[alias] = target
+	}
+	bc.aliases.Store(aliases)
+
+	nsConfigs := make(map[string]*configs.NamespaceConfig, len(cfg.Namespaces))
+	for name, nsCfg := range cfg.Namespaces {
+		nsConfigs[name] = nsCfg
+	}
+	bc.nsConfigs.Store(nsConfigs)
 
 	if cfg.GlobalDefaultBucket != nil {
 		bc.defaultBucket = bf.NewBucket(GLOBAL_NAMESPACE, DEFAULT_BUCKET_NAME, cfg.GlobalDefaultBucket, false)
 	}
 
 	for nsName, nsCfg := range cfg.Namespaces {
-		nsp := &namespace{cfg: nsCfg, buckets: make(map[string]Bucket)}
+		// Namespaces inherit settings they don't set from the global policy.
+		nsCfg = cfg.GlobalPolicy.Apply(nsCfg)
+		nsp := &namespace{cfg: nsCfg, buckets: make(map[string]Bucket), watchers: make(map[string]Bucket), dryRun: nsCfg.DryRun,
+			circuit: newCircuitBreaker(nsCfg), parentName: nsCfg.Parent}
+		if nsCfg.OnColdStart != nil {
+			nsp.coldStarts = newColdStarts(nsCfg.ColdStartIdleMillis)
+		}
+
+		if nsCfg.AuditWriter != nil {
+			nsp.audit = newAuditLog(nsCfg.AuditWriter, nsCfg.AuditBufferSize, bc.stopper)
+		}
+
+		if nsCfg.MaxDynamicBucketMemoryBytes > 0 {
+			nsp.dynamicPool = newDynamicPool(nsCfg.MaxDynamicBucketMemoryBytes)
+		}
+
 		if nsCfg.DefaultBucket != nil {
 			nsp.defaultBucket = bf.NewBucket(nsName, DEFAULT_BUCKET_NAME, nsCfg.DefaultBucket, false)
 		}
 
+		if nsCfg.AggregateBucket != nil {
+			nsp.aggregateBucket = bf.NewBucket(nsName, AGGREGATE_BUCKET_NAME, nsCfg.AggregateBucket, false)
+		}
+
+		if len(nsCfg.OperationBuckets) > 0 {
+			nsp.operationBuckets = make(map[string]Bucket, len(nsCfg.OperationBuckets))
+			for op, opCfg := range nsCfg.OperationBuckets {
+				nsp.operationBuckets[op] = bf.NewBucket(nsName, OPERATION_BUCKET_PREFIX + op, opCfg, false)
+			}
+		}
+
 		for bucketName, bucketCfg := range nsCfg.Buckets {
 			bc.createNewNamedBucketFromCfg(nsName, bucketName, nsp, bucketCfg, false)
 		}
 
-		bc.namespaces[nsName] = nsp
+		registry.Put(nsName, nsp)
+	}
+
+	bc.namespaces.Store(registryRef{registry})
+
+	if cfg.BorrowMarket != nil {
+		m := cfg.BorrowMarket
+		go bc.every(time.Duration(m.MarketIntervalMillis) * time.Millisecond, func() {
+			bc.runBorrowMarket(m)
+		})
 	}
 	return
 }
@@ -151,52 +448,334 @@ func NewBucketContainer(cfg *configs.ServiceConfig, bf BucketFactory) (bc *Bucke
 // if a global default bucket is configured, it will be used. If the namespace is available but the
 // named bucket doesn't exist, it will either use a namespace-scoped default bucket if available, or
 // a dynamic bucket is created if enabled (and space for more dynamic buckets is available). If all
-// fails, this function returns nil. This function is thread-safe, and may lazily create dynamic
+// fails, this function returns nil. If the namespace has been locked using LockNamespace(),
+// ErrNamespaceLocked is returned. This function is thread-safe, and may lazily create dynamic
 // buckets or re-create statically defined buckets that have been invalidated.
-func (bc *BucketContainer) FindBucket(namespace string, bucketName string) (bucket Bucket) {
-	ns := bc.namespaces[namespace]
+func (bc *BucketContainer) FindBucket(namespace string, bucketName string) (bucket Bucket, err error) {
+	return bc.FindBucketTraced(namespace, bucketName, nil)
+}
+
+// FindBucketTraced is like FindBucket, but also records each step taken to resolve the bucket in
+// trace, if it isn't nil, using TraceStep().
+func (bc *BucketContainer) FindBucketTraced(namespace string, bucketName string, trace *strings.Builder) (bucket Bucket, err error) {
+	if !bc.becameReady() {
+		TraceStep(trace, "bucket factory not ready")
+		return nil, ErrNotReady
+	}
+
+	if resolved := bc.resolveAlias(namespace); resolved != namespace {
+		TraceStep(trace, "resolved alias %v to namespace %v", namespace, resolved)
+		namespace = resolved
+	}
+
+	ns := bc.namespace(namespace)
 	if ns == nil {
 		// Namespace doesn't exist. Use default bucket if possible.
+		TraceStep(trace, "found no namespace %v", namespace)
 		bucket = bc.defaultBucket
+		if bucket == nil {
+			TraceStep(trace, "found no global default bucket")
+		} else {
+			TraceStep(trace, "fell back to global default bucket")
+		}
 	} else {
+		TraceStep(trace, "looked up namespace %v", namespace)
 
 		// Check if the precise bucket exists.
 		ns.RLock()
+		locked := ns.locked
 		bucket = ns.buckets[bucketName]
 		ns.RUnlock()
 
-		if bucket == nil {
-			if ns.cfg.DynamicBucketTemplate != nil {
-				// Double-checked locking is safe in Golang, since acquiring locks (read or write)
-				// have the same effect as volatile in Java, causing a memory fence being crossed.
-				ns.Lock()
-				defer ns.Unlock()
-				// need to check if an instance has been created concurrently.
-				bucket = ns.buckets[bucketName]
+		if locked {
+			TraceStep(trace, "namespace %v is locked", namespace)
+			return nil, ErrNamespaceLocked
+		}
+
+		if bucket != nil {
+			TraceStep(trace, "found bucket %v", bucketName)
+		} else if ns.cfg.DynamicBucketTemplate != nil {
+			// Double-checked locking is safe in Golang, since acquiring locks (read or write)
+			// have the same effect as volatile in Java, causing a memory fence being crossed.
+			ns.Lock()
+			defer ns.Unlock()
+			// need to check if an instance has been created concurrently.
+			bucket = ns.buckets[bucketName]
+			if bucket == nil {
+				bucket = bc.createNewNamedBucket(namespace, bucketName, ns)
 				if bucket == nil {
-					bucket = bc.createNewNamedBucket(namespace, bucketName, ns)
+					TraceStep(trace, "found no bucket %v, and unable to create a dynamic bucket", bucketName)
+				} else {
+					TraceStep(trace, "created dynamic bucket %v", bucketName)
 				}
 			} else {
-				// Try a default for the namespace.
-				bucket = ns.defaultBucket
+				TraceStep(trace, "found bucket %v", bucketName)
+			}
+		} else {
+			// Try a default for the namespace.
+			TraceStep(trace, "found no named bucket %v", bucketName)
+			bucket = ns.defaultBucket
+			if bucket == nil {
+				TraceStep(trace, "found no namespace default bucket")
+			} else {
+				TraceStep(trace, "fell back to namespace default bucket")
 			}
 		}
 	}
 
 	if bucket != nil {
 		bucket.ReportActivity()
+		if ns != nil && ns.dynamicPool != nil && bucket.Dynamic() {
+			ns.dynamicPool.touch(bucketName)
+		}
+
+		if ns != nil && ns.coldStarts != nil {
+			ns.coldStarts.requested(namespace, bucketName, bucket == ns.defaultBucket, ns.cfg.OnColdStart)
+		}
 	}
 
 	return
 }
 
+// TraceStep appends a step to a resolution trace, separating steps using semicolons. Does nothing if
+// trace is nil.
+func TraceStep(trace *strings.Builder, format string, args ...interface{}) {
+	if trace == nil {
+		return
+	}
+
+	if trace.Len() > 0 {
+		trace.WriteByte(';')
+	}
+	fmt.Fprintf(trace, format, args...)
+}
+
+// LockNamespace stops all new token grants for a namespace, without removing it, until
+// UnlockNamespace() is called. Requests that have already found a bucket are either allowed to
+// complete or aborted, depending on the namespace's AbortInFlightOnLock setting.
+func (bc *BucketContainer) LockNamespace(namespace string) error {
+	return bc.setLocked(namespace, true)
+}
+
+// UnlockNamespace resumes token grants for a namespace locked using LockNamespace().
+func (bc *BucketContainer) UnlockNamespace(namespace string) error {
+	return bc.setLocked(namespace, false)
+}
+
+// IsNamespaceLocked tells you if a namespace has been locked using LockNamespace().
+func (bc *BucketContainer) IsNamespaceLocked(namespace string) bool {
+	ns := bc.namespace(namespace)
+	return ns != nil && ns.isLocked()
+}
+
+// SetNamespaceDryRun puts a namespace into, or takes it out of, dry-run mode, overriding its
+// DryRun config. Requests against a namespace in dry-run mode are served as though they were dry
+// runs, peeking at buckets without taking any tokens.
+func (bc *BucketContainer) SetNamespaceDryRun(namespace string, dryRun bool) error {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return ErrNoSuchNamespace
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+	ns.dryRun = dryRun
+	logging.Printf("Namespace %v dryRun=%v", namespace, dryRun)
+	return nil
+}
+
+// IsNamespaceDryRun tells you if a namespace is in dry-run mode.
+func (bc *BucketContainer) IsNamespaceDryRun(namespace string) bool {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return false
+	}
+
+	ns.RLock()
+	defer ns.RUnlock()
+	return ns.dryRun
+}
+
+func (bc *BucketContainer) setLocked(namespace string, locked bool) error {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return ErrNoSuchNamespace
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+	ns.locked = locked
+	logging.Printf("Namespace %v locked=%v", namespace, locked)
+	return nil
+}
+
+// Quiesce stops the creation of new dynamic buckets, for example during rolling restarts, until
+// Unquiesce() is called. Existing buckets continue to serve requests.
+func (bc *BucketContainer) Quiesce() error {
+	if !atomic.CompareAndSwapInt32(&bc.quiesced, 0, 1) {
+		return ErrAlreadyQuiesced
+	}
+
+	logging.Print("Bucket container quiesced")
+	return nil
+}
+
+// Unquiesce resumes the creation of dynamic buckets, stopped using Quiesce().
+func (bc *BucketContainer) Unquiesce() error {
+	if !atomic.CompareAndSwapInt32(&bc.quiesced, 1, 0) {
+		return ErrNotQuiesced
+	}
+
+	logging.Print("Bucket container unquiesced")
+	return nil
+}
+
+// IsQuiesced tells you if the creation of dynamic buckets has been stopped using Quiesce().
+func (bc *BucketContainer) IsQuiesced() bool {
+	return atomic.LoadInt32(&bc.quiesced) == 1
+}
+
+// FallbackBuckets returns the buckets to try, in order, when a bucket has no tokens available. The
+// bucket's FallbackChain is walked depth-first, so each fallback's own FallbackChain is tried
+// before the next fallback. Fallbacks that don't exist, are locked, or have already been visited
+// are skipped, so cycles are never followed.
+func (bc *BucketContainer) FallbackBuckets(b Bucket) []Bucket {
+	var fallbacks []Bucket
+	visited := make(map[string]bool)
+	bc.collectFallbacks(b, b, visited, &fallbacks)
+	return fallbacks
+}
+
+func (bc *BucketContainer) collectFallbacks(origin, b Bucket, visited map[string]bool, fallbacks *[]Bucket) {
+	for _, fqn := range b.Config().FallbackChain {
+		if visited[fqn] {
+			continue
+		}
+		visited[fqn] = true
+
+		namespace, bucketName, ok := configs.SplitFullyQualifiedName(fqn)
+		if !ok {
+			continue
+		}
+
+		fallback, _ := bc.FindBucket(namespace, bucketName)
+		if fallback == nil || fallback == origin {
+			continue
+		}
+
+		*fallbacks = append(*fallbacks, fallback)
+		bc.collectFallbacks(origin, fallback, visited, fallbacks)
+	}
+}
+
+// Ready returns true only when the bucket factories used by this container are ready.
+func (bc *BucketContainer) Ready() bool {
+	return bc.bf.Ready()
+}
+
+// becameReady tells you if the bucket factories used by this container have been ready since the
+// container was created. Unlike Ready(), it only checks the factories until they are first ready.
+func (bc *BucketContainer) becameReady() bool {
+	if atomic.LoadInt32(&bc.ready) == 1 {
+		return true
+	}
+
+	if !bc.bf.Ready() {
+		return false
+	}
+
+	atomic.StoreInt32(&bc.ready, 1)
+	return true
+}
+
+// WaitUntilReady blocks until the bucket factories used by this container are ready, checking
+// every ReadyPollInterval, or until ctx is done, returning its error. Until the factories are
+// first ready, FindBucket() returns ErrNotReady.
+func (bc *BucketContainer) WaitUntilReady(ctx context.Context) error {
+	t := time.NewTicker(ReadyPollInterval)
+	defer t.Stop()
+
+	for !bc.becameReady() {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// CreateBucket adds a named bucket to an existing namespace at runtime, as though it had been
+// statically configured. The config is validated, and defaults are applied to it. Creating a bucket
+// that already exists, or that shares a name with a reserved bucket, fails.
+func (bc *BucketContainer) CreateBucket(namespace, bucketName string, cfg *configs.BucketConfig) error {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return ErrNoSuchNamespace
+	}
+
+	if bucketName == "" || bucketName == DEFAULT_BUCKET_NAME || bucketName == AGGREGATE_BUCKET_NAME ||
+		strings.HasPrefix(bucketName, OPERATION_BUCKET_PREFIX) {
+		return fmt.Errorf("Invalid bucket name %q", bucketName)
+	}
+
+	if cfg == nil || cfg.Ref != "" {
+		return fmt.Errorf("Bucket %v needs a config", FullyQualifiedName(namespace, bucketName))
+	}
+
+	if err := configs.ValidateBucketConfig(cfg); err != nil {
+		return err
+	}
+
+	configs.ApplyBucketDefaults(cfg)
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.buckets[bucketName] != nil || ns.cfg.Buckets[bucketName] != nil {
+		return ErrBucketExists
+	}
+
+	if ns.cfg.Buckets == nil {
+		ns.cfg.Buckets = make(map[string]*configs.BucketConfig)
+	}
+
+	// Recorded in the namespace's config, so the bucket is re-created as a named bucket if it is
+	// removed when idle.
+	ns.cfg.Buckets[bucketName] = cfg
+	ns.cfgCache.invalidate(bucketName)
+	bc.createNewNamedBucketFromCfg(namespace, bucketName, ns, cfg, false)
+	return nil
+}
+
+// PromoteDefaultToNamed creates a named bucket in a namespace with a copy of the config of its
+// default bucket, so that the bucket can be tuned independently. The default bucket remains in
+// place. Fails as CreateBucket() does, or with ErrNoDefaultBucket if the namespace has none.
+func (bc *BucketContainer) PromoteDefaultToNamed(namespace, newName string) error {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return ErrNoSuchNamespace
+	}
+
+	if ns.defaultBucket == nil {
+		return ErrNoDefaultBucket
+	}
+
+	cfg := *ns.defaultBucket.Config()
+	return bc.CreateBucket(namespace, newName, &cfg)
+}
+
 // createNewNamedBucket creates a new, named bucket. May return nil if the named bucket is dynamic,
 // and the namespace has already reached its maxDynamicBuckets setting.
 func (bc *BucketContainer) createNewNamedBucket(namespace, bucketName string, ns *namespace) Bucket {
-	bCfg := ns.cfg.Buckets[bucketName]
-	dyn := false
-	if bCfg == nil {
-		// Dynamic.
+	bCfg, dyn := ns.bucketConfig(bucketName)
+	if dyn {
+		if bc.IsQuiesced() {
+			logging.Printf("Bucket %v:%v not created, since the container is quiesced.", namespace, bucketName)
+			return nil
+		}
+
 		numDynamicBuckets := bc.countDynamicBuckets(namespace)
 		if  numDynamicBuckets >= ns.cfg.MaxDynamicBuckets && ns.cfg.MaxDynamicBuckets > 0 {
 			logging.Printf("Bucket %v:%v numDynamicBuckets=%v maxDynamicBuckets=%v. Not creating more dynamic buckets.",
@@ -204,8 +783,19 @@ func (bc *BucketContainer) createNewNamedBucket(namespace, bucketName string, ns
 			return nil
 		}
 
-		dyn = true
-		bCfg = ns.cfg.DynamicBucketTemplate
+		if ns.dynamicPool != nil {
+			evicted, ok := ns.dynamicPool.reserve(bucketName, estimatedMemory(bucketName, bCfg))
+			if !ok {
+				logging.Printf("Bucket %v:%v not created, since it needs more than max_dynamic_bucket_memory_bytes=%v.",
+					namespace, bucketName, ns.cfg.MaxDynamicBucketMemoryBytes)
+				return nil
+			}
+
+			for _, name := range evicted {
+				logging.Printf("Evicting least recently used bucket %v:%v to make room for %v.", namespace, name, bucketName)
+				ns.evict(name)
+			}
+		}
 	}
 
 	return bc.createNewNamedBucketFromCfg(namespace, bucketName, ns, bCfg, dyn)
@@ -213,7 +803,7 @@ func (bc *BucketContainer) createNewNamedBucket(namespace, bucketName string, ns
 
 func (bc *BucketContainer) countDynamicBuckets(namespace string) int {
 	c := 0
-	for _, b := range bc.namespaces[namespace].buckets {
+	for _, b := range bc.namespace(namespace).buckets {
 		if b.Dynamic() {
 			c++
 		}
@@ -223,14 +813,330 @@ func (bc *BucketContainer) countDynamicBuckets(namespace string) int {
 
 func (bc *BucketContainer) createNewNamedBucketFromCfg(namespace, bucketName string, ns *namespace, bCfg *configs.BucketConfig, dyn bool) Bucket {
 	bucket := bc.bf.NewBucket(namespace, bucketName, bCfg, dyn)
+	bc.watchRecovery(namespace, ns, bucketName, bucket)
+	ns.modifiers.apply(bucket)
 	ns.buckets[bucketName] = bucket
 	bucket.ReportActivity()
+	if bCfg.MaxIdleMillis != 0 {
+		ns.watchers[bucketName] = bucket
+	}
 	go ns.watch(bucketName, bucket, time.Duration(bCfg.MaxIdleMillis) * time.Millisecond)
 	return bucket
 }
 
+// Stop stops the container's background goroutines, such as the one adapting to memory pressure,
+// and persists the lifetime stats of buckets that persist them. Buckets keep serving requests.
+func (bc *BucketContainer) Stop() {
+	bc.stopOnce.Do(func() { close(bc.stopper) })
+	bc.flushStats()
+}
+
+// every calls f every interval until the container is stopped.
+func (bc *BucketContainer) every(interval time.Duration, f func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			f()
+		case <-bc.stopper:
+			return
+		}
+	}
+}
+
+// WithEventLog enables recording of the last size quota decisions, for post-mortem analysis. The
+// event log is disabled by default.
+func (bc *BucketContainer) WithEventLog(size int) *BucketContainer {
+	if size < 1 {
+		panic(fmt.Sprintf("Event log size should be positive, but is %v", size))
+	}
+
+	bc.eventLog = newEventLog(size)
+	return bc
+}
+
+// WithCostFunction prices requests that carry metadata using fn, overriding the number of tokens
+// requested by the caller.
+func (bc *BucketContainer) WithCostFunction(fn CostFunction) *BucketContainer {
+	bc.costFunction = fn
+	return bc
+}
+
+// TokenCost returns the number of tokens a request costs. The CostCalculator of the bucket's config
+// is used if it has one, or else the container's cost function. If neither is configured, or the
+// request carries no metadata, the number of tokens requested by the caller is used.
+func (bc *BucketContainer) TokenCost(namespace, bucketName string, metadata map[string]string, tokensRequested int64) int64 {
+	if metadata == nil {
+		return tokensRequested
+	}
+
+	if ns := bc.namespace(namespace); ns != nil {
+		cfg, _ := ns.bucketConfig(bucketName)
+		if cfg == nil {
+			cfg = ns.cfg.DefaultBucket
+		}
+
+		if cfg != nil && cfg.CostCalculator != nil {
+			return cfg.CostCalculator(metadata)
+		}
+	}
+
+	if bc.costFunction == nil {
+		return tokensRequested
+	}
+
+	return bc.costFunction(namespace, bucketName, metadata)
+}
+
+// RecordEvent records a quota decision in the event log, if enabled, and in the namespace's audit
+// log, if it has an AuditWriter, and counts it towards the bucket's rate of requests, and of
+// tokens granted if rate tracking is started.
+func (bc *BucketContainer) RecordEvent(namespace, bucketName string, tokens int64, status EventStatus) {
+	now := time.Now()
+	bc.rates.record(FullyQualifiedName(namespace, bucketName), now)
+	if t, ok := bc.consumption.Load().(*consumptionTracker); ok && status != EVENT_REJECTED {
+		t.record(FullyQualifiedName(namespace, bucketName), tokens)
+	}
+	if r, ok := bc.replicator.Load().(*replicator); ok && status != EVENT_REJECTED {
+		r.replicate(namespace, bucketName, tokens, now)
+	}
+	if bc.eventLog != nil {
+		bc.eventLog.record(QuotaEvent{now, namespace, bucketName, tokens, status})
+	}
+
+	if ns := bc.namespace(namespace); ns != nil && ns.audit != nil {
+		ns.audit.record(QuotaEvent{now, namespace, bucketName, tokens, status})
+	}
+}
+
+// DumpEventLog returns the events in the event log, oldest first, or nil if the event log is
+// disabled.
+func (bc *BucketContainer) DumpEventLog() []QuotaEvent {
+	if bc.eventLog == nil {
+		return nil
+	}
+
+	return bc.eventLog.dump()
+}
+
+// AggregateBucket returns the bucket that limits all requests made against a namespace, or nil if
+// the namespace doesn't exist or doesn't have an aggregate bucket configured.
+func (bc *BucketContainer) AggregateBucket(namespace string) Bucket {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return nil
+	}
+
+	return ns.aggregateBucket
+}
+
+// OperationBucket returns the bucket limiting a type of operation in a namespace, or nil if there
+// is none.
+func (bc *BucketContainer) OperationBucket(namespace, operationType string) Bucket {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return nil
+	}
+
+	return ns.operationBuckets[operationType]
+}
+
+// AggregateBuckets returns all aggregate buckets that limit requests made against a namespace: the
+// namespace's own, if configured, followed by those of its ancestors, nearest first.
+func (bc *BucketContainer) AggregateBuckets(namespace string) []Bucket {
+	var aggregates []Bucket
+
+	// Bound the walk by the number of namespaces, in case of a concurrent SetParent().
+	ns := bc.namespace(namespace)
+	for i := 0; ns != nil && i < bc.registry().Len(); i++ {
+		if ns.aggregateBucket != nil {
+			aggregates = append(aggregates, ns.aggregateBucket)
+		}
+		ns = bc.namespace(ns.parent())
+	}
+
+	return aggregates
+}
+
+// SetParent makes parent the parent namespace of child, so that requests made against child are
+// limited by parent's aggregate bucket, and those of parent's ancestors, too. An empty parent
+// removes child's parent. Returns an error if either namespace doesn't exist, or if child would
+// become its own ancestor.
+func (bc *BucketContainer) SetParent(child, parent string) error {
+	bc.hierarchyLock.Lock()
+	defer bc.hierarchyLock.Unlock()
+
+	childNs := bc.namespace(child)
+	if childNs == nil {
+		return fmt.Errorf("Namespace %v doesn't exist", child)
+	}
+
+	if parent != "" {
+		if bc.namespace(parent) == nil {
+			return fmt.Errorf("Namespace %v doesn't exist", parent)
+		}
+
+		for ancestor := parent; ancestor != ""; ancestor = bc.namespace(ancestor).parent() {
+			if ancestor == child {
+				return fmt.Errorf("Namespace %v cannot be an ancestor of itself", child)
+			}
+		}
+	}
+
+	childNs.Lock()
+	defer childNs.Unlock()
+	childNs.parentName = parent
+	return nil
+}
+
+// DonateTokens moves tokens from one namespace's aggregate bucket to another's. The receiving
+// namespace must list the donor in its AcceptDonationsFrom configuration. Tokens are only donated
+// if the donor's aggregate bucket can give them up without waiting; otherwise
+// ErrInsufficientTokens is returned and neither bucket is changed.
+func (bc *BucketContainer) DonateTokens(fromNamespace, toNamespace string, tokens int64) error {
+	if tokens < 1 {
+		return fmt.Errorf("Cannot donate %v tokens", tokens)
+	}
+
+	if fromNamespace == toNamespace {
+		return fmt.Errorf("Namespace %v cannot donate tokens to itself", fromNamespace)
+	}
+
+	from := bc.namespace(fromNamespace)
+	to := bc.namespace(toNamespace)
+	if from == nil || from.aggregateBucket == nil {
+		return fmt.Errorf("Namespace %v doesn't exist or has no aggregate bucket", fromNamespace)
+	}
+
+	if to == nil || to.aggregateBucket == nil {
+		return fmt.Errorf("Namespace %v doesn't exist or has no aggregate bucket", toNamespace)
+	}
+
+	if !to.acceptsDonationsFrom(fromNamespace) {
+		return ErrDonationNotAccepted
+	}
+
+	// Always lock namespaces in the same order to prevent deadlocks with concurrent donations.
+	first, second := from, to
+	if toNamespace < fromNamespace {
+		first, second = to, from
+	}
+
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+
+	// Buckets that lend tokens grant requests beyond the tokens they have without waiting, so those
+	// that count their tokens are checked first.
+	if tc, ok := from.aggregateBucket.(TokenCounter); ok && tc.AvailableTokens() < tokens {
+		return ErrInsufficientTokens
+	}
+
+	if w := from.aggregateBucket.Take(tokens, time.Nanosecond); w != 0 {
+		if w > 0 {
+			from.aggregateBucket.AddTokens(tokens)
+		}
+		return ErrInsufficientTokens
+	}
+
+	to.aggregateBucket.AddTokens(tokens)
+	logging.Printf("Namespace %v donated %v tokens to namespace %v", fromNamespace, tokens, toNamespace)
+	return nil
+}
+
+// Drain removes all tokens accumulated in a bucket, for emergencies and tests, and returns the
+// number removed. Default and aggregate buckets are drained using DEFAULT_BUCKET_NAME and
+// AGGREGATE_BUCKET_NAME, and the global default bucket using GLOBAL_NAMESPACE. Dynamic buckets
+// aren't created. Returns ErrNoSuchBucket if the bucket doesn't exist.
+func (bc *BucketContainer) Drain(namespace, bucketName string) (int64, error) {
+	b := bc.existingBucket(namespace, bucketName)
+	if b == nil {
+		return 0, ErrNoSuchBucket
+	}
+
+	return b.Drain()
+}
+
+// Backfill atomically adds tokens to a bucket, up to its configured size, for example to restore
+// capacity consumed by requests that later failed. Borrowed tokens are paid off first. Buckets are
+// named as for Drain, and dynamic buckets aren't created. Returns ErrNonPositiveTokens if tokens
+// isn't positive, and ErrNoSuchBucket if the bucket doesn't exist.
+func (bc *BucketContainer) Backfill(namespace, bucketName string, tokens int64) error {
+	if tokens <= 0 {
+		return ErrNonPositiveTokens
+	}
+
+	b := bc.existingBucket(namespace, bucketName)
+	if b == nil {
+		return ErrNoSuchBucket
+	}
+
+	b.AddTokens(tokens)
+	return nil
+}
+
+// ServingConfig returns the config of the bucket that would serve requests for
+// namespace:bucketName, or nil if none would. Unlike FindBucket(), it doesn't create dynamic
+// buckets or report activity on the bucket, so it's cheap enough to consult before serving a
+// request. Buckets that don't exist yet are described by the namespace's DynamicBucketTemplate.
+func (bc *BucketContainer) ServingConfig(namespace, bucketName string) *configs.BucketConfig {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		if bc.defaultBucket == nil {
+			return nil
+		}
+		return bc.defaultBucket.Config()
+	}
+
+	ns.RLock()
+	b := ns.buckets[bucketName]
+	ns.RUnlock()
+
+	if b != nil {
+		return b.Config()
+	}
+
+	if ns.cfg.DynamicBucketTemplate != nil {
+		bCfg, _ := ns.bucketConfig(bucketName)
+		return bCfg
+	}
+
+	if ns.defaultBucket == nil {
+		return nil
+	}
+	return ns.defaultBucket.Config()
+}
+
+// existingBucket returns a bucket by name, without creating it. Default and aggregate buckets are
+// named using DEFAULT_BUCKET_NAME and AGGREGATE_BUCKET_NAME, and the global default bucket using
+// GLOBAL_NAMESPACE.
+func (bc *BucketContainer) existingBucket(namespace, bucketName string) Bucket {
+	if namespace == GLOBAL_NAMESPACE && bucketName == DEFAULT_BUCKET_NAME {
+		return bc.defaultBucket
+	}
+
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return nil
+	}
+
+	switch bucketName {
+	case DEFAULT_BUCKET_NAME:
+		return ns.defaultBucket
+	case AGGREGATE_BUCKET_NAME:
+		return ns.aggregateBucket
+	}
+
+	ns.RLock()
+	defer ns.RUnlock()
+	return ns.buckets[bucketName]
+}
+
 func (bc *BucketContainer) Exists(namespace, name string) bool {
-	return bc.namespaces[namespace] != nil && bc.namespaces[namespace].buckets[name] != nil
+	return bc.namespace(namespace) != nil && bc.namespace(namespace).buckets[name] != nil
 }
 
 func (bc *BucketContainer) String() string {
@@ -239,17 +1145,16 @@ func (bc *BucketContainer) String() string {
 		buffer.WriteString("Global default present\n\n")
 	}
 
-	sortedNamespaces := make([]string, len(bc.namespaces))
-	i := 0
-	for nsName, _ := range bc.namespaces {
-		sortedNamespaces[i] = nsName
-		i++
-	}
+	registry := bc.registry()
+	sortedNamespaces := make([]string, 0, registry.Len())
+	registry.Walk(func(nsName string, _ interface{}) {
+		sortedNamespaces = append(sortedNamespaces, nsName)
+	})
 
 	sort.Strings(sortedNamespaces)
 
 	for _, nsName := range sortedNamespaces{
-		ns := bc.namespaces[nsName]
+		ns := registry.Get(nsName).(*namespace)
 		buffer.WriteString(fmt.Sprintf(" * Namespace: %v\n", nsName))
 		if ns.defaultBucket != nil {
 			buffer.WriteString("   + Default present\n")
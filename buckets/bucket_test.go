@@ -5,24 +5,69 @@
 package buckets
 
 import (
+	"context"
 	"testing"
 	"github.com/maniksurtani/quotaservice/configs"
 	"time"
 	"strconv"
+	"sync"
+	"fmt"
+	"runtime"
+	"log"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"reflect"
+	"sync/atomic"
+	"strings"
+	"github.com/maniksurtani/quotaservice/logging"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"github.com/maniksurtani/quotaservice/scaling"
+	qspb "github.com/maniksurtani/quotaservice/protos"
 )
 
 // Mock objects
 type mockBucket struct {
 	namespace, bucketName string
 	dyn                   bool
+	cfg                   *configs.BucketConfig
+	tokens                int64
 }
 
 func (b *mockBucket) Take(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration) {
+	if numTokens > b.tokens {
+		return -1
+	}
+	b.tokens -= numTokens
 	return 0
 }
-func (b *mockBucket) Config() *configs.BucketConfig {
+func (b *mockBucket) AddTokens(numTokens int64) {
+	b.tokens += numTokens
+	if b.tokens > b.cfg.Size {
+		b.tokens = b.cfg.Size
+	}
+}
+func (b *mockBucket) AvailableTokens() int64 {
+	return b.tokens
+}
+func (b *mockBucket) Drain() (int64, error) {
+	drained := b.tokens
+	b.tokens = 0
+	return drained, nil
+}
+func (b *mockBucket) Tune(cfg *configs.BucketConfig) error {
+	b.tokens = b.tokens * cfg.Size / b.cfg.Size
+	b.cfg = cfg
+	return nil
+}
+func (b *mockBucket) TokenLevelHistory(since time.Time, resolution time.Duration) []TokenSnapshot {
 	return nil
 }
+func (b *mockBucket) Config() *configs.BucketConfig {
+	return b.cfg
+}
 func (b *mockBucket) ActivityDetected() bool {
 	return true
 }
@@ -33,11 +78,19 @@ func (b *mockBucket) Dynamic() bool {
 func (b *mockBucket) Destroy() {}
 
 
-type mockBucketFactory struct{}
+type mockBucketFactory struct {
+	readyErr error
+}
 
 func (bf mockBucketFactory) Init(cfg *configs.ServiceConfig) {}
+func (bf mockBucketFactory) Ready() bool {
+	return bf.readyErr == nil
+}
+func (bf mockBucketFactory) ReadyErr() error {
+	return bf.readyErr
+}
 func (bf mockBucketFactory) NewBucket(namespace string, bucketName string, cfg *configs.BucketConfig, dyn bool) Bucket {
-	return &mockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn}
+	return &mockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg, tokens: cfg.Size}
 }
 
 var cfg = func() *configs.ServiceConfig {
@@ -62,8 +115,24 @@ var cfg = func() *configs.ServiceConfig {
 
 var container = NewBucketContainer(cfg, &mockBucketFactory{})
 
+// newTestConfig creates a default service config, adjusted by each of configure in turn. Fixtures
+// are written as configure functions, so that tests can combine them.
+func newTestConfig(configure ...func(c *configs.ServiceConfig)) *configs.ServiceConfig {
+	c := configs.NewDefaultServiceConfig()
+	for _, f := range configure {
+		f(c)
+	}
+
+	return c
+}
+
+// newTestContainer creates a container of mock buckets for a config created by newTestConfig().
+func newTestContainer(configure ...func(c *configs.ServiceConfig)) *BucketContainer {
+	return NewBucketContainer(newTestConfig(configure...), &mockBucketFactory{})
+}
+
 func TestFallbackToGlobalDefaultBucket(t *testing.T) {
-	b := container.FindBucket("nonexistent_namespace", "nonexistent_bucket")
+	b, _ := container.FindBucket("nonexistent_namespace", "nonexistent_bucket")
 	if b == nil {
 		t.Fatal("Should fall back to default bucket.")
 	}
@@ -74,43 +143,43 @@ func TestFallbackToGlobalDefaultBucket(t *testing.T) {
 }
 
 func TestFallbackToDefaultBucket(t *testing.T) {
-	b := container.FindBucket("x", "nonexistent_bucket")
+	b, _ := container.FindBucket("x", "nonexistent_bucket")
 	if b == nil {
 		t.Fatal("Should fall back to default bucket.")
 	}
 
-	if b != container.namespaces["x"].defaultBucket {
+	if b != container.namespace("x").defaultBucket {
 		t.Fatal("Should fall back to default bucket.")
 	}
 }
 
 func TestDynamicBucket(t *testing.T) {
-	b := container.FindBucket("y", "new")
+	b, _ := container.FindBucket("y", "new")
 	if b == nil {
 		t.Fatal("Should create new bucket.")
 	}
 
-	if b != container.namespaces["y"].buckets["new"] {
+	if b != container.namespace("y").buckets["new"] {
 		t.Fatal("Should create new bucket.")
 	}
 }
 
 func TestBucketNamespaces(t *testing.T) {
-	bx := container.FindBucket("x", "a")
+	bx, _ := container.FindBucket("x", "a")
 	if bx == nil {
 		t.Fatal("Should create new bucket.")
 	}
 
-	if bx != container.namespaces["x"].buckets["a"] {
+	if bx != container.namespace("x").buckets["a"] {
 		t.Fatal("Should create new bucket.")
 	}
 
-	by := container.FindBucket("y", "a")
+	by, _ := container.FindBucket("y", "a")
 	if by == nil {
 		t.Fatal("Should create new bucket.")
 	}
 
-	if by != container.namespaces["y"].buckets["a"] {
+	if by != container.namespace("y").buckets["a"] {
 		t.Fatal("Should create new bucket.")
 	}
 
@@ -126,7 +195,7 @@ func TestMaxDynamic(t *testing.T) {
 	}
 
 	for i := 0; i < 5; i++ {
-		container.createNewNamedBucket("z", strconv.Itoa(i), container.namespaces["z"])
+		container.createNewNamedBucket("z", strconv.Itoa(i), container.namespace("z"))
 	}
 
 	c = container.countDynamicBuckets("z")
@@ -134,8 +203,2231 @@ func TestMaxDynamic(t *testing.T) {
 		t.Fatalf("Should have 5 dynamic buckets. Instead was %v", c)
 	}
 
-	b := container.createNewNamedBucket("z", "should_fail", container.namespaces["z"])
+	b := container.createNewNamedBucket("z", "should_fail", container.namespace("z"))
 	if b != nil {
 		t.Fatal("Should not have created dynamic bucket z:should_fail")
 	}
 }
+
+func donationConfig(c *configs.ServiceConfig) {
+	for _, nsName := range []string{"donor", "recipient", "stranger"} {
+		c.Namespaces[nsName] = configs.NewDefaultNamespaceConfig()
+		c.Namespaces[nsName].AggregateBucket = configs.NewDefaultBucketConfig()
+	}
+	c.Namespaces["recipient"].AcceptDonationsFrom = []string{"donor"}
+}
+
+func TestDonation(t *testing.T) {
+	bc := newTestContainer(donationConfig)
+	bc.AggregateBucket("recipient").Take(80, 0)
+
+	err := bc.DonateTokens("donor", "recipient", 50)
+	if err != nil {
+		t.Fatalf("Donation should have succeeded. Error: %v", err)
+	}
+
+	if tokens := bc.AggregateBucket("donor").(*mockBucket).tokens; tokens != 50 {
+		t.Fatalf("Donor should have 50 tokens left. Had %v", tokens)
+	}
+
+	if tokens := bc.AggregateBucket("recipient").(*mockBucket).tokens; tokens != 70 {
+		t.Fatalf("Recipient should have 70 tokens. Had %v", tokens)
+	}
+}
+
+func TestDonationDeniedByAllowlist(t *testing.T) {
+	bc := newTestContainer(donationConfig)
+
+	for _, donor := range []string{"stranger", "recipient"} {
+		recipient := "recipient"
+		if donor == recipient {
+			recipient = "donor"
+		}
+
+		err := bc.DonateTokens(donor, recipient, 10)
+		if err != ErrDonationNotAccepted {
+			t.Fatalf("Donation from %v to %v should not be accepted. Error: %v", donor, recipient, err)
+		}
+
+		if tokens := bc.AggregateBucket(donor).(*mockBucket).tokens; tokens != 100 {
+			t.Fatalf("Donor %v should still have 100 tokens. Had %v", donor, tokens)
+		}
+	}
+}
+
+func TestDonationFromExhaustedNamespace(t *testing.T) {
+	bc := newTestContainer(donationConfig)
+	bc.AggregateBucket("donor").Take(95, 0)
+	bc.AggregateBucket("recipient").Take(50, 0)
+
+	err := bc.DonateTokens("donor", "recipient", 10)
+	if err != ErrInsufficientTokens {
+		t.Fatalf("Donation should have failed with insufficient tokens. Error: %v", err)
+	}
+
+	if tokens := bc.AggregateBucket("donor").(*mockBucket).tokens; tokens != 5 {
+		t.Fatalf("Donor should still have 5 tokens. Had %v", tokens)
+	}
+
+	if tokens := bc.AggregateBucket("recipient").(*mockBucket).tokens; tokens != 50 {
+		t.Fatalf("Recipient should still have 50 tokens. Had %v", tokens)
+	}
+}
+
+func TestEventLogDisabled(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{})
+	bc.RecordEvent("x", "a", 1, EVENT_OK)
+
+	if events := bc.DumpEventLog(); events != nil {
+		t.Fatalf("Expecting no events. Was %+v", events)
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{}).WithEventLog(3)
+	bc.RecordEvent("x", "a", 1, EVENT_OK)
+	bc.RecordEvent("x", "a", 2, EVENT_OK_WAIT)
+
+	events := bc.DumpEventLog()
+	if len(events) != 2 || events[0].Tokens != 1 || events[1].Tokens != 2 {
+		t.Fatalf("Expecting 2 events, oldest first. Was %+v", events)
+	}
+
+	if events[1].Namespace != "x" || events[1].BucketName != "a" || events[1].Status != EVENT_OK_WAIT {
+		t.Fatalf("Unexpected event %+v", events[1])
+	}
+}
+
+func TestEventLogWrapsAround(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{}).WithEventLog(3)
+	for i := int64(1); i <= 7; i++ {
+		bc.RecordEvent("x", "a", i, EVENT_REJECTED)
+	}
+
+	events := bc.DumpEventLog()
+	if len(events) != 3 {
+		t.Fatalf("Expecting 3 events. Was %+v", events)
+	}
+
+	for i, e := range events {
+		if e.Tokens != int64(i + 5) {
+			t.Fatalf("Expecting the most recent events, oldest first. Was %+v", events)
+		}
+	}
+}
+
+// auditWriter collects the lines written to it, and blocks writes until unblocked, if block is set.
+type auditWriter struct {
+	lines chan string
+	block chan struct{}
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.block != nil {
+		<-w.block
+	}
+
+	w.lines <- string(p)
+	return len(p), nil
+}
+
+func auditedConfig(w *auditWriter, bufferSize int) func(c *configs.ServiceConfig) {
+	return func(c *configs.ServiceConfig) {
+		c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+		c.Namespaces["n"].AuditBufferSize = bufferSize
+		if w != nil {
+			c.Namespaces["n"].AuditWriter = w
+		}
+	}
+}
+
+func TestAuditWriter(t *testing.T) {
+	w := &auditWriter{lines: make(chan string, 10)}
+	bc := newTestContainer(auditedConfig(w, 0))
+	bc.RecordEvent("n", "a", 2, EVENT_OK_WAIT)
+	bc.RecordEvent("x", "a", 3, EVENT_OK)
+
+	select {
+	case line := <-w.lines:
+		if !strings.HasSuffix(line, `"namespace":"n","bucket":"a","tokens":2,"status":"OK_WAIT"}`+"\n") {
+			t.Fatalf("Unexpected audit line %v", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expecting the decision to be audited")
+	}
+
+	select {
+	case line := <-w.lines:
+		t.Fatalf("Expecting only decisions in the namespace to be audited. Was %v", line)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestAuditWriterOverflow(t *testing.T) {
+	w := &auditWriter{lines: make(chan string, 10), block: make(chan struct{})}
+	bc := newTestContainer(auditedConfig(w, 1))
+
+	// At most one decision is being written, and one buffered. The rest are dropped.
+	for i := 0; i < 5; i++ {
+		bc.RecordEvent("n", "a", 1, EVENT_REJECTED)
+	}
+
+	if overflows := bc.AuditOverflows("n"); overflows < 3 {
+		t.Fatalf("Expecting at least 3 decisions to be dropped. Was %v", overflows)
+	}
+
+	close(w.block)
+	for deadline := time.Now().Add(5 * time.Second); len(w.lines) + int(bc.AuditOverflows("n")) < 5; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting every decision to be written or dropped. %v written", len(w.lines))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAuditWriterStopped(t *testing.T) {
+	stopper := make(chan struct{})
+	a := &auditLog{writer: &auditWriter{lines: make(chan string, 10)}, lines: make(chan []byte, 1), stopper: stopper}
+	stopped := make(chan struct{})
+	go func() {
+		a.run()
+		close(stopped)
+	}()
+
+	close(stopper)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expecting the audit log to stop writing once stopped")
+	}
+}
+
+func TestAuditWriterDisabled(t *testing.T) {
+	bc := newTestContainer(auditedConfig(nil, 1))
+	for i := 0; i < 5; i++ {
+		bc.RecordEvent("n", "a", 1, EVENT_OK)
+	}
+
+	if ns := bc.namespace("n"); ns.audit != nil {
+		t.Fatal("Expecting no audit log without an AuditWriter")
+	}
+
+	if overflows := bc.AuditOverflows("n"); overflows != 0 {
+		t.Fatalf("Expecting no overflows. Was %v", overflows)
+	}
+}
+
+func hierarchyConfig(c *configs.ServiceConfig) {
+	for _, nsName := range []string{"product", "product.team", "product.team.service", "other"} {
+		c.Namespaces[nsName] = configs.NewDefaultNamespaceConfig()
+	}
+	c.Namespaces["product"].AggregateBucket = configs.NewDefaultBucketConfig()
+	c.Namespaces["product.team.service"].AggregateBucket = configs.NewDefaultBucketConfig()
+	c.Namespaces["product.team"].Parent = "product"
+	c.Namespaces["product.team.service"].Parent = "product.team"
+}
+
+func TestAggregateBuckets(t *testing.T) {
+	bc := newTestContainer(hierarchyConfig)
+
+	aggs := bc.AggregateBuckets("product.team.service")
+	if len(aggs) != 2 || aggs[0] != bc.AggregateBucket("product.team.service") || aggs[1] != bc.AggregateBucket("product") {
+		t.Fatalf("Expecting own aggregate bucket, followed by ancestor's. Was %+v", aggs)
+	}
+
+	if aggs := bc.AggregateBuckets("other"); len(aggs) != 0 {
+		t.Fatalf("Expecting no aggregate buckets. Was %+v", aggs)
+	}
+}
+
+func TestSetParent(t *testing.T) {
+	bc := newTestContainer(hierarchyConfig)
+
+	if err := bc.SetParent("other", "product.team"); err != nil {
+		t.Fatalf("Should be able to set parent. Error: %v", err)
+	}
+
+	if aggs := bc.AggregateBuckets("other"); len(aggs) != 1 || aggs[0] != bc.AggregateBucket("product") {
+		t.Fatalf("Expecting ancestor's aggregate bucket. Was %+v", aggs)
+	}
+
+	if err := bc.SetParent("other", ""); err != nil {
+		t.Fatalf("Should be able to remove parent. Error: %v", err)
+	}
+
+	if aggs := bc.AggregateBuckets("other"); len(aggs) != 0 {
+		t.Fatalf("Expecting no aggregate buckets. Was %+v", aggs)
+	}
+}
+
+func TestSetParentErrors(t *testing.T) {
+	bc := newTestContainer(hierarchyConfig)
+
+	if err := bc.SetParent("product", "product.team.service"); err == nil {
+		t.Fatal("Namespace should not be allowed to be its own ancestor")
+	}
+
+	if err := bc.SetParent("product", "product"); err == nil {
+		t.Fatal("Namespace should not be allowed to be its own parent")
+	}
+
+	if err := bc.SetParent("nonexistent", "product"); err == nil {
+		t.Fatal("Should not be able to set the parent of a nonexistent namespace")
+	}
+
+	if err := bc.SetParent("other", "nonexistent"); err == nil {
+		t.Fatal("Should not be able to set a nonexistent parent")
+	}
+}
+
+func lockingConfig(c *configs.ServiceConfig) {
+	c.Namespaces["locked"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["locked"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+}
+
+func TestLockNamespace(t *testing.T) {
+	bc := newTestContainer(lockingConfig)
+
+	if err := bc.LockNamespace("locked"); err != nil {
+		t.Fatalf("Should be able to lock namespace. Error: %v", err)
+	}
+
+	if b, err := bc.FindBucket("locked", "a"); b != nil || err != ErrNamespaceLocked {
+		t.Fatalf("Expecting ErrNamespaceLocked. Was %v, %v", b, err)
+	}
+
+	if !bc.IsNamespaceLocked("locked") {
+		t.Fatal("Namespace should be locked")
+	}
+
+	if err := bc.LockNamespace("nonexistent"); err != ErrNoSuchNamespace {
+		t.Fatalf("Expecting ErrNoSuchNamespace. Was %v", err)
+	}
+}
+
+func TestUnlockNamespace(t *testing.T) {
+	bc := newTestContainer(lockingConfig)
+	bc.LockNamespace("locked")
+
+	if err := bc.UnlockNamespace("locked"); err != nil {
+		t.Fatalf("Should be able to unlock namespace. Error: %v", err)
+	}
+
+	if b, err := bc.FindBucket("locked", "a"); b == nil || err != nil {
+		t.Fatalf("Expecting a bucket. Was %v, %v", b, err)
+	}
+
+	if bc.IsNamespaceLocked("locked") {
+		t.Fatal("Namespace should not be locked")
+	}
+}
+
+func TestConcurrentFindBucketDuringLock(t *testing.T) {
+	bc := newTestContainer(lockingConfig)
+	bc.LockNamespace("locked")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := bc.FindBucket("locked", strconv.Itoa(i)); err != ErrNamespaceLocked {
+				errs <- fmt.Errorf("Expecting ErrNamespaceLocked for bucket %v. Was %v", i, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if c := bc.countDynamicBuckets("locked"); c != 0 {
+		t.Fatalf("Expecting no buckets to be created in a locked namespace. Was %v", c)
+	}
+}
+
+func TestContainerReady(t *testing.T) {
+	if !container.Ready() {
+		t.Fatal("Expecting container to be ready")
+	}
+
+	notReady := NewBucketContainer(configs.NewDefaultServiceConfig(), &mockBucketFactory{readyErr: ErrFactoryNotInitialized})
+	if notReady.Ready() {
+		t.Fatal("Expecting container not to be ready")
+	}
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	if err := container.WaitUntilReady(context.Background()); err != nil {
+		t.Fatalf("Expecting a ready container not to wait. Was %v", err)
+	}
+
+	notReady := NewBucketContainer(cfg, &mockBucketFactory{readyErr: ErrFactoryNotInitialized})
+	if _, err := notReady.FindBucket(GLOBAL_NAMESPACE, "b"); err != ErrNotReady {
+		t.Fatalf("Expecting ErrNotReady finding buckets before the container is ready. Was %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*ReadyPollInterval)
+	defer cancel()
+	if err := notReady.WaitUntilReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expecting the wait to time out. Was %v", err)
+	}
+}
+
+// gatedBucketFactory isn't ready until opened.
+type gatedBucketFactory struct {
+	mockBucketFactory
+	open int32
+}
+
+func (bf *gatedBucketFactory) Ready() bool {
+	return atomic.LoadInt32(&bf.open) == 1
+}
+
+func TestWaitUntilBecomesReady(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	bf := &gatedBucketFactory{}
+	bc := NewBucketContainer(cfg, bf)
+
+	waited := make(chan error)
+	go func() { waited <- bc.WaitUntilReady(context.Background()) }()
+
+	select {
+	case err := <-waited:
+		t.Fatalf("Expecting the wait to block until the factory is ready. Was %v", err)
+	case <-time.After(2 * ReadyPollInterval):
+	}
+
+	atomic.StoreInt32(&bf.open, 1)
+	if err := <-waited; err != nil {
+		t.Fatalf("Expecting the wait to end once the factory is ready. Was %v", err)
+	}
+
+	if b, err := bc.FindBucket(GLOBAL_NAMESPACE, "b"); b == nil || err != nil {
+		t.Fatalf("Expecting the global default bucket once ready. Was %v, %v", b, err)
+	}
+}
+
+func TestCreateBucket(t *testing.T) {
+	bc := newTestContainer(healthConfig)
+	bCfg := &configs.BucketConfig{Size: 10}
+	if err := bc.CreateBucket("n", "new", bCfg); err != nil {
+		t.Fatalf("Expecting bucket to be created. Was %v", err)
+	}
+
+	b, _ := bc.FindBucket("n", "new")
+	if b == nil || b.Config() != bCfg || b.Dynamic() {
+		t.Fatalf("Expecting a named bucket. Was %v", b)
+	}
+
+	if bCfg.FillRate != 50 {
+		t.Fatalf("Expecting defaults to be applied. Was %+v", bCfg)
+	}
+
+	if err := bc.CreateBucket("n", "new", configs.NewDefaultBucketConfig()); err != ErrBucketExists {
+		t.Fatalf("Expecting ErrBucketExists. Was %v", err)
+	}
+
+	if err := bc.CreateBucket("nonexistent", "new", configs.NewDefaultBucketConfig()); err != ErrNoSuchNamespace {
+		t.Fatalf("Expecting ErrNoSuchNamespace. Was %v", err)
+	}
+
+	if err := bc.CreateBucket("n", "invalid", &configs.BucketConfig{Size: -1}); err == nil {
+		t.Fatal("Expecting invalid config to be rejected")
+	}
+}
+
+func TestPromoteDefaultToNamed(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DefaultBucket = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].DefaultBucket.Size = 20
+	c.Namespaces["n"].DefaultBucket.FillRate = 7
+	c.Namespaces["n"].Buckets["a"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["m"] = configs.NewDefaultNamespaceConfig()
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	if err := bc.PromoteDefaultToNamed("n", "vip"); err != nil {
+		t.Fatalf("Expecting the default bucket to be promoted. Was %v", err)
+	}
+
+	def, _ := bc.FindBucket("n", "unnamed")
+	vip, _ := bc.FindBucket("n", "vip")
+	if vip == def || vip.Dynamic() {
+		t.Fatalf("Expecting a named bucket. Was %v", vip)
+	}
+
+	if vip.Config() == def.Config() || !reflect.DeepEqual(vip.Config(), def.Config()) {
+		t.Fatalf("Expecting a copy of the default bucket's config. Was %+v", vip.Config())
+	}
+
+	// The buckets operate independently.
+	vip.Take(20, 0)
+	vip.Tune(&configs.BucketConfig{Size: 40, FillRate: 7})
+	if tokens := def.(TokenCounter).AvailableTokens(); tokens != 20 || def.Config().Size != 20 {
+		t.Fatalf("Expecting the default bucket to be unaffected. Had %v tokens, and config %+v", tokens, def.Config())
+	}
+
+	for _, test := range []struct {
+		namespace, name string
+		err             error
+	}{
+		{"n", "vip", ErrBucketExists},
+		{"n", "a", ErrBucketExists},
+		{"m", "vip", ErrNoDefaultBucket},
+		{"nonexistent", "vip", ErrNoSuchNamespace}} {
+		if err := bc.PromoteDefaultToNamed(test.namespace, test.name); err != test.err {
+			t.Fatalf("Expecting %v promoting to %v:%v. Was %v", test.err, test.namespace, test.name, err)
+		}
+	}
+}
+
+func TestConfigCacheInvalidatedOnCreate(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+	ns := bc.namespace("n")
+
+	if _, dyn := ns.bucketConfig("b"); !dyn {
+		t.Fatal("Expecting b to be dynamic")
+	}
+
+	bCfg := configs.NewDefaultBucketConfig()
+	if err := bc.CreateBucket("n", "b", bCfg); err != nil {
+		t.Fatalf("Expecting bucket to be created. Was %v", err)
+	}
+
+	if cached, dyn := ns.bucketConfig("b"); dyn || cached != bCfg {
+		t.Fatalf("Expecting the cached dynamic config to be invalidated. Was %v", cached)
+	}
+}
+
+// BenchmarkFindBucketMisses requests buckets from a namespace that is full of dynamic buckets, so
+// every request misses and looks up the bucket's config. 90% of requests are for the same 10
+// bucket names, out of 10,000.
+func BenchmarkFindBucketMisses(b *testing.B) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].MaxDynamicBuckets = 1
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+	bc.FindBucket("n", "occupied")
+
+	names := make([]string, 10000)
+	for i := range names {
+		names[i] = strconv.Itoa(i)
+	}
+
+	requests := make([]string, 1 << 16)
+	r := rand.New(rand.NewSource(1))
+	for i := range requests {
+		if r.Intn(10) < 9 {
+			requests[i] = names[r.Intn(10)]
+		} else {
+			requests[i] = names[r.Intn(len(names))]
+		}
+	}
+
+	// Misses are logged.
+	defer logging.SetLogger(logging.CurrentLogger())
+	logging.SetLogger(log.New(ioutil.Discard, "", 0))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bc.FindBucket("n", requests[i % len(requests)])
+	}
+	b.StopTimer()
+
+	b.ReportMetric(bc.namespace("n").cfgCache.hitRate(), "config-cache-hit-rate")
+}
+
+func newPolicyConfig() *configs.ServiceConfig {
+	c := configs.NewDefaultServiceConfig()
+	c.GlobalPolicy = &configs.RateLimitPolicy{
+		MaxIdleMillis:         1000,
+		MaxDynamicBuckets:     10,
+		DynamicBucketTemplate: configs.NewDefaultBucketConfig()}
+	c.GlobalPolicy.DynamicBucketTemplate.Size = 42
+	return c
+}
+
+func TestGlobalPolicyInherited(t *testing.T) {
+	c := newPolicyConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	ns := NewBucketContainer(c, &mockBucketFactory{}).namespace("n")
+
+	if ns.cfg.MaxDynamicBuckets != 10 {
+		t.Fatalf("Expecting max dynamic buckets to be inherited. Was %v", ns.cfg.MaxDynamicBuckets)
+	}
+
+	template := ns.cfg.DynamicBucketTemplate
+	if template == nil || template.Size != 42 || template.MaxIdleMillis != 1000 {
+		t.Fatalf("Expecting the dynamic bucket template to be inherited. Was %v", template)
+	}
+
+	if c.GlobalPolicy.DynamicBucketTemplate.MaxIdleMillis != -1 || c.Namespaces["n"].DynamicBucketTemplate != nil {
+		t.Fatal("Expecting configs not to be modified")
+	}
+}
+
+func TestGlobalPolicyPartiallyOverridden(t *testing.T) {
+	c := newPolicyConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].MaxDynamicBuckets = 3
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].DynamicBucketTemplate.MaxIdleMillis = 500
+	c.Namespaces["d"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["d"].DefaultBucket = configs.NewDefaultBucketConfig()
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	ns := bc.namespace("n")
+	if ns.cfg.MaxDynamicBuckets != 3 || ns.cfg.DynamicBucketTemplate.Size != 100 || ns.cfg.DynamicBucketTemplate.MaxIdleMillis != 500 {
+		t.Fatalf("Expecting the namespace's own settings to be used. Was %+v", ns.cfg)
+	}
+
+	if d := bc.namespace("d"); d.cfg.DynamicBucketTemplate != nil || d.cfg.MaxDynamicBuckets != 10 {
+		t.Fatalf("Expecting a namespace with a default bucket not to inherit a dynamic bucket template. Was %+v", d.cfg)
+	}
+}
+
+func TestNoGlobalPolicy(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	ns := NewBucketContainer(c, &mockBucketFactory{}).namespace("n")
+
+	if ns.cfg != c.Namespaces["n"] || ns.cfg.DynamicBucketTemplate != nil {
+		t.Fatalf("Expecting the namespace's config to be used as-is. Was %+v", ns.cfg)
+	}
+}
+
+func fallbackConfig(c *configs.ServiceConfig) {
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["user"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["user"].FallbackChain = []string{"n:account", "n:global"}
+	c.Namespaces["n"].Buckets["account"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["account"].FallbackChain = []string{"n:plan", "n:nonexistent"}
+	c.Namespaces["n"].Buckets["plan"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["global"] = configs.NewDefaultBucketConfig()
+}
+
+func TestFallbackBuckets(t *testing.T) {
+	bc := newTestContainer(fallbackConfig)
+	user, _ := bc.FindBucket("n", "user")
+
+	fallbacks := bc.FallbackBuckets(user)
+	expected := []Bucket{bc.namespace("n").buckets["account"], bc.namespace("n").buckets["plan"], bc.namespace("n").buckets["global"]}
+	if len(fallbacks) != len(expected) {
+		t.Fatalf("Expecting %v fallbacks. Was %v", len(expected), len(fallbacks))
+	}
+
+	for i := range expected {
+		if fallbacks[i] != expected[i] {
+			t.Fatalf("Expecting fallback %v to be %v. Was %v", i, expected[i], fallbacks[i])
+		}
+	}
+}
+
+func TestCyclicFallbackBuckets(t *testing.T) {
+	bc := newTestContainer(fallbackConfig)
+
+	// Introduce a cycle after the container has been created, bypassing config validation.
+	bc.namespace("n").buckets["plan"].Config().FallbackChain = []string{"n:user", "n:account"}
+	user, _ := bc.FindBucket("n", "user")
+
+	if fallbacks := bc.FallbackBuckets(user); len(fallbacks) != 3 {
+		t.Fatalf("Expecting each fallback to be visited once. Was %v", fallbacks)
+	}
+}
+
+func TestCostFunction(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{}).WithCostFunction(
+		func(namespace, bucketName string, metadata map[string]string) int64 {
+			size, _ := strconv.ParseInt(metadata["payload_bytes"], 10, 64)
+			return 1 + size / 1024
+		})
+
+	if cost := bc.TokenCost("x", "a", map[string]string{"payload_bytes": "4096"}, 1); cost != 5 {
+		t.Fatalf("Expecting a cost of 5 tokens. Was %v", cost)
+	}
+
+	if cost := bc.TokenCost("x", "a", nil, 3); cost != 3 {
+		t.Fatalf("Expecting requests without metadata to cost the tokens requested. Was %v", cost)
+	}
+}
+
+func TestBucketCostCalculator(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["bytes"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["bytes"].CostCalculator = func(meta map[string]string) int64 {
+		size, _ := strconv.ParseInt(meta["payload_bytes"], 10, 64)
+		return size
+	}
+	c.Namespaces["n"].Buckets["requests"] = configs.NewDefaultBucketConfig()
+	bc := NewBucketContainer(c, &mockBucketFactory{}).WithCostFunction(
+		func(namespace, bucketName string, metadata map[string]string) int64 {
+			return 7
+		})
+
+	meta := map[string]string{"payload_bytes": "4096"}
+	if cost := bc.TokenCost("n", "bytes", meta, 1); cost != 4096 {
+		t.Fatalf("Expecting the bucket's cost calculator to be used. Was %v", cost)
+	}
+
+	if cost := bc.TokenCost("n", "requests", meta, 1); cost != 7 {
+		t.Fatalf("Expecting the container's cost function to be used. Was %v", cost)
+	}
+}
+
+func TestNoCostFunction(t *testing.T) {
+	if cost := container.TokenCost("x", "a", map[string]string{"payload_bytes": "4096"}, 3); cost != 3 {
+		t.Fatalf("Expecting a cost of the tokens requested. Was %v", cost)
+	}
+}
+
+func healthConfig(c *configs.ServiceConfig) {
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["a"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["b"] = configs.NewDefaultBucketConfig()
+}
+
+func TestHealthy(t *testing.T) {
+	if report := newTestContainer(healthConfig).HealthReport(); !report.Healthy() {
+		t.Fatalf("Expecting a healthy report. Was %+v", report)
+	}
+}
+
+func TestWatchGoroutineNotRunning(t *testing.T) {
+	bc := newTestContainer(healthConfig)
+	delete(bc.namespace("n").watchers, "a")
+
+	report := bc.HealthReport()
+	if len(report.UnhealthyBuckets) != 1 || report.UnhealthyBuckets[0].BucketName != "a" ||
+		report.UnhealthyBuckets[0].Problem != "watch goroutine not running" {
+		t.Fatalf("Expecting bucket a not to be watched. Was %+v", report)
+	}
+}
+
+func TestLowTokens(t *testing.T) {
+	bc := newTestContainer(healthConfig)
+	b, _ := bc.FindBucket("n", "b")
+	b.Take(100, 0)
+
+	// The bucket has only just been found to be low on tokens.
+	if report := bc.HealthReport(); !report.Healthy() {
+		t.Fatalf("Expecting a healthy report. Was %+v", report)
+	}
+
+	bc.health.lowTokensSince[b] = time.Now().Add(-2 * LowTokensDuration)
+	report := bc.HealthReport()
+	if len(report.UnhealthyBuckets) != 1 || report.UnhealthyBuckets[0].BucketName != "b" {
+		t.Fatalf("Expecting bucket b to be low on tokens. Was %+v", report)
+	}
+
+	b.AddTokens(100)
+	if report := bc.HealthReport(); !report.Healthy() {
+		t.Fatalf("Expecting a healthy report once refilled. Was %+v", report)
+	}
+}
+
+func TestMemoryPressure(t *testing.T) {
+	heapInuse := uint64(2000)
+	bc := newTestContainer().withMemoryPressureAdaptation(1000, 0.5, func(stats *runtime.MemStats) {
+		stats.HeapInuse = atomic.LoadUint64(&heapInuse)
+	})
+	defer bc.Stop()
+	bc.pressure.check()
+
+	if tokens := bc.AdaptTokens(10); tokens != 5 {
+		t.Fatalf("Expecting grants to be halved. Was %v", tokens)
+	}
+
+	if tokens := bc.AdaptTokens(1); tokens != 1 {
+		t.Fatalf("Expecting at least 1 token to be granted. Was %v", tokens)
+	}
+
+	atomic.StoreUint64(&heapInuse, 500)
+	bc.pressure.check()
+	if tokens := bc.AdaptTokens(10); tokens != 10 {
+		t.Fatalf("Expecting full grants once pressure is relieved. Was %v", tokens)
+	}
+}
+
+func TestStopStopsBackgroundGoroutines(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{})
+	stopped := make(chan struct{})
+	go func() {
+		bc.every(time.Millisecond, func() {})
+		close(stopped)
+	}()
+
+	bc.Stop()
+	// Stopping is idempotent.
+	bc.Stop()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expecting background goroutines to stop")
+	}
+}
+
+func TestNoMemoryPressureAdaptation(t *testing.T) {
+	if tokens := container.AdaptTokens(10); tokens != 10 {
+		t.Fatalf("Expecting full grants. Was %v", tokens)
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	bc := newTestContainer(lockingConfig)
+	existing, _ := bc.FindBucket("locked", "existing")
+
+	if err := bc.Quiesce(); err != nil {
+		t.Fatalf("Should be able to quiesce. Error: %v", err)
+	}
+
+	if !bc.IsQuiesced() {
+		t.Fatal("Container should be quiesced")
+	}
+
+	if err := bc.Quiesce(); err != ErrAlreadyQuiesced {
+		t.Fatalf("Expecting ErrAlreadyQuiesced. Was %v", err)
+	}
+
+	if b, _ := bc.FindBucket("locked", "new"); b != nil {
+		t.Fatal("Should not create dynamic buckets while quiesced")
+	}
+
+	if b, _ := bc.FindBucket("locked", "existing"); b != existing {
+		t.Fatalf("Existing buckets should still be found while quiesced. Was %v", b)
+	}
+}
+
+func TestUnquiesce(t *testing.T) {
+	bc := newTestContainer(lockingConfig)
+	if err := bc.Unquiesce(); err != ErrNotQuiesced {
+		t.Fatalf("Expecting ErrNotQuiesced. Was %v", err)
+	}
+
+	bc.Quiesce()
+	if err := bc.Unquiesce(); err != nil {
+		t.Fatalf("Should be able to unquiesce. Error: %v", err)
+	}
+
+	if bc.IsQuiesced() {
+		t.Fatal("Container should not be quiesced")
+	}
+
+	if b, _ := bc.FindBucket("locked", "new"); b == nil {
+		t.Fatal("Should create dynamic buckets once unquiesced")
+	}
+}
+
+// countingBucket is a thread-safe mockBucket that counts calls to Take(), and makes requests it
+// grants wait for wait.
+type countingBucket struct {
+	mockBucket
+	takes int64
+	wait  time.Duration
+	sync.Mutex
+}
+
+func (b *countingBucket) Take(numTokens int64, maxWaitTime time.Duration) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.takes++
+	if w := b.mockBucket.Take(numTokens, maxWaitTime); w < 0 {
+		return w
+	}
+	return b.wait
+}
+
+type countingBucketFactory struct {
+	mockBucketFactory
+}
+
+func (bf countingBucketFactory) NewBucket(namespace string, bucketName string, cfg *configs.BucketConfig, dyn bool) Bucket {
+	return &countingBucket{mockBucket: mockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg, tokens: cfg.Size}}
+}
+
+func newSmoothingContainer(size int64) *BucketContainer {
+	return NewBucketContainer(newTestConfig(func(c *configs.ServiceConfig) {
+		c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+		c.Namespaces["n"].Buckets["b"] = configs.NewDefaultBucketConfig()
+		c.Namespaces["n"].Buckets["b"].Size = size
+	}), countingBucketFactory{})
+}
+
+func smoothedTakes(s *SmoothedBucketContainer, n int) []time.Duration {
+	waits := make([]time.Duration, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			waits[i], _ = s.Take("n", "b", 1, 0)
+		}(i)
+	}
+	wg.Wait()
+	return waits
+}
+
+func TestSmoothedBucketContainerBatches(t *testing.T) {
+	bc := newSmoothingContainer(1000)
+	s := NewSmoothedBucketContainer(bc, 50000)
+	for _, wait := range smoothedTakes(s, 100) {
+		if wait != 0 {
+			t.Fatalf("Expecting all requests to be granted. Wait was %v", wait)
+		}
+	}
+
+	b, _ := bc.FindBucket("n", "b")
+	if takes := b.(*countingBucket).takes; takes >= 100 {
+		t.Fatalf("Expecting requests to be batched. Took %v times", takes)
+	}
+
+	if tokens := b.(*countingBucket).tokens; tokens != 900 {
+		t.Fatalf("Expecting 100 tokens to be taken. %v left", tokens)
+	}
+}
+
+func TestSmoothedBucketContainerWaits(t *testing.T) {
+	bc := newSmoothingContainer(1000)
+	s := NewSmoothedBucketContainer(bc, 50000)
+	b, _ := bc.FindBucket("n", "b")
+	b.(*countingBucket).wait = 100 * time.Millisecond
+
+	// No request in a batch waits less than the batch does.
+	for _, wait := range smoothedTakes(s, 100) {
+		if wait != 100*time.Millisecond {
+			t.Fatalf("Expecting every request to wait 100ms. Wait was %v", wait)
+		}
+	}
+}
+
+func TestSmoothedBucketContainerPartialBatch(t *testing.T) {
+	bc := newSmoothingContainer(10)
+	s := NewSmoothedBucketContainer(bc, 50000)
+	granted := 0
+	for _, wait := range smoothedTakes(s, 20) {
+		if wait >= 0 {
+			granted++
+		}
+	}
+
+	if granted != 10 {
+		t.Fatalf("Expecting requests that fit to be granted individually. Granted %v", granted)
+	}
+}
+
+func TestSmoothedBucketContainerNoSuchBucket(t *testing.T) {
+	s := NewSmoothedBucketContainer(newSmoothingContainer(10), 100)
+	if _, err := s.Take("n", "nonexistent", 1, 0); err != ErrNoSuchBucket {
+		t.Fatalf("Expecting ErrNoSuchBucket. Was %v", err)
+	}
+}
+
+func benchmarkTakes(b *testing.B, smoothed bool) {
+	bc := newSmoothingContainer(math.MaxInt64)
+	s := NewSmoothedBucketContainer(bc, 100)
+	bucket, _ := bc.FindBucket("n", "b")
+
+	b.SetParallelism(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if smoothed {
+				s.Take("n", "b", 1, 0)
+			} else {
+				bucket.Take(1, 0)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(bucket.(*countingBucket).takes)/float64(b.N), "takes/op")
+}
+
+func BenchmarkUnsmoothedTakes(b *testing.B) {
+	benchmarkTakes(b, false)
+}
+
+// BenchmarkSmoothedTakes shows the reduction in calls to Take(), each of which would be a
+// round-trip to Redis, under high concurrency.
+func BenchmarkSmoothedTakes(b *testing.B) {
+	benchmarkTakes(b, true)
+}
+
+type mockFeedbackSource struct {
+	errorRate float64
+}
+
+func (m *mockFeedbackSource) ErrorRate() float64 {
+	return m.errorRate
+}
+
+func feedbackConfig(c *configs.ServiceConfig) {
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["b"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["b"].FillRate = 100
+	c.Namespaces["n"].FeedbackReductionFactor = 0.25
+	c.Namespaces["n"].FeedbackErrorRateThreshold = 0.1
+	c.Namespaces["unconfigured"] = configs.NewDefaultNamespaceConfig()
+}
+
+func TestFeedbackReducesFillRate(t *testing.T) {
+	bc := newTestContainer(feedbackConfig)
+	source := &mockFeedbackSource{}
+	f, err := bc.newFeedback("n", source)
+	if err != nil {
+		t.Fatalf("Unable to register feedback source: %v", err)
+	}
+
+	b, _ := bc.FindBucket("n", "b")
+	f.check()
+	if b.Config().FillRate != 100 {
+		t.Fatalf("Fill rate should not be reduced while healthy. Was %v", b.Config().FillRate)
+	}
+
+	source.errorRate = 0.5
+	f.check()
+	f.check()
+	if b.Config().FillRate != 25 {
+		t.Fatalf("Expecting fill rate to be reduced once to 25. Was %v", b.Config().FillRate)
+	}
+
+	source.errorRate = 0
+	f.check()
+	if b.Config().FillRate != 100 {
+		t.Fatalf("Expecting fill rate to be restored. Was %v", b.Config().FillRate)
+	}
+}
+
+func TestFeedbackForgetsRemovedBuckets(t *testing.T) {
+	bc := newTestContainer(feedbackConfig)
+	source := &mockFeedbackSource{errorRate: 0.5}
+	f, err := bc.newFeedback("n", source)
+	if err != nil {
+		t.Fatalf("Unable to register feedback source: %v", err)
+	}
+
+	b, _ := bc.FindBucket("n", "b")
+	f.check()
+	if b.Config().FillRate != 25 {
+		t.Fatalf("Expecting fill rate to be reduced to 25. Was %v", b.Config().FillRate)
+	}
+
+	ns := bc.namespace("n")
+	ns.Lock()
+	ns.evict("b")
+	ns.Unlock()
+
+	source.errorRate = 0
+	f.check()
+	if b.Config().FillRate != 25 {
+		t.Fatalf("Removed bucket should not be restored. Was %v", b.Config().FillRate)
+	}
+
+	if len(ns.modifiers.modified) != 0 {
+		t.Fatalf("Expecting removed buckets to be forgotten. Was %v", ns.modifiers.modified)
+	}
+}
+
+func TestFeedbackDuringGracePeriod(t *testing.T) {
+	bc := newTestContainer(feedbackConfig)
+	source := &mockFeedbackSource{}
+	f, err := bc.newFeedback("n", source)
+	if err != nil {
+		t.Fatalf("Unable to register feedback source: %v", err)
+	}
+
+	b, _ := bc.FindBucket("n", "b")
+	expectFillRate := func(expected int64, when string) {
+		if b.Config().FillRate != expected {
+			t.Fatalf("Expecting fill rate %v %v. Was %v", expected, when, b.Config().FillRate)
+		}
+	}
+
+	if err := bc.EnterGracePeriod("n", 2, time.Hour); err != nil {
+		t.Fatalf("Unable to enter grace period: %v", err)
+	}
+	expectFillRate(200, "during the grace period")
+
+	source.errorRate = 0.5
+	f.check()
+	expectFillRate(50, "with both the grace period and feedback")
+
+	ns := bc.namespace("n")
+	ns.RLock()
+	g := ns.grace
+	ns.RUnlock()
+	bc.endGracePeriod("n", ns, g)
+	expectFillRate(25, "once the grace period ends")
+
+	source.errorRate = 0
+	f.check()
+	expectFillRate(100, "once feedback recovers")
+}
+
+func TestFeedbackAfterRename(t *testing.T) {
+	bc := newTestContainer(feedbackConfig)
+	source := &mockFeedbackSource{errorRate: 0.5}
+	f, err := bc.newFeedback("n", source)
+	if err != nil {
+		t.Fatalf("Unable to register feedback source: %v", err)
+	}
+
+	if err := bc.RenameNamespace("n", "m"); err != nil {
+		t.Fatalf("Unable to rename namespace: %v", err)
+	}
+
+	// Polling follows the namespace to its new name.
+	f.check()
+	b, _ := bc.FindBucket("m", "b")
+	if b.Config().FillRate != 25 {
+		t.Fatalf("Expecting fill rate to be reduced to 25 after the rename. Was %v", b.Config().FillRate)
+	}
+}
+
+func TestRegisterFeedbackSourceErrors(t *testing.T) {
+	bc := newTestContainer(feedbackConfig)
+	if err := bc.RegisterFeedbackSource("nonexistent", &mockFeedbackSource{}); err != ErrNoSuchNamespace {
+		t.Fatalf("Expecting ErrNoSuchNamespace. Was %v", err)
+	}
+
+	if err := bc.RegisterFeedbackSource("unconfigured", &mockFeedbackSource{}); err == nil {
+		t.Fatal("Expecting an error for a namespace without a feedback_reduction_factor")
+	}
+}
+
+func TestTrieNamespaceRegistry(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{}).WithTrieNamespaceRegistry()
+	if bc.registry().Len() != len(cfg.Namespaces) {
+		t.Fatalf("Expecting %v namespaces. Was %v", len(cfg.Namespaces), bc.registry().Len())
+	}
+
+	b, _ := bc.FindBucket("y", "a")
+	if b == nil || b != bc.namespace("y").buckets["a"] {
+		t.Fatalf("Expecting bucket y:a to be found. Was %v", b)
+	}
+
+	if b, _ := bc.FindBucket("nonexistent", "a"); b != bc.defaultBucket {
+		t.Fatalf("Expecting the global default bucket for unknown namespaces. Was %v", b)
+	}
+}
+
+// activityBucket is a mockBucket that counts reported activity.
+type activityBucket struct {
+	mockBucket
+	reported int
+}
+
+func (b *activityBucket) ReportActivity() {
+	b.reported++
+}
+
+type activityBucketFactory struct {
+	mockBucketFactory
+}
+
+func (bf activityBucketFactory) NewBucket(namespace string, bucketName string, cfg *configs.BucketConfig, dyn bool) Bucket {
+	return &activityBucket{mockBucket: mockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg, tokens: cfg.Size}}
+}
+
+func TestPeekBucket(t *testing.T) {
+	bc := NewBucketContainer(cfg, activityBucketFactory{})
+	view := bc.ReadOnlyView()
+	b := bc.namespace("y").buckets["a"].(*activityBucket)
+	b.Take(10, 0)
+	reported := b.reported
+
+	tokens, err := view.PeekBucket("y", "a")
+	if err != nil || tokens != b.cfg.Size-10 {
+		t.Fatalf("Expecting %v tokens. Was %v, %v", b.cfg.Size-10, tokens, err)
+	}
+
+	if b.reported != reported {
+		t.Fatal("Peeking should not report activity")
+	}
+
+	if _, err := view.PeekBucket("y", "not_created"); err != ErrNoSuchBucket {
+		t.Fatalf("Expecting ErrNoSuchBucket. Was %v", err)
+	}
+
+	if bc.Exists("y", "not_created") {
+		t.Fatal("Peeking should not create dynamic buckets")
+	}
+
+	if tokens, err := view.PeekBucket("x", "anything"); err != nil || tokens != bc.namespace("x").defaultBucket.(*activityBucket).tokens {
+		t.Fatalf("Expecting the namespace default bucket's tokens. Was %v, %v", tokens, err)
+	}
+}
+
+func TestReadOnlyFindBucket(t *testing.T) {
+	bc := NewBucketContainer(cfg, activityBucketFactory{})
+	b := bc.namespace("y").buckets["a"].(*activityBucket)
+	reported := b.reported
+
+	if found, _ := bc.ReadOnlyView().FindBucket("y", "a"); found != b {
+		t.Fatalf("Expecting bucket y:a. Was %v", found)
+	}
+
+	if b.reported != reported+1 {
+		t.Fatal("FindBucket should report activity")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["a"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["b"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].DynamicBucketTemplate.FillRate = 10
+	c.Namespaces["m"] = configs.NewDefaultNamespaceConfig()
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	a, _ := bc.FindBucket("n", "a")
+	a.Take(100, 0)
+	d, _ := bc.FindBucket("n", "d")
+	d.Take(50, 0)
+
+	expected := "namespace | total_rate | utilisation% | dynamic_count | exhausted_count\n" +
+		"m | 0 | - | 0 | 0\n" +
+		"n | 110 | 50.0% | 1 | 1\n"
+	if summary := bc.Summary(); summary != expected {
+		t.Fatalf("Expecting summary\n%v\nWas\n%v", expected, summary)
+	}
+}
+
+func TestTotalRate(t *testing.T) {
+	bc := NewBucketContainer(configs.NewDefaultServiceConfig(), &mockBucketFactory{})
+	if rate := bc.TotalRate(); rate != 0 {
+		t.Fatalf("Expecting an empty container to have no rate. Was %v", rate)
+	}
+
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DefaultBucket = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].AggregateBucket = configs.NewDefaultBucketConfig()
+	for name, rate := range map[string]int64{"a": 10, "b": 20} {
+		c.Namespaces["n"].Buckets[name] = configs.NewDefaultBucketConfig()
+		c.Namespaces["n"].Buckets[name].FillRate = rate
+	}
+	bc = NewBucketContainer(c, &mockBucketFactory{})
+
+	if rate := bc.TotalRate(); rate != 30 {
+		t.Fatalf("Expecting a total rate of 30. Was %v", rate)
+	}
+
+	if rate := bc.NamespaceRate("n"); rate != 30 {
+		t.Fatalf("Expecting a namespace rate of 30. Was %v", rate)
+	}
+}
+
+func TestTotalRateWithDynamicBuckets(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["a"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["a"].FillRate = 10
+	c.Namespaces["m"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["m"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	c.Namespaces["m"].DynamicBucketTemplate.FillRate = 5
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	if rate := bc.NamespaceRate("m"); rate != 0 {
+		t.Fatalf("Expecting no rate before dynamic buckets are created. Was %v", rate)
+	}
+
+	for _, name := range []string{"x", "y", "z"} {
+		bc.FindBucket("m", name)
+	}
+
+	for namespace, expected := range map[string]float64{"n": 10, "m": 15, "nonexistent": 0} {
+		if rate := bc.NamespaceRate(namespace); rate != expected {
+			t.Fatalf("Expecting namespace %v to have rate %v. Was %v", namespace, expected, rate)
+		}
+	}
+
+	if rate := bc.TotalRate(); rate != 25 {
+		t.Fatalf("Expecting a total rate of 25. Was %v", rate)
+	}
+}
+
+func TestSummaryWhileFindingBuckets(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			bc.FindBucket("n", strconv.Itoa(i))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		bc.Summary()
+	}
+	wg.Wait()
+}
+
+func TestDrain(t *testing.T) {
+	bc := newTestContainer(healthConfig)
+	b, _ := bc.FindBucket("n", "a")
+	b.Take(30, 0)
+
+	if drained, err := bc.Drain("n", "a"); err != nil || drained != 70 {
+		t.Fatalf("Expecting 70 tokens drained. Was %v, %v", drained, err)
+	}
+
+	if drained, err := bc.Drain(GLOBAL_NAMESPACE, DEFAULT_BUCKET_NAME); err != nil || drained != 100 {
+		t.Fatalf("Expecting the global default bucket to be drained. Was %v, %v", drained, err)
+	}
+
+	if _, err := bc.Drain("n", "nonexistent"); err != ErrNoSuchBucket {
+		t.Fatalf("Expecting ErrNoSuchBucket. Was %v", err)
+	}
+}
+
+func TestBackfillBelowCap(t *testing.T) {
+	bc := newTestContainer(healthConfig)
+	b, _ := bc.FindBucket("n", "a")
+	b.Take(30, 0)
+
+	if err := bc.Backfill("n", "a", 20); err != nil {
+		t.Fatalf("Expecting no error. Was %v", err)
+	}
+
+	if tokens := b.(TokenCounter).AvailableTokens(); tokens != 90 {
+		t.Fatalf("Expecting 90 tokens. Was %v", tokens)
+	}
+}
+
+func TestBackfillAtCap(t *testing.T) {
+	bc := newTestContainer(healthConfig)
+	b, _ := bc.FindBucket("n", "a")
+	b.Take(30, 0)
+
+	if err := bc.Backfill("n", "a", 50); err != nil {
+		t.Fatalf("Expecting no error. Was %v", err)
+	}
+
+	if tokens := b.(TokenCounter).AvailableTokens(); tokens != 100 {
+		t.Fatalf("Expecting tokens capped at 100. Was %v", tokens)
+	}
+
+	if err := bc.Backfill("n", "nonexistent", 10); err != ErrNoSuchBucket {
+		t.Fatalf("Expecting ErrNoSuchBucket. Was %v", err)
+	}
+}
+
+func TestBackfillNegativeTokens(t *testing.T) {
+	bc := newTestContainer(healthConfig)
+	b, _ := bc.FindBucket("n", "a")
+	b.Take(30, 0)
+
+	for _, tokens := range []int64{-10, 0} {
+		if err := bc.Backfill("n", "a", tokens); err != ErrNonPositiveTokens {
+			t.Fatalf("Expecting ErrNonPositiveTokens for %v tokens. Was %v", tokens, err)
+		}
+	}
+
+	if tokens := b.(TokenCounter).AvailableTokens(); tokens != 70 {
+		t.Fatalf("Expecting 70 tokens. Was %v", tokens)
+	}
+}
+
+func TestFindBucketTraced(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.GlobalDefaultBucket = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DefaultBucket = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["a"] = configs.NewDefaultBucketConfig()
+	withGlobalDefault := NewBucketContainer(c, &mockBucketFactory{})
+
+	c = configs.NewDefaultServiceConfig()
+	c.GlobalDefaultBucket = nil
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	withoutGlobalDefault := NewBucketContainer(c, &mockBucketFactory{})
+
+	for _, test := range []struct {
+		bc              *BucketContainer
+		namespace, name string
+		trace           string
+	}{
+		{withGlobalDefault, "n", "a", "looked up namespace n;found bucket a"},
+		{withGlobalDefault, "n", "x", "looked up namespace n;found no named bucket x;fell back to namespace default bucket"},
+		{withGlobalDefault, "x", "a", "found no namespace x;fell back to global default bucket"},
+		{withoutGlobalDefault, "x", "a", "found no namespace x;found no global default bucket"},
+		{withoutGlobalDefault, "n", "x", "looked up namespace n;found no named bucket x;found no namespace default bucket"}} {
+		var trace strings.Builder
+		test.bc.FindBucketTraced(test.namespace, test.name, &trace)
+		if trace.String() != test.trace {
+			t.Fatalf("Expecting trace %q for %v:%v. Was %q", test.trace, test.namespace, test.name, trace.String())
+		}
+	}
+}
+
+func coldStartConfig(coldStarts chan string) func(c *configs.ServiceConfig) {
+	onColdStart := func(namespace, bucket string) {
+		coldStarts <- FullyQualifiedName(namespace, bucket)
+	}
+
+	return func(c *configs.ServiceConfig) {
+		c.Namespaces["dyn"] = configs.NewDefaultNamespaceConfig()
+		c.Namespaces["dyn"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+		c.Namespaces["dyn"].OnColdStart = onColdStart
+		c.Namespaces["def"] = configs.NewDefaultNamespaceConfig()
+		c.Namespaces["def"].DefaultBucket = configs.NewDefaultBucketConfig()
+		c.Namespaces["def"].OnColdStart = onColdStart
+	}
+}
+
+// expectColdStarts fails unless exactly the cold starts expected are reported, in any order.
+func expectColdStarts(t *testing.T, coldStarts chan string, expected ...string) {
+	remaining := make(map[string]int)
+	for _, e := range expected {
+		remaining[e]++
+	}
+
+	for range expected {
+		select {
+		case c := <-coldStarts:
+			if remaining[c] == 0 {
+				t.Fatalf("Unexpected cold start of %v", c)
+			}
+			remaining[c]--
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting cold starts %v", remaining)
+		}
+	}
+
+	select {
+	case c := <-coldStarts:
+		t.Fatalf("Unexpected cold start of %v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestColdStart(t *testing.T) {
+	coldStarts := make(chan string, 10)
+	bc := newTestContainer(coldStartConfig(coldStarts))
+
+	for i := 0; i < 3; i++ {
+		bc.FindBucket("dyn", "a")
+		bc.FindBucket("dyn", "b")
+		bc.FindBucket("def", strconv.Itoa(i))
+	}
+
+	// Requests served by a default bucket are reported against it.
+	expectColdStarts(t, coldStarts, "dyn:a", "dyn:b", "def:"+DEFAULT_BUCKET_NAME)
+
+	// Pretend a has been idle.
+	cs := bc.namespace("dyn").coldStarts
+	cs.Lock()
+	cs.lastRequested["a"] = time.Now().Add(-DefaultColdStartIdle)
+	cs.Unlock()
+
+	bc.FindBucket("dyn", "a")
+	bc.FindBucket("dyn", "a")
+	bc.FindBucket("dyn", "b")
+	expectColdStarts(t, coldStarts, "dyn:a")
+}
+
+func TestNoColdStartHook(t *testing.T) {
+	if ns := newTestContainer(lockingConfig).namespace("locked"); ns.coldStarts != nil {
+		t.Fatal("Not expecting cold starts to be tracked without a hook")
+	}
+}
+
+func TestDynamicBucketMemoryLimit(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].Buckets["named"] = configs.NewDefaultBucketConfig()
+	perBucket := estimatedMemory("a", c.Namespaces["n"].DynamicBucketTemplate)
+	c.Namespaces["n"].MaxDynamicBucketMemoryBytes = 3 * perBucket
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	for _, name := range []string{"a", "b", "c"} {
+		bc.FindBucket("n", name)
+	}
+
+	if usage := bc.DynamicBucketMemoryUsage("n"); usage != 3*perBucket {
+		t.Fatalf("Expecting %v bytes used by dynamic buckets. Was %v", 3*perBucket, usage)
+	}
+
+	// a becomes more recently used than b, so b is evicted first.
+	bc.FindBucket("n", "a")
+	bc.FindBucket("n", "d")
+	if bc.Exists("n", "b") || !bc.Exists("n", "a") || !bc.Exists("n", "c") || !bc.Exists("n", "d") {
+		t.Fatalf("Expecting b to be evicted. Buckets: %v", bc)
+	}
+
+	bc.FindBucket("n", "e")
+	if bc.Exists("n", "c") || !bc.Exists("n", "named") {
+		t.Fatalf("Expecting c to be evicted, and named buckets to be kept. Buckets: %v", bc)
+	}
+
+	if usage := bc.DynamicBucketMemoryUsage("n"); usage != 3*perBucket {
+		t.Fatalf("Expecting usage to stay within the limit. Was %v", usage)
+	}
+}
+
+func TestDynamicBucketTooLarge(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].MaxDynamicBucketMemoryBytes = 1
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	if b, _ := bc.FindBucket("n", "a"); b != nil || bc.DynamicBucketMemoryUsage("n") != 0 {
+		t.Fatalf("Not expecting buckets larger than the limit to be created. Was %v", b)
+	}
+}
+
+func TestRateOfWithoutActivity(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{})
+	if rate := bc.RateOf("x", "a", time.Minute); rate != 0 {
+		t.Fatalf("Expecting a rate of 0. Was %v", rate)
+	}
+
+	start := time.Unix(1000, 0)
+	c := newRateCounter(start)
+	c.record(start)
+	if rate := c.rate(start.Add(30*time.Second), 10*time.Second); rate != 0 {
+		t.Fatalf("Expecting a rate of 0 once quiet. Was %v", rate)
+	}
+}
+
+func TestRateOfConstantRate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := newRateCounter(start)
+	for s := 0; s < 30; s++ {
+		for i := 0; i < 10; i++ {
+			c.record(start.Add(time.Duration(s)*time.Second + time.Duration(i)*100*time.Millisecond))
+		}
+	}
+
+	now := start.Add(29 * time.Second)
+	for _, window := range []time.Duration{time.Second, 10 * time.Second, time.Hour} {
+		if rate := c.rate(now, window); rate != 10 {
+			t.Fatalf("Expecting a rate of 10 over %v. Was %v", window, rate)
+		}
+	}
+}
+
+func TestRateOfBurstThenQuiet(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := newRateCounter(start)
+	for i := 0; i < 120; i++ {
+		c.record(start)
+	}
+
+	// Only 6 seconds of history are available.
+	if rate := c.rate(start.Add(5*time.Second), time.Minute); rate != 20 {
+		t.Fatalf("Expecting a rate of 20. Was %v", rate)
+	}
+
+	if rate := c.rate(start.Add(20*time.Second), 10*time.Second); rate != 0 {
+		t.Fatalf("Expecting a rate of 0 after the burst. Was %v", rate)
+	}
+
+	// The burst falls out of the history.
+	if rate := c.rate(start.Add(RateHistory+time.Second), RateHistory); rate != 0 {
+		t.Fatalf("Expecting the burst to be forgotten. Was %v", rate)
+	}
+}
+
+func TestRateOf(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{})
+	for i := 0; i < 5; i++ {
+		bc.RecordEvent("x", "a", 1, EVENT_OK)
+	}
+
+	// The events may straddle a second.
+	if rate := bc.RateOf("x", "a", 2*time.Second); rate < 2.5 || rate > 5 {
+		t.Fatalf("Expecting a rate of up to 5. Was %v", rate)
+	}
+
+	if rate := bc.RateOf("x", "b", time.Second); rate != 0 {
+		t.Fatalf("Expecting no rate for other buckets. Was %v", rate)
+	}
+}
+
+func aliasConfig(c *configs.ServiceConfig) {
+	c.Namespaces["payments.v2"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["payments.v2"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	c.NamespaceAliases = map[string]string{"payments": "payments.v2"}
+}
+
+func TestAliasResolution(t *testing.T) {
+	bc := newTestContainer(aliasConfig)
+	viaAlias, _ := bc.FindBucket("payments", "b")
+	direct, _ := bc.FindBucket("payments.v2", "b")
+	if viaAlias == nil || viaAlias != direct {
+		t.Fatalf("Expecting the alias to find the namespace's bucket. Was %v and %v", viaAlias, direct)
+	}
+
+	if b := viaAlias.(*mockBucket); b.namespace != "payments.v2" {
+		t.Fatalf("Expecting buckets to be created in the aliased namespace. Was %v", b.namespace)
+	}
+
+	if names := bc.ListNamespaces(); len(names) != 1 || names[0] != "payments.v2" {
+		t.Fatalf("Not expecting aliases to be listed as namespaces. Was %v", names)
+	}
+}
+
+func TestChainedAlias(t *testing.T) {
+	bc := newTestContainer(aliasConfig)
+	if err := bc.AddAlias("pay", "payments"); err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	viaChain, _ := bc.FindBucket("pay", "b")
+	direct, _ := bc.FindBucket("payments.v2", "b")
+	if viaChain == nil || viaChain != direct {
+		t.Fatalf("Expecting the alias chain to find the namespace's bucket. Was %v and %v", viaChain, direct)
+	}
+
+	if aliases := bc.ListAliases(); len(aliases) != 2 || aliases["pay"] != "payments" {
+		t.Fatalf("Expecting 2 aliases. Was %v", aliases)
+	}
+}
+
+func TestRenameNamespace(t *testing.T) {
+	for _, useTrie := range []bool{false, true} {
+		c := newTestConfig(func(c *configs.ServiceConfig) {
+			c.Namespaces["auth"] = configs.NewDefaultNamespaceConfig()
+			c.Namespaces["auth"].Buckets["login"] = configs.NewDefaultBucketConfig()
+			c.Namespaces["auth"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+			c.Namespaces["child"] = configs.NewDefaultNamespaceConfig()
+			c.Namespaces["child"].Parent = "auth"
+			c.NamespaceAliases = map[string]string{"legacy-auth": "auth"}
+		})
+		bc := NewBucketContainer(c, &mockBucketFactory{})
+		if useTrie {
+			bc.WithTrieNamespaceRegistry()
+		}
+
+		login, _ := bc.FindBucket("auth", "login")
+		dyn, _ := bc.FindBucket("auth", "dyn")
+		login.Take(10, 0)
+
+		if err := bc.RenameNamespace("auth", "authentication"); err != nil {
+			t.Fatalf("Not expecting an error. Was %v", err)
+		}
+
+		for name, expected := range map[string]Bucket{"login": login, "dyn": dyn} {
+			if b, _ := bc.FindBucket("authentication", name); b != expected {
+				t.Fatalf("Expecting bucket %v under the new name. Was %v", name, b)
+			}
+		}
+
+		if tokens := login.(TokenCounter).AvailableTokens(); tokens != 90 {
+			t.Fatalf("Expecting the bucket's state to be kept. Had %v tokens", tokens)
+		}
+
+		if b, _ := bc.FindBucket("auth", "login"); b != bc.defaultBucket {
+			t.Fatalf("Expecting the global default bucket for the old name. Was %v", b)
+		}
+
+		if b, _ := bc.FindBucket("legacy-auth", "login"); b != login {
+			t.Fatalf("Expecting aliases to follow the rename. Was %v", b)
+		}
+
+		if names := bc.ListNamespaces(); !reflect.DeepEqual(names, []string{"authentication", "child"}) {
+			t.Fatalf("Expecting the namespace to be listed under the new name. Was %v", names)
+		}
+
+		if parent := bc.namespace("child").parent(); parent != "authentication" {
+			t.Fatalf("Expecting children to follow the rename. Parent was %v", parent)
+		}
+
+		if bc.NamespaceConfig("auth") != nil || bc.NamespaceConfig("authentication") != c.Namespaces["auth"] ||
+			bc.NamespaceConfig("legacy-auth") != c.Namespaces["auth"] || bc.NamespaceConfig("child").Parent != "authentication" {
+			t.Fatalf("Expecting namespace configs to follow the rename")
+		}
+
+		if c.Namespaces["auth"] == nil || c.Namespaces["child"].Parent != "auth" {
+			t.Fatalf("Expecting the service config to be left alone. Was %v", c.Namespaces)
+		}
+	}
+}
+
+func TestRenameNamespaceWhileReadingConfigs(t *testing.T) {
+	c := newTestConfig(func(c *configs.ServiceConfig) {
+		c.Namespaces["a"] = configs.NewDefaultNamespaceConfig()
+		c.Namespaces["child"] = configs.NewDefaultNamespaceConfig()
+		c.Namespaces["child"].Parent = "a"
+	})
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if nsCfg := bc.NamespaceConfig("child"); nsCfg == nil || nsCfg.Parent == "" {
+				t.Errorf("Expecting the child's config to have a parent. Was %v", nsCfg)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		bc.RenameNamespace("a", "b")
+		bc.RenameNamespace("b", "a")
+	}
+	<-done
+
+	if c.Namespaces["child"].Parent != "a" {
+		t.Fatalf("Expecting the service config to be left alone. Parent was %v", c.Namespaces["child"].Parent)
+	}
+}
+
+func TestRenameAliasedNamespace(t *testing.T) {
+	bc := newTestContainer(aliasConfig)
+	dyn, _ := bc.FindBucket("payments", "dyn")
+
+	if err := bc.RenameNamespace("payments.v2", "payments.v3"); err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	if resolved := bc.ResolveNamespace("payments"); resolved != "payments.v3" {
+		t.Fatalf("Expecting the alias to resolve to the new name. Was %v", resolved)
+	}
+
+	for _, name := range []string{"payments", "payments.v3"} {
+		if b, _ := bc.FindBucket(name, "dyn"); b != dyn {
+			t.Fatalf("Expecting the dynamic bucket through %v. Was %v", name, b)
+		}
+
+		if bc.NamespaceConfig(name) == nil {
+			t.Fatalf("Expecting the namespace config through %v", name)
+		}
+	}
+}
+
+func TestRenameWithFeedbackThroughAlias(t *testing.T) {
+	bc := newTestContainer(feedbackConfig, func(c *configs.ServiceConfig) {
+		c.NamespaceAliases = map[string]string{"legacy": "n"}
+	})
+	source := &mockFeedbackSource{errorRate: 0.5}
+	f, err := bc.newFeedback("legacy", source)
+	if err != nil {
+		t.Fatalf("Unable to register feedback source: %v", err)
+	}
+
+	if err := bc.RenameNamespace("n", "m"); err != nil {
+		t.Fatalf("Unable to rename namespace: %v", err)
+	}
+
+	// The source registered through the alias tunes the renamed namespace, whichever name its
+	// buckets are found by.
+	f.check()
+	b, _ := bc.FindBucket("legacy", "b")
+	if m, _ := bc.FindBucket("m", "b"); m != b || b.Config().FillRate != 25 {
+		t.Fatalf("Expecting fill rate to be reduced to 25 after the rename. Was %v", b.Config().FillRate)
+	}
+
+	source.errorRate = 0
+	f.check()
+	if b.Config().FillRate != 100 {
+		t.Fatalf("Expecting fill rate to be restored. Was %v", b.Config().FillRate)
+	}
+}
+
+func TestRenameNamespaceErrors(t *testing.T) {
+	bc := newTestContainer(aliasConfig)
+	bc.RenameNamespace("payments.v2", "payments.v3")
+
+	if err := bc.RenameNamespace("payments.v2", "x"); err != ErrNoSuchNamespace {
+		t.Fatalf("Expecting ErrNoSuchNamespace. Was %v", err)
+	}
+
+	if err := bc.RenameNamespace("payments.v3", "payments"); err != ErrNamespaceExists {
+		t.Fatalf("Expecting ErrNamespaceExists. Was %v", err)
+	}
+}
+
+func TestAddAliasErrors(t *testing.T) {
+	bc := newTestContainer(aliasConfig)
+	bc.AddAlias("a", "payments")
+
+	if err := bc.AddAlias("payments", "a"); err != ErrCircularAlias {
+		t.Fatalf("Expecting ErrCircularAlias. Was %v", err)
+	}
+
+	if err := bc.AddAlias("payments.v2", "payments"); err != ErrNamespaceExists {
+		t.Fatalf("Expecting ErrNamespaceExists. Was %v", err)
+	}
+
+	if err := bc.AddAlias("b", "nonexistent"); err != ErrNoSuchNamespace {
+		t.Fatalf("Expecting ErrNoSuchNamespace. Was %v", err)
+	}
+
+	if aliases := bc.ListAliases(); len(aliases) != 2 {
+		t.Fatalf("Expecting failed aliases not to be added. Was %v", aliases)
+	}
+}
+
+func TestPredictExhaustion(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["b"] = &configs.BucketConfig{Size: 100, FillRate: 10}
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	if _, err := bc.PredictExhaustion("n", "b"); err != ErrRateTrackingNotStarted {
+		t.Fatalf("Expecting ErrRateTrackingNotStarted. Was %v", err)
+	}
+
+	// Updates are made by hand, rather than by the tracker's goroutine.
+	bc.StartRateTracking(time.Hour)
+	tracker := bc.consumption.Load().(*consumptionTracker)
+	hour := int64(time.Hour / time.Second)
+
+	// 30 tokens a second are granted, so the bucket loses 20 a second.
+	bc.RecordEvent("n", "b", 30*hour, EVENT_OK)
+	bc.RecordEvent("n", "b", 5*hour, EVENT_REJECTED)
+	tracker.update()
+	if d, err := bc.PredictExhaustion("n", "b"); err != nil || math.Abs(d.Seconds()-5) > 0.5 {
+		t.Fatalf("Expecting exhaustion in about 5s. Was %v, %v", d, err)
+	}
+
+	// The average is weighted towards recent rates.
+	bc.RecordEvent("n", "b", 5*hour, EVENT_OK)
+	tracker.update()
+	if d, err := bc.PredictExhaustion("n", "b"); err != nil || d != -1 {
+		t.Fatalf("Expecting the bucket never to be exhausted. Was %v, %v", d, err)
+	}
+
+	if _, err := bc.PredictExhaustion("n", "nonexistent"); err != ErrNoSuchBucket {
+		t.Fatalf("Expecting ErrNoSuchBucket. Was %v", err)
+	}
+}
+
+func TestBorrowMarket(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	for _, name := range []string{"idle", "busy", "closed"} {
+		c.Namespaces[name] = configs.NewDefaultNamespaceConfig()
+		c.Namespaces[name].AggregateBucket = &configs.BucketConfig{Size: 100, FillRate: 1}
+	}
+	c.Namespaces["busy"].AcceptDonationsFrom = []string{"idle"}
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	tokens := func(namespace string) int64 {
+		return bc.AggregateBucket(namespace).(TokenCounter).AvailableTokens()
+	}
+
+	// Both are 95% utilised, but only busy accepts donations from idle.
+	bc.AggregateBucket("busy").Take(95, 0)
+	bc.AggregateBucket("closed").Take(95, 0)
+	m := &configs.BorrowMarketConfig{LendingThreshold: 50, BorrowingThreshold: 80, MarketIntervalMillis: 1000}
+	bc.runBorrowMarket(m)
+
+	// Busy borrows enough to fall to 80% utilisation.
+	if tokens("busy") != 20 || tokens("idle") != 85 || tokens("closed") != 5 {
+		t.Fatalf("Expecting 15 tokens lent to busy. Had %v, %v and %v tokens", tokens("idle"), tokens("busy"), tokens("closed"))
+	}
+
+	// Lenders don't rise above the lending threshold.
+	bc.AggregateBucket("busy").Take(20, 0)
+	bc.AggregateBucket("idle").Take(30, 0)
+	bc.runBorrowMarket(m)
+	if tokens("busy") != 5 || tokens("idle") != 50 {
+		t.Fatalf("Expecting 5 tokens lent to busy. Had %v and %v tokens", tokens("idle"), tokens("busy"))
+	}
+}
+
+func TestActivityCount(t *testing.T) {
+	a := NewActivityChannel()
+	if a.ActivityCount() != 0 {
+		t.Fatal("Expecting no activity before any is reported")
+	}
+
+	for i := 0; i < 3; i++ {
+		a.ReportActivity()
+	}
+
+	// Copies, as embedded in buckets, share the activity reported.
+	copied := a
+	copied.ReportActivity()
+
+	if c := a.ActivityCount(); c != 4 {
+		t.Fatalf("Expecting 4 reports of activity, but counted %v", c)
+	}
+
+	if c := a.ActivityCount(); c != 0 {
+		t.Fatalf("Expecting count to be reset, but counted %v", c)
+	}
+
+	// Counting doesn't consume activity detected.
+	if !a.ActivityDetected() || a.ActivityDetected() {
+		t.Fatal("Expecting activity to be detected once")
+	}
+}
+
+func TestClampTokens(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	for _, name := range []string{"global", "override"} {
+		c.Namespaces[name] = configs.NewDefaultNamespaceConfig()
+	}
+	c.Namespaces["override"].MaxTokensPerRequest = 50
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	// Requests aren't capped by default.
+	if tokens := bc.ClampTokens("global", 1000); tokens != 1000 {
+		t.Fatalf("Expecting no cap. Was clamped to %v", tokens)
+	}
+
+	c.GlobalMaxTokensPerRequest = 10
+	for _, test := range []struct {
+		namespace           string
+		requested, expected int64
+	}{
+		{"global", 5, 5},
+		{"global", 20, 10},
+		{"nonexistent", 20, 10},
+		{"override", 20, 20},
+		{"override", 100, 50}} {
+		if tokens := bc.ClampTokens(test.namespace, test.requested); tokens != test.expected {
+			t.Fatalf("Expecting %v tokens requested in %v to be clamped to %v. Was %v",
+				test.requested, test.namespace, test.expected, tokens)
+		}
+	}
+}
+
+func TestSlogOutput(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	var buf bytes.Buffer
+	defer logging.SetLogger(logging.CurrentLogger())
+	logging.SetSlogHandler(slog.NewJSONHandler(&buf, nil))
+
+	if err := bc.LockNamespace("n"); err != nil {
+		t.Fatal(err)
+	}
+
+	var record struct {
+		Level string
+		Msg   string
+		Attrs map[string]interface{}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expecting a JSON log record. Was %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]interface{}{"namespace": "n", "locked": true}
+	if record.Level != "INFO" || record.Msg != "Namespace n locked=true" || !reflect.DeepEqual(record.Attrs, expected) {
+		t.Fatalf("Expecting the namespace and its lock state logged. Was %+v", record)
+	}
+}
+
+// signalRecorder is a scaling adapter that records the signals published.
+type signalRecorder struct {
+	signals []scaling.Signal
+}
+
+func (r *signalRecorder) Publish(s scaling.Signal) error {
+	r.signals = append(r.signals, s)
+	return nil
+}
+
+func TestScalingSignals(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.GlobalDefaultBucket = nil
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["b"] = &configs.BucketConfig{Size: 100, FillRate: 1}
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+	b, _ := bc.FindBucket("n", "b")
+	r := &signalRecorder{}
+	tracker := newScalingTracker(r)
+	start := time.Now()
+
+	// Utilisation at the threshold isn't above it.
+	b.Take(80, 0)
+	bc.checkScaling(tracker, start)
+	b.Take(10, 0)
+	bc.checkScaling(tracker, start)
+	bc.checkScaling(tracker, start.Add(ScalingSustainDuration-time.Second))
+	if len(r.signals) != 0 {
+		t.Fatalf("Expecting no signals before utilisation is sustained. Was %+v", r.signals)
+	}
+
+	bc.checkScaling(tracker, start.Add(ScalingSustainDuration))
+	expected := scaling.Signal{Namespace: "n", BucketName: "b", Utilisation: 90, Sustained: true}
+	if len(r.signals) != 1 || r.signals[0] != expected {
+		t.Fatalf("Expecting %+v. Was %+v", expected, r.signals)
+	}
+
+	// Falling below the threshold is signalled once.
+	b.AddTokens(50)
+	bc.checkScaling(tracker, start.Add(ScalingSustainDuration+time.Second))
+	bc.checkScaling(tracker, start.Add(ScalingSustainDuration+2*time.Second))
+	expected = scaling.Signal{Namespace: "n", BucketName: "b", Utilisation: 40}
+	if len(r.signals) != 2 || r.signals[1] != expected {
+		t.Fatalf("Expecting %+v. Was %+v", expected, r.signals)
+	}
+}
+
+func TestSetNamespaceDryRun(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["dry"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["dry"].DryRun = true
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	if bc.IsNamespaceDryRun("n") || !bc.IsNamespaceDryRun("dry") {
+		t.Fatal("Expecting dry-run mode to start as configured")
+	}
+
+	if err := bc.SetNamespaceDryRun("n", true); err != nil || !bc.IsNamespaceDryRun("n") {
+		t.Fatalf("Expecting n to be put into dry-run mode. Error: %v", err)
+	}
+
+	if err := bc.SetNamespaceDryRun("dry", false); err != nil || bc.IsNamespaceDryRun("dry") {
+		t.Fatalf("Expecting dry to be taken out of dry-run mode. Error: %v", err)
+	}
+
+	if err := bc.SetNamespaceDryRun("nonexistent", true); err != ErrNoSuchNamespace {
+		t.Fatalf("Expecting ErrNoSuchNamespace. Was %v", err)
+	}
+}
+
+// refillRecordingBucket records the refill callbacks registered with it.
+type refillRecordingBucket struct {
+	mockBucket
+	thresholds []float64
+	fns        []func()
+}
+
+func (b *refillRecordingBucket) OnRefillAbove(threshold float64, fn func()) {
+	b.thresholds = append(b.thresholds, threshold)
+	b.fns = append(b.fns, fn)
+}
+
+type refillRecordingBucketFactory struct {
+	mockBucketFactory
+}
+
+func (bf refillRecordingBucketFactory) NewBucket(namespace string, bucketName string, cfg *configs.BucketConfig, dyn bool) Bucket {
+	return &refillRecordingBucket{mockBucket: mockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg, tokens: cfg.Size}}
+}
+
+func TestOnBucketRecovered(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.GlobalDefaultBucket = nil
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].Buckets["existing"] = configs.NewDefaultBucketConfig()
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	bc := NewBucketContainer(c, refillRecordingBucketFactory{})
+	existing, _ := bc.FindBucket("n", "existing")
+
+	var recovered []string
+	bc.OnBucketRecovered(func(namespace, bucketName string) {
+		recovered = append(recovered, FullyQualifiedName(namespace, bucketName))
+	})
+	created, _ := bc.FindBucket("n", "created")
+
+	for _, b := range []Bucket{existing, created} {
+		rb := b.(*refillRecordingBucket)
+		if !reflect.DeepEqual(rb.thresholds, []float64{RecoveryThreshold}) {
+			t.Fatalf("Expecting a callback registered at %v. Were %v", RecoveryThreshold, rb.thresholds)
+		}
+		rb.fns[0]()
+	}
+
+	expected := []string{FullyQualifiedName("n", "existing"), FullyQualifiedName("n", "created")}
+	if !reflect.DeepEqual(recovered, expected) {
+		t.Fatalf("Expecting %v to be reported recovered. Were %v", expected, recovered)
+	}
+}
+
+// lockedRefillRecordingBucket is a refillRecordingBucket that may be registered with concurrently.
+type lockedRefillRecordingBucket struct {
+	refillRecordingBucket
+	sync.Mutex
+}
+
+func (b *lockedRefillRecordingBucket) OnRefillAbove(threshold float64, fn func()) {
+	b.Lock()
+	defer b.Unlock()
+	b.refillRecordingBucket.OnRefillAbove(threshold, fn)
+}
+
+type lockedRefillRecordingBucketFactory struct {
+	mockBucketFactory
+}
+
+func (bf lockedRefillRecordingBucketFactory) NewBucket(namespace string, bucketName string, cfg *configs.BucketConfig, dyn bool) Bucket {
+	return &lockedRefillRecordingBucket{refillRecordingBucket: refillRecordingBucket{
+		mockBucket: mockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg, tokens: cfg.Size}}}
+}
+
+func TestOnBucketRecoveredWhileCreatingBuckets(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.GlobalDefaultBucket = nil
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	bc := NewBucketContainer(c, lockedRefillRecordingBucketFactory{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bc.FindBucket("n", strconv.Itoa(i))
+		}(i)
+	}
+	bc.OnBucketRecovered(func(namespace, bucketName string) {})
+	wg.Wait()
+
+	// Every bucket is registered exactly once, whether created before or after the callback.
+	for i := 0; i < 50; i++ {
+		b, _ := bc.FindBucket("n", strconv.Itoa(i))
+		rb := b.(*lockedRefillRecordingBucket)
+		rb.Lock()
+		registered := len(rb.thresholds)
+		rb.Unlock()
+		if registered != 1 {
+			t.Fatalf("Expecting bucket %v registered once. Was %v times", i, registered)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["n"].CircuitBreakerThreshold = 3
+	c.Namespaces["n"].CircuitBreakerResetTimeoutMs = 1000
+	c.Namespaces["unbroken"] = configs.NewDefaultNamespaceConfig()
+	bc := NewBucketContainer(c, &mockBucketFactory{})
+
+	now := time.Unix(0, 0)
+	bc.namespace("n").circuit.now = func() time.Time { return now }
+
+	expect := func(state CircuitState, entered error) {
+		if s := bc.GetCircuitState("n"); s != state {
+			t.Fatalf("Expecting circuit %v. Was %v", state, s)
+		}
+
+		if err := bc.EnterCircuit("n"); err != entered {
+			t.Fatalf("Expecting %v entering the circuit. Was %v", entered, err)
+		}
+	}
+
+	// Rejections that aren't consecutive don't open the circuit.
+	for i := 0; i < 2; i++ {
+		expect(CIRCUIT_CLOSED, nil)
+		bc.ExitCircuit("n", CIRCUIT_EXHAUSTED)
+	}
+	expect(CIRCUIT_CLOSED, nil)
+	bc.ExitCircuit("n", CIRCUIT_GRANTED)
+
+	for i := 0; i < 3; i++ {
+		expect(CIRCUIT_CLOSED, nil)
+		bc.ExitCircuit("n", CIRCUIT_EXHAUSTED)
+	}
+	expect(CIRCUIT_OPEN, ErrCircuitOpen)
+
+	// Only one probe is let through after the reset timeout.
+	now = now.Add(time.Second)
+	expect(CIRCUIT_OPEN, nil)
+	expect(CIRCUIT_HALF_OPEN, ErrCircuitOpen)
+
+	// A failed probe keeps it open for another reset timeout.
+	bc.ExitCircuit("n", CIRCUIT_EXHAUSTED)
+	expect(CIRCUIT_OPEN, ErrCircuitOpen)
+	now = now.Add(999 * time.Millisecond)
+	expect(CIRCUIT_OPEN, ErrCircuitOpen)
+
+	// An inconclusive probe leaves it open, letting the next request probe it.
+	now = now.Add(time.Millisecond)
+	expect(CIRCUIT_OPEN, nil)
+	bc.ExitCircuit("n", CIRCUIT_INCONCLUSIVE)
+	expect(CIRCUIT_OPEN, nil)
+
+	// A successful probe closes it.
+	bc.ExitCircuit("n", CIRCUIT_GRANTED)
+	expect(CIRCUIT_CLOSED, nil)
+
+	// Namespaces without a threshold, or that don't exist, are never open.
+	for _, ns := range []string{"unbroken", "nonexistent"} {
+		for i := 0; i < 5; i++ {
+			if err := bc.EnterCircuit(ns); err != nil {
+				t.Fatalf("Expecting %v never to open. Was %v", ns, err)
+			}
+			bc.ExitCircuit(ns, CIRCUIT_EXHAUSTED)
+		}
+
+		if s := bc.GetCircuitState(ns); s != CIRCUIT_CLOSED {
+			t.Fatalf("Expecting %v closed. Was %v", ns, s)
+		}
+	}
+}
+
+func TestPreloadEntriesFromEventLog(t *testing.T) {
+	events := []QuotaEvent{
+		{Namespace: "n", BucketName: "a", Status: EVENT_OK},
+		{Namespace: "n", BucketName: "missing", Status: EVENT_REJECTED},
+		{Namespace: "n", BucketName: "b", Status: EVENT_OK_WAIT},
+		{Namespace: "n", BucketName: "a", Status: EVENT_OK}}
+
+	expected := []PreloadEntry{{Namespace: "n", BucketName: "a"}, {Namespace: "n", BucketName: "b"}}
+	if entries := PreloadEntriesFromEventLog(events); !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("Expecting entries %+v. Were %+v", expected, entries)
+	}
+}
+
+func TestReadPreloadEntries(t *testing.T) {
+	entries, err := ReadPreloadEntries(strings.NewReader(`
+- namespace: n
+  bucket: a
+- namespace: n
+  bucket: b
+  initial_tokens: 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PreloadEntry{{Namespace: "n", BucketName: "a"}, {Namespace: "n", BucketName: "b", InitialTokens: 10}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("Expecting entries %+v. Were %+v", expected, entries)
+	}
+
+	if _, err := ReadPreloadEntries(strings.NewReader("not: [a list")); err == nil {
+		t.Fatal("Expecting an error reading malformed entries")
+	}
+}
+
+func TestLifetimeStatsUnsupported(t *testing.T) {
+	bc := NewBucketContainer(cfg, &mockBucketFactory{})
+	bc.FindBucket("y", "a")
+	if _, err := bc.LifetimeStats("y", "a"); err != ErrNoLifetimeStats {
+		t.Fatalf("Expecting ErrNoLifetimeStats. Was %v", err)
+	}
+}
+
+func TestReplicateSkipsEmptyGrants(t *testing.T) {
+	r := &replicator{grants: make(chan *qspb.ReplicateGrantRequest, 2)}
+	r.replicate("n", "a", 0, time.Now())
+	if len(r.grants) != 0 {
+		t.Fatal("Expecting grants of no tokens not to be replicated")
+	}
+
+	r.replicate("n", "a", 1, time.Now())
+	if len(r.grants) != 1 {
+		t.Fatal("Expecting the grant to be replicated")
+	}
+}
@@ -0,0 +1,164 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// CircuitState is the state of a namespace's circuit breaker.
+type CircuitState int
+
+const (
+	// CIRCUIT_CLOSED lets requests through to the namespace's buckets.
+	CIRCUIT_CLOSED CircuitState = iota
+	// CIRCUIT_OPEN rejects requests without taking tokens.
+	CIRCUIT_OPEN
+	// CIRCUIT_HALF_OPEN has let a single request through to probe whether the namespace has
+	// recovered, and rejects other requests until it finishes.
+	CIRCUIT_HALF_OPEN
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CIRCUIT_CLOSED:
+		return "CLOSED"
+	case CIRCUIT_OPEN:
+		return "OPEN"
+	case CIRCUIT_HALF_OPEN:
+		return "HALF_OPEN"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// circuitBreaker counts consecutive rejections of requests against a namespace.
+type circuitBreaker struct {
+	threshold    int
+	resetTimeout time.Duration
+	state        CircuitState
+	failures     int       // Consecutive rejections while closed.
+	openedAt     time.Time // When the circuit last opened.
+	now          func() time.Time
+	sync.Mutex
+}
+
+// newCircuitBreaker returns nil unless the namespace has a CircuitBreakerThreshold.
+func newCircuitBreaker(cfg *configs.NamespaceConfig) *circuitBreaker {
+	if cfg.CircuitBreakerThreshold < 1 {
+		return nil
+	}
+
+	return &circuitBreaker{
+		threshold:    cfg.CircuitBreakerThreshold,
+		resetTimeout: time.Duration(cfg.CircuitBreakerResetTimeoutMs) * time.Millisecond,
+		now:          time.Now}
+}
+
+// EnterCircuit tells you if a request may take tokens from a namespace's buckets, returning
+// ErrCircuitOpen if the namespace's circuit is open. Once the circuit has been open for
+// CircuitBreakerResetTimeoutMs, a single request is let through to probe the namespace. Each request
+// let through must be followed by a call to ExitCircuit(). Namespaces without a
+// CircuitBreakerThreshold are never open.
+func (bc *BucketContainer) EnterCircuit(namespace string) error {
+	ns := bc.namespace(namespace)
+	if ns == nil || ns.circuit == nil {
+		return nil
+	}
+
+	c := ns.circuit
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case CIRCUIT_OPEN:
+		if c.now().Sub(c.openedAt) < c.resetTimeout {
+			return ErrCircuitOpen
+		}
+		c.transition(namespace, CIRCUIT_HALF_OPEN)
+	case CIRCUIT_HALF_OPEN:
+		// A probe is in flight.
+		return ErrCircuitOpen
+	}
+
+	return nil
+}
+
+// CircuitOutcome is the outcome of a request let through by EnterCircuit().
+type CircuitOutcome int
+
+const (
+	// CIRCUIT_GRANTED means the request was granted tokens.
+	CIRCUIT_GRANTED CircuitOutcome = iota
+	// CIRCUIT_EXHAUSTED means the request was rejected for lack of tokens.
+	CIRCUIT_EXHAUSTED
+	// CIRCUIT_INCONCLUSIVE means the request failed for some other reason, such as the namespace
+	// being locked, and says nothing about whether the namespace has recovered.
+	CIRCUIT_INCONCLUSIVE
+)
+
+// ExitCircuit records the outcome of a request let through by EnterCircuit(). Requests rejected
+// for lack of tokens count towards opening the circuit, or keep it open if the request was a
+// probe. Granted requests close the circuit. Inconclusive outcomes leave the circuit as it was,
+// reopening it if the request was a probe so that the next request probes the namespace instead.
+func (bc *BucketContainer) ExitCircuit(namespace string, outcome CircuitOutcome) {
+	ns := bc.namespace(namespace)
+	if ns == nil || ns.circuit == nil {
+		return
+	}
+
+	c := ns.circuit
+	c.Lock()
+	defer c.Unlock()
+
+	switch outcome {
+	case CIRCUIT_GRANTED:
+		c.failures = 0
+		if c.state == CIRCUIT_HALF_OPEN {
+			c.transition(namespace, CIRCUIT_CLOSED)
+		}
+		return
+	case CIRCUIT_INCONCLUSIVE:
+		// openedAt is left alone, so the reset timeout has already passed.
+		if c.state == CIRCUIT_HALF_OPEN {
+			c.transition(namespace, CIRCUIT_OPEN)
+		}
+		return
+	}
+
+	switch c.state {
+	case CIRCUIT_CLOSED:
+		c.failures++
+		if c.failures < c.threshold {
+			return
+		}
+		fallthrough
+	case CIRCUIT_HALF_OPEN:
+		c.failures = 0
+		c.openedAt = c.now()
+		c.transition(namespace, CIRCUIT_OPEN)
+	}
+}
+
+// GetCircuitState tells you the state of a namespace's circuit breaker. Namespaces without a
+// CircuitBreakerThreshold, and namespaces that don't exist, are always CIRCUIT_CLOSED.
+func (bc *BucketContainer) GetCircuitState(namespace string) CircuitState {
+	ns := bc.namespace(namespace)
+	if ns == nil || ns.circuit == nil {
+		return CIRCUIT_CLOSED
+	}
+
+	ns.circuit.Lock()
+	defer ns.circuit.Unlock()
+	return ns.circuit.state
+}
+
+func (c *circuitBreaker) transition(namespace string, state CircuitState) {
+	c.state = state
+	logging.Printf("Namespace %v circuit=%v", namespace, state)
+}
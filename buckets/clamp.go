@@ -0,0 +1,25 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+// MaxTokensPerRequest returns the most tokens granted to any one request against a namespace: the
+// namespace's MaxTokensPerRequest if set, otherwise the service's GlobalMaxTokensPerRequest. 0
+// means requests aren't capped.
+func (bc *BucketContainer) MaxTokensPerRequest(namespace string) int64 {
+	if ns := bc.namespace(namespace); ns != nil && ns.cfg.MaxTokensPerRequest > 0 {
+		return ns.cfg.MaxTokensPerRequest
+	}
+
+	return bc.cfg.GlobalMaxTokensPerRequest
+}
+
+// ClampTokens returns the number of tokens to grant for a request against a namespace, reduced to
+// MaxTokensPerRequest() if the request is for more.
+func (bc *BucketContainer) ClampTokens(namespace string, tokensRequested int64) int64 {
+	if max := bc.MaxTokensPerRequest(namespace); max > 0 && tokensRequested > max {
+		return max
+	}
+
+	return tokensRequested
+}
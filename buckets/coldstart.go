@@ -0,0 +1,59 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultColdStartIdle is how long a bucket goes without requests before it is idle, for
+// namespaces that don't set ColdStartIdleMillis.
+const DefaultColdStartIdle = time.Minute
+
+// coldStarts keeps track of when the buckets of a namespace were last requested, to detect the
+// first request for a bucket after it has been idle.
+type coldStarts struct {
+	idle          time.Duration
+	lastRequested map[string]time.Time
+	lastSweep     time.Time
+	sync.Mutex    // Embedded mutex
+}
+
+func newColdStarts(idleMillis int64) *coldStarts {
+	idle := time.Duration(idleMillis) * time.Millisecond
+	if idle <= 0 {
+		idle = DefaultColdStartIdle
+	}
+
+	return &coldStarts{idle: idle, lastRequested: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+// requested records a request for a bucket, calling onColdStart asynchronously if the bucket was
+// idle. Requests served by the namespace's default bucket are recorded against it.
+func (c *coldStarts) requested(namespace, bucketName string, defaultBucket bool, onColdStart func(namespace, bucket string)) {
+	if defaultBucket {
+		bucketName = DEFAULT_BUCKET_NAME
+	}
+
+	now := time.Now()
+	c.Lock()
+	last, seen := c.lastRequested[bucketName]
+	c.lastRequested[bucketName] = now
+
+	// Forget buckets that have gone idle, since dynamic buckets may never be requested again.
+	if now.Sub(c.lastSweep) >= c.idle {
+		for name, t := range c.lastRequested {
+			if now.Sub(t) >= c.idle {
+				delete(c.lastRequested, name)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.Unlock()
+
+	if !seen || now.Sub(last) >= c.idle {
+		go onColdStart(namespace, bucketName)
+	}
+}
@@ -0,0 +1,26 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync/atomic"
+)
+
+// AcquireConcurrency reserves one of the namespace's MaxConcurrency slots for a request, returning
+// ErrMaxConcurrency if all of them are in use. The function returned releases the slot, and must
+// be called once the request has finished taking tokens. Namespaces without a MaxConcurrency
+// aren't limited.
+func (bc *BucketContainer) AcquireConcurrency(namespace string) (release func(), err error) {
+	ns := bc.namespace(namespace)
+	if ns == nil || ns.cfg.MaxConcurrency < 1 {
+		return func() {}, nil
+	}
+
+	if atomic.AddInt64(&ns.concurrency, 1) > ns.cfg.MaxConcurrency {
+		atomic.AddInt64(&ns.concurrency, -1)
+		return nil, ErrMaxConcurrency
+	}
+
+	return func() { atomic.AddInt64(&ns.concurrency, -1) }, nil
+}
@@ -0,0 +1,65 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// maxConfigCacheEntries bounds the number of bucket names cached per namespace, since the names
+// of dynamic buckets are chosen by clients.
+const maxConfigCacheEntries = 10000
+
+// configCache caches the config used to create each bucket in a namespace, so that buckets that
+// are repeatedly missing, because they have been removed when idle or can't be created, don't
+// repeat the lookup. Entries must be invalidated whenever the namespace's bucket configs change.
+type configCache struct {
+	entries sync.Map
+	// Updated atomically.
+	size, hits, misses int64
+}
+
+// cachedConfig is the config for a bucket, and whether the bucket is dynamic.
+type cachedConfig struct {
+	cfg *configs.BucketConfig
+	dyn bool
+}
+
+// get returns the cached config for a bucket, using load to look it up on a miss.
+func (c *configCache) get(bucketName string, load func() cachedConfig) cachedConfig {
+	if v, ok := c.entries.Load(bucketName); ok {
+		atomic.AddInt64(&c.hits, 1)
+		return v.(cachedConfig)
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+	cc := load()
+	if atomic.LoadInt64(&c.size) < maxConfigCacheEntries {
+		if _, loaded := c.entries.LoadOrStore(bucketName, cc); !loaded {
+			atomic.AddInt64(&c.size, 1)
+		}
+	}
+
+	return cc
+}
+
+// invalidate removes a bucket's config from the cache.
+func (c *configCache) invalidate(bucketName string) {
+	if _, ok := c.entries.LoadAndDelete(bucketName); ok {
+		atomic.AddInt64(&c.size, -1)
+	}
+}
+
+// hitRate returns the fraction of lookups served from the cache.
+func (c *configCache) hitRate() float64 {
+	hits, misses := atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+	if hits + misses == 0 {
+		return 0
+	}
+
+	return float64(hits) / float64(hits + misses)
+}
@@ -0,0 +1,288 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package coordinated implements token buckets that divide a bucket's fill rate between the
+// instances of the quota service currently using it, like the partitioned package, but without
+// needing to know up front how many instances there are.
+//
+// Each instance serves tokens from a bucket in its own memory. Every Take() announces the instance
+// in a Redis sorted set per bucket, scored by the time of the announcement, and a Lua script
+// counts the instances announced within InstanceTimeout, and returns this instance's share of the
+// fill rate. Instances that stop taking tokens from a bucket drop out of its count once their last
+// announcement is older than InstanceTimeout, and the remaining instances' shares grow on their
+// next Take().
+//
+// If Redis is unavailable, buckets keep the share they last had.
+package coordinated
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+	"gopkg.in/redis.v3"
+)
+
+// InstanceTimeout is how long an instance counts as using a bucket after it last took tokens from
+// it.
+const InstanceTimeout = 10 * time.Second
+
+// INSTANCES_SUFFIX is the suffix of the Redis keys holding the instances using each bucket.
+const INSTANCES_SUFFIX = "INSTANCES"
+
+type bucketFactory struct {
+	redisOpts   *redis.Options
+	instanceID  string
+	local       buckets.BucketFactory
+	client      *redis.Client
+	announceSHA string
+	initialized bool
+	readyErr    error
+	m           sync.RWMutex
+}
+
+// NewCoordinatedBucketFactory creates a factory for buckets that own an equal share of the
+// configured fill rate with every other instance using the same bucket, identified to the others
+// by instanceID.
+func NewCoordinatedBucketFactory(redisOpts *redis.Options, instanceID string) buckets.BucketFactory {
+	if instanceID == "" {
+		panic("Instance ID should not be empty")
+	}
+
+	return &bucketFactory{
+		redisOpts:  redisOpts,
+		instanceID: instanceID,
+		local:      memory.NewBucketFactory()}
+}
+
+func (bf *bucketFactory) Init(cfg *configs.ServiceConfig) {
+	bf.m.Lock()
+	defer bf.m.Unlock()
+
+	if bf.initialized {
+		return
+	}
+
+	bf.initialized = true
+	bf.local.Init(cfg)
+	bf.readyErr = bf.connectToRedis()
+	if bf.readyErr != nil {
+		logging.Printf("Unable to initialize coordinated bucket factory: %v", bf.readyErr)
+	}
+}
+
+func (bf *bucketFactory) connectToRedis() error {
+	bf.client = redis.NewClient(bf.redisOpts)
+	if err := bf.client.Time().Err(); err != nil {
+		return fmt.Errorf("Unable to connect to Redis: %v", err)
+	}
+
+	sha, err := bf.client.ScriptLoad(announceScript).Result()
+	if err != nil {
+		return fmt.Errorf("Unable to load LUA script into Redis: %v", err)
+	}
+
+	bf.announceSHA = sha
+	return nil
+}
+
+func (bf *bucketFactory) Ready() bool {
+	return bf.ReadyErr() == nil
+}
+
+func (bf *bucketFactory) ReadyErr() error {
+	bf.m.RLock()
+	defer bf.m.RUnlock()
+
+	if !bf.initialized {
+		return buckets.ErrFactoryNotInitialized
+	}
+
+	return bf.readyErr
+}
+
+func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	return &coordinatedBucket{
+		delegate:  bf.local.NewBucket(namespace, bucketName, cfg, dyn),
+		factory:   bf,
+		cfg:       cfg,
+		instances: 1,
+		redisKeys: []string{fmt.Sprintf("%v:%v:%v", namespace, bucketName, INSTANCES_SUFFIX)}}
+}
+
+// coordinatedBucket owns this instance's share of a bucket's fill rate, in a local bucket.
+type coordinatedBucket struct {
+	delegate  buckets.Bucket
+	factory   *bucketFactory
+	cfg       *configs.BucketConfig // The configured bucket, before it is shared.
+	instances int64                 // The number of instances the fill rate was last shared between.
+	redisKeys []string
+	m         sync.RWMutex // Guards cfg and instances.
+}
+
+// Take announces this instance to the others using the bucket, reshares the fill rate if the
+// number of instances using it has changed, and takes tokens from this instance's share.
+func (b *coordinatedBucket) Take(numTokens int64, maxWaitTime time.Duration) time.Duration {
+	b.announce()
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.delegate.Take(numTokens, maxWaitTime)
+}
+
+// announce runs the announce script, and retunes the local bucket if the result differs from the
+// share it has.
+func (b *coordinatedBucket) announce() {
+	b.m.RLock()
+	fillRate := b.cfg.FillRate
+	b.m.RUnlock()
+
+	args := []string{strconv.FormatInt(time.Now().UnixNano(), 10), b.factory.instanceID,
+		strconv.FormatInt(InstanceTimeout.Nanoseconds(), 10), strconv.FormatInt(fillRate, 10)}
+
+	res, err := b.factory.client.EvalSha(b.factory.announceSHA, b.redisKeys, args).Result()
+	if err != nil {
+		logging.Printf("Unable to announce instance %v for %v: %v", b.factory.instanceID, b.redisKeys[0], err)
+		return
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		logging.Printf("Unknown response '%v' of type %T announcing %v", res, res, b.redisKeys[0])
+		return
+	}
+
+	instances, _ := vals[0].(int64)
+	share, _ := vals[1].(int64)
+	if instances < 1 || share < 1 {
+		logging.Printf("Unknown response '%v' announcing %v", res, b.redisKeys[0])
+		return
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if instances == b.instances || b.cfg.FillRate != fillRate {
+		// Unchanged, or tuned since the script ran, in which case the next Take() reshares.
+		return
+	}
+
+	if err := b.delegate.Tune(withFillRate(b.cfg, share)); err != nil {
+		logging.Printf("Unable to reshare %v between %v instances: %v", b.redisKeys[0], instances, err)
+		return
+	}
+
+	b.instances = instances
+}
+
+// shareOf returns the fill rate each of a number of instances owns, which, like in the announce
+// script, is never less than 1.
+func shareOf(fillRate, instances int64) int64 {
+	share := fillRate / instances
+	if share < 1 {
+		share = 1
+	}
+
+	return share
+}
+
+// withFillRate returns a copy of cfg with a different fill rate.
+func withFillRate(cfg *configs.BucketConfig, fillRate int64) *configs.BucketConfig {
+	share := *cfg
+	share.FillRate = fillRate
+	return &share
+}
+
+func (b *coordinatedBucket) AddTokens(numTokens int64) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	b.delegate.AddTokens(numTokens)
+}
+
+// Tune tunes this instance's share of the bucket, sharing the new fill rate between the same
+// number of instances as before.
+func (b *coordinatedBucket) Tune(cfg *configs.BucketConfig) error {
+	if err := buckets.ValidateTunedConfig(cfg); err != nil {
+		return err
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if err := b.delegate.Tune(withFillRate(cfg, shareOf(cfg.FillRate, b.instances))); err != nil {
+		return err
+	}
+
+	b.cfg = cfg
+	return nil
+}
+
+// Drain drains this instance's share of the bucket.
+func (b *coordinatedBucket) Drain() (int64, error) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.delegate.Drain()
+}
+
+// TokenLevelHistory returns the history of this instance's share of the bucket.
+func (b *coordinatedBucket) TokenLevelHistory(since time.Time, resolution time.Duration) []buckets.TokenSnapshot {
+	return b.delegate.TokenLevelHistory(since, resolution)
+}
+
+// Instances returns the number of instances the bucket's fill rate was last shared between.
+func (b *coordinatedBucket) Instances() int64 {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.instances
+}
+
+// Config returns the configuration of the bucket, before its fill rate is shared.
+func (b *coordinatedBucket) Config() *configs.BucketConfig {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.cfg
+}
+
+func (b *coordinatedBucket) Dynamic() bool {
+	return b.delegate.Dynamic()
+}
+
+func (b *coordinatedBucket) Destroy() {
+	b.delegate.Destroy()
+}
+
+func (b *coordinatedBucket) ActivityDetected() bool {
+	return b.delegate.ActivityDetected()
+}
+
+func (b *coordinatedBucket) ReportActivity() {
+	b.delegate.ReportActivity()
+}
+
+func (b *coordinatedBucket) ActivityCount() int64 {
+	if c, ok := b.delegate.(buckets.ActivityCounter); ok {
+		return c.ActivityCount()
+	}
+
+	return 0
+}
+
+// announceScript records that an instance is using a bucket, forgets instances that haven't used
+// it within the timeout, and returns the number of instances left and the fill rate each owns.
+const announceScript = `
+	local now = tonumber(ARGV[1])
+	local timeout = tonumber(ARGV[3])
+	local fillRate = tonumber(ARGV[4])
+
+	redis.call("ZADD", KEYS[1], now, ARGV[2])
+	redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - timeout)
+	redis.call("PEXPIRE", KEYS[1], math.ceil(timeout / 1000000))
+
+	local instances = redis.call("ZCARD", KEYS[1])
+	return {instances, math.max(1, math.floor(fillRate / instances))}
+`
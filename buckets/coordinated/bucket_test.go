@@ -0,0 +1,168 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package coordinated
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+	"gopkg.in/redis.v3"
+)
+
+var redisOpts = &redis.Options{Addr: "localhost:6379"}
+
+// newFactories creates a factory for each of a number of simulated instances, skipping the test if
+// Redis isn't available.
+func newFactories(tb testing.TB, instances int) []buckets.BucketFactory {
+	factories := make([]buckets.BucketFactory, instances)
+	for i := range factories {
+		factories[i] = NewCoordinatedBucketFactory(redisOpts, fmt.Sprintf("instance-%v", i))
+		factories[i].Init(configs.NewDefaultServiceConfig())
+		if !factories[i].Ready() {
+			tb.Skipf("Redis unavailable: %v", factories[i].ReadyErr())
+		}
+	}
+
+	return factories
+}
+
+// uniqueBucketName names a bucket no earlier run has announced instances for.
+func uniqueBucketName() string {
+	return fmt.Sprintf("b-%v", time.Now().UnixNano())
+}
+
+func TestShareOf(t *testing.T) {
+	for _, tc := range []struct {
+		fillRate, instances, share int64
+	}{
+		{100, 1, 100},
+		{100, 3, 33},
+		{100, 4, 25},
+		{2, 3, 1},
+	} {
+		if share := shareOf(tc.fillRate, tc.instances); share != tc.share {
+			t.Errorf("Expected a fill rate of %v shared by %v to be %v, but was %v",
+				tc.fillRate, tc.instances, tc.share, share)
+		}
+	}
+}
+
+func TestNotReadyBeforeInit(t *testing.T) {
+	bf := NewCoordinatedBucketFactory(redisOpts, "instance")
+	if bf.Ready() || bf.ReadyErr() != buckets.ErrFactoryNotInitialized {
+		t.Fatalf("Expecting factory not to be ready before Init. Was %v", bf.ReadyErr())
+	}
+}
+
+func TestInstancesShareFillRate(t *testing.T) {
+	factories := newFactories(t, 2)
+	name := uniqueBucketName()
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.FillRate = 100
+
+	b1 := factories[0].NewBucket("coordinated", name, cfg, false).(*coordinatedBucket)
+	b2 := factories[1].NewBucket("coordinated", name, cfg, false).(*coordinatedBucket)
+
+	b1.Take(1, 0)
+	if b1.Instances() != 1 || b1.delegate.Config().FillRate != 100 {
+		t.Fatalf("Expected the first instance to own the whole fill rate, but shared %v between %v",
+			b1.delegate.Config().FillRate, b1.Instances())
+	}
+
+	b2.Take(1, 0)
+	b1.Take(1, 0)
+	for i, b := range []*coordinatedBucket{b1, b2} {
+		if b.Instances() != 2 || b.delegate.Config().FillRate != 50 {
+			t.Errorf("Expected instance %v to own half the fill rate, but shared %v between %v",
+				i, b.delegate.Config().FillRate, b.Instances())
+		}
+
+		if b.Config() != cfg {
+			t.Errorf("Expected instance %v to report the configured bucket, but was %+v", i, b.Config())
+		}
+	}
+}
+
+func TestTuneKeepsShare(t *testing.T) {
+	factories := newFactories(t, 2)
+	name := uniqueBucketName()
+	cfg := configs.NewDefaultBucketConfig()
+
+	b1 := factories[0].NewBucket("coordinated", name, cfg, false).(*coordinatedBucket)
+	b2 := factories[1].NewBucket("coordinated", name, cfg, false).(*coordinatedBucket)
+	b1.Take(1, 0)
+	b2.Take(1, 0)
+
+	tuned := configs.NewDefaultBucketConfig()
+	tuned.FillRate = 1000
+	if err := b2.Tune(tuned); err != nil {
+		t.Fatal(err)
+	}
+
+	if b2.delegate.Config().FillRate != 500 {
+		t.Fatalf("Expected the tuned fill rate to be shared between 2, but was %v", b2.delegate.Config().FillRate)
+	}
+}
+
+// takeAll takes as many tokens as a set of buckets will grant without waiting, one at a time,
+// round-robin, over a period, and returns the total granted.
+func takeAll(bs []buckets.Bucket, period time.Duration) (granted int64) {
+	for end := time.Now().Add(period); time.Now().Before(end); {
+		for _, b := range bs {
+			if b.Take(1, 0) == 0 {
+				granted++
+			}
+		}
+	}
+
+	return
+}
+
+// benchmarkInstances reports the tokens granted by 3 simulated instances sharing a bucket, relative
+// to the tokens a single bucket would grant.
+func benchmarkInstances(b *testing.B, factories []buckets.BucketFactory) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 1
+	cfg.FillRate = 1000
+	cfg.MaxDebtMillis = 0
+	name := uniqueBucketName()
+
+	bs := make([]buckets.Bucket, len(factories))
+	for i, f := range factories {
+		bs[i] = f.NewBucket("coordinated", name, cfg, false)
+	}
+
+	// Announce all instances before measuring.
+	for _, bucket := range bs {
+		bucket.Take(1, 0)
+	}
+
+	b.ResetTimer()
+	var granted int64
+	period := 100 * time.Millisecond
+	for i := 0; i < b.N; i++ {
+		granted += takeAll(bs, period)
+	}
+
+	expected := float64(cfg.FillRate) * period.Seconds() * float64(b.N)
+	b.ReportMetric(float64(granted)/expected, "granted/expected")
+}
+
+func BenchmarkUncoordinated_3instances(b *testing.B) {
+	factories := make([]buckets.BucketFactory, 3)
+	for i := range factories {
+		factories[i] = memory.NewBucketFactory()
+		factories[i].Init(configs.NewDefaultServiceConfig())
+	}
+
+	benchmarkInstances(b, factories)
+}
+
+func BenchmarkCoordinated_3instances(b *testing.B) {
+	benchmarkInstances(b, newFactories(b, 3))
+}
@@ -0,0 +1,35 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// Degradation returns the level of a bucket's DegradationLadder that applies given the tokens it
+// has available, numbered from 1, and the level's action. Level 0, with no action, applies if the
+// bucket has more tokens than every level's threshold, has no ladder, or isn't a TokenCounter.
+func Degradation(b Bucket) (level int32, action configs.DegradationAction) {
+	ladder := b.Config().DegradationLadder
+	tc, ok := b.(TokenCounter)
+	if len(ladder) == 0 || !ok {
+		return 0, ""
+	}
+
+	size := b.Config().Size
+	if size < 1 {
+		return 0, ""
+	}
+
+	percent := tc.AvailableTokens() * 100 / size
+	for i, l := range ladder {
+		if percent > l.TokenThreshold {
+			break
+		}
+
+		level, action = int32(i+1), l.Action
+	}
+
+	return
+}
@@ -0,0 +1,105 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// DynamicBucketOverheadBytes is the estimated memory used by a dynamic bucket beyond its name and
+// config, such as its state, channels and goroutine.
+const DynamicBucketOverheadBytes = 2048
+
+// estimatedMemory estimates the memory used by a dynamic bucket.
+func estimatedMemory(bucketName string, cfg *configs.BucketConfig) int64 {
+	return int64(unsafe.Sizeof(*cfg)) + int64(len(bucketName)) + DynamicBucketOverheadBytes
+}
+
+// dynamicPool keeps the estimated memory used by the dynamic buckets of a namespace within its
+// MaxDynamicBucketMemoryBytes, by evicting the least recently used buckets.
+type dynamicPool struct {
+	maxBytes, usedBytes int64
+	lru                 *list.List // Of *poolEntry, most recently used first.
+	entries             map[string]*list.Element
+	sync.Mutex          // Embedded mutex
+}
+
+type poolEntry struct {
+	bucketName string
+	bytes      int64
+}
+
+func newDynamicPool(maxBytes int64) *dynamicPool {
+	return &dynamicPool{maxBytes: maxBytes, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// touch marks a bucket as the most recently used.
+func (p *dynamicPool) touch(bucketName string) {
+	p.Lock()
+	defer p.Unlock()
+	if e := p.entries[bucketName]; e != nil {
+		p.lru.MoveToFront(e)
+	}
+}
+
+// reserve adds a bucket to the pool, returning the names of the least recently used buckets to
+// evict to make room for it. Returns false if the bucket doesn't fit in the pool on its own.
+func (p *dynamicPool) reserve(bucketName string, bytes int64) (evicted []string, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if bytes > p.maxBytes {
+		return nil, false
+	}
+
+	for p.usedBytes+bytes > p.maxBytes && p.lru.Len() > 0 {
+		entry := p.lru.Back().Value.(*poolEntry)
+		p.removeEntry(entry.bucketName)
+		evicted = append(evicted, entry.bucketName)
+	}
+
+	p.entries[bucketName] = p.lru.PushFront(&poolEntry{bucketName, bytes})
+	p.usedBytes += bytes
+	return evicted, true
+}
+
+// remove removes a bucket that has been removed from its namespace, such as when idle.
+func (p *dynamicPool) remove(bucketName string) {
+	p.Lock()
+	defer p.Unlock()
+	p.removeEntry(bucketName)
+}
+
+func (p *dynamicPool) removeEntry(bucketName string) {
+	if e := p.entries[bucketName]; e != nil {
+		p.usedBytes -= e.Value.(*poolEntry).bytes
+		p.lru.Remove(e)
+		delete(p.entries, bucketName)
+	}
+}
+
+// DynamicBucketMemoryUsage returns the estimated memory used by the dynamic buckets of a
+// namespace, in bytes.
+func (bc *BucketContainer) DynamicBucketMemoryUsage(namespace string) int64 {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return 0
+	}
+
+	ns.RLock()
+	defer ns.RUnlock()
+
+	var usage int64
+	for bucketName, b := range ns.buckets {
+		if b.Dynamic() {
+			usage += estimatedMemory(bucketName, b.Config())
+		}
+	}
+
+	return usage
+}
@@ -0,0 +1,77 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync"
+	"time"
+)
+
+// EventStatus is the outcome of a quota decision.
+type EventStatus int
+
+const (
+	EVENT_OK EventStatus = iota
+	EVENT_OK_WAIT
+	EVENT_REJECTED
+)
+
+func (s EventStatus) String() string {
+	switch s {
+	case EVENT_OK:
+		return "OK"
+	case EVENT_OK_WAIT:
+		return "OK_WAIT"
+	case EVENT_REJECTED:
+		return "REJECTED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// QuotaEvent is a record of a single quota decision.
+type QuotaEvent struct {
+	Timestamp  time.Time
+	Namespace  string
+	BucketName string
+	Tokens     int64
+	Status     EventStatus
+}
+
+// eventLog is a fixed-size ring buffer of the most recent quota events.
+type eventLog struct {
+	events []QuotaEvent
+	next   int
+	full   bool
+	sync.Mutex // Embedded mutex
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]QuotaEvent, size)}
+}
+
+func (l *eventLog) record(e QuotaEvent) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// dump returns a copy of the events in the log, oldest first.
+func (l *eventLog) dump() []QuotaEvent {
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.full {
+		return append([]QuotaEvent(nil), l.events[:l.next]...)
+	}
+
+	events := make([]QuotaEvent, 0, len(l.events))
+	events = append(events, l.events[l.next:]...)
+	return append(events, l.events[:l.next]...)
+}
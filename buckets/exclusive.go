@@ -0,0 +1,32 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrLeaseHeld          = errors.New("Lease held by another caller")
+	ErrNoSuchLease        = errors.New("No such lease")
+	ErrNotExclusiveBucket = errors.New("Bucket doesn't support exclusive takes")
+)
+
+// ExclusiveBucket is implemented by buckets that let only one caller at a time, across all
+// instances sharing the bucket, hold a token, such as a slot to run a scheduled job in.
+type ExclusiveBucket interface {
+	Bucket
+	// TakeExclusive acquires the bucket's lease, waiting for it until ctx is done, and then takes a
+	// token as Take does. The lease is held until released using ReleaseExclusive(), or until
+	// lockTTL passes. ErrLeaseHeld is returned if another caller held the lease throughout. If the
+	// token isn't available within maxWaitTime, a negative wait time is returned, and the lease is
+	// released straight away.
+	TakeExclusive(ctx context.Context, maxWaitTime, lockTTL time.Duration) (waitTime time.Duration, leaseID string, err error)
+
+	// ReleaseExclusive releases a lease acquired using TakeExclusive(), returning ErrNoSuchLease if
+	// it has already been released or has expired.
+	ReleaseExclusive(leaseID string) error
+}
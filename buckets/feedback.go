@@ -0,0 +1,92 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// FeedbackPollInterval is how often feedback sources are polled.
+var FeedbackPollInterval = 5 * time.Second
+
+// FeedbackSource reports the health of a service downstream of a namespace's callers.
+type FeedbackSource interface {
+	// ErrorRate returns the fraction of recent requests to the downstream service that failed,
+	// between 0 and 1.
+	ErrorRate() float64
+}
+
+// feedback tunes down the fill rates of a namespace's buckets while its source reports a high
+// error rate. It holds on to the namespace rather than its name, so it follows renames.
+type feedback struct {
+	ns      *namespace
+	name    string // The namespace's name when the source was registered, for logging.
+	source  FeedbackSource
+	reduced bool
+	sync.Mutex
+}
+
+// RegisterFeedbackSource polls source every FeedbackPollInterval, and tunes the fill rates of a
+// namespace's buckets down by its FeedbackReductionFactor for as long as the source's error rate
+// exceeds the namespace's FeedbackErrorRateThreshold. Fill rates are restored once the error rate
+// recovers. The reduction combines with other fill rate modifiers, such as grace periods. Polling
+// stops when the container is stopped.
+func (bc *BucketContainer) RegisterFeedbackSource(namespace string, source FeedbackSource) error {
+	f, err := bc.newFeedback(namespace, source)
+	if err != nil {
+		return err
+	}
+
+	go bc.every(FeedbackPollInterval, f.check)
+	return nil
+}
+
+func (bc *BucketContainer) newFeedback(namespace string, source FeedbackSource) (*feedback, error) {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return nil, ErrNoSuchNamespace
+	}
+
+	if ns.cfg.FeedbackReductionFactor <= 0 {
+		return nil, fmt.Errorf("Namespace %v has no feedback_reduction_factor", namespace)
+	}
+
+	return &feedback{ns: ns, name: namespace, source: source}, nil
+}
+
+func (f *feedback) check() {
+	ns := f.ns
+	if ns == nil {
+		return
+	}
+
+	errorRate := f.source.ErrorRate()
+
+	f.Lock()
+	defer f.Unlock()
+
+	// Buckets created since the last check are tuned down too.
+	bs := namespaceBuckets(ns)
+	if errorRate <= ns.cfg.FeedbackErrorRateThreshold {
+		if f.reduced {
+			logging.Printf("Error rate %v for namespace %v recovered. Restoring fill rates.", errorRate, f.name)
+		}
+
+		f.reduced = false
+		ns.modifiers.set(f, 1, bs)
+		return
+	}
+
+	if !f.reduced {
+		logging.Printf("Error rate %v for namespace %v. Fill rates reduced by a factor of %v.",
+			errorRate, f.name, ns.cfg.FeedbackReductionFactor)
+	}
+
+	f.reduced = true
+	ns.modifiers.set(f, ns.cfg.FeedbackReductionFactor, bs)
+}
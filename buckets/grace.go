@@ -0,0 +1,97 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+var ErrInGracePeriod = errors.New("Namespace already in grace period")
+
+// gracePeriod scales up the fill rates of a namespace's buckets until it expires.
+type gracePeriod struct {
+	multiplier float64
+	expiry     time.Time
+}
+
+// EnterGracePeriod multiplies the fill rates of a namespace's buckets, including those created
+// during the grace period, by multiplier, until duration passes. This makes up for each instance
+// receiving a share of the traffic during deployments, such as rolling restarts, where old and new
+// instances serve requests at the same time. ErrInGracePeriod is returned if the namespace is
+// already in a grace period. The multiplier combines with other fill rate modifiers, such as
+// feedback sources.
+func (bc *BucketContainer) EnterGracePeriod(namespace string, multiplier float64, duration time.Duration) error {
+	if multiplier <= 0 {
+		return fmt.Errorf("Grace period multiplier %v should be positive", multiplier)
+	}
+
+	if duration <= 0 {
+		return fmt.Errorf("Grace period duration %v should be positive", duration)
+	}
+
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return ErrNoSuchNamespace
+	}
+
+	g := &gracePeriod{multiplier: multiplier, expiry: time.Now().Add(duration)}
+
+	ns.Lock()
+	if ns.grace != nil {
+		ns.Unlock()
+		return ErrInGracePeriod
+	}
+	ns.grace = g
+	ns.Unlock()
+
+	logging.Printf("Namespace %v entering grace period. Fill rates multiplied by %v until %v.",
+		namespace, multiplier, g.expiry)
+
+	// Buckets created from now on are tuned up when they are created.
+	ns.modifiers.set(g, multiplier, namespaceBuckets(ns))
+
+	time.AfterFunc(duration, func() {
+		bc.endGracePeriod(namespace, ns, g)
+	})
+
+	return nil
+}
+
+// IsInGracePeriod tells you whether a namespace's fill rates are multiplied by a grace period.
+func (bc *BucketContainer) IsInGracePeriod(namespace string) bool {
+	return !bc.GracePeriodExpiry(namespace).IsZero()
+}
+
+// GracePeriodExpiry returns the time a namespace's grace period expires, or the zero time if it
+// isn't in one.
+func (bc *BucketContainer) GracePeriodExpiry(namespace string) time.Time {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return time.Time{}
+	}
+
+	ns.RLock()
+	defer ns.RUnlock()
+
+	if ns.grace == nil {
+		return time.Time{}
+	}
+
+	return ns.grace.expiry
+}
+
+func (bc *BucketContainer) endGracePeriod(namespace string, ns *namespace, g *gracePeriod) {
+	ns.Lock()
+	if ns.grace == g {
+		ns.grace = nil
+	}
+	ns.Unlock()
+
+	ns.modifiers.set(g, 1, namespaceBuckets(ns))
+	logging.Printf("Grace period for namespace %v expired. Fill rates restored.", namespace)
+}
@@ -0,0 +1,155 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// LowTokensRatio is the fraction of a bucket's capacity below which its token count is
+	// considered low.
+	LowTokensRatio = 0.01
+	// LowTokensDuration is how long a bucket's token count may stay low before it is reported as
+	// unhealthy.
+	LowTokensDuration = time.Minute
+)
+
+// TokenCounter is implemented by buckets that are able to report how many tokens they hold.
+type TokenCounter interface {
+	// AvailableTokens returns the number of tokens that can be taken without waiting.
+	AvailableTokens() int64
+}
+
+// BucketHealthIssue describes a problem found with a bucket.
+type BucketHealthIssue struct {
+	Namespace  string
+	BucketName string
+	Problem    string
+}
+
+// BucketHealthReport lists the buckets found to be in a bad state.
+type BucketHealthReport struct {
+	Timestamp        time.Time
+	UnhealthyBuckets []BucketHealthIssue
+}
+
+// Healthy tells you if no problems were found.
+func (r *BucketHealthReport) Healthy() bool {
+	return len(r.UnhealthyBuckets) == 0
+}
+
+// healthTracker remembers state between health reports, for heuristics that span time.
+type healthTracker struct {
+	lowTokensSince map[Bucket]time.Time
+	sync.Mutex // Embedded mutex
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{lowTokensSince: make(map[Bucket]time.Time)}
+}
+
+// checkTokens reports a bucket whose token count has been low for longer than LowTokensDuration.
+// Since this is measured across calls, it relies on health reports being requested periodically.
+func (h *healthTracker) checkTokens(now time.Time, b Bucket) (problem string) {
+	tc, ok := b.(TokenCounter)
+	if !ok {
+		return
+	}
+
+	if float64(tc.AvailableTokens()) >= float64(b.Config().Size) * LowTokensRatio {
+		delete(h.lowTokensSince, b)
+		return
+	}
+
+	since, ok := h.lowTokensSince[b]
+	if !ok {
+		h.lowTokensSince[b] = now
+	} else if low := now.Sub(since); low > LowTokensDuration {
+		problem = fmt.Sprintf("token count below %v%% of capacity for %v", LowTokensRatio * 100, low)
+	}
+
+	return
+}
+
+// HealthReport checks all buckets in the container for problems, using the following heuristics:
+//  - A bucket that should be removed when idle isn't being watched for activity.
+//  - A bucket's token count has stayed below LowTokensRatio of its capacity for longer than
+//    LowTokensDuration. Only buckets that implement TokenCounter are checked.
+func (bc *BucketContainer) HealthReport() *BucketHealthReport {
+	report := &BucketHealthReport{Timestamp: time.Now()}
+
+	type namedBucket struct {
+		namespace, bucketName string
+		bucket                Bucket
+	}
+
+	var all []namedBucket
+	if bc.defaultBucket != nil {
+		all = append(all, namedBucket{GLOBAL_NAMESPACE, DEFAULT_BUCKET_NAME, bc.defaultBucket})
+	}
+
+	bc.registry().Walk(func(nsName string, v interface{}) {
+		ns := v.(*namespace)
+		ns.RLock()
+		for bName, b := range ns.buckets {
+			all = append(all, namedBucket{nsName, bName, b})
+			if b.Config().MaxIdleMillis != 0 && ns.watchers[bName] != b {
+				report.UnhealthyBuckets = append(report.UnhealthyBuckets,
+					BucketHealthIssue{nsName, bName, "watch goroutine not running"})
+			}
+		}
+		ns.RUnlock()
+
+		if ns.defaultBucket != nil {
+			all = append(all, namedBucket{nsName, DEFAULT_BUCKET_NAME, ns.defaultBucket})
+		}
+
+		if ns.aggregateBucket != nil {
+			all = append(all, namedBucket{nsName, AGGREGATE_BUCKET_NAME, ns.aggregateBucket})
+		}
+	})
+
+	bc.health.Lock()
+	defer bc.health.Unlock()
+
+	live := make(map[Bucket]bool)
+	for _, nb := range all {
+		live[nb.bucket] = true
+		if problem := bc.health.checkTokens(report.Timestamp, nb.bucket); problem != "" {
+			report.UnhealthyBuckets = append(report.UnhealthyBuckets,
+				BucketHealthIssue{nb.namespace, nb.bucketName, problem})
+		}
+	}
+
+	// Forget buckets that have been removed.
+	for b := range bc.health.lowTokensSince {
+		if !live[b] {
+			delete(bc.health.lowTokensSince, b)
+		}
+	}
+
+	sort.Sort(byBucket(report.UnhealthyBuckets))
+	return report
+}
+
+type byBucket []BucketHealthIssue
+
+func (b byBucket) Len() int {
+	return len(b)
+}
+
+func (b byBucket) Less(i, j int) bool {
+	if b[i].Namespace != b[j].Namespace {
+		return b[i].Namespace < b[j].Namespace
+	}
+	return b[i].BucketName < b[j].BucketName
+}
+
+func (b byBucket) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
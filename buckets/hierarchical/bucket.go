@@ -0,0 +1,179 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package hierarchical implements token buckets that are limited by parent buckets, much like a
+// cgroup hierarchy. Tokens are only granted if the bucket and all of its ancestors grant them, so a
+// parent bucket caps the combined rate of all buckets beneath it, while each child caps its own.
+//
+// Trees are built by a factory from the ParentName of each named bucket in a namespace. Named
+// buckets are shared by all buckets beneath them, so the factory keeps them until it is initialized
+// with a new config.
+package hierarchical
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// HierarchicalBucket takes tokens from a child bucket, and then from its parent. The parent may
+// itself be a HierarchicalBucket, so buckets nest arbitrarily deep. Everything but Take() and
+// AddTokens() applies to the child only.
+type HierarchicalBucket struct {
+	buckets.Bucket // The child.
+	parent         buckets.Bucket
+}
+
+// NewHierarchicalBucket creates a bucket that grants tokens only if both child and parent grant
+// them.
+func NewHierarchicalBucket(parent, child buckets.Bucket) *HierarchicalBucket {
+	return &HierarchicalBucket{Bucket: child, parent: parent}
+}
+
+// Take takes tokens from the child first, and if the child grants them, from the parent. If the
+// parent rejects the request, the tokens taken from the child are returned to it. The longer wait
+// applies.
+func (b *HierarchicalBucket) Take(numTokens int64, maxWaitTime time.Duration) time.Duration {
+	waitTime := b.Bucket.Take(numTokens, maxWaitTime)
+	if waitTime < 0 {
+		return waitTime
+	}
+
+	parentWaitTime := b.parent.Take(numTokens, maxWaitTime)
+	if parentWaitTime < 0 {
+		b.Bucket.AddTokens(numTokens)
+		return parentWaitTime
+	}
+
+	if parentWaitTime > waitTime {
+		waitTime = parentWaitTime
+	}
+
+	return waitTime
+}
+
+// AddTokens adds tokens to the child and all its ancestors, since they were all taken from.
+func (b *HierarchicalBucket) AddTokens(numTokens int64) {
+	b.Bucket.AddTokens(numTokens)
+	b.parent.AddTokens(numTokens)
+}
+
+// Parent returns the bucket limiting this one.
+func (b *HierarchicalBucket) Parent() buckets.Bucket {
+	return b.parent
+}
+
+// HierarchicalBucketFactory creates buckets using a delegate factory, nested beneath the bucket
+// named by the ParentName of their config.
+type HierarchicalBucketFactory struct {
+	delegate buckets.BucketFactory
+	cfg      *configs.ServiceConfig
+	named    map[string]*sharedBucket // Shared named buckets, by fully qualified name.
+	sync.Mutex
+}
+
+// NewBucketFactory creates a factory that nests buckets created by delegate.
+func NewBucketFactory(delegate buckets.BucketFactory) *HierarchicalBucketFactory {
+	return &HierarchicalBucketFactory{delegate: delegate, named: make(map[string]*sharedBucket)}
+}
+
+// Init discards the named buckets created for any previous config.
+func (bf *HierarchicalBucketFactory) Init(cfg *configs.ServiceConfig) {
+	bf.Lock()
+	defer bf.Unlock()
+
+	for _, b := range bf.named {
+		b.Bucket.Destroy()
+	}
+	bf.named = make(map[string]*sharedBucket)
+	bf.cfg = cfg
+	bf.delegate.Init(cfg)
+}
+
+func (bf *HierarchicalBucketFactory) Ready() bool {
+	return bf.delegate.Ready()
+}
+
+func (bf *HierarchicalBucketFactory) ReadyErr() error {
+	return bf.delegate.ReadyErr()
+}
+
+func (bf *HierarchicalBucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	bf.Lock()
+	defer bf.Unlock()
+
+	var b buckets.Bucket
+	if dyn {
+		b = bf.delegate.NewBucket(namespace, bucketName, cfg, dyn)
+	} else {
+		b = bf.namedBucket(namespace, bucketName, cfg)
+	}
+
+	visited := map[string]bool{bucketName: true}
+	if parent := bf.parentOf(namespace, bucketName, cfg, visited); parent != nil {
+		return NewHierarchicalBucket(parent, b)
+	}
+
+	return b
+}
+
+// namedBucket returns the shared bucket for a named bucket, creating it if needed, or tuning it if
+// its config has changed. Must be called with the lock held.
+func (bf *HierarchicalBucketFactory) namedBucket(namespace, bucketName string, cfg *configs.BucketConfig) buckets.Bucket {
+	fqn := buckets.FullyQualifiedName(namespace, bucketName)
+	b := bf.named[fqn]
+	if b != nil && b.cfg != cfg {
+		if err := b.Tune(cfg); err != nil {
+			logging.Printf("Unable to tune bucket %v: %v. Replacing it.", fqn, err)
+			b = nil
+		} else {
+			b.cfg = cfg
+		}
+	}
+
+	if b == nil {
+		b = &sharedBucket{Bucket: bf.delegate.NewBucket(namespace, bucketName, cfg, false), cfg: cfg}
+		bf.named[fqn] = b
+	}
+
+	return b
+}
+
+// parentOf returns the parent of a bucket, nested beneath its own parent, or nil if it has none.
+// Must be called with the lock held.
+func (bf *HierarchicalBucketFactory) parentOf(namespace, bucketName string, cfg *configs.BucketConfig, visited map[string]bool) buckets.Bucket {
+	if cfg.ParentName == "" {
+		return nil
+	}
+
+	var parentCfg *configs.BucketConfig
+	if nsCfg := bf.cfg.Namespaces[namespace]; nsCfg != nil {
+		parentCfg = nsCfg.Buckets[cfg.ParentName]
+	}
+
+	if parentCfg == nil || visited[cfg.ParentName] {
+		logging.Printf("Bucket %v:%v has a parent %v which doesn't exist, or is its own ancestor. Ignoring it.",
+			namespace, bucketName, cfg.ParentName)
+		return nil
+	}
+
+	visited[cfg.ParentName] = true
+	parent := bf.namedBucket(namespace, cfg.ParentName, parentCfg)
+	if grandparent := bf.parentOf(namespace, cfg.ParentName, parentCfg, visited); grandparent != nil {
+		return NewHierarchicalBucket(grandparent, parent)
+	}
+
+	return parent
+}
+
+// sharedBucket is a named bucket that other buckets may be nested beneath, so it outlives the
+// buckets the container creates for it.
+type sharedBucket struct {
+	buckets.Bucket
+	cfg *configs.BucketConfig // The config the factory last created or tuned it with.
+}
+
+func (b *sharedBucket) Destroy() {}
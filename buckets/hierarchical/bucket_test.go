@@ -0,0 +1,160 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package hierarchical
+
+import (
+	"testing"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+func bucketConfig(size int64, parentName string) *configs.BucketConfig {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = size
+	cfg.FillRate = 1
+	cfg.MaxDebtMillis = 0
+	cfg.ParentName = parentName
+	return cfg
+}
+
+func newMemoryBucket(size int64) buckets.Bucket {
+	bf := memory.NewBucketFactory()
+	bf.Init(configs.NewDefaultServiceConfig())
+	return bf.NewBucket("n", "b", bucketConfig(size, ""), false)
+}
+
+func expectTokens(t *testing.T, b buckets.Bucket, expected int64) {
+	if tokens := b.(buckets.TokenCounter).AvailableTokens(); tokens != expected {
+		t.Fatalf("Expecting %v tokens available. Was %v", expected, tokens)
+	}
+}
+
+func TestLeafExhausted(t *testing.T) {
+	parent, child := newMemoryBucket(10), newMemoryBucket(2)
+	defer parent.Destroy()
+	b := NewHierarchicalBucket(parent, child)
+	defer b.Destroy()
+
+	if w := b.Take(2, 0); w != 0 {
+		t.Fatalf("Expecting tokens to be granted. Wait was %v", w)
+	}
+
+	if w := b.Take(1, 0); w > -1 {
+		t.Fatalf("Expecting the child to reject the request. Wait was %v", w)
+	}
+
+	// The parent isn't touched by requests its child rejects.
+	expectTokens(t, parent, 8)
+}
+
+func TestParentExhausted(t *testing.T) {
+	parent, child := newMemoryBucket(2), newMemoryBucket(10)
+	defer parent.Destroy()
+	b := NewHierarchicalBucket(parent, child)
+	defer b.Destroy()
+
+	if w := b.Take(2, 0); w != 0 {
+		t.Fatalf("Expecting tokens to be granted. Wait was %v", w)
+	}
+
+	if w := b.Take(3, 0); w > -1 {
+		t.Fatalf("Expecting the parent to reject the request. Wait was %v", w)
+	}
+
+	// Tokens taken from the child are returned to it.
+	expectTokens(t, child, 8)
+}
+
+func TestDeepNesting(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["org"] = bucketConfig(5, "")
+	cfg.Namespaces["n"].Buckets["team"] = bucketConfig(10, "org")
+	cfg.Namespaces["n"].Buckets["service"] = bucketConfig(10, "team")
+	cfg.Namespaces["n"].Buckets["other"] = bucketConfig(10, "team")
+
+	bf := NewBucketFactory(memory.NewBucketFactory())
+	bf.Init(cfg)
+	service := bf.NewBucket("n", "service", cfg.Namespaces["n"].Buckets["service"], false)
+	other := bf.NewBucket("n", "other", cfg.Namespaces["n"].Buckets["other"], false)
+
+	if w := service.Take(3, 0); w != 0 {
+		t.Fatalf("Expecting tokens to be granted. Wait was %v", w)
+	}
+
+	// Siblings share their ancestors, so the org only has 2 tokens left.
+	if w := other.Take(3, 0); w > -1 {
+		t.Fatalf("Expecting the org bucket to reject the request. Wait was %v", w)
+	}
+
+	if w := other.Take(2, 0); w != 0 {
+		t.Fatalf("Expecting tokens to be granted. Wait was %v", w)
+	}
+
+	team := bf.NewBucket("n", "team", cfg.Namespaces["n"].Buckets["team"], false).(*HierarchicalBucket)
+	expectTokens(t, team.Bucket.(*sharedBucket).Bucket, 5)
+	expectTokens(t, team.Parent().(*sharedBucket).Bucket, 0)
+	expectTokens(t, other.(*HierarchicalBucket).Bucket.(*sharedBucket).Bucket, 8)
+}
+
+func TestDynamicBucketsUseTemplateParent(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["all"] = bucketConfig(3, "")
+	cfg.Namespaces["n"].DynamicBucketTemplate = bucketConfig(2, "all")
+
+	bf := NewBucketFactory(memory.NewBucketFactory())
+	bf.Init(cfg)
+
+	for _, name := range []string{"a", "b"} {
+		b := bf.NewBucket("n", name, cfg.Namespaces["n"].DynamicBucketTemplate, true)
+		defer b.Destroy()
+		if w := b.Take(2, 0); (name == "a") != (w == 0) {
+			t.Fatalf("Unexpected wait %v for dynamic bucket %v", w, name)
+		}
+	}
+}
+
+func TestReconfiguration(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["org"] = bucketConfig(5, "")
+	cfg.Namespaces["n"].Buckets["team"] = bucketConfig(10, "org")
+
+	bf := NewBucketFactory(memory.NewBucketFactory())
+	bf.Init(cfg)
+	team := bf.NewBucket("n", "team", cfg.Namespaces["n"].Buckets["team"], false).(*HierarchicalBucket)
+	if size := team.Parent().Config().Size; size != 5 {
+		t.Fatalf("Expecting the org bucket to have size 5. Was %v", size)
+	}
+
+	// Reloaded configs replace the named buckets.
+	reloaded := configs.NewDefaultServiceConfig()
+	reloaded.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	reloaded.Namespaces["n"].Buckets["org"] = bucketConfig(50, "")
+	reloaded.Namespaces["n"].Buckets["team"] = bucketConfig(10, "org")
+	bf.Init(reloaded)
+
+	org := bf.NewBucket("n", "org", reloaded.Namespaces["n"].Buckets["org"], false)
+	if size := org.Config().Size; size != 50 {
+		t.Fatalf("Expecting the reloaded org bucket to have size 50. Was %v", size)
+	}
+
+	team = bf.NewBucket("n", "team", reloaded.Namespaces["n"].Buckets["team"], false).(*HierarchicalBucket)
+	if team.Parent() != org {
+		t.Fatal("Expecting the team bucket to be nested beneath the reloaded org bucket")
+	}
+
+	// Named buckets created with a changed config are tuned.
+	org = bf.NewBucket("n", "org", bucketConfig(100, ""), false)
+	if size := org.Config().Size; size != 100 {
+		t.Fatalf("Expecting the org bucket to be tuned to size 100. Was %v", size)
+	}
+
+	if team.Parent() != org {
+		t.Fatal("Expecting buckets nested beneath the org bucket to share the tuned bucket")
+	}
+}
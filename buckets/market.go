@@ -0,0 +1,102 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"math"
+	"sort"
+
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// marketParticipant is a namespace taking part in the borrow market, and the tokens it may lend,
+// or needs to borrow.
+type marketParticipant struct {
+	namespace   string
+	utilisation float64
+	tokens      int64
+}
+
+// runBorrowMarket moves tokens from the aggregate buckets of namespaces below the lending threshold
+// to those above the borrowing threshold, using DonateTokens(). Borrowers are served busiest first,
+// by the least busy lenders first. The market is best-effort: tokens are counted before they are
+// moved, and requests may take or return tokens in between, so donations may fail, or leave
+// namespaces short of, or beyond, their thresholds.
+func (bc *BucketContainer) runBorrowMarket(cfg *configs.BorrowMarketConfig) {
+	var lenders, borrowers []*marketParticipant
+	bc.registry().Walk(func(nsName string, v interface{}) {
+		ns := v.(*namespace)
+		agg, ok := ns.aggregateBucket.(TokenCounter)
+		if !ok {
+			return
+		}
+
+		size := float64(ns.aggregateBucket.Config().Size)
+		if size <= 0 {
+			return
+		}
+
+		available := float64(agg.AvailableTokens())
+		utilisation := 100 * (size - available) / size
+		switch {
+		case utilisation < cfg.LendingThreshold:
+			// Lenders stay at or below the lending threshold.
+			floor := math.Ceil(size * (100 - cfg.LendingThreshold) / 100)
+			if lendable := int64(available - floor); lendable > 0 {
+				lenders = append(lenders, &marketParticipant{nsName, utilisation, lendable})
+			}
+		case utilisation > cfg.BorrowingThreshold:
+			// Borrowers are brought back down to the borrowing threshold.
+			target := math.Ceil(size * (100 - cfg.BorrowingThreshold) / 100)
+			if needed := int64(target - available); needed > 0 {
+				borrowers = append(borrowers, &marketParticipant{nsName, utilisation, needed})
+			}
+		}
+	})
+
+	sort.Sort(byUtilisation(lenders))
+	sort.Sort(sort.Reverse(byUtilisation(borrowers)))
+
+	for _, b := range borrowers {
+		for _, l := range lenders {
+			if b.tokens == 0 {
+				break
+			}
+
+			if l.tokens == 0 {
+				continue
+			}
+
+			tokens := l.tokens
+			if b.tokens < tokens {
+				tokens = b.tokens
+			}
+
+			switch err := bc.DonateTokens(l.namespace, b.namespace, tokens); err {
+			case nil:
+				l.tokens -= tokens
+				b.tokens -= tokens
+			case ErrDonationNotAccepted:
+			default:
+				logging.Printf("Borrow market unable to move %v tokens from namespace %v to %v: %v",
+					tokens, l.namespace, b.namespace, err)
+			}
+		}
+	}
+}
+
+type byUtilisation []*marketParticipant
+
+func (b byUtilisation) Len() int {
+	return len(b)
+}
+
+func (b byUtilisation) Less(i, j int) bool {
+	return b[i].utilisation < b[j].utilisation
+}
+
+func (b byUtilisation) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
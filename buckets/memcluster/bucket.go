@@ -0,0 +1,178 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package memcluster implements token buckets that are shared by all bucket factories in the same
+// process with the same cluster ID. This simulates multiple instances of the quota service sharing
+// buckets, as they would with Redis, and is useful for testing multi-instance logic without Redis.
+package memcluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// registry holds all clusters in this process, keyed by cluster ID.
+var registry = struct {
+	clusters map[string]*cluster
+	sync.Mutex
+}{clusters: make(map[string]*cluster)}
+
+// cluster holds the buckets shared by all factories with the same cluster ID.
+type cluster struct {
+	bf      buckets.BucketFactory
+	buckets map[string]*sharedBucket
+	sync.Mutex
+}
+
+// sharedBucket is a bucket shared by all factories in a cluster, and the number of live buckets
+// that refer to it.
+type sharedBucket struct {
+	buckets.Bucket
+	refs int
+}
+
+func clusterFor(clusterID string) *cluster {
+	registry.Lock()
+	defer registry.Unlock()
+
+	c := registry.clusters[clusterID]
+	if c == nil {
+		bf := memory.NewBucketFactory()
+		bf.Init(configs.NewDefaultServiceConfig())
+		c = &cluster{bf: bf, buckets: make(map[string]*sharedBucket)}
+		registry.clusters[clusterID] = c
+	}
+
+	return c
+}
+
+// acquire returns the shared bucket for a fully qualified bucket name, creating it using cfg if
+// it doesn't exist.
+func (c *cluster) acquire(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) *sharedBucket {
+	c.Lock()
+	defer c.Unlock()
+
+	fqn := buckets.FullyQualifiedName(namespace, bucketName)
+	shared := c.buckets[fqn]
+	if shared == nil {
+		shared = &sharedBucket{Bucket: c.bf.NewBucket(namespace, bucketName, cfg, dyn)}
+		c.buckets[fqn] = shared
+	}
+
+	shared.refs++
+	return shared
+}
+
+// release destroys a shared bucket once no live buckets refer to it.
+func (c *cluster) release(namespace, bucketName string) {
+	c.Lock()
+	defer c.Unlock()
+
+	fqn := buckets.FullyQualifiedName(namespace, bucketName)
+	shared := c.buckets[fqn]
+	shared.refs--
+	if shared.refs == 0 {
+		delete(c.buckets, fqn)
+		shared.Destroy()
+	}
+}
+
+type bucketFactory struct {
+	clusterID   string
+	cluster     *cluster
+	initialized bool
+	sync.RWMutex
+}
+
+// NewClusterBucketFactory creates a factory whose buckets share their tokens with buckets of the
+// same name created by any other factory in this process with the same cluster ID. The first
+// factory to create a bucket determines its configuration.
+func NewClusterBucketFactory(clusterID string) buckets.BucketFactory {
+	return &bucketFactory{clusterID: clusterID, cluster: clusterFor(clusterID)}
+}
+
+func (bf *bucketFactory) Init(cfg *configs.ServiceConfig) {
+	bf.Lock()
+	defer bf.Unlock()
+	bf.initialized = true
+}
+
+func (bf *bucketFactory) Ready() bool {
+	return bf.ReadyErr() == nil
+}
+
+func (bf *bucketFactory) ReadyErr() error {
+	bf.RLock()
+	defer bf.RUnlock()
+
+	if !bf.initialized {
+		return buckets.ErrFactoryNotInitialized
+	}
+
+	return nil
+}
+
+func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	return &clusterBucket{
+		ActivityChannel: buckets.NewActivityChannel(),
+		cluster:         bf.cluster,
+		shared:          bf.cluster.acquire(namespace, bucketName, cfg, dyn),
+		namespace:       namespace,
+		bucketName:      bucketName,
+		dynamic:         dyn}
+}
+
+// clusterBucket is this factory's reference to a shared bucket. Activity is tracked per reference,
+// so that each factory's BucketContainer removes idle buckets independently.
+type clusterBucket struct {
+	buckets.ActivityChannel
+	cluster    *cluster
+	shared     *sharedBucket
+	namespace  string
+	bucketName string
+	dynamic    bool
+	destroyed  sync.Once
+}
+
+func (b *clusterBucket) Take(numTokens int64, maxWaitTime time.Duration) time.Duration {
+	return b.shared.Take(numTokens, maxWaitTime)
+}
+
+func (b *clusterBucket) AddTokens(numTokens int64) {
+	b.shared.AddTokens(numTokens)
+}
+
+// Tune tunes the shared bucket, affecting all factories in the cluster.
+func (b *clusterBucket) Tune(cfg *configs.BucketConfig) error {
+	return b.shared.Tune(cfg)
+}
+
+// Drain drains the shared bucket, affecting all factories in the cluster.
+func (b *clusterBucket) Drain() (int64, error) {
+	return b.shared.Drain()
+}
+
+// TokenLevelHistory returns the history of the shared bucket.
+func (b *clusterBucket) TokenLevelHistory(since time.Time, resolution time.Duration) []buckets.TokenSnapshot {
+	return b.shared.TokenLevelHistory(since, resolution)
+}
+
+func (b *clusterBucket) Config() *configs.BucketConfig {
+	return b.shared.Config()
+}
+
+func (b *clusterBucket) Dynamic() bool {
+	return b.dynamic
+}
+
+// Destroy releases this reference to the shared bucket, which is destroyed once all factories in
+// the cluster have released it.
+func (b *clusterBucket) Destroy() {
+	b.destroyed.Do(func() {
+		b.cluster.release(b.namespace, b.bucketName)
+	})
+}
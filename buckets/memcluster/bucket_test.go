@@ -0,0 +1,86 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memcluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+func newFactory(clusterID string) buckets.BucketFactory {
+	bf := NewClusterBucketFactory(clusterID)
+	bf.Init(configs.NewDefaultServiceConfig())
+	return bf
+}
+
+func newBucket(bf buckets.BucketFactory) buckets.Bucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 10
+	cfg.FillRate = 1
+	return bf.NewBucket("n", "b", cfg, false)
+}
+
+func TestContention(t *testing.T) {
+	b1 := newBucket(newFactory("contention"))
+	b2 := newBucket(newFactory("contention"))
+	defer b1.Destroy()
+	defer b2.Destroy()
+
+	if w := b1.Take(10, time.Nanosecond); w != 0 {
+		t.Fatalf("Expecting 0 wait. Was %v", w)
+	}
+
+	// Instance 1 has used all tokens, so instance 2 can only borrow a token from the future.
+	if w := b2.Take(1, 0); w != 0 {
+		t.Fatalf("Expecting the first borrowed token to be granted without a wait. Was %v", w)
+	}
+
+	if w := b2.Take(1, time.Nanosecond); w != -1 {
+		t.Fatalf("Expecting no tokens. Was %v", w)
+	}
+}
+
+func TestSeparateClusters(t *testing.T) {
+	b1 := newBucket(newFactory("cluster1"))
+	b2 := newBucket(newFactory("cluster2"))
+	defer b1.Destroy()
+	defer b2.Destroy()
+
+	b1.Take(10, 0)
+	b1.Take(1, 0)
+	if w := b2.Take(10, time.Nanosecond); w != 0 {
+		t.Fatalf("Expecting buckets in different clusters not to share tokens. Was %v", w)
+	}
+}
+
+func TestSharedBucketOutlivesReference(t *testing.T) {
+	b1 := newBucket(newFactory("outlive"))
+	b2 := newBucket(newFactory("outlive"))
+	defer b2.Destroy()
+
+	b1.Take(10, 0)
+	b1.Destroy()
+	b1.Destroy()
+
+	// The shared bucket is still referenced by instance 2, so its tokens are still used up.
+	b2.Take(1, 0)
+	if w := b2.Take(1, time.Nanosecond); w != -1 {
+		t.Fatalf("Expecting no tokens. Was %v", w)
+	}
+}
+
+func TestReady(t *testing.T) {
+	bf := NewClusterBucketFactory("ready")
+	if bf.Ready() {
+		t.Fatal("Expecting factory not to be ready before Init")
+	}
+
+	bf.Init(configs.NewDefaultServiceConfig())
+	if !bf.Ready() {
+		t.Fatal("Expecting factory to be ready after Init")
+	}
+}
@@ -0,0 +1,101 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"math"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+const (
+	// autoTuneWindow is the window over which the rate of tokens requested is measured.
+	autoTuneWindow = time.Second
+	// autoTuneAlpha is the weight of the latest window in the moving average of demand.
+	autoTuneAlpha = 0.3
+	// autoTuneMinRequests is the number of requests observed before a fill rate is raised.
+	autoTuneMinRequests = 100
+	// autoTuneThreshold is the multiple of the fill rate that demand needs to exceed for the fill
+	// rate to be raised.
+	autoTuneThreshold = 1.1
+)
+
+// demandTracker keeps an exponentially weighted moving average of the rate of tokens requested
+// from a bucket. It is only accessed by the bucket's goroutine.
+type demandTracker struct {
+	windowStartNanos, windowTokens int64
+	requests                       int
+	// tokensPerSec is the moving average, which is 0 until the first window closes.
+	tokensPerSec float64
+}
+
+// observe records a request for tokens, and returns the moving average of demand.
+func (d *demandTracker) observe(tokens, currentTimeNanos int64) float64 {
+	if d.windowStartNanos == 0 {
+		d.windowStartNanos = currentTimeNanos
+	}
+
+	if elapsed := currentTimeNanos - d.windowStartNanos; elapsed >= autoTuneWindow.Nanoseconds() {
+		rate := float64(d.windowTokens) * 1e9 / float64(elapsed)
+		if d.tokensPerSec == 0 {
+			d.tokensPerSec = rate
+		} else {
+			d.tokensPerSec = autoTuneAlpha*rate + (1-autoTuneAlpha)*d.tokensPerSec
+		}
+
+		d.windowStartNanos = currentTimeNanos
+		d.windowTokens = 0
+	}
+
+	d.windowTokens += tokens
+	d.requests++
+	return d.tokensPerSec
+}
+
+// autoTune raises the bucket's fill rate to match demand, once enough requests have been seen and
+// demand exceeds the fill rate by autoTuneThreshold. Runs on the bucket's goroutine.
+func (b *tokenBucket) autoTune(requested, currentTimeNanos int64) {
+	if !b.cfg.AutoTune {
+		return
+	}
+
+	if b.demand == nil {
+		b.demand = &demandTracker{}
+	}
+
+	demand := b.demand.observe(requested, currentTimeNanos)
+	if b.demand.requests < autoTuneMinRequests || demand <= float64(b.cfg.FillRate)*autoTuneThreshold {
+		return
+	}
+
+	fillRate := int64(demand)
+	if limit := b.autoTuneLimit(); fillRate > limit {
+		fillRate = limit
+	}
+
+	if fillRate <= b.cfg.FillRate {
+		return
+	}
+
+	logging.Printf("Demand for bucket %v is %.1f tokens per second. Fill rate raised from %v to %v.",
+		b.fullName, demand, b.cfg.FillRate, fillRate)
+	tuned := *b.cfg
+	tuned.FillRate = fillRate
+	b.tune(&tuned)
+}
+
+// autoTuneLimit returns the highest fill rate AutoTune may raise the bucket's fill rate to.
+func (b *tokenBucket) autoTuneLimit() int64 {
+	limit := int64(math.MaxInt64)
+	if m := b.cfg.AutoTuneCapMultiplier; m > 0 {
+		limit = int64(float64(b.baseFillRate) * m)
+	}
+
+	if max := b.cfg.AutoTuneMaxFillRate; max > 0 && max < limit {
+		limit = max
+	}
+
+	return limit
+}
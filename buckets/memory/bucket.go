@@ -6,6 +6,9 @@
 package memory
 
 import (
+	"math"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/maniksurtani/quotaservice/buckets"
@@ -14,13 +17,29 @@ import (
 )
 
 type bucketFactory struct {
-	cfg *configs.ServiceConfig
+	cfg      *configs.ServiceConfig
+	detector *DeadlockDetector // nil unless buckets are checked for deadlocks.
+	statsDir string // Empty unless buckets configured with PersistStats persist their stats.
 }
 
 func (bf *bucketFactory) Init(cfg *configs.ServiceConfig) {
 	bf.cfg = cfg
 }
 
+// Ready returns true once the factory has been initialized, since in-memory buckets can't fail to
+// initialize.
+func (bf *bucketFactory) Ready() bool {
+	return bf.ReadyErr() == nil
+}
+
+func (bf *bucketFactory) ReadyErr() error {
+	if bf.cfg == nil {
+		return buckets.ErrFactoryNotInitialized
+	}
+
+	return nil
+}
+
 func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
 	// fill rate is tokens-per-second.
 	bucket := &tokenBucket{
@@ -28,12 +47,45 @@ func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *configs.Bu
 		dynamic: dyn,
 		cfg: cfg,
 		nanosBetweenTokens: 1e9 / cfg.FillRate,
-		accumulatedTokens: cfg.Size, // Start full
+		accumulatedTokens: accumulationLimit(cfg), // Start full
+		createdNanos: time.Now().UnixNano(),
+		baseFillRate: cfg.FillRate,
 		fullName: buckets.FullyQualifiedName(namespace, bucketName),
 		waitTimer: make(chan *waitTimeReq),
-		closer: make(chan struct{})}
+		executor: make(chan func()),
+		closer: make(chan struct{}),
+		done: make(chan struct{}),
+		detector: bf.detector,
+		tiers: newTiers(cfg.Tiers),
+		schedule: newFillSchedule(cfg.FillSchedule),
+		multipliers: newTimeMultipliers(cfg.TimeMultipliers)}
+
+	if cfg.HistoryResolutionMs > 0 {
+		bucket.history = newTokenHistory(cfg.HistoryRetentionMs / cfg.HistoryResolutionMs)
+	}
+
+	var statsPersistedTo string
+	if cfg.PersistStats {
+		if bf.statsDir == "" {
+			logging.Printf("Stats of bucket %v not persisted, since the factory has no stats directory.", bucket.fullName)
+		} else {
+			statsPersistedTo = statsPath(bf.statsDir, bucket.fullName)
+		}
+	}
+	bucket.stats = newLifetimeStats(statsPersistedTo)
+
+	bucket.lastGrantNanos = bucket.createdNanos
+	bucket.lastDrainNanos = bucket.createdNanos
+	if cfg.WarmupRampDurationMs > 0 {
+		// Start empty, and only accumulate tokens from the time of creation.
+		bucket.accumulatedTokens = 0
+		bucket.tokensNextAvailableNanos = bucket.createdNanos
+	}
 
 	go bucket.waitTimeLoop()
+	if bucket.detector != nil {
+		bucket.detector.watch(bucket)
+	}
 
 	return bucket
 }
@@ -44,70 +96,461 @@ func NewBucketFactory() buckets.BucketFactory {
 
 // tokenBucket is a single-threaded implementation. A single goroutine updates the values of
 // tokensNextAvailable and accumulatedTokens. When requesting tokens, Take() puts a request on
-// the waitTimer channel, and listens on the response channel in the request for a result. The
-// goroutine is shut down when Destroy() is called on this bucket. In-flight requests will be
-// served, but new requests will not.
+// the waitTimer channel, and listens on the response channel in the request for a result.
+// Other operations that update the bucket's state, such as AddTokens() and Tune(), put a function on
+// the executor channel, which the goroutine runs. The goroutine is shut down when Destroy() is called on this bucket. In-flight requests will be
+// served, but new requests are rejected.
 type tokenBucket struct {
 	buckets.ActivityChannel
 	dynamic           bool
 	cfg               *configs.BucketConfig
 	nanosBetweenTokens,
 	tokensNextAvailableNanos,
-	accumulatedTokens int64
+	accumulatedTokens,
+	createdNanos,
+	lastGrantNanos,
+	lastDrainNanos    int64
+	drainCarry        float64 // The fraction of a token passively drained, but not yet discarded.
 	fullName          string
 	waitTimer         chan *waitTimeReq
+	executor          chan func()
 	closer            chan struct{}
+	done              chan struct{} // Closed once the bucket's goroutine exits.
+	detector          *DeadlockDetector
+	history           *tokenHistory // nil unless HistoryResolutionMs is set when the bucket is created.
+	demand            *demandTracker // nil until the bucket is first auto-tuned.
+	baseFillRate      int64 // The fill rate configured, before any auto-tuning.
+	tiers             tiers // Empty unless the bucket is configured with Tiers.
+	schedule          fillSchedule // Empty unless the bucket is configured with a FillSchedule.
+	multipliers       timeMultipliers // Empty unless the bucket is configured with TimeMultipliers.
+	refillWatches     []*refillWatch // Callbacks registered using OnRefillAbove().
+	refillTicker      *time.Ticker // nil until a refill callback is registered.
+	stats             *lifetimeStats
+	cfgLock           sync.RWMutex // Guards cfg, which is only written to by the bucket's goroutine.
 }
 
 // waitTimeReq is a request that you put on the channel for the waitTimer goroutine to pick up and
 // process.
 type waitTimeReq struct {
 	requested, maxWaitTimeNanos int64
-	response                    chan int64
+	response                    chan waitTimeRsp
+}
+
+// waitTimeRsp is the wait time for a request, and how many of the tokens granted were taken from
+// those accumulated before the request.
+type waitTimeRsp struct {
+	waitTimeNanos, burstTokens int64
 }
 
 func (b *tokenBucket) Take(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration) {
-	rsp := make(chan int64, 1)
-	b.waitTimer <- &waitTimeReq{numTokens, maxWaitTime.Nanoseconds(), rsp}
-	waitTimeNanos := <-rsp
+	if b.Config().TrafficShaping {
+		schedule := b.TakeShaped(numTokens, maxWaitTime)
+		if schedule == nil {
+			return -1
+		}
+
+		return schedule[0].WaitTime
+	}
+
+	return b.take(numTokens, maxWaitTime)
+}
+
+// TakeCost implements buckets.VariableCostBucket. Tokens are units of cost, so a request costing
+// costUnits takes as many tokens.
+func (b *tokenBucket) TakeCost(costUnits int64, maxWaitTime time.Duration) (waitTime time.Duration) {
+	return b.Take(costUnits, maxWaitTime)
+}
+
+// TakeShaped reserves all tokens requested, and spreads their use over sub-batches of FillRate
+// tokens, released a second apart starting when the first sub-batch is available.
+func (b *tokenBucket) TakeShaped(numTokens int64, maxWaitTime time.Duration) []buckets.ScheduledGrant {
+	waitTime := b.take(numTokens, maxWaitTime)
+	if waitTime < 0 {
+		return nil
+	}
+
+	batchSize := b.Config().FillRate
+	schedule := make([]buckets.ScheduledGrant, 0, numTokens / batchSize + 1)
+	for remaining := numTokens; remaining > 0 || len(schedule) == 0; remaining -= batchSize {
+		schedule = append(schedule, buckets.ScheduledGrant{Tokens: min(remaining, batchSize), WaitTime: waitTime})
+		waitTime += time.Second
+	}
+
+	return schedule
+}
+
+func (b *tokenBucket) take(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration) {
+	waitTime, _ = b.TakeWithBurst(numTokens, maxWaitTime)
+	return
+}
+
+// TakeWithBurst implements buckets.BurstAccountingBucket. Tokens refilled since the last request
+// are used first, then those accumulated before it, which are burst tokens. Tokens that have to
+// be waited for are not burst tokens.
+func (b *tokenBucket) TakeWithBurst(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration, burstTokens int64) {
+	rsp := make(chan waitTimeRsp, 1)
+	select {
+	case b.waitTimer <- &waitTimeReq{numTokens, maxWaitTime.Nanoseconds(), rsp}:
+	case <-b.done:
+		// Destroyed, such as when evicted, while callers still held it.
+		return -1, 0
+	}
+	r := <-rsp
+
+	waitTime = time.Duration(r.waitTimeNanos) * time.Nanosecond
+	if waitTime > maxWaitTime && maxWaitTime > 0 {
+		return -1, 0
+	}
+
+	if waitTime < 0 {
+		return waitTime, 0
+	}
+
+	return waitTime, r.burstTokens
+}
+
+// Peek implements buckets.PeekingBucket.
+func (b *tokenBucket) Peek(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration) {
+	var waitTimeNanos int64
+	if !b.exec(func() { waitTimeNanos, _ = b.calcWaitTime(numTokens, maxWaitTime.Nanoseconds(), false) }) {
+		return -1
+	}
 
 	waitTime = time.Duration(waitTimeNanos) * time.Nanosecond
 	if waitTime > maxWaitTime && maxWaitTime > 0 {
-		waitTime = -1
+		return -1
 	}
 
 	return
 }
 
-func (b *tokenBucket) calcWaitTime(requested, maxWaitTimeNanos int64) (waitTimeNanos int64) {
+// calcWaitTime works out how long a request has to wait for tokens. Only if commit is set are
+// the tokens taken, and the request counted as demand.
+func (b *tokenBucket) calcWaitTime(requested, maxWaitTimeNanos int64, commit bool) (waitTimeNanos, burstTokens int64) {
 	currentTimeNanos := time.Now().UnixNano()
+	nanosBetweenTokens := b.nanosBetweenTokensAt(currentTimeNanos)
 	tna := b.tokensNextAvailableNanos
-	ac := b.accumulatedTokens
-
-	var freshTokens int64 = 0
-
+	ac, drainCarry := b.accumulated(currentTimeNanos, nanosBetweenTokens)
 	if currentTimeNanos > tna {
-		freshTokens = (currentTimeNanos - tna) / b.nanosBetweenTokens
-		ac = min(b.cfg.Size, ac + freshTokens)
 		tna = currentTimeNanos
 	}
 
+	ac = b.decay(ac, currentTimeNanos)
 	waitTimeNanos = tna - currentTimeNanos
 	accumulatedTokensUsed := min(ac, requested)
+	// Accumulated tokens beyond those refilled since the last request are burst tokens.
+	burstTokens = accumulatedTokensUsed - min(accumulatedTokensUsed, max(ac - b.accumulatedTokens, 0))
 	tokensToWaitFor := requested - accumulatedTokensUsed
-	futureWaitNanos := tokensToWaitFor * b.nanosBetweenTokens
+	futureWaitNanos := mulNanos(tokensToWaitFor, nanosBetweenTokens)
 
-	tna += futureWaitNanos
+	tna = addNanos(tna, futureWaitNanos)
 	ac -= accumulatedTokensUsed
 
-	if (tna - currentTimeNanos > b.cfg.MaxDebtMillis * 1e6) || (waitTimeNanos > 0 && waitTimeNanos > maxWaitTimeNanos && maxWaitTimeNanos > 0) {
+	// Tokens must also be granted by every tier, and the longest wait applies.
+	tiersWaitNanos := b.tiers.waitTime(requested, currentTimeNanos, maxWaitTimeNanos, b.cfg.MaxDebtMillis * 1e6)
+
+	if (tna - currentTimeNanos > b.cfg.MaxDebtMillis * 1e6) || (waitTimeNanos > 0 && waitTimeNanos > maxWaitTimeNanos && maxWaitTimeNanos > 0) || tiersWaitNanos < 0 {
 		waitTimeNanos = -1
+	} else if !commit {
+		return max(waitTimeNanos, tiersWaitNanos), burstTokens
 	} else {
+		waitTimeNanos = max(waitTimeNanos, tiersWaitNanos)
+		b.tiers.take(requested, currentTimeNanos)
 		b.tokensNextAvailableNanos = tna
 		b.accumulatedTokens = ac
+		b.lastGrantNanos = currentTimeNanos
+		b.lastDrainNanos = currentTimeNanos
+		b.drainCarry = drainCarry
+	}
+
+	// Demand includes rejected requests. A new fill rate applies from the next request.
+	if commit {
+		b.autoTune(requested, currentTimeNanos)
+		b.observeTokens(b.accumulatedTokens)
+	}
+	return waitTimeNanos, burstTokens
+}
+
+// decay discards accumulated tokens that have lost value since the last grant, if the bucket is
+// configured with an AccumulationDecayRatePerSec.
+func (b *tokenBucket) decay(accumulatedTokens, currentTimeNanos int64) int64 {
+	rate := b.cfg.AccumulationDecayRatePerSec
+	if rate <= 0 || currentTimeNanos <= b.lastGrantNanos {
+		return accumulatedTokens
+	}
+
+	idleSecs := float64(currentTimeNanos - b.lastGrantNanos) / 1e9
+	decayed := accumulatedTokens - int64(float64(b.cfg.Size) * (1 - math.Exp(-rate * idleSecs)))
+	if decayed < 0 {
+		return 0
+	}
+
+	return decayed
+}
+
+// nanosBetweenTokensAt returns the time between tokens at a given point in time. The fill rate is
+// scaled by the bucket's TimeMultiplier at that time, if any. While a bucket is warming up, its
+// effective fill rate is also scaled by elapsed / WarmupRampDuration, and the time between tokens
+// is capped at math.MaxInt64 early on in long ramps.
+func (b *tokenBucket) nanosBetweenTokensAt(currentTimeNanos int64) int64 {
+	nanosBetweenTokens := b.unrampedNanosBetweenTokensAt(currentTimeNanos)
+	rampNanos := b.cfg.WarmupRampDurationMs * 1e6
+	elapsedNanos := currentTimeNanos - b.createdNanos
+	if rampNanos <= 0 || elapsedNanos >= rampNanos {
+		return nanosBetweenTokens
+	}
+
+	if elapsedNanos < 1 {
+		elapsedNanos = 1
+	}
+
+	ramped := float64(nanosBetweenTokens) * float64(rampNanos) / float64(elapsedNanos)
+	if ramped >= math.MaxInt64 {
+		return math.MaxInt64
 	}
 
-	return waitTimeNanos
+	return int64(ramped)
+}
+
+// unrampedNanosBetweenTokensAt returns the time between tokens at a given point in time, scaled by
+// the bucket's TimeMultiplier at that time, if any, but not by its warmup ramp.
+func (b *tokenBucket) unrampedNanosBetweenTokensAt(currentTimeNanos int64) int64 {
+	if m := b.multipliers.at(currentTimeNanos); m != 1 {
+		return max(1, int64(float64(b.nanosBetweenTokens) / m))
+	}
+
+	return b.nanosBetweenTokens
+}
+
+// freshTokens returns the number of tokens made available between two points in time, within the
+// bucket's FillSchedule if it has one. While the bucket is warming up, its fill rate grows with
+// the time since it was created, so the ramped fill rate is integrated over the part of the
+// interval within the ramp, rather than applying the rate at the end of the interval to all of it.
+// nanosBetweenTokens applies after the ramp.
+func (b *tokenBucket) freshTokens(fromNanos, toNanos, nanosBetweenTokens int64) int64 {
+	rampEndNanos := b.createdNanos + b.cfg.WarmupRampDurationMs * 1e6
+	if b.cfg.WarmupRampDurationMs <= 0 || fromNanos >= rampEndNanos {
+		return b.schedule.fillingNanos(fromNanos, toNanos) / nanosBetweenTokens
+	}
+
+	// The fill rate grows linearly from 0 at creation, so the tokens made available between two
+	// points in the ramp grow with the difference of the squares of their times since creation.
+	rampToNanos := min(toNanos, rampEndNanos)
+	fromElapsed := float64(max(fromNanos - b.createdNanos, 0))
+	toElapsed := float64(rampToNanos - b.createdNanos)
+	rampNanos := float64(rampEndNanos - b.createdNanos)
+	tokens := (toElapsed * toElapsed - fromElapsed * fromElapsed) /
+		(2 * rampNanos * float64(b.unrampedNanosBetweenTokensAt(rampToNanos)))
+
+	// Only the part of the ramp within the FillSchedule counts.
+	if rampToNanos > fromNanos {
+		tokens *= float64(b.schedule.fillingNanos(fromNanos, rampToNanos)) / float64(rampToNanos - fromNanos)
+	}
+
+	if toNanos > rampEndNanos {
+		tokens += float64(b.schedule.fillingNanos(rampEndNanos, toNanos) / nanosBetweenTokens)
+	}
+
+	return int64(tokens)
+}
+
+// exec runs f on the bucket's goroutine, and waits for it to complete. Once the bucket has been
+// destroyed, f isn't run, and false is returned straight away.
+func (b *tokenBucket) exec(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case b.executor <- func() {
+		f()
+		close(done)
+	}:
+	case <-b.done:
+		return false
+	}
+
+	<-done
+	return true
+}
+
+func (b *tokenBucket) AddTokens(numTokens int64) {
+	b.exec(func() { b.addTokens(numTokens) })
+}
+
+// tokensAt returns the number of tokens accumulated at a point in time, without updating the
+// bucket's state, so that frequent reads don't discard partially accumulated tokens.
+func (b *tokenBucket) tokensAt(currentTimeNanos int64) int64 {
+	tokens, _ := b.accumulated(currentTimeNanos, b.nanosBetweenTokensAt(currentTimeNanos))
+	return tokens
+}
+
+// accumulated returns the number of tokens accumulated at a point in time, and the fraction of a
+// token drained but not yet discarded, without updating the bucket's state. Tokens made available
+// since tokensNextAvailableNanos, as by freshTokens(), are added and, if
+// the bucket is configured with a PassiveDrainRatePerSec, tokens drained since lastDrainNanos are
+// discarded.
+func (b *tokenBucket) accumulated(currentTimeNanos, nanosBetweenTokens int64) (int64, float64) {
+	tna := b.tokensNextAvailableNanos
+	var freshTokens int64
+	if currentTimeNanos > tna {
+		freshTokens = b.freshTokens(tna, currentTimeNanos, nanosBetweenTokens)
+	}
+
+	// Nothing drains while the bucket is in debt.
+	drainStartNanos := max(b.lastDrainNanos, tna)
+	rate := b.cfg.PassiveDrainRatePerSec
+	if rate <= 0 || currentTimeNanos <= drainStartNanos {
+		return b.fill(b.accumulatedTokens, freshTokens), b.drainCarry
+	}
+
+	// Tokens made available before draining started fill the bucket up to its size. After that,
+	// tokens fill and drain at the same time, so the bucket only changes by the difference.
+	var tokensBeforeDrain int64
+	if drainStartNanos > tna {
+		tokensBeforeDrain = b.freshTokens(tna, drainStartNanos, nanosBetweenTokens)
+	}
+
+	drained := rate * float64(currentTimeNanos - drainStartNanos) / 1e9 + b.drainCarry
+	startTokens := b.fill(b.accumulatedTokens, tokensBeforeDrain)
+	tokens := startTokens + freshTokens - tokensBeforeDrain - int64(drained)
+	if tokens <= 0 {
+		return 0, 0
+	}
+
+	return min(max(startTokens, accumulationLimit(b.cfg)), tokens), drained - math.Floor(drained)
+}
+
+// fill returns the tokens accumulated after refilling freshTokens, up to the bucket's
+// accumulation limit. Tokens already beyond the limit, such as those added using AddTokens(),
+// are kept.
+func (b *tokenBucket) fill(tokens, freshTokens int64) int64 {
+	return max(tokens, min(accumulationLimit(b.cfg), tokens + freshTokens))
+}
+
+// accumulationLimit returns the most tokens a bucket accumulates by refilling: its Size, or its
+// MaxAccumulatedTokens if lower.
+func accumulationLimit(cfg *configs.BucketConfig) int64 {
+	if cfg.MaxAccumulatedTokens != nil && *cfg.MaxAccumulatedTokens < cfg.Size {
+		return *cfg.MaxAccumulatedTokens
+	}
+
+	return cfg.Size
+}
+
+// refill accumulates tokens made available since tokensNextAvailableNanos, and discards tokens
+// passively drained since lastDrainNanos.
+func (b *tokenBucket) refill(currentTimeNanos, nanosBetweenTokens int64) {
+	b.accumulatedTokens, b.drainCarry = b.accumulated(currentTimeNanos, nanosBetweenTokens)
+	b.lastDrainNanos = currentTimeNanos
+	if currentTimeNanos > b.tokensNextAvailableNanos {
+		b.tokensNextAvailableNanos = currentTimeNanos
+	}
+}
+
+func (b *tokenBucket) addTokens(numTokens int64) {
+	currentTimeNanos := time.Now().UnixNano()
+	nanosBetweenTokens := b.nanosBetweenTokensAt(currentTimeNanos)
+	b.refill(currentTimeNanos, nanosBetweenTokens)
+
+	// Pay off tokens borrowed from the future first, counting partially repaid tokens as borrowed.
+	borrowedTokens := (b.tokensNextAvailableNanos - currentTimeNanos + nanosBetweenTokens - 1) / nanosBetweenTokens
+	repaidTokens := min(borrowedTokens, numTokens)
+	b.tokensNextAvailableNanos -= repaidTokens * nanosBetweenTokens
+	b.accumulatedTokens = min(b.cfg.Size, b.accumulatedTokens + numTokens - repaidTokens)
+	b.tiers.addTokens(numTokens, currentTimeNanos)
+}
+
+func (b *tokenBucket) Drain() (tokensRemoved int64, err error) {
+	if !b.exec(func() {
+		currentTimeNanos := time.Now().UnixNano()
+		b.refill(currentTimeNanos, b.nanosBetweenTokensAt(currentTimeNanos))
+		tokensRemoved = b.accumulatedTokens
+		b.accumulatedTokens = 0
+		b.observeTokens(0)
+	}) {
+		return 0, buckets.ErrBucketDestroyed
+	}
+
+	return
+}
+
+// AvailableTokens returns the number of tokens accumulated, which can be taken without waiting.
+func (b *tokenBucket) AvailableTokens() (tokens int64) {
+	b.exec(func() {
+		tokens = b.tokensAt(time.Now().UnixNano())
+	})
+
+	return
+}
+
+// ExportState implements buckets.StatefulBucket.
+func (b *tokenBucket) ExportState() (accumulatedTokens, tokensNextAvailableNanos int64) {
+	b.exec(func() {
+		accumulatedTokens, tokensNextAvailableNanos = b.accumulatedTokens, b.tokensNextAvailableNanos
+	})
+
+	return
+}
+
+// ImportState implements buckets.StatefulBucket.
+func (b *tokenBucket) ImportState(accumulatedTokens, tokensNextAvailableNanos int64) {
+	b.exec(func() {
+		b.accumulatedTokens = min(b.cfg.Size, accumulatedTokens)
+		b.tokensNextAvailableNanos = tokensNextAvailableNanos
+	})
+}
+
+// TokenLevelHistory returns the token levels recorded every HistoryResolutionMs, as configured when
+// the bucket was created.
+func (b *tokenBucket) TokenLevelHistory(since time.Time, resolution time.Duration) (history []buckets.TokenSnapshot) {
+	if b.history == nil {
+		return nil
+	}
+
+	b.exec(func() {
+		history = buckets.DownsampleHistory(b.history.all(), since, resolution)
+	})
+
+	return
+}
+
+func (b *tokenBucket) recordTokenLevel(now time.Time) {
+	b.history.record(buckets.TokenSnapshot{Time: now, Tokens: b.tokensAt(now.UnixNano())})
+}
+
+// Tune applies a new fill rate and size to the bucket. Tokens accumulated are refilled at the old
+// fill rate, and then scaled in proportion to the new size.
+func (b *tokenBucket) Tune(cfg *configs.BucketConfig) error {
+	if err := buckets.ValidateTunedConfig(cfg); err != nil {
+		return err
+	}
+
+	if !b.exec(func() {
+		b.tune(cfg)
+		// Auto-tuning starts over from the new fill rate.
+		b.baseFillRate = cfg.FillRate
+		b.demand = nil
+	}) {
+		return buckets.ErrBucketDestroyed
+	}
+
+	return nil
+}
+
+func (b *tokenBucket) tune(cfg *configs.BucketConfig) {
+	currentTimeNanos := time.Now().UnixNano()
+	b.refill(currentTimeNanos, b.nanosBetweenTokensAt(currentTimeNanos))
+
+	b.accumulatedTokens = b.accumulatedTokens * cfg.Size / b.cfg.Size
+	b.nanosBetweenTokens = 1e9 / cfg.FillRate
+	if !reflect.DeepEqual(cfg.Tiers, b.cfg.Tiers) {
+		// New tiers start full.
+		b.tiers = newTiers(cfg.Tiers)
+	}
+	b.schedule = newFillSchedule(cfg.FillSchedule)
+	b.multipliers = newTimeMultipliers(cfg.TimeMultipliers)
+
+	b.cfgLock.Lock()
+	b.cfg = cfg
+	b.cfgLock.Unlock()
 }
 
 func min(x, y int64) int64 {
@@ -117,21 +560,76 @@ func min(x, y int64) int64 {
 	return y
 }
 
+func max(x, y int64) int64 {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+// mulNanos multiplies a number of tokens by the time between tokens, saturating at math.MaxInt64.
+func mulNanos(tokens, nanosBetweenTokens int64) int64 {
+	if tokens > 0 && nanosBetweenTokens > math.MaxInt64 / tokens {
+		return math.MaxInt64
+	}
+	return tokens * nanosBetweenTokens
+}
+
+// addNanos adds a non-negative duration to a time, saturating at math.MaxInt64.
+func addNanos(nanos, durationNanos int64) int64 {
+	if nanos > math.MaxInt64 - durationNanos {
+		return math.MaxInt64
+	}
+	return nanos + durationNanos
+}
+
 func (b *tokenBucket) waitTimeLoop() {
+	var historyTicks <-chan time.Time
+	if b.history != nil {
+		ticker := time.NewTicker(time.Duration(b.cfg.HistoryResolutionMs) * time.Millisecond)
+		defer ticker.Stop()
+		historyTicks = ticker.C
+	}
+
+	var statsTicks <-chan time.Time
+	if b.stats.path != "" && b.cfg.StatsFlushIntervalMs > 0 {
+		ticker := time.NewTicker(time.Duration(b.cfg.StatsFlushIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		statsTicks = ticker.C
+	}
+
+	defer close(b.done)
+	defer func() {
+		if b.refillTicker != nil {
+			b.refillTicker.Stop()
+		}
+	}()
 	keepRunning := true
 	for ; keepRunning; {
 		select {
+		case now := <-historyTicks:
+			b.recordTokenLevel(now)
+		case <-statsTicks:
+			b.stats.flushAsync()
+		case now := <-b.refillTicks():
+			b.observeTokens(b.tokensAt(now.UnixNano()))
 		case req := <-b.waitTimer:
-			w := b.calcWaitTime(req.requested, req.maxWaitTimeNanos)
-			req.response <- w
+			w, burst := b.calcWaitTime(req.requested, req.maxWaitTimeNanos, true)
+			b.stats.record(w >= 0)
+			req.response <- waitTimeRsp{w, burst}
+		case f := <-b.executor:
+			f()
 		case <-b.closer:
 			keepRunning = false
+			go b.stats.flush()
 			logging.Printf("Garbage collecting bucket %v", b.fullName)
 		}
 	}
 }
 
 func (b *tokenBucket) Config() *configs.BucketConfig {
+	b.cfgLock.RLock()
+	defer b.cfgLock.RUnlock()
 	return b.cfg
 }
 
@@ -140,6 +638,13 @@ func (b *tokenBucket) Dynamic() bool {
 }
 
 func (b *tokenBucket) Destroy() {
-	// Signal the waitTimeLoop to exit
-	b.closer <- struct{}{}
+	if b.detector != nil {
+		b.detector.unwatch(b)
+	}
+
+	// Signal the waitTimeLoop to exit, unless it already has.
+	select {
+	case b.closer <- struct{}{}:
+	case <-b.done:
+	}
 }
@@ -0,0 +1,1458 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+var factory = func() *bucketFactory {
+	bf := NewBucketFactory().(*bucketFactory)
+	bf.Init(configs.NewDefaultServiceConfig())
+	return bf
+}()
+
+func newWarmingUpBucket(createdAgo time.Duration) *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 10000
+	cfg.FillRate = 1000
+	cfg.WarmupRampDurationMs = 1000
+	b := factory.NewBucket("memory", "warmup", cfg, false).(*tokenBucket)
+
+	// Pretend the bucket was created a while ago. Safe, since the bucket's goroutine only reads
+	// these fields when serving a request.
+	b.createdNanos -= createdAgo.Nanoseconds()
+	b.tokensNextAvailableNanos = b.createdNanos
+	return b
+}
+
+// accumulatedTokens reports the number of tokens a bucket has accumulated.
+func accumulatedTokens(b *tokenBucket) int64 {
+	// Taking 0 tokens updates accumulated tokens, and the response channel ensures the update is
+	// visible to this goroutine.
+	b.Take(0, 0)
+	return b.accumulatedTokens
+}
+
+func TestStartsEmptyWhenWarmingUp(t *testing.T) {
+	b := newWarmingUpBucket(0)
+	defer b.Destroy()
+
+	if tokens := accumulatedTokens(b); tokens != 0 {
+		t.Fatalf("Expecting 0 accumulated tokens. Was %v", tokens)
+	}
+}
+
+func TestMidRamp(t *testing.T) {
+	b := newWarmingUpBucket(500 * time.Millisecond)
+	defer b.Destroy()
+
+	// Halfway through the ramp, the effective fill rate has grown from 0 to 500 tokens/sec, so over
+	// 500ms roughly 125 tokens are available rather than the 500 that the full fill rate would
+	// provide.
+	if tokens := accumulatedTokens(b); tokens < 120 || tokens > 135 {
+		t.Fatalf("Expecting about 125 accumulated tokens. Was %v", tokens)
+	}
+}
+
+func TestIdleMidRamp(t *testing.T) {
+	b := newWarmingUpBucket(800 * time.Millisecond)
+	defer b.Destroy()
+
+	// The bucket was last refilled 200ms into the ramp, and has been idle since. The fill rate grew
+	// from 200 to 800 tokens/sec over the gap, so roughly 300 tokens are available, rather than
+	// the 480 that the current fill rate would provide over the whole gap.
+	b.tokensNextAvailableNanos = b.createdNanos + (200 * time.Millisecond).Nanoseconds()
+	if tokens := accumulatedTokens(b); tokens < 295 || tokens > 315 {
+		t.Fatalf("Expecting about 300 accumulated tokens. Was %v", tokens)
+	}
+}
+
+func TestPostRamp(t *testing.T) {
+	b := newWarmingUpBucket(2 * time.Second)
+	defer b.Destroy()
+
+	// 500 tokens are made available during the ramp, and 1000 in the second after it.
+	if tokens := accumulatedTokens(b); tokens < 1500 || tokens > 1520 {
+		t.Fatalf("Expecting about 1500 accumulated tokens. Was %v", tokens)
+	}
+
+	if b.nanosBetweenTokensAt(time.Now().UnixNano()) != b.nanosBetweenTokens {
+		t.Fatal("Expecting the full fill rate after warming up")
+	}
+}
+
+func TestLongRampDoesNotOverflow(t *testing.T) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.FillRate = 1
+	cfg.WarmupRampDurationMs = 1e6
+	b := factory.NewBucket("memory", "long_warmup", cfg, false).(*tokenBucket)
+	defer b.Destroy()
+
+	// A second between tokens, scaled by a ramp of 1e15ns, is far beyond what an int64 can hold.
+	if n := b.nanosBetweenTokensAt(b.createdNanos); n != math.MaxInt64 {
+		t.Fatalf("Expecting the time between tokens capped at %v. Was %v", int64(math.MaxInt64), n)
+	}
+
+	if w := b.Take(1, time.Second); w != -1 {
+		t.Fatalf("Expecting no tokens this early in the ramp. Was %v", w)
+	}
+}
+
+func TestNoRamp(t *testing.T) {
+	b := factory.NewBucket("memory", "no_warmup", configs.NewDefaultBucketConfig(), false).(*tokenBucket)
+	defer b.Destroy()
+
+	if tokens := accumulatedTokens(b); tokens != b.cfg.Size {
+		t.Fatalf("Expecting a full bucket. Was %v", tokens)
+	}
+}
+
+func newShapingBucket() *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.FillRate = 20
+	cfg.TrafficShaping = true
+	return factory.NewBucket("memory", "shaping", cfg, false).(*tokenBucket)
+}
+
+func TestTrafficShapingSpreadsGrant(t *testing.T) {
+	b := newShapingBucket()
+	defer b.Destroy()
+
+	// The bucket is full, but the grant should still be spread over 5 seconds.
+	schedule := b.TakeShaped(100, 0)
+	if len(schedule) != 5 {
+		t.Fatalf("Expecting 5 sub-batches. Was %+v", schedule)
+	}
+
+	for i, grant := range schedule {
+		if grant.Tokens != 20 {
+			t.Fatalf("Expecting 20 tokens in sub-batch %v. Was %v", i, grant.Tokens)
+		}
+
+		if grant.WaitTime != time.Duration(i) * time.Second {
+			t.Fatalf("Expecting sub-batch %v after %v. Was %v", i, time.Duration(i) * time.Second, grant.WaitTime)
+		}
+	}
+}
+
+func TestTrafficShapingPartialBatch(t *testing.T) {
+	b := newShapingBucket()
+	defer b.Destroy()
+
+	schedule := b.TakeShaped(50, 0)
+	if len(schedule) != 3 || schedule[2].Tokens != 10 {
+		t.Fatalf("Expecting sub-batches of 20, 20 and 10 tokens. Was %+v", schedule)
+	}
+}
+
+func TestTrafficShapingTake(t *testing.T) {
+	b := newShapingBucket()
+	defer b.Destroy()
+
+	if w := b.Take(100, 0); w != 0 {
+		t.Fatalf("Expecting the first sub-batch to be available immediately. Was %v", w)
+	}
+
+	// All 100 tokens were reserved, so the next grant starts after the bucket pays off its debt.
+	b.Take(10, 0)
+	schedule := b.TakeShaped(40, 0)
+	if len(schedule) != 2 || schedule[0].WaitTime < 1 || schedule[1].WaitTime - schedule[0].WaitTime != time.Second {
+		t.Fatalf("Expecting 2 sub-batches a second apart, after a wait. Was %+v", schedule)
+	}
+
+	if schedule := b.TakeShaped(40, time.Nanosecond); schedule != nil {
+		t.Fatalf("Expecting no grant. Was %+v", schedule)
+	}
+}
+
+func TestTune(t *testing.T) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 100
+	cfg.FillRate = 1
+	b := factory.NewBucket("memory", "tune", cfg, false).(*tokenBucket)
+	defer b.Destroy()
+
+	b.Take(50, 0)
+
+	tuned := *cfg
+	tuned.Size = 200
+	tuned.FillRate = 1000
+	if err := b.Tune(&tuned); err != nil {
+		t.Fatal(err)
+	}
+
+	if tokens := accumulatedTokens(b); tokens != 100 {
+		t.Fatalf("Expecting accumulated tokens to be scaled to 100. Was %v", tokens)
+	}
+
+	if b.Config() != &tuned || b.nanosBetweenTokens != 1e6 {
+		t.Fatalf("Expecting the tuned config to be applied. Was %+v", b.Config())
+	}
+
+	invalid := tuned
+	invalid.FillRate = 0
+	if err := b.Tune(&invalid); err == nil {
+		t.Fatal("Expecting an error tuning with a fill rate of 0")
+	}
+}
+
+func TestTuneWithConcurrentTakes(t *testing.T) {
+	cfg := configs.NewDefaultBucketConfig()
+	b := factory.NewBucket("memory", "tune_concurrent", cfg, false).(*tokenBucket)
+	defer b.Destroy()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					b.Take(1, time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		tuned := *cfg
+		tuned.Size = i * 10
+		tuned.FillRate = i * 100
+		if err := b.Tune(&tuned); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if b.Config().FillRate != 10000 {
+		t.Fatalf("Expecting the last tuned config to be applied. Was %+v", b.Config())
+	}
+
+	if tokens := accumulatedTokens(b); tokens > 1000 {
+		t.Fatalf("Expecting accumulated tokens not to exceed the tuned size. Was %v", tokens)
+	}
+}
+
+func TestReady(t *testing.T) {
+	bf := NewBucketFactory()
+	if bf.Ready() || bf.ReadyErr() != buckets.ErrFactoryNotInitialized {
+		t.Fatalf("Expecting factory not to be ready before Init. Was %v", bf.ReadyErr())
+	}
+
+	bf.Init(configs.NewDefaultServiceConfig())
+	if !bf.Ready() || bf.ReadyErr() != nil {
+		t.Fatalf("Expecting factory to be ready after Init. Was %v", bf.ReadyErr())
+	}
+}
+
+func TestAvailableTokens(t *testing.T) {
+	b := factory.NewBucket("memory", "available", configs.NewDefaultBucketConfig(), false).(*tokenBucket)
+	defer b.Destroy()
+
+	b.Take(40, 0)
+	if tokens := b.AvailableTokens(); tokens != 60 {
+		t.Fatalf("Expecting 60 available tokens. Was %v", tokens)
+	}
+}
+
+func newHistoryBucket(resolution, retention int64) *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.FillRate = 1
+	cfg.HistoryResolutionMs = resolution
+	cfg.HistoryRetentionMs = retention
+	return factory.NewBucket("memory", "history", cfg, false).(*tokenBucket)
+}
+
+func TestTokenLevelHistory(t *testing.T) {
+	b := newHistoryBucket(10, 1000)
+	defer b.Destroy()
+
+	start := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	b.Take(60, 0)
+	time.Sleep(50 * time.Millisecond)
+
+	history := b.TokenLevelHistory(start, 0)
+	if len(history) < 5 {
+		t.Fatalf("Expecting a snapshot every 10ms. Was %+v", history)
+	}
+
+	first, last := history[0], history[len(history)-1]
+	if first.Tokens != 100 || last.Tokens != 40 {
+		t.Fatalf("Expecting token levels to drop from 100 to 40. Was %+v", history)
+	}
+
+	for i := 1; i < len(history); i++ {
+		if !history[i].Time.After(history[i-1].Time) {
+			t.Fatalf("Expecting snapshots oldest first. Was %+v", history)
+		}
+	}
+
+	if recent := b.TokenLevelHistory(last.Time, 0); len(recent) != 1 {
+		t.Fatalf("Expecting only snapshots since the given time. Was %+v", recent)
+	}
+
+	if downsampled := b.TokenLevelHistory(start, time.Hour); len(downsampled) != 1 || downsampled[0] != first {
+		t.Fatalf("Expecting a single snapshot per hour. Was %+v", downsampled)
+	}
+}
+
+func TestTokenLevelHistoryRetention(t *testing.T) {
+	b := newHistoryBucket(10, 30)
+	defer b.Destroy()
+
+	time.Sleep(100 * time.Millisecond)
+	if history := b.TokenLevelHistory(time.Time{}, 0); len(history) != 3 {
+		t.Fatalf("Expecting 3 snapshots to be retained. Was %+v", history)
+	}
+}
+
+func TestNoTokenLevelHistory(t *testing.T) {
+	b := factory.NewBucket("memory", "no_history", configs.NewDefaultBucketConfig(), false)
+	defer b.Destroy()
+
+	if history := b.TokenLevelHistory(time.Time{}, 0); history != nil {
+		t.Fatalf("Expecting no history. Was %+v", history)
+	}
+}
+
+func newStateContainer(size int64) *buckets.BucketContainer {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = nil
+	nsCfg := configs.NewDefaultNamespaceConfig()
+	nsCfg.DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	nsCfg.DynamicBucketTemplate.Size = size
+	nsCfg.DynamicBucketTemplate.FillRate = 1
+	cfg.Namespaces["n"] = nsCfg
+	return buckets.NewBucketContainer(cfg, factory)
+}
+
+func availableTokens(t *testing.T, bc *buckets.BucketContainer, name string) int64 {
+	b, _ := bc.FindBucket("n", name)
+	if b == nil {
+		t.Fatalf("Bucket n:%v doesn't exist", name)
+	}
+
+	return b.(buckets.TokenCounter).AvailableTokens()
+}
+
+func TestExportImport(t *testing.T) {
+	from := newStateContainer(100)
+	b, _ := from.FindBucket("n", "b")
+	b.Take(60, 0)
+
+	snapshot, err := from.Export()
+	if err != nil {
+		t.Fatalf("Unable to export: %v", err)
+	}
+
+	to := newStateContainer(100)
+	if err := to.Import(snapshot); err != nil {
+		t.Fatalf("Unable to import: %v", err)
+	}
+
+	if tokens := availableTokens(t, to, "b"); tokens != 40 {
+		t.Fatalf("Expecting 40 tokens to be imported. Was %v", tokens)
+	}
+}
+
+func TestImportStaleSnapshot(t *testing.T) {
+	from := newStateContainer(100)
+	b, _ := from.FindBucket("n", "b")
+	b.Take(10, 0)
+	snapshot, _ := from.Export()
+
+	// Buckets have shrunk since the snapshot was taken.
+	to := newStateContainer(50)
+	to.Import(snapshot)
+	if tokens := availableTokens(t, to, "b"); tokens != 50 {
+		t.Fatalf("Expecting imported tokens to be capped at 50. Was %v", tokens)
+	}
+
+	// Tokens accumulate from the time of the snapshot.
+	snapshot.Buckets[0].AccumulatedTokens = proto.Int64(0)
+	snapshot.Buckets[0].TokensNextAvailableNanos = proto.Int64(time.Now().Add(-10 * time.Second).UnixNano())
+	to = newStateContainer(100)
+	to.Import(snapshot)
+	if tokens := availableTokens(t, to, "b"); tokens < 10 || tokens > 11 {
+		t.Fatalf("Expecting 10 tokens to have accumulated since the snapshot. Was %v", tokens)
+	}
+}
+
+func newDecayingBucket(idle time.Duration) *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 1000
+	cfg.FillRate = 1
+	cfg.AccumulationDecayRatePerSec = 0.5
+	b := factory.NewBucket("memory", "decay", cfg, false).(*tokenBucket)
+
+	// Pretend the bucket has been idle for a while. Safe, since the bucket's goroutine only reads
+	// this field when serving a request.
+	b.lastGrantNanos -= idle.Nanoseconds()
+	return b
+}
+
+func TestAccumulationDecay(t *testing.T) {
+	// Size * e^(-rate * idle) tokens are left.
+	for _, test := range []struct {
+		idle     time.Duration
+		expected int64
+	}{{0, 1000}, {time.Second, 606}, {5 * time.Second, 82}} {
+		b := newDecayingBucket(test.idle)
+		if tokens := accumulatedTokens(b); tokens < test.expected-1 || tokens > test.expected+1 {
+			t.Fatalf("Expecting %v tokens after %v idle. Was %v", test.expected, test.idle, tokens)
+		}
+		b.Destroy()
+	}
+}
+
+func TestNoAccumulationDecay(t *testing.T) {
+	b := newDecayingBucket(5 * time.Second)
+	b.cfg.AccumulationDecayRatePerSec = 0
+	if tokens := accumulatedTokens(b); tokens != 1000 {
+		t.Fatalf("Expecting no decay. Was %v tokens", tokens)
+	}
+}
+
+func newDrainingBucket(size, fillRate int64, drainRate float64) *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = size
+	cfg.FillRate = fillRate
+	cfg.PassiveDrainRatePerSec = drainRate
+	return factory.NewBucket("memory", "drain", cfg, false).(*tokenBucket)
+}
+
+// rewind pretends the bucket has been refilling and draining for a while. Safe, since the
+// bucket's goroutine only reads these fields when serving a request.
+func rewind(b *tokenBucket, d time.Duration) {
+	b.tokensNextAvailableNanos -= d.Nanoseconds()
+	b.lastDrainNanos -= d.Nanoseconds()
+}
+
+func TestPassiveDrainWithoutRequests(t *testing.T) {
+	b := newDrainingBucket(100, 1, 20)
+	defer b.Destroy()
+
+	// 40 tokens drain in 2 seconds, while 2 are refilled.
+	rewind(b, 2*time.Second)
+	if tokens := b.AvailableTokens(); tokens < 61 || tokens > 62 {
+		t.Fatalf("Expecting 62 tokens left. Was %v", tokens)
+	}
+}
+
+func TestPassiveDrainAndFillBalance(t *testing.T) {
+	b := newDrainingBucket(1000, 100, 40)
+	defer b.Destroy()
+
+	// An empty bucket gains the difference between the fill and drain rates.
+	b.Take(1000, 0)
+	rewind(b, time.Second)
+	if tokens := accumulatedTokens(b); tokens < 59 || tokens > 60 {
+		t.Fatalf("Expecting 60 tokens. Was %v", tokens)
+	}
+
+	// A full bucket that fills as fast as it drains stays full.
+	full := newDrainingBucket(100, 10, 10)
+	defer full.Destroy()
+
+	rewind(full, 5*time.Second)
+	if tokens := accumulatedTokens(full); tokens < 99 {
+		t.Fatalf("Expecting the bucket to stay full. Was %v tokens", tokens)
+	}
+}
+
+func TestPassiveDrainToZero(t *testing.T) {
+	b := newDrainingBucket(100, 1, 100)
+	defer b.Destroy()
+
+	rewind(b, 10*time.Second)
+	if tokens := accumulatedTokens(b); tokens != 0 {
+		t.Fatalf("Expecting the bucket to drain to 0 tokens. Was %v", tokens)
+	}
+
+	// Tokens refilled after draining to 0 aren't lost to drain that has already happened.
+	b.tokensNextAvailableNanos -= (5 * time.Second).Nanoseconds()
+	if tokens := accumulatedTokens(b); tokens < 4 || tokens > 5 {
+		t.Fatalf("Expecting 5 refilled tokens. Was %v", tokens)
+	}
+}
+
+func newAccumulationCappedBucket(size, maxAccumulated int64) *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = size
+	cfg.FillRate = 10
+	cfg.MaxAccumulatedTokens = &maxAccumulated
+	return factory.NewBucket("memory", "capped", cfg, false).(*tokenBucket)
+}
+
+func TestAccumulationCappedAfterIdle(t *testing.T) {
+	b := newAccumulationCappedBucket(100, 20)
+	defer b.Destroy()
+
+	if tokens := b.AvailableTokens(); tokens != 20 {
+		t.Fatalf("Expecting a new bucket to start with 20 tokens. Was %v", tokens)
+	}
+
+	// An hour's refills would fill the bucket's capacity, but only 20 tokens accumulate.
+	b.Take(20, 0)
+	rewind(b, time.Hour)
+	if tokens := b.AvailableTokens(); tokens != 20 {
+		t.Fatalf("Expecting 20 tokens accumulated. Was %v", tokens)
+	}
+}
+
+func TestCapacityBeyondAccumulationCap(t *testing.T) {
+	b := newAccumulationCappedBucket(100, 20)
+	defer b.Destroy()
+
+	// Tokens added explicitly fill the bucket up to its capacity.
+	b.AddTokens(50)
+	if tokens := b.AvailableTokens(); tokens != 70 {
+		t.Fatalf("Expecting 70 tokens. Was %v", tokens)
+	}
+
+	// Refills don't discard tokens beyond the accumulation cap, or add to them.
+	rewind(b, time.Minute)
+	if tokens := b.AvailableTokens(); tokens != 70 {
+		t.Fatalf("Expecting 70 tokens. Was %v", tokens)
+	}
+
+	b.AddTokens(50)
+	if tokens := b.AvailableTokens(); tokens != 100 {
+		t.Fatalf("Expecting tokens capped at the bucket's size of 100. Was %v", tokens)
+	}
+}
+
+func TestAccumulationCapAboveSize(t *testing.T) {
+	b := newAccumulationCappedBucket(100, 500)
+	defer b.Destroy()
+
+	b.Take(100, 0)
+	rewind(b, time.Hour)
+	if tokens := b.AvailableTokens(); tokens != 100 {
+		t.Fatalf("Expecting tokens capped at the bucket's size of 100. Was %v", tokens)
+	}
+}
+
+func TestBurstAccounting(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		taken     int64
+		refilled  time.Duration
+		requested int64
+		burst     int64
+	}{
+		{"burst only", 0, 0, 10, 10},
+		{"sustained only", 100, 2 * time.Second, 20, 0},
+		{"mixed", 70, time.Second, 25, 15},
+		{"refill capped by size", 5, time.Second, 100, 95},
+		{"sustained with wait", 100, 0, 5, 0}} {
+		cfg := configs.NewDefaultBucketConfig()
+		cfg.Size = 100
+		cfg.FillRate = 10
+		b := factory.NewBucket("memory", "burst", cfg, false).(*tokenBucket)
+
+		if test.taken > 0 {
+			b.Take(test.taken, 0)
+		}
+
+		// Pretend tokens have been refilling since. Safe, since the bucket's goroutine only reads
+		// this field when serving a request.
+		b.tokensNextAvailableNanos -= test.refilled.Nanoseconds()
+
+		w, burst := b.TakeWithBurst(test.requested, time.Second)
+		if w < 0 {
+			t.Fatalf("%v: expecting tokens to be granted", test.name)
+		}
+
+		if burst != test.burst {
+			t.Fatalf("%v: expecting %v burst tokens. Was %v", test.name, test.burst, burst)
+		}
+		b.Destroy()
+	}
+}
+
+func TestNoBurstTokensWhenRejected(t *testing.T) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 100
+	cfg.FillRate = 10
+	b := factory.NewBucket("memory", "burst", cfg, false).(*tokenBucket)
+	defer b.Destroy()
+
+	// Leave the bucket in debt, so the next tokens are 2 seconds away.
+	b.Take(120, 0)
+	if w, burst := b.TakeWithBurst(5, time.Millisecond); w >= 0 || burst != 0 {
+		t.Fatalf("Expecting a rejection without burst tokens. Was %v, %v", w, burst)
+	}
+}
+
+func newAutoTuneBucket(capMultiplier float64, maxFillRate int64) *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 1000
+	cfg.FillRate = 100
+	cfg.AutoTune = true
+	cfg.AutoTuneCapMultiplier = capMultiplier
+	cfg.AutoTuneMaxFillRate = maxFillRate
+	return factory.NewBucket("memory", "autotune", cfg, false).(*tokenBucket)
+}
+
+// simulateDemand feeds the bucket's auto-tuner 50 requests a second for 5 seconds, at
+// tokensPerSec.
+func simulateDemand(b *tokenBucket, tokensPerSec int64) {
+	b.exec(func() {
+		start := time.Now().UnixNano()
+		for i := int64(0); i < 250; i++ {
+			b.autoTune(tokensPerSec/50, start+i*int64(20*time.Millisecond))
+		}
+	})
+}
+
+func TestAutoTuneRaisesFillRate(t *testing.T) {
+	b := newAutoTuneBucket(2, 0)
+	defer b.Destroy()
+
+	simulateDemand(b, 150)
+	if fillRate := b.Config().FillRate; fillRate != 150 {
+		t.Fatalf("Expecting the fill rate to follow demand. Was %v", fillRate)
+	}
+}
+
+func TestAutoTuneBelowThreshold(t *testing.T) {
+	b := newAutoTuneBucket(2, 0)
+	defer b.Destroy()
+
+	simulateDemand(b, 105)
+	if fillRate := b.Config().FillRate; fillRate != 100 {
+		t.Fatalf("Expecting the fill rate to be unchanged. Was %v", fillRate)
+	}
+}
+
+func TestAutoTuneCaps(t *testing.T) {
+	for _, test := range []struct {
+		capMultiplier float64
+		maxFillRate   int64
+		expected      int64
+	}{{2, 0, 200}, {0, 120, 120}, {2, 250, 200}, {3, 250, 250}} {
+		b := newAutoTuneBucket(test.capMultiplier, test.maxFillRate)
+		simulateDemand(b, 1000)
+		if fillRate := b.Config().FillRate; fillRate != test.expected {
+			t.Fatalf("Expecting the fill rate to be capped at %v for %+v. Was %v", test.expected, test, fillRate)
+		}
+		b.Destroy()
+	}
+}
+
+func TestAutoTuneDisabled(t *testing.T) {
+	b := newAutoTuneBucket(2, 0)
+	defer b.Destroy()
+
+	b.cfg.AutoTune = false
+	simulateDemand(b, 150)
+	if fillRate := b.Config().FillRate; fillRate != 100 {
+		t.Fatalf("Expecting the fill rate to be unchanged. Was %v", fillRate)
+	}
+}
+
+func newDrainBucket() *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 100
+	cfg.FillRate = 1
+	// Tokens can't be borrowed, so every token granted was accumulated.
+	cfg.MaxDebtMillis = 0
+	return factory.NewBucket("memory", "drain", cfg, false).(*tokenBucket)
+}
+
+func TestDrainEmpty(t *testing.T) {
+	b := newDrainBucket()
+	defer b.Destroy()
+
+	b.Take(100, 0)
+	if drained, err := b.Drain(); err != nil || drained != 0 {
+		t.Fatalf("Expecting nothing to drain. Was %v, %v", drained, err)
+	}
+}
+
+func TestDrainPartial(t *testing.T) {
+	b := newDrainBucket()
+	defer b.Destroy()
+
+	b.Take(40, 0)
+	if drained, err := b.Drain(); err != nil || drained != 60 {
+		t.Fatalf("Expecting 60 tokens drained. Was %v, %v", drained, err)
+	}
+
+	if tokens := b.AvailableTokens(); tokens != 0 {
+		t.Fatalf("Expecting an empty bucket. Was %v", tokens)
+	}
+
+	if w := b.Take(1, 0); w >= 0 {
+		t.Fatalf("Expecting no tokens after draining. Was %v", w)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	b := newDrainBucket()
+	defer b.Destroy()
+
+	for i := 0; i < 3; i++ {
+		if w := b.Peek(100, 0); w != 0 {
+			t.Fatalf("Expecting tokens to be available. Was %v", w)
+		}
+	}
+
+	if tokens := b.AvailableTokens(); tokens != 100 {
+		t.Fatalf("Expecting peeking not to take tokens. Was %v", tokens)
+	}
+
+	if w := b.Peek(101, 0); w >= 0 {
+		t.Fatalf("Expecting more tokens than the bucket holds to be rejected. Was %v", w)
+	}
+}
+
+func TestTakeCost(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		costs   []int64
+		granted int
+	}{
+		{"small", []int64{10}, 100},
+		{"large", []int64{400}, 2},
+		{"combined", []int64{400, 10, 10, 10}, 8}} {
+		// A bucket of 1000 units, which refills too slowly to matter during the test.
+		cfg := configs.NewDefaultBucketConfig()
+		cfg.Size = 1000
+		cfg.FillRate = 1
+		cfg.MaxDebtMillis = 0
+		b := factory.NewBucket("memory", "cost", cfg, false).(buckets.VariableCostBucket)
+
+		granted := 0
+		for i := 0; b.TakeCost(test.costs[i%len(test.costs)], 0) == 0; i++ {
+			granted++
+		}
+
+		if granted != test.granted {
+			t.Fatalf("Expecting %v %v requests to be granted. Was %v", test.granted, test.name, granted)
+		}
+		b.Destroy()
+	}
+}
+
+func TestTiers(t *testing.T) {
+	ts := newTiers([]configs.TierConfig{{WindowMillis: 1000, MaxTokens: 10}, {WindowMillis: 24 * 3600 * 1000, MaxTokens: 100}})
+	maxDebtNanos := time.Second.Nanoseconds()
+	start := time.Now().UnixNano()
+
+	// 10 requests in the first second use up the per-second tier.
+	for i := 0; i < 10; i++ {
+		if w := ts.waitTime(1, start, 0, maxDebtNanos); w != 0 {
+			t.Fatalf("Expecting request %v to be granted without waiting. Was %v", i, w)
+		}
+		ts.take(1, start)
+	}
+
+	if w := ts.waitTime(1, start, 0, maxDebtNanos); w != 100*time.Millisecond.Nanoseconds() {
+		t.Fatalf("Expecting the per-second tier to make the request wait. Was %v", w)
+	}
+
+	// 90 more, faster than the per-day tier refills a token every 14.4 minutes.
+	now := start
+	for i := 0; i < 90; i++ {
+		now += 6 * time.Second.Nanoseconds()
+		if w := ts.waitTime(1, now, 0, maxDebtNanos); w != 0 {
+			t.Fatalf("Expecting request %v to be granted without waiting. Was %v", i+10, w)
+		}
+		ts.take(1, now)
+	}
+
+	now += 6 * time.Second.Nanoseconds()
+	if w := ts.waitTime(1, now, 0, maxDebtNanos); w >= 0 {
+		t.Fatalf("Expecting the per-day tier to reject the 101st request. Was %v", w)
+	}
+
+	// Tokens returned are available again.
+	ts.addTokens(1, now)
+	if w := ts.waitTime(1, now, 0, maxDebtNanos); w != 0 {
+		t.Fatalf("Expecting the returned token to be granted. Was %v", w)
+	}
+}
+
+func TestBucketWithTiers(t *testing.T) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 1000
+	cfg.FillRate = 1000
+	cfg.MaxDebtMillis = 0
+	cfg.Tiers = []configs.TierConfig{{WindowMillis: 60 * 1000, MaxTokens: 10}}
+	b := factory.NewBucket("memory", "tiers", cfg, false).(*tokenBucket)
+	defer b.Destroy()
+
+	if w := b.Take(10, 0); w != 0 {
+		t.Fatalf("Expecting tokens to be granted. Was %v", w)
+	}
+
+	if w := b.Peek(1, 0); w >= 0 {
+		t.Fatalf("Expecting the tier to reject the request. Was %v", w)
+	}
+
+	if w := b.Take(1, 0); w >= 0 {
+		t.Fatalf("Expecting the tier to reject the request. Was %v", w)
+	}
+
+	// The bucket itself still has tokens, but tiers are unchanged by tuning to the same tiers.
+	tuned := *cfg
+	if err := b.Tune(&tuned); err != nil {
+		t.Fatalf("Unexpected error tuning: %v", err)
+	}
+
+	if w := b.Take(1, 0); w >= 0 {
+		t.Fatalf("Expecting the tier to reject the request after tuning. Was %v", w)
+	}
+}
+
+func newQueueBucket() *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 1
+	cfg.FillRate = 10
+	cfg.MaxDebtMillis = 10000
+	return factory.NewBucket("memory", "queue", cfg, false).(*tokenBucket)
+}
+
+func TestWaitingRequestsServedInOrder(t *testing.T) {
+	b := newQueueBucket()
+	defer b.Destroy()
+
+	// Each request reserves the next tokens to be refilled, so later requests wait longer.
+	b.Take(1, 0)
+	last := b.Take(1, 0)
+	for i := 0; i < 5; i++ {
+		w := b.Take(1, 0)
+		if w <= last {
+			t.Fatalf("Expecting request %v to wait longer than %v. Was %v", i, last, w)
+		}
+		last = w
+	}
+}
+
+func TestTimedOutRequestsReserveNothing(t *testing.T) {
+	b := newQueueBucket()
+	defer b.Destroy()
+
+	b.Take(1, 0)
+	b.Take(1, 0)
+	b.Take(1, 0)
+	if w := b.Take(1, 50*time.Millisecond); w >= 0 {
+		t.Fatalf("Expecting the request to time out before being served. Was %v", w)
+	}
+
+	// The request that timed out didn't hold up the next one.
+	if w := b.Take(1, 0); w > 200*time.Millisecond {
+		t.Fatalf("Expecting the next request to wait for one token. Was %v", w)
+	}
+}
+
+func utcNanos(day, hour, minute int) int64 {
+	return time.Date(2016, 6, day, hour, minute, 0, 0, time.UTC).UnixNano()
+}
+
+func TestFillSchedule(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No time zone database: %v", err)
+	}
+
+	businessHours := newFillSchedule([]configs.FillWindow{{StartHour: 9, EndHour: 17}})
+	overnight := newFillSchedule([]configs.FillWindow{{StartHour: 22, EndHour: 6, Timezone: "America/New_York"}})
+	for _, test := range []struct {
+		name     string
+		schedule fillSchedule
+		from, to int64
+		expected time.Duration
+	}{
+		{"no schedule", nil, utcNanos(1, 1, 0), utcNanos(1, 2, 0), time.Hour},
+		{"within window", businessHours, utcNanos(1, 10, 0), utcNanos(1, 11, 30), 90 * time.Minute},
+		{"outside window", businessHours, utcNanos(1, 18, 0), utcNanos(2, 8, 0), 0},
+		{"crossing window start", businessHours, utcNanos(1, 8, 0), utcNanos(1, 10, 0), time.Hour},
+		{"crossing window end", businessHours, utcNanos(1, 16, 0), utcNanos(1, 19, 0), time.Hour},
+		{"spanning days", businessHours, utcNanos(1, 12, 0), utcNanos(3, 12, 0), 16 * time.Hour},
+		{"crossing midnight", overnight,
+			time.Date(2016, 6, 1, 21, 0, 0, 0, newYork).UnixNano(),
+			time.Date(2016, 6, 2, 7, 0, 0, 0, newYork).UnixNano(), 8 * time.Hour}} {
+		if filling := time.Duration(test.schedule.fillingNanos(test.from, test.to)); filling != test.expected {
+			t.Fatalf("%v: expecting %v of filling. Was %v", test.name, test.expected, filling)
+		}
+	}
+}
+
+func TestOverlappingFillWindows(t *testing.T) {
+	schedule := newFillSchedule([]configs.FillWindow{{StartHour: 9, EndHour: 12}, {StartHour: 11, EndHour: 14}})
+	if filling := time.Duration(schedule.fillingNanos(utcNanos(1, 0, 0), utcNanos(2, 0, 0))); filling != 5*time.Hour {
+		t.Fatalf("Expecting overlapping windows to be counted once. Was %v", filling)
+	}
+}
+
+func TestBucketWithFillSchedule(t *testing.T) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 100000
+	cfg.FillRate = 1
+	cfg.FillSchedule = []configs.FillWindow{{StartHour: 9, EndHour: 17}}
+	b := factory.NewBucket("memory", "schedule", cfg, false).(*tokenBucket)
+	defer b.Destroy()
+
+	// Safe, since the bucket's goroutine only reads these fields when serving a request.
+	b.accumulatedTokens = 10
+	b.tokensNextAvailableNanos = utcNanos(1, 8, 0)
+
+	if tokens, _ := b.accumulated(utcNanos(1, 8, 59), b.nanosBetweenTokens); tokens != 10 {
+		t.Fatalf("Expecting the bucket to stay at its level outside the schedule. Was %v", tokens)
+	}
+
+	if tokens, _ := b.accumulated(utcNanos(1, 10, 0), b.nanosBetweenTokens); tokens != 3610 {
+		t.Fatalf("Expecting the bucket to fill within the schedule. Was %v", tokens)
+	}
+}
+
+func TestTimeMultipliers(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No time zone database: %v", err)
+	}
+
+	businessHours := newTimeMultipliers([]configs.TimeMultiplier{{StartHour: 9, EndHour: 17, Multiplier: 10}})
+	overnight := newTimeMultipliers([]configs.TimeMultiplier{{StartHour: 22, EndHour: 6, Timezone: "America/New_York", Multiplier: 0.5}})
+	for _, test := range []struct {
+		name        string
+		multipliers timeMultipliers
+		at          int64
+		expected    float64
+	}{
+		{"no multipliers", nil, utcNanos(1, 10, 0), 1},
+		{"within window", businessHours, utcNanos(1, 10, 30), 10},
+		{"outside window", businessHours, utcNanos(1, 20, 0), 1},
+		{"window start", businessHours, utcNanos(1, 9, 0), 10},
+		{"before window start", businessHours, utcNanos(1, 8, 59), 1},
+		{"before window end", businessHours, utcNanos(1, 16, 59), 10},
+		{"window end", businessHours, utcNanos(1, 17, 0), 1},
+		{"after midnight", overnight, time.Date(2016, 6, 2, 1, 0, 0, 0, newYork).UnixNano(), 0.5},
+		{"in another timezone", overnight, utcNanos(2, 3, 0), 0.5},
+		{"outside overnight window", overnight, utcNanos(2, 12, 0), 1}} {
+		if m := test.multipliers.at(test.at); m != test.expected {
+			t.Fatalf("%v: expecting a multiplier of %v. Was %v", test.name, test.expected, m)
+		}
+	}
+}
+
+func TestBucketWithTimeMultipliers(t *testing.T) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 100000
+	cfg.FillRate = 1
+	cfg.TimeMultipliers = []configs.TimeMultiplier{{StartHour: 9, EndHour: 17, Multiplier: 10}}
+	b := factory.NewBucket("memory", "multiplied", cfg, false).(*tokenBucket)
+	defer b.Destroy()
+
+	if n := b.nanosBetweenTokensAt(utcNanos(1, 10, 0)); n != 1e8 {
+		t.Fatalf("Expecting 10 tokens a second within the window. Was a token every %v", time.Duration(n))
+	}
+
+	if n := b.nanosBetweenTokensAt(utcNanos(1, 18, 0)); n != 1e9 {
+		t.Fatalf("Expecting a token a second outside the window. Was a token every %v", time.Duration(n))
+	}
+}
+
+func TestConcurrentDrainAndTake(t *testing.T) {
+	b := newDrainBucket()
+	defer b.Destroy()
+
+	var taken, drained int64
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if w := b.Take(5, 0); w >= 0 {
+				m.Lock()
+				taken += 5
+				m.Unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			d, _ := b.Drain()
+			m.Lock()
+			drained += d
+			m.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Every token is either taken or drained, never both. A token may have been refilled during
+	// the test.
+	if total := taken + drained; total < 100 || total > 101 {
+		t.Fatalf("Expecting the 100 tokens to be taken or drained. Was %v taken, %v drained", taken, drained)
+	}
+}
+
+func TestDeadlockDetector(t *testing.T) {
+	d := NewDeadlockDetector(10*time.Millisecond, true)
+	defer d.Stop()
+
+	b := NewBucketFactoryWithDeadlockDetector(d).NewBucket("memory", "deadlock", configs.NewDefaultBucketConfig(), false).(*tokenBucket)
+	defer b.Destroy()
+
+	// Simulate the bucket's goroutine being stuck.
+	release := make(chan struct{})
+	go b.exec(func() { <-release })
+
+	deadline := time.Now().Add(time.Second)
+	for d.DeadlockCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting a deadlock to be detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A bucket is reported once while stuck, and no longer once it recovers.
+	time.Sleep(5 * DeadlockTimeout)
+	close(release)
+	time.Sleep(5 * DeadlockTimeout)
+	if count := d.DeadlockCount(); count != 1 {
+		t.Fatalf("Expecting 1 deadlock. Was %v", count)
+	}
+
+	if w := b.Take(1, 0); w < 0 {
+		t.Fatal("Expecting the bucket to serve requests once it recovers")
+	}
+}
+
+func TestNoDeadlockAfterDestroy(t *testing.T) {
+	d := NewDeadlockDetector(10*time.Millisecond, false)
+	defer d.Stop()
+
+	b := NewBucketFactoryWithDeadlockDetector(d).NewBucket("memory", "destroyed", configs.NewDefaultBucketConfig(), false)
+	b.Destroy()
+	time.Sleep(5 * DeadlockTimeout)
+	if count := d.DeadlockCount(); count != 0 {
+		t.Fatalf("Not expecting destroyed buckets to be reported. Was %v", count)
+	}
+}
+
+func TestOnRefillAbove(t *testing.T) {
+	// A token every 10ms.
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 10
+	cfg.FillRate = 100
+	b := factory.NewBucket("memory", "refill", cfg, false).(buckets.RefillNotifyingBucket)
+	defer b.(buckets.Bucket).Destroy()
+
+	fired := make(chan time.Time, 10)
+	b.OnRefillAbove(0.5, func() { fired <- time.Now() })
+
+	// Full buckets haven't been exhausted, so they haven't recovered.
+	select {
+	case <-fired:
+		t.Fatal("Expecting no callback before the bucket is exhausted")
+	case <-time.After(3 * RefillCheckInterval):
+	}
+
+	for cycle := 0; cycle < 2; cycle++ {
+		exhausted := time.Now()
+		b.(buckets.Bucket).Take(10, 0)
+
+		select {
+		case at := <-fired:
+			if refilled := at.Sub(exhausted); refilled < 50*time.Millisecond {
+				t.Fatalf("Expecting the callback once 5 tokens refilled. Was called after %v", refilled)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting a callback once the bucket refilled in cycle %v", cycle)
+		}
+
+		// Staying above the threshold doesn't call it again.
+		select {
+		case <-fired:
+			t.Fatalf("Expecting a single callback in cycle %v", cycle)
+		case <-time.After(3 * RefillCheckInterval):
+		}
+	}
+}
+
+func TestPreload(t *testing.T) {
+	bc := newStateContainer(100)
+	err := bc.Preload([]buckets.PreloadEntry{
+		{Namespace: "n", BucketName: "user_123"},
+		{Namespace: "missing", BucketName: "user_123"},
+		{Namespace: "n", BucketName: "user_456", InitialTokens: 10}})
+	if err == nil {
+		t.Fatal("Expecting an error preloading a bucket in a missing namespace")
+	}
+
+	// Entries after the one that failed are still preloaded.
+	for _, name := range []string{"user_123", "user_456"} {
+		if !bc.Exists("n", name) {
+			t.Fatalf("Expecting n:%v to be preloaded", name)
+		}
+	}
+
+	if tokens := availableTokens(t, bc, "user_123"); tokens != 100 {
+		t.Fatalf("Expecting n:user_123 to start full. Had %v", tokens)
+	}
+
+	if tokens := availableTokens(t, bc, "user_456"); tokens != 10 {
+		t.Fatalf("Expecting n:user_456 to start with 10 tokens. Had %v", tokens)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	bc := newStateContainer(100)
+	before, _ := bc.FindBucket("n", "before")
+
+	if bc.IsInGracePeriod("n") || !bc.GracePeriodExpiry("n").IsZero() {
+		t.Fatal("Expecting no grace period")
+	}
+
+	start := time.Now()
+	if err := bc.EnterGracePeriod("n", 2, 100*time.Millisecond); err != nil {
+		t.Fatalf("Unable to enter grace period: %v", err)
+	}
+
+	if !bc.IsInGracePeriod("n") {
+		t.Fatal("Expecting n to be in a grace period")
+	}
+
+	if expiry := bc.GracePeriodExpiry("n"); expiry.Before(start.Add(100*time.Millisecond)) || expiry.After(time.Now().Add(100*time.Millisecond)) {
+		t.Fatalf("Expecting the grace period to expire in 100ms. Expires at %v", expiry)
+	}
+
+	// Nested grace periods aren't allowed.
+	if err := bc.EnterGracePeriod("n", 3, time.Minute); err != buckets.ErrInGracePeriod {
+		t.Fatalf("Expecting ErrInGracePeriod. Was %v", err)
+	}
+
+	// Buckets created during the grace period are tuned up too.
+	during, _ := bc.FindBucket("n", "during")
+	for _, b := range []buckets.Bucket{before, during} {
+		if b.Config().FillRate != 2 {
+			t.Fatalf("Expecting fill rate doubled to 2 during the grace period. Was %v", b.Config().FillRate)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for before.Config().FillRate != 1 || during.Config().FillRate != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting fill rates restored once the grace period expires. Were %v, %v",
+				before.Config().FillRate, during.Config().FillRate)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if bc.IsInGracePeriod("n") {
+		t.Fatal("Expecting the grace period to have expired")
+	}
+
+	after, _ := bc.FindBucket("n", "after")
+	if after.Config().FillRate != 1 {
+		t.Fatalf("Expecting buckets created after the grace period not to be tuned up. Was %v", after.Config().FillRate)
+	}
+
+	if err := bc.EnterGracePeriod("n", 2, time.Minute); err != nil {
+		t.Fatalf("Expecting a new grace period once the last expired. Was %v", err)
+	}
+}
+
+func TestEnterGracePeriodErrors(t *testing.T) {
+	bc := newStateContainer(100)
+	if err := bc.EnterGracePeriod("nonexistent", 2, time.Minute); err != buckets.ErrNoSuchNamespace {
+		t.Fatalf("Expecting ErrNoSuchNamespace. Was %v", err)
+	}
+
+	if err := bc.EnterGracePeriod("n", 0, time.Minute); err == nil {
+		t.Fatal("Expecting an error for a multiplier that isn't positive")
+	}
+
+	if err := bc.EnterGracePeriod("n", 2, 0); err == nil {
+		t.Fatal("Expecting an error for a duration that isn't positive")
+	}
+
+	if bc.IsInGracePeriod("n") {
+		t.Fatal("Expecting no grace period after errors")
+	}
+}
+
+func newStatsBucket(dir string) *tokenBucket {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 2
+	cfg.FillRate = 1
+	cfg.PersistStats = true
+	cfg.StatsFlushIntervalMs = 10
+	bf := NewBucketFactoryWithStatsDir(dir)
+	bf.Init(configs.NewDefaultServiceConfig())
+	return bf.NewBucket("n", "b", cfg, false).(*tokenBucket)
+}
+
+func readStats(dir string) buckets.LifetimeStats {
+	s := newLifetimeStats(statsPath(dir, "n:b"))
+	return s.get()
+}
+
+// expectFlushed waits for stats to be persisted to dir.
+func expectFlushed(t *testing.T, dir string, expected buckets.LifetimeStats) {
+	deadline := time.Now().Add(5 * time.Second)
+	for readStats(dir) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting %+v to be flushed. Was %+v", expected, readStats(dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLifetimeStatsPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatalf("Unable to create stats directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The third request borrows a token, and the fourth would have to wait for one.
+	b := newStatsBucket(dir)
+	for i := 0; i < 3; i++ {
+		b.Take(1, 0)
+	}
+	b.Take(1, time.Millisecond)
+	expected := buckets.LifetimeStats{Grants: 3, Rejections: 1}
+	if stats := b.LifetimeStats(); stats != expected {
+		t.Fatalf("Expecting %+v. Was %+v", expected, stats)
+	}
+
+	// Stats are flushed every StatsFlushIntervalMs.
+	expectFlushed(t, dir, expected)
+
+	// Stats are flushed when the bucket is destroyed.
+	b.Take(1, time.Millisecond)
+	b.Destroy()
+	expected.Rejections++
+	expectFlushed(t, dir, expected)
+
+	// Stats are restored when the bucket is re-created.
+	b = newStatsBucket(dir)
+	defer b.Destroy()
+	if stats := b.LifetimeStats(); stats != expected {
+		t.Fatalf("Expecting %+v to be restored. Was %+v", expected, stats)
+	}
+
+	b.Take(1, 0)
+	expected.Grants++
+	if stats := b.LifetimeStats(); stats != expected {
+		t.Fatalf("Expecting restored stats to keep counting. Was %+v", stats)
+	}
+}
+
+func TestStopFlushesStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatalf("Unable to create stats directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["b"] = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["n"].Buckets["b"].PersistStats = true
+	bf := NewBucketFactoryWithStatsDir(dir)
+	bf.Init(cfg)
+	bc := buckets.NewBucketContainer(cfg, bf)
+
+	b, _ := bc.FindBucket("n", "b")
+	b.Take(1, 0)
+
+	// Stats aren't flushed periodically, but are once the container is stopped.
+	bc.Stop()
+	expected := buckets.LifetimeStats{Grants: 1}
+	if stats := readStats(dir); stats != expected {
+		t.Fatalf("Expecting %+v to be persisted when stopped. Was %+v", expected, stats)
+	}
+}
+
+func TestLifetimeStatsNotPersisted(t *testing.T) {
+	b := factory.NewBucket("n", "b", configs.NewDefaultBucketConfig(), false).(*tokenBucket)
+	defer b.Destroy()
+
+	b.Take(1, 0)
+	if stats := b.LifetimeStats(); stats.Grants != 1 || b.stats.path != "" {
+		t.Fatalf("Expecting grants counted without persisting them. Was %+v, %v", stats, b.stats.path)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatalf("Unable to create stats directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "n%3Ab.stats")
+	for _, data := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(data)); err != nil {
+			t.Fatalf("Unable to write %v: %v", path, err)
+		}
+
+		if contents, err := ioutil.ReadFile(path); err != nil || string(contents) != data {
+			t.Fatalf("Expecting %v to contain %v. Was %v, %v", path, data, string(contents), err)
+		}
+	}
+
+	// No temporary files are left behind.
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Expecting only %v in %v. Was %v", path, dir, files)
+	}
+
+	// Failed writes leave the file untouched.
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "n%3Ab.stats"), []byte("third")); err == nil {
+		t.Fatal("Expecting an error writing to a missing directory")
+	}
+
+	if contents, _ := ioutil.ReadFile(path); string(contents) != "second" {
+		t.Fatalf("Expecting %v to be untouched. Was %v", path, string(contents))
+	}
+}
+
+func TestContainerLifetimeStats(t *testing.T) {
+	bc := newStateContainer(100)
+	b, _ := bc.FindBucket("n", "a")
+	b.Take(1, 0)
+
+	if stats, err := bc.LifetimeStats("n", "a"); err != nil || stats.Grants != 1 {
+		t.Fatalf("Expecting 1 grant. Was %+v, %v", stats, err)
+	}
+
+	if _, err := bc.LifetimeStats("n", "nonexistent"); err != buckets.ErrNoSuchBucket {
+		t.Fatalf("Expecting ErrNoSuchBucket. Was %v", err)
+	}
+
+	if bc.Exists("n", "nonexistent") {
+		t.Fatal("Expecting dynamic buckets not to be created")
+	}
+}
+
+func TestDestroyedBucketDoesNotBlock(t *testing.T) {
+	b := factory.NewBucket("memory", "destroyed", configs.NewDefaultBucketConfig(), false).(*tokenBucket)
+	b.Destroy()
+	<-b.done
+
+	returned := make(chan struct{})
+	go func() {
+		b.OnRefillAbove(0.5, func() {})
+		b.AddTokens(1)
+		// Destroying twice is harmless.
+		b.Destroy()
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expecting operations on a destroyed bucket to return")
+	}
+}
+
+func TestEvictWhileTaking(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	nsCfg := configs.NewDefaultNamespaceConfig()
+	nsCfg.DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	// Room for about 2 dynamic buckets, so that buckets are evicted while others take from them.
+	nsCfg.MaxDynamicBucketMemoryBytes = 5 * buckets.DynamicBucketOverheadBytes / 2
+	cfg.Namespaces["n"] = nsCfg
+	bc := buckets.NewBucketContainer(cfg, factory)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if b, _ := bc.FindBucket("n", strconv.Itoa((i+j)%20)); b != nil {
+					b.Take(1, 0)
+				}
+			}
+		}(i)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expecting takes from evicted buckets not to block")
+	}
+}
+
+func TestDestroyedBucketRejects(t *testing.T) {
+	b := factory.NewBucket("memory", "destroyed", configs.NewDefaultBucketConfig(), false).(*tokenBucket)
+	b.Destroy()
+	<-b.done
+
+	if w := b.Take(1, 0); w >= 0 {
+		t.Fatalf("Expecting takes from a destroyed bucket to be rejected. Waited %v", w)
+	}
+
+	if w := b.Peek(1, 0); w >= 0 {
+		t.Fatalf("Expecting peeks at a destroyed bucket to be rejected. Waited %v", w)
+	}
+
+	if err := b.Tune(configs.NewDefaultBucketConfig()); err != buckets.ErrBucketDestroyed {
+		t.Fatalf("Expecting ErrBucketDestroyed. Was %v", err)
+	}
+
+	if _, err := b.Drain(); err != buckets.ErrBucketDestroyed {
+		t.Fatalf("Expecting ErrBucketDestroyed. Was %v", err)
+	}
+}
+
+func TestDonationWithoutDebt(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	for _, nsName := range []string{"donor", "recipient"} {
+		cfg.Namespaces[nsName] = configs.NewDefaultNamespaceConfig()
+		cfg.Namespaces[nsName].AggregateBucket = configs.NewDefaultBucketConfig()
+		cfg.Namespaces[nsName].AggregateBucket.FillRate = 1
+	}
+	cfg.Namespaces["recipient"].AcceptDonationsFrom = []string{"donor"}
+	bc := buckets.NewBucketContainer(cfg, factory)
+
+	donor := bc.AggregateBucket("donor").(buckets.TokenCounter)
+	if err := bc.DonateTokens("donor", "recipient", 101); err != buckets.ErrInsufficientTokens {
+		t.Fatalf("Expecting ErrInsufficientTokens donating more tokens than the donor has. Was %v", err)
+	}
+
+	if tokens := donor.AvailableTokens(); tokens != 100 {
+		t.Fatalf("Expecting the donor to keep its 100 tokens, without going into debt. Had %v", tokens)
+	}
+
+	if err := bc.DonateTokens("donor", "recipient", 100); err != nil {
+		t.Fatalf("Expecting the donor's tokens to be donated. Was %v", err)
+	}
+
+	if tokens := donor.AvailableTokens(); tokens != 0 {
+		t.Fatalf("Expecting the donor to have no tokens left. Had %v", tokens)
+	}
+}
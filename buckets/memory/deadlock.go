@@ -0,0 +1,137 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// DeadlockTimeout is how long a bucket's goroutine may take to respond before the bucket is
+// reported as deadlocked.
+const DeadlockTimeout = 100 * time.Millisecond
+
+// DeadlockDetector periodically checks that the goroutines serving memory buckets are responsive.
+// Since a bucket's goroutine serves all of its requests, a goroutine that is stuck, such as on a
+// lock that is never released, blocks all Take() calls on the bucket forever. Each bucket is
+// reported once each time it becomes stuck.
+type DeadlockDetector struct {
+	count      int64 // First, so atomic operations on it are aligned.
+	interval   time.Duration
+	dumpStacks bool
+	buckets    map[*tokenBucket]bool // Whether each bucket was stuck when last checked.
+	stopper    chan struct{}
+	sync.Mutex // Embedded mutex
+}
+
+// NewDeadlockDetector creates a detector that checks buckets every interval. If dumpStacks is
+// set, the stacks of all goroutines are logged when a deadlock is detected.
+func NewDeadlockDetector(interval time.Duration, dumpStacks bool) *DeadlockDetector {
+	if interval <= 0 {
+		panic("Deadlock detection interval should be positive")
+	}
+
+	d := &DeadlockDetector{
+		interval:   interval,
+		dumpStacks: dumpStacks,
+		buckets:    make(map[*tokenBucket]bool),
+		stopper:    make(chan struct{})}
+	go d.run()
+	return d
+}
+
+// NewBucketFactoryWithDeadlockDetector creates a factory whose buckets are checked by d.
+func NewBucketFactoryWithDeadlockDetector(d *DeadlockDetector) buckets.BucketFactory {
+	return &bucketFactory{detector: d}
+}
+
+// DeadlockCount returns the number of times buckets have been found deadlocked.
+func (d *DeadlockDetector) DeadlockCount() int64 {
+	return atomic.LoadInt64(&d.count)
+}
+
+// Stop stops checking buckets.
+func (d *DeadlockDetector) Stop() {
+	close(d.stopper)
+}
+
+func (d *DeadlockDetector) watch(b *tokenBucket) {
+	d.Lock()
+	defer d.Unlock()
+	d.buckets[b] = false
+}
+
+func (d *DeadlockDetector) unwatch(b *tokenBucket) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.buckets, b)
+}
+
+func (d *DeadlockDetector) run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.checkAll()
+		case <-d.stopper:
+			return
+		}
+	}
+}
+
+func (d *DeadlockDetector) checkAll() {
+	d.Lock()
+	bs := make([]*tokenBucket, 0, len(d.buckets))
+	for b := range d.buckets {
+		bs = append(bs, b)
+	}
+	d.Unlock()
+
+	for _, b := range bs {
+		stuck := !b.responsive(DeadlockTimeout)
+
+		d.Lock()
+		wasStuck, watched := d.buckets[b]
+		if watched {
+			d.buckets[b] = stuck
+		}
+		d.Unlock()
+
+		if stuck && watched && !wasStuck {
+			d.report(b)
+		}
+	}
+}
+
+func (d *DeadlockDetector) report(b *tokenBucket) {
+	atomic.AddInt64(&d.count, 1)
+	logging.Printf("CRITICAL: Bucket %v hasn't responded in %v, and may be deadlocked.", b.fullName, DeadlockTimeout)
+	if d.dumpStacks {
+		buf := make([]byte, 1<<20)
+		logging.Printf("Goroutines:\n%s", buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// responsive tells you if the bucket's goroutine picks up work within timeout. Buckets that have
+// been destroyed are responsive.
+func (b *tokenBucket) responsive(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case b.executor <- func() {}:
+		return true
+	case <-b.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,43 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"github.com/maniksurtani/quotaservice/buckets"
+)
+
+// tokenHistory is a fixed-size ring buffer of the most recent token levels of a bucket. It is only
+// accessed by the bucket's goroutine.
+type tokenHistory struct {
+	snapshots []buckets.TokenSnapshot
+	next      int
+	full      bool
+}
+
+func newTokenHistory(size int64) *tokenHistory {
+	if size < 1 {
+		size = 1
+	}
+
+	return &tokenHistory{snapshots: make([]buckets.TokenSnapshot, size)}
+}
+
+func (h *tokenHistory) record(s buckets.TokenSnapshot) {
+	h.snapshots[h.next] = s
+	h.next = (h.next + 1) % len(h.snapshots)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// all returns a copy of the snapshots in the history, oldest first.
+func (h *tokenHistory) all() []buckets.TokenSnapshot {
+	if !h.full {
+		return append([]buckets.TokenSnapshot(nil), h.snapshots[:h.next]...)
+	}
+
+	all := make([]buckets.TokenSnapshot, 0, len(h.snapshots))
+	all = append(all, h.snapshots[h.next:]...)
+	return append(all, h.snapshots[:h.next]...)
+}
@@ -0,0 +1,57 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"time"
+
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// timeMultipliers scale a bucket's fill rate during daily windows. Empty unless the bucket is
+// configured with TimeMultipliers.
+type timeMultipliers []timeMultiplier
+
+type timeMultiplier struct {
+	window     fillWindow
+	multiplier float64
+}
+
+func newTimeMultipliers(multipliers []configs.TimeMultiplier) timeMultipliers {
+	m := make(timeMultipliers, len(multipliers))
+	for i, tm := range multipliers {
+		loc, err := time.LoadLocation(tm.Timezone)
+		if err != nil {
+			// Validated with the rest of the config, so only possible for configs that weren't.
+			logging.Printf("Unknown time_multipliers timezone %v, using UTC. Error %v", tm.Timezone, err)
+			loc = time.UTC
+		}
+
+		m[i] = timeMultiplier{fillWindow{tm.StartHour, tm.EndHour, loc}, tm.Multiplier}
+	}
+
+	return m
+}
+
+// at returns the multiplier of the first window containing a point in time, or 1 if none does.
+func (m timeMultipliers) at(nanos int64) float64 {
+	for _, tm := range m {
+		if tm.window.contains(nanos) {
+			return tm.multiplier
+		}
+	}
+
+	return 1
+}
+
+// contains tells you whether a point in time falls within the window on its day.
+func (w fillWindow) contains(nanos int64) bool {
+	hour := time.Unix(0, nanos).In(w.loc).Hour()
+	if w.endHour < w.startHour {
+		return hour >= w.startHour || hour < w.endHour
+	}
+
+	return hour >= w.startHour && hour < w.endHour
+}
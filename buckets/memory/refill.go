@@ -0,0 +1,64 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"fmt"
+	"time"
+)
+
+// RefillCheckInterval is how often buckets with refill callbacks check how many tokens they hold.
+const RefillCheckInterval = 100 * time.Millisecond
+
+// refillWatch calls fn once a bucket that has been exhausted refills to a threshold fraction of
+// its size.
+type refillWatch struct {
+	threshold float64
+	fn        func()
+	exhausted bool
+}
+
+// OnRefillAbove implements buckets.RefillNotifyingBucket. Exhaustion is noticed whenever tokens are
+// taken or drained, and refilling every RefillCheckInterval.
+func (b *tokenBucket) OnRefillAbove(threshold float64, fn func()) {
+	if threshold <= 0 || threshold > 1 {
+		panic(fmt.Sprintf("Refill threshold should be in (0, 1], but is %v", threshold))
+	}
+
+	b.exec(func() {
+		w := &refillWatch{threshold: threshold, fn: fn}
+		b.refillWatches = append(b.refillWatches, w)
+		if b.refillTicker == nil {
+			b.refillTicker = time.NewTicker(RefillCheckInterval)
+		}
+		w.observe(b.tokensAt(time.Now().UnixNano()), b.cfg.Size)
+	})
+}
+
+// refillTicks returns the channel refill checks are ticked on, or nil if nothing is watching for
+// refills, so that the bucket's goroutine never selects it.
+func (b *tokenBucket) refillTicks() <-chan time.Time {
+	if b.refillTicker == nil {
+		return nil
+	}
+
+	return b.refillTicker.C
+}
+
+// observeTokens passes the number of tokens the bucket holds to its refill watches. Must be called
+// on the bucket's goroutine.
+func (b *tokenBucket) observeTokens(tokens int64) {
+	for _, w := range b.refillWatches {
+		w.observe(tokens, b.cfg.Size)
+	}
+}
+
+func (w *refillWatch) observe(tokens, size int64) {
+	if tokens <= 0 {
+		w.exhausted = true
+	} else if w.exhausted && float64(tokens) >= w.threshold*float64(size) {
+		w.exhausted = false
+		go w.fn()
+	}
+}
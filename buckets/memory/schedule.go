@@ -0,0 +1,103 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// fillSchedule is the daily windows during which a bucket refills. An empty schedule refills all
+// the time.
+type fillSchedule []fillWindow
+
+type fillWindow struct {
+	startHour, endHour int
+	loc                *time.Location
+}
+
+func newFillSchedule(windows []configs.FillWindow) fillSchedule {
+	schedule := make(fillSchedule, len(windows))
+	for i, w := range windows {
+		loc, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			// Validated with the rest of the config, so only possible for configs that weren't.
+			logging.Printf("Unknown fill_schedule timezone %v, using UTC. Error %v", w.Timezone, err)
+			loc = time.UTC
+		}
+
+		schedule[i] = fillWindow{w.StartHour, w.EndHour, loc}
+	}
+
+	return schedule
+}
+
+type interval struct {
+	from, to int64
+}
+
+// fillingNanos returns how many of the nanoseconds between fromNanos and toNanos fall within the
+// schedule, counting overlapping windows once.
+func (s fillSchedule) fillingNanos(fromNanos, toNanos int64) int64 {
+	if len(s) == 0 || toNanos <= fromNanos {
+		return max(0, toNanos-fromNanos)
+	}
+
+	var intervals []interval
+	for _, w := range s {
+		intervals = w.intervals(fromNanos, toNanos, intervals)
+	}
+
+	sort.Sort(byStart(intervals))
+
+	var filling, end int64
+	for _, i := range intervals {
+		from := max(i.from, end)
+		if i.to > from {
+			filling += i.to - from
+		}
+		end = max(end, i.to)
+	}
+
+	return filling
+}
+
+// intervals appends the parts of each day's window that fall between fromNanos and toNanos.
+func (w fillWindow) intervals(fromNanos, toNanos int64, intervals []interval) []interval {
+	from := time.Unix(0, fromNanos).In(w.loc)
+	to := time.Unix(0, toNanos)
+
+	// Start from the day before, in case its window crosses midnight.
+	for day := time.Date(from.Year(), from.Month(), from.Day()-1, 0, 0, 0, 0, w.loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		start := time.Date(day.Year(), day.Month(), day.Day(), w.startHour, 0, 0, 0, w.loc)
+		end := time.Date(day.Year(), day.Month(), day.Day(), w.endHour, 0, 0, 0, w.loc)
+		if w.endHour < w.startHour {
+			end = time.Date(day.Year(), day.Month(), day.Day()+1, w.endHour, 0, 0, 0, w.loc)
+		}
+
+		i := interval{max(fromNanos, start.UnixNano()), min(toNanos, end.UnixNano())}
+		if i.to > i.from {
+			intervals = append(intervals, i)
+		}
+	}
+
+	return intervals
+}
+
+type byStart []interval
+
+func (b byStart) Len() int {
+	return len(b)
+}
+
+func (b byStart) Less(i, j int) bool {
+	return b[i].from < b[j].from
+}
+
+func (b byStart) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
@@ -0,0 +1,168 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// lifetimeStats counts the requests a bucket grants and rejects. The counts are only updated by
+// the bucket's goroutine, but may be read by others.
+type lifetimeStats struct {
+	grants, rejections int64
+	flushing           int32 // 1 while flushAsync() is writing the counts.
+	// path is the file the counts are persisted to, or empty unless the bucket is configured with
+	// PersistStats.
+	path string
+	// written is the sum of the counts last persisted. Since the counts only grow, flushes that
+	// find them unchanged are skipped.
+	written    int64
+	sync.Mutex // Serializes flushes.
+}
+
+// NewBucketFactoryWithStatsDir creates a factory whose buckets configured with PersistStats
+// persist their lifetime stats to files in dir, one per bucket.
+func NewBucketFactoryWithStatsDir(dir string) buckets.BucketFactory {
+	if dir == "" {
+		panic("Stats directory should not be empty")
+	}
+
+	return &bucketFactory{statsDir: dir}
+}
+
+// statsPath returns the file a bucket's stats are persisted to, named after its fully qualified
+// name.
+func statsPath(dir, fullName string) string {
+	return filepath.Join(dir, url.PathEscape(fullName)+".stats")
+}
+
+// newLifetimeStats restores the counts persisted to path, if any.
+func newLifetimeStats(path string) *lifetimeStats {
+	s := &lifetimeStats{path: path}
+	if path == "" {
+		return s
+	}
+
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s
+	}
+
+	var persisted buckets.LifetimeStats
+	if err == nil {
+		err = json.Unmarshal(bytes, &persisted)
+	}
+
+	if err != nil {
+		logging.Printf("Unable to restore stats from %v, starting from 0: %v", path, err)
+		return s
+	}
+
+	s.grants, s.rejections = persisted.Grants, persisted.Rejections
+	s.written = s.grants + s.rejections
+	return s
+}
+
+func (s *lifetimeStats) record(granted bool) {
+	if granted {
+		atomic.AddInt64(&s.grants, 1)
+	} else {
+		atomic.AddInt64(&s.rejections, 1)
+	}
+}
+
+func (s *lifetimeStats) get() buckets.LifetimeStats {
+	return buckets.LifetimeStats{
+		Grants:     atomic.LoadInt64(&s.grants),
+		Rejections: atomic.LoadInt64(&s.rejections)}
+}
+
+// flush persists the counts, if the bucket is configured to, and they have changed since they were
+// last persisted. The bucket's goroutine should use flushAsync() instead, so that requests aren't
+// held up by writes.
+func (s *lifetimeStats) flush() {
+	if s.path == "" {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	stats := s.get()
+	if stats.Grants+stats.Rejections == s.written {
+		return
+	}
+
+	bytes, err := json.Marshal(stats)
+	if err == nil {
+		err = writeFileAtomic(s.path, bytes)
+	}
+
+	if err != nil {
+		logging.Printf("Unable to persist stats to %v: %v", s.path, err)
+		return
+	}
+
+	s.written = stats.Grants + stats.Rejections
+}
+
+// flushAsync flushes the counts on a new goroutine, unless an earlier flushAsync() is still
+// writing them.
+func (s *lifetimeStats) flushAsync() {
+	if s.path == "" || !atomic.CompareAndSwapInt32(&s.flushing, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&s.flushing, 0)
+		s.flush()
+	}()
+}
+
+// writeFileAtomic writes data to a temporary file alongside path, and renames it to path, so that
+// readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// LifetimeStats implements buckets.LifetimeStatsBucket.
+func (b *tokenBucket) LifetimeStats() buckets.LifetimeStats {
+	return b.stats.get()
+}
+
+// FlushStats implements buckets.StatsPersistingBucket.
+func (b *tokenBucket) FlushStats() {
+	b.stats.flush()
+}
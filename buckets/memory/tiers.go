@@ -0,0 +1,63 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// tier is a token bucket of MaxTokens, refilled at MaxTokens per window, that a bucket's requests
+// must also be granted by. Rather than counting tokens, it tracks when it would be full again, so
+// that tokens refilled slowly, such as a few a day, aren't lost to rounding between requests.
+type tier struct {
+	size               int64
+	nanosBetweenTokens int64
+	fullNanos          int64 // When the tier would be full again, if no more tokens were taken.
+}
+
+type tiers []*tier
+
+func newTiers(cfgs []configs.TierConfig) tiers {
+	ts := make(tiers, len(cfgs))
+	for i, cfg := range cfgs {
+		ts[i] = &tier{size: cfg.MaxTokens, nanosBetweenTokens: cfg.WindowMillis * 1e6 / cfg.MaxTokens}
+	}
+
+	return ts
+}
+
+// waitTime returns how long a request for tokens would wait for the tier to refill.
+func (t *tier) waitTime(requested, currentTimeNanos int64) int64 {
+	fullNanos := max(t.fullNanos, currentTimeNanos) + requested*t.nanosBetweenTokens
+	return max(0, fullNanos-currentTimeNanos-t.size*t.nanosBetweenTokens)
+}
+
+// waitTime returns the longest wait for tokens across all tiers, or -1 if any tier would make the
+// request wait longer than maxDebtNanos, or than maxWaitTimeNanos if it is positive.
+func (ts tiers) waitTime(requested, currentTimeNanos, maxWaitTimeNanos, maxDebtNanos int64) int64 {
+	var waitTimeNanos int64
+	for _, t := range ts {
+		w := t.waitTime(requested, currentTimeNanos)
+		if w > maxDebtNanos || (w > maxWaitTimeNanos && maxWaitTimeNanos > 0) {
+			return -1
+		}
+
+		waitTimeNanos = max(waitTimeNanos, w)
+	}
+
+	return waitTimeNanos
+}
+
+func (ts tiers) take(requested, currentTimeNanos int64) {
+	for _, t := range ts {
+		t.fullNanos = max(t.fullNanos, currentTimeNanos) + requested*t.nanosBetweenTokens
+	}
+}
+
+// addTokens returns tokens to all tiers, which never hold more than their size.
+func (ts tiers) addTokens(numTokens, currentTimeNanos int64) {
+	for _, t := range ts {
+		t.fullNanos = max(currentTimeNanos, t.fullNanos-numTokens*t.nanosBetweenTokens)
+	}
+}
@@ -0,0 +1,110 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync"
+
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// fillRateModifiers multiplies the fill rates of a namespace's buckets by factors set by features
+// such as grace periods and feedback sources. A bucket's fill rate is always its configured fill
+// rate multiplied by every active factor, so overlapping modifiers can start and end in any order.
+// The zero value has no factors.
+type fillRateModifiers struct {
+	// factors holds the active factors, keyed by whatever set them.
+	factors map[interface{}]float64
+	// modified holds the buckets whose fill rates have been multiplied.
+	modified map[Bucket]*modifiedBucket
+	sync.Mutex
+}
+
+type modifiedBucket struct {
+	// base is the bucket's config before any factor was applied.
+	base   *configs.BucketConfig
+	factor float64
+}
+
+// set sets the factor owned by key, removing it if factor is 1, and applies the factors to the
+// buckets passed in. Buckets not passed in are forgotten, since they may have been destroyed.
+func (m *fillRateModifiers) set(key interface{}, factor float64, bs []Bucket) {
+	m.Lock()
+	defer m.Unlock()
+
+	if factor == 1 {
+		delete(m.factors, key)
+	} else {
+		if m.factors == nil {
+			m.factors = make(map[interface{}]float64)
+		}
+		m.factors[key] = factor
+	}
+
+	live := make(map[Bucket]bool, len(bs))
+	for _, b := range bs {
+		live[b] = true
+		m.applyLocked(b)
+	}
+
+	for b := range m.modified {
+		if !live[b] {
+			delete(m.modified, b)
+		}
+	}
+}
+
+// apply multiplies the fill rate of a bucket by the active factors, such as when it is created.
+func (m *fillRateModifiers) apply(b Bucket) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.applyLocked(b)
+}
+
+func (m *fillRateModifiers) applyLocked(b Bucket) {
+	factor := 1.0
+	for _, f := range m.factors {
+		factor *= f
+	}
+
+	mb := m.modified[b]
+	if mb == nil {
+		if factor == 1 {
+			return
+		}
+		mb = &modifiedBucket{base: b.Config(), factor: 1}
+	}
+
+	if mb.factor == factor {
+		return
+	}
+
+	cfg := mb.base
+	if factor != 1 {
+		modified := *mb.base
+		modified.FillRate = int64(float64(mb.base.FillRate) * factor)
+		if modified.FillRate < 1 {
+			modified.FillRate = 1
+		}
+		cfg = &modified
+	}
+
+	if err := b.Tune(cfg); err != nil {
+		logging.Printf("Unable to multiply fill rate of %v by %v: %v", mb.base, factor, err)
+		return
+	}
+
+	if factor == 1 {
+		delete(m.modified, b)
+		return
+	}
+
+	if m.modified == nil {
+		m.modified = make(map[Bucket]*modifiedBucket)
+	}
+	mb.factor = factor
+	m.modified[b] = mb
+}
@@ -0,0 +1,269 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/maniksurtani/quotaservice/buckets/trie"
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// namespaceRegistry holds a container's namespaces, keyed by name. Registries are populated when
+// the container is created, and only read afterwards. Renaming a namespace replaces the registry
+// with a renamed copy.
+type namespaceRegistry interface {
+	Get(name string) interface{}
+	Put(name string, ns interface{})
+	Len() int
+	Walk(f func(name string, ns interface{}))
+}
+
+// registryRef wraps a namespaceRegistry, so that registries of different types may be stored in the
+// same atomic.Value.
+type registryRef struct {
+	namespaceRegistry
+}
+
+func (bc *BucketContainer) registry() namespaceRegistry {
+	return bc.namespaces.Load().(registryRef).namespaceRegistry
+}
+
+// newRegistryLike returns an empty registry of the same type as r.
+func newRegistryLike(r namespaceRegistry) namespaceRegistry {
+	if _, ok := r.(*trie.NamespaceRegistry); ok {
+		return trie.New()
+	}
+
+	return make(mapRegistry)
+}
+
+// mapRegistry is the default namespaceRegistry.
+type mapRegistry map[string]interface{}
+
+func (m mapRegistry) Get(name string) interface{} {
+	return m[name]
+}
+
+func (m mapRegistry) Put(name string, ns interface{}) {
+	if ns == nil {
+		delete(m, name)
+	} else {
+		m[name] = ns
+	}
+}
+
+func (m mapRegistry) Len() int {
+	return len(m)
+}
+
+func (m mapRegistry) Walk(f func(name string, ns interface{})) {
+	for name, ns := range m {
+		f(name, ns)
+	}
+}
+
+// namespace returns a namespace by name or alias, or nil if it doesn't exist.
+func (bc *BucketContainer) namespace(name string) *namespace {
+	ns, _ := bc.registry().Get(bc.resolveAlias(name)).(*namespace)
+	return ns
+}
+
+// resolveAlias returns the name of the namespace an alias stands for. Names that aren't aliases
+// are returned as-is.
+func (bc *BucketContainer) resolveAlias(name string) string {
+	aliases := bc.aliasMap()
+	if len(aliases) == 0 {
+		return name
+	}
+
+	// Aliases are checked for cycles when added.
+	resolved, _ := configs.ResolveNamespaceAlias(aliases, name)
+	return resolved
+}
+
+// ResolveNamespace returns the name of the namespace an alias stands for. Names that aren't aliases
+// are returned as-is, whether or not they are namespaces.
+func (bc *BucketContainer) ResolveNamespace(name string) string {
+	return bc.resolveAlias(name)
+}
+
+// NamespaceConfig returns the config of a namespace by name or alias, as passed to
+// NewBucketContainer, or nil if it doesn't exist. Configs follow renames made using
+// RenameNamespace().
+func (bc *BucketContainer) NamespaceConfig(name string) *configs.NamespaceConfig {
+	nsConfigs, _ := bc.nsConfigs.Load().(map[string]*configs.NamespaceConfig)
+	return nsConfigs[bc.resolveAlias(name)]
+}
+
+func (bc *BucketContainer) aliasMap() map[string]string {
+	aliases, _ := bc.aliases.Load().(map[string]string)
+	return aliases
+}
+
+// AddAlias makes alias stand for the namespace target, which may itself be an alias. Returns
+// ErrNamespaceExists if alias is the name of a namespace, ErrCircularAlias if the alias would lead
+// back to itself, and ErrNoSuchNamespace if target doesn't lead to a namespace.
+func (bc *BucketContainer) AddAlias(alias, target string) error {
+	bc.aliasLock.Lock()
+	defer bc.aliasLock.Unlock()
+
+	if bc.registry().Get(alias) != nil {
+		return ErrNamespaceExists
+	}
+
+	aliases := make(map[string]string)
+	for a, t := range bc.aliasMap() {
+		aliases[a] = t
+	}
+	aliases[alias] = target
+
+	resolved, err := configs.ResolveNamespaceAlias(aliases, alias)
+	if err != nil {
+		return ErrCircularAlias
+	}
+
+	if bc.registry().Get(resolved) == nil {
+		return ErrNoSuchNamespace
+	}
+
+	bc.aliases.Store(aliases)
+	logging.Printf("Namespace alias %v added for %v", alias, target)
+	return nil
+}
+
+// ListNamespaces returns the names of all namespaces, sorted. Aliases aren't included; use
+// ListAliases() for them.
+func (bc *BucketContainer) ListNamespaces() []string {
+	registry := bc.registry()
+	names := make([]string, 0, registry.Len())
+	registry.Walk(func(name string, _ interface{}) {
+		names = append(names, name)
+	})
+
+	sort.Strings(names)
+	return names
+}
+
+// ListAliases returns a copy of the namespace aliases, mapping each alias to the name it stands
+// for, which may be another alias.
+func (bc *BucketContainer) ListAliases() map[string]string {
+	aliases := make(map[string]string)
+	for a, t := range bc.aliasMap() {
+		aliases[a] = t
+	}
+
+	return aliases
+}
+
+// WithTrieNamespaceRegistry stores namespaces in a compressed trie rather than a map, which uses
+// less memory in deployments with very many namespaces sharing common prefixes, at the cost of
+// slightly slower lookups. Must be called before the container is used.
+func (bc *BucketContainer) WithTrieNamespaceRegistry() *BucketContainer {
+	t := trie.New()
+	bc.registry().Walk(func(name string, ns interface{}) {
+		t.Put(name, ns)
+	})
+
+	bc.namespaces.Store(registryRef{t})
+	return bc
+}
+
+// RenameNamespace renames a namespace, keeping its buckets and their state. Aliases of the old
+// name, namespaces whose parent it is, and NamespaceConfig() follow the rename, so settings read
+// from the config keep applying. The service config passed to NewBucketContainer isn't modified. Requests that found the namespace before the rename
+// are served by it as usual, and requests against the old name afterwards are treated as for any
+// namespace that doesn't exist. Buckets keep the name they were created with, such as in the keys
+// of a shared store; only buckets created after the rename use the new name. Returns
+// ErrNoSuchNamespace if oldName isn't a namespace, and ErrNamespaceExists if newName is already a
+// namespace or an alias.
+func (bc *BucketContainer) RenameNamespace(oldName, newName string) error {
+	if newName == "" {
+		return fmt.Errorf("Invalid namespace name %q", newName)
+	}
+
+	bc.aliasLock.Lock()
+	defer bc.aliasLock.Unlock()
+	bc.hierarchyLock.Lock()
+	defer bc.hierarchyLock.Unlock()
+
+	registry := bc.registry()
+	ns, _ := registry.Get(oldName).(*namespace)
+	if ns == nil {
+		return ErrNoSuchNamespace
+	}
+
+	if registry.Get(newName) != nil || bc.aliasMap()[newName] != "" {
+		return ErrNamespaceExists
+	}
+
+	renamed := newRegistryLike(registry)
+	var locked []string
+	registry.Walk(func(name string, v interface{}) {
+		if name == oldName || v.(*namespace).parent() == oldName {
+			locked = append(locked, name)
+		}
+
+		if name == oldName {
+			name = newName
+		}
+		renamed.Put(name, v)
+	})
+
+	aliases := make(map[string]string)
+	for a, t := range bc.aliasMap() {
+		if t == oldName {
+			t = newName
+		}
+		aliases[a] = t
+	}
+
+	// Requests that found the namespace or its children wait for the rename to complete, so they
+	// never find a parent that doesn't exist. Namespaces are locked in name order, as by
+	// DonateTokens(), to prevent deadlocks.
+	sort.Strings(locked)
+	for _, name := range locked {
+		registry.Get(name).(*namespace).Lock()
+	}
+
+	bc.namespaces.Store(registryRef{renamed})
+	bc.aliases.Store(aliases)
+	for _, name := range locked {
+		if child := registry.Get(name).(*namespace); child.parentName == oldName {
+			child.parentName = newName
+		}
+	}
+	bc.renameNamespaceConfig(oldName, newName)
+
+	for _, name := range locked {
+		registry.Get(name).(*namespace).Unlock()
+	}
+
+	logging.Printf("Namespace %v renamed to %v", oldName, newName)
+	return nil
+}
+
+// renameNamespaceConfig publishes a copy of the namespace configs keyed by the new name, with
+// copies of the configs of the namespace's children pointing at the new name. Configs already
+// published are left alone, so readers of them are unaffected. Must be called with aliasLock held.
+func (bc *BucketContainer) renameNamespaceConfig(oldName, newName string) {
+	nsConfigs := bc.nsConfigs.Load().(map[string]*configs.NamespaceConfig)
+	renamed := make(map[string]*configs.NamespaceConfig, len(nsConfigs))
+	for name, nsCfg := range nsConfigs {
+		if name == oldName {
+			name = newName
+		}
+
+		if nsCfg.Parent == oldName {
+			child := *nsCfg
+			child.Parent = newName
+			nsCfg = &child
+		}
+		renamed[name] = nsCfg
+	}
+
+	bc.nsConfigs.Store(renamed)
+}
@@ -0,0 +1,207 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package partitioned implements token buckets that partition a bucket's capacity across multiple
+// instances of the quota service. In a deployment of 10 instances sharing a bucket with a fill rate
+// of 1000 tokens per second, each instance owns a bucket with a fill rate of 100 tokens per second,
+// rather than racing with every other instance for tokens in a shared bucket.
+//
+// Bucket names are suffixed with the instance ID, so that instances don't share state even if the
+// wrapped bucket factory stores buckets in a shared backend such as Redis.
+package partitioned
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// InstancePartitionedBucketFactory creates buckets that own a share of the configured fill rate.
+type InstancePartitionedBucketFactory struct {
+	inner          buckets.BucketFactory
+	instanceID     string
+	totalInstances int64
+	liveBuckets    map[*partitionedBucket]bool
+	sync.Mutex     // Embedded mutex
+}
+
+// NewBucketFactory creates a factory for buckets that own a 1/totalInstances share of the fill rate
+// of buckets created by inner.
+func NewBucketFactory(inner buckets.BucketFactory, instanceID string, totalInstances int) *InstancePartitionedBucketFactory {
+	if totalInstances < 1 {
+		panic(fmt.Sprintf("totalInstances should be positive, but is %v", totalInstances))
+	}
+
+	return &InstancePartitionedBucketFactory{
+		inner:          inner,
+		instanceID:     instanceID,
+		totalInstances: int64(totalInstances),
+		liveBuckets:    make(map[*partitionedBucket]bool)}
+}
+
+func (bf *InstancePartitionedBucketFactory) Init(cfg *configs.ServiceConfig) {
+	bf.inner.Init(cfg)
+}
+
+func (bf *InstancePartitionedBucketFactory) Ready() bool {
+	return bf.inner.Ready()
+}
+
+func (bf *InstancePartitionedBucketFactory) ReadyErr() error {
+	return bf.inner.ReadyErr()
+}
+
+func (bf *InstancePartitionedBucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	bf.Lock()
+	defer bf.Unlock()
+
+	b := &partitionedBucket{
+		ActivityChannel: buckets.NewActivityChannel(),
+		factory:         bf,
+		namespace:       namespace,
+		bucketName:      bucketName,
+		cfg:             cfg,
+		dynamic:         dyn}
+	b.delegate = bf.newDelegate(b)
+	bf.liveBuckets[b] = true
+	return b
+}
+
+// Rebalance adjusts the share of the fill rate owned by all buckets created by this factory, when
+// instances are added or removed. Existing buckets are re-created with their new fill rate, and
+// start full.
+func (bf *InstancePartitionedBucketFactory) Rebalance(newTotalInstances int) error {
+	if newTotalInstances < 1 {
+		return errors.New("Total instances should be positive")
+	}
+
+	bf.Lock()
+	defer bf.Unlock()
+
+	logging.Printf("Rebalancing buckets on instance %v from %v to %v instances",
+		bf.instanceID, bf.totalInstances, newTotalInstances)
+	bf.totalInstances = int64(newTotalInstances)
+	for b := range bf.liveBuckets {
+		b.replaceDelegate(bf.newDelegate(b))
+	}
+
+	return nil
+}
+
+// newDelegate creates a bucket for this instance's share of the fill rate. Must be called while
+// holding the factory's lock.
+func (bf *InstancePartitionedBucketFactory) newDelegate(b *partitionedBucket) buckets.Bucket {
+	cfg := *b.cfg
+	cfg.FillRate = bf.shareOf(b.cfg.FillRate)
+	return bf.inner.NewBucket(b.namespace, fmt.Sprintf("%v:%v", b.bucketName, bf.instanceID), &cfg, b.dynamic)
+}
+
+// shareOf returns this instance's share of a fill rate. Must be called while holding the factory's
+// lock.
+func (bf *InstancePartitionedBucketFactory) shareOf(fillRate int64) int64 {
+	if share := fillRate / bf.totalInstances; share > 0 {
+		return share
+	}
+
+	return 1
+}
+
+func (bf *InstancePartitionedBucketFactory) destroyed(b *partitionedBucket) {
+	bf.Lock()
+	defer bf.Unlock()
+	delete(bf.liveBuckets, b)
+}
+
+// partitionedBucket delegates to a bucket that can be replaced when the factory is rebalanced.
+type partitionedBucket struct {
+	buckets.ActivityChannel
+	factory    *InstancePartitionedBucketFactory
+	namespace  string
+	bucketName string
+	cfg        *configs.BucketConfig
+	dynamic    bool
+	delegate   buckets.Bucket
+	m          sync.RWMutex
+}
+
+func (b *partitionedBucket) currentDelegate() buckets.Bucket {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.delegate
+}
+
+func (b *partitionedBucket) replaceDelegate(delegate buckets.Bucket) {
+	b.m.Lock()
+	old := b.delegate
+	b.delegate = delegate
+	b.m.Unlock()
+	old.Destroy()
+}
+
+// Take holds a read lock for the duration of the call, so the delegate isn't destroyed mid-flight.
+func (b *partitionedBucket) Take(numTokens int64, maxWaitTime time.Duration) time.Duration {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.delegate.Take(numTokens, maxWaitTime)
+}
+
+func (b *partitionedBucket) AddTokens(numTokens int64) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	b.delegate.AddTokens(numTokens)
+}
+
+// Tune tunes this instance's share of the bucket, using this instance's share of the new fill rate.
+func (b *partitionedBucket) Tune(cfg *configs.BucketConfig) error {
+	if err := buckets.ValidateTunedConfig(cfg); err != nil {
+		return err
+	}
+
+	// Hold the factory's lock so the bucket isn't rebalanced mid-flight.
+	b.factory.Lock()
+	defer b.factory.Unlock()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	share := *cfg
+	share.FillRate = b.factory.shareOf(cfg.FillRate)
+	if err := b.delegate.Tune(&share); err != nil {
+		return err
+	}
+
+	b.cfg = cfg
+	return nil
+}
+
+// Drain drains this instance's share of the bucket.
+func (b *partitionedBucket) Drain() (int64, error) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.delegate.Drain()
+}
+
+// TokenLevelHistory returns the history of this instance's share of the bucket, since it was last
+// rebalanced.
+func (b *partitionedBucket) TokenLevelHistory(since time.Time, resolution time.Duration) []buckets.TokenSnapshot {
+	return b.currentDelegate().TokenLevelHistory(since, resolution)
+}
+
+// Config returns the configuration of this instance's share of the bucket.
+func (b *partitionedBucket) Config() *configs.BucketConfig {
+	return b.currentDelegate().Config()
+}
+
+func (b *partitionedBucket) Dynamic() bool {
+	return b.dynamic
+}
+
+func (b *partitionedBucket) Destroy() {
+	b.factory.destroyed(b)
+	b.currentDelegate().Destroy()
+}
@@ -0,0 +1,92 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package partitioned
+
+import (
+	"testing"
+
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+func newFactory(totalInstances int) *InstancePartitionedBucketFactory {
+	bf := NewBucketFactory(memory.NewBucketFactory(), "instance1", totalInstances)
+	bf.Init(configs.NewDefaultServiceConfig())
+	return bf
+}
+
+func newConfig() *configs.BucketConfig {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.FillRate = 1000
+	return cfg
+}
+
+func TestPartitionedRate(t *testing.T) {
+	cfg := newConfig()
+	b := newFactory(10).NewBucket("n", "b", cfg, false)
+	defer b.Destroy()
+
+	if b.Config().FillRate != 100 {
+		t.Fatalf("Expecting a fill rate of 100. Was %v", b.Config().FillRate)
+	}
+
+	if cfg.FillRate != 1000 {
+		t.Fatalf("Original config should not be modified. Fill rate was %v", cfg.FillRate)
+	}
+}
+
+func TestMinimumRate(t *testing.T) {
+	cfg := newConfig()
+	cfg.FillRate = 5
+	b := newFactory(10).NewBucket("n", "b", cfg, false)
+	defer b.Destroy()
+
+	if b.Config().FillRate != 1 {
+		t.Fatalf("Expecting a fill rate of 1. Was %v", b.Config().FillRate)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	bf := newFactory(10)
+	b1 := bf.NewBucket("n", "b1", newConfig(), false)
+	b2 := bf.NewBucket("n", "b2", newConfig(), true)
+	defer b1.Destroy()
+	defer b2.Destroy()
+
+	if err := bf.Rebalance(4); err != nil {
+		t.Fatalf("Should be able to rebalance. Error: %v", err)
+	}
+
+	for _, b := range []interface {
+		Dynamic() bool
+		Config() *configs.BucketConfig
+	}{b1, b2} {
+		if b.Config().FillRate != 250 {
+			t.Fatalf("Expecting a fill rate of 250. Was %v", b.Config().FillRate)
+		}
+	}
+
+	if !b2.Dynamic() {
+		t.Fatal("Rebalanced bucket should still be dynamic")
+	}
+
+	if w := b1.Take(1, 0); w != 0 {
+		t.Fatalf("Rebalanced bucket should be usable. Wait was %v", w)
+	}
+}
+
+func TestRebalanceDestroyedBuckets(t *testing.T) {
+	bf := newFactory(10)
+	bf.NewBucket("n", "b", newConfig(), false).Destroy()
+
+	if len(bf.liveBuckets) != 0 {
+		t.Fatalf("Destroyed buckets should not be rebalanced. Live buckets: %v", bf.liveBuckets)
+	}
+}
+
+func TestRebalanceInvalid(t *testing.T) {
+	if err := newFactory(10).Rebalance(0); err == nil {
+		t.Fatal("Should not be able to rebalance to 0 instances")
+	}
+}
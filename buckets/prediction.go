@@ -0,0 +1,143 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConsumptionHalfLife is how long it takes for the consumption rate observed at any one time to
+// carry half as much weight in the average rate used to predict exhaustion.
+const ConsumptionHalfLife = time.Minute
+
+var ErrRateTrackingNotStarted = errors.New("Rate tracking not started")
+
+// StartRateTracking starts keeping an exponentially weighted moving average of the rate at which
+// tokens are granted by each bucket, as recorded using RecordEvent(), updated every resolution.
+// Calling it again restarts tracking at the new resolution.
+func (bc *BucketContainer) StartRateTracking(resolution time.Duration) {
+	if resolution <= 0 {
+		panic(fmt.Sprintf("Rate tracking resolution should be positive, but is %v", resolution))
+	}
+
+	t := newConsumptionTracker(resolution)
+	if old, ok := bc.consumption.Swap(t).(*consumptionTracker); ok {
+		close(old.stop)
+	}
+	go t.updateEvery(resolution)
+}
+
+// PredictExhaustion returns how long a bucket will take to run out of tokens if they keep being
+// granted at the average rate observed since StartRateTracking() was called, or -1 if that rate
+// doesn't exceed the bucket's fill rate. Buckets are named as for Drain(). Returns
+// ErrRateTrackingNotStarted if rate tracking hasn't been started, ErrNoSuchBucket if the bucket
+// doesn't exist, and ErrNotTokenCounter if it doesn't report the tokens it holds.
+func (bc *BucketContainer) PredictExhaustion(namespace, bucketName string) (time.Duration, error) {
+	t, ok := bc.consumption.Load().(*consumptionTracker)
+	if !ok {
+		return 0, ErrRateTrackingNotStarted
+	}
+
+	b := bc.existingBucket(namespace, bucketName)
+	if b == nil {
+		return 0, ErrNoSuchBucket
+	}
+
+	tc, ok := b.(TokenCounter)
+	if !ok {
+		return 0, ErrNotTokenCounter
+	}
+
+	rate := t.rateOf(FullyQualifiedName(namespace, bucketName))
+	fillRate := float64(b.Config().FillRate)
+	if rate <= fillRate {
+		return -1, nil
+	}
+
+	available := tc.AvailableTokens()
+	if available <= 0 {
+		return 0, nil
+	}
+
+	return time.Duration(float64(available) / (rate - fillRate) * float64(time.Second)), nil
+}
+
+// consumptionTracker averages the rate tokens are granted at, for each bucket.
+type consumptionTracker struct {
+	resolution time.Duration
+	alpha      float64  // The weight of each update.
+	buckets    sync.Map // Of *consumption, by fully qualified bucket name.
+	stop       chan struct{}
+}
+
+type consumption struct {
+	granted int64 // Tokens granted since the last update. First, so atomic operations on it are aligned.
+	rate    float64
+	sampled bool // Whether rate has been updated yet.
+	sync.Mutex
+}
+
+func newConsumptionTracker(resolution time.Duration) *consumptionTracker {
+	return &consumptionTracker{
+		resolution: resolution,
+		alpha:      1 - math.Pow(0.5, float64(resolution)/float64(ConsumptionHalfLife)),
+		stop:       make(chan struct{})}
+}
+
+func (t *consumptionTracker) record(fqn string, tokens int64) {
+	c, ok := t.buckets.Load(fqn)
+	if !ok {
+		c, _ = t.buckets.LoadOrStore(fqn, &consumption{})
+	}
+	atomic.AddInt64(&c.(*consumption).granted, tokens)
+}
+
+func (t *consumptionTracker) updateEvery(resolution time.Duration) {
+	ticker := time.NewTicker(resolution)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.update()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// update folds the tokens granted since the last update into each bucket's average rate. The
+// first update of a bucket's rate replaces it, so the average isn't biased towards 0.
+func (t *consumptionTracker) update() {
+	t.buckets.Range(func(_, v interface{}) bool {
+		c := v.(*consumption)
+		rate := float64(atomic.SwapInt64(&c.granted, 0)) / t.resolution.Seconds()
+
+		c.Lock()
+		if c.sampled {
+			c.rate += t.alpha * (rate - c.rate)
+		} else {
+			c.rate, c.sampled = rate, true
+		}
+		c.Unlock()
+		return true
+	})
+}
+
+func (t *consumptionTracker) rateOf(fqn string) float64 {
+	c, ok := t.buckets.Load(fqn)
+	if !ok {
+		return 0
+	}
+
+	cons := c.(*consumption)
+	cons.Lock()
+	defer cons.Unlock()
+	return cons.rate
+}
@@ -0,0 +1,98 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/logging"
+	"gopkg.in/yaml.v2"
+)
+
+// PreloadEntry names a bucket to create using Preload().
+type PreloadEntry struct {
+	Namespace  string `yaml:"namespace"`
+	BucketName string `yaml:"bucket"`
+	// InitialTokens, if set, is the number of tokens the bucket starts with, rather than starting
+	// full. Only applies to StatefulBuckets.
+	InitialTokens int64 `yaml:"initial_tokens"`
+}
+
+// Preload creates buckets before traffic arrives, such as the dynamic buckets that served traffic
+// before a restart, so that the first requests against them don't pay for creating them. Named
+// buckets already exist, but their InitialTokens are still applied. Entries that can't be
+// preloaded, such as for namespaces that don't allow dynamic buckets, are skipped, and the first
+// such error is returned once all other entries have been preloaded.
+func (bc *BucketContainer) Preload(entries []PreloadEntry) error {
+	var firstErr error
+	for _, e := range entries {
+		if err := bc.preload(e); err != nil {
+			logging.Printf("Unable to preload %v:%v: %v", e.Namespace, e.BucketName, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Unable to preload %v:%v: %v", e.Namespace, e.BucketName, err)
+			}
+		}
+	}
+
+	return firstErr
+}
+
+func (bc *BucketContainer) preload(e PreloadEntry) error {
+	if e.InitialTokens < 0 {
+		return fmt.Errorf("Negative initial tokens %v", e.InitialTokens)
+	}
+
+	if bc.namespace(e.Namespace) == nil {
+		return ErrNoSuchNamespace
+	}
+
+	b := bc.bucketForState(e.Namespace, e.BucketName)
+	if b == nil {
+		return ErrNoSuchBucket
+	}
+
+	if sb, ok := b.(StatefulBucket); ok && e.InitialTokens > 0 {
+		sb.ImportState(e.InitialTokens, time.Now().UnixNano())
+	}
+
+	return nil
+}
+
+// ReadPreloadEntries reads a YAML list of PreloadEntries, such as from a file listing the buckets
+// a service is known to need.
+func ReadPreloadEntries(yamlStream io.Reader) ([]PreloadEntry, error) {
+	bytes, err := ioutil.ReadAll(yamlStream)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read preload entries: %v", err)
+	}
+
+	var entries []PreloadEntry
+	if err := yaml.Unmarshal(bytes, &entries); err != nil {
+		return nil, fmt.Errorf("Unable to parse preload entries: %v", err)
+	}
+
+	return entries, nil
+}
+
+// PreloadEntriesFromEventLog returns an entry for each bucket that served a request in an event
+// log dumped using DumpEventLog(), such as before a restart, in the order each bucket first
+// appears. Rejected requests are skipped, since they may be for buckets that don't exist.
+func PreloadEntriesFromEventLog(events []QuotaEvent) []PreloadEntry {
+	var entries []PreloadEntry
+	seen := make(map[string]bool)
+	for _, e := range events {
+		fqn := FullyQualifiedName(e.Namespace, e.BucketName)
+		if e.Status == EVENT_REJECTED || seen[fqn] {
+			continue
+		}
+
+		seen[fqn] = true
+		entries = append(entries, PreloadEntry{Namespace: e.Namespace, BucketName: e.BucketName})
+	}
+
+	return entries
+}
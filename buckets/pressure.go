@@ -0,0 +1,75 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// memoryPressure reduces token grants while the heap in use exceeds a threshold.
+type memoryPressure struct {
+	threshold       uint64
+	reductionFactor float64
+	underPressure   int32 // Accessed atomically; 1 while under pressure.
+	readMemStats    func(*runtime.MemStats)
+}
+
+// WithMemoryPressureAdaptation reduces the number of tokens granted per request to reductionFactor
+// of the number requested, for as long as the heap in use exceeds threshold bytes. Memory usage is
+// checked every second. This is a last-resort safety valve, which signals callers to back off and
+// reduce load on the service; it is no substitute for sizing buckets correctly.
+func (bc *BucketContainer) WithMemoryPressureAdaptation(threshold uint64, reductionFactor float64) *BucketContainer {
+	return bc.withMemoryPressureAdaptation(threshold, reductionFactor, runtime.ReadMemStats)
+}
+
+func (bc *BucketContainer) withMemoryPressureAdaptation(threshold uint64, reductionFactor float64, readMemStats func(*runtime.MemStats)) *BucketContainer {
+	if reductionFactor <= 0 || reductionFactor > 1 {
+		panic(fmt.Sprintf("Reduction factor should be in (0, 1], but is %v", reductionFactor))
+	}
+
+	bc.pressure = &memoryPressure{
+		threshold:       threshold,
+		reductionFactor: reductionFactor,
+		readMemStats:    readMemStats}
+
+	go bc.every(time.Second, bc.pressure.check)
+
+	return bc
+}
+
+func (p *memoryPressure) check() {
+	stats := &runtime.MemStats{}
+	p.readMemStats(stats)
+
+	var underPressure int32
+	if stats.HeapInuse > p.threshold {
+		underPressure = 1
+	}
+
+	if atomic.SwapInt32(&p.underPressure, underPressure) != underPressure {
+		logging.Printf("Heap in use %v, threshold %v. Reducing token grants: %v",
+			stats.HeapInuse, p.threshold, underPressure == 1)
+	}
+}
+
+// AdaptTokens returns the number of tokens to grant for a request, reduced if memory pressure
+// adaptation is enabled and the service is under memory pressure. At least one token is granted
+// for requests of one or more tokens.
+func (bc *BucketContainer) AdaptTokens(tokensRequested int64) int64 {
+	p := bc.pressure
+	if p == nil || atomic.LoadInt32(&p.underPressure) == 0 || tokensRequested < 1 {
+		return tokensRequested
+	}
+
+	if reduced := int64(float64(tokensRequested) * p.reductionFactor); reduced > 0 {
+		return reduced
+	}
+
+	return 1
+}
@@ -0,0 +1,122 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateHistory is how long the rate of requests for each bucket is remembered.
+const RateHistory = time.Minute
+
+const rateHistorySeconds = int64(RateHistory / time.Second)
+
+// RateOf returns the rate of requests, per second, recorded for namespace:bucketName using
+// RecordEvent() over a trailing window, measured in whole seconds. Windows longer than the
+// history available, up to RateHistory, use all of it.
+func (bc *BucketContainer) RateOf(namespace, bucketName string, window time.Duration) float64 {
+	return bc.rates.rateOf(FullyQualifiedName(namespace, bucketName), time.Now(), window)
+}
+
+// rateTracker counts the requests for each bucket in one-second slots.
+type rateTracker struct {
+	counters  sync.Map // Of *rateCounter, by fully qualified bucket name.
+	lastSweep int64    // Unix seconds.
+}
+
+func newRateTracker() *rateTracker {
+	return &rateTracker{lastSweep: time.Now().Unix()}
+}
+
+func (r *rateTracker) record(fqn string, now time.Time) {
+	c, ok := r.counters.Load(fqn)
+	if !ok {
+		c, _ = r.counters.LoadOrStore(fqn, newRateCounter(now))
+	}
+	c.(*rateCounter).record(now)
+
+	// Forget buckets without requests in the history, since dynamic buckets may never be
+	// requested again.
+	last := atomic.LoadInt64(&r.lastSweep)
+	if now.Unix()-last >= rateHistorySeconds && atomic.CompareAndSwapInt64(&r.lastSweep, last, now.Unix()) {
+		r.counters.Range(func(k, v interface{}) bool {
+			if v.(*rateCounter).idle(now) {
+				r.counters.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+func (r *rateTracker) rateOf(fqn string, now time.Time, window time.Duration) float64 {
+	c, ok := r.counters.Load(fqn)
+	if !ok {
+		return 0
+	}
+
+	return c.(*rateCounter).rate(now, window)
+}
+
+// rateCounter counts requests in a ring of one-second slots.
+type rateCounter struct {
+	createdSec int64
+	lastSec    int64
+	counts     [rateHistorySeconds]int64
+	slotSecs   [rateHistorySeconds]int64 // The second each slot holds the count of.
+	sync.Mutex                           // Embedded mutex
+}
+
+func newRateCounter(now time.Time) *rateCounter {
+	return &rateCounter{createdSec: now.Unix()}
+}
+
+func (c *rateCounter) record(now time.Time) {
+	sec := now.Unix()
+	i := sec % rateHistorySeconds
+
+	c.Lock()
+	defer c.Unlock()
+	if c.slotSecs[i] != sec {
+		c.slotSecs[i] = sec
+		c.counts[i] = 0
+	}
+	c.counts[i]++
+	c.lastSec = sec
+}
+
+func (c *rateCounter) idle(now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	return now.Unix()-c.lastSec >= rateHistorySeconds
+}
+
+func (c *rateCounter) rate(now time.Time, window time.Duration) float64 {
+	sec := now.Unix()
+	windowSecs := int64((window + time.Second - 1) / time.Second)
+	if windowSecs < 1 {
+		windowSecs = 1
+	}
+
+	if windowSecs > rateHistorySeconds {
+		windowSecs = rateHistorySeconds
+	}
+
+	// The current second counts as available history.
+	if available := sec - c.createdSec + 1; windowSecs > available {
+		windowSecs = available
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	var count int64
+	for i := range c.counts {
+		if s := c.slotSecs[i]; s > sec-windowSecs && s <= sec {
+			count += c.counts[i]
+		}
+	}
+
+	return float64(count) / float64(windowSecs)
+}
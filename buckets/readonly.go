@@ -0,0 +1,66 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"errors"
+)
+
+// ErrNotTokenCounter is returned when peeking at a bucket that doesn't implement TokenCounter.
+var ErrNotTokenCounter = errors.New("Bucket doesn't report its tokens")
+
+// ReadOnlyBucketContainer is a view of a BucketContainer for monitoring tools, which only exposes
+// operations that don't change buckets or their configuration.
+type ReadOnlyBucketContainer struct {
+	bc *BucketContainer
+}
+
+// ReadOnlyView returns a read-only view of the container.
+func (bc *BucketContainer) ReadOnlyView() *ReadOnlyBucketContainer {
+	return &ReadOnlyBucketContainer{bc}
+}
+
+// FindBucket behaves as BucketContainer.FindBucket() does, so it reports activity on the bucket
+// found, and may create dynamic buckets. Use PeekBucket() to inspect buckets without side effects.
+func (r *ReadOnlyBucketContainer) FindBucket(namespace, bucketName string) (Bucket, error) {
+	return r.bc.FindBucket(namespace, bucketName)
+}
+
+// PeekBucket returns the number of tokens available in the bucket that would serve requests for
+// namespace:bucketName, without reporting activity on it or creating it. Returns ErrNoSuchBucket
+// if no bucket exists yet, and ErrNotTokenCounter if the bucket doesn't report its tokens.
+func (r *ReadOnlyBucketContainer) PeekBucket(namespace, bucketName string) (int64, error) {
+	var b Bucket
+	if ns := r.bc.namespace(namespace); ns == nil {
+		b = r.bc.defaultBucket
+	} else {
+		ns.RLock()
+		b = ns.buckets[bucketName]
+		ns.RUnlock()
+
+		if b == nil {
+			b = ns.defaultBucket
+		}
+	}
+
+	if b == nil {
+		return 0, ErrNoSuchBucket
+	}
+
+	tc, ok := b.(TokenCounter)
+	if !ok {
+		return 0, ErrNotTokenCounter
+	}
+
+	return tc.AvailableTokens(), nil
+}
+
+// Exists tells you if a named bucket exists.
+func (r *ReadOnlyBucketContainer) Exists(namespace, bucketName string) bool {
+	return r.bc.Exists(namespace, bucketName)
+}
+
+func (r *ReadOnlyBucketContainer) String() string {
+	return r.bc.String()
+}
@@ -0,0 +1,87 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import "sync"
+
+// RecoveryThreshold is the fraction of its size an exhausted bucket has to refill to before
+// OnBucketRecovered() callbacks are called.
+const RecoveryThreshold = 0.5
+
+// RefillNotifyingBucket is implemented by buckets that tell you when they recover from exhaustion.
+type RefillNotifyingBucket interface {
+	// OnRefillAbove calls fn asynchronously whenever the bucket has run out of tokens, and then
+	// refilled to at least threshold, a fraction of its size. fn is called once per cycle of
+	// exhaustion and recovery.
+	OnRefillAbove(threshold float64, fn func())
+}
+
+// recoveryHooks are the callbacks registered using OnBucketRecovered().
+type recoveryHooks struct {
+	fns []func(namespace, bucketName string)
+	sync.Mutex
+}
+
+// OnBucketRecovered calls fn asynchronously whenever any bucket, including buckets created later,
+// recovers from exhaustion, refilling to RecoveryThreshold of its size. Only buckets that implement
+// RefillNotifyingBucket are watched.
+func (bc *BucketContainer) OnBucketRecovered(fn func(namespace, bucketName string)) {
+	bc.recovery.Lock()
+	bc.recovery.fns = append(bc.recovery.fns, fn)
+	bc.recovery.Unlock()
+
+	if bc.defaultBucket != nil {
+		watchRecovery(GLOBAL_NAMESPACE, DEFAULT_BUCKET_NAME, bc.defaultBucket, fn)
+	}
+
+	bc.registry().Walk(func(nsName string, v interface{}) {
+		bc.catchUpRecovery(nsName, v.(*namespace))
+	})
+}
+
+// catchUpRecovery registers the callbacks a namespace's buckets aren't registered with yet. Since
+// buckets are created with the namespace locked, and registered with the callbacks the namespace
+// has caught up with, each bucket is registered with each callback exactly once.
+func (bc *BucketContainer) catchUpRecovery(nsName string, ns *namespace) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	fns := bc.recoveryFns()
+	pending := fns[ns.recoveryCaughtUp:]
+	ns.recoveryCaughtUp = len(fns)
+
+	for _, fn := range pending {
+		for bName, b := range ns.buckets {
+			watchRecovery(nsName, bName, b, fn)
+		}
+
+		if ns.defaultBucket != nil {
+			watchRecovery(nsName, DEFAULT_BUCKET_NAME, ns.defaultBucket, fn)
+		}
+
+		if ns.aggregateBucket != nil {
+			watchRecovery(nsName, AGGREGATE_BUCKET_NAME, ns.aggregateBucket, fn)
+		}
+	}
+}
+
+// watchRecovery registers the OnBucketRecovered() callbacks a namespace has caught up with with a
+// new bucket. Should be called with the namespace locked.
+func (bc *BucketContainer) watchRecovery(nsName string, ns *namespace, bucketName string, b Bucket) {
+	for _, fn := range bc.recoveryFns()[:ns.recoveryCaughtUp] {
+		watchRecovery(nsName, bucketName, b, fn)
+	}
+}
+
+func (bc *BucketContainer) recoveryFns() []func(namespace, bucketName string) {
+	bc.recovery.Lock()
+	defer bc.recovery.Unlock()
+	return bc.recovery.fns
+}
+
+func watchRecovery(namespace, bucketName string, b Bucket, fn func(namespace, bucketName string)) {
+	if rb, ok := b.(RefillNotifyingBucket); ok {
+		rb.OnRefillAbove(RecoveryThreshold, func() { fn(namespace, bucketName) })
+	}
+}
@@ -3,6 +3,14 @@
 
 // Package redis implements token buckets backed by Redis, inspired by the algorithms used in Guava's
 // RateLimiter library - https://github.com/google/guava/blob/master/guava/src/com/google/common/util/concurrent/RateLimiter.java
+//
+// Bucket state lives in Redis, and is shared by all instances of the quota service using the same
+// Redis, so these buckets don't implement buckets.StatefulBucket; BucketContainer.Export() skips
+// them, and there is no state to transfer between instances.
+//
+// Bucket configuration, on the other hand, is passed to the scripts by the instance running them,
+// except for the fill rate and size of tuned buckets, which are stored in Redis next to the bucket
+// state, so that all instances take tokens using the tuned values. See redisBucket.Tune().
 package redis
 
 import (
@@ -14,14 +22,21 @@ import (
 	"fmt"
 	"github.com/maniksurtani/quotaservice/logging"
 	"strconv"
+	"crypto/sha1"
+	"encoding/hex"
 )
 
 // Suffixes for Redis keys
 const (
 	TOKENS_NEXT_AVBL_NANOS_SUFFIX = "TNA"
 	ACCUMULATED_TOKENS_SUFFIX = "AT"
+	TUNED_PARAMS_SUFFIX = "TP"
 )
 
+// SCRIPT_VERSION_KEY is the Redis key, after the factory's key prefix, holding the version of the
+// scripts that wrote the bucket state in Redis.
+const SCRIPT_VERSION_KEY = "___SCRIPT_VERSION___"
+
 // redisBucket is threadsafe since it delegates concurrency to the Redis instance.
 type redisBucket struct {
 	dynamic               bool
@@ -31,8 +46,10 @@ type redisBucket struct {
 	maxTokensToAccumulate string
 	maxIdleTimeMillis     string
 	maxDebtNanos          string
-	redisKeys             []string // {tokensNextAvailableRedisKey, accumulatedTokensRedisKey}
+	redisKeys             []string // {tokensNextAvailableRedisKey, accumulatedTokensRedisKey, tunedParamsRedisKey}
+	leaseKey              string // Holds the ID of the bucket's exclusive lease, if any.
 	buckets.ActivityChannel
+	m                     sync.RWMutex // Guards cfg and the script arguments derived from it.
 }
 
 type bucketFactory struct {
@@ -42,10 +59,23 @@ type bucketFactory struct {
 	initialized       bool
 	redisOpts         *redis.Options
 	scriptSHA         string
+	addTokensSHA      string
+	tuneSHA           string
+	drainSHA          string
+	readyErr          error
 	connectionRetries int
+	keyPrefix         string // Prefixes every key the factory's buckets use.
 }
 
 func NewBucketFactory(redisOpts *redis.Options, connectionRetries int) buckets.BucketFactory {
+	return NewBucketFactoryWithKeyPrefix(redisOpts, connectionRetries, "")
+}
+
+// NewBucketFactoryWithKeyPrefix creates a factory whose buckets prefix their Redis keys with
+// keyPrefix, so that several quota services may share a Redis without sharing buckets. Bucket state
+// discarded when the scripts change is limited to keys with the prefix too, although factories
+// without a prefix discard the state of all factories.
+func NewBucketFactoryWithKeyPrefix(redisOpts *redis.Options, connectionRetries int, keyPrefix string) buckets.BucketFactory {
 	if connectionRetries < 1 {
 		connectionRetries = 1
 	}
@@ -54,7 +84,8 @@ func NewBucketFactory(redisOpts *redis.Options, connectionRetries int) buckets.B
 		initialized: false,
 		m: &sync.RWMutex{},
 		redisOpts: redisOpts,
-		connectionRetries: connectionRetries}
+		connectionRetries: connectionRetries,
+		keyPrefix: keyPrefix}
 }
 
 func (bf *bucketFactory) Init(cfg *configs.ServiceConfig) {
@@ -65,64 +96,287 @@ func (bf *bucketFactory) Init(cfg *configs.ServiceConfig) {
 		if !bf.initialized {
 			bf.initialized = true
 			bf.cfg = cfg
-			bf.connectToRedis()
+			bf.readyErr = bf.connectToRedis()
+			if bf.readyErr == nil {
+				// Only once, rather than on every reconnection, since buckets are in use by then.
+				bf.readyErr = bf.migrate()
+			}
+
+			if bf.readyErr != nil {
+				logging.Printf("Unable to initialize Redis bucket factory: %v", bf.readyErr)
+			}
 		}
 	}
 }
 
-func (bf *bucketFactory) connectToRedis() {
+func (bf *bucketFactory) connectToRedis() error {
 	// Set up connection to Redis
 	bf.client = redis.NewClient(bf.redisOpts)
-	logging.Printf("Connection established. Time on Redis server: %v", time.Unix(toInt64(bf.client.Time().Val()[0], 0), 0))
-	bf.scriptSHA = loadScript(bf.client)
+	t, err := bf.client.Time().Result()
+	if err != nil {
+		return fmt.Errorf("Unable to connect to Redis: %v", err)
+	}
+
+	logging.Printf("Connection established. Time on Redis server: %v", time.Unix(toInt64(t[0], 0), 0))
+	if bf.scriptSHA, err = loadScript(bf.client, takeScript); err != nil {
+		return err
+	}
+
+	if bf.addTokensSHA, err = loadScript(bf.client, addTokensScript); err != nil {
+		return err
+	}
+
+	if bf.tuneSHA, err = loadScript(bf.client, tuneScript); err != nil {
+		return err
+	}
+
+	if bf.drainSHA, err = loadScript(bf.client, drainScript); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ScriptVersion returns a hash of the scripts used by this factory's buckets.
+func (bf *bucketFactory) ScriptVersion() string {
+	h := sha1.New()
+	for _, script := range []string{takeScript, addTokensScript, tuneScript, drainScript} {
+		h.Write([]byte(script))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// migrate discards bucket state written by a different version of the scripts, since its layout
+// may not be understood by the current scripts, and records the current version. Buckets are
+// recreated full on their next use. The version is only recorded if no other instance changed it in
+// the meantime, so that concurrently starting instances don't overwrite each other's migrations.
+func (bf *bucketFactory) migrate() error {
+	versionKey := bf.keyPrefix + SCRIPT_VERSION_KEY
+	tx, err := bf.client.Watch(versionKey)
+	if err != nil {
+		return fmt.Errorf("Unable to watch script version in Redis: %v", err)
+	}
+	defer tx.Close()
+
+	version, err := tx.Get(versionKey).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("Unable to read script version from Redis: %v", err)
+	}
+
+	if version == bf.ScriptVersion() {
+		return nil
+	}
+
+	logging.Printf("Script version changed from '%v' to '%v'. Flushing bucket state.", version, bf.ScriptVersion())
+	for _, suffix := range []string{TOKENS_NEXT_AVBL_NANOS_SUFFIX, ACCUMULATED_TOKENS_SUFFIX, TUNED_PARAMS_SUFFIX} {
+		if err := bf.deleteKeys(bf.key("*", "*", suffix)); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(func() error {
+		tx.Set(versionKey, bf.ScriptVersion(), 0)
+		return nil
+	})
+
+	if err == redis.TxFailedErr {
+		logging.Printf("Script version changed by another instance while migrating. Leaving it.")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Unable to write script version to Redis: %v", err)
+	}
+
+	return nil
+}
+
+// deleteKeys deletes all keys matching a pattern, scanning rather than blocking Redis with KEYS.
+func (bf *bucketFactory) deleteKeys(pattern string) error {
+	var cursor int64
+	for {
+		next, keys, err := bf.client.Scan(cursor, pattern, 1000).Result()
+		if err != nil {
+			return fmt.Errorf("Unable to scan Redis for %v: %v", pattern, err)
+		}
+
+		if len(keys) > 0 {
+			if err := bf.client.Del(keys...).Err(); err != nil {
+				return fmt.Errorf("Unable to delete keys from Redis: %v", err)
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// reconnect re-establishes the connection to Redis, updating the factory's readiness.
+func (bf *bucketFactory) reconnect() {
+	err := bf.connectToRedis()
+	if err != nil {
+		logging.Printf("Unable to reconnect to Redis: %v", err)
+	}
+
+	bf.m.Lock()
+	defer bf.m.Unlock()
+	bf.readyErr = err
+}
+
+func (bf *bucketFactory) Ready() bool {
+	return bf.ReadyErr() == nil
+}
+
+func (bf *bucketFactory) ReadyErr() error {
+	bf.m.RLock()
+	defer bf.m.RUnlock()
+
+	if !bf.initialized {
+		return buckets.ErrFactoryNotInitialized
+	}
+
+	return bf.readyErr
 }
 
 func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	rb := &redisBucket{
+		dynamic: dyn,
+		factory: bf,
+		redisKeys: []string{bf.key(namespace, bucketName, TOKENS_NEXT_AVBL_NANOS_SUFFIX),
+			bf.key(namespace, bucketName, ACCUMULATED_TOKENS_SUFFIX),
+			bf.key(namespace, bucketName, TUNED_PARAMS_SUFFIX)},
+		leaseKey: bf.key(namespace, bucketName, LEASE_SUFFIX),
+		ActivityChannel: buckets.NewActivityChannel()}
+	rb.setConfig(cfg)
+
+	return rb
+}
+
+// setConfig sets the bucket's config, and the script arguments derived from it. Must be called
+// while holding the bucket's write lock, or before the bucket is published.
+func (b *redisBucket) setConfig(cfg *configs.BucketConfig) {
 	idle := "0"
 	if cfg.MaxIdleMillis > 0 {
 		idle = strconv.FormatInt(int64(cfg.MaxIdleMillis), 10)
 	}
 
-	rb := &redisBucket{
-		dyn,
-		cfg,
-		bf,
-		strconv.FormatInt(1e9 / cfg.FillRate, 10),
-		strconv.FormatInt(cfg.Size, 10),
-		idle,
-		strconv.FormatInt(cfg.MaxDebtMillis * 1e6, 10), // Convert millis to nanos
-		[]string{toRedisKey(namespace, bucketName, TOKENS_NEXT_AVBL_NANOS_SUFFIX),
-			toRedisKey(namespace, bucketName, ACCUMULATED_TOKENS_SUFFIX)},
-		buckets.NewActivityChannel()}
-
-	return rb
+	b.cfg = cfg
+	b.nanosBetweenTokens = strconv.FormatInt(1e9 / cfg.FillRate, 10)
+	b.maxTokensToAccumulate = strconv.FormatInt(cfg.Size, 10)
+	b.maxIdleTimeMillis = idle
+	b.maxDebtNanos = strconv.FormatInt(cfg.MaxDebtMillis * 1e6, 10) // Convert millis to nanos
 }
 
 func toRedisKey(namespace, bucketName, suffix string) string {
 	return fmt.Sprintf("%v:%v:%v", namespace, bucketName, suffix)
 }
 
+// key returns the Redis key of a bucket, with the factory's key prefix.
+func (bf *bucketFactory) key(namespace, bucketName, suffix string) string {
+	return bf.keyPrefix + toRedisKey(namespace, bucketName, suffix)
+}
+
 func (b *redisBucket) Take(requested int64, maxWaitTime time.Duration) (waitTime time.Duration) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
 	currentTimeNanos := strconv.FormatInt(time.Now().UnixNano(), 10)
 	args := []string{currentTimeNanos, b.nanosBetweenTokens, b.maxTokensToAccumulate,
 		strconv.FormatInt(requested, 10), strconv.FormatInt(maxWaitTime.Nanoseconds(), 10),
 		b.maxIdleTimeMillis, b.maxDebtNanos}
 
+	res := b.evalSha(&b.factory.scriptSHA, args)
+	switch waitTimeNanos := res.Val().(type) {
+	case int64:
+		waitTime = time.Nanosecond * time.Duration(waitTimeNanos)
+	default:
+		panic(fmt.Sprintf("Unknown response '%v' of type %T. Full result %+v",
+			waitTimeNanos, waitTimeNanos, res))
+	}
+
+	return
+}
+
+func (b *redisBucket) AddTokens(numTokens int64) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	args := []string{strconv.FormatInt(time.Now().UnixNano(), 10), b.nanosBetweenTokens,
+		b.maxTokensToAccumulate, strconv.FormatInt(numTokens, 10), b.maxIdleTimeMillis}
+
+	res := b.evalSha(&b.factory.addTokensSHA, args)
+	if res.Err() != nil {
+		panic(fmt.Sprintf("Unable to add tokens to %v. Full result %+v", b.redisKeys, res))
+	}
+}
+
+// Tune stores the new fill rate and size in Redis, next to the bucket state, and scales the tokens
+// accumulated to the new size. All instances sharing the bucket take tokens using the stored
+// values, whatever their own config says. The tokens are only scaled if the stored values change,
+// so instances applying the same change, such as a grace period or a feedback source tuning every
+// instance from its configured values, scale them once rather than once per instance. The stored
+// values expire with the bucket state, after which buckets start with the configured values again.
+func (b *redisBucket) Tune(cfg *configs.BucketConfig) error {
+	if err := buckets.ValidateTunedConfig(cfg); err != nil {
+		return err
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	args := []string{strconv.FormatInt(time.Now().UnixNano(), 10), b.nanosBetweenTokens,
+		b.maxTokensToAccumulate, strconv.FormatInt(1e9 / cfg.FillRate, 10),
+		strconv.FormatInt(cfg.Size, 10), b.maxIdleTimeMillis}
+
+	res := b.evalSha(&b.factory.tuneSHA, args)
+	if res.Err() != nil {
+		return fmt.Errorf("Unable to tune %v: %v", b.redisKeys, res.Err())
+	}
+
+	b.setConfig(cfg)
+	return nil
+}
+
+// Drain atomically reads and zeroes the tokens accumulated in Redis, affecting all instances
+// sharing this bucket.
+func (b *redisBucket) Drain() (int64, error) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	args := []string{strconv.FormatInt(time.Now().UnixNano(), 10), b.nanosBetweenTokens,
+		b.maxTokensToAccumulate, b.maxIdleTimeMillis}
+
+	res := b.evalSha(&b.factory.drainSHA, args)
+	if res.Err() != nil {
+		return 0, fmt.Errorf("Unable to drain %v: %v", b.redisKeys, res.Err())
+	}
+
+	drained, ok := res.Val().(int64)
+	if !ok {
+		return 0, fmt.Errorf("Unknown response '%v' of type %T draining %v", res.Val(), res.Val(), b.redisKeys)
+	}
+
+	return drained, nil
+}
+
+// TokenLevelHistory returns nil, since token levels aren't recorded in Redis.
+func (b *redisBucket) TokenLevelHistory(since time.Time, resolution time.Duration) []buckets.TokenSnapshot {
+	return nil
+}
+
+// evalSha evaluates a script against this bucket's keys, reconnecting to Redis if necessary. The
+// script's SHA is dereferenced on every attempt, since reconnecting reloads all scripts.
+func (b *redisBucket) evalSha(sha *string, args []string) (res *redis.Cmd) {
 	keepTrying := true
 	for attempt := 0; keepTrying && attempt < b.factory.connectionRetries; attempt++ {
-		res := b.factory.client.EvalSha(b.factory.scriptSHA, b.redisKeys, args)
-		switch waitTimeNanos := res.Val().(type) {
-		case int64:
-			waitTime = time.Nanosecond * time.Duration(waitTimeNanos)
+		res = b.factory.client.EvalSha(*sha, b.redisKeys, args)
+		if res.Err() != nil && res.Err().Error() == "redis: client is closed" {
+			b.factory.reconnect()
+		} else {
 			keepTrying = false
-		default:
-			if res.Err() != nil && res.Err().Error() == "redis: client is closed" {
-				b.factory.connectToRedis()
-			} else {
-				keepTrying = false
-				panic(fmt.Sprintf("Unknown response '%v' of type %T. Full result %+v",
-					waitTimeNanos, waitTimeNanos, res))
-			}
 		}
 	}
 
@@ -146,6 +400,8 @@ func toInt64(s interface{}, defaultValue int64) (v int64) {
 }
 
 func (b *redisBucket) Config() *configs.BucketConfig {
+	b.m.RLock()
+	defer b.m.RUnlock()
 	return b.cfg
 }
 
@@ -162,24 +418,43 @@ func checkScriptExists(c *redis.Client, sha string) bool {
 	return r.Val()[0]
 }
 
-// loadScript loads the LUA script into Redis. The LUA script contains the token bucket algorithm
-// which is executed atomically in Redis. Once the script is loaded, it is invoked using its SHA.
-func loadScript(c *redis.Client) (sha string) {
-	lua := `
+// loadScript loads a LUA script into Redis. LUA scripts contain the token bucket algorithms which
+// are executed atomically in Redis. Once a script is loaded, it is invoked using its SHA.
+func loadScript(c *redis.Client, lua string) (sha string, err error) {
+	sha, err = c.ScriptLoad(lua).Result()
+	if err != nil {
+		return "", fmt.Errorf("Unable to load LUA script into Redis: %v", err)
+	}
+
+	logging.Printf("Loaded LUA script into Redis; script SHA %v", sha)
+	return
+}
+
+// tunedParamsScript starts every script, reading the fill rate, as nanos between tokens, and the
+// size of the bucket from Redis if it has been tuned, or from the arguments passed otherwise.
+const tunedParamsScript = `
+	local nanosBetweenTokens = tonumber(ARGV[2])
+	local maxTokensToAccumulate = tonumber(ARGV[3])
+	local tuned = redis.call("HMGET", KEYS[3], "nanosBetweenTokens", "maxTokensToAccumulate")
+	if tuned[1] and tuned[2] then
+		nanosBetweenTokens = tonumber(tuned[1])
+		maxTokensToAccumulate = tonumber(tuned[2])
+	end
+`
+
+// takeScript contains the algorithm used by Take().
+const takeScript = tunedParamsScript + `
 	local tokensNextAvailableNanos = tonumber(redis.call("GET", KEYS[1]))
 	if not tokensNextAvailableNanos then
 		tokensNextAvailableNanos = 0
 	end
 
-	local maxTokensToAccumulate = tonumber(ARGV[3])
-
 	local accumulatedTokens = redis.call("GET", KEYS[2])
 	if not accumulatedTokens then
 		accumulatedTokens = maxTokensToAccumulate
 	end
 
 	local currentTimeNanos = tonumber(ARGV[1])
-	local nanosBetweenTokens = tonumber(ARGV[2])
 	local requested = tonumber(ARGV[4])
 	local maxWaitTime = tonumber(ARGV[5])
 	local lifespan = tonumber(ARGV[6])
@@ -206,6 +481,7 @@ func loadScript(c *redis.Client) (sha string) {
 		if lifespan > 0 then
 			redis.call("SET", KEYS[1], tokensNextAvailableNanos, "PX", lifespan)
 			redis.call("SET", KEYS[2], math.floor(accumulatedTokens), "PX", lifespan)
+			redis.call("PEXPIRE", KEYS[3], lifespan)
 		else
 			redis.call("SET", KEYS[1], tokensNextAvailableNanos)
 			redis.call("SET", KEYS[2], math.floor(accumulatedTokens))
@@ -213,9 +489,122 @@ func loadScript(c *redis.Client) (sha string) {
 	end
 
 	return waitTime
+`
+
+// addTokensScript contains the algorithm used by AddTokens().
+const addTokensScript = tunedParamsScript + `
+	local tokensNextAvailableNanos = tonumber(redis.call("GET", KEYS[1]))
+	if not tokensNextAvailableNanos then
+		tokensNextAvailableNanos = 0
+	end
+
+	local accumulatedTokens = redis.call("GET", KEYS[2])
+	if not accumulatedTokens then
+		accumulatedTokens = maxTokensToAccumulate
+	end
+
+	local currentTimeNanos = tonumber(ARGV[1])
+	local tokensToAdd = tonumber(ARGV[4])
+	local lifespan = tonumber(ARGV[5])
+
+	if currentTimeNanos > tokensNextAvailableNanos then
+		local freshTokens = math.floor((currentTimeNanos - tokensNextAvailableNanos) / nanosBetweenTokens)
+		accumulatedTokens = math.min(maxTokensToAccumulate, accumulatedTokens + freshTokens)
+		tokensNextAvailableNanos = currentTimeNanos
+	end
+
+	-- Pay off tokens borrowed from the future first, counting partially repaid tokens as borrowed.
+	local borrowedTokens = math.ceil((tokensNextAvailableNanos - currentTimeNanos) / nanosBetweenTokens)
+	local repaidTokens = math.min(borrowedTokens, tokensToAdd)
+	tokensNextAvailableNanos = tokensNextAvailableNanos - (repaidTokens * nanosBetweenTokens)
+	accumulatedTokens = math.min(maxTokensToAccumulate, accumulatedTokens + tokensToAdd - repaidTokens)
+
+	if lifespan > 0 then
+		redis.call("SET", KEYS[1], tokensNextAvailableNanos, "PX", lifespan)
+		redis.call("SET", KEYS[2], math.floor(accumulatedTokens), "PX", lifespan)
+		redis.call("PEXPIRE", KEYS[3], lifespan)
+	else
+		redis.call("SET", KEYS[1], tokensNextAvailableNanos)
+		redis.call("SET", KEYS[2], math.floor(accumulatedTokens))
+	end
+
+	return 0
+	`
+
+// tuneScript contains the algorithm used by Tune(). Tokens are accumulated using the current fill
+// rate and size, and then scaled to the new size, which is stored with the new fill rate. Nothing
+// changes if the bucket has already been tuned to the new values.
+const tuneScript = tunedParamsScript + `
+	local tokensNextAvailableNanos = tonumber(redis.call("GET", KEYS[1]))
+	if not tokensNextAvailableNanos then
+		tokensNextAvailableNanos = 0
+	end
+
+	local accumulatedTokens = redis.call("GET", KEYS[2])
+	if not accumulatedTokens then
+		accumulatedTokens = maxTokensToAccumulate
+	end
+
+	local currentTimeNanos = tonumber(ARGV[1])
+	local newNanosBetweenTokens = tonumber(ARGV[4])
+	local newMaxTokensToAccumulate = tonumber(ARGV[5])
+	local lifespan = tonumber(ARGV[6])
+
+	if nanosBetweenTokens == newNanosBetweenTokens and maxTokensToAccumulate == newMaxTokensToAccumulate then
+		return 0
+	end
+
+	if currentTimeNanos > tokensNextAvailableNanos then
+		local freshTokens = math.floor((currentTimeNanos - tokensNextAvailableNanos) / nanosBetweenTokens)
+		accumulatedTokens = math.min(maxTokensToAccumulate, accumulatedTokens + freshTokens)
+		tokensNextAvailableNanos = currentTimeNanos
+	end
+
+	accumulatedTokens = math.floor(accumulatedTokens * newMaxTokensToAccumulate / maxTokensToAccumulate)
+	redis.call("HMSET", KEYS[3], "nanosBetweenTokens", newNanosBetweenTokens, "maxTokensToAccumulate", newMaxTokensToAccumulate)
+
+	if lifespan > 0 then
+		redis.call("SET", KEYS[1], tokensNextAvailableNanos, "PX", lifespan)
+		redis.call("SET", KEYS[2], accumulatedTokens, "PX", lifespan)
+		redis.call("PEXPIRE", KEYS[3], lifespan)
+	else
+		redis.call("SET", KEYS[1], tokensNextAvailableNanos)
+		redis.call("SET", KEYS[2], accumulatedTokens)
+	end
+
+	return 0
+	`
+
+// drainScript contains the algorithm used by Drain(). Tokens are accumulated up to the current
+// time, and then removed.
+const drainScript = tunedParamsScript + `
+	local tokensNextAvailableNanos = tonumber(redis.call("GET", KEYS[1]))
+	if not tokensNextAvailableNanos then
+		tokensNextAvailableNanos = 0
+	end
+
+	local accumulatedTokens = redis.call("GET", KEYS[2])
+	if not accumulatedTokens then
+		accumulatedTokens = maxTokensToAccumulate
+	end
+
+	local currentTimeNanos = tonumber(ARGV[1])
+	local lifespan = tonumber(ARGV[4])
+
+	if currentTimeNanos > tokensNextAvailableNanos then
+		local freshTokens = math.floor((currentTimeNanos - tokensNextAvailableNanos) / nanosBetweenTokens)
+		accumulatedTokens = math.min(maxTokensToAccumulate, accumulatedTokens + freshTokens)
+		tokensNextAvailableNanos = currentTimeNanos
+	end
+
+	if lifespan > 0 then
+		redis.call("SET", KEYS[1], tokensNextAvailableNanos, "PX", lifespan)
+		redis.call("SET", KEYS[2], 0, "PX", lifespan)
+		redis.call("PEXPIRE", KEYS[3], lifespan)
+	else
+		redis.call("SET", KEYS[1], tokensNextAvailableNanos)
+		redis.call("SET", KEYS[2], 0)
+	end
+
+	return math.floor(accumulatedTokens)
 	`
-	s := c.ScriptLoad(lua)
-	sha = s.Val()
-	logging.Printf("Loaded LUA script into Redis; script SHA %v", sha)
-	return
-}
@@ -4,7 +4,9 @@
 package redis
 
 import (
+	"context"
 	"testing"
+	"time"
 	"github.com/maniksurtani/quotaservice/buckets"
 	"gopkg.in/redis.v3"
 	"github.com/maniksurtani/quotaservice/configs"
@@ -50,3 +52,197 @@ func TestFailingRedisConn(t *testing.T) {
 		t.Fatalf("Should have not seen any wait time. Saw %v", w)
 	}
 }
+
+func TestInitFailed(t *testing.T) {
+	// Nothing should be listening on port 1.
+	bf := NewBucketFactory(&redis.Options{Addr: "localhost:1"}, 1)
+	if bf.Ready() || bf.ReadyErr() != buckets.ErrFactoryNotInitialized {
+		t.Fatalf("Expecting factory not to be ready before Init. Was %v", bf.ReadyErr())
+	}
+
+	bf.Init(cfg)
+	if bf.Ready() || bf.ReadyErr() == nil {
+		t.Fatal("Expecting factory not to be ready after failing to connect")
+	}
+}
+
+func TestReady(t *testing.T) {
+	if !factory.Ready() {
+		t.Fatalf("Expecting factory to be ready. Was %v", factory.ReadyErr())
+	}
+}
+
+func TestScriptVersionMatch(t *testing.T) {
+	bf := bucket.factory
+	b := factory.NewBucket("redis", "versioned", configs.NewDefaultBucketConfig(), false)
+	b.Take(1, 0)
+
+	if err := bf.migrate(); err != nil {
+		t.Fatalf("Unable to migrate: %v", err)
+	}
+
+	if !bf.client.Exists(bf.key("redis", "versioned", ACCUMULATED_TOKENS_SUFFIX)).Val() {
+		t.Fatal("Bucket state should be kept when the script version matches")
+	}
+}
+
+func TestScriptVersionMismatch(t *testing.T) {
+	bf := bucket.factory
+	b := factory.NewBucket("redis", "versioned", configs.NewDefaultBucketConfig(), false)
+	b.Take(1, 0)
+
+	bf.client.Set(SCRIPT_VERSION_KEY, "old", 0)
+	if err := bf.migrate(); err != nil {
+		t.Fatalf("Unable to migrate: %v", err)
+	}
+
+	if bf.client.Exists(bf.key("redis", "versioned", ACCUMULATED_TOKENS_SUFFIX)).Val() {
+		t.Fatal("Bucket state should be flushed when the script version changes")
+	}
+
+	if v := bf.client.Get(SCRIPT_VERSION_KEY).Val(); v != bf.ScriptVersion() {
+		t.Fatalf("Expecting script version %v. Was %v", bf.ScriptVersion(), v)
+	}
+}
+
+func TestScriptVersionMismatchWithKeyPrefix(t *testing.T) {
+	prefixed := NewBucketFactoryWithKeyPrefix(&redis.Options{Addr: "localhost:6379"}, 2, "prefixed:")
+	prefixed.Init(cfg)
+	bf := prefixed.(*bucketFactory)
+	prefixed.NewBucket("redis", "versioned", configs.NewDefaultBucketConfig(), false).Take(1, 0)
+	factory.NewBucket("redis", "versioned", configs.NewDefaultBucketConfig(), false).Take(1, 0)
+
+	bf.client.Set("prefixed:"+SCRIPT_VERSION_KEY, "old", 0)
+	if err := bf.migrate(); err != nil {
+		t.Fatalf("Unable to migrate: %v", err)
+	}
+
+	if bf.client.Exists(bf.key("redis", "versioned", ACCUMULATED_TOKENS_SUFFIX)).Val() {
+		t.Fatal("Bucket state with the prefix should be flushed when the script version changes")
+	}
+
+	if !bf.client.Exists(toRedisKey("redis", "versioned", ACCUMULATED_TOKENS_SUFFIX)).Val() {
+		t.Fatal("Bucket state without the prefix should be kept")
+	}
+
+	if v := bf.client.Get(SCRIPT_VERSION_KEY).Val(); v != bf.ScriptVersion() {
+		t.Fatalf("Expecting the unprefixed script version to be untouched. Was %v", v)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	b := factory.NewBucket("redis", "drain", configs.NewDefaultBucketConfig(), false)
+	b.Take(40, 0)
+
+	if drained, err := b.Drain(); err != nil || drained != 60 {
+		t.Fatalf("Expecting 60 tokens drained. Was %v, %v", drained, err)
+	}
+
+	if drained, err := b.Drain(); err != nil || drained != 0 {
+		t.Fatalf("Expecting nothing left to drain. Was %v, %v", drained, err)
+	}
+}
+
+func TestTuneSharedBucket(t *testing.T) {
+	b := factory.NewBucket("redis", "tuned", configs.NewDefaultBucketConfig(), false)
+	// Another instance sharing the bucket.
+	other := factory.NewBucket("redis", "tuned", configs.NewDefaultBucketConfig(), false)
+	b.Take(40, 0)
+
+	// Both instances halve the size from their configured values, which scales the tokens once.
+	for _, instance := range []buckets.Bucket{b, other} {
+		tuned := *instance.Config()
+		tuned.Size /= 2
+		if err := instance.Tune(&tuned); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if drained, err := other.Drain(); err != nil || drained != 30 {
+		t.Fatalf("Expecting 30 tokens drained. Was %v, %v", drained, err)
+	}
+
+	// The tuned size is shared, so refilling stops there even on instances that weren't tuned.
+	untuned := factory.NewBucket("redis", "tuned", configs.NewDefaultBucketConfig(), false)
+	untuned.AddTokens(100)
+	if drained, err := untuned.Drain(); err != nil || drained != 50 {
+		t.Fatalf("Expecting 50 tokens drained. Was %v, %v", drained, err)
+	}
+}
+
+func TestTakeExclusive(t *testing.T) {
+	b := factory.NewBucket("redis", "exclusive", configs.NewDefaultBucketConfig(), false).(*redisBucket)
+	w, leaseID, err := b.TakeExclusive(context.Background(), 0, time.Minute)
+	if err != nil || w != 0 || leaseID == "" {
+		t.Fatalf("Expecting the lease to be granted. Was %v, %v, %v", w, leaseID, err)
+	}
+
+	if err := b.ReleaseExclusive(leaseID); err != nil {
+		t.Fatalf("Expecting the lease to be released. Was %v", err)
+	}
+
+	if err := b.ReleaseExclusive(leaseID); err != buckets.ErrNoSuchLease {
+		t.Fatalf("Expecting ErrNoSuchLease releasing twice. Was %v", err)
+	}
+}
+
+func TestTakeExclusiveContended(t *testing.T) {
+	b := factory.NewBucket("redis", "contended", configs.NewDefaultBucketConfig(), false).(*redisBucket)
+	// Another instance sharing the bucket.
+	other := factory.NewBucket("redis", "contended", configs.NewDefaultBucketConfig(), false).(*redisBucket)
+
+	_, leaseID, err := b.TakeExclusive(context.Background(), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*LeasePollInterval)
+	defer cancel()
+	if _, _, err := other.TakeExclusive(ctx, 0, time.Minute); err != buckets.ErrLeaseHeld {
+		t.Fatalf("Expecting ErrLeaseHeld while the lease is held. Was %v", err)
+	}
+
+	// Waiting callers acquire the lease once it's released.
+	acquired := make(chan error)
+	go func() {
+		_, otherLeaseID, err := other.TakeExclusive(context.Background(), 0, time.Minute)
+		if err == nil {
+			err = other.ReleaseExclusive(otherLeaseID)
+		}
+		acquired <- err
+	}()
+
+	time.Sleep(5 * LeasePollInterval)
+	if err := b.ReleaseExclusive(leaseID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-acquired; err != nil {
+		t.Fatalf("Expecting the waiting caller to acquire the lease. Was %v", err)
+	}
+}
+
+func TestTakeExclusiveExpiry(t *testing.T) {
+	b := factory.NewBucket("redis", "expiring", configs.NewDefaultBucketConfig(), false).(*redisBucket)
+	_, leaseID, err := b.TakeExclusive(context.Background(), 0, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*LeasePollInterval)
+	defer cancel()
+	_, otherLeaseID, err := b.TakeExclusive(ctx, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("Expecting the lease to be granted once expired. Was %v", err)
+	}
+
+	// The expired lease can't release its successor.
+	if err := b.ReleaseExclusive(leaseID); err != buckets.ErrNoSuchLease {
+		t.Fatalf("Expecting ErrNoSuchLease releasing an expired lease. Was %v", err)
+	}
+
+	if err := b.ReleaseExclusive(otherLeaseID); err != nil {
+		t.Fatal(err)
+	}
+}
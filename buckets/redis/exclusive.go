@@ -0,0 +1,80 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+)
+
+// LEASE_SUFFIX is the suffix of the Redis key holding the ID of a bucket's exclusive lease.
+const LEASE_SUFFIX = "LEASE"
+
+// LeasePollInterval is how often TakeExclusive() retries acquiring a lease held by another caller.
+const LeasePollInterval = 10 * time.Millisecond
+
+// TakeExclusive implements buckets.ExclusiveBucket, using SET NX on a key shared by all instances
+// as the lease.
+func (b *redisBucket) TakeExclusive(ctx context.Context, maxWaitTime, lockTTL time.Duration) (waitTime time.Duration, leaseID string, err error) {
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return 0, "", fmt.Errorf("Unable to generate a lease ID: %v", err)
+	}
+	leaseID = hex.EncodeToString(id)
+
+	for {
+		acquired, err := b.factory.client.SetNX(b.leaseKey, leaseID, lockTTL).Result()
+		if err != nil {
+			return 0, "", fmt.Errorf("Unable to acquire lease %v: %v", b.leaseKey, err)
+		}
+
+		if acquired {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, "", buckets.ErrLeaseHeld
+		case <-time.After(LeasePollInterval):
+		}
+	}
+
+	if waitTime = b.Take(1, maxWaitTime); waitTime < 0 {
+		if err = b.ReleaseExclusive(leaseID); err != nil {
+			return 0, "", err
+		}
+		return waitTime, "", nil
+	}
+
+	return waitTime, leaseID, nil
+}
+
+// ReleaseExclusive implements buckets.ExclusiveBucket. The lease is only deleted if it still holds
+// leaseID, so a lease that has expired and been acquired by another caller isn't released.
+func (b *redisBucket) ReleaseExclusive(leaseID string) error {
+	res := b.factory.client.Eval(releaseScript, []string{b.leaseKey}, []string{leaseID})
+	if res.Err() != nil {
+		return fmt.Errorf("Unable to release lease %v: %v", b.leaseKey, res.Err())
+	}
+
+	if released, _ := res.Val().(int64); released == 0 {
+		return buckets.ErrNoSuchLease
+	}
+
+	return nil
+}
+
+// releaseScript deletes a lease if it's held by the caller.
+const releaseScript = `
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+
+	return 0
+`
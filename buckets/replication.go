@@ -0,0 +1,105 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice/logging"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+)
+
+// ReplicationTimeout is how long the standby has to acknowledge each replicated grant.
+const ReplicationTimeout = time.Second
+
+// replicator sends grants to a standby quota service in the background.
+type replicator struct {
+	standby qspb.QuotaServiceClient
+	grants  chan *qspb.ReplicateGrantRequest
+	dropped int64
+	stopper <-chan struct{} // Closed to stop replicating.
+}
+
+// WithStandbyReplication sends every grant recorded using RecordEvent() to a standby quota
+// service, using the ReplicateGrant RPC, so that the standby takes the same tokens from its own
+// buckets and has approximately the same state should this instance fail. Grants are sent
+// asynchronously, in order, and are dropped if bufferSize grants are already waiting to be sent.
+// Replication is best-effort; grants the standby fails to apply aren't retried. Replication stops
+// when the container is stopped.
+//
+// Grants are replicated by the name of the bucket requested, and the standby takes them from that
+// bucket and its namespace's aggregate buckets. Tokens taken from operation buckets aren't
+// replicated, and grants served by a fallback bucket are taken from the requested bucket on the
+// standby rather than from the fallback. Grants of no tokens, such as those of zero-cost
+// operations, aren't replicated.
+func (bc *BucketContainer) WithStandbyReplication(standby qspb.QuotaServiceClient, bufferSize int) *BucketContainer {
+	if standby == nil {
+		panic("Standby should not be nil")
+	}
+
+	if bufferSize < 1 {
+		panic("Replication buffer size should be positive")
+	}
+
+	r := &replicator{
+		standby: standby,
+		grants:  make(chan *qspb.ReplicateGrantRequest, bufferSize),
+		stopper: bc.stopper}
+	go r.run()
+	bc.replicator.Store(r)
+	return bc
+}
+
+// DroppedReplications tells you how many grants weren't replicated to the standby, because the
+// replication buffer was full.
+func (bc *BucketContainer) DroppedReplications() int64 {
+	if r, ok := bc.replicator.Load().(*replicator); ok {
+		return atomic.LoadInt64(&r.dropped)
+	}
+
+	return 0
+}
+
+func (r *replicator) replicate(namespace, bucketName string, tokens int64, grantedAt time.Time) {
+	if tokens < 1 {
+		// The standby has nothing to take, and rejects such grants.
+		return
+	}
+
+	req := &qspb.ReplicateGrantRequest{
+		Namespace:      proto.String(namespace),
+		Name:           proto.String(bucketName),
+		TokensGranted:  proto.Int64(tokens),
+		TimestampNanos: proto.Int64(grantedAt.UnixNano())}
+
+	select {
+	case r.grants <- req:
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+func (r *replicator) run() {
+	for {
+		select {
+		case req := <-r.grants:
+			r.send(req)
+		case <-r.stopper:
+			return
+		}
+	}
+}
+
+func (r *replicator) send(req *qspb.ReplicateGrantRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), ReplicationTimeout)
+	defer cancel()
+
+	if _, err := r.standby.ReplicateGrant(ctx, req); err != nil {
+		logging.Printf("Unable to replicate grant of %v tokens from %v:%v: %v",
+			req.GetTokensGranted(), req.GetNamespace(), req.GetName(), err)
+	}
+}
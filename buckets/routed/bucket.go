@@ -0,0 +1,81 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package routed implements a bucket factory that spreads buckets across multiple factories, such
+// as one per Redis shard. Each bucket is always created by the same factory, so that a client sees
+// the same token counts wherever its bucket is re-created. Buckets are routed by a hash of their
+// fully qualified name, unless their namespace has a StickyBucketHashFunc, which can route related
+// buckets, such as all buckets of a user, to the same factory.
+package routed
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// RoutedBucketFactory creates each bucket using one of several factories.
+type RoutedBucketFactory struct {
+	factories []buckets.BucketFactory
+	cfg       *configs.ServiceConfig
+}
+
+// NewBucketFactory creates a factory that routes buckets across factories.
+func NewBucketFactory(factories ...buckets.BucketFactory) *RoutedBucketFactory {
+	if len(factories) == 0 {
+		panic("Need at least 1 bucket factory to route buckets to.")
+	}
+
+	return &RoutedBucketFactory{factories: factories}
+}
+
+func (bf *RoutedBucketFactory) Init(cfg *configs.ServiceConfig) {
+	bf.cfg = cfg
+	for _, f := range bf.factories {
+		f.Init(cfg)
+	}
+}
+
+// Ready returns true once all factories are ready.
+func (bf *RoutedBucketFactory) Ready() bool {
+	return bf.ReadyErr() == nil
+}
+
+func (bf *RoutedBucketFactory) ReadyErr() error {
+	for i, f := range bf.factories {
+		if err := f.ReadyErr(); err != nil {
+			return fmt.Errorf("Bucket factory %v isn't ready: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (bf *RoutedBucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	return bf.factories[bf.FactoryIndex(namespace, bucketName)].NewBucket(namespace, bucketName, cfg, dyn)
+}
+
+// FactoryIndex returns the index of the factory that creates the bucket namespace:bucketName.
+func (bf *RoutedBucketFactory) FactoryIndex(namespace, bucketName string) int {
+	var h int
+	if nsCfg := bf.namespaceConfig(namespace); nsCfg != nil && nsCfg.StickyBucketHashFunc != nil {
+		h = nsCfg.StickyBucketHashFunc(bucketName)
+	} else {
+		fnvHash := fnv.New32a()
+		fnvHash.Write([]byte(buckets.FullyQualifiedName(namespace, bucketName)))
+		h = int(fnvHash.Sum32())
+	}
+
+	n := len(bf.factories)
+	return (h%n + n) % n
+}
+
+func (bf *RoutedBucketFactory) namespaceConfig(namespace string) *configs.NamespaceConfig {
+	if bf.cfg == nil {
+		return nil
+	}
+
+	return bf.cfg.Namespaces[namespace]
+}
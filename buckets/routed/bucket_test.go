@@ -0,0 +1,99 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package routed
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// recordingFactory records the names of the buckets it creates.
+type recordingFactory struct {
+	buckets.BucketFactory
+	created map[string]bool
+}
+
+func (f *recordingFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	f.created[bucketName] = true
+	return f.BucketFactory.NewBucket(namespace, bucketName, cfg, dyn)
+}
+
+func newFactory(shards int, hashFunc func(bucketName string) int) (*RoutedBucketFactory, []*recordingFactory) {
+	recorders := make([]*recordingFactory, shards)
+	factories := make([]buckets.BucketFactory, shards)
+	for i := range recorders {
+		recorders[i] = &recordingFactory{memory.NewBucketFactory(), make(map[string]bool)}
+		factories[i] = recorders[i]
+	}
+
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].StickyBucketHashFunc = hashFunc
+	bf := NewBucketFactory(factories...)
+	bf.Init(cfg)
+	return bf, recorders
+}
+
+// userHash routes buckets named user/resource by user.
+func userHash(bucketName string) int {
+	user, _ := strconv.Atoi(strings.SplitN(bucketName, "/", 2)[0])
+	return user
+}
+
+func bucketNames() []string {
+	names := make([]string, 0, 100)
+	for user := 0; user < 25; user++ {
+		for _, resource := range []string{"reads", "writes", "uploads", "searches"} {
+			names = append(names, fmt.Sprintf("%v/%v", user, resource))
+		}
+	}
+	return names
+}
+
+func TestStickyRouting(t *testing.T) {
+	bf, recorders := newFactory(4, userHash)
+	for _, name := range bucketNames() {
+		shard := bf.FactoryIndex("n", name)
+		if expected := userHash(name) % 4; shard != expected {
+			t.Fatalf("Expecting %v on shard %v. Was %v", name, expected, shard)
+		}
+
+		b := bf.NewBucket("n", name, configs.NewDefaultBucketConfig(), false)
+		b.Destroy()
+		if !recorders[shard].created[name] || bf.FactoryIndex("n", name) != shard {
+			t.Fatalf("Expecting %v to be created on shard %v", name, shard)
+		}
+	}
+}
+
+func TestDefaultRouting(t *testing.T) {
+	bf, _ := newFactory(4, nil)
+	used := make(map[int]bool)
+	for _, name := range bucketNames() {
+		shard := bf.FactoryIndex("n", name)
+		for i := 0; i < 3; i++ {
+			if bf.FactoryIndex("n", name) != shard {
+				t.Fatalf("Expecting %v to be routed consistently", name)
+			}
+		}
+		used[shard] = true
+	}
+
+	if len(used) != 4 {
+		t.Fatalf("Expecting buckets on all 4 shards. Were on %v", used)
+	}
+}
+
+func TestNegativeHash(t *testing.T) {
+	bf, _ := newFactory(3, func(bucketName string) int { return -5 })
+	if shard := bf.FactoryIndex("n", "b"); shard != 1 {
+		t.Fatalf("Expecting shard 1. Was %v", shard)
+	}
+}
@@ -0,0 +1,133 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/logging"
+	"github.com/maniksurtani/quotaservice/scaling"
+)
+
+const (
+	// ScalingUtilisationThreshold is the percentage of a bucket's size that has to be taken before
+	// it is considered for scaling.
+	ScalingUtilisationThreshold = 80
+	// ScalingSustainDuration is how long a bucket's utilisation has to stay above
+	// ScalingUtilisationThreshold before scaling is signalled.
+	ScalingSustainDuration = 5 * time.Minute
+	// ScalingCheckInterval is how often bucket utilisation is checked.
+	ScalingCheckInterval = 30 * time.Second
+)
+
+// WithScalingAdapter signals adapter while the utilisation of any bucket has stayed above
+// ScalingUtilisationThreshold for ScalingSustainDuration, on every check, and once more when it
+// falls back below the threshold. Only buckets that implement TokenCounter are checked. Checks stop
+// when the container is stopped.
+func (bc *BucketContainer) WithScalingAdapter(adapter scaling.ScalingAdapter) *BucketContainer {
+	if adapter == nil {
+		panic("Scaling adapter should not be nil")
+	}
+
+	t := newScalingTracker(adapter)
+	go bc.every(ScalingCheckInterval, func() {
+		bc.checkScaling(t, time.Now())
+	})
+
+	return bc
+}
+
+// scalingTracker remembers when each bucket's utilisation rose above the threshold.
+type scalingTracker struct {
+	adapter   scaling.ScalingAdapter
+	highSince map[Bucket]time.Time
+	sustained map[Bucket]bool // Buckets that have been signalled as sustained.
+	sync.Mutex
+}
+
+func newScalingTracker(adapter scaling.ScalingAdapter) *scalingTracker {
+	return &scalingTracker{
+		adapter:   adapter,
+		highSince: make(map[Bucket]time.Time),
+		sustained: make(map[Bucket]bool)}
+}
+
+func (bc *BucketContainer) checkScaling(t *scalingTracker, now time.Time) {
+	var signals []scaling.Signal
+	live := make(map[Bucket]bool)
+
+	t.Lock()
+	bc.walkBuckets(func(nsName, bName string, b Bucket) {
+		tc, ok := b.(TokenCounter)
+		size := float64(b.Config().Size)
+		if !ok || size <= 0 {
+			return
+		}
+
+		live[b] = true
+		utilisation := 100 * (size - float64(tc.AvailableTokens())) / size
+		if utilisation <= ScalingUtilisationThreshold {
+			delete(t.highSince, b)
+			if t.sustained[b] {
+				delete(t.sustained, b)
+				signals = append(signals, scaling.Signal{Namespace: nsName, BucketName: bName, Utilisation: utilisation})
+			}
+			return
+		}
+
+		since, ok := t.highSince[b]
+		if !ok {
+			t.highSince[b] = now
+		} else if now.Sub(since) >= ScalingSustainDuration {
+			t.sustained[b] = true
+			signals = append(signals, scaling.Signal{Namespace: nsName, BucketName: bName, Utilisation: utilisation, Sustained: true})
+		}
+	})
+
+	// Forget buckets that have been removed.
+	for b := range t.highSince {
+		if !live[b] {
+			delete(t.highSince, b)
+			delete(t.sustained, b)
+		}
+	}
+	t.Unlock()
+
+	for _, s := range signals {
+		if err := t.adapter.Publish(s); err != nil {
+			logging.Printf("Unable to publish scaling signal for %v:%v: %v", s.Namespace, s.BucketName, err)
+		}
+	}
+}
+
+// walkBuckets calls fn with every bucket in the container, including default and aggregate
+// buckets.
+func (bc *BucketContainer) walkBuckets(fn func(namespace, bucketName string, b Bucket)) {
+	if bc.defaultBucket != nil {
+		fn(GLOBAL_NAMESPACE, DEFAULT_BUCKET_NAME, bc.defaultBucket)
+	}
+
+	bc.registry().Walk(func(nsName string, v interface{}) {
+		ns := v.(*namespace)
+		ns.RLock()
+		named := make(map[string]Bucket, len(ns.buckets))
+		for bName, b := range ns.buckets {
+			named[bName] = b
+		}
+		ns.RUnlock()
+
+		for bName, b := range named {
+			fn(nsName, bName, b)
+		}
+
+		if ns.defaultBucket != nil {
+			fn(nsName, DEFAULT_BUCKET_NAME, ns.defaultBucket)
+		}
+
+		if ns.aggregateBucket != nil {
+			fn(nsName, AGGREGATE_BUCKET_NAME, ns.aggregateBucket)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"sync"
+	"time"
+)
+
+// SmoothedBucketContainer batches concurrent requests for tokens from the same bucket into a
+// single Take(), to reduce the load on remote buckets such as the ones in the redis package during
+// spikes of traffic. Requests arriving within batchWindowMicros of the first request in a batch
+// are taken together once the window closes, and each request waits as long as the batch, since
+// none of the batch's tokens are available any sooner. If the batch can't be granted as a whole,
+// its requests are taken individually, so that those that fit are still granted.
+//
+// Each request is delayed by up to the batch window, so keep it small relative to the latency of
+// the bucket implementation.
+type SmoothedBucketContainer struct {
+	*BucketContainer
+	batchWindow time.Duration
+	pending     map[batchKey]*batch
+	sync.Mutex
+}
+
+// batchKey identifies requests that may be batched together.
+type batchKey struct {
+	bucket      Bucket
+	maxWaitTime time.Duration
+}
+
+type batch struct {
+	tokens []int64
+	waits  []time.Duration
+	done   chan struct{}
+}
+
+// NewSmoothedBucketContainer wraps a BucketContainer, batching requests made using Take() within
+// batchWindowMicros of each other.
+func NewSmoothedBucketContainer(bc *BucketContainer, batchWindowMicros int) *SmoothedBucketContainer {
+	if batchWindowMicros < 1 {
+		panic("Batch window should be positive")
+	}
+
+	return &SmoothedBucketContainer{
+		BucketContainer: bc,
+		batchWindow:     time.Duration(batchWindowMicros) * time.Microsecond,
+		pending:         make(map[batchKey]*batch)}
+}
+
+// Take finds a bucket and takes tokens from it as part of a batch, returning the wait time for
+// this request's tokens as Bucket.Take() does.
+func (s *SmoothedBucketContainer) Take(namespace, bucketName string, numTokens int64, maxWaitTime time.Duration) (time.Duration, error) {
+	bucket, err := s.FindBucket(namespace, bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	if bucket == nil {
+		return 0, ErrNoSuchBucket
+	}
+
+	key := batchKey{bucket, maxWaitTime}
+	s.Lock()
+	b := s.pending[key]
+	if b == nil {
+		b = &batch{done: make(chan struct{})}
+		s.pending[key] = b
+		time.AfterFunc(s.batchWindow, func() { s.flush(key, b) })
+	}
+	i := len(b.tokens)
+	b.tokens = append(b.tokens, numTokens)
+	s.Unlock()
+
+	<-b.done
+	return b.waits[i], nil
+}
+
+// flush closes a batch to new requests, and takes its tokens.
+func (s *SmoothedBucketContainer) flush(key batchKey, b *batch) {
+	s.Lock()
+	delete(s.pending, key)
+	s.Unlock()
+
+	var total int64
+	for _, t := range b.tokens {
+		total += t
+	}
+
+	b.waits = make([]time.Duration, len(b.tokens))
+	if wait := key.bucket.Take(total, key.maxWaitTime); wait >= 0 {
+		for i := range b.tokens {
+			b.waits[i] = wait
+		}
+	} else {
+		for i, t := range b.tokens {
+			b.waits[i] = key.bucket.Take(t, key.maxWaitTime)
+		}
+	}
+
+	close(b.done)
+}
@@ -0,0 +1,105 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice/logging"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+)
+
+// StatefulBucket is implemented by buckets that hold their state locally, such as in-memory
+// buckets, so that it can be transferred to another instance of the quota service. Buckets
+// backed by a shared store, such as the ones in the redis package, needn't implement it, since
+// their state is already shared by all instances using the store.
+type StatefulBucket interface {
+	Bucket
+	// ExportState returns the tokens accumulated, and the time at which the next token is
+	// available, in nanos since the epoch.
+	ExportState() (accumulatedTokens, tokensNextAvailableNanos int64)
+	// ImportState restores state returned by ExportState. Tokens beyond the bucket's size are
+	// discarded.
+	ImportState(accumulatedTokens, tokensNextAvailableNanos int64)
+}
+
+// Export returns the state of all stateful buckets, for Import() into another container, such as
+// when failing over to another datacenter. Buckets that aren't StatefulBuckets are skipped.
+func (bc *BucketContainer) Export() (*qspb.StateSnapshot, error) {
+	snapshot := &qspb.StateSnapshot{TimestampNanos: proto.Int64(time.Now().UnixNano())}
+	export := func(namespace, bucketName string, b Bucket) {
+		if sb, ok := b.(StatefulBucket); ok {
+			tokens, tna := sb.ExportState()
+			snapshot.Buckets = append(snapshot.Buckets, &qspb.BucketState{
+				Namespace:                proto.String(namespace),
+				Name:                     proto.String(bucketName),
+				AccumulatedTokens:        proto.Int64(tokens),
+				TokensNextAvailableNanos: proto.Int64(tna)})
+		}
+	}
+
+	if bc.defaultBucket != nil {
+		export(GLOBAL_NAMESPACE, DEFAULT_BUCKET_NAME, bc.defaultBucket)
+	}
+
+	bc.registry().Walk(func(nsName string, v interface{}) {
+		ns := v.(*namespace)
+		ns.RLock()
+		for bName, b := range ns.buckets {
+			export(nsName, bName, b)
+		}
+		ns.RUnlock()
+
+		if ns.defaultBucket != nil {
+			export(nsName, DEFAULT_BUCKET_NAME, ns.defaultBucket)
+		}
+
+		if ns.aggregateBucket != nil {
+			export(nsName, AGGREGATE_BUCKET_NAME, ns.aggregateBucket)
+		}
+	})
+
+	return snapshot, nil
+}
+
+// Import restores the state of buckets exported using Export(), and should be called before the
+// container serves its first request. Dynamic buckets are created if the namespace allows them.
+// Buckets that no longer exist, or that aren't StatefulBuckets, are skipped. Tokens accumulate
+// from the time of the snapshot, up to the bucket's current size.
+func (bc *BucketContainer) Import(snapshot *qspb.StateSnapshot) error {
+	for _, s := range snapshot.Buckets {
+		b := bc.bucketForState(s.GetNamespace(), s.GetName())
+		sb, ok := b.(StatefulBucket)
+		if !ok {
+			logging.Printf("Not importing state for %v:%v; no such stateful bucket.", s.GetNamespace(), s.GetName())
+			continue
+		}
+
+		sb.ImportState(s.GetAccumulatedTokens(), s.GetTokensNextAvailableNanos())
+	}
+
+	return nil
+}
+
+// bucketForState returns the bucket state was exported from, creating dynamic buckets if needed.
+func (bc *BucketContainer) bucketForState(namespace, bucketName string) Bucket {
+	if b := bc.existingBucket(namespace, bucketName); b != nil {
+		return b
+	}
+
+	ns := bc.namespace(namespace)
+	if ns == nil || bucketName == DEFAULT_BUCKET_NAME || bucketName == AGGREGATE_BUCKET_NAME {
+		return nil
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+	b := ns.buckets[bucketName]
+	if b == nil && ns.cfg.DynamicBucketTemplate != nil {
+		b = bc.createNewNamedBucket(namespace, bucketName, ns)
+	}
+
+	return b
+}
@@ -0,0 +1,55 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import "errors"
+
+var ErrNoLifetimeStats = errors.New("Bucket doesn't record lifetime stats")
+
+// LifetimeStats are the number of requests a bucket has granted and rejected. Buckets configured
+// with PersistStats count requests served before restarts too.
+type LifetimeStats struct {
+	Grants     int64 `json:"grants"`
+	Rejections int64 `json:"rejections"`
+}
+
+// LifetimeStatsBucket is implemented by buckets that count the requests they grant and reject.
+type LifetimeStatsBucket interface {
+	Bucket
+	LifetimeStats() LifetimeStats
+}
+
+// LifetimeStats returns the number of requests a bucket has granted and rejected. Buckets are named
+// as for Drain, and dynamic buckets aren't created. Returns ErrNoSuchBucket if the bucket doesn't
+// exist, and ErrNoLifetimeStats if it doesn't count requests.
+func (bc *BucketContainer) LifetimeStats(namespace, bucketName string) (LifetimeStats, error) {
+	b := bc.existingBucket(namespace, bucketName)
+	if b == nil {
+		return LifetimeStats{}, ErrNoSuchBucket
+	}
+
+	sb, ok := b.(LifetimeStatsBucket)
+	if !ok {
+		return LifetimeStats{}, ErrNoLifetimeStats
+	}
+
+	return sb.LifetimeStats(), nil
+}
+
+// StatsPersistingBucket is implemented by buckets that persist their lifetime stats, such as memory
+// buckets configured with PersistStats.
+type StatsPersistingBucket interface {
+	Bucket
+	// FlushStats persists the bucket's lifetime stats, waiting for them to be written.
+	FlushStats()
+}
+
+// flushStats persists the lifetime stats of every bucket that persists them.
+func (bc *BucketContainer) flushStats() {
+	bc.walkBuckets(func(_, _ string, b Bucket) {
+		if sb, ok := b.(StatsPersistingBucket); ok {
+			sb.FlushStats()
+		}
+	})
+}
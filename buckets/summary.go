@@ -0,0 +1,126 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package buckets
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Summary returns a table of the capacity of each namespace, for capacity planning. For each
+// namespace, it shows the total fill rate of its buckets, the percentage of their tokens in use,
+// the number of dynamic buckets and the number of buckets with no tokens left. Utilisation and
+// exhaustion are only known for buckets that are TokenCounters, and utilisation is shown as "-"
+// if the namespace has none. Aggregate buckets aren't included. Summary is safe to call while
+// the container serves requests.
+func (bc *BucketContainer) Summary() string {
+	var names []string
+	registry := bc.registry()
+	registry.Walk(func(nsName string, _ interface{}) {
+		names = append(names, nsName)
+	})
+
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	buffer.WriteString("namespace | total_rate | utilisation% | dynamic_count | exhausted_count\n")
+	for _, nsName := range names {
+		var totalRate, size, available int64
+		var dynamic, exhausted int
+		counted := false
+		for _, b := range namespaceBuckets(registry.Get(nsName).(*namespace)) {
+			cfg := b.Config()
+			totalRate += cfg.FillRate
+			if b.Dynamic() {
+				dynamic++
+			}
+
+			if tc, ok := b.(TokenCounter); ok {
+				tokens := tc.AvailableTokens()
+				if tokens <= 0 {
+					exhausted++
+					tokens = 0
+				}
+
+				counted = true
+				size += cfg.Size
+				available += tokens
+			}
+		}
+
+		utilisation := "-"
+		if counted && size > 0 {
+			utilisation = fmt.Sprintf("%.1f%%", 100*float64(size-available)/float64(size))
+		}
+
+		buffer.WriteString(fmt.Sprintf("%v | %v | %v | %v | %v\n", nsName, totalRate, utilisation, dynamic, exhausted))
+	}
+
+	return buffer.String()
+}
+
+// TotalRate returns the sum of the fill rates, in tokens per second, of all named buckets in all
+// namespaces, and of the dynamic buckets that currently exist. Default and aggregate buckets aren't
+// included. This is a planning metric, for an SLO on total throughput, rather than the rate at
+// which tokens are being granted.
+func (bc *BucketContainer) TotalRate() float64 {
+	var total float64
+	bc.registry().Walk(func(_ string, ns interface{}) {
+		total += ns.(*namespace).rate()
+	})
+
+	return total
+}
+
+// NamespaceRate returns the contribution of a namespace to TotalRate(), or 0 if the namespace
+// doesn't exist.
+func (bc *BucketContainer) NamespaceRate(namespace string) float64 {
+	ns := bc.namespace(namespace)
+	if ns == nil {
+		return 0
+	}
+
+	return ns.rate()
+}
+
+// rate sums the fill rates of the namespace's named buckets, and those of its dynamic buckets.
+func (ns *namespace) rate() float64 {
+	ns.RLock()
+	defer ns.RUnlock()
+
+	var rate float64
+	for _, cfg := range ns.cfg.Buckets {
+		rate += float64(cfg.FillRate)
+	}
+
+	if template := ns.cfg.DynamicBucketTemplate; template != nil {
+		dynamic := 0
+		for _, b := range ns.buckets {
+			if b.Dynamic() {
+				dynamic++
+			}
+		}
+		rate += float64(dynamic) * float64(template.FillRate)
+	}
+
+	return rate
+}
+
+// namespaceBuckets returns the named and default buckets of a namespace.
+func namespaceBuckets(ns *namespace) []Bucket {
+	ns.RLock()
+	defer ns.RUnlock()
+
+	bs := make([]Bucket, 0, len(ns.buckets)+1)
+	for _, b := range ns.buckets {
+		bs = append(bs, b)
+	}
+
+	if ns.defaultBucket != nil {
+		bs = append(bs, ns.defaultBucket)
+	}
+
+	return bs
+}
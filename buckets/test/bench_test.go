@@ -0,0 +1,119 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package test
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// newBenchmarkContainer creates a container with a namespace of dynamic buckets large enough that
+// benchmarks don't run out of tokens.
+func newBenchmarkContainer(factory buckets.BucketFactory) *buckets.BucketContainer {
+	bCfg := configs.NewDefaultBucketConfig()
+	bCfg.Size = 1e12
+	bCfg.FillRate = 1e9
+	bCfg.MaxDebtMillis = 1e9
+
+	c := configs.NewDefaultServiceConfig()
+	c.Namespaces["bench"] = configs.NewDefaultNamespaceConfig()
+	c.Namespaces["bench"].DynamicBucketTemplate = bCfg
+	return buckets.NewBucketContainer(c, factory)
+}
+
+// runConcurrently drives goroutines goroutines, each calling f for its share of b.N iterations. It
+// reports throughput in tokens per second, and the p99 latency of calls to f, in nanoseconds. A
+// goroutine stops at the first error f returns, which fails the benchmark once all goroutines are
+// done, since b.Fatal may only be called from the benchmark's goroutine.
+func runConcurrently(b *testing.B, goroutines int, f func(iteration int) error) {
+	histograms := make([]*hdrhistogram.Histogram, goroutines)
+	for g := range histograms {
+		histograms[g] = hdrhistogram.New(1, int64(time.Minute), 3)
+	}
+	errs := make(chan error, goroutines)
+	var wg sync.WaitGroup
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < b.N; i += goroutines {
+				callStart := time.Now()
+				if err := f(i); err != nil {
+					errs <- err
+					return
+				}
+				histograms[g].RecordValue(int64(time.Since(callStart)))
+			}
+		}(g)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	close(errs)
+	if err := <-errs; err != nil {
+		b.Fatal(err)
+	}
+
+	merged := histograms[0]
+	for _, h := range histograms[1:] {
+		merged.Merge(h)
+	}
+
+	b.ReportMetric(float64(b.N) / elapsed.Seconds(), "tokens/sec")
+	b.ReportMetric(float64(merged.ValueAtQuantile(99)), "p99-ns")
+}
+
+// allow finds a bucket and takes a token from it, as the quota service does for every request.
+func allow(container *buckets.BucketContainer, bucketName string) error {
+	bucket, err := container.FindBucket("bench", bucketName)
+	if bucket == nil {
+		return fmt.Errorf("Unable to find bucket %v: %v", bucketName, err)
+	}
+
+	bucket.Take(1, 0)
+	return nil
+}
+
+func BenchmarkAllowSingleBucket_N_goroutines(b *testing.B) {
+	for impl, factory := range factories {
+		container := newBenchmarkContainer(factory)
+		for _, n := range []int{1, 2, 4, 8, 16, 32, 64} {
+			b.Run(fmt.Sprintf("%v/%v", impl, n), func(b *testing.B) {
+				runConcurrently(b, n, func(int) error {
+					return allow(container, "single")
+				})
+			})
+		}
+	}
+}
+
+func BenchmarkAllowMultiBucket_100buckets(b *testing.B) {
+	bucketNames := make([]string, 100)
+	for i := range bucketNames {
+		bucketNames[i] = strconv.Itoa(i)
+	}
+
+	for impl, factory := range factories {
+		container := newBenchmarkContainer(factory)
+		b.Run(impl, func(b *testing.B) {
+			runConcurrently(b, 16, func(i int) error {
+				return allow(container, bucketNames[i % len(bucketNames)])
+			})
+		})
+	}
+}
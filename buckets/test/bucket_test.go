@@ -70,3 +70,38 @@ func TestTokenAcquisition(t *testing.T) {
 		}
 	}
 }
+
+func TestAddTokens(t *testing.T) {
+	for impl, factory := range factories {
+		fmt.Println("Testing ", impl)
+		bucket := factory.NewBucket(impl, "add_tokens", configs.NewDefaultBucketConfig(), false)
+
+		// Consume all tokens, and borrow 10 from the future.
+		bucket.Take(110, 0)
+
+		// Pays off the borrowed tokens, and accumulates 10.
+		bucket.AddTokens(20)
+
+		wait := bucket.Take(10, 0)
+		if wait != 0 {
+			t.Fatalf("Expecting 0 wait. Was %v", wait)
+		}
+
+		// Accumulated tokens are capped at the bucket size.
+		bucket.AddTokens(1000)
+		wait = bucket.Take(100, 0)
+		if wait != 0 {
+			t.Fatalf("Expecting 0 wait. Was %v", wait)
+		}
+
+		wait = bucket.Take(10, 0)
+		if wait != 0 {
+			t.Fatalf("Expecting 0 wait. Was %v", wait)
+		}
+
+		wait = bucket.Take(10, 0)
+		if wait < 1 {
+			t.Fatalf("Expecting positive wait time. Was %v", wait)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package trie implements a compressed trie (radix tree) of namespaces, for deployments with so
+// many namespaces that storing each name in full, as a map does, wastes memory on their common
+// prefixes. Names such as customer.12345.api and customer.12346.api share the nodes holding
+// "customer.1234", and only store their differing suffixes.
+package trie
+
+// NamespaceRegistry maps namespace names to values. Lookups and insertions take O(len(namespace))
+// time. A NamespaceRegistry is not thread-safe for concurrent writes, but may be read concurrently
+// once populated.
+type NamespaceRegistry struct {
+	root node
+	size int
+}
+
+// node holds the fragment of a name on the edge leading to it. Fragments are copied, rather than
+// sliced from the names inserted, so that names aren't kept alive in full. Most nodes are leaves,
+// so children are held by pointer to keep leaves small.
+type node struct {
+	fragment string
+	children *[]*node
+	value    interface{}
+}
+
+func New() *NamespaceRegistry {
+	return &NamespaceRegistry{}
+}
+
+// Get returns the value stored for a namespace, or nil if there is none.
+func (r *NamespaceRegistry) Get(namespace string) interface{} {
+	n := &r.root
+	for len(namespace) > 0 {
+		n = n.child(namespace[0])
+		if n == nil || len(namespace) < len(n.fragment) || namespace[:len(n.fragment)] != n.fragment {
+			return nil
+		}
+
+		namespace = namespace[len(n.fragment):]
+	}
+
+	return n.value
+}
+
+// Put stores a value for a namespace, replacing any value already stored. Storing nil removes
+// the namespace from Len() and Walk(), though its nodes are kept.
+func (r *NamespaceRegistry) Put(namespace string, value interface{}) {
+	n := &r.root
+	for len(namespace) > 0 {
+		c := n.child(namespace[0])
+		if c == nil {
+			c = &node{fragment: clone(namespace)}
+			n.addChild(c)
+			n = c
+			break
+		}
+
+		common := commonPrefixLen(namespace, c.fragment)
+		if common < len(c.fragment) {
+			// Split the child at the end of the common prefix.
+			split := &node{fragment: clone(c.fragment[:common]), children: &[]*node{c}}
+			c.fragment = clone(c.fragment[common:])
+			n.replaceChild(c, split)
+			c = split
+		}
+
+		namespace = namespace[common:]
+		n = c
+	}
+
+	if n.value == nil && value != nil {
+		r.size++
+	} else if n.value != nil && value == nil {
+		r.size--
+	}
+	n.value = value
+}
+
+// Len returns the number of namespaces with values.
+func (r *NamespaceRegistry) Len() int {
+	return r.size
+}
+
+// Walk calls f for each namespace with a value, in lexicographic order.
+func (r *NamespaceRegistry) Walk(f func(namespace string, value interface{})) {
+	r.root.walk("", f)
+}
+
+func (n *node) walk(prefix string, f func(string, interface{})) {
+	name := prefix + n.fragment
+	if n.value != nil {
+		f(name, n.value)
+	}
+
+	for _, c := range n.childList() {
+		c.walk(name, f)
+	}
+}
+
+// child returns the child whose fragment starts with b. Children are kept sorted by their first
+// byte, and there are at most 256 of them.
+func (n *node) child(b byte) *node {
+	children := n.childList()
+	lo, hi := 0, len(children)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch c := children[mid].fragment[0]; {
+		case c == b:
+			return children[mid]
+		case c < b:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+
+	return nil
+}
+
+func (n *node) childList() []*node {
+	if n.children == nil {
+		return nil
+	}
+
+	return *n.children
+}
+
+func (n *node) addChild(c *node) {
+	if n.children == nil {
+		n.children = &[]*node{}
+	}
+
+	children := *n.children
+	i := 0
+	for i < len(children) && children[i].fragment[0] < c.fragment[0] {
+		i++
+	}
+
+	children = append(children, nil)
+	copy(children[i+1:], children[i:])
+	children[i] = c
+	*n.children = children
+}
+
+func (n *node) replaceChild(old, c *node) {
+	children := n.childList()
+	for i := range children {
+		if children[i] == old {
+			children[i] = c
+			return
+		}
+	}
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+func clone(s string) string {
+	return string([]byte(s))
+}
@@ -0,0 +1,134 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package trie
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestGetPut(t *testing.T) {
+	r := New()
+	names := []string{"customer.12345.api", "customer.12346.api", "customer.1234", "customer", "other", ""}
+	for i, name := range names {
+		r.Put(name, i)
+	}
+
+	for i, name := range names {
+		if v := r.Get(name); v != i {
+			t.Fatalf("Expecting %v for %v. Was %v", i, name, v)
+		}
+	}
+
+	for _, name := range []string{"customer.123", "customer.12345", "customer.12345.apix", "o", "others"} {
+		if v := r.Get(name); v != nil {
+			t.Fatalf("Expecting nothing for %v. Was %v", name, v)
+		}
+	}
+
+	if r.Len() != len(names) {
+		t.Fatalf("Expecting %v namespaces. Was %v", len(names), r.Len())
+	}
+}
+
+func TestReplaceAndRemove(t *testing.T) {
+	r := New()
+	r.Put("a.b", 1)
+	r.Put("a.b", 2)
+	if v := r.Get("a.b"); v != 2 || r.Len() != 1 {
+		t.Fatalf("Expecting the value to be replaced. Was %v, len %v", v, r.Len())
+	}
+
+	r.Put("a.b", nil)
+	if v := r.Get("a.b"); v != nil || r.Len() != 0 {
+		t.Fatalf("Expecting the value to be removed. Was %v, len %v", v, r.Len())
+	}
+}
+
+func TestWalk(t *testing.T) {
+	r := New()
+	names := []string{"b", "a.2", "a.1", "a", "c.x.y"}
+	for _, name := range names {
+		r.Put(name, name)
+	}
+
+	var walked []string
+	r.Walk(func(name string, v interface{}) {
+		if v != name {
+			t.Fatalf("Expecting value %v for %v. Was %v", name, name, v)
+		}
+		walked = append(walked, name)
+	})
+
+	sort.Strings(names)
+	if fmt.Sprint(walked) != fmt.Sprint(names) {
+		t.Fatalf("Expecting %v in order. Was %v", names, walked)
+	}
+}
+
+// namespaceNames returns n names, 80% of which share a long common prefix.
+func namespaceNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		if i%5 == 0 {
+			names[i] = fmt.Sprintf("%08x.tenant.api", i*2654435761)
+		} else {
+			names[i] = fmt.Sprintf("customer.production.us-east-1.%d.api", i)
+		}
+	}
+
+	return names
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	stats := &runtime.MemStats{}
+	runtime.ReadMemStats(stats)
+	return stats.HeapAlloc
+}
+
+// benchmarkMemory reports the memory used per namespace by a registry of 100,000 namespaces.
+func benchmarkMemory(b *testing.B, build func(names []string) interface{}) {
+	var bytesPerNamespace float64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		before := heapAlloc()
+		// Names are built on the fly and not retained, as when read from configs, so the memory
+		// used includes any names the registry keeps alive.
+		names := namespaceNames(100000)
+		b.StartTimer()
+
+		registry := build(names)
+		names = nil
+
+		b.StopTimer()
+		bytesPerNamespace = float64(heapAlloc()-before) / 100000
+		runtime.KeepAlive(registry)
+		b.StartTimer()
+	}
+
+	b.ReportMetric(bytesPerNamespace, "bytes/namespace")
+}
+
+func BenchmarkMapMemory(b *testing.B) {
+	benchmarkMemory(b, func(names []string) interface{} {
+		m := make(map[string]interface{})
+		for _, name := range names {
+			m[name] = true
+		}
+		return m
+	})
+}
+
+func BenchmarkTrieMemory(b *testing.B) {
+	benchmarkMemory(b, func(names []string) interface{} {
+		r := New()
+		for _, name := range names {
+			r.Put(name, true)
+		}
+		return r
+	})
+}
@@ -0,0 +1,156 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package twolevel implements token buckets that keep a small, local, in-process cache of tokens
+// in front of a remote bucket implementation such as the one in the redis package.
+//
+// Every Take() against a Redis-backed bucket incurs a network round-trip. A TwoLevelBucket instead
+// fetches tokens from the remote bucket in batches of localBatchSize, and serves subsequent
+// requests from its local cache until the batch is exhausted. This amortizes the cost of the
+// round-trip by a factor of localBatchSize.
+//
+// The trade-off is accuracy. Tokens fetched into a local cache are no longer available to other
+// instances of the quota service, even if this instance never uses them. In the worst case, each
+// instance holds up to localBatchSize - 1 unused tokens, and when instances independently refill
+// their caches the effective global rate can approach fillRate × numInstances for short periods,
+// unless the configured fill rate is compensated for the number of instances. Keep localBatchSize
+// small relative to the bucket's size and fill rate, and only use this for high-throughput buckets
+// where the latency saving matters more than strict global accuracy.
+package twolevel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+type bucketFactory struct {
+	delegate       buckets.BucketFactory
+	localBatchSize int64
+}
+
+// NewBucketFactory creates a BucketFactory that wraps buckets created by delegate in a local
+// cache of localBatchSize tokens.
+func NewBucketFactory(delegate buckets.BucketFactory, localBatchSize int64) buckets.BucketFactory {
+	if localBatchSize < 1 {
+		localBatchSize = 1
+	}
+
+	return &bucketFactory{delegate: delegate, localBatchSize: localBatchSize}
+}
+
+func (bf *bucketFactory) Init(cfg *configs.ServiceConfig) {
+	bf.delegate.Init(cfg)
+}
+
+func (bf *bucketFactory) Ready() bool {
+	return bf.delegate.Ready()
+}
+
+func (bf *bucketFactory) ReadyErr() error {
+	return bf.delegate.ReadyErr()
+}
+
+func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	return &TwoLevelBucket{
+		ActivityChannel: buckets.NewActivityChannel(),
+		delegate:        bf.delegate.NewBucket(namespace, bucketName, cfg, dyn),
+		localBatchSize:  bf.localBatchSize}
+}
+
+// TwoLevelBucket serves tokens from a local cache, only going to the delegate bucket when the
+// cache is exhausted. Tokens fetched from the delegate that are only available after a wait are
+// tracked too, so that callers served from the cache wait no less than the delegate asked for.
+type TwoLevelBucket struct {
+	buckets.ActivityChannel
+	delegate       buckets.Bucket
+	localBatchSize int64
+	localTokens    int64
+	availableAt    time.Time
+	sync.Mutex // Embedded mutex
+}
+
+func (b *TwoLevelBucket) Take(numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.localTokens < numTokens {
+		toFetch := b.localBatchSize
+		if shortfall := numTokens - b.localTokens; shortfall > toFetch {
+			toFetch = shortfall
+		}
+
+		w := b.delegate.Take(toFetch, maxWaitTime)
+		if w < 0 {
+			return w
+		}
+
+		b.localTokens += toFetch
+		if avbl := time.Now().Add(w); avbl.After(b.availableAt) {
+			b.availableAt = avbl
+		}
+	}
+
+	waitTime = b.availableAt.Sub(time.Now())
+	if waitTime < 0 {
+		waitTime = 0
+	} else if waitTime > maxWaitTime && maxWaitTime > 0 {
+		return -1
+	}
+
+	b.localTokens -= numTokens
+	return
+}
+
+// AddTokens adds tokens to the delegate bucket. The local cache is unaffected.
+func (b *TwoLevelBucket) AddTokens(numTokens int64) {
+	b.delegate.AddTokens(numTokens)
+}
+
+// Tune tunes the delegate bucket. Tokens already held in the local cache are unaffected.
+func (b *TwoLevelBucket) Tune(cfg *configs.BucketConfig) error {
+	return b.delegate.Tune(cfg)
+}
+
+// Drain drains both the local cache and the delegate bucket. Tokens fetched from the delegate that
+// haven't yet been used are counted as removed.
+func (b *TwoLevelBucket) Drain() (int64, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	removed, err := b.delegate.Drain()
+	if err != nil {
+		return 0, err
+	}
+
+	removed += b.localTokens
+	b.localTokens = 0
+	return removed, nil
+}
+
+// TokenLevelHistory returns the history of the delegate bucket, excluding tokens held in the local
+// cache.
+func (b *TwoLevelBucket) TokenLevelHistory(since time.Time, resolution time.Duration) []buckets.TokenSnapshot {
+	return b.delegate.TokenLevelHistory(since, resolution)
+}
+
+// LocalTokens returns the number of tokens currently held in the local cache.
+func (b *TwoLevelBucket) LocalTokens() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.localTokens
+}
+
+func (b *TwoLevelBucket) Config() *configs.BucketConfig {
+	return b.delegate.Config()
+}
+
+func (b *TwoLevelBucket) Dynamic() bool {
+	return b.delegate.Dynamic()
+}
+
+func (b *TwoLevelBucket) Destroy() {
+	b.delegate.Destroy()
+}
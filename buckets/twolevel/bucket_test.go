@@ -0,0 +1,135 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package twolevel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// remoteBucketFactory simulates a remote backend, such as Redis, by adding latency to each Take()
+// on buckets created by a memory.BucketFactory. It also counts round-trips.
+type remoteBucketFactory struct {
+	buckets.BucketFactory
+	latency    time.Duration
+	roundTrips int64
+}
+
+func (bf *remoteBucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	return &remoteBucket{bf.BucketFactory.NewBucket(namespace, bucketName, cfg, dyn), bf}
+}
+
+type remoteBucket struct {
+	buckets.Bucket
+	factory *remoteBucketFactory
+}
+
+func (b *remoteBucket) Take(numTokens int64, maxWaitTime time.Duration) time.Duration {
+	atomic.AddInt64(&b.factory.roundTrips, 1)
+	time.Sleep(b.factory.latency)
+	return b.Bucket.Take(numTokens, maxWaitTime)
+}
+
+func newRemoteBucketFactory(latency time.Duration) *remoteBucketFactory {
+	bf := &remoteBucketFactory{BucketFactory: memory.NewBucketFactory(), latency: latency}
+	bf.Init(configs.NewDefaultServiceConfig())
+	return bf
+}
+
+func TestBatching(t *testing.T) {
+	remote := newRemoteBucketFactory(0)
+	b := NewBucketFactory(remote, 10).NewBucket("n", "b", configs.NewDefaultBucketConfig(), false)
+	defer b.Destroy()
+
+	for i := 0; i < 25; i++ {
+		if w := b.Take(1, 0); w != 0 {
+			t.Fatalf("Expecting 0 wait. Was %v", w)
+		}
+	}
+
+	if remote.roundTrips != 3 {
+		t.Fatalf("Expecting 3 round-trips to the delegate. Was %v", remote.roundTrips)
+	}
+
+	if l := b.(*TwoLevelBucket).LocalTokens(); l != 5 {
+		t.Fatalf("Expecting 5 tokens cached locally. Was %v", l)
+	}
+}
+
+func TestRequestLargerThanBatch(t *testing.T) {
+	remote := newRemoteBucketFactory(0)
+	b := NewBucketFactory(remote, 10).NewBucket("n", "b", configs.NewDefaultBucketConfig(), false)
+	defer b.Destroy()
+
+	if w := b.Take(30, 0); w != 0 {
+		t.Fatalf("Expecting 0 wait. Was %v", w)
+	}
+
+	if l := b.(*TwoLevelBucket).LocalTokens(); l != 0 {
+		t.Fatalf("Expecting no tokens cached locally. Was %v", l)
+	}
+}
+
+func TestDelegateRejection(t *testing.T) {
+	remote := newRemoteBucketFactory(0)
+	b := NewBucketFactory(remote, 10).NewBucket("n", "b", configs.NewDefaultBucketConfig(), false)
+	defer b.Destroy()
+
+	// Drain the delegate, and go into debt.
+	b.Take(100, 0)
+	b.Take(10, 0)
+
+	if w := b.Take(10, time.Nanosecond); w > -1 {
+		t.Fatalf("Expecting negative wait time. Was %v", w)
+	}
+
+	if l := b.(*TwoLevelBucket).LocalTokens(); l != 0 {
+		t.Fatalf("Rejected requests should not change the local cache. Was %v", l)
+	}
+}
+
+func TestWaitIsHonouredForCachedTokens(t *testing.T) {
+	remote := newRemoteBucketFactory(0)
+	b := NewBucketFactory(remote, 10).NewBucket("n", "b", configs.NewDefaultBucketConfig(), false)
+	defer b.Destroy()
+
+	b.Take(100, 0)
+	b.Take(10, 0)
+
+	// Tokens fetched from the delegate now are only available in the future.
+	if w := b.Take(1, 0); w < 1 {
+		t.Fatalf("Expecting positive wait time. Was %v", w)
+	}
+
+	// ... so tokens served from the cache must be waited for too.
+	if w := b.Take(1, 0); w < 1 {
+		t.Fatalf("Expecting positive wait time. Was %v", w)
+	}
+}
+
+func benchmarkTake(b *testing.B, bf buckets.BucketFactory) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.Size = 1e12
+	cfg.FillRate = 1e9
+	bucket := bf.NewBucket("n", "b", cfg, false)
+	defer bucket.Destroy()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bucket.Take(1, 0)
+	}
+}
+
+func BenchmarkTakeWithoutCaching(b *testing.B) {
+	benchmarkTake(b, newRemoteBucketFactory(100*time.Microsecond))
+}
+
+func BenchmarkTakeWithCaching(b *testing.B) {
+	benchmarkTake(b, NewBucketFactory(newRemoteBucketFactory(100*time.Microsecond), 100))
+}
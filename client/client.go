@@ -0,0 +1,352 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package client implements a client of the quota service that spreads requests across several
+// instances, preferring the healthiest.
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice/logging"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// DefaultAttemptTimeout bounds each attempt to call an endpoint, including health checks, unless
+// overridden using WithAttemptTimeout().
+const DefaultAttemptTimeout = time.Second
+
+var ErrNoHealthyEndpoints = errors.New("No healthy endpoints")
+
+// Client sends Allow requests to the quota service endpoint that responded fastest to its last
+// health check, failing over to the next fastest if the call fails.
+type Client struct {
+	endpoints      []*endpoint
+	attemptTimeout time.Duration
+	hedgingDelay   time.Duration
+	// Healthy endpoints, fastest first.
+	ranked   []*endpoint
+	stop     chan struct{}
+	stopOnce sync.Once
+	sync.RWMutex
+}
+
+type endpoint struct {
+	addr    string
+	conn    *grpc.ClientConn
+	client  qspb.QuotaServiceClient
+	healthy bool
+	latency time.Duration
+}
+
+// NewHealthAwareClient creates a client of the quota service instances listening on endpoints, in
+// the form "host:port". Every endpoint is health checked before this function returns, and again
+// every checkInterval until the client is closed.
+func NewHealthAwareClient(endpoints []string, checkInterval time.Duration) *Client {
+	if len(endpoints) == 0 {
+		panic("At least one endpoint is required")
+	}
+
+	if checkInterval <= 0 {
+		panic(fmt.Sprintf("Check interval should be positive, but is %v", checkInterval))
+	}
+
+	c := &Client{attemptTimeout: DefaultAttemptTimeout, stop: make(chan struct{})}
+	for _, addr := range endpoints {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			panic(fmt.Sprintf("Unable to connect to %v. Error %v", addr, err))
+		}
+
+		c.endpoints = append(c.endpoints, &endpoint{
+			addr:   addr,
+			conn:   conn,
+			client: qspb.NewQuotaServiceClient(conn)})
+	}
+
+	c.checkHealth()
+	go c.checkHealthEvery(checkInterval)
+	return c
+}
+
+// WithAttemptTimeout bounds each attempt to call an endpoint to timeout, after which the next
+// endpoint is tried. Since requests are allowed to wait for tokens on the server, timeout should
+// exceed the longest wait configured.
+func (c *Client) WithAttemptTimeout(timeout time.Duration) *Client {
+	c.Lock()
+	defer c.Unlock()
+	c.attemptTimeout = timeout
+	return c
+}
+
+// WithHedging sends each Allow request to the second fastest healthy endpoint as well, if the
+// fastest hasn't responded after delay. The first response is used, and any tokens granted to the
+// other request are returned using the ReturnTokens RPC once it completes.
+func (c *Client) WithHedging(delay time.Duration) *Client {
+	if delay <= 0 {
+		panic(fmt.Sprintf("Hedging delay should be positive, but is %v", delay))
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.hedgingDelay = delay
+	return c
+}
+
+// Allow sends req to the fastest healthy endpoint. If the endpoint is unavailable, or doesn't
+// respond in time, it is considered unhealthy until its next health check, and the next fastest is
+// tried. Returns ErrNoHealthyEndpoints if no endpoint is healthy.
+func (c *Client) Allow(ctx context.Context, req *qspb.AllowRequest) (*qspb.AllowResponse, error) {
+	c.RLock()
+	ranked, timeout, hedgingDelay := c.ranked, c.attemptTimeout, c.hedgingDelay
+	c.RUnlock()
+
+	if hedgingDelay > 0 && len(ranked) > 1 {
+		rsp, err := c.allowHedged(ctx, req, ranked[0], ranked[1], timeout, hedgingDelay)
+		if err == nil || ctx.Err() != nil || !shouldFailOver(err) {
+			return rsp, err
+		}
+
+		ranked = ranked[2:]
+	}
+
+	for _, e := range ranked {
+		rsp, err := c.attempt(ctx, e, req, timeout)
+		if err == nil || ctx.Err() != nil || !shouldFailOver(err) {
+			return rsp, err
+		}
+	}
+
+	return nil, ErrNoHealthyEndpoints
+}
+
+type attemptResult struct {
+	e   *endpoint
+	rsp *qspb.AllowResponse
+	err error
+}
+
+// allowHedged sends req to primary, and also to backup if primary hasn't responded after delay.
+// The first successful response is returned. Attempts aren't cancelled once sent, since a server may
+// grant tokens before noticing the cancellation. Tokens granted to attempts whose responses aren't
+// used are returned instead.
+func (c *Client) allowHedged(ctx context.Context, req *qspb.AllowRequest, primary, backup *endpoint, timeout, delay time.Duration) (*qspb.AllowResponse, error) {
+	// Buffered, so that the losing attempt never blocks.
+	results := make(chan attemptResult, 2)
+	send := func(e *endpoint) {
+		rsp, err := c.attempt(detached{ctx}, e, req, timeout)
+		results <- attemptResult{e, rsp, err}
+	}
+
+	go send(primary)
+	inFlight, hedged := 1, false
+	hedge := time.NewTimer(delay)
+	defer hedge.Stop()
+
+	var last attemptResult
+	for inFlight > 0 {
+		select {
+		case <-hedge.C:
+			if !hedged {
+				go send(backup)
+				inFlight, hedged = inFlight+1, true
+			}
+			continue
+		case last = <-results:
+			inFlight--
+		case <-ctx.Done():
+			go c.returnLosingGrants(results, inFlight, req, timeout)
+			return nil, ctx.Err()
+		}
+
+		if last.err != nil {
+			if !hedged && shouldFailOver(last.err) {
+				// The primary failed before the hedge was sent. Send it now.
+				go send(backup)
+				inFlight, hedged = inFlight+1, true
+			}
+			continue
+		}
+
+		if inFlight > 0 {
+			go c.returnLosingGrants(results, inFlight, req, timeout)
+		}
+		return last.rsp, nil
+	}
+
+	return nil, last.err
+}
+
+// returnLosingGrants waits for the n attempts of a hedged request whose responses aren't used, and
+// returns any tokens they were granted.
+func (c *Client) returnLosingGrants(results <-chan attemptResult, n int, req *qspb.AllowRequest, timeout time.Duration) {
+	for i := 0; i < n; i++ {
+		loser := <-results
+		if loser.err != nil || loser.rsp.GetNumTokensGranted() < 1 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := loser.e.client.ReturnTokens(ctx, &qspb.ReturnTokensRequest{
+			Namespace:     req.Namespace,
+			Name:          req.Name,
+			Tokens:        proto.Int64(loser.rsp.GetNumTokensGranted()),
+			OperationType: req.OperationType})
+		cancel()
+
+		if err != nil {
+			logging.Printf("Unable to return %v tokens to quota service endpoint %v. Error %v",
+				loser.rsp.GetNumTokensGranted(), loser.e.addr, err)
+		}
+	}
+}
+
+// detached carries the values of its context, such as outgoing metadata, but is never done.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// attempt sends req to an endpoint. If it fails, and another endpoint might serve the request, the
+// endpoint is considered unhealthy until its next health check.
+func (c *Client) attempt(ctx context.Context, e *endpoint, req *qspb.AllowRequest, timeout time.Duration) (*qspb.AllowResponse, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	rsp, err := e.client.Allow(attemptCtx, req)
+	cancel()
+
+	if err != nil && ctx.Err() == nil && shouldFailOver(err) {
+		logging.Printf("Quota service endpoint %v failed, failing over. Error %v", e.addr, err)
+		c.unhealthy(e)
+	}
+
+	return rsp, err
+}
+
+// shouldFailOver returns true if err means the endpoint failed, so another might serve the request.
+func shouldFailOver(err error) bool {
+	switch grpc.Code(err) {
+	// Broken connections are reported as internal errors.
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// Endpoints returns the healthy endpoints, fastest first.
+func (c *Client) Endpoints() []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	addrs := make([]string, len(c.ranked))
+	for i, e := range c.ranked {
+		addrs[i] = e.addr
+	}
+
+	return addrs
+}
+
+// Close stops health checks, and closes the connections to all endpoints.
+func (c *Client) Close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		for _, e := range c.endpoints {
+			e.conn.Close()
+		}
+	})
+}
+
+func (c *Client) checkHealthEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.checkHealth()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// checkHealth health checks all endpoints in parallel, and ranks the healthy ones by latency.
+func (c *Client) checkHealth() {
+	c.RLock()
+	timeout := c.attemptTimeout
+	c.RUnlock()
+
+	type result struct {
+		healthy bool
+		latency time.Duration
+	}
+
+	results := make([]result, len(c.endpoints))
+	var wg sync.WaitGroup
+	for i, e := range c.endpoints {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			start := time.Now()
+			rsp, err := e.client.HealthCheck(ctx, &qspb.HealthCheckRequest{})
+			results[i] = result{err == nil && rsp.GetHealthy(), time.Since(start)}
+		}(i, e)
+	}
+	wg.Wait()
+
+	c.Lock()
+	defer c.Unlock()
+	for i, e := range c.endpoints {
+		e.healthy, e.latency = results[i].healthy, results[i].latency
+	}
+	c.rank()
+}
+
+// unhealthy stops requests being sent to an endpoint until its next health check.
+func (c *Client) unhealthy(e *endpoint) {
+	c.Lock()
+	defer c.Unlock()
+	e.healthy = false
+	c.rank()
+}
+
+// rank orders the healthy endpoints by latency. Must be called with the lock held.
+func (c *Client) rank() {
+	ranked := make([]*endpoint, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		if e.healthy {
+			ranked = append(ranked, e)
+		}
+	}
+
+	sort.Stable(byLatency(ranked))
+	c.ranked = ranked
+}
+
+type byLatency []*endpoint
+
+func (b byLatency) Len() int {
+	return len(b)
+}
+
+func (b byLatency) Less(i, j int) bool {
+	return b[i].latency < b[j].latency
+}
+
+func (b byLatency) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
@@ -0,0 +1,98 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"github.com/maniksurtani/quotaservice/testing/mockserver"
+	"golang.org/x/net/context"
+)
+
+var req = &qspb.AllowRequest{
+	Namespace: proto.String("n"),
+	Name:      proto.String("b")}
+
+// newMockServers starts mock servers responding to health checks after each of latencies.
+func newMockServers(t *testing.T, latencies ...time.Duration) ([]*mockserver.MockServer, []string) {
+	servers := make([]*mockserver.MockServer, len(latencies))
+	addrs := make([]string, len(latencies))
+	for i, latency := range latencies {
+		servers[i] = mockserver.NewMockServer(t)
+		servers[i].SetHealthCheckLatency(latency)
+		addrs[i] = servers[i].Addr()
+	}
+
+	return servers, addrs
+}
+
+func expectAllowedBy(t *testing.T, c *Client, m *mockserver.MockServer) {
+	before := m.AllCallCount("n", "b")
+	rsp, err := c.Allow(context.TODO(), req)
+	if err != nil || rsp.GetStatus() != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting status OK. Was %v, %v", rsp, err)
+	}
+
+	if calls := m.AllCallCount("n", "b"); calls != before+1 {
+		t.Fatalf("Expecting the request to be sent to %v.", m.Addr())
+	}
+}
+
+func TestRoutesToFastestEndpoint(t *testing.T) {
+	servers, addrs := newMockServers(t, 100*time.Millisecond, 0, 50*time.Millisecond)
+	c := NewHealthAwareClient(addrs, time.Hour)
+	defer c.Close()
+
+	expected := []string{addrs[1], addrs[2], addrs[0]}
+	if endpoints := c.Endpoints(); !reflect.DeepEqual(endpoints, expected) {
+		t.Fatalf("Expecting endpoints ranked %v. Were %v", expected, endpoints)
+	}
+
+	expectAllowedBy(t, c, servers[1])
+}
+
+func TestSkipsUnhealthyEndpoint(t *testing.T) {
+	servers, addrs := newMockServers(t, 0, 50*time.Millisecond)
+	c := NewHealthAwareClient(addrs, 10*time.Millisecond)
+	defer c.Close()
+	expectAllowedBy(t, c, servers[0])
+
+	servers[0].SetHealthy(false)
+	for deadline := time.Now().Add(5 * time.Second); len(c.Endpoints()) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting the unhealthy endpoint to be skipped. Endpoints were %v", c.Endpoints())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	expectAllowedBy(t, c, servers[1])
+}
+
+func TestFailsOverWhenEndpointFails(t *testing.T) {
+	servers, addrs := newMockServers(t, 0, 50*time.Millisecond)
+	c := NewHealthAwareClient(addrs, time.Hour).WithAttemptTimeout(200 * time.Millisecond)
+	defer c.Close()
+
+	servers[0].Stop()
+	expectAllowedBy(t, c, servers[1])
+
+	if endpoints := c.Endpoints(); !reflect.DeepEqual(endpoints, []string{addrs[1]}) {
+		t.Fatalf("Expecting the failed endpoint to be considered unhealthy. Endpoints were %v", endpoints)
+	}
+}
+
+func TestNoHealthyEndpoints(t *testing.T) {
+	servers, addrs := newMockServers(t, 0)
+	servers[0].SetHealthy(false)
+	c := NewHealthAwareClient(addrs, time.Hour)
+	defer c.Close()
+
+	if _, err := c.Allow(context.TODO(), req); err != ErrNoHealthyEndpoints {
+		t.Fatalf("Expecting ErrNoHealthyEndpoints. Was %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"github.com/maniksurtani/quotaservice/testing/mockserver"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// fakeEndpoint grants all tokens requested after its latency, even if the request is cancelled in
+// the meantime, like a server that grants tokens before noticing the cancellation.
+type fakeEndpoint struct {
+	latency  time.Duration
+	allows   int32
+	returned int64
+}
+
+func (f *fakeEndpoint) Allow(ctx context.Context, in *qspb.AllowRequest, opts ...grpc.CallOption) (*qspb.AllowResponse, error) {
+	atomic.AddInt32(&f.allows, 1)
+	time.Sleep(f.latency)
+	status := qspb.AllowResponse_OK
+	return &qspb.AllowResponse{Status: &status, NumTokensGranted: proto.Int64(in.GetNumTokensRequested())}, nil
+}
+
+func (f *fakeEndpoint) HealthCheck(ctx context.Context, in *qspb.HealthCheckRequest, opts ...grpc.CallOption) (*qspb.HealthCheckResponse, error) {
+	return &qspb.HealthCheckResponse{Healthy: proto.Bool(true)}, nil
+}
+
+func (f *fakeEndpoint) ReturnTokens(ctx context.Context, in *qspb.ReturnTokensRequest, opts ...grpc.CallOption) (*qspb.ReturnTokensResponse, error) {
+	atomic.AddInt64(&f.returned, in.GetTokens())
+	return &qspb.ReturnTokensResponse{}, nil
+}
+
+func (f *fakeEndpoint) ReplicateGrant(ctx context.Context, in *qspb.ReplicateGrantRequest, opts ...grpc.CallOption) (*qspb.ReplicateGrantResponse, error) {
+	return &qspb.ReplicateGrantResponse{}, nil
+}
+
+// newHedgingClient creates a client of fake endpoints, ranked in the order given, without running
+// health checks.
+func newHedgingClient(delay time.Duration, fakes ...*fakeEndpoint) *Client {
+	c := &Client{attemptTimeout: DefaultAttemptTimeout, stop: make(chan struct{})}
+	for i, f := range fakes {
+		c.endpoints = append(c.endpoints, &endpoint{
+			addr:    fmt.Sprintf("fake-%v", i),
+			client:  f,
+			healthy: true,
+			latency: time.Duration(i)})
+	}
+	c.rank()
+	return c.WithHedging(delay)
+}
+
+var hedgedReq = &qspb.AllowRequest{
+	Namespace:          proto.String("n"),
+	Name:               proto.String("b"),
+	NumTokensRequested: proto.Int64(5)}
+
+func TestHedgeSentAfterDelay(t *testing.T) {
+	primary, backup := &fakeEndpoint{latency: time.Second}, &fakeEndpoint{}
+	c := newHedgingClient(50*time.Millisecond, primary, backup)
+
+	start := time.Now()
+	rsp, err := c.Allow(context.TODO(), hedgedReq)
+	if err != nil || rsp.GetNumTokensGranted() != 5 {
+		t.Fatalf("Expecting 5 tokens granted. Was %v, %v", rsp, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("Expecting the hedge to be sent after 50ms, and respond first. Took %v", elapsed)
+	}
+
+	if allows := atomic.LoadInt32(&backup.allows); allows != 1 {
+		t.Fatalf("Expecting the hedge to be sent. Backup was called %v times", allows)
+	}
+}
+
+func TestFastPrimaryCancelsHedge(t *testing.T) {
+	primary, backup := &fakeEndpoint{}, &fakeEndpoint{}
+	c := newHedgingClient(50*time.Millisecond, primary, backup)
+
+	rsp, err := c.Allow(context.TODO(), hedgedReq)
+	if err != nil || rsp.GetNumTokensGranted() != 5 {
+		t.Fatalf("Expecting 5 tokens granted. Was %v, %v", rsp, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if allows := atomic.LoadInt32(&backup.allows); allows != 0 {
+		t.Fatalf("Not expecting the hedge to be sent. Backup was called %v times", allows)
+	}
+}
+
+func TestDoubleGrantReturned(t *testing.T) {
+	primary, backup := &fakeEndpoint{latency: 100 * time.Millisecond}, &fakeEndpoint{}
+	c := newHedgingClient(10*time.Millisecond, primary, backup)
+
+	rsp, err := c.Allow(context.TODO(), hedgedReq)
+	if err != nil || rsp.GetNumTokensGranted() != 5 {
+		t.Fatalf("Expecting 5 tokens granted. Was %v, %v", rsp, err)
+	}
+
+	// The primary also grants tokens, which are returned since the hedge's response was used.
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&primary.returned) != 5; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting the primary's 5 tokens to be returned. Were %v", atomic.LoadInt64(&primary.returned))
+		}
+	}
+
+	if returned := atomic.LoadInt64(&backup.returned); returned != 0 {
+		t.Fatalf("Not expecting the hedge's tokens to be returned. Were %v", returned)
+	}
+}
+
+func TestLosingGrantReturnedByServer(t *testing.T) {
+	servers, addrs := newMockServers(t, 0, 50*time.Millisecond)
+	servers[0].OnAllow("n", "b", func(req *qspb.AllowRequest) *qspb.AllowResponse {
+		time.Sleep(200 * time.Millisecond)
+		return mockserver.Granted(0)(req)
+	})
+	c := NewHealthAwareClient(addrs, time.Hour).WithHedging(10 * time.Millisecond)
+	defer c.Close()
+
+	rsp, err := c.Allow(context.TODO(), hedgedReq)
+	if err != nil || rsp.GetNumTokensGranted() != 5 {
+		t.Fatalf("Expecting 5 tokens granted. Was %v, %v", rsp, err)
+	}
+
+	// The slow primary still completes, and its tokens are returned.
+	for deadline := time.Now().Add(5 * time.Second); servers[0].ReturnedTokens("n", "b") != 5; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting the primary's 5 tokens to be returned. Were %v", servers[0].ReturnedTokens("n", "b"))
+		}
+	}
+
+	if returned := servers[1].ReturnedTokens("n", "b"); returned != 0 {
+		t.Fatalf("Not expecting the hedge's tokens to be returned. Were %v", returned)
+	}
+}
@@ -0,0 +1,302 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package builder implements a fluent DSL for building configs.ServiceConfig programmatically.
+// For example:
+//
+//	cfg, err := builder.NewServiceConfig().
+//	    AddNamespace("api", func(ns *builder.NamespaceBuilder) {
+//	        ns.WithFillRate(100).WithSize(1000).WithDynamicBuckets(50, builder.MaxIdleMillis(30000))
+//	    }).
+//	    Build()
+//
+// Arguments are validated as soon as each builder method is called, and the first invalid
+// argument is reported by Build().
+package builder
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// BucketOption sets a value on a bucket configuration, returning an error if the value is invalid.
+type BucketOption func(b *configs.BucketConfig) error
+
+// Size sets the maximum number of tokens a bucket holds.
+func Size(size int64) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		if size < 1 {
+			return fmt.Errorf("size should be positive, but is %v", size)
+		}
+		b.Size = size
+		return nil
+	}
+}
+
+// FillRate sets the number of tokens added to a bucket per second.
+func FillRate(fillRate int64) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		if fillRate < 1 {
+			return fmt.Errorf("fill rate should be positive, but is %v", fillRate)
+		}
+		b.FillRate = fillRate
+		return nil
+	}
+}
+
+// WaitTimeoutMillis sets the maximum time a caller is allowed to wait for tokens.
+func WaitTimeoutMillis(millis int64) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		if millis < 1 {
+			return fmt.Errorf("wait timeout should be positive, but is %v", millis)
+		}
+		b.WaitTimeoutMillis = millis
+		return nil
+	}
+}
+
+// MaxIdleMillis sets how long a bucket may be idle before it is removed. Set to -1 to never remove
+// idle buckets.
+func MaxIdleMillis(millis int64) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		if millis < 1 && millis != -1 {
+			return fmt.Errorf("max idle millis should be positive or -1, but is %v", millis)
+		}
+		b.MaxIdleMillis = millis
+		return nil
+	}
+}
+
+// MaxDebtMillis sets how far into the future tokens may be borrowed from.
+func MaxDebtMillis(millis int64) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		if millis < 1 {
+			return fmt.Errorf("max debt millis should be positive, but is %v", millis)
+		}
+		b.MaxDebtMillis = millis
+		return nil
+	}
+}
+
+// WarmupRampDurationMs sets how long a new bucket's fill rate takes to ramp up.
+func WarmupRampDurationMs(millis int64) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		if millis < 0 {
+			return fmt.Errorf("warmup ramp duration should not be negative, but is %v", millis)
+		}
+		b.WarmupRampDurationMs = millis
+		return nil
+	}
+}
+
+// TrafficShaping enables or disables spreading grants evenly over time.
+func TrafficShaping(enabled bool) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		b.TrafficShaping = enabled
+		return nil
+	}
+}
+
+// OperationCost sets the number of tokens an operation type costs.
+func OperationCost(operationType string, cost int64) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		if cost < 0 {
+			return fmt.Errorf("cost of %v should not be negative, but is %v", operationType, cost)
+		}
+		if b.OperationCosts == nil {
+			b.OperationCosts = make(map[string]int64)
+		}
+		b.OperationCosts[operationType] = cost
+		return nil
+	}
+}
+
+// FallbackChain sets the fully qualified names of buckets to try, in order, when a bucket has no
+// tokens available.
+func FallbackChain(fqns ...string) BucketOption {
+	return func(b *configs.BucketConfig) error {
+		for _, fqn := range fqns {
+			if _, _, ok := configs.SplitFullyQualifiedName(fqn); !ok {
+				return fmt.Errorf("fallback %v is not of the form namespace:bucket", fqn)
+			}
+		}
+		b.FallbackChain = fqns
+		return nil
+	}
+}
+
+// ServiceConfigBuilder builds a configs.ServiceConfig.
+type ServiceConfigBuilder struct {
+	cfg        *configs.ServiceConfig
+	namespaces []*NamespaceBuilder
+	err        error
+}
+
+// NewServiceConfig creates a builder for a configuration with metrics enabled, and no global
+// default bucket.
+func NewServiceConfig() *ServiceConfigBuilder {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = nil
+	return &ServiceConfigBuilder{cfg: cfg}
+}
+
+// WithMetricsEnabled enables or disables metrics.
+func (sb *ServiceConfigBuilder) WithMetricsEnabled(enabled bool) *ServiceConfigBuilder {
+	sb.cfg.MetricsEnabled = enabled
+	return sb
+}
+
+// WithGlobalDefaultBucket adds a global default bucket, used for requests against namespaces that
+// don't exist.
+func (sb *ServiceConfigBuilder) WithGlobalDefaultBucket(opts ...BucketOption) *ServiceConfigBuilder {
+	sb.cfg.GlobalDefaultBucket = sb.newBucket(opts)
+	return sb
+}
+
+// AddNamespace adds a namespace, configured by fn.
+func (sb *ServiceConfigBuilder) AddNamespace(name string, fn func(ns *NamespaceBuilder)) *ServiceConfigBuilder {
+	if name == "" {
+		sb.setErr(errors.New("namespace name should not be empty"))
+		return sb
+	}
+
+	if sb.cfg.Namespaces[name] != nil {
+		sb.setErr(fmt.Errorf("namespace %v has already been added", name))
+		return sb
+	}
+
+	ns := &NamespaceBuilder{parent: sb, cfg: configs.NewDefaultNamespaceConfig(), bucketDefaults: &configs.BucketConfig{}}
+	sb.cfg.Namespaces[name] = ns.cfg
+	sb.namespaces = append(sb.namespaces, ns)
+	if fn != nil {
+		fn(ns)
+	}
+	return sb
+}
+
+// Build returns the configuration built, with defaults applied, or the first error encountered
+// while building it.
+func (sb *ServiceConfigBuilder) Build() (*configs.ServiceConfig, error) {
+	if sb.err != nil {
+		return nil, sb.err
+	}
+
+	for _, ns := range sb.namespaces {
+		ns.applyBucketDefaults()
+	}
+
+	if err := sb.cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return configs.ApplyDefaults(sb.cfg), nil
+}
+
+func (sb *ServiceConfigBuilder) setErr(err error) {
+	if sb.err == nil {
+		sb.err = err
+	}
+}
+
+func (sb *ServiceConfigBuilder) newBucket(opts []BucketOption) *configs.BucketConfig {
+	b := &configs.BucketConfig{}
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			sb.setErr(err)
+		}
+	}
+	return b
+}
+
+// NamespaceBuilder builds a configs.NamespaceConfig. Values set using WithSize() and
+// WithFillRate() apply to all buckets in the namespace that don't set them explicitly.
+type NamespaceBuilder struct {
+	parent         *ServiceConfigBuilder
+	cfg            *configs.NamespaceConfig
+	bucketDefaults *configs.BucketConfig
+}
+
+// WithSize sets the size of all buckets in the namespace that don't set their own.
+func (nb *NamespaceBuilder) WithSize(size int64) *NamespaceBuilder {
+	nb.apply(nb.bucketDefaults, Size(size))
+	return nb
+}
+
+// WithFillRate sets the fill rate of all buckets in the namespace that don't set their own.
+func (nb *NamespaceBuilder) WithFillRate(fillRate int64) *NamespaceBuilder {
+	nb.apply(nb.bucketDefaults, FillRate(fillRate))
+	return nb
+}
+
+// WithDefaultBucket adds a default bucket, used for requests against buckets that don't exist.
+func (nb *NamespaceBuilder) WithDefaultBucket(opts ...BucketOption) *NamespaceBuilder {
+	nb.cfg.DefaultBucket = nb.parent.newBucket(opts)
+	return nb
+}
+
+// WithDynamicBuckets allows up to maxDynamicBuckets buckets to be created on demand, using a
+// template configured by opts. Set maxDynamicBuckets to 0 to allow an unlimited number.
+func (nb *NamespaceBuilder) WithDynamicBuckets(maxDynamicBuckets int, opts ...BucketOption) *NamespaceBuilder {
+	if maxDynamicBuckets < 0 {
+		nb.parent.setErr(fmt.Errorf("max dynamic buckets should not be negative, but is %v", maxDynamicBuckets))
+	}
+	nb.cfg.MaxDynamicBuckets = maxDynamicBuckets
+	nb.cfg.DynamicBucketTemplate = nb.parent.newBucket(opts)
+	return nb
+}
+
+// WithBucket adds a named bucket.
+func (nb *NamespaceBuilder) WithBucket(name string, opts ...BucketOption) *NamespaceBuilder {
+	if name == "" {
+		nb.parent.setErr(errors.New("bucket name should not be empty"))
+	}
+	nb.cfg.Buckets[name] = nb.parent.newBucket(opts)
+	return nb
+}
+
+// WithAggregateBucket adds a bucket that limits all requests made against the namespace.
+func (nb *NamespaceBuilder) WithAggregateBucket(opts ...BucketOption) *NamespaceBuilder {
+	nb.cfg.AggregateBucket = nb.parent.newBucket(opts)
+	return nb
+}
+
+// WithParent sets the namespace's parent namespace.
+func (nb *NamespaceBuilder) WithParent(parent string) *NamespaceBuilder {
+	nb.cfg.Parent = parent
+	return nb
+}
+
+// AcceptDonationsFrom allows the given namespaces to donate tokens to this namespace.
+func (nb *NamespaceBuilder) AcceptDonationsFrom(namespaces ...string) *NamespaceBuilder {
+	nb.cfg.AcceptDonationsFrom = append(nb.cfg.AcceptDonationsFrom, namespaces...)
+	return nb
+}
+
+func (nb *NamespaceBuilder) apply(b *configs.BucketConfig, opt BucketOption) {
+	if err := opt(b); err != nil {
+		nb.parent.setErr(err)
+	}
+}
+
+func (nb *NamespaceBuilder) applyBucketDefaults() {
+	all := []*configs.BucketConfig{nb.cfg.DefaultBucket, nb.cfg.DynamicBucketTemplate, nb.cfg.AggregateBucket}
+	for _, b := range nb.cfg.Buckets {
+		all = append(all, b)
+	}
+
+	for _, b := range all {
+		if b == nil {
+			continue
+		}
+
+		if b.Size == 0 {
+			b.Size = nb.bucketDefaults.Size
+		}
+
+		if b.FillRate == 0 {
+			b.FillRate = nb.bucketDefaults.FillRate
+		}
+	}
+}
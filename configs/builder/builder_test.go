@@ -0,0 +1,124 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package builder
+
+import (
+	"testing"
+
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+func TestBuildComplexConfig(t *testing.T) {
+	cfg, err := NewServiceConfig().
+		WithMetricsEnabled(false).
+		WithGlobalDefaultBucket(Size(10), FillRate(5)).
+		AddNamespace("api", func(ns *NamespaceBuilder) {
+			ns.WithFillRate(100).WithSize(1000).WithDynamicBuckets(50, MaxIdleMillis(30000))
+		}).
+		AddNamespace("db", func(ns *NamespaceBuilder) {
+			ns.WithDefaultBucket(FillRate(20)).
+				WithBucket("reads", FillRate(500), Size(2000), WaitTimeoutMillis(100)).
+				WithBucket("writes", FillRate(50), TrafficShaping(true)).
+				WithAggregateBucket(Size(5000), FillRate(1000)).
+				AcceptDonationsFrom("api")
+		}).
+		AddNamespace("db.child", func(ns *NamespaceBuilder) {
+			ns.WithParent("db")
+		}).
+		Build()
+
+	if err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	if cfg.MetricsEnabled {
+		t.Fatal("Metrics should not be enabled")
+	}
+
+	assertBucket(t, cfg.GlobalDefaultBucket, 10, 5)
+
+	if len(cfg.Namespaces) != 3 {
+		t.Fatalf("Expecting 3 namespaces. Was %v", len(cfg.Namespaces))
+	}
+
+	api := cfg.Namespaces["api"]
+	if api.MaxDynamicBuckets != 50 || api.DefaultBucket != nil {
+		t.Fatalf("Expecting 50 dynamic buckets and no default bucket. Was %+v", api)
+	}
+	assertBucket(t, api.DynamicBucketTemplate, 1000, 100)
+	if api.DynamicBucketTemplate.MaxIdleMillis != 30000 {
+		t.Fatalf("Expecting max idle millis of 30000. Was %v", api.DynamicBucketTemplate.MaxIdleMillis)
+	}
+
+	db := cfg.Namespaces["db"]
+	assertBucket(t, db.DefaultBucket, 100, 20)
+	assertBucket(t, db.Buckets["reads"], 2000, 500)
+	assertBucket(t, db.Buckets["writes"], 100, 50)
+	assertBucket(t, db.AggregateBucket, 5000, 1000)
+	if db.Buckets["reads"].WaitTimeoutMillis != 100 || !db.Buckets["writes"].TrafficShaping {
+		t.Fatalf("Unexpected bucket configs %+v", db.Buckets)
+	}
+
+	if len(db.AcceptDonationsFrom) != 1 || db.AcceptDonationsFrom[0] != "api" {
+		t.Fatalf("Expecting donations from api. Was %v", db.AcceptDonationsFrom)
+	}
+
+	if cfg.Namespaces["db.child"].Parent != "db" {
+		t.Fatalf("Expecting parent db. Was %v", cfg.Namespaces["db.child"].Parent)
+	}
+}
+
+func assertBucket(t *testing.T, b *configs.BucketConfig, size, fillRate int64) {
+	if b == nil {
+		t.Fatal("Bucket doesn't exist")
+	}
+
+	if b.Size != size {
+		t.Fatalf("Expected bucket size of %v; was %v", size, b.Size)
+	}
+
+	if b.FillRate != fillRate {
+		t.Fatalf("Expected fill_rate of %v; was %v", fillRate, b.FillRate)
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+	builders := map[string]*ServiceConfigBuilder{
+		"negative size": NewServiceConfig().WithGlobalDefaultBucket(Size(-1)),
+		"zero fill rate": NewServiceConfig().AddNamespace("n", func(ns *NamespaceBuilder) {
+			ns.WithFillRate(0)
+		}),
+		"empty namespace":     NewServiceConfig().AddNamespace("", nil),
+		"duplicate namespace": NewServiceConfig().AddNamespace("n", nil).AddNamespace("n", nil),
+		"negative max dynamic buckets": NewServiceConfig().AddNamespace("n", func(ns *NamespaceBuilder) {
+			ns.WithDynamicBuckets(-1)
+		}),
+		"invalid max idle": NewServiceConfig().AddNamespace("n", func(ns *NamespaceBuilder) {
+			ns.WithBucket("b", MaxIdleMillis(0))
+		}),
+	}
+
+	for desc, b := range builders {
+		if _, err := b.Build(); err == nil {
+			t.Fatalf("Expecting an error for %v", desc)
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	builders := map[string]*ServiceConfigBuilder{
+		"default and dynamic": NewServiceConfig().AddNamespace("n", func(ns *NamespaceBuilder) {
+			ns.WithDefaultBucket().WithDynamicBuckets(10)
+		}),
+		"nonexistent parent": NewServiceConfig().AddNamespace("n", func(ns *NamespaceBuilder) {
+			ns.WithParent("nonexistent")
+		}),
+	}
+
+	for desc, b := range builders {
+		if _, err := b.Build(); err == nil {
+			t.Fatalf("Expecting an error for %v", desc)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
+	"time"
 	"github.com/maniksurtani/quotaservice/logging"
 	"gopkg.in/yaml.v2"
 )
@@ -16,6 +18,74 @@ type ServiceConfig struct {
 	MetricsEnabled      bool                        `yaml:"metrics_enabled"`
 	GlobalDefaultBucket *BucketConfig               `yaml:"global_default_bucket,flow"`
 	Namespaces          map[string]*NamespaceConfig `yaml:",flow"`
+	// GlobalPolicy, if set, holds settings inherited by namespaces that don't set their own.
+	GlobalPolicy        *RateLimitPolicy            `yaml:"global_policy,flow"`
+	// NamespaceAliases maps alternative names of namespaces, such as names used by legacy
+	// clients, to the namespaces they stand for. Aliases may refer to other aliases.
+	NamespaceAliases    map[string]string           `yaml:"namespace_aliases,flow"`
+	// PrefetchTTLMillis is how long prefetched tokens are held once delivered, before they expire
+	// unconsumed. Defaults to a minute if unset.
+	PrefetchTTLMillis   int64                       `yaml:"prefetch_ttl_millis"`
+	// PriorityNamespaceMap maps the priority of Allow requests to the namespace serving them, so
+	// that requests of different priorities may share bucket names but not tokens. Requests of
+	// priorities not mapped are served by the namespace requested.
+	PriorityNamespaceMap map[int]string             `yaml:"priority_namespace_map,flow"`
+	// BorrowMarket, if set, periodically moves tokens between the aggregate buckets of namespaces,
+	// from those using little of theirs to those using most of theirs.
+	BorrowMarket        *BorrowMarketConfig         `yaml:"borrow_market,flow"`
+	// GlobalMaxTokensPerRequest, if set, is the most tokens granted to any one request. Requests for
+	// more are granted this many instead. Namespaces may override it with max_tokens_per_request.
+	GlobalMaxTokensPerRequest int64                 `yaml:"global_max_tokens_per_request"`
+}
+
+// BorrowMarketConfig configures the redistribution of tokens between namespaces. Utilisation is the
+// percentage of a namespace's aggregate bucket that has been used. Every MarketIntervalMillis,
+// namespaces below LendingThreshold lend tokens to namespaces above BorrowingThreshold that accept
+// donations from them, without lenders rising above, or borrowers falling below, their thresholds.
+type BorrowMarketConfig struct {
+	LendingThreshold     float64 `yaml:"lending_threshold"`
+	BorrowingThreshold   float64 `yaml:"borrowing_threshold"`
+	MarketIntervalMillis int64   `yaml:"market_interval_millis"`
+}
+
+// RateLimitPolicy groups namespace settings that can be shared by all namespaces. Unlike the
+// GlobalDefaultBucket, which serves requests for namespaces that don't exist, a policy only
+// changes how configured namespaces behave.
+type RateLimitPolicy struct {
+	// MaxIdleMillis is used by the dynamic buckets of namespaces whose dynamic bucket template
+	// would otherwise never be removed when idle.
+	MaxIdleMillis         int64         `yaml:"max_idle_millis"`
+	// MaxDynamicBuckets is used by namespaces that don't set max_dynamic_buckets.
+	MaxDynamicBuckets     int           `yaml:"max_dynamic_buckets"`
+	// DynamicBucketTemplate is used by namespaces that have neither a dynamic bucket template nor
+	// a default bucket.
+	DynamicBucketTemplate *BucketConfig `yaml:"dynamic_bucket_template,flow"`
+}
+
+// Apply returns a copy of a namespace's config, with settings the namespace doesn't set inherited
+// from the policy. The namespace's config is returned as-is if the policy is nil.
+func (p *RateLimitPolicy) Apply(ns *NamespaceConfig) *NamespaceConfig {
+	if p == nil {
+		return ns
+	}
+
+	merged := *ns
+	if merged.MaxDynamicBuckets == 0 {
+		merged.MaxDynamicBuckets = p.MaxDynamicBuckets
+	}
+
+	if merged.DynamicBucketTemplate == nil && merged.DefaultBucket == nil && p.DynamicBucketTemplate != nil {
+		template := *p.DynamicBucketTemplate
+		merged.DynamicBucketTemplate = &template
+	}
+
+	if merged.DynamicBucketTemplate != nil && merged.DynamicBucketTemplate.MaxIdleMillis <= 0 && p.MaxIdleMillis > 0 {
+		template := *merged.DynamicBucketTemplate
+		template.MaxIdleMillis = p.MaxIdleMillis
+		merged.DynamicBucketTemplate = &template
+	}
+
+	return &merged
 }
 
 type NamespaceConfig struct {
@@ -23,20 +93,242 @@ type NamespaceConfig struct {
 	DynamicBucketTemplate *BucketConfig            `yaml:"dynamic_bucket_template,flow"`
 	MaxDynamicBuckets     int                      `yaml:"max_dynamic_buckets"`
 	Buckets               map[string]*BucketConfig `yaml:",flow"`
+	// AggregateBucket, if set, limits all requests made against buckets in this namespace.
+	AggregateBucket       *BucketConfig            `yaml:"aggregate_bucket,flow"`
+	// AcceptDonationsFrom lists namespaces allowed to donate tokens to this namespace's aggregate
+	// bucket. An empty list denies all donations.
+	AcceptDonationsFrom   []string                 `yaml:"accept_donations_from,flow"`
+	// Parent, if set, is the name of a namespace whose aggregate bucket limits all requests made
+	// against this namespace too.
+	Parent                string                   `yaml:"parent"`
+	// AbortInFlightOnLock, if set, causes requests that are in flight when the namespace is locked
+	// to be rejected, and their tokens returned. Otherwise in-flight requests are allowed to drain.
+	AbortInFlightOnLock   bool                     `yaml:"abort_in_flight_on_lock"`
+	// DeduplicationWindowMs, if set, causes identical requests from the same client within this
+	// window, such as network retries, to consume tokens once and receive the same response.
+	DeduplicationWindowMs int64                    `yaml:"deduplication_window_ms"`
+	// CoalesceWindowMs, if set, batches requests for the same bucket that carry the same group key
+	// within this window, so that they take tokens in a single call and share its outcome.
+	CoalesceWindowMs      int64                    `yaml:"coalesce_window_ms"`
+	// MaxTokensPerRequest, if set, overrides the service's GlobalMaxTokensPerRequest for requests
+	// against this namespace.
+	MaxTokensPerRequest   int64                    `yaml:"max_tokens_per_request"`
+	// DryRun, if set, serves requests against this namespace as though they were dry runs, without
+	// taking any tokens, such as while rolling out new limits.
+	DryRun                bool                     `yaml:"dry_run"`
+	// FeedbackReductionFactor, if set, is the fraction of their configured fill rate that the
+	// namespace's buckets are tuned down to while a feedback source registered for the namespace
+	// reports an error rate above FeedbackErrorRateThreshold.
+	FeedbackReductionFactor float64                `yaml:"feedback_reduction_factor"`
+	// FeedbackErrorRateThreshold is the error rate, between 0 and 1, above which the namespace's
+	// fill rates are reduced.
+	FeedbackErrorRateThreshold float64             `yaml:"feedback_error_rate_threshold"`
+	// OperationBuckets maps operation types to buckets that limit requests for that type of
+	// operation against all buckets in this namespace, such as reads and writes.
+	OperationBuckets      map[string]*BucketConfig `yaml:"operation_buckets,flow"`
+	// MaxConcurrency, if set, is the number of requests that may be taking tokens from the
+	// namespace's buckets at the same time. Requests beyond it are rejected.
+	MaxConcurrency        int64                    `yaml:"max_concurrency"`
+	// CircuitBreakerThreshold, if set, is the number of consecutive requests against this namespace
+	// that have to be rejected for lack of tokens before the namespace's circuit opens, and further
+	// requests are rejected without taking tokens, for CircuitBreakerResetTimeoutMs.
+	CircuitBreakerThreshold int                    `yaml:"circuit_breaker_threshold"`
+	// CircuitBreakerResetTimeoutMs is how long an open circuit rejects requests, before a single
+	// request is let through to probe whether the namespace has recovered.
+	CircuitBreakerResetTimeoutMs int64             `yaml:"circuit_breaker_reset_timeout_ms"`
+	// OnColdStart, if set, is called asynchronously with the first request for a bucket in this
+	// namespace after it has been idle, such as to pre-warm downstream caches. Buckets are idle
+	// until first requested, and after ColdStartIdleMillis without requests.
+	OnColdStart           func(namespace, bucket string) `yaml:"-"`
+	// ColdStartIdleMillis is how long a bucket goes without requests before it is idle. Defaults
+	// to a minute.
+	ColdStartIdleMillis   int64                    `yaml:"cold_start_idle_millis"`
+	// MaxDynamicBucketMemoryBytes, if set, limits the estimated memory used by the namespace's
+	// dynamic buckets. The least recently used dynamic buckets are removed to make room for new
+	// ones.
+	MaxDynamicBucketMemoryBytes int64              `yaml:"max_dynamic_bucket_memory_bytes"`
+	// StickyBucketHashFunc, if set, is used by factories that spread buckets across shards to
+	// choose the shard of each bucket in this namespace, such as to keep all buckets of a client on
+	// the same shard. Buckets with the same hash are always on the same shard.
+	StickyBucketHashFunc  func(bucketName string) int `yaml:"-"`
+	// AuditWriter, if set, is sent every quota decision made in this namespace, as a line of JSON.
+	// Decisions are written asynchronously, so a slow writer never holds up requests.
+	AuditWriter           io.Writer                `yaml:"-"`
+	// AuditBufferSize is how many decisions are buffered for the AuditWriter. Decisions made while
+	// the buffer is full are dropped. Defaults to 1000.
+	AuditBufferSize       int                      `yaml:"audit_buffer_size"`
 }
 
 type BucketConfig struct {
 	Size              int64
 	FillRate          int64 `yaml:"fill_rate"`
 	WaitTimeoutMillis int64 `yaml:"wait_timeout_millis"`
+	// MaxWaitCapMillis, if set, is the longest a request may ask to wait for tokens, using a max
+	// wait override, so that clients may wait longer than WaitTimeoutMillis. Otherwise requests may
+	// only ask to wait less than WaitTimeoutMillis.
+	MaxWaitCapMillis int64 `yaml:"max_wait_cap_millis"`
 	MaxIdleMillis     int64 `yaml:"max_idle_millis"`
 	MaxDebtMillis     int64 `yaml:"max_debt_millis"`
+	// WarmupRampDurationMs, if set, causes a new bucket to start empty and its fill rate to ramp up
+	// linearly from 0 to FillRate over this duration.
+	WarmupRampDurationMs int64 `yaml:"warmup_ramp_duration_ms"`
+	// TrafficShaping, if enabled, spreads large grants evenly over time in sub-batches of FillRate
+	// tokens, one second apart, rather than granting accumulated tokens in a single burst.
+	TrafficShaping    bool  `yaml:"traffic_shaping"`
+	// OperationCosts maps operation types to the number of tokens each operation costs, for use
+	// with QuotaService.AllowOp().
+	OperationCosts    map[string]int64 `yaml:"operation_costs,flow"`
+	// FallbackChain lists fully qualified bucket names, of the form namespace:bucket, to try in
+	// order when this bucket has no tokens available. A fallback's own FallbackChain is tried
+	// before moving on to the next fallback. Chains that lead back to a bucket are rejected.
+	FallbackChain     []string `yaml:"fallback_chain,flow"`
+	// HistoryResolutionMs, if set, causes buckets that support it to record their token level at
+	// this interval, for Bucket.TokenLevelHistory().
+	HistoryResolutionMs int64 `yaml:"history_resolution_ms"`
+	// HistoryRetentionMs is how long token levels are kept for. Defaults to 60 times
+	// HistoryResolutionMs.
+	HistoryRetentionMs  int64 `yaml:"history_retention_ms"`
+	// PersistStats, if enabled, causes buckets that support it to write the number of requests
+	// they have granted and rejected to disk, every StatsFlushIntervalMs, when destroyed and when
+	// the quota service stops, and to restore them when re-created, so that lifetime stats survive
+	// restarts.
+	PersistStats bool `yaml:"persist_stats"`
+	// StatsFlushIntervalMs is how often stats are written to disk. Defaults to 10000.
+	StatsFlushIntervalMs int64 `yaml:"stats_flush_interval_ms"`
+	// AccumulationDecayRatePerSec, if set, causes tokens accumulated by buckets that support it to
+	// lose value while the bucket is idle: after T idle seconds, Size * (1 - e^(-rate * T)) tokens
+	// are discarded before the next grant, so long-idle clients can't burst.
+	AccumulationDecayRatePerSec float64 `yaml:"accumulation_decay_rate_per_sec"`
+	// PassiveDrainRatePerSec, if set, causes buckets that support it to lose this many tokens per
+	// second whether or not requests arrive, in addition to refilling at FillRate, modelling "use
+	// it or lose it" quotas. Tokens never drain below 0.
+	PassiveDrainRatePerSec float64 `yaml:"passive_drain_rate_per_sec"`
+	// MaxAccumulatedTokens, if set below Size, caps the tokens buckets that support it accumulate
+	// by refilling, so that clients returning from long idle periods can't burst all of Size.
+	// Tokens added explicitly, such as those returned using AddTokens(), may still fill the bucket
+	// up to Size.
+	MaxAccumulatedTokens *int64 `yaml:"max_accumulated_tokens"`
+	// AutoTune, if enabled, causes buckets that support it to follow demand: once the rate of
+	// tokens requested exceeds FillRate by 10%, FillRate is raised to match it. This is
+	// experimental. Fill rates are never lowered automatically.
+	AutoTune bool `yaml:"auto_tune"`
+	// AutoTuneCapMultiplier, if set, caps fill rates raised by AutoTune at this multiple of the
+	// configured FillRate.
+	AutoTuneCapMultiplier float64 `yaml:"auto_tune_cap_multiplier"`
+	// AutoTuneMaxFillRate, if set, caps fill rates raised by AutoTune. Buckets using AutoTune need
+	// at least one of AutoTuneCapMultiplier or AutoTuneMaxFillRate.
+	AutoTuneMaxFillRate int64 `yaml:"auto_tune_max_fill_rate"`
+	// DegradationLadder, if set, lists levels of progressively harsher treatment of requests as
+	// the bucket empties, in order of decreasing TokenThreshold. Only applies to buckets that
+	// report their tokens.
+	DegradationLadder []DegradationLevel `yaml:"degradation_ladder,flow"`
+	// RejectionMessage, if set, is passed on to clients whose requests this bucket rejects, to tell
+	// them what they can do about it, such as upgrading to a plan with higher limits.
+	RejectionMessage string `yaml:"rejection_message"`
+	// ParentName, if set, is the name of another named bucket in the same namespace that limits
+	// requests made against this bucket too, when buckets are created by a hierarchical bucket
+	// factory.
+	ParentName string `yaml:"parent_name"`
+	// Tiers, if set, limit the tokens granted over windows of time, such as per second and per
+	// day, in addition to the bucket's own size and fill rate. Requests are only granted if every
+	// tier grants them. Only supported by in-memory buckets.
+	Tiers []TierConfig `yaml:"tiers,flow"`
+	// FillSchedule, if set, lists the daily windows during which the bucket refills. Outside them,
+	// the bucket keeps the tokens it has, but gains none. Waits for tokens borrowed from the future
+	// still assume the bucket refills. Only supported by in-memory buckets.
+	FillSchedule []FillWindow `yaml:"fill_schedule,flow"`
+	// TimeMultipliers, if set, scale the bucket's fill rate during daily windows, such as to allow
+	// more traffic during business hours. The first window containing the current time applies,
+	// and the fill rate is unscaled outside them all. Only supported by in-memory buckets.
+	TimeMultipliers []TimeMultiplier `yaml:"time_multipliers,flow"`
+	// BloomDeduplication, if set, causes the gRPC endpoint to remember the requests this named
+	// bucket granted within BloomWindowMs using bloom filters, so memory use doesn't grow with
+	// traffic, but about BloomFPRate of new requests are mistaken for retries. Retries are still
+	// served by the bucket and charged for, so that neither false positives nor clients sharing
+	// an address are granted tokens for free.
+	BloomDeduplication bool `yaml:"bloom_deduplication"`
+	// BloomWindowMs is how long granted requests are remembered for. Filters are rotated every
+	// window, so requests are remembered for between one and two windows.
+	BloomWindowMs int64 `yaml:"bloom_window_ms"`
+	// BloomFPRate is the rate of false positives bloom filters are sized for. Defaults to 0.01.
+	BloomFPRate float64 `yaml:"bloom_fp_rate"`
+	// CostCalculator, if set, prices requests for this bucket that carry metadata, such as the
+	// size of a payload, overriding the tokens requested. Size and FillRate are then in the units
+	// of cost it returns. It can only be set in code.
+	CostCalculator func(meta map[string]string) int64 `yaml:"-"`
+	// Ref, if set, is the name of a Registry entry this bucket uses, in place of its own settings.
+	// In YAML, it is set by using the name with a $ prefix in place of a bucket config.
+	Ref               string `yaml:"-"`
+}
+
+// DegradationAction is how requests are treated at a level of a DegradationLadder.
+type DegradationAction string
+
+const (
+	// DEGRADE_WARN allows requests, which are told the degradation level they were served at.
+	DEGRADE_WARN           DegradationAction = "WARN"
+	// DEGRADE_THROTTLE_50PCT rejects half of all requests.
+	DEGRADE_THROTTLE_50PCT DegradationAction = "THROTTLE_50PCT"
+	// DEGRADE_THROTTLE_90PCT rejects 9 in 10 requests.
+	DEGRADE_THROTTLE_90PCT DegradationAction = "THROTTLE_90PCT"
+	// DEGRADE_REJECT_NEW rejects all requests.
+	DEGRADE_REJECT_NEW     DegradationAction = "REJECT_NEW"
+)
+
+// DegradationLevel is a level of a DegradationLadder, which applies while the tokens available
+// in a bucket are at or below TokenThreshold percent of its size.
+type DegradationLevel struct {
+	TokenThreshold int64             `yaml:"token_threshold"`
+	Action         DegradationAction `yaml:"action"`
+}
+
+// TierConfig limits the tokens a bucket grants to MaxTokens over a window of WindowMillis. Like a
+// bucket, a tier refills evenly over its window, rather than all at once at the end of it.
+type TierConfig struct {
+	WindowMillis int64 `yaml:"window_millis"`
+	MaxTokens    int64 `yaml:"max_tokens"`
+}
+
+// FillWindow is a daily window, from StartHour up to EndHour in Timezone, during which a bucket
+// with a FillSchedule refills. Windows with an EndHour before their StartHour cross midnight.
+type FillWindow struct {
+	StartHour int    `yaml:"start_hour"`
+	EndHour   int    `yaml:"end_hour"`
+	// Timezone is an IANA time zone name, such as America/New_York. Defaults to UTC.
+	Timezone  string `yaml:"timezone"`
+}
+
+// TimeMultiplier scales the fill rate of a bucket by Multiplier from StartHour up to EndHour each
+// day, in Timezone. Windows with an EndHour before their StartHour cross midnight.
+type TimeMultiplier struct {
+	StartHour  int     `yaml:"start_hour"`
+	EndHour    int     `yaml:"end_hour"`
+	// Timezone is an IANA time zone name, such as America/New_York. Defaults to UTC.
+	Timezone   string  `yaml:"timezone"`
+	Multiplier float64 `yaml:"multiplier"`
 }
 
 func (b *BucketConfig) String() string {
 	return fmt.Sprint(*b)
 }
 
+// UnmarshalYAML reads either a bucket config, or a reference to a Registry entry.
+func (b *BucketConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ref string
+	if err := unmarshal(&ref); err == nil {
+		if !strings.HasPrefix(ref, "$") || len(ref) == 1 {
+			return fmt.Errorf("Bucket config %q should either be a mapping, or a reference starting with $", ref)
+		}
+
+		b.Ref = ref[1:]
+		return nil
+	}
+
+	// Avoid recursing into this method.
+	type plain BucketConfig
+	return unmarshal((*plain)(b))
+}
+
 func ReadConfigFromFile(filename string) *ServiceConfig {
 	bytes, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -56,22 +348,28 @@ func ReadConfig(yamlStream io.Reader) *ServiceConfig {
 }
 
 func readConfigFromBytes(bytes []byte) *ServiceConfig {
+	return ApplyDefaults(unmarshalConfig(bytes))
+}
+
+func unmarshalConfig(bytes []byte) *ServiceConfig {
 	logging.Print(string(bytes))
 	cfg := NewDefaultServiceConfig()
 	cfg.GlobalDefaultBucket = nil
 	yaml.Unmarshal(bytes, cfg)
-
-	return ApplyDefaults(cfg)
+	return cfg
 }
 
 func ApplyDefaults(cfg *ServiceConfig) *ServiceConfig {
-	applyBucketDefaults(cfg.GlobalDefaultBucket)
+	if err := cfg.Validate(); err != nil {
+		panic(err.Error())
+	}
 
-	for name, ns := range cfg.Namespaces {
-		if ns.DefaultBucket != nil && ns.DynamicBucketTemplate != nil {
-			panic(fmt.Sprintf("Namespace %v is not allowed to have a default bucket as well as allow dynamic buckets.", name))
-		}
+	applyBucketDefaults(cfg.GlobalDefaultBucket)
+	if cfg.GlobalPolicy != nil {
+		applyBucketDefaults(cfg.GlobalPolicy.DynamicBucketTemplate)
+	}
 
+	for _, ns := range cfg.Namespaces {
 		// Ensure the namespace's bucket map exists.
 		if ns.Buckets == nil {
 			ns.Buckets = make(map[string]*BucketConfig)
@@ -79,16 +377,424 @@ func ApplyDefaults(cfg *ServiceConfig) *ServiceConfig {
 
 		applyBucketDefaults(ns.DefaultBucket)
 		applyBucketDefaults(ns.DynamicBucketTemplate)
+		applyBucketDefaults(ns.AggregateBucket)
 
 		for _, b := range ns.Buckets {
 			applyBucketDefaults(b)
 		}
+
+		for _, b := range ns.OperationBuckets {
+			applyBucketDefaults(b)
+		}
 	}
 
 	logging.Printf("Read config %+v", cfg)
 	return cfg
 }
 
+// Validate checks that a configuration is consistent, returning an error describing the first
+// problem found. Unset (zero) values are valid, since defaults are applied to them.
+func (cfg *ServiceConfig) Validate() error {
+	if err := validateBucket(cfg.GlobalDefaultBucket); err != nil {
+		return fmt.Errorf("Global default bucket is invalid: %v", err)
+	}
+
+	if p := cfg.GlobalPolicy; p != nil {
+		if p.MaxDynamicBuckets < 0 {
+			return fmt.Errorf("Global policy has a negative max_dynamic_buckets %v.", p.MaxDynamicBuckets)
+		}
+
+		if err := validateBucket(p.DynamicBucketTemplate); err != nil {
+			return fmt.Errorf("Global policy has an invalid dynamic bucket template: %v", err)
+		}
+	}
+
+	if cfg.PrefetchTTLMillis < 0 {
+		return fmt.Errorf("Service has a negative prefetch_ttl_millis %v.", cfg.PrefetchTTLMillis)
+	}
+
+	for alias := range cfg.NamespaceAliases {
+		if cfg.Namespaces[alias] != nil {
+			return fmt.Errorf("Alias %v is also a namespace.", alias)
+		}
+
+		target, err := ResolveNamespaceAlias(cfg.NamespaceAliases, alias)
+		if err != nil {
+			return err
+		}
+
+		if cfg.Namespaces[target] == nil {
+			return fmt.Errorf("Alias %v refers to namespace %v, which doesn't exist.", alias, target)
+		}
+	}
+
+	if m := cfg.BorrowMarket; m != nil {
+		if m.LendingThreshold < 0 || m.BorrowingThreshold > 100 || m.LendingThreshold >= m.BorrowingThreshold {
+			return fmt.Errorf("Borrow market needs thresholds in [0, 100], with the lending threshold below the borrowing threshold. Were %v and %v.",
+				m.LendingThreshold, m.BorrowingThreshold)
+		}
+
+		if m.MarketIntervalMillis <= 0 {
+			return fmt.Errorf("Borrow market has a non-positive market_interval_millis %v.", m.MarketIntervalMillis)
+		}
+	}
+
+	if cfg.GlobalMaxTokensPerRequest < 0 {
+		return fmt.Errorf("Service has a negative global_max_tokens_per_request %v.", cfg.GlobalMaxTokensPerRequest)
+	}
+
+	for priority, namespace := range cfg.PriorityNamespaceMap {
+		if cfg.Namespaces[namespace] == nil && cfg.NamespaceAliases[namespace] == "" {
+			return fmt.Errorf("Priority %v is mapped to namespace %v, which doesn't exist.", priority, namespace)
+		}
+	}
+
+	for name, ns := range cfg.Namespaces {
+		if ns.DefaultBucket != nil && ns.DynamicBucketTemplate != nil {
+			return fmt.Errorf("Namespace %v is not allowed to have a default bucket as well as allow dynamic buckets.", name)
+		}
+
+		if ns.MaxDynamicBuckets < 0 {
+			return fmt.Errorf("Namespace %v has a negative max_dynamic_buckets %v.", name, ns.MaxDynamicBuckets)
+		}
+
+		if ns.DeduplicationWindowMs < 0 {
+			return fmt.Errorf("Namespace %v has a negative deduplication_window_ms %v.", name, ns.DeduplicationWindowMs)
+		}
+
+		if ns.CoalesceWindowMs < 0 {
+			return fmt.Errorf("Namespace %v has a negative coalesce_window_ms %v.", name, ns.CoalesceWindowMs)
+		}
+
+		if ns.MaxTokensPerRequest < 0 {
+			return fmt.Errorf("Namespace %v has a negative max_tokens_per_request %v.", name, ns.MaxTokensPerRequest)
+		}
+
+		if ns.AuditBufferSize < 0 {
+			return fmt.Errorf("Namespace %v has a negative audit_buffer_size %v.", name, ns.AuditBufferSize)
+		}
+
+		if ns.MaxDynamicBucketMemoryBytes < 0 {
+			return fmt.Errorf("Namespace %v has a negative max_dynamic_bucket_memory_bytes %v.", name, ns.MaxDynamicBucketMemoryBytes)
+		}
+
+		if ns.ColdStartIdleMillis < 0 {
+			return fmt.Errorf("Namespace %v has a negative cold_start_idle_millis %v.", name, ns.ColdStartIdleMillis)
+		}
+
+		if ns.MaxConcurrency < 0 {
+			return fmt.Errorf("Namespace %v has a negative max_concurrency %v.", name, ns.MaxConcurrency)
+		}
+
+		if ns.CircuitBreakerThreshold < 0 {
+			return fmt.Errorf("Namespace %v has a negative circuit_breaker_threshold %v.", name, ns.CircuitBreakerThreshold)
+		}
+
+		if ns.CircuitBreakerThreshold > 0 && ns.CircuitBreakerResetTimeoutMs <= 0 {
+			return fmt.Errorf("Namespace %v has a circuit_breaker_threshold but no positive circuit_breaker_reset_timeout_ms.", name)
+		}
+
+		if ns.FeedbackReductionFactor < 0 || ns.FeedbackReductionFactor > 1 {
+			return fmt.Errorf("Namespace %v has a feedback_reduction_factor %v outside [0, 1].", name, ns.FeedbackReductionFactor)
+		}
+
+		if ns.FeedbackErrorRateThreshold < 0 || ns.FeedbackErrorRateThreshold > 1 {
+			return fmt.Errorf("Namespace %v has a feedback_error_rate_threshold %v outside [0, 1].", name, ns.FeedbackErrorRateThreshold)
+		}
+
+		if ns.Parent != "" && cfg.Namespaces[ns.Parent] == nil {
+			return fmt.Errorf("Namespace %v has a parent %v which doesn't exist.", name, ns.Parent)
+		}
+
+		if HasCyclicParents(cfg, name) {
+			return fmt.Errorf("Namespace %v is its own ancestor.", name)
+		}
+
+		if b := ns.DynamicBucketTemplate; b != nil && b.ParentName != "" && ns.Buckets[b.ParentName] == nil {
+			return fmt.Errorf("Namespace %v has a dynamic bucket template with a parent %v which doesn't exist.", name, b.ParentName)
+		}
+
+		for _, b := range []*BucketConfig{ns.DefaultBucket, ns.DynamicBucketTemplate, ns.AggregateBucket} {
+			if err := validateBucket(b); err != nil {
+				return fmt.Errorf("Namespace %v has an invalid bucket: %v", name, err)
+			}
+		}
+
+		for op, b := range ns.OperationBuckets {
+			if b == nil {
+				return fmt.Errorf("Namespace %v has no config for operation %v.", name, op)
+			}
+
+			if err := validateBucket(b); err != nil {
+				return fmt.Errorf("Namespace %v has an invalid bucket for operation %v: %v", name, op, err)
+			}
+		}
+
+		for bName, b := range ns.Buckets {
+			if b != nil && b.Ref != "" {
+				return fmt.Errorf("Bucket %v:%v references $%v, which hasn't been resolved using a Registry.", name, bName, b.Ref)
+			}
+
+			if err := validateBucket(b); err != nil {
+				return fmt.Errorf("Bucket %v:%v is invalid: %v", name, bName, err)
+			}
+
+			if HasCyclicFallbacks(cfg, name, bName) {
+				return fmt.Errorf("Bucket %v:%v falls back to itself.", name, bName)
+			}
+
+			if b != nil && b.ParentName != "" && ns.Buckets[b.ParentName] == nil {
+				return fmt.Errorf("Bucket %v:%v has a parent %v which doesn't exist.", name, bName, b.ParentName)
+			}
+
+			if HasCyclicBucketParents(ns, bName) {
+				return fmt.Errorf("Bucket %v:%v is its own ancestor.", name, bName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateBucketConfig checks a single bucket config, such as one created at runtime, in isolation
+// from the rest of the service's configuration.
+func ValidateBucketConfig(b *BucketConfig) error {
+	return validateBucket(b)
+}
+
+func validateBucket(b *BucketConfig) error {
+	if b == nil {
+		return nil
+	}
+
+	if b.Size < 0 {
+		return fmt.Errorf("size %v is negative", b.Size)
+	}
+
+	if b.FillRate < 0 {
+		return fmt.Errorf("fill_rate %v is negative", b.FillRate)
+	}
+
+	if b.WaitTimeoutMillis < 0 {
+		return fmt.Errorf("wait_timeout_millis %v is negative", b.WaitTimeoutMillis)
+	}
+
+	if b.MaxWaitCapMillis < 0 {
+		return fmt.Errorf("max_wait_cap_millis %v is negative", b.MaxWaitCapMillis)
+	}
+
+	if b.MaxDebtMillis < 0 {
+		return fmt.Errorf("max_debt_millis %v is negative", b.MaxDebtMillis)
+	}
+
+	if b.WarmupRampDurationMs < 0 {
+		return fmt.Errorf("warmup_ramp_duration_ms %v is negative", b.WarmupRampDurationMs)
+	}
+
+	if b.AccumulationDecayRatePerSec < 0 {
+		return fmt.Errorf("accumulation_decay_rate_per_sec %v is negative", b.AccumulationDecayRatePerSec)
+	}
+
+	if b.PassiveDrainRatePerSec < 0 {
+		return fmt.Errorf("passive_drain_rate_per_sec %v is negative", b.PassiveDrainRatePerSec)
+	}
+
+	if b.MaxAccumulatedTokens != nil && *b.MaxAccumulatedTokens < 0 {
+		return fmt.Errorf("max_accumulated_tokens %v is negative", *b.MaxAccumulatedTokens)
+	}
+
+	if b.AutoTuneCapMultiplier != 0 && b.AutoTuneCapMultiplier < 1 {
+		return fmt.Errorf("auto_tune_cap_multiplier %v is less than 1", b.AutoTuneCapMultiplier)
+	}
+
+	if b.AutoTuneMaxFillRate < 0 {
+		return fmt.Errorf("auto_tune_max_fill_rate %v is negative", b.AutoTuneMaxFillRate)
+	}
+
+	if b.AutoTune && b.AutoTuneCapMultiplier == 0 && b.AutoTuneMaxFillRate == 0 {
+		return fmt.Errorf("auto_tune needs auto_tune_cap_multiplier or auto_tune_max_fill_rate")
+	}
+
+	for i, level := range b.DegradationLadder {
+		if level.TokenThreshold < 0 || level.TokenThreshold > 100 {
+			return fmt.Errorf("degradation_ladder token_threshold %v is outside [0, 100]", level.TokenThreshold)
+		}
+
+		if i > 0 && level.TokenThreshold >= b.DegradationLadder[i-1].TokenThreshold {
+			return fmt.Errorf("degradation_ladder token_threshold %v doesn't decrease", level.TokenThreshold)
+		}
+
+		switch level.Action {
+		case DEGRADE_WARN, DEGRADE_THROTTLE_50PCT, DEGRADE_THROTTLE_90PCT, DEGRADE_REJECT_NEW:
+		default:
+			return fmt.Errorf("degradation_ladder action %v is unknown", level.Action)
+		}
+	}
+
+	for _, fqn := range b.FallbackChain {
+		if _, _, ok := SplitFullyQualifiedName(fqn); !ok {
+			return fmt.Errorf("fallback_chain entry %v is not of the form namespace:bucket", fqn)
+		}
+	}
+
+	for _, tier := range b.Tiers {
+		if tier.WindowMillis <= 0 || tier.MaxTokens <= 0 {
+			return fmt.Errorf("tiers need a positive window_millis and max_tokens. Were %v and %v", tier.WindowMillis, tier.MaxTokens)
+		}
+
+		if tier.WindowMillis*1e6 < tier.MaxTokens {
+			return fmt.Errorf("tiers can't refill more than a token a nanosecond. window_millis %v is too short for max_tokens %v", tier.WindowMillis, tier.MaxTokens)
+		}
+	}
+
+	for _, w := range b.FillSchedule {
+		if w.StartHour < 0 || w.StartHour > 23 || w.EndHour < 0 || w.EndHour > 24 || w.StartHour == w.EndHour {
+			return fmt.Errorf("fill_schedule window from %v to %v isn't a window of whole hours", w.StartHour, w.EndHour)
+		}
+
+		if _, err := time.LoadLocation(w.Timezone); err != nil {
+			return fmt.Errorf("fill_schedule timezone %v is unknown: %v", w.Timezone, err)
+		}
+	}
+
+	for _, m := range b.TimeMultipliers {
+		if m.StartHour < 0 || m.StartHour > 23 || m.EndHour < 0 || m.EndHour > 24 || m.StartHour == m.EndHour {
+			return fmt.Errorf("time_multipliers window from %v to %v isn't a window of whole hours", m.StartHour, m.EndHour)
+		}
+
+		if _, err := time.LoadLocation(m.Timezone); err != nil {
+			return fmt.Errorf("time_multipliers timezone %v is unknown: %v", m.Timezone, err)
+		}
+
+		if m.Multiplier <= 0 {
+			return fmt.Errorf("time_multipliers multiplier %v isn't positive", m.Multiplier)
+		}
+	}
+
+	if b.BloomDeduplication && b.BloomWindowMs <= 0 {
+		return fmt.Errorf("bloom_deduplication needs a positive bloom_window_ms. Was %v", b.BloomWindowMs)
+	}
+
+	if b.BloomFPRate < 0 || b.BloomFPRate >= 1 {
+		return fmt.Errorf("bloom_fp_rate %v is outside [0, 1)", b.BloomFPRate)
+	}
+
+	if b.HistoryResolutionMs < 0 {
+		return fmt.Errorf("history_resolution_ms %v is negative", b.HistoryResolutionMs)
+	}
+
+	if b.HistoryRetentionMs < 0 {
+		return fmt.Errorf("history_retention_ms %v is negative", b.HistoryRetentionMs)
+	}
+
+	if b.StatsFlushIntervalMs < 0 {
+		return fmt.Errorf("stats_flush_interval_ms %v is negative", b.StatsFlushIntervalMs)
+	}
+
+	for op, cost := range b.OperationCosts {
+		if cost < 0 {
+			return fmt.Errorf("operation_costs for %v is negative: %v", op, cost)
+		}
+	}
+
+	return nil
+}
+
+// HasCyclicParents tells you whether a namespace is its own ancestor.
+func HasCyclicParents(cfg *ServiceConfig, namespace string) bool {
+	visited := make(map[string]bool)
+	for ns := cfg.Namespaces[namespace]; ns != nil && ns.Parent != ""; ns = cfg.Namespaces[ns.Parent] {
+		if ns.Parent == namespace || visited[ns.Parent] {
+			return true
+		}
+		visited[ns.Parent] = true
+	}
+
+	return false
+}
+
+// HasCyclicBucketParents tells you whether a named bucket is its own ancestor, through the
+// ParentName of each bucket.
+func HasCyclicBucketParents(ns *NamespaceConfig, bucketName string) bool {
+	visited := make(map[string]bool)
+	for b := ns.Buckets[bucketName]; b != nil && b.ParentName != ""; b = ns.Buckets[b.ParentName] {
+		if b.ParentName == bucketName || visited[b.ParentName] {
+			return true
+		}
+		visited[b.ParentName] = true
+	}
+
+	return false
+}
+
+// HasCyclicFallbacks tells you if a named bucket's fallback chain, followed through the fallback
+// chains of the named buckets it lists, leads back to the bucket.
+func HasCyclicFallbacks(cfg *ServiceConfig, namespace, bucketName string) bool {
+	start := namespace + ":" + bucketName
+	visited := make(map[string]bool)
+	toVisit := []string{start}
+	for len(toVisit) > 0 {
+		fqn := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+
+		b := findNamedBucket(cfg, fqn)
+		if b == nil {
+			continue
+		}
+
+		for _, fallback := range b.FallbackChain {
+			if fallback == start {
+				return true
+			}
+
+			if !visited[fallback] {
+				visited[fallback] = true
+				toVisit = append(toVisit, fallback)
+			}
+		}
+	}
+
+	return false
+}
+
+// ResolveNamespaceAlias follows aliases from name until reaching a name that isn't an alias,
+// returning an error if the aliases are circular. Names that aren't aliases are returned as-is.
+func ResolveNamespaceAlias(aliases map[string]string, name string) (string, error) {
+	seen := make(map[string]bool)
+	for {
+		target, ok := aliases[name]
+		if !ok {
+			return name, nil
+		}
+
+		if seen[name] {
+			return "", fmt.Errorf("Alias %v is circular.", name)
+		}
+
+		seen[name] = true
+		name = target
+	}
+}
+
+// SplitFullyQualifiedName splits a bucket name of the form namespace:bucket.
+func SplitFullyQualifiedName(fqn string) (namespace, bucketName string, ok bool) {
+	i := strings.Index(fqn, ":")
+	if i < 1 || i == len(fqn)-1 {
+		return "", "", false
+	}
+
+	return fqn[:i], fqn[i+1:], true
+}
+
+func findNamedBucket(cfg *ServiceConfig, fqn string) *BucketConfig {
+	namespace, bucketName, ok := SplitFullyQualifiedName(fqn)
+	if !ok || cfg.Namespaces[namespace] == nil {
+		return nil
+	}
+
+	return cfg.Namespaces[namespace].Buckets[bucketName]
+}
+
 func NewDefaultServiceConfig() *ServiceConfig {
 	return &ServiceConfig{
 		MetricsEnabled:        true,
@@ -104,6 +810,11 @@ func NewDefaultBucketConfig() *BucketConfig {
 	return &BucketConfig{Size: 100, FillRate: 50, WaitTimeoutMillis: 1000, MaxIdleMillis: -1, MaxDebtMillis: 10000}
 }
 
+// ApplyBucketDefaults sets defaults on a single bucket config, such as one created at runtime.
+func ApplyBucketDefaults(b *BucketConfig) {
+	applyBucketDefaults(b)
+}
+
 func applyBucketDefaults(b *BucketConfig) {
 	if b != nil {
 		if b.Size == 0 {
@@ -125,5 +836,17 @@ func applyBucketDefaults(b *BucketConfig) {
 		if b.MaxDebtMillis == 0 {
 			b.MaxDebtMillis = 10000
 		}
+
+		if b.HistoryResolutionMs > 0 && b.HistoryRetentionMs == 0 {
+			b.HistoryRetentionMs = 60 * b.HistoryResolutionMs
+		}
+
+		if b.PersistStats && b.StatsFlushIntervalMs == 0 {
+			b.StatsFlushIntervalMs = 10000
+		}
+
+		if b.BloomDeduplication && b.BloomFPRate == 0 {
+			b.BloomFPRate = 0.01
+		}
 	}
 }
@@ -117,3 +117,379 @@ func TestNonexistentFile(t *testing.T) {
 }
 
 
+func TestNonexistentParent(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["child"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["child"].Parent = "nonexistent"
+
+	test.ExpectingPanic(t, func() {
+		ApplyDefaults(cfg)
+	})
+}
+
+func TestCyclicParents(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["a"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["a"].Parent = "b"
+	cfg.Namespaces["b"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["b"].Parent = "a"
+
+	test.ExpectingPanic(t, func() {
+		ApplyDefaults(cfg)
+	})
+}
+
+func TestCyclicBucketParents(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["a"] = NewDefaultBucketConfig()
+	cfg.Namespaces["n"].Buckets["a"].ParentName = "b"
+	cfg.Namespaces["n"].Buckets["b"] = NewDefaultBucketConfig()
+	cfg.Namespaces["n"].Buckets["b"].ParentName = "a"
+
+	test.ExpectingPanic(t, func() {
+		ApplyDefaults(cfg)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["b"] = &BucketConfig{Size: 10}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unset values should be valid. Error: %v", err)
+	}
+
+	cfg.Namespaces["n"].Buckets["b"].FillRate = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Negative fill rate should be invalid")
+	}
+}
+
+func TestValidateAutoTune(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	b := &BucketConfig{Size: 10, FillRate: 10, AutoTune: true}
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Auto-tuning without a cap should be invalid")
+	}
+
+	b.AutoTuneMaxFillRate = 100
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Auto-tuning with a max fill rate should be valid. Error: %v", err)
+	}
+
+	b.AutoTuneCapMultiplier = 0.5
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Cap multiplier below 1 should be invalid")
+	}
+}
+
+func TestValidateDegradationLadder(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	b := &BucketConfig{Size: 10, FillRate: 10, DegradationLadder: []DegradationLevel{
+		{TokenThreshold: 50, Action: DEGRADE_WARN},
+		{TokenThreshold: 10, Action: DEGRADE_REJECT_NEW}}}
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Ladder should be valid. Error: %v", err)
+	}
+
+	b.DegradationLadder[1].TokenThreshold = 50
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Thresholds that don't decrease should be invalid")
+	}
+
+	b.DegradationLadder[1].TokenThreshold = 10
+	b.DegradationLadder[1].Action = "PANIC"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Unknown actions should be invalid")
+	}
+
+	b.DegradationLadder[1].Action = DEGRADE_REJECT_NEW
+	b.DegradationLadder[0].TokenThreshold = 101
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Thresholds above 100 should be invalid")
+	}
+}
+
+func TestValidateTiers(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	b := &BucketConfig{Size: 10, FillRate: 10, Tiers: []TierConfig{{WindowMillis: 1000, MaxTokens: 10}}}
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Tiers should be valid. Error: %v", err)
+	}
+
+	b.Tiers[0].MaxTokens = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Tier without tokens should be invalid")
+	}
+
+	b.Tiers[0] = TierConfig{WindowMillis: 1, MaxTokens: 2e6}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Tier refilling more than a token a nanosecond should be invalid")
+	}
+}
+
+func TestValidateFillSchedule(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	b := &BucketConfig{Size: 10, FillRate: 10, FillSchedule: []FillWindow{{StartHour: 22, EndHour: 6}}}
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Schedule should be valid. Error: %v", err)
+	}
+
+	b.FillSchedule[0].EndHour = 25
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Hours beyond a day should be invalid")
+	}
+
+	b.FillSchedule[0] = FillWindow{StartHour: 9, EndHour: 17, Timezone: "Nowhere/Special"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Unknown time zone should be invalid")
+	}
+}
+
+func TestValidateBloomDeduplication(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	b := &BucketConfig{Size: 10, FillRate: 10, BloomDeduplication: true, BloomWindowMs: 1000}
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Bloom deduplication should be valid. Error: %v", err)
+	}
+
+	b.BloomFPRate = 1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("False positive rates of 1 should be invalid")
+	}
+
+	b.BloomFPRate = 0
+	b.BloomWindowMs = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Bloom deduplication without a window should be invalid")
+	}
+}
+
+func TestValidateNamespaceAliases(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.NamespaceAliases = map[string]string{"a": "b", "b": "n"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Chained aliases should be valid. Error: %v", err)
+	}
+
+	cfg.NamespaceAliases["b"] = "a"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Circular aliases should be invalid")
+	}
+
+	cfg.NamespaceAliases = map[string]string{"a": "nonexistent"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Aliases of missing namespaces should be invalid")
+	}
+
+	cfg.NamespaceAliases = map[string]string{"n": "n"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Aliases named after namespaces should be invalid")
+	}
+}
+
+func TestValidatePriorityNamespaceMap(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.NamespaceAliases = map[string]string{"a": "n"}
+	cfg.PriorityNamespaceMap = map[int]string{0: "n", 1: "a"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Priorities mapped to namespaces and aliases should be valid. Error: %v", err)
+	}
+
+	cfg.PriorityNamespaceMap[2] = "nonexistent"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Priorities mapped to missing namespaces should be invalid")
+	}
+}
+
+func TestValidateMaxTokensPerRequest(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.GlobalMaxTokensPerRequest = 10
+	cfg.Namespaces["n"].MaxTokensPerRequest = 20
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Positive caps should be valid. Error: %v", err)
+	}
+
+	cfg.Namespaces["n"].MaxTokensPerRequest = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Negative namespace caps should be invalid")
+	}
+
+	cfg.Namespaces["n"].MaxTokensPerRequest = 0
+	cfg.GlobalMaxTokensPerRequest = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Negative global caps should be invalid")
+	}
+}
+
+func TestValidateCircuitBreaker(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].CircuitBreakerThreshold = 5
+	cfg.Namespaces["n"].CircuitBreakerResetTimeoutMs = 1000
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Circuit breaker should be valid. Error: %v", err)
+	}
+
+	cfg.Namespaces["n"].CircuitBreakerResetTimeoutMs = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Circuit breaker without a reset timeout should be invalid")
+	}
+
+	cfg.Namespaces["n"].CircuitBreakerThreshold = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Negative circuit breaker thresholds should be invalid")
+	}
+}
+
+func TestValidateMaxWaitCap(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["b"] = NewDefaultBucketConfig()
+	cfg.Namespaces["n"].Buckets["b"].MaxWaitCapMillis = 5000
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Max wait cap should be valid. Error: %v", err)
+	}
+
+	cfg.Namespaces["n"].Buckets["b"].MaxWaitCapMillis = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Negative max wait caps should be invalid")
+	}
+}
+
+func TestPersistStatsDefaults(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["b"] = &BucketConfig{Size: 10, PersistStats: true}
+	cfg.Namespaces["n"].Buckets["c"] = &BucketConfig{Size: 10}
+	ApplyDefaults(cfg)
+
+	if interval := cfg.Namespaces["n"].Buckets["b"].StatsFlushIntervalMs; interval != 10000 {
+		t.Fatalf("Expecting stats flushed every 10000ms. Was %v", interval)
+	}
+
+	if interval := cfg.Namespaces["n"].Buckets["c"].StatsFlushIntervalMs; interval != 0 {
+		t.Fatalf("Expecting no stats flush interval without persist_stats. Was %v", interval)
+	}
+
+	cfg.Namespaces["n"].Buckets["b"].StatsFlushIntervalMs = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Negative stats flush intervals should be invalid")
+	}
+}
+
+func TestValidateOperationBuckets(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].OperationBuckets = map[string]*BucketConfig{"read": {Size: 10}}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Operation buckets should be valid. Error: %v", err)
+	}
+
+	cfg.Namespaces["n"].OperationBuckets["write"] = &BucketConfig{FillRate: -1}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Operation bucket with a negative fill rate should be invalid")
+	}
+}
+
+func TestCyclicFallbacks(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["user"] = &BucketConfig{FallbackChain: []string{"n:account"}}
+	cfg.Namespaces["n"].Buckets["account"] = &BucketConfig{FallbackChain: []string{"m:plan"}}
+	cfg.Namespaces["m"] = NewDefaultNamespaceConfig()
+	cfg.Namespaces["m"].Buckets["plan"] = &BucketConfig{}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Fallback chain should be valid. Error: %v", err)
+	}
+
+	cfg.Namespaces["m"].Buckets["plan"].FallbackChain = []string{"n:user"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Cyclic fallback chain should be invalid")
+	}
+
+	if !HasCyclicFallbacks(cfg, "n", "account") {
+		t.Fatal("Expecting n:account to fall back to itself")
+	}
+
+	cfg.Namespaces["m"].Buckets["plan"].FallbackChain = []string{"plan"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Fallback that isn't fully qualified should be invalid")
+	}
+}
+
+func TestGlobalPolicy(t *testing.T) {
+	yaml := `global_policy:
+  max_idle_millis: 5000
+  max_dynamic_buckets: 20
+  dynamic_bucket_template:
+    size: 42
+namespaces:
+  n:
+    max_dynamic_buckets: 3
+`
+
+	cfg := readConfigFromBytes([]byte(yaml))
+	p := cfg.GlobalPolicy
+	if p == nil || p.MaxIdleMillis != 5000 || p.MaxDynamicBuckets != 20 || p.DynamicBucketTemplate.Size != 42 {
+		t.Fatalf("Expecting a global policy. Was %+v", p)
+	}
+
+	if p.DynamicBucketTemplate.FillRate != 50 {
+		t.Fatalf("Expecting defaults to be applied to the policy's template. Was %v", p.DynamicBucketTemplate)
+	}
+
+	merged := p.Apply(cfg.Namespaces["n"])
+	if merged.MaxDynamicBuckets != 3 || merged.DynamicBucketTemplate.MaxIdleMillis != 5000 {
+		t.Fatalf("Expecting the template to be inherited, and max_dynamic_buckets overridden. Was %+v", merged)
+	}
+
+	p.MaxDynamicBuckets = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Negative max_dynamic_buckets in the global policy should be invalid")
+	}
+}
+
+func TestValidateTimeMultipliers(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = NewDefaultNamespaceConfig()
+	b := &BucketConfig{Size: 10, FillRate: 10, TimeMultipliers: []TimeMultiplier{{StartHour: 22, EndHour: 6, Multiplier: 0.5}}}
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Multipliers should be valid. Error: %v", err)
+	}
+
+	for _, m := range []TimeMultiplier{
+		{StartHour: 9, EndHour: 9, Multiplier: 2},
+		{StartHour: 9, EndHour: 25, Multiplier: 2},
+		{StartHour: 9, EndHour: 17, Timezone: "Nowhere/Special", Multiplier: 2},
+		{StartHour: 9, EndHour: 17, Multiplier: 0}} {
+		b.TimeMultipliers[0] = m
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("Multiplier %+v should be invalid", m)
+		}
+	}
+}
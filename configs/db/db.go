@@ -0,0 +1,217 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package db implements a configs.ConfigSource that loads per-tenant bucket configs from a
+// database table. Each row returned by the configured query describes one bucket, using the
+// columns:
+//
+//	namespace            the namespace of the bucket; required.
+//	bucket               the name of the bucket. Empty or NULL for the namespace's default
+//	                     bucket, and "*" for its dynamic bucket template.
+//	max_size             the bucket's size.
+//	fill_rate            tokens added per second.
+//	wait_timeout_millis  the longest a request may wait for tokens.
+//	max_idle_millis      how long a dynamic bucket may be idle before it is removed.
+//	max_debt_millis      how far into the future tokens may be borrowed.
+//
+// Only namespace is required, and columns may be returned in any order. NULL values take the
+// defaults of a YAML config. For example:
+//
+//	source := db.NewDBConfigSource(sqlDB,
+//	    "SELECT tenant AS namespace, bucket, max_size, fill_rate FROM quotas", time.Minute)
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// DynamicBucketName is the bucket name of rows describing a namespace's dynamic bucket template.
+const DynamicBucketName = "*"
+
+type dbConfigSource struct {
+	db                   *sql.DB
+	query                string
+	pollInterval         time.Duration
+	updates              chan *configs.ServiceConfig
+	stopper              chan struct{}
+	watchOnce, closeOnce sync.Once
+}
+
+// NewDBConfigSource creates a ConfigSource that runs query against db to load configs, and polls
+// for changes every pollInterval once watched.
+func NewDBConfigSource(db *sql.DB, query string, pollInterval time.Duration) configs.ConfigSource {
+	if pollInterval <= 0 {
+		panic(fmt.Sprintf("Poll interval should be positive, but is %v", pollInterval))
+	}
+
+	return &dbConfigSource{
+		db:           db,
+		query:        query,
+		pollInterval: pollInterval,
+		updates:      make(chan *configs.ServiceConfig, 1),
+		stopper:      make(chan struct{})}
+}
+
+func (s *dbConfigSource) Load() (*configs.ServiceConfig, error) {
+	rows, err := s.db.Query(s.query)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query configs: %v", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read columns: %v", err)
+	}
+
+	r, err := newRow(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = nil
+	for rows.Next() {
+		if err := rows.Scan(r.dest...); err != nil {
+			return nil, fmt.Errorf("Unable to read row: %v", err)
+		}
+
+		if err := r.addTo(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read rows: %v", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return configs.ApplyDefaults(cfg), nil
+}
+
+func (s *dbConfigSource) Watch() <-chan *configs.ServiceConfig {
+	s.watchOnce.Do(func() {
+		go s.poll()
+	})
+
+	return s.updates
+}
+
+func (s *dbConfigSource) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stopper)
+	})
+}
+
+// poll loads configs every pollInterval, sending them on the updates channel when they change.
+// Configs that fail to load are logged and skipped.
+func (s *dbConfigSource) poll() {
+	defer close(s.updates)
+
+	var last *configs.ServiceConfig
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if cfg, err := s.Load(); err != nil {
+			logging.Printf("Unable to load configs from the database: %v", err)
+		} else if !reflect.DeepEqual(cfg, last) {
+			last = cfg
+			// Replace any update the receiver hasn't received yet.
+			select {
+			case <-s.updates:
+			default:
+			}
+			s.updates <- cfg
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stopper:
+			return
+		}
+	}
+}
+
+// row holds the values of a row, scanned into the columns of the schema.
+type row struct {
+	namespace, bucket sql.NullString
+	ints              map[string]*sql.NullInt64
+	dest              []interface{}
+}
+
+func newRow(columns []string) (*row, error) {
+	r := &row{ints: make(map[string]*sql.NullInt64)}
+	hasNamespace := false
+	for _, c := range columns {
+		switch c {
+		case "namespace":
+			hasNamespace = true
+			r.dest = append(r.dest, &r.namespace)
+		case "bucket":
+			r.dest = append(r.dest, &r.bucket)
+		case "max_size", "fill_rate", "wait_timeout_millis", "max_idle_millis", "max_debt_millis":
+			v := &sql.NullInt64{}
+			r.ints[c] = v
+			r.dest = append(r.dest, v)
+		default:
+			return nil, fmt.Errorf("Unknown column %v", c)
+		}
+	}
+
+	if !hasNamespace {
+		return nil, fmt.Errorf("Query doesn't return a namespace column")
+	}
+
+	return r, nil
+}
+
+// addTo adds the bucket described by the row to cfg, creating its namespace if needed.
+func (r *row) addTo(cfg *configs.ServiceConfig) error {
+	if !r.namespace.Valid || r.namespace.String == "" {
+		return fmt.Errorf("Row has no namespace")
+	}
+
+	ns := cfg.Namespaces[r.namespace.String]
+	if ns == nil {
+		ns = configs.NewDefaultNamespaceConfig()
+		cfg.Namespaces[r.namespace.String] = ns
+	}
+
+	b := &configs.BucketConfig{
+		Size:              r.int("max_size"),
+		FillRate:          r.int("fill_rate"),
+		WaitTimeoutMillis: r.int("wait_timeout_millis"),
+		MaxIdleMillis:     r.int("max_idle_millis"),
+		MaxDebtMillis:     r.int("max_debt_millis")}
+
+	switch name := r.bucket.String; {
+	case !r.bucket.Valid || name == "":
+		ns.DefaultBucket = b
+	case name == DynamicBucketName:
+		ns.DynamicBucketTemplate = b
+	default:
+		ns.Buckets[name] = b
+	}
+
+	return nil
+}
+
+// int returns the value of an integer column, or 0 if it is NULL or not returned by the query.
+func (r *row) int(column string) int64 {
+	if v := r.ints[column]; v != nil && v.Valid {
+		return v.Int64
+	}
+
+	return 0
+}
@@ -0,0 +1,182 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver serves the same result to every query.
+type fakeDriver struct {
+	columns []string
+	rows    [][]driver.Value
+	sync.Mutex
+}
+
+var fake = &fakeDriver{}
+
+func init() {
+	sql.Register("fake", fake)
+}
+
+func (d *fakeDriver) set(columns []string, rows ...[]driver.Value) {
+	d.Lock()
+	defer d.Unlock()
+	d.columns, d.rows = columns, rows
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c.d}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, driver.ErrSkip
+}
+
+type fakeStmt struct {
+	d *fakeDriver
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return 0
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.Lock()
+	defer s.d.Unlock()
+	return &fakeRows{columns: s.d.columns, rows: s.d.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var columns = []string{"namespace", "bucket", "max_size", "fill_rate", "max_idle_millis"}
+
+func newSource(t *testing.T) *dbConfigSource {
+	db, err := sql.Open("fake", "")
+	if err != nil {
+		t.Fatalf("Unable to open database. Error: %v", err)
+	}
+
+	return NewDBConfigSource(db, "SELECT * FROM quotas", 10*time.Millisecond).(*dbConfigSource)
+}
+
+func TestLoad(t *testing.T) {
+	fake.set(columns,
+		[]driver.Value{"tenant_a", nil, int64(1000), int64(100), nil},
+		[]driver.Value{"tenant_a", "uploads", int64(10), int64(1), nil},
+		[]driver.Value{"tenant_b", DynamicBucketName, nil, int64(20), int64(30000)})
+
+	cfg, err := newSource(t).Load()
+	if err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	if cfg.GlobalDefaultBucket != nil || len(cfg.Namespaces) != 2 {
+		t.Fatalf("Expecting 2 namespaces and no global default bucket. Was %+v", cfg)
+	}
+
+	a := cfg.Namespaces["tenant_a"]
+	if a.DefaultBucket.Size != 1000 || a.DefaultBucket.FillRate != 100 {
+		t.Fatalf("Unexpected default bucket %v", a.DefaultBucket)
+	}
+
+	if b := a.Buckets["uploads"]; b == nil || b.Size != 10 || b.FillRate != 1 {
+		t.Fatalf("Unexpected named bucket %v", b)
+	}
+
+	// NULLs take defaults.
+	template := cfg.Namespaces["tenant_b"].DynamicBucketTemplate
+	if template.Size != 100 || template.FillRate != 20 || template.MaxIdleMillis != 30000 || template.WaitTimeoutMillis != 1000 {
+		t.Fatalf("Unexpected dynamic bucket template %v", template)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		columns []string
+		rows    [][]driver.Value
+	}{
+		"unknown column": {[]string{"namespace", "colour"}, [][]driver.Value{{"ns", "red"}}},
+		"no namespace":   {[]string{"bucket"}, [][]driver.Value{{"b"}}},
+		"null namespace": {columns, [][]driver.Value{{nil, "b", int64(1), int64(1), nil}}},
+		"negative size":  {columns, [][]driver.Value{{"ns", "b", int64(-1), int64(1), nil}}},
+		"both defaults":  {columns, [][]driver.Value{{"ns", nil, nil, nil, nil}, {"ns", DynamicBucketName, nil, nil, nil}}},
+	} {
+		fake.set(test.columns, test.rows...)
+		if _, err := newSource(t).Load(); err == nil {
+			t.Fatalf("%v: expecting an error", name)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	fake.set(columns, []driver.Value{"ns", nil, int64(10), nil, nil})
+	s := newSource(t)
+	updates := s.Watch()
+
+	if cfg := <-updates; cfg.Namespaces["ns"].DefaultBucket.Size != 10 {
+		t.Fatalf("Expecting the initial config. Was %v", cfg.Namespaces["ns"].DefaultBucket)
+	}
+
+	fake.set(columns, []driver.Value{"ns", nil, int64(20), nil, nil})
+	select {
+	case cfg := <-updates:
+		if cfg.Namespaces["ns"].DefaultBucket.Size != 20 {
+			t.Fatalf("Expecting the updated config. Was %v", cfg.Namespaces["ns"].DefaultBucket)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expecting the updated config to be sent")
+	}
+
+	s.Close()
+	for range updates {
+		// Drain any update sent before closing.
+	}
+}
@@ -0,0 +1,121 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package configs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Registry holds named bucket configurations, shared by multiple BucketContainers. Buckets in a
+// NamespaceConfig reference a registry entry using its name with a $ prefix; in YAML:
+//
+//	namespaces:
+//	  tenant_shard_1:
+//	    buckets:
+//	      api: $shared_api
+//
+// References are replaced with a copy of the registry entry by Resolve(). Subscribers are notified
+// of updates, and are expected to apply them to their buckets, for example using Bucket.Tune().
+type Registry struct {
+	configs     map[string]*BucketConfig
+	subscribers map[string][]chan *BucketConfig
+	sync.RWMutex // Embedded mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		configs:     make(map[string]*BucketConfig),
+		subscribers: make(map[string][]chan *BucketConfig)}
+}
+
+// Register adds or replaces a named bucket configuration, without notifying subscribers.
+func (r *Registry) Register(name string, cfg *BucketConfig) {
+	r.Lock()
+	defer r.Unlock()
+	r.configs[name] = cfg
+}
+
+// Get returns a named bucket configuration, if it has been registered.
+func (r *Registry) Get(name string) (*BucketConfig, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	cfg, ok := r.configs[name]
+	return cfg, ok
+}
+
+// Subscribe returns a channel on which updates to a named bucket configuration are sent. Slow
+// subscribers only receive the latest update.
+func (r *Registry) Subscribe(name string) <-chan *BucketConfig {
+	r.Lock()
+	defer r.Unlock()
+	ch := make(chan *BucketConfig, 1)
+	r.subscribers[name] = append(r.subscribers[name], ch)
+	return ch
+}
+
+// Update replaces a registered bucket configuration, and notifies its subscribers.
+func (r *Registry) Update(name string, cfg *BucketConfig) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.configs[name] == nil {
+		return fmt.Errorf("Bucket config %v is not registered", name)
+	}
+
+	r.configs[name] = cfg
+	for _, ch := range r.subscribers[name] {
+		// Replace any update the subscriber hasn't received yet.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- cfg
+	}
+
+	return nil
+}
+
+// Resolve replaces all references to registry entries in a configuration's namespaces with copies
+// of the entries.
+func (r *Registry) Resolve(cfg *ServiceConfig) error {
+	r.RLock()
+	defer r.RUnlock()
+
+	for nsName, ns := range cfg.Namespaces {
+		for bName, b := range ns.Buckets {
+			if b == nil || b.Ref == "" {
+				continue
+			}
+
+			registered := r.configs[b.Ref]
+			if registered == nil {
+				return fmt.Errorf("Bucket %v:%v references $%v, which is not registered", nsName, bName, b.Ref)
+			}
+
+			resolved := *registered
+			ns.Buckets[bName] = &resolved
+		}
+	}
+
+	return nil
+}
+
+// ReadConfigWithRegistry reads a configuration, resolving references to registry entries before
+// applying defaults.
+func ReadConfigWithRegistry(yamlStream io.Reader, r *Registry) *ServiceConfig {
+	bytes, err := ioutil.ReadAll(yamlStream)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to open reader. Error: %v", err))
+	}
+
+	cfg := unmarshalConfig(bytes)
+	if err := r.Resolve(cfg); err != nil {
+		panic(err.Error())
+	}
+
+	return ApplyDefaults(cfg)
+}
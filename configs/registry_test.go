@@ -0,0 +1,92 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package configs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/test"
+)
+
+func TestRegisterAndGet(t *testing.T) {
+	r := NewRegistry()
+	cfg := NewDefaultBucketConfig()
+	r.Register("shared", cfg)
+
+	if got, ok := r.Get("shared"); !ok || got != cfg {
+		t.Fatalf("Expecting registered config. Was %v", got)
+	}
+
+	if _, ok := r.Get("nonexistent"); ok {
+		t.Fatal("Not expecting a config that hasn't been registered")
+	}
+}
+
+func TestUpdateNotification(t *testing.T) {
+	r := NewRegistry()
+	r.Register("shared", NewDefaultBucketConfig())
+	updates := r.Subscribe("shared")
+
+	first := NewDefaultBucketConfig()
+	latest := NewDefaultBucketConfig()
+	latest.FillRate = 1000
+	r.Update("shared", first)
+	r.Update("shared", latest)
+
+	select {
+	case cfg := <-updates:
+		if cfg != latest {
+			t.Fatalf("Expecting the latest update. Was %v", cfg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expecting an update")
+	}
+
+	if got, _ := r.Get("shared"); got != latest {
+		t.Fatalf("Expecting the updated config. Was %v", got)
+	}
+
+	if err := r.Update("nonexistent", latest); err == nil {
+		t.Fatal("Expecting an error updating a config that hasn't been registered")
+	}
+}
+
+func TestReadConfigWithRegistry(t *testing.T) {
+	yaml := `namespaces:
+  shard1:
+    buckets:
+      api: $shared
+  shard2:
+    buckets:
+      api: $shared
+      own:
+        fill_rate: 10
+`
+
+	r := NewRegistry()
+	r.Register("shared", &BucketConfig{Size: 500, FillRate: 200})
+	cfg := ReadConfigWithRegistry(strings.NewReader(yaml), r)
+
+	for _, ns := range []string{"shard1", "shard2"} {
+		b := cfg.Namespaces[ns].Buckets["api"]
+		if b.Size != 500 || b.FillRate != 200 || b.WaitTimeoutMillis != 1000 {
+			t.Fatalf("Expecting %v:api to use the registered config, with defaults. Was %+v", ns, b)
+		}
+	}
+
+	if b := cfg.Namespaces["shard2"].Buckets["own"]; b.FillRate != 10 {
+		t.Fatalf("Expecting shard2:own to use its own config. Was %+v", b)
+	}
+
+	// Unresolved references are rejected.
+	test.ExpectingPanic(t, func() {
+		ReadConfig(strings.NewReader(yaml))
+	})
+
+	test.ExpectingPanic(t, func() {
+		ReadConfigWithRegistry(strings.NewReader(yaml), NewRegistry())
+	})
+}
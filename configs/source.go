@@ -0,0 +1,16 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package configs
+
+// ConfigSource loads ServiceConfigs from outside the quota service, such as from a database, and
+// watches for changes to them.
+type ConfigSource interface {
+	// Load returns the current config, with defaults applied.
+	Load() (*ServiceConfig, error)
+	// Watch returns a channel on which the config is sent each time it changes, until Close() is
+	// called. Slow receivers only receive the latest config.
+	Watch() <-chan *ServiceConfig
+	// Close stops watching for changes, and closes the channel returned by Watch().
+	Close()
+}
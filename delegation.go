@@ -0,0 +1,160 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+)
+
+// DelegationToken allows one service to take tokens from a bucket of another, which has quota to
+// spare. Tokens are signed by the quota service issuing them, so they can't be altered by the
+// services they are handed to.
+type DelegationToken struct {
+	FromService, FromNamespace, FromBucket string
+	ToService, ToNamespace, ToBucket       string
+	// Tokens is the total number of tokens that may be taken using this delegation.
+	Tokens    int64
+	Expires   time.Time
+	Signature []byte
+}
+
+// Delegation is implemented by QuotaServices that allow services to borrow quota from each other.
+type Delegation interface {
+	// Delegate issues a token allowing toService to take up to tokens tokens from the bucket
+	// fromNamespace:fromBucket of fromService, for the duration of expiry.
+	Delegate(fromService, fromNamespace, fromBucket, toService, toNamespace, toBucket string, tokens int64, expiry time.Duration) (DelegationToken, error)
+
+	// AllowWithDelegation is like Allow, but takes tokens from the bucket a delegation token was
+	// issued for. The token must be unexpired, and have enough tokens left.
+	AllowWithDelegation(token DelegationToken, numTokens int64) (granted int64, waitTime time.Duration, err error)
+}
+
+// delegations signs delegation tokens, and keeps track of the tokens used with each of them.
+// Tokens are signed with a key generated when the quota service is created, so they are only
+// honored by the quota service that issued them.
+type delegations struct {
+	key  []byte
+	used map[string]*delegationUse
+	sync.Mutex
+}
+
+type delegationUse struct {
+	tokens  int64
+	expires time.Time
+}
+
+func newDelegations() *delegations {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("Unable to generate a delegation key: %v", err))
+	}
+
+	return &delegations{key: key, used: make(map[string]*delegationUse)}
+}
+
+func (d *delegations) sign(t *DelegationToken) []byte {
+	mac := hmac.New(sha256.New, d.key)
+	// Strings are length-prefixed, so that moving bytes between fields changes the signature.
+	for _, s := range []string{t.FromService, t.FromNamespace, t.FromBucket, t.ToService, t.ToNamespace, t.ToBucket} {
+		binary.Write(mac, binary.BigEndian, int64(len(s)))
+		mac.Write([]byte(s))
+	}
+	binary.Write(mac, binary.BigEndian, t.Tokens)
+	binary.Write(mac, binary.BigEndian, t.Expires.UnixNano())
+	return mac.Sum(nil)
+}
+
+// use records numTokens being taken using a token, returning an error if numTokens isn't positive,
+// or the token is invalid, expired or doesn't have enough tokens left.
+func (d *delegations) use(t *DelegationToken, numTokens int64) error {
+	if numTokens < 1 {
+		// Negative requests would otherwise add tokens back to the delegation.
+		return newError(fmt.Sprintf("Delegation requests need at least 1 token. Was %v.", numTokens), ER_REJECTED)
+	}
+
+	if !hmac.Equal(t.Signature, d.sign(t)) {
+		return newError("Invalid delegation token.", ER_REJECTED)
+	}
+
+	now := time.Now()
+	if !now.Before(t.Expires) {
+		return newError("Delegation token has expired.", ER_REJECTED)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for sig, u := range d.used {
+		if !now.Before(u.expires) {
+			delete(d.used, sig)
+		}
+	}
+
+	u := d.used[string(t.Signature)]
+	if u == nil {
+		u = &delegationUse{expires: t.Expires}
+		d.used[string(t.Signature)] = u
+	}
+
+	if u.tokens+numTokens > t.Tokens {
+		return newError(fmt.Sprintf("Delegation token has %v tokens left.", t.Tokens-u.tokens), ER_REJECTED)
+	}
+
+	u.tokens += numTokens
+	return nil
+}
+
+// release returns tokens recorded by use() that weren't granted.
+func (d *delegations) release(t *DelegationToken, numTokens int64) {
+	d.Lock()
+	defer d.Unlock()
+
+	if u := d.used[string(t.Signature)]; u != nil {
+		u.tokens -= numTokens
+	}
+}
+
+func (s *server) Delegate(fromService, fromNamespace, fromBucket, toService, toNamespace, toBucket string, tokens int64, expiry time.Duration) (DelegationToken, error) {
+	if tokens < 1 || expiry <= 0 {
+		return DelegationToken{}, fmt.Errorf("Delegations need tokens and an expiry. Were %v and %v", tokens, expiry)
+	}
+
+	if b, _ := s.bucketContainer.FindBucket(fromNamespace, fromBucket); b == nil {
+		return DelegationToken{}, newError(fmt.Sprintf("No such bucket %v:%v.", fromNamespace, fromBucket), ER_NO_SUCH_BUCKET)
+	}
+
+	t := DelegationToken{
+		FromService:   fromService,
+		FromNamespace: fromNamespace,
+		FromBucket:    fromBucket,
+		ToService:     toService,
+		ToNamespace:   toNamespace,
+		ToBucket:      toBucket,
+		Tokens:        tokens,
+		Expires:       time.Now().Add(expiry)}
+	t.Signature = s.delegations.sign(&t)
+	return t, nil
+}
+
+func (s *server) AllowWithDelegation(token DelegationToken, numTokens int64) (granted int64, waitTime time.Duration, err error) {
+	if err = s.delegations.use(&token, numTokens); err != nil {
+		s.bucketContainer.RecordEvent(token.FromNamespace, token.FromBucket, numTokens, buckets.EVENT_REJECTED)
+		return
+	}
+
+	granted, waitTime, err = s.Allow(token.FromNamespace, token.FromBucket, numTokens, -1)
+	if err != nil {
+		s.delegations.release(&token, numTokens)
+	}
+
+	return
+}
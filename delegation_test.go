@@ -0,0 +1,102 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+func newDelegationServer() *server {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = nil
+	cfg.Namespaces["a"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["a"].DefaultBucket = configs.NewDefaultBucketConfig()
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	return s
+}
+
+func expectRejected(t *testing.T, err error) {
+	if qsErr, ok := err.(QuotaServiceError); !ok || qsErr.Reason != ER_REJECTED {
+		t.Fatalf("Expecting ER_REJECTED. Was %v", err)
+	}
+}
+
+func TestValidDelegation(t *testing.T) {
+	s := newDelegationServer()
+	defer s.Stop()
+
+	token, err := s.Delegate("service-a", "a", "b", "service-b", "b", "b", 10, time.Minute)
+	if err != nil {
+		t.Fatalf("Unable to delegate: %v", err)
+	}
+
+	if granted, _, err := s.AllowWithDelegation(token, 6); err != nil || granted != 6 {
+		t.Fatalf("Expecting 6 tokens granted. Was %v, %v", granted, err)
+	}
+
+	// Only 4 of the delegated tokens are left.
+	_, _, err = s.AllowWithDelegation(token, 6)
+	expectRejected(t, err)
+
+	if granted, _, err := s.AllowWithDelegation(token, 4); err != nil || granted != 4 {
+		t.Fatalf("Expecting 4 tokens granted. Was %v, %v", granted, err)
+	}
+}
+
+func TestDelegationWithoutTokens(t *testing.T) {
+	s := newDelegationServer()
+	defer s.Stop()
+
+	token, _ := s.Delegate("service-a", "a", "b", "service-b", "b", "b", 10, time.Minute)
+	for _, numTokens := range []int64{0, -10} {
+		_, _, err := s.AllowWithDelegation(token, numTokens)
+		expectRejected(t, err)
+	}
+
+	// Negative requests haven't added tokens to the delegation.
+	_, _, err := s.AllowWithDelegation(token, 11)
+	expectRejected(t, err)
+}
+
+func TestDelegationFromMissingBucket(t *testing.T) {
+	s := newDelegationServer()
+	defer s.Stop()
+
+	_, err := s.Delegate("service-a", "nonexistent", "b", "service-b", "b", "b", 10, time.Minute)
+	if qsErr, ok := err.(QuotaServiceError); !ok || qsErr.Reason != ER_NO_SUCH_BUCKET {
+		t.Fatalf("Expecting ER_NO_SUCH_BUCKET. Was %v", err)
+	}
+}
+
+func TestExpiredDelegation(t *testing.T) {
+	s := newDelegationServer()
+	defer s.Stop()
+
+	token, _ := s.Delegate("service-a", "a", "b", "service-b", "b", "b", 10, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	_, _, err := s.AllowWithDelegation(token, 1)
+	expectRejected(t, err)
+}
+
+func TestTamperedDelegation(t *testing.T) {
+	s := newDelegationServer()
+	defer s.Stop()
+
+	token, _ := s.Delegate("service-a", "a", "b", "service-b", "b", "b", 10, time.Minute)
+	token.Tokens = 1000
+	_, _, err := s.AllowWithDelegation(token, 100)
+	expectRejected(t, err)
+
+	// Tokens issued by another quota service aren't honored either.
+	other := newDelegationServer()
+	defer other.Stop()
+	token, _ = other.Delegate("service-a", "a", "b", "service-b", "b", "b", 10, time.Minute)
+	_, _, err = s.AllowWithDelegation(token, 1)
+	expectRejected(t, err)
+}
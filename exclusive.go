@@ -0,0 +1,85 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// TakeExclusive implements ExclusiveTaking. Lease IDs are prefixed with the fully qualified name of
+// the bucket they lease, so that they can be released against any instance.
+func (s *server) TakeExclusive(ctx context.Context, namespace string, name string, lockTTL time.Duration) (granted int64, waitTime time.Duration, leaseID string, err error) {
+	// Leases expire with millisecond precision, so shorter TTLs would round down to none.
+	if lockTTL < time.Millisecond {
+		err = newError(fmt.Sprintf("Lock TTL %v should be at least 1ms.", lockTTL), ER_REJECTED)
+		return
+	}
+
+	b, err := s.findBucket(namespace, name, 1, nil)
+	if err != nil {
+		return
+	}
+
+	eb, ok := b.(buckets.ExclusiveBucket)
+	if !ok {
+		s.bucketContainer.RecordEvent(namespace, name, 1, buckets.EVENT_REJECTED)
+		err = newError(fmt.Sprintf("Bucket %v:%v doesn't support exclusive takes.", namespace, name), ER_REJECTED)
+		return
+	}
+
+	waitTime, bucketLeaseID, takeErr := eb.TakeExclusive(ctx, maxWait(b.Config(), -1), lockTTL)
+	switch {
+	case takeErr == buckets.ErrLeaseHeld:
+		s.bucketContainer.RecordEvent(namespace, name, 1, buckets.EVENT_REJECTED)
+		err = rejectedBy(b, newError(fmt.Sprintf("Lease on %v:%v held by another caller.", namespace, name), ER_REJECTED))
+	case takeErr != nil:
+		s.bucketContainer.RecordEvent(namespace, name, 1, buckets.EVENT_REJECTED)
+		err = newError(fmt.Sprintf("Unable to take %v:%v exclusively: %v", namespace, name, takeErr), ER_REJECTED)
+	case waitTime < 0:
+		waitTime = 0
+		s.bucketContainer.RecordEvent(namespace, name, 1, buckets.EVENT_REJECTED)
+		err = rejectedBy(b, newError(fmt.Sprintf("Timed out waiting on %v:%v", namespace, name), ER_TIMED_OUT_WAITING))
+	default:
+		granted = 1
+		leaseID = buckets.FullyQualifiedName(namespace, name) + "/" + bucketLeaseID
+		if waitTime > 0 {
+			s.bucketContainer.RecordEvent(namespace, name, 1, buckets.EVENT_OK_WAIT)
+		} else {
+			s.bucketContainer.RecordEvent(namespace, name, 1, buckets.EVENT_OK)
+		}
+	}
+
+	return
+}
+
+// ReleaseExclusive implements ExclusiveTaking.
+func (s *server) ReleaseExclusive(leaseID string) error {
+	i := strings.LastIndex(leaseID, "/")
+	if i < 0 {
+		return newError(fmt.Sprintf("Malformed lease ID %v.", leaseID), ER_REJECTED)
+	}
+
+	namespace, name, ok := configs.SplitFullyQualifiedName(leaseID[:i])
+	if !ok {
+		return newError(fmt.Sprintf("Malformed lease ID %v.", leaseID), ER_REJECTED)
+	}
+
+	b, _ := s.bucketContainer.FindBucket(namespace, name)
+	eb, ok := b.(buckets.ExclusiveBucket)
+	if !ok {
+		return newError(fmt.Sprintf("No such bucket %v:%v.", namespace, name), ER_NO_SUCH_BUCKET)
+	}
+
+	if err := eb.ReleaseExclusive(leaseID[i+1:]); err != nil {
+		return newError(fmt.Sprintf("Unable to release lease on %v:%v: %v", namespace, name, err), ER_REJECTED)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package federation shares token usage between quota services, such as those in different
+// regions, so that together they approximately enforce a single set of limits. Requests are served
+// by the local quota service, and token counts are gossiped between peers in the background, so
+// limits are only eventually consistent.
+package federation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice"
+	"github.com/maniksurtani/quotaservice/logging"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+)
+
+type bucketKey struct {
+	namespace, name string
+}
+
+// FederatedQuotaService serves requests using a local QuotaService, and periodically exchanges the
+// number of tokens granted by each bucket with its peers, using the SyncTokenCounts RPC. Each node
+// only ever increases its own counts, so counts received from peers are merged by taking the
+// maximum per node, and converge regardless of the order they are received in. Tokens granted by
+// other nodes are charged to the local buckets once learned of, on a best-effort basis, using
+// Allow() without a maximum wait.
+type FederatedQuotaService struct {
+	local  quotaservice.QuotaService
+	peers  []qspb.QuotaServiceFederationClient
+	nodeID string
+	// counts holds the number of tokens granted by each bucket, per node ID.
+	counts map[bucketKey]map[string]int64
+	// charged holds the number of tokens granted by other nodes that have been charged locally.
+	charged map[bucketKey]int64
+	stopper chan struct{}
+	sync.Mutex // Embedded mutex
+}
+
+// NewFederatedQuotaService creates a FederatedQuotaService that syncs with peers every
+// syncInterval. The FederatedQuotaService also needs to be served to its peers, as a
+// QuotaServiceFederationServer.
+func NewFederatedQuotaService(local quotaservice.QuotaService, peers []qspb.QuotaServiceFederationClient, syncInterval time.Duration) *FederatedQuotaService {
+	f := &FederatedQuotaService{
+		local:   local,
+		peers:   peers,
+		nodeID:  newNodeID(),
+		counts:  make(map[bucketKey]map[string]int64),
+		charged: make(map[bucketKey]int64),
+		stopper: make(chan struct{})}
+
+	go f.syncLoop(syncInterval)
+	return f
+}
+
+// newNodeID identifies this process. A restarted process is a new node, so counts from its
+// previous life are kept by its peers.
+func newNodeID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Stop stops syncing with peers.
+func (f *FederatedQuotaService) Stop() {
+	close(f.stopper)
+}
+
+func (f *FederatedQuotaService) syncLoop(syncInterval time.Duration) {
+	t := time.NewTicker(syncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			f.sync(syncInterval)
+		case <-f.stopper:
+			return
+		}
+	}
+}
+
+// sync pushes all known counts to each peer, and merges the counts they know of in return.
+func (f *FederatedQuotaService) sync(timeout time.Duration) {
+	req := &qspb.SyncTokenCountsRequest{Counts: f.snapshot()}
+	for _, peer := range f.peers {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		rsp, err := peer.SyncTokenCounts(ctx, req)
+		cancel()
+		if err != nil {
+			logging.Printf("Unable to sync token counts with peer: %v", err)
+			continue
+		}
+
+		f.merge(rsp.GetCounts())
+	}
+}
+
+// SyncTokenCounts merges a peer's counts, and returns all counts known to this node.
+func (f *FederatedQuotaService) SyncTokenCounts(ctx context.Context, req *qspb.SyncTokenCountsRequest) (*qspb.SyncTokenCountsResponse, error) {
+	f.merge(req.GetCounts())
+	return &qspb.SyncTokenCountsResponse{Counts: f.snapshot()}, nil
+}
+
+func (f *FederatedQuotaService) snapshot() []*qspb.TokenCount {
+	f.Lock()
+	defer f.Unlock()
+
+	var counts []*qspb.TokenCount
+	for key, perNode := range f.counts {
+		for node, tokens := range perNode {
+			counts = append(counts, &qspb.TokenCount{
+				NodeId:        proto.String(node),
+				Namespace:     proto.String(key.namespace),
+				Name:          proto.String(key.name),
+				TokensGranted: proto.Int64(tokens)})
+		}
+	}
+
+	return counts
+}
+
+// merge takes the maximum of each node's known and received counts, and charges any new tokens
+// granted by other nodes to the local buckets.
+func (f *FederatedQuotaService) merge(counts []*qspb.TokenCount) {
+	f.Lock()
+	updated := make(map[bucketKey]bool)
+	for _, c := range counts {
+		if c.GetNodeId() == f.nodeID {
+			// This node's own counts are always up to date.
+			continue
+		}
+
+		key := bucketKey{c.GetNamespace(), c.GetName()}
+		perNode := f.perNode(key)
+		if c.GetTokensGranted() > perNode[c.GetNodeId()] {
+			perNode[c.GetNodeId()] = c.GetTokensGranted()
+			updated[key] = true
+		}
+	}
+
+	charges := make(map[bucketKey]int64)
+	for key := range updated {
+		var remote int64
+		for node, tokens := range f.counts[key] {
+			if node != f.nodeID {
+				remote += tokens
+			}
+		}
+
+		if delta := remote - f.charged[key]; delta > 0 {
+			charges[key] = delta
+			f.charged[key] = remote
+		}
+	}
+	f.Unlock()
+
+	for key, tokens := range charges {
+		f.local.Allow(key.namespace, key.name, tokens, 0)
+	}
+}
+
+func (f *FederatedQuotaService) perNode(key bucketKey) map[string]int64 {
+	perNode := f.counts[key]
+	if perNode == nil {
+		perNode = make(map[string]int64)
+		f.counts[key] = perNode
+	}
+
+	return perNode
+}
+
+func (f *FederatedQuotaService) recordGrant(namespace, name string, granted int64) {
+	if granted <= 0 {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.perNode(bucketKey{namespace, name})[f.nodeID] += granted
+}
+
+// GrantedTokens returns the number of tokens granted by a bucket across all nodes, as far as this
+// node knows.
+func (f *FederatedQuotaService) GrantedTokens(namespace, name string) int64 {
+	f.Lock()
+	defer f.Unlock()
+
+	var total int64
+	for _, tokens := range f.counts[bucketKey{namespace, name}] {
+		total += tokens
+	}
+
+	return total
+}
+
+func (f *FederatedQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	granted, waitTime, err := f.local.Allow(namespace, name, tokensRequested, maxWaitMillisOverride)
+	f.recordGrant(namespace, name, granted)
+	return granted, waitTime, err
+}
+
+func (f *FederatedQuotaService) AllowOp(namespace string, name string, operationType string, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	granted, waitTime, err := f.local.AllowOp(namespace, name, operationType, maxWaitMillisOverride)
+	f.recordGrant(namespace, name, granted)
+	return granted, waitTime, err
+}
+
+func (f *FederatedQuotaService) AllowWithMeta(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64, meta map[string]string) (int64, time.Duration, error) {
+	granted, waitTime, err := f.local.AllowWithMeta(namespace, name, tokensRequested, maxWaitMillisOverride, meta)
+	f.recordGrant(namespace, name, granted)
+	return granted, waitTime, err
+}
+
+// DonateTokens donates tokens locally. Donations aren't shared with peers.
+func (f *FederatedQuotaService) DonateTokens(fromNamespace, toNamespace string, tokens int64) error {
+	return f.local.DonateTokens(fromNamespace, toNamespace, tokens)
+}
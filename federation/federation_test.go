@@ -0,0 +1,123 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package federation
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// mockQuotaService grants all requests, and remembers the tokens requested from each bucket.
+type mockQuotaService struct {
+	requested map[string]int64
+	sync.Mutex
+}
+
+func newMockQuotaService() *mockQuotaService {
+	return &mockQuotaService{requested: make(map[string]int64)}
+}
+
+func (m *mockQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.requested[namespace + ":" + name] += tokensRequested
+	return tokensRequested, 0, nil
+}
+
+func (m *mockQuotaService) AllowOp(namespace string, name string, operationType string, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return m.Allow(namespace, name, 1, maxWaitMillisOverride)
+}
+
+func (m *mockQuotaService) AllowWithMeta(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64, meta map[string]string) (int64, time.Duration, error) {
+	return m.Allow(namespace, name, tokensRequested, maxWaitMillisOverride)
+}
+
+func (m *mockQuotaService) DonateTokens(fromNamespace, toNamespace string, tokens int64) error {
+	return nil
+}
+
+func (m *mockQuotaService) requestedFrom(fqn string) int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.requested[fqn]
+}
+
+// inProcessPeer calls a FederatedQuotaService directly, in place of a gRPC client.
+type inProcessPeer struct {
+	f *FederatedQuotaService
+}
+
+func (p *inProcessPeer) SyncTokenCounts(ctx context.Context, in *qspb.SyncTokenCountsRequest, opts ...grpc.CallOption) (*qspb.SyncTokenCountsResponse, error) {
+	return p.f.SyncTokenCounts(ctx, in)
+}
+
+func TestTwoNodeConvergence(t *testing.T) {
+	localA, localB := newMockQuotaService(), newMockQuotaService()
+	peerA, peerB := &inProcessPeer{}, &inProcessPeer{}
+	a := NewFederatedQuotaService(localA, []qspb.QuotaServiceFederationClient{peerB}, 10 * time.Millisecond)
+	b := NewFederatedQuotaService(localB, []qspb.QuotaServiceFederationClient{peerA}, 10 * time.Millisecond)
+	peerA.f, peerB.f = a, b
+	defer a.Stop()
+	defer b.Stop()
+
+	a.Allow("n", "b", 5, 0)
+	b.Allow("n", "b", 3, 0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.GrantedTokens("n", "b") != 8 || b.GrantedTokens("n", "b") != 8 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting both nodes to converge on 8 tokens. Were %v and %v",
+				a.GrantedTokens("n", "b"), b.GrantedTokens("n", "b"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Each node's local bucket is charged for the tokens granted by the other.
+	for localB.requestedFrom("n:b") != 8 || localA.requestedFrom("n:b") != 8 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expecting remote grants to be charged locally. Were %v and %v",
+				localA.requestedFrom("n:b"), localB.requestedFrom("n:b"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxMerge(t *testing.T) {
+	local := newMockQuotaService()
+	f := NewFederatedQuotaService(local, nil, time.Hour)
+	defer f.Stop()
+
+	count := func(node string, tokens int64) *qspb.TokenCount {
+		return &qspb.TokenCount{
+			NodeId:        proto.String(node),
+			Namespace:     proto.String("n"),
+			Name:          proto.String("b"),
+			TokensGranted: proto.Int64(tokens)}
+	}
+
+	f.merge([]*qspb.TokenCount{count("x", 5), count("y", 2)})
+	// Stale and repeated counts are ignored.
+	f.merge([]*qspb.TokenCount{count("x", 3), count("y", 2)})
+	f.merge([]*qspb.TokenCount{count("y", 4)})
+
+	if granted := f.GrantedTokens("n", "b"); granted != 9 {
+		t.Fatalf("Expecting 9 tokens granted. Was %v", granted)
+	}
+
+	if charged := local.requestedFrom("n:b"); charged != 9 {
+		t.Fatalf("Expecting 9 tokens charged locally. Was %v", charged)
+	}
+
+	// Counts reported for this node by others are ignored.
+	f.merge([]*qspb.TokenCount{count(f.nodeID, 100)})
+	if granted := f.GrantedTokens("n", "b"); granted != 9 {
+		t.Fatalf("Expecting 9 tokens granted. Was %v", granted)
+	}
+}
@@ -0,0 +1,164 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+)
+
+// journalEntry is a single record in the journal, stored as a line of JSON.
+type journalEntry struct {
+	Timestamp  time.Time `json:"ts"`
+	Namespace  string    `json:"namespace"`
+	BucketName string    `json:"bucket"`
+	Tokens     int64     `json:"tokens"`
+	Status     string    `json:"status"`
+}
+
+// JournaledQuotaService wraps a QuotaService, durably recording every decision made by Allow,
+// AllowOp and AllowWithMeta in an append-only journal before returning it to the caller. Tokens
+// recorded are those granted, so rejections record 0 tokens. If a decision can't be recorded, the
+// caller gets an error instead. Token donations aren't journaled.
+type JournaledQuotaService struct {
+	qs      QuotaService
+	path    string
+	file    *os.File
+	granted map[string]int64
+	sync.Mutex // Embedded mutex
+}
+
+// NewJournaledQuotaService creates a JournaledQuotaService appending to the journal at path,
+// creating it if it doesn't exist. Recover() should be called before any requests are served, if
+// the journal may have been left behind by a previous process.
+func NewJournaledQuotaService(qs QuotaService, path string) (*JournaledQuotaService, error) {
+	j := &JournaledQuotaService{qs: qs, path: path, granted: make(map[string]int64)}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *JournaledQuotaService) open() (err error) {
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_SYNC, 0644)
+	return
+}
+
+// Recover replays the journal, rebuilding the number of tokens granted by each bucket. A record
+// left incomplete by a crash is discarded, and the journal truncated to the last complete record.
+// Any other record that can't be read fails recovery.
+func (j *JournaledQuotaService) Recover() error {
+	j.Lock()
+	defer j.Unlock()
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	granted := make(map[string]int64)
+	var valid int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything left over is a record that was being written when the process crashed.
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		entry := &journalEntry{}
+		if err := json.Unmarshal(bytes.TrimSpace(line), entry); err != nil {
+			return fmt.Errorf("Corrupt journal record at offset %v: %v", valid, err)
+		}
+
+		granted[buckets.FullyQualifiedName(entry.Namespace, entry.BucketName)] += entry.Tokens
+		valid += int64(len(line))
+	}
+
+	if err := j.file.Truncate(valid); err != nil {
+		return err
+	}
+
+	j.granted = granted
+	return nil
+}
+
+// GrantedTokens returns the number of tokens granted by a bucket, as recorded in the journal.
+func (j *JournaledQuotaService) GrantedTokens(namespace, name string) int64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.granted[buckets.FullyQualifiedName(namespace, name)]
+}
+
+// Close closes the journal.
+func (j *JournaledQuotaService) Close() error {
+	j.Lock()
+	defer j.Unlock()
+	return j.file.Close()
+}
+
+// record appends a decision to the journal, returning an error in place of the decision's if it
+// can't be written.
+func (j *JournaledQuotaService) record(namespace, name string, granted int64, waitTime time.Duration, err error) (int64, time.Duration, error) {
+	entry := &journalEntry{
+		Timestamp:  time.Now(),
+		Namespace:  namespace,
+		BucketName: name,
+		Tokens:     granted,
+		Status:     buckets.EVENT_OK.String()}
+
+	if err != nil {
+		entry.Status = buckets.EVENT_REJECTED.String()
+	} else if waitTime > 0 {
+		entry.Status = buckets.EVENT_OK_WAIT.String()
+	}
+
+	line, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return 0, 0, jsonErr
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if _, writeErr := j.file.Write(append(line, '\n')); writeErr != nil {
+		return 0, 0, fmt.Errorf("Unable to journal decision for %v:%v: %v", namespace, name, writeErr)
+	}
+
+	j.granted[buckets.FullyQualifiedName(namespace, name)] += granted
+	return granted, waitTime, err
+}
+
+func (j *JournaledQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	granted, waitTime, err := j.qs.Allow(namespace, name, tokensRequested, maxWaitMillisOverride)
+	return j.record(namespace, name, granted, waitTime, err)
+}
+
+func (j *JournaledQuotaService) AllowOp(namespace string, name string, operationType string, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	granted, waitTime, err := j.qs.AllowOp(namespace, name, operationType, maxWaitMillisOverride)
+	return j.record(namespace, name, granted, waitTime, err)
+}
+
+func (j *JournaledQuotaService) AllowWithMeta(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64, meta map[string]string) (int64, time.Duration, error) {
+	granted, waitTime, err := j.qs.AllowWithMeta(namespace, name, tokensRequested, maxWaitMillisOverride, meta)
+	return j.record(namespace, name, granted, waitTime, err)
+}
+
+func (j *JournaledQuotaService) DonateTokens(fromNamespace, toNamespace string, tokens int64) error {
+	return j.qs.DonateTokens(fromNamespace, toNamespace, tokens)
+}
@@ -0,0 +1,110 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newJournaledServer(t *testing.T, path string) *JournaledQuotaService {
+	j, err := NewJournaledQuotaService(newOperationCostServer(), path)
+	if err != nil {
+		t.Fatalf("Unable to open journal: %v", err)
+	}
+
+	return j
+}
+
+func readJournal(t *testing.T, path string) []*journalEntry {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read journal: %v", err)
+	}
+
+	var entries []*journalEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		entry := &journalEntry{}
+		if err := json.Unmarshal([]byte(line), entry); err != nil {
+			t.Fatalf("Unable to parse journal record %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestJournalWrittenOnGrant(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j := newJournaledServer(t, path)
+	defer j.Close()
+
+	if granted, _, err := j.Allow("ns", "b", 3, 0); err != nil || granted != 3 {
+		t.Fatalf("Expecting 3 tokens. Was %v, %v", granted, err)
+	}
+
+	j.AllowOp("ns", "b", "delete", 0)
+
+	entries := readJournal(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("Expecting 2 records. Was %v", len(entries))
+	}
+
+	if e := entries[0]; e.Namespace != "ns" || e.BucketName != "b" || e.Tokens != 3 || e.Status != "OK" || e.Timestamp.IsZero() {
+		t.Fatalf("Expecting a grant of 3 tokens. Was %+v", e)
+	}
+
+	if e := entries[1]; e.Tokens != 0 || e.Status != "REJECTED" {
+		t.Fatalf("Expecting a rejection. Was %+v", e)
+	}
+}
+
+func TestJournalReplayAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j := newJournaledServer(t, path)
+	j.Allow("ns", "b", 3, 0)
+	j.Allow("ns", "b", 2, 0)
+	j.Allow("ns", "c", 1, 0)
+	j.Close()
+
+	// Simulate a crash part of the way through writing a record.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"ts":"2016-01-01T00:00:00Z","namespace":"ns","buck`)
+	f.Close()
+
+	j = newJournaledServer(t, path)
+	defer j.Close()
+	if err := j.Recover(); err != nil {
+		t.Fatalf("Expecting recovery to succeed. Was %v", err)
+	}
+
+	if granted := j.GrantedTokens("ns", "b"); granted != 5 {
+		t.Fatalf("Expecting 5 tokens granted by ns:b. Was %v", granted)
+	}
+
+	if granted := j.GrantedTokens("ns", "c"); granted != 1 {
+		t.Fatalf("Expecting 1 token granted by ns:c. Was %v", granted)
+	}
+
+	// The incomplete record is discarded, so new records can be read.
+	j.Allow("ns", "b", 1, 0)
+	if entries := readJournal(t, path); len(entries) != 4 {
+		t.Fatalf("Expecting 4 records. Was %v", len(entries))
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	ioutil.WriteFile(path, []byte("not json\n"), 0644)
+
+	j := newJournaledServer(t, path)
+	defer j.Close()
+	if err := j.Recover(); err == nil {
+		t.Fatal("Expecting recovery of a corrupt journal to fail")
+	}
+}
@@ -0,0 +1,137 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// SetSlogHandler routes all quota service logging through a log/slog handler, in place of the
+// Logger set using SetLogger().
+//
+// Each Printf() call is logged at slog.LevelInfo with the formatted message, and an "attrs" group
+// holding each of its arguments, keyed by the text preceding it in the format string: the name
+// before an '=', or else the last word, lowercased. Namespace %v locked=%v, for instance, is logged
+// with attrs namespace and locked. Arguments without a usable key are keyed by position, such as
+// arg1. Print() and Println() are logged without attrs, and the Fatal variants are logged at
+// slog.LevelError before exiting.
+//
+// Services that implemented Logger to forward to a structured logger can migrate by passing their
+// handler here instead, and can then match on the attrs of quota service log records, rather than
+// parsing messages. Log records emitted through gRPC's logger, which is set to the current Logger
+// when the gRPC endpoint is initialized, are routed through the handler too, as long as this is
+// called first.
+func SetSlogHandler(h slog.Handler) {
+	SetLogger(&slogLogger{slog.New(h)})
+}
+
+// slogLogger adapts a slog.Logger to the Logger interface.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s *slogLogger) Fatal(args ...interface{}) {
+	s.l.Error(fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+func (s *slogLogger) Fatalf(format string, args ...interface{}) {
+	s.logf(slog.LevelError, format, args)
+	os.Exit(1)
+}
+
+func (s *slogLogger) Fatalln(args ...interface{}) {
+	s.l.Error(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+	os.Exit(1)
+}
+
+func (s *slogLogger) Print(args ...interface{}) {
+	s.l.Info(fmt.Sprint(args...))
+}
+
+func (s *slogLogger) Printf(format string, args ...interface{}) {
+	s.logf(slog.LevelInfo, format, args)
+}
+
+func (s *slogLogger) Println(args ...interface{}) {
+	s.l.Info(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+func (s *slogLogger) logf(level slog.Level, format string, args []interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	keys := formatKeys(format, len(args))
+	attrs := make([]slog.Attr, len(args))
+	for i, arg := range args {
+		attrs[i] = slog.Any(keys[i], arg)
+	}
+
+	s.l.LogAttrs(context.Background(), level, msg, slog.Attr{Key: "attrs", Value: slog.GroupValue(attrs...)})
+}
+
+// formatKeys returns a key for each of numArgs arguments of a format string, derived from the text
+// preceding each verb. Keys are unique; arguments without a key of their own are keyed by position.
+func formatKeys(format string, numArgs int) []string {
+	keys := make([]string, numArgs)
+	used := make(map[string]bool)
+	arg, textStart := 0, 0
+	for i := 0; i < len(format) && arg < numArgs; i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		if i+1 < len(format) && format[i+1] == '%' {
+			i++
+			continue
+		}
+
+		if key := keyBefore(format[textStart:i]); key != "" && !used[key] {
+			keys[arg] = key
+			used[key] = true
+		}
+
+		// Skip flags, width and precision, up to the verb.
+		for i++; i < len(format) && !unicode.IsLetter(rune(format[i])); i++ {
+		}
+		textStart = i + 1
+		arg++
+	}
+
+	for i, key := range keys {
+		if key == "" {
+			keys[i] = fmt.Sprintf("arg%v", i)
+		}
+	}
+
+	return keys
+}
+
+// keyBefore returns the name before a trailing '=' in text, or the last word of text, lowercased,
+// if text ends with a space.
+func keyBefore(text string) string {
+	switch {
+	case strings.HasSuffix(text, "="):
+		fields := strings.Fields(strings.TrimSuffix(text, "="))
+		if len(fields) == 0 {
+			return ""
+		}
+		return strings.TrimFunc(fields[len(fields)-1], isNotKeyRune)
+	case strings.HasSuffix(text, " "):
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			return ""
+		}
+		return strings.ToLower(strings.TrimFunc(fields[len(fields)-1], isNotKeyRune))
+	}
+
+	return ""
+}
+
+func isNotKeyRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+}
@@ -0,0 +1,29 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package logging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatKeys(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		keys   []string
+	}{
+		{"Namespace %v locked=%v", []string{"namespace", "locked"}},
+		{"Unable to connect to Redis: %v", []string{"redis"}},
+		{"Bucket %v:%v numDynamicBuckets=%v", []string{"bucket", "arg1", "numDynamicBuckets"}},
+		// Flags and precision are skipped, and escaped percent signs aren't verbs.
+		{"Used 100%% of %+v, rate %.2f", []string{"of", "rate"}},
+		// Repeated keys are keyed by position.
+		{"Namespace %v donated %v tokens to namespace %v", []string{"namespace", "donated", "arg2"}},
+		// Arguments beyond the verbs are keyed by position.
+		{"Caught %v", []string{"caught", "arg1"}}} {
+		if keys := formatKeys(test.format, len(test.keys)); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("Expecting keys %v for %q. Were %v", test.keys, test.format, keys)
+		}
+	}
+}
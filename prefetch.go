@@ -0,0 +1,144 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultPrefetchTTL is how long prefetched tokens are held once delivered, unless the service's
+// PrefetchTTLMillis is set.
+const DefaultPrefetchTTL = time.Minute
+
+var (
+	ErrNoSuchPrefetch       = newError("No such prefetch, or its tokens have expired.", ER_REJECTED)
+	ErrPrefetchNotDelivered = newError("Prefetched tokens haven't been delivered yet.", ER_REJECTED)
+)
+
+// Prefetching is implemented by QuotaServices that reserve tokens ahead of the operations that
+// need them, so that pipelines can acquire quota for later stages in advance.
+type Prefetching interface {
+	// Prefetch schedules tokens to be taken from a bucket at deliverAt, waiting for them up to the
+	// bucket's wait timeout. Once delivered, the tokens are held for the prefetch ID returned
+	// until consumed using ConsumePrefetch(), or until they expire. The ID is unguessable, so only
+	// the client it was returned to can consume the tokens.
+	Prefetch(ctx context.Context, namespace, bucket string, tokens int64, deliverAt time.Time) (prefetchID string, err error)
+
+	// ConsumePrefetch consumes the tokens held for a prefetch. Returns ErrPrefetchNotDelivered if
+	// called before the tokens are delivered, ErrNoSuchPrefetch if the prefetch doesn't exist, or
+	// has been consumed or expired, and the error taking the tokens if they couldn't be delivered.
+	ConsumePrefetch(prefetchID string) error
+}
+
+// prefetches keeps track of scheduled and held prefetches.
+type prefetches struct {
+	ttl     time.Duration
+	pending map[string]*prefetch
+	sync.Mutex
+}
+
+type prefetch struct {
+	timer     *time.Timer
+	delivered bool
+	err       error
+}
+
+func newPrefetches(ttl time.Duration) *prefetches {
+	if ttl <= 0 {
+		ttl = DefaultPrefetchTTL
+	}
+
+	return &prefetches{ttl: ttl, pending: make(map[string]*prefetch)}
+}
+
+func newPrefetchID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("Unable to generate a prefetch ID: %v", err))
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// schedule calls take at deliverAt, holding the tokens it takes for the TTL.
+func (p *prefetches) schedule(deliverAt time.Time, take func() error) string {
+	id := newPrefetchID()
+	pf := &prefetch{}
+
+	p.Lock()
+	defer p.Unlock()
+	p.pending[id] = pf
+	pf.timer = time.AfterFunc(deliverAt.Sub(time.Now()), func() {
+		err := take()
+
+		p.Lock()
+		defer p.Unlock()
+		if p.pending[id] != pf {
+			return
+		}
+
+		pf.delivered, pf.err = true, err
+		pf.timer = time.AfterFunc(p.ttl, func() {
+			p.Lock()
+			defer p.Unlock()
+			if p.pending[id] == pf {
+				delete(p.pending, id)
+			}
+		})
+	})
+
+	return id
+}
+
+func (p *prefetches) consume(id string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	pf := p.pending[id]
+	if pf == nil {
+		return ErrNoSuchPrefetch
+	}
+
+	if !pf.delivered {
+		return ErrPrefetchNotDelivered
+	}
+
+	pf.timer.Stop()
+	delete(p.pending, id)
+	return pf.err
+}
+
+func (s *server) Prefetch(ctx context.Context, namespace, bucket string, tokens int64, deliverAt time.Time) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	if tokens < 1 {
+		return "", fmt.Errorf("Prefetches need tokens. Were %v", tokens)
+	}
+
+	if b, _ := s.bucketContainer.FindBucket(namespace, bucket); b == nil {
+		return "", newError(fmt.Sprintf("No such bucket %v:%v.", namespace, bucket), ER_NO_SUCH_BUCKET)
+	}
+
+	return s.prefetches.schedule(deliverAt, func() error {
+		// Tokens that need waiting for are delivered once they are available. This runs on the
+		// timer's own goroutine, so waiting doesn't hold up other prefetches.
+		_, wait, err := s.Allow(namespace, bucket, tokens, -1)
+		if err == nil && wait > 0 {
+			time.Sleep(wait)
+		}
+		return err
+	}), nil
+}
+
+func (s *server) ConsumePrefetch(prefetchID string) error {
+	return s.prefetches.consume(prefetchID)
+}
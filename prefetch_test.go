@@ -0,0 +1,119 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+	"golang.org/x/net/context"
+)
+
+func newPrefetchServer(ttl time.Duration) (*server, buckets.Bucket) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = nil
+	cfg.PrefetchTTLMillis = int64(ttl / time.Millisecond)
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].Buckets["b"] = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].Buckets["b"].FillRate = 1
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+
+	b, _ := s.bucketContainer.FindBucket("ns", "b")
+	return s, b
+}
+
+// awaitDelivery consumes a prefetch once its tokens have been delivered.
+func awaitDelivery(t *testing.T, s *server, id string) error {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if err := s.ConsumePrefetch(id); err != ErrPrefetchNotDelivered {
+			return err
+		}
+	}
+
+	t.Fatalf("Expecting prefetch %v to be delivered.", id)
+	return nil
+}
+
+func TestPrefetchDeliveredOnTime(t *testing.T) {
+	s, b := newPrefetchServer(time.Minute)
+	defer s.Stop()
+
+	deliverAt := time.Now().Add(50 * time.Millisecond)
+	id, err := s.Prefetch(context.TODO(), "ns", "b", 30, deliverAt)
+	if err != nil {
+		t.Fatalf("Unable to prefetch: %v", err)
+	}
+
+	if err := awaitDelivery(t, s, id); err != nil {
+		t.Fatalf("Expecting the prefetched tokens to be consumed. Was %v", err)
+	}
+
+	if time.Now().Before(deliverAt) {
+		t.Fatalf("Not expecting tokens to be delivered early.")
+	}
+
+	if tokens := b.(buckets.TokenCounter).AvailableTokens(); tokens != 70 {
+		t.Fatalf("Expecting 30 tokens taken from the bucket. %v are left", tokens)
+	}
+
+	if err := s.ConsumePrefetch(id); err != ErrNoSuchPrefetch {
+		t.Fatalf("Not expecting tokens to be consumed twice. Was %v", err)
+	}
+}
+
+func TestPrefetchExpiry(t *testing.T) {
+	s, _ := newPrefetchServer(20 * time.Millisecond)
+	defer s.Stop()
+
+	id, err := s.Prefetch(context.TODO(), "ns", "b", 30, time.Now())
+	if err != nil {
+		t.Fatalf("Unable to prefetch: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if err := s.ConsumePrefetch(id); err != ErrNoSuchPrefetch {
+		t.Fatalf("Expecting the prefetched tokens to have expired. Was %v", err)
+	}
+}
+
+func TestPrefetchConsumedEarly(t *testing.T) {
+	s, b := newPrefetchServer(time.Minute)
+	defer s.Stop()
+
+	id, err := s.Prefetch(context.TODO(), "ns", "b", 30, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Unable to prefetch: %v", err)
+	}
+
+	if err := s.ConsumePrefetch(id); err != ErrPrefetchNotDelivered {
+		t.Fatalf("Expecting ErrPrefetchNotDelivered. Was %v", err)
+	}
+
+	if tokens := b.(buckets.TokenCounter).AvailableTokens(); tokens != 100 {
+		t.Fatalf("Not expecting tokens to be taken before delivery. %v are left", tokens)
+	}
+}
+
+func TestPrefetchNotDeliverable(t *testing.T) {
+	s, b := newPrefetchServer(time.Minute)
+	defer s.Stop()
+	b.Take(100, 0)
+
+	id, err := s.Prefetch(context.TODO(), "ns", "b", 30, time.Now())
+	if err != nil {
+		t.Fatalf("Unable to prefetch: %v", err)
+	}
+
+	if err := awaitDelivery(t, s, id); err == nil {
+		t.Fatalf("Expecting an error, since the bucket has no tokens to deliver.")
+	}
+
+	if _, err := s.Prefetch(context.TODO(), "nonexistent", "b", 30, time.Now()); err == nil {
+		t.Fatalf("Expecting prefetches from missing buckets to fail.")
+	}
+}
@@ -0,0 +1,427 @@
+// Code generated by protoc-gen-go.
+// source: protos/admin.proto
+// DO NOT EDIT!
+
+package quotaservice
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type BucketConfig struct {
+	Size              *int64 `protobuf:"varint,1,opt,name=size" json:"size,omitempty"`
+	FillRate          *int64 `protobuf:"varint,2,opt,name=fill_rate" json:"fill_rate,omitempty"`
+	WaitTimeoutMillis *int64 `protobuf:"varint,3,opt,name=wait_timeout_millis" json:"wait_timeout_millis,omitempty"`
+	MaxIdleMillis     *int64 `protobuf:"varint,4,opt,name=max_idle_millis" json:"max_idle_millis,omitempty"`
+	MaxDebtMillis     *int64 `protobuf:"varint,5,opt,name=max_debt_millis" json:"max_debt_millis,omitempty"`
+	XXX_unrecognized  []byte `json:"-"`
+}
+
+func (m *BucketConfig) Reset()                    { *m = BucketConfig{} }
+func (m *BucketConfig) String() string            { return proto.CompactTextString(m) }
+func (*BucketConfig) ProtoMessage()               {}
+func (*BucketConfig) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{0} }
+
+func (m *BucketConfig) GetSize() int64 {
+	if m != nil && m.Size != nil {
+		return *m.Size
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetFillRate() int64 {
+	if m != nil && m.FillRate != nil {
+		return *m.FillRate
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetWaitTimeoutMillis() int64 {
+	if m != nil && m.WaitTimeoutMillis != nil {
+		return *m.WaitTimeoutMillis
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetMaxIdleMillis() int64 {
+	if m != nil && m.MaxIdleMillis != nil {
+		return *m.MaxIdleMillis
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetMaxDebtMillis() int64 {
+	if m != nil && m.MaxDebtMillis != nil {
+		return *m.MaxDebtMillis
+	}
+	return 0
+}
+
+type CreateSpec struct {
+	Namespace        *string       `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	Name             *string       `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Config           *BucketConfig `protobuf:"bytes,3,opt,name=config" json:"config,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *CreateSpec) Reset()                    { *m = CreateSpec{} }
+func (m *CreateSpec) String() string            { return proto.CompactTextString(m) }
+func (*CreateSpec) ProtoMessage()               {}
+func (*CreateSpec) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{1} }
+
+func (m *CreateSpec) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *CreateSpec) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *CreateSpec) GetConfig() *BucketConfig {
+	if m != nil {
+		return m.Config
+	}
+	return nil
+}
+
+type BatchCreateRequest struct {
+	Specs            []*CreateSpec `protobuf:"bytes,1,rep,name=specs" json:"specs,omitempty"`
+	MaxParallelism   *int32        `protobuf:"varint,2,opt,name=max_parallelism" json:"max_parallelism,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *BatchCreateRequest) Reset()                    { *m = BatchCreateRequest{} }
+func (m *BatchCreateRequest) String() string            { return proto.CompactTextString(m) }
+func (*BatchCreateRequest) ProtoMessage()               {}
+func (*BatchCreateRequest) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{2} }
+
+func (m *BatchCreateRequest) GetSpecs() []*CreateSpec {
+	if m != nil {
+		return m.Specs
+	}
+	return nil
+}
+
+func (m *BatchCreateRequest) GetMaxParallelism() int32 {
+	if m != nil && m.MaxParallelism != nil {
+		return *m.MaxParallelism
+	}
+	return 0
+}
+
+type CreateResult struct {
+	Namespace        *string `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	Name             *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Success          *bool   `protobuf:"varint,3,opt,name=success" json:"success,omitempty"`
+	Error            *string `protobuf:"bytes,4,opt,name=error" json:"error,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *CreateResult) Reset()                    { *m = CreateResult{} }
+func (m *CreateResult) String() string            { return proto.CompactTextString(m) }
+func (*CreateResult) ProtoMessage()               {}
+func (*CreateResult) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{3} }
+
+func (m *CreateResult) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *CreateResult) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *CreateResult) GetSuccess() bool {
+	if m != nil && m.Success != nil {
+		return *m.Success
+	}
+	return false
+}
+
+func (m *CreateResult) GetError() string {
+	if m != nil && m.Error != nil {
+		return *m.Error
+	}
+	return ""
+}
+
+type BatchCreateResponse struct {
+	Results          []*CreateResult `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+	XXX_unrecognized []byte          `json:"-"`
+}
+
+func (m *BatchCreateResponse) Reset()                    { *m = BatchCreateResponse{} }
+func (m *BatchCreateResponse) String() string            { return proto.CompactTextString(m) }
+func (*BatchCreateResponse) ProtoMessage()               {}
+func (*BatchCreateResponse) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{4} }
+
+func (m *BatchCreateResponse) GetResults() []*CreateResult {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
+type DrainRequest struct {
+	Namespace        *string `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	Name             *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *DrainRequest) Reset()                    { *m = DrainRequest{} }
+func (m *DrainRequest) String() string            { return proto.CompactTextString(m) }
+func (*DrainRequest) ProtoMessage()               {}
+func (*DrainRequest) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{5} }
+
+func (m *DrainRequest) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *DrainRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+type DrainResponse struct {
+	TokensRemoved    *int64 `protobuf:"varint,1,opt,name=tokens_removed" json:"tokens_removed,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *DrainResponse) Reset()                    { *m = DrainResponse{} }
+func (m *DrainResponse) String() string            { return proto.CompactTextString(m) }
+func (*DrainResponse) ProtoMessage()               {}
+func (*DrainResponse) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{6} }
+
+func (m *DrainResponse) GetTokensRemoved() int64 {
+	if m != nil && m.TokensRemoved != nil {
+		return *m.TokensRemoved
+	}
+	return 0
+}
+
+type BackfillRequest struct {
+	Namespace        *string `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	Name             *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Tokens           *int64  `protobuf:"varint,3,opt,name=tokens" json:"tokens,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *BackfillRequest) Reset()                    { *m = BackfillRequest{} }
+func (m *BackfillRequest) String() string            { return proto.CompactTextString(m) }
+func (*BackfillRequest) ProtoMessage()               {}
+func (*BackfillRequest) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{7} }
+
+func (m *BackfillRequest) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *BackfillRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *BackfillRequest) GetTokens() int64 {
+	if m != nil && m.Tokens != nil {
+		return *m.Tokens
+	}
+	return 0
+}
+
+type BackfillResponse struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *BackfillResponse) Reset()                    { *m = BackfillResponse{} }
+func (m *BackfillResponse) String() string            { return proto.CompactTextString(m) }
+func (*BackfillResponse) ProtoMessage()               {}
+func (*BackfillResponse) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{8} }
+
+func init() {
+	proto.RegisterType((*BucketConfig)(nil), "quotaservice.BucketConfig")
+	proto.RegisterType((*CreateSpec)(nil), "quotaservice.CreateSpec")
+	proto.RegisterType((*BatchCreateRequest)(nil), "quotaservice.BatchCreateRequest")
+	proto.RegisterType((*CreateResult)(nil), "quotaservice.CreateResult")
+	proto.RegisterType((*BatchCreateResponse)(nil), "quotaservice.BatchCreateResponse")
+	proto.RegisterType((*DrainRequest)(nil), "quotaservice.DrainRequest")
+	proto.RegisterType((*DrainResponse)(nil), "quotaservice.DrainResponse")
+	proto.RegisterType((*BackfillRequest)(nil), "quotaservice.BackfillRequest")
+	proto.RegisterType((*BackfillResponse)(nil), "quotaservice.BackfillResponse")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Client API for QuotaServiceAdmin service
+
+type QuotaServiceAdminClient interface {
+	BatchCreateBuckets(ctx context.Context, in *BatchCreateRequest, opts ...grpc.CallOption) (*BatchCreateResponse, error)
+	DrainBucket(ctx context.Context, in *DrainRequest, opts ...grpc.CallOption) (*DrainResponse, error)
+	BackfillBucket(ctx context.Context, in *BackfillRequest, opts ...grpc.CallOption) (*BackfillResponse, error)
+}
+
+type quotaServiceAdminClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewQuotaServiceAdminClient(cc *grpc.ClientConn) QuotaServiceAdminClient {
+	return &quotaServiceAdminClient{cc}
+}
+
+func (c *quotaServiceAdminClient) BatchCreateBuckets(ctx context.Context, in *BatchCreateRequest, opts ...grpc.CallOption) (*BatchCreateResponse, error) {
+	out := new(BatchCreateResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.QuotaServiceAdmin/BatchCreateBuckets", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quotaServiceAdminClient) DrainBucket(ctx context.Context, in *DrainRequest, opts ...grpc.CallOption) (*DrainResponse, error) {
+	out := new(DrainResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.QuotaServiceAdmin/DrainBucket", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quotaServiceAdminClient) BackfillBucket(ctx context.Context, in *BackfillRequest, opts ...grpc.CallOption) (*BackfillResponse, error) {
+	out := new(BackfillResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.QuotaServiceAdmin/BackfillBucket", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for QuotaServiceAdmin service
+
+type QuotaServiceAdminServer interface {
+	BatchCreateBuckets(context.Context, *BatchCreateRequest) (*BatchCreateResponse, error)
+	DrainBucket(context.Context, *DrainRequest) (*DrainResponse, error)
+	BackfillBucket(context.Context, *BackfillRequest) (*BackfillResponse, error)
+}
+
+func RegisterQuotaServiceAdminServer(s *grpc.Server, srv QuotaServiceAdminServer) {
+	s.RegisterService(&_QuotaServiceAdmin_serviceDesc, srv)
+}
+
+func _QuotaServiceAdmin_BatchCreateBuckets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(BatchCreateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(QuotaServiceAdminServer).BatchCreateBuckets(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _QuotaServiceAdmin_DrainBucket_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(DrainRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(QuotaServiceAdminServer).DrainBucket(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _QuotaServiceAdmin_BackfillBucket_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(BackfillRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(QuotaServiceAdminServer).BackfillBucket(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _QuotaServiceAdmin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "quotaservice.QuotaServiceAdmin",
+	HandlerType: (*QuotaServiceAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "BatchCreateBuckets",
+			Handler:    _QuotaServiceAdmin_BatchCreateBuckets_Handler,
+		},
+		{
+			MethodName: "DrainBucket",
+			Handler:    _QuotaServiceAdmin_DrainBucket_Handler,
+		},
+		{
+			MethodName: "BackfillBucket",
+			Handler:    _QuotaServiceAdmin_BackfillBucket_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+var fileDescriptor1 = []byte{
+	// 433 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x92, 0x51, 0x6f, 0xd3, 0x30,
+	0x14, 0x85, 0xe9, 0xba, 0x6e, 0xf4, 0x36, 0x6b, 0x99, 0x27, 0x41, 0x94, 0x09, 0x54, 0xfc, 0xb2,
+	0x09, 0xa4, 0x4e, 0xea, 0x3f, 0x20, 0xe3, 0x81, 0x37, 0x34, 0x26, 0x21, 0x21, 0x1e, 0x22, 0xe3,
+	0xdc, 0x81, 0x55, 0x27, 0xce, 0x7c, 0x9d, 0x81, 0x78, 0xe0, 0x1f, 0xf0, 0x9f, 0x51, 0xec, 0x64,
+	0x24, 0x65, 0x30, 0x1e, 0x9b, 0x53, 0x9f, 0xf3, 0x9d, 0x7b, 0x2f, 0xb0, 0xca, 0x1a, 0x67, 0xe8,
+	0x4c, 0xe4, 0x85, 0x2a, 0x57, 0xfe, 0x07, 0x8b, 0xae, 0x6b, 0xe3, 0x04, 0xa1, 0xbd, 0x51, 0x12,
+	0xf9, 0x0f, 0x88, 0xd2, 0x5a, 0x6e, 0xd0, 0x9d, 0x9b, 0xf2, 0x4a, 0x7d, 0x66, 0x11, 0xec, 0x92,
+	0xfa, 0x8e, 0xf1, 0x68, 0x39, 0x3a, 0x1d, 0xb3, 0x43, 0x98, 0x5e, 0x29, 0xad, 0x33, 0x2b, 0x1c,
+	0xc6, 0x3b, 0xfe, 0xd3, 0x31, 0x1c, 0x7d, 0x15, 0xca, 0x65, 0x4e, 0x15, 0x68, 0x6a, 0x97, 0x15,
+	0x4a, 0x6b, 0x45, 0xf1, 0xd8, 0x8b, 0x4f, 0x60, 0x51, 0x88, 0x6f, 0x99, 0xca, 0x35, 0x76, 0xc2,
+	0x6e, 0x5f, 0xc8, 0xf1, 0xd3, 0xed, 0x8b, 0x49, 0x23, 0xf0, 0x0f, 0x00, 0xe7, 0x16, 0x85, 0xc3,
+	0xcb, 0x0a, 0x65, 0x93, 0x57, 0x8a, 0x02, 0xa9, 0x12, 0x32, 0x20, 0x4c, 0x1b, 0xa0, 0xe6, 0x93,
+	0x4f, 0x9f, 0xb2, 0x17, 0xb0, 0x27, 0x3d, 0xa8, 0x0f, 0x9c, 0xad, 0x93, 0x55, 0xbf, 0xcd, 0xaa,
+	0x5f, 0x85, 0xbf, 0x07, 0x96, 0x0a, 0x27, 0xbf, 0x04, 0xff, 0x77, 0x78, 0x5d, 0x23, 0x39, 0x76,
+	0x02, 0x13, 0xaa, 0x50, 0x52, 0x3c, 0x5a, 0x8e, 0x4f, 0x67, 0xeb, 0x78, 0x68, 0xd0, 0x63, 0x69,
+	0x91, 0x2b, 0x61, 0x85, 0xd6, 0xa8, 0x15, 0x15, 0x9e, 0x61, 0xc2, 0xdf, 0x42, 0xd4, 0x59, 0x52,
+	0xad, 0xdd, 0xfd, 0xd0, 0x0b, 0xd8, 0xa7, 0x5a, 0x4a, 0xa4, 0x30, 0xa6, 0x87, 0xec, 0x00, 0x26,
+	0x68, 0xad, 0xb1, 0x7e, 0x38, 0x53, 0x9e, 0xc2, 0xd1, 0x00, 0x94, 0x2a, 0x53, 0x12, 0xb2, 0x97,
+	0xb0, 0x6f, 0x7d, 0x42, 0xc7, 0x9a, 0xdc, 0xc5, 0x1a, 0x20, 0xf8, 0x19, 0x44, 0xaf, 0xad, 0x50,
+	0x65, 0x57, 0xf3, 0x3e, 0x28, 0x7e, 0x02, 0x07, 0xed, 0x83, 0x36, 0xee, 0x31, 0xcc, 0x9d, 0xd9,
+	0x60, 0x49, 0x99, 0xc5, 0xc2, 0xdc, 0x60, 0x1e, 0x6e, 0x80, 0xa7, 0xb0, 0x48, 0x85, 0xdc, 0x34,
+	0x77, 0xf0, 0xbf, 0xe6, 0x6c, 0x0e, 0x7b, 0xc1, 0x2b, 0xdc, 0x05, 0x67, 0xf0, 0xe8, 0xb7, 0x47,
+	0xc8, 0x5b, 0xff, 0xdc, 0x81, 0xc3, 0x8b, 0xa6, 0xcf, 0x65, 0xe8, 0xf3, 0xaa, 0xb9, 0x51, 0xf6,
+	0x71, 0xb0, 0xb4, 0xb0, 0x4f, 0x62, 0xcb, 0xad, 0x35, 0xff, 0xb1, 0xd6, 0xe4, 0xf9, 0x3f, 0xfe,
+	0x11, 0x02, 0xf9, 0x03, 0xf6, 0x06, 0x66, 0xbe, 0x73, 0xb0, 0x65, 0x5b, 0xf3, 0xec, 0xcf, 0x2f,
+	0x39, 0xbe, 0x53, 0xbb, 0x75, 0xba, 0x80, 0x79, 0x57, 0xa8, 0x35, 0x7b, 0xba, 0x0d, 0x30, 0x18,
+	0x59, 0xf2, 0xec, 0x6f, 0x72, 0x67, 0xf9, 0x6b, 0x00, 0x6e, 0x6a, 0x84, 0xce, 0xac, 0x03, 0x00,
+	0x00,
+}
@@ -0,0 +1,179 @@
+// Code generated by protoc-gen-go.
+// source: protos/federation.proto
+// DO NOT EDIT!
+
+package quotaservice
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type TokenCount struct {
+	NodeId           *string `protobuf:"bytes,1,opt,name=node_id" json:"node_id,omitempty"`
+	Namespace        *string `protobuf:"bytes,2,opt,name=namespace" json:"namespace,omitempty"`
+	Name             *string `protobuf:"bytes,3,opt,name=name" json:"name,omitempty"`
+	TokensGranted    *int64  `protobuf:"varint,4,opt,name=tokens_granted" json:"tokens_granted,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TokenCount) Reset()                    { *m = TokenCount{} }
+func (m *TokenCount) String() string            { return proto.CompactTextString(m) }
+func (*TokenCount) ProtoMessage()               {}
+func (*TokenCount) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{0} }
+
+func (m *TokenCount) GetNodeId() string {
+	if m != nil && m.NodeId != nil {
+		return *m.NodeId
+	}
+	return ""
+}
+
+func (m *TokenCount) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *TokenCount) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *TokenCount) GetTokensGranted() int64 {
+	if m != nil && m.TokensGranted != nil {
+		return *m.TokensGranted
+	}
+	return 0
+}
+
+type SyncTokenCountsRequest struct {
+	Counts           []*TokenCount `protobuf:"bytes,1,rep,name=counts" json:"counts,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *SyncTokenCountsRequest) Reset()                    { *m = SyncTokenCountsRequest{} }
+func (m *SyncTokenCountsRequest) String() string            { return proto.CompactTextString(m) }
+func (*SyncTokenCountsRequest) ProtoMessage()               {}
+func (*SyncTokenCountsRequest) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{1} }
+
+func (m *SyncTokenCountsRequest) GetCounts() []*TokenCount {
+	if m != nil {
+		return m.Counts
+	}
+	return nil
+}
+
+type SyncTokenCountsResponse struct {
+	Counts           []*TokenCount `protobuf:"bytes,1,rep,name=counts" json:"counts,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *SyncTokenCountsResponse) Reset()                    { *m = SyncTokenCountsResponse{} }
+func (m *SyncTokenCountsResponse) String() string            { return proto.CompactTextString(m) }
+func (*SyncTokenCountsResponse) ProtoMessage()               {}
+func (*SyncTokenCountsResponse) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{2} }
+
+func (m *SyncTokenCountsResponse) GetCounts() []*TokenCount {
+	if m != nil {
+		return m.Counts
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*TokenCount)(nil), "quotaservice.TokenCount")
+	proto.RegisterType((*SyncTokenCountsRequest)(nil), "quotaservice.SyncTokenCountsRequest")
+	proto.RegisterType((*SyncTokenCountsResponse)(nil), "quotaservice.SyncTokenCountsResponse")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Client API for QuotaServiceFederation service
+
+type QuotaServiceFederationClient interface {
+	SyncTokenCounts(ctx context.Context, in *SyncTokenCountsRequest, opts ...grpc.CallOption) (*SyncTokenCountsResponse, error)
+}
+
+type quotaServiceFederationClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewQuotaServiceFederationClient(cc *grpc.ClientConn) QuotaServiceFederationClient {
+	return &quotaServiceFederationClient{cc}
+}
+
+func (c *quotaServiceFederationClient) SyncTokenCounts(ctx context.Context, in *SyncTokenCountsRequest, opts ...grpc.CallOption) (*SyncTokenCountsResponse, error) {
+	out := new(SyncTokenCountsResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.QuotaServiceFederation/SyncTokenCounts", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for QuotaServiceFederation service
+
+type QuotaServiceFederationServer interface {
+	SyncTokenCounts(context.Context, *SyncTokenCountsRequest) (*SyncTokenCountsResponse, error)
+}
+
+func RegisterQuotaServiceFederationServer(s *grpc.Server, srv QuotaServiceFederationServer) {
+	s.RegisterService(&_QuotaServiceFederation_serviceDesc, srv)
+}
+
+func _QuotaServiceFederation_SyncTokenCounts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(SyncTokenCountsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(QuotaServiceFederationServer).SyncTokenCounts(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _QuotaServiceFederation_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "quotaservice.QuotaServiceFederation",
+	HandlerType: (*QuotaServiceFederationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SyncTokenCounts",
+			Handler:    _QuotaServiceFederation_SyncTokenCounts_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+var fileDescriptor2 = []byte{
+	// 220 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x90, 0x4f, 0x4b, 0x03, 0x31,
+	0x10, 0xc5, 0x5d, 0xb7, 0x28, 0x1d, 0x8b, 0xc5, 0x1c, 0xb6, 0xc1, 0xd3, 0x12, 0x14, 0x72, 0x5a,
+	0xa1, 0x1f, 0xc1, 0x82, 0x77, 0xad, 0x78, 0xad, 0x21, 0x19, 0x65, 0x11, 0x67, 0xb6, 0x99, 0xac,
+	0xa0, 0x9f, 0x5e, 0x36, 0x05, 0xd7, 0x7f, 0xa0, 0xc7, 0xfc, 0x5e, 0xde, 0x8f, 0x97, 0xc0, 0xa2,
+	0x8b, 0x9c, 0x58, 0x2e, 0x1e, 0x30, 0x60, 0x74, 0xa9, 0x65, 0x6a, 0x32, 0x51, 0xb3, 0x6d, 0xcf,
+	0xc9, 0x09, 0xc6, 0x97, 0xd6, 0xa3, 0xb9, 0x03, 0xb8, 0xe5, 0x27, 0xa4, 0x15, 0xf7, 0x94, 0xd4,
+	0x1c, 0x0e, 0x89, 0x03, 0x6e, 0xda, 0xa0, 0x8b, 0xba, 0xb0, 0x53, 0x75, 0x02, 0x53, 0x72, 0xcf,
+	0x28, 0x9d, 0xf3, 0xa8, 0xf7, 0x33, 0x9a, 0xc1, 0x64, 0x40, 0xba, 0xcc, 0xa7, 0x0a, 0x8e, 0xd3,
+	0xd0, 0x97, 0xcd, 0x63, 0x74, 0x94, 0x30, 0xe8, 0x49, 0x5d, 0xd8, 0xd2, 0x5c, 0x42, 0xb5, 0x7e,
+	0x25, 0x3f, 0xba, 0xe5, 0x06, 0xb7, 0x3d, 0x4a, 0x52, 0x16, 0x0e, 0x7c, 0x06, 0xba, 0xa8, 0x4b,
+	0x7b, 0xb4, 0xd4, 0xcd, 0xe7, 0x41, 0xcd, 0xd8, 0x30, 0x2b, 0x58, 0xfc, 0x70, 0x48, 0xc7, 0x24,
+	0xf8, 0x7f, 0xc9, 0xf2, 0x0d, 0xaa, 0xeb, 0x21, 0x5a, 0xef, 0xa2, 0xab, 0x8f, 0xef, 0x50, 0xf7,
+	0x30, 0xff, 0xa6, 0x57, 0x67, 0x5f, 0x35, 0xbf, 0xbf, 0xe0, 0xf4, 0xfc, 0x8f, 0x5b, 0xbb, 0x8d,
+	0x66, 0xef, 0x7d, 0x00, 0x81, 0x70, 0x28, 0x3f, 0x84, 0x01, 0x00, 0x00,
+}
@@ -7,10 +7,33 @@ Package quotaservice is a generated protocol buffer package.
 
 It is generated from these files:
 	protos/quota_service.proto
+	protos/admin.proto
+	protos/federation.proto
+	protos/state.proto
 
 It has these top-level messages:
 	AllowRequest
 	AllowResponse
+	HealthCheckRequest
+	HealthCheckResponse
+	ReturnTokensRequest
+	ReturnTokensResponse
+	ReplicateGrantRequest
+	ReplicateGrantResponse
+	BucketConfig
+	CreateSpec
+	BatchCreateRequest
+	CreateResult
+	BatchCreateResponse
+	DrainRequest
+	DrainResponse
+	BackfillRequest
+	BackfillResponse
+	TokenCount
+	SyncTokenCountsRequest
+	SyncTokenCountsResponse
+	BucketState
+	StateSnapshot
 */
 package quotaservice
 
@@ -73,6 +96,11 @@ type AllowRequest struct {
 	Name                  *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
 	NumTokensRequested    *int64  `protobuf:"varint,3,opt,name=num_tokens_requested" json:"num_tokens_requested,omitempty"`
 	MaxWaitMillisOverride *int64  `protobuf:"varint,4,opt,name=max_wait_millis_override" json:"max_wait_millis_override,omitempty"`
+	OperationType         *string `protobuf:"bytes,5,opt,name=operation_type" json:"operation_type,omitempty"`
+	IncludeTrace          *bool   `protobuf:"varint,6,opt,name=include_trace" json:"include_trace,omitempty"`
+	DryRun                *bool   `protobuf:"varint,7,opt,name=dry_run" json:"dry_run,omitempty"`
+	Priority              *int32  `protobuf:"varint,8,opt,name=priority" json:"priority,omitempty"`
+	GroupKey              *string `protobuf:"bytes,9,opt,name=group_key" json:"group_key,omitempty"`
 	XXX_unrecognized      []byte  `json:"-"`
 }
 
@@ -109,11 +137,55 @@ func (m *AllowRequest) GetMaxWaitMillisOverride() int64 {
 	return 0
 }
 
+func (m *AllowRequest) GetOperationType() string {
+	if m != nil && m.OperationType != nil {
+		return *m.OperationType
+	}
+	return ""
+}
+
+func (m *AllowRequest) GetIncludeTrace() bool {
+	if m != nil && m.IncludeTrace != nil {
+		return *m.IncludeTrace
+	}
+	return false
+}
+
+func (m *AllowRequest) GetDryRun() bool {
+	if m != nil && m.DryRun != nil {
+		return *m.DryRun
+	}
+	return false
+}
+
+func (m *AllowRequest) GetPriority() int32 {
+	if m != nil && m.Priority != nil {
+		return *m.Priority
+	}
+	return 0
+}
+
+func (m *AllowRequest) GetGroupKey() string {
+	if m != nil && m.GroupKey != nil {
+		return *m.GroupKey
+	}
+	return ""
+}
+
 type AllowResponse struct {
-	Status           *AllowResponse_Status `protobuf:"varint,1,opt,name=status,enum=quotaservice.AllowResponse_Status" json:"status,omitempty"`
-	NumTokensGranted *int64                `protobuf:"varint,2,opt,name=num_tokens_granted" json:"num_tokens_granted,omitempty"`
-	WaitMillis       *int64                `protobuf:"varint,3,opt,name=wait_millis" json:"wait_millis,omitempty"`
-	XXX_unrecognized []byte                `json:"-"`
+	Status                 *AllowResponse_Status `protobuf:"varint,1,opt,name=status,enum=quotaservice.AllowResponse_Status" json:"status,omitempty"`
+	NumTokensGranted       *int64                `protobuf:"varint,2,opt,name=num_tokens_granted" json:"num_tokens_granted,omitempty"`
+	WaitMillis             *int64                `protobuf:"varint,3,opt,name=wait_millis" json:"wait_millis,omitempty"`
+	TraceId                *string               `protobuf:"bytes,4,opt,name=trace_id" json:"trace_id,omitempty"`
+	BurstTokens            *int64                `protobuf:"varint,5,opt,name=burst_tokens" json:"burst_tokens,omitempty"`
+	SustainedTokens        *int64                `protobuf:"varint,6,opt,name=sustained_tokens" json:"sustained_tokens,omitempty"`
+	DegradationLevel       *int32                `protobuf:"varint,7,opt,name=degradation_level" json:"degradation_level,omitempty"`
+	ResolutionTrace        *string               `protobuf:"bytes,8,opt,name=resolution_trace" json:"resolution_trace,omitempty"`
+	RejectionMessage       *string               `protobuf:"bytes,9,opt,name=rejection_message" json:"rejection_message,omitempty"`
+	ClampedTokens          *int64                `protobuf:"varint,10,opt,name=clamped_tokens" json:"clamped_tokens,omitempty"`
+	DryRun                 *bool                 `protobuf:"varint,11,opt,name=dry_run" json:"dry_run,omitempty"`
+	EffectiveMaxWaitMillis *int64                `protobuf:"varint,12,opt,name=effective_max_wait_millis" json:"effective_max_wait_millis,omitempty"`
+	XXX_unrecognized       []byte                `json:"-"`
 }
 
 func (m *AllowResponse) Reset()                    { *m = AllowResponse{} }
@@ -142,9 +214,204 @@ func (m *AllowResponse) GetWaitMillis() int64 {
 	return 0
 }
 
+func (m *AllowResponse) GetTraceId() string {
+	if m != nil && m.TraceId != nil {
+		return *m.TraceId
+	}
+	return ""
+}
+
+func (m *AllowResponse) GetBurstTokens() int64 {
+	if m != nil && m.BurstTokens != nil {
+		return *m.BurstTokens
+	}
+	return 0
+}
+
+func (m *AllowResponse) GetSustainedTokens() int64 {
+	if m != nil && m.SustainedTokens != nil {
+		return *m.SustainedTokens
+	}
+	return 0
+}
+
+func (m *AllowResponse) GetDegradationLevel() int32 {
+	if m != nil && m.DegradationLevel != nil {
+		return *m.DegradationLevel
+	}
+	return 0
+}
+
+func (m *AllowResponse) GetResolutionTrace() string {
+	if m != nil && m.ResolutionTrace != nil {
+		return *m.ResolutionTrace
+	}
+	return ""
+}
+
+func (m *AllowResponse) GetRejectionMessage() string {
+	if m != nil && m.RejectionMessage != nil {
+		return *m.RejectionMessage
+	}
+	return ""
+}
+
+func (m *AllowResponse) GetClampedTokens() int64 {
+	if m != nil && m.ClampedTokens != nil {
+		return *m.ClampedTokens
+	}
+	return 0
+}
+
+func (m *AllowResponse) GetDryRun() bool {
+	if m != nil && m.DryRun != nil {
+		return *m.DryRun
+	}
+	return false
+}
+
+func (m *AllowResponse) GetEffectiveMaxWaitMillis() int64 {
+	if m != nil && m.EffectiveMaxWaitMillis != nil {
+		return *m.EffectiveMaxWaitMillis
+	}
+	return 0
+}
+
+type HealthCheckRequest struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *HealthCheckRequest) Reset()                    { *m = HealthCheckRequest{} }
+func (m *HealthCheckRequest) String() string            { return proto.CompactTextString(m) }
+func (*HealthCheckRequest) ProtoMessage()               {}
+func (*HealthCheckRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+type HealthCheckResponse struct {
+	Healthy          *bool  `protobuf:"varint,1,opt,name=healthy" json:"healthy,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *HealthCheckResponse) Reset()                    { *m = HealthCheckResponse{} }
+func (m *HealthCheckResponse) String() string            { return proto.CompactTextString(m) }
+func (*HealthCheckResponse) ProtoMessage()               {}
+func (*HealthCheckResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *HealthCheckResponse) GetHealthy() bool {
+	if m != nil && m.Healthy != nil {
+		return *m.Healthy
+	}
+	return false
+}
+
+type ReturnTokensRequest struct {
+	Namespace        *string `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	Name             *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Tokens           *int64  `protobuf:"varint,3,opt,name=tokens" json:"tokens,omitempty"`
+	OperationType    *string `protobuf:"bytes,4,opt,name=operation_type" json:"operation_type,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ReturnTokensRequest) Reset()                    { *m = ReturnTokensRequest{} }
+func (m *ReturnTokensRequest) String() string            { return proto.CompactTextString(m) }
+func (*ReturnTokensRequest) ProtoMessage()               {}
+func (*ReturnTokensRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *ReturnTokensRequest) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *ReturnTokensRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *ReturnTokensRequest) GetTokens() int64 {
+	if m != nil && m.Tokens != nil {
+		return *m.Tokens
+	}
+	return 0
+}
+
+func (m *ReturnTokensRequest) GetOperationType() string {
+	if m != nil && m.OperationType != nil {
+		return *m.OperationType
+	}
+	return ""
+}
+
+type ReturnTokensResponse struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *ReturnTokensResponse) Reset()                    { *m = ReturnTokensResponse{} }
+func (m *ReturnTokensResponse) String() string            { return proto.CompactTextString(m) }
+func (*ReturnTokensResponse) ProtoMessage()               {}
+func (*ReturnTokensResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+type ReplicateGrantRequest struct {
+	Namespace        *string `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	Name             *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	TokensGranted    *int64  `protobuf:"varint,3,opt,name=tokens_granted" json:"tokens_granted,omitempty"`
+	TimestampNanos   *int64  `protobuf:"varint,4,opt,name=timestamp_nanos" json:"timestamp_nanos,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ReplicateGrantRequest) Reset()                    { *m = ReplicateGrantRequest{} }
+func (m *ReplicateGrantRequest) String() string            { return proto.CompactTextString(m) }
+func (*ReplicateGrantRequest) ProtoMessage()               {}
+func (*ReplicateGrantRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *ReplicateGrantRequest) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *ReplicateGrantRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *ReplicateGrantRequest) GetTokensGranted() int64 {
+	if m != nil && m.TokensGranted != nil {
+		return *m.TokensGranted
+	}
+	return 0
+}
+
+func (m *ReplicateGrantRequest) GetTimestampNanos() int64 {
+	if m != nil && m.TimestampNanos != nil {
+		return *m.TimestampNanos
+	}
+	return 0
+}
+
+type ReplicateGrantResponse struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *ReplicateGrantResponse) Reset()                    { *m = ReplicateGrantResponse{} }
+func (m *ReplicateGrantResponse) String() string            { return proto.CompactTextString(m) }
+func (*ReplicateGrantResponse) ProtoMessage()               {}
+func (*ReplicateGrantResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
 func init() {
 	proto.RegisterType((*AllowRequest)(nil), "quotaservice.AllowRequest")
 	proto.RegisterType((*AllowResponse)(nil), "quotaservice.AllowResponse")
+	proto.RegisterType((*HealthCheckRequest)(nil), "quotaservice.HealthCheckRequest")
+	proto.RegisterType((*HealthCheckResponse)(nil), "quotaservice.HealthCheckResponse")
+	proto.RegisterType((*ReturnTokensRequest)(nil), "quotaservice.ReturnTokensRequest")
+	proto.RegisterType((*ReturnTokensResponse)(nil), "quotaservice.ReturnTokensResponse")
+	proto.RegisterType((*ReplicateGrantRequest)(nil), "quotaservice.ReplicateGrantRequest")
+	proto.RegisterType((*ReplicateGrantResponse)(nil), "quotaservice.ReplicateGrantResponse")
 	proto.RegisterEnum("quotaservice.AllowResponse_Status", AllowResponse_Status_name, AllowResponse_Status_value)
 }
 
@@ -156,6 +423,9 @@ var _ grpc.ClientConn
 
 type QuotaServiceClient interface {
 	Allow(ctx context.Context, in *AllowRequest, opts ...grpc.CallOption) (*AllowResponse, error)
+	HealthCheck(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckResponse, error)
+	ReturnTokens(ctx context.Context, in *ReturnTokensRequest, opts ...grpc.CallOption) (*ReturnTokensResponse, error)
+	ReplicateGrant(ctx context.Context, in *ReplicateGrantRequest, opts ...grpc.CallOption) (*ReplicateGrantResponse, error)
 }
 
 type quotaServiceClient struct {
@@ -175,10 +445,40 @@ func (c *quotaServiceClient) Allow(ctx context.Context, in *AllowRequest, opts .
 	return out, nil
 }
 
+func (c *quotaServiceClient) HealthCheck(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckResponse, error) {
+	out := new(HealthCheckResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.QuotaService/HealthCheck", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quotaServiceClient) ReturnTokens(ctx context.Context, in *ReturnTokensRequest, opts ...grpc.CallOption) (*ReturnTokensResponse, error) {
+	out := new(ReturnTokensResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.QuotaService/ReturnTokens", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quotaServiceClient) ReplicateGrant(ctx context.Context, in *ReplicateGrantRequest, opts ...grpc.CallOption) (*ReplicateGrantResponse, error) {
+	out := new(ReplicateGrantResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.QuotaService/ReplicateGrant", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for QuotaService service
 
 type QuotaServiceServer interface {
 	Allow(context.Context, *AllowRequest) (*AllowResponse, error)
+	HealthCheck(context.Context, *HealthCheckRequest) (*HealthCheckResponse, error)
+	ReturnTokens(context.Context, *ReturnTokensRequest) (*ReturnTokensResponse, error)
+	ReplicateGrant(context.Context, *ReplicateGrantRequest) (*ReplicateGrantResponse, error)
 }
 
 func RegisterQuotaServiceServer(s *grpc.Server, srv QuotaServiceServer) {
@@ -197,6 +497,42 @@ func _QuotaService_Allow_Handler(srv interface{}, ctx context.Context, dec func(
 	return out, nil
 }
 
+func _QuotaService_HealthCheck_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(HealthCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(QuotaServiceServer).HealthCheck(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _QuotaService_ReturnTokens_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ReturnTokensRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(QuotaServiceServer).ReturnTokens(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _QuotaService_ReplicateGrant_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ReplicateGrantRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(QuotaServiceServer).ReplicateGrant(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _QuotaService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "quotaservice.QuotaService",
 	HandlerType: (*QuotaServiceServer)(nil),
@@ -205,28 +541,62 @@ var _QuotaService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Allow",
 			Handler:    _QuotaService_Allow_Handler,
 		},
+		{
+			MethodName: "HealthCheck",
+			Handler:    _QuotaService_HealthCheck_Handler,
+		},
+		{
+			MethodName: "ReturnTokens",
+			Handler:    _QuotaService_ReturnTokens_Handler,
+		},
+		{
+			MethodName: "ReplicateGrant",
+			Handler:    _QuotaService_ReplicateGrant_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{},
 }
 
 var fileDescriptor0 = []byte{
-	// 286 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x7c, 0x90, 0xcf, 0x4f, 0x83, 0x30,
-	0x14, 0xc7, 0xe5, 0x87, 0xe8, 0xde, 0xd0, 0x60, 0xf5, 0x40, 0xd0, 0xc3, 0xc2, 0xc9, 0x13, 0x26,
-	0x5c, 0x3c, 0xa3, 0x62, 0x32, 0x67, 0xb2, 0xc8, 0x96, 0x78, 0x6c, 0x9a, 0xed, 0xc5, 0x10, 0x81,
-	0xb2, 0xb6, 0x6c, 0xfe, 0x53, 0xfe, 0x8f, 0x42, 0xe1, 0x80, 0x89, 0xf1, 0xd6, 0x7e, 0xfa, 0x7d,
-	0xf9, 0x7e, 0x5e, 0x21, 0xa8, 0x05, 0x57, 0x5c, 0xde, 0xed, 0x1a, 0xae, 0x18, 0x95, 0x28, 0xf6,
-	0xf9, 0x06, 0x23, 0x0d, 0x89, 0xab, 0xe1, 0xc0, 0x42, 0x0e, 0x6e, 0x52, 0x14, 0xfc, 0x90, 0xe1,
-	0xae, 0x41, 0xa9, 0xc8, 0x05, 0x4c, 0x2a, 0x56, 0xa2, 0xac, 0xd9, 0x06, 0x7d, 0x63, 0x66, 0xdc,
-	0x4e, 0x88, 0x0b, 0x76, 0x87, 0x7c, 0x53, 0xdf, 0x6e, 0xe0, 0xaa, 0x6a, 0x4a, 0xaa, 0xf8, 0x27,
-	0x56, 0x92, 0x8a, 0x7e, 0x0c, 0xb7, 0xbe, 0xd5, 0xbe, 0x5a, 0x64, 0x06, 0x7e, 0xc9, 0xbe, 0xe8,
-	0x81, 0xe5, 0x8a, 0x96, 0x79, 0x51, 0xe4, 0x92, 0xf2, 0x3d, 0x0a, 0x91, 0x6f, 0xd1, 0xb7, 0xbb,
-	0x44, 0xf8, 0x6d, 0xc0, 0xd9, 0xd0, 0x28, 0x6b, 0x5e, 0x49, 0x24, 0x31, 0x38, 0x52, 0x31, 0xd5,
-	0x48, 0xdd, 0x77, 0x1e, 0x87, 0xd1, 0xd8, 0x30, 0xfa, 0x15, 0x8e, 0x56, 0x3a, 0x49, 0x02, 0x20,
-	0x23, 0x8b, 0x0f, 0xc1, 0xaa, 0xce, 0xc1, 0xd4, 0x0e, 0x97, 0x30, 0x1d, 0xf5, 0xf7, 0x62, 0xe1,
-	0x3d, 0x38, 0xc3, 0xa8, 0x03, 0xe6, 0x72, 0xe1, 0x19, 0x64, 0x0a, 0x27, 0xcb, 0x05, 0x7d, 0x4f,
-	0xe6, 0x6b, 0xcf, 0x6c, 0x77, 0x3c, 0xcd, 0xd2, 0x97, 0xf4, 0x71, 0x9d, 0x3e, 0x79, 0x16, 0x01,
-	0x70, 0x9e, 0x93, 0xf9, 0x6b, 0x7b, 0xb6, 0xe3, 0x0c, 0xdc, 0xb7, 0x4e, 0x67, 0xd5, 0xeb, 0x90,
-	0x07, 0x38, 0xd6, 0x46, 0x24, 0xf8, 0x53, 0x53, 0x7f, 0x47, 0x70, 0xfd, 0xcf, 0x0a, 0xe1, 0xd1,
-	0x4f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x14, 0x38, 0xdd, 0x6a, 0x9f, 0x01, 0x00, 0x00,
+	// 625 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x53, 0xdd, 0x52, 0xd3, 0x40,
+	0x14, 0x36, 0x2d, 0x4d, 0xd3, 0xd3, 0x50, 0xc2, 0x52, 0x6a, 0x88, 0x5e, 0x94, 0xe8, 0x38, 0xbd,
+	0xaa, 0x33, 0xdc, 0x78, 0x8d, 0x50, 0x15, 0x71, 0x86, 0xb1, 0x74, 0x86, 0x2b, 0xdd, 0x59, 0x93,
+	0x43, 0x59, 0xc9, 0x1f, 0xbb, 0x9b, 0x62, 0x9f, 0xc1, 0xd7, 0xf3, 0x01, 0x7c, 0x14, 0x27, 0x9b,
+	0x80, 0x6d, 0xc5, 0x0e, 0x97, 0x39, 0x7b, 0xce, 0x77, 0xce, 0xf7, 0x13, 0xf0, 0x32, 0x91, 0xaa,
+	0x54, 0xbe, 0xbe, 0xc9, 0x53, 0xc5, 0xa8, 0x44, 0x31, 0xe3, 0x01, 0x0e, 0x75, 0x91, 0xd8, 0xba,
+	0x58, 0xd5, 0xfc, 0x5f, 0x06, 0xd8, 0x87, 0x51, 0x94, 0xde, 0x8e, 0xf1, 0x26, 0x47, 0xa9, 0xc8,
+	0x36, 0xb4, 0x12, 0x16, 0xa3, 0xcc, 0x58, 0x80, 0xae, 0xd1, 0x37, 0x06, 0x2d, 0x62, 0xc3, 0x46,
+	0x51, 0x72, 0x6b, 0xfa, 0xeb, 0x39, 0x74, 0x93, 0x3c, 0xa6, 0x2a, 0xbd, 0xc6, 0x44, 0x52, 0x51,
+	0x8e, 0x61, 0xe8, 0xd6, 0xfb, 0xc6, 0xa0, 0x4e, 0xfa, 0xe0, 0xc6, 0xec, 0x07, 0xbd, 0x65, 0x5c,
+	0xd1, 0x98, 0x47, 0x11, 0x97, 0x34, 0x9d, 0xa1, 0x10, 0x3c, 0x44, 0x77, 0x43, 0x77, 0xf4, 0xa0,
+	0x93, 0x66, 0x28, 0x98, 0xe2, 0x69, 0x42, 0xd5, 0x3c, 0x43, 0xb7, 0xa1, 0x71, 0x77, 0x61, 0x93,
+	0x27, 0x41, 0x94, 0x87, 0x48, 0x95, 0x28, 0x96, 0x9b, 0x7d, 0x63, 0x60, 0x91, 0x2d, 0x68, 0x86,
+	0x62, 0x4e, 0x45, 0x9e, 0xb8, 0x4d, 0x5d, 0x70, 0xc0, 0xca, 0x04, 0x4f, 0x05, 0x57, 0x73, 0xd7,
+	0xea, 0x1b, 0x83, 0x46, 0x71, 0xf2, 0x54, 0xa4, 0x79, 0x46, 0xaf, 0x71, 0xee, 0xb6, 0x0a, 0x30,
+	0xff, 0x67, 0x1d, 0x36, 0x2b, 0x5a, 0x32, 0x4b, 0x13, 0x89, 0xe4, 0x00, 0x4c, 0xa9, 0x98, 0xca,
+	0xa5, 0x26, 0xd5, 0x39, 0xf0, 0x87, 0x8b, 0x3a, 0x0c, 0x97, 0x9a, 0x87, 0xe7, 0xba, 0x93, 0x78,
+	0x40, 0x16, 0xa8, 0x4e, 0x05, 0x4b, 0x0a, 0xa2, 0x35, 0x4d, 0x63, 0x07, 0xda, 0x0b, 0x24, 0x2b,
+	0xf6, 0x0e, 0x58, 0xfa, 0x76, 0xca, 0x43, 0xcd, 0xb6, 0x45, 0xba, 0x60, 0x7f, 0xcb, 0x85, 0x54,
+	0x15, 0x88, 0xe6, 0x5a, 0x27, 0x2e, 0x38, 0x32, 0x97, 0x8a, 0xf1, 0x04, 0xc3, 0xbb, 0x17, 0x53,
+	0xbf, 0xec, 0xc1, 0x76, 0x88, 0x53, 0xc1, 0xc2, 0x52, 0x9f, 0x08, 0x67, 0x18, 0x69, 0xe2, 0x8d,
+	0x62, 0x48, 0xa0, 0x4c, 0xa3, 0x5c, 0xbf, 0x94, 0x1a, 0x59, 0x7a, 0xc9, 0x1e, 0x6c, 0x0b, 0xfc,
+	0x8e, 0x81, 0x7e, 0x88, 0x51, 0x4a, 0x36, 0xc5, 0x52, 0x88, 0x42, 0xed, 0x20, 0x62, 0x71, 0xf6,
+	0x77, 0x0f, 0xe8, 0x3d, 0x0b, 0xb2, 0xb6, 0xb5, 0xac, 0xfb, 0xb0, 0x87, 0x97, 0x97, 0x05, 0xc6,
+	0x0c, 0xe9, 0x8a, 0x85, 0xae, 0x5d, 0xcc, 0xf8, 0x6f, 0xc0, 0xac, 0x84, 0x31, 0xa1, 0x76, 0x76,
+	0xea, 0x18, 0xa4, 0x0d, 0xcd, 0xb3, 0x53, 0x7a, 0x71, 0x78, 0x32, 0x71, 0x6a, 0xc4, 0x06, 0x6b,
+	0x3c, 0xfa, 0x38, 0x3a, 0x9a, 0x8c, 0x8e, 0x9d, 0x3a, 0x01, 0x30, 0xdf, 0x1d, 0x9e, 0x7c, 0x1a,
+	0x1d, 0x3b, 0x1b, 0x7e, 0x17, 0xc8, 0x07, 0x64, 0x91, 0xba, 0x3a, 0xba, 0xc2, 0xe0, 0xba, 0x4a,
+	0x9a, 0xff, 0x0a, 0x76, 0x96, 0xaa, 0x95, 0x51, 0x5b, 0xd0, 0xbc, 0xd2, 0xe5, 0xb9, 0x76, 0xca,
+	0xf2, 0xbf, 0xc2, 0xce, 0x18, 0x55, 0x2e, 0x92, 0x89, 0x26, 0xf0, 0xe8, 0xa0, 0x76, 0xc0, 0xac,
+	0x28, 0xd7, 0xff, 0x13, 0x3c, 0x6d, 0x91, 0xdf, 0x83, 0xee, 0x32, 0x7e, 0x79, 0x88, 0xcf, 0x61,
+	0x77, 0x8c, 0x59, 0xc4, 0x03, 0xa6, 0xf0, 0x7d, 0xe1, 0xfd, 0xa3, 0x37, 0xf7, 0xa0, 0xb3, 0x92,
+	0x99, 0xf2, 0x82, 0xa7, 0xb0, 0xa5, 0x78, 0x8c, 0x52, 0xb1, 0x38, 0xa3, 0x09, 0x4b, 0x52, 0x59,
+	0xfe, 0x13, 0xbe, 0x0b, 0xbd, 0xd5, 0x55, 0xe5, 0x11, 0x07, 0xbf, 0x6b, 0x60, 0x7f, 0x2e, 0x82,
+	0x7a, 0x5e, 0x06, 0x95, 0xbc, 0x85, 0x86, 0xce, 0x2a, 0xf1, 0x1e, 0x0c, 0xb0, 0xbe, 0xd0, 0x7b,
+	0xb6, 0x26, 0xdc, 0xfe, 0x13, 0x32, 0x81, 0xf6, 0x82, 0xf2, 0xa4, 0xbf, 0xdc, 0xfd, 0xaf, 0x55,
+	0xde, 0xfe, 0x9a, 0x8e, 0x7b, 0xd4, 0x0b, 0xb0, 0x17, 0x75, 0x24, 0x2b, 0x43, 0x0f, 0x78, 0xe8,
+	0xf9, 0xeb, 0x5a, 0xee, 0x81, 0xbf, 0x40, 0x67, 0x59, 0x1d, 0xf2, 0x62, 0x75, 0xee, 0x01, 0x9b,
+	0xbc, 0x97, 0xeb, 0x9b, 0xee, 0xe0, 0xff, 0x0c, 0x00, 0xc1, 0x35, 0xbc, 0xfb, 0x2d, 0x05, 0x00,
+	0x00,
 }
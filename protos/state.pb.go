@@ -0,0 +1,102 @@
+// Code generated by protoc-gen-go.
+// source: protos/state.proto
+// DO NOT EDIT!
+
+package quotaservice
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type BucketState struct {
+	Namespace                *string `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	Name                     *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	AccumulatedTokens        *int64  `protobuf:"varint,3,opt,name=accumulated_tokens" json:"accumulated_tokens,omitempty"`
+	TokensNextAvailableNanos *int64  `protobuf:"varint,4,opt,name=tokens_next_available_nanos" json:"tokens_next_available_nanos,omitempty"`
+	XXX_unrecognized         []byte  `json:"-"`
+}
+
+func (m *BucketState) Reset()                    { *m = BucketState{} }
+func (m *BucketState) String() string            { return proto.CompactTextString(m) }
+func (*BucketState) ProtoMessage()               {}
+func (*BucketState) Descriptor() ([]byte, []int) { return fileDescriptor3, []int{0} }
+
+func (m *BucketState) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *BucketState) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *BucketState) GetAccumulatedTokens() int64 {
+	if m != nil && m.AccumulatedTokens != nil {
+		return *m.AccumulatedTokens
+	}
+	return 0
+}
+
+func (m *BucketState) GetTokensNextAvailableNanos() int64 {
+	if m != nil && m.TokensNextAvailableNanos != nil {
+		return *m.TokensNextAvailableNanos
+	}
+	return 0
+}
+
+type StateSnapshot struct {
+	TimestampNanos   *int64         `protobuf:"varint,1,opt,name=timestamp_nanos" json:"timestamp_nanos,omitempty"`
+	Buckets          []*BucketState `protobuf:"bytes,2,rep,name=buckets" json:"buckets,omitempty"`
+	XXX_unrecognized []byte         `json:"-"`
+}
+
+func (m *StateSnapshot) Reset()                    { *m = StateSnapshot{} }
+func (m *StateSnapshot) String() string            { return proto.CompactTextString(m) }
+func (*StateSnapshot) ProtoMessage()               {}
+func (*StateSnapshot) Descriptor() ([]byte, []int) { return fileDescriptor3, []int{1} }
+
+func (m *StateSnapshot) GetTimestampNanos() int64 {
+	if m != nil && m.TimestampNanos != nil {
+		return *m.TimestampNanos
+	}
+	return 0
+}
+
+func (m *StateSnapshot) GetBuckets() []*BucketState {
+	if m != nil {
+		return m.Buckets
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*BucketState)(nil), "quotaservice.BucketState")
+	proto.RegisterType((*StateSnapshot)(nil), "quotaservice.StateSnapshot")
+}
+
+var fileDescriptor3 = []byte{
+	// 193 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x4c, 0x8e, 0xcf, 0x4a, 0xc4, 0x30,
+	0x10, 0x87, 0xc9, 0x76, 0x41, 0x76, 0x76, 0x45, 0xcc, 0xc5, 0xa8, 0x97, 0x52, 0x2f, 0xc5, 0x43,
+	0x05, 0x1f, 0xc1, 0x57, 0xa8, 0xf7, 0x30, 0x8d, 0x03, 0x96, 0x36, 0x7f, 0xec, 0x4c, 0x8a, 0x8f,
+	0x2f, 0x8d, 0x7b, 0xe8, 0xf1, 0x1b, 0x3e, 0xe6, 0xf7, 0x81, 0x4e, 0x4b, 0x94, 0xc8, 0x6f, 0x2c,
+	0x28, 0xd4, 0x15, 0xd0, 0x97, 0x9f, 0x1c, 0x05, 0x99, 0x96, 0x75, 0x74, 0xd4, 0x44, 0x38, 0x7f,
+	0x64, 0x37, 0x91, 0xf4, 0x9b, 0xa2, 0xef, 0xe1, 0x14, 0xd0, 0x13, 0x27, 0x74, 0x64, 0x54, 0xad,
+	0xda, 0x93, 0xbe, 0xc0, 0x71, 0x3b, 0x99, 0x43, 0xa1, 0x27, 0xd0, 0xe8, 0x5c, 0xf6, 0x79, 0x46,
+	0xa1, 0x2f, 0x2b, 0x71, 0xa2, 0xc0, 0xa6, 0xaa, 0x55, 0x5b, 0xe9, 0x17, 0x78, 0xfe, 0x67, 0x1b,
+	0xe8, 0x57, 0x2c, 0xae, 0x38, 0xce, 0x38, 0xcc, 0x64, 0x03, 0x86, 0xc8, 0xe6, 0xb8, 0x49, 0xcd,
+	0x27, 0xdc, 0x96, 0xa9, 0x3e, 0x60, 0xe2, 0xef, 0x28, 0xfa, 0x01, 0xee, 0x64, 0xf4, 0xc4, 0x82,
+	0x3e, 0x5d, 0x4d, 0x55, 0xde, 0xbd, 0xc2, 0xcd, 0x50, 0xd2, 0xd8, 0x1c, 0xea, 0xaa, 0x3d, 0xbf,
+	0x3f, 0x76, 0xfb, 0xf4, 0x6e, 0xd7, 0xfd, 0x37, 0x00, 0x95, 0xb2, 0xfb, 0xb4, 0xe9, 0x00, 0x00,
+	0x00,
+}
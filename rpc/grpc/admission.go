@@ -0,0 +1,108 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// AdmissionWorkers is the number of requests from an admission queue served at once.
+const AdmissionWorkers = 32
+
+// Ticket states. A ticket is either run by a worker, or abandoned by the request waiting on it,
+// whichever happens first.
+const (
+	ticketQueued int32 = iota
+	ticketRunning
+	ticketAbandoned
+)
+
+// admissionQueue queues requests for a fixed pool of workers, so that when the quota service
+// slows down, requests wait in a bounded queue rather than each holding a goroutine that is
+// blocked on the quota service.
+type admissionQueue struct {
+	workers int
+	maxWait time.Duration
+	queue   chan *admissionTicket
+	stop    chan struct{}
+}
+
+type admissionTicket struct {
+	state int32
+	run   func()
+	done  chan struct{}
+}
+
+func newAdmissionQueue(workers, maxQueue int, maxWait time.Duration) *admissionQueue {
+	return &admissionQueue{
+		workers: workers,
+		maxWait: maxWait,
+		queue:   make(chan *admissionTicket, maxQueue)}
+}
+
+// submit queues run, and waits for a worker to run it. Fails with codes.ResourceExhausted if the
+// queue is full, or if no worker starts running it within maxWait, and with codes.Canceled if the
+// request is canceled first. Once a worker starts running it, submit waits for it to finish.
+func (q *admissionQueue) submit(ctx context.Context, run func()) error {
+	t := &admissionTicket{run: run, done: make(chan struct{})}
+	select {
+	case q.queue <- t:
+	default:
+		return grpc.Errorf(codes.ResourceExhausted, "admission queue full")
+	}
+
+	timer := time.NewTimer(q.maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-t.done:
+		return nil
+	case <-timer.C:
+		err = grpc.Errorf(codes.ResourceExhausted, "timed out in admission queue")
+	case <-ctx.Done():
+		err = grpc.Errorf(codes.Canceled, "canceled in admission queue")
+	}
+
+	if atomic.CompareAndSwapInt32(&t.state, ticketQueued, ticketAbandoned) {
+		return err
+	}
+
+	// A worker started running it in the meantime.
+	<-t.done
+	return nil
+}
+
+func (q *admissionQueue) start() {
+	q.stop = make(chan struct{})
+	for i := 0; i < q.workers; i++ {
+		go q.work(q.stop)
+	}
+}
+
+func (q *admissionQueue) work(stop chan struct{}) {
+	for {
+		select {
+		case t := <-q.queue:
+			if atomic.CompareAndSwapInt32(&t.state, ticketQueued, ticketRunning) {
+				t.run()
+				close(t.done)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (q *admissionQueue) stopWorkers() {
+	if q.stop != nil {
+		close(q.stop)
+		q.stop = nil
+	}
+}
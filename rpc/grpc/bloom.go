@@ -0,0 +1,130 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// bloomFilter is a fixed-size set of keys, which may report keys as present that were never added,
+// at a rate that depends on its size and the number of keys added. Keys are hashes already, so
+// the k indexes of a key are derived from the two halves of it.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // Number of bits.
+	k    uint64 // Number of indexes per key.
+}
+
+// maxBloomFilterBits caps the size of a bloom filter at 8MiB. Filters for buckets granting more
+// requests than fit have a higher false positive rate than configured.
+const maxBloomFilterBits = 1 << 26
+
+// newBloomFilter creates a filter sized to hold n keys with a false positive rate of fpRate, up to
+// maxBloomFilterBits.
+func newBloomFilter(n int64, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+
+	m := uint64(math.Min(maxBloomFilterBits, math.Ceil(-float64(n)*math.Log(fpRate)/(math.Ln2*math.Ln2))))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func (f *bloomFilter) add(key uint64) {
+	h1, h2 := key&0xffffffff, key>>32|1
+	for i := uint64(0); i < f.k; i++ {
+		idx := (h1 + i*h2) % f.m
+		f.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+func (f *bloomFilter) contains(key uint64) bool {
+	h1, h2 := key&0xffffffff, key>>32|1
+	for i := uint64(0); i < f.k; i++ {
+		idx := (h1 + i*h2) % f.m
+		if f.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *bloomFilter) reset() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
+
+// bloomDedup remembers the requests a bucket granted during the current and previous windows,
+// using a bloom filter for each.
+type bloomDedup struct {
+	window            time.Duration
+	current, previous *bloomFilter
+	rotated           time.Time
+	now               func() time.Time
+	sync.Mutex
+}
+
+// newBloomDedup sizes filters for the most requests a bucket could grant in a window: its size,
+// plus the tokens it refills in the window, plus those it may lend from the future.
+func newBloomDedup(cfg *configs.BucketConfig) *bloomDedup {
+	keys := float64(cfg.Size) + float64(cfg.FillRate)*(float64(cfg.BloomWindowMs)+float64(cfg.MaxDebtMillis))/1000
+	n := int64(math.MaxInt64)
+	if keys < math.MaxInt64 {
+		n = int64(keys)
+	}
+	fpRate := cfg.BloomFPRate
+	if fpRate == 0 {
+		// Defaults haven't been applied to the config.
+		fpRate = 0.01
+	}
+
+	return &bloomDedup{
+		window:   time.Duration(cfg.BloomWindowMs) * time.Millisecond,
+		current:  newBloomFilter(n, fpRate),
+		previous: newBloomFilter(n, fpRate),
+		rotated:  time.Now(),
+		now:      time.Now}
+}
+
+// seen returns true if key was added during the current or previous window.
+func (d *bloomDedup) seen(key uint64) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	d.rotate()
+	return d.current.contains(key) || d.previous.contains(key)
+}
+
+func (d *bloomDedup) add(key uint64) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.rotate()
+	d.current.add(key)
+}
+
+// rotate starts a new window if the current one has ended. Must be called with the lock held.
+func (d *bloomDedup) rotate() {
+	elapsed := d.now().Sub(d.rotated)
+	if elapsed < d.window {
+		return
+	}
+
+	d.previous.reset()
+	if elapsed < 2*d.window {
+		d.current, d.previous = d.previous, d.current
+	} else {
+		// Both windows have ended.
+		d.current.reset()
+	}
+
+	d.rotated = d.now()
+}
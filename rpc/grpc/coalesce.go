@@ -0,0 +1,104 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice"
+)
+
+// coalescer batches Allow requests for the same bucket that carry the same group key, so that
+// each group takes tokens from the quota service once per window, rather than once per request.
+type coalescer struct {
+	groups map[coalesceKey]*coalescedGroup // Groups still accepting requests.
+	sync.Mutex
+}
+
+type coalesceKey struct {
+	namespace, name, groupKey string
+}
+
+// coalescedGroup is a batch of requests, and the outcome they share once done is closed.
+type coalescedGroup struct {
+	requested []int64 // Tokens requested by each request, in the order they joined.
+	total     int64
+	done      chan struct{}
+	granted   []int64 // Tokens granted to each request.
+	wait      time.Duration
+	err       error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{groups: make(map[coalesceKey]*coalescedGroup)}
+}
+
+// allow adds a request for tokens to the group for its key, starting a group if there is none.
+// The first request of a group waits for window, then takes the tokens requested by the whole
+// group, waiting for them as long as the bucket allows. Every request of the group shares the
+// outcome, and the tokens granted are split across requests in proportion to the tokens they
+// requested. Requests granted no tokens, such as when the group is clamped to fewer tokens than
+// it has requests, should be rejected.
+func (c *coalescer) allow(qs quotaservice.QuotaService, key coalesceKey, tokens int64, window time.Duration) (int64, time.Duration, error) {
+	c.Lock()
+	if group := c.groups[key]; group != nil {
+		i := group.join(tokens)
+		c.Unlock()
+		<-group.done
+		return group.granted[i], group.wait, group.err
+	}
+
+	group := &coalescedGroup{done: make(chan struct{})}
+	group.join(tokens)
+	c.groups[key] = group
+	c.Unlock()
+
+	time.Sleep(window)
+
+	c.Lock()
+	// Requests arriving from now on start a new group.
+	delete(c.groups, key)
+	c.Unlock()
+
+	granted, wait, err := qs.Allow(key.namespace, key.name, group.total, -1)
+	if err == nil && wait < 0 {
+		// Rejected without waiting, such as by buckets with no wait timeout.
+		granted, wait = 0, 0
+	}
+
+	group.split(granted)
+	group.wait, group.err = wait, err
+	close(group.done)
+	return group.granted[0], group.wait, group.err
+}
+
+// join adds a request for tokens to the group, returning its index.
+func (g *coalescedGroup) join(tokens int64) int {
+	g.requested = append(g.requested, tokens)
+	g.total += tokens
+	return len(g.requested) - 1
+}
+
+// split shares tokens granted to the group across its requests, in proportion to the tokens each
+// requested. Tokens left over from rounding go to the earliest requests.
+func (g *coalescedGroup) split(granted int64) {
+	g.granted = make([]int64, len(g.requested))
+	if granted <= 0 || g.total <= 0 {
+		return
+	}
+
+	remaining := granted
+	for i, requested := range g.requested {
+		g.granted[i] = requested * granted / g.total
+		remaining -= g.granted[i]
+	}
+
+	for i := 0; remaining > 0 && i < len(g.requested); i++ {
+		if g.granted[i] < g.requested[i] {
+			g.granted[i]++
+			remaining--
+		}
+	}
+}
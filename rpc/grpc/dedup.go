@@ -0,0 +1,108 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+)
+
+// maxDedupEntries bounds the number of responses remembered for deduplication. The least recently
+// used responses are evicted first.
+const maxDedupEntries = 10000
+
+// dedupCache is an LRU cache of recent responses, keyed by a hash of the request that caused them,
+// so that retries of the same request within a namespace's deduplication window don't consume
+// tokens again.
+type dedupCache struct {
+	capacity int
+	entries  map[uint64]*list.Element
+	lru      *list.List
+	now      func() time.Time
+	sync.Mutex
+}
+
+type dedupEntry struct {
+	key     uint64
+	rsp     qspb.AllowResponse
+	created time.Time
+}
+
+func newDedupCache(capacity int) *dedupCache {
+	return &dedupCache{
+		capacity: capacity,
+		entries:  make(map[uint64]*list.Element),
+		lru:      list.New(),
+		now:      time.Now}
+}
+
+// dedupKey hashes the tuple identifying duplicate requests.
+func dedupKey(clientIP, namespace, name, operationType string, tokens int64) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v\x00%v\x00%v\x00%v\x00%v", clientIP, namespace, name, operationType, tokens)
+	return h.Sum64()
+}
+
+// get returns a copy of the response cached for key, if it was cached within window.
+func (c *dedupCache) get(key uint64, window time.Duration) *qspb.AllowResponse {
+	c.Lock()
+	defer c.Unlock()
+
+	e := c.entries[key]
+	if e == nil {
+		return nil
+	}
+
+	entry := e.Value.(*dedupEntry)
+	if c.now().Sub(entry.created) > window {
+		// Expired; the next request is treated as new.
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+
+	c.lru.MoveToFront(e)
+	rsp := entry.rsp
+	return &rsp
+}
+
+// put caches a copy of a response for key, evicting the least recently used response if full.
+func (c *dedupCache) put(key uint64, rsp *qspb.AllowResponse) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e := c.entries[key]; e != nil {
+		c.lru.Remove(e)
+	}
+
+	c.entries[key] = c.lru.PushFront(&dedupEntry{key: key, rsp: *rsp, created: c.now()})
+	if c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dedupEntry).key)
+	}
+}
+
+// clientIP returns the IP address of the client making a request, if known.
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
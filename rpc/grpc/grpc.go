@@ -7,21 +7,60 @@ import (
 	"net"
 	"fmt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
 	"golang.org/x/net/context"
 	"github.com/maniksurtani/quotaservice/logging"
 	"github.com/maniksurtani/quotaservice"
+	"github.com/maniksurtani/quotaservice/admin"
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
 	qspb "github.com/maniksurtani/quotaservice/protos"
 	"github.com/maniksurtani/quotaservice/lifecycle"
 	"github.com/golang/protobuf/proto"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultKeepalivePeriod is a keepalive period short enough to stop most load balancers from
+// silently dropping idle connections.
+const DefaultKeepalivePeriod = 30 * time.Second
+
+// RetryAfterTrailer is the trailing metadata key holding the number of seconds clients should wait
+// before retrying a rejected request, if the quota service reports it.
+const RetryAfterTrailer = "retry-after"
+
+// Stop() waits up to stopDrainTimeout for Allow RPCs in flight to complete, checking every
+// stopDrainInterval, before stopping the gRPC server.
+const (
+	stopDrainTimeout  = 5 * time.Second
+	stopDrainInterval = 10 * time.Millisecond
 )
 
 type GrpcEndpoint struct {
-	hostport      string
-	grpcServer    *grpc.Server
-	currentStatus lifecycle.Status
-	qs            quotaservice.QuotaService
+	hostport        string
+	grpcServer      *grpc.Server
+	listener        net.Listener
+	keepalivePeriod time.Duration
+	adminService    bool
+	federation      qspb.QuotaServiceFederationServer
+	namespaceKey    string
+	dedup           *dedupCache
+	bloomDedups     sync.Map   // Of *bloomEntry, by fully qualified bucket name.
+	bloomLock       sync.Mutex // Guards replacing entries in bloomDedups.
+	coalescer       *coalescer
+	allowSlots      chan struct{}
+	admission       *admissionQueue
+	selfBucket      buckets.Bucket
+	ipLimiter       *ipRateLimiter
+	inFlightAllows  int64
+	currentStatus   int32 // A lifecycle.Status, read and written atomically.
+	qs              quotaservice.QuotaService
 }
 // New creates a new GrpcEndpoint, listening on hostport. Hostport is a string in the form
 // "host:port"
@@ -30,7 +69,102 @@ func New(hostport string) *GrpcEndpoint {
 		panic(fmt.Sprintf("hostport should be in the format 'host:port', but is currently %v",
 			hostport))
 	}
-	return &GrpcEndpoint{hostport: hostport}
+	return &GrpcEndpoint{hostport: hostport, dedup: newDedupCache(maxDedupEntries), coalescer: newCoalescer()}
+}
+
+// WithKeepalive enables TCP keepalives, sent every period on otherwise idle connections, so that
+// long-lived connections aren't silently dropped by load balancers. Must be called before Start().
+func (g *GrpcEndpoint) WithKeepalive(period time.Duration) *GrpcEndpoint {
+	g.keepalivePeriod = period
+	return g
+}
+
+// WithAdminService also serves the QuotaServiceAdmin service on this endpoint, if the quota
+// service it is initialized with is administrable. Must be called before Start().
+func (g *GrpcEndpoint) WithAdminService() *GrpcEndpoint {
+	g.adminService = true
+	return g
+}
+
+// WithFederation also serves the QuotaServiceFederation service on this endpoint, so that peers
+// can sync token counts with f, usually a federation.FederatedQuotaService. Must be called before
+// Start().
+func (g *GrpcEndpoint) WithFederation(f qspb.QuotaServiceFederationServer) *GrpcEndpoint {
+	g.federation = f
+	return g
+}
+
+// WithNamespaceFromMetadata resolves the namespace of requests that don't specify one from the
+// value of metadataKey in the request's gRPC metadata, such as a tenant ID set by clients in
+// multi-tenant deployments. Requests with neither are rejected, as though no bucket exists.
+func (g *GrpcEndpoint) WithNamespaceFromMetadata(metadataKey string) *GrpcEndpoint {
+	// gRPC metadata keys are lower case.
+	g.namespaceKey = strings.ToLower(metadataKey)
+	return g
+}
+
+// WithMaxConcurrentAllows limits the number of Allow RPCs in flight to n, so that a slow backend
+// doesn't cause goroutines waiting for tokens to pile up. RPCs beyond the limit fail immediately
+// with codes.ResourceExhausted.
+func (g *GrpcEndpoint) WithMaxConcurrentAllows(n int) *GrpcEndpoint {
+	if n < 1 {
+		panic(fmt.Sprintf("Max concurrent allows should be positive, but is %v", n))
+	}
+
+	g.allowSlots = make(chan struct{}, n)
+	return g
+}
+
+// WithAdmissionQueue serves Allow RPCs using a fixed pool of AdmissionWorkers goroutines, which
+// RPCs queue for, so that a slow backend doesn't cause goroutines waiting for tokens to pile up.
+// RPCs fail with codes.ResourceExhausted if maxQueue RPCs are already queued, or if they wait
+// longer than maxWait for a worker.
+func (g *GrpcEndpoint) WithAdmissionQueue(maxQueue int, maxWait time.Duration) *GrpcEndpoint {
+	if maxQueue < 1 || maxWait <= 0 {
+		panic(fmt.Sprintf("Admission queue should have a positive size and wait, but has %v and %v", maxQueue, maxWait))
+	}
+
+	g.admission = newAdmissionQueue(AdmissionWorkers, maxQueue, maxWait)
+	return g
+}
+
+// WithSelfRateLimit limits the rate of Allow RPCs served by this endpoint to rps, with bursts of
+// up to burst RPCs, using an in-memory token bucket. RPCs beyond the limit fail immediately with
+// codes.ResourceExhausted. Unlike WithMaxConcurrentAllows(), this also protects the endpoint from
+// floods of requests that are served quickly.
+func (g *GrpcEndpoint) WithSelfRateLimit(rps int64, burst int64) *GrpcEndpoint {
+	if rps < 1 || burst < 1 {
+		panic(fmt.Sprintf("Self rate limit should be positive, but is %v rps with bursts of %v", rps, burst))
+	}
+
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.FillRate = rps
+	cfg.Size = burst
+	cfg.MaxIdleMillis = -1
+	// Requests are never allowed to wait for tokens.
+	cfg.MaxDebtMillis = 0
+
+	bf := memory.NewBucketFactory()
+	bf.Init(configs.NewDefaultServiceConfig())
+	g.selfBucket = bf.NewBucket("grpc", "self", cfg, false)
+	return g
+}
+
+// WithIPRateLimit limits the rate of Allow RPCs from each caller IP to rps, with bursts of up to
+// burst RPCs, using an in-memory token bucket per IP. RPCs beyond the limit fail immediately with
+// codes.ResourceExhausted. Buckets of IPs not seen for IPRateLimitIdleTimeout are garbage collected.
+func (g *GrpcEndpoint) WithIPRateLimit(rps int64, burst int64) *GrpcEndpoint {
+	if rps < 1 || burst < 1 {
+		panic(fmt.Sprintf("IP rate limit should be positive, but is %v rps with bursts of %v", rps, burst))
+	}
+
+	g.ipLimiter = newIPRateLimiter(rps, burst)
+	return g
+}
+
+// InFlightAllows returns the number of Allow RPCs currently being served.
+func (g *GrpcEndpoint) InFlightAllows() int {
+	return int(atomic.LoadInt64(&g.inFlightAllows))
 }
 
 func (g *GrpcEndpoint) Init(qs quotaservice.QuotaService) {
@@ -44,23 +178,138 @@ func (g *GrpcEndpoint) Start() {
 		panic(fmt.Sprintf("Cannot start server on port %v. Error %v", g.hostport, err))
 	}
 
+	if g.keepalivePeriod > 0 {
+		lis = &keepaliveListener{lis.(*net.TCPListener), g.keepalivePeriod}
+	}
+	g.listener = lis
+
 	grpclog.SetLogger(logging.CurrentLogger())
 	g.grpcServer = grpc.NewServer()
 	// Each service should be registered
 	qspb.RegisterQuotaServiceServer(g.grpcServer, g)
+	if a, ok := g.qs.(admin.Administrable); ok && g.adminService {
+		qspb.RegisterQuotaServiceAdminServer(g.grpcServer, admin.NewAdminServer(a))
+	}
+	if g.federation != nil {
+		qspb.RegisterQuotaServiceFederationServer(g.grpcServer, g.federation)
+	}
+	if g.ipLimiter != nil {
+		g.ipLimiter.start()
+	}
+	if g.admission != nil {
+		g.admission.start()
+	}
 	go g.grpcServer.Serve(lis)
-	g.currentStatus = lifecycle.Started
+	g.setStatus(lifecycle.Started)
 	logging.Printf("Starting server on %v", g.hostport)
-	logging.Printf("Server status: %v", g.currentStatus)
+	logging.Printf("Server status: %v", g.status())
+}
+
+// status returns the endpoint's lifecycle status, which is read by RPCs while Start() and Stop()
+// write it.
+func (g *GrpcEndpoint) status() lifecycle.Status {
+	return lifecycle.Status(atomic.LoadInt32(&g.currentStatus))
+}
+
+func (g *GrpcEndpoint) setStatus(status lifecycle.Status) {
+	atomic.StoreInt32(&g.currentStatus, int32(status))
+}
+
+// keepaliveListener enables TCP keepalives on accepted connections.
+type keepaliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l *keepaliveListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetKeepAlive(true)
+	c.SetKeepAlivePeriod(l.period)
+	return c, nil
 }
 
 func (g *GrpcEndpoint) Stop() {
-	g.currentStatus = lifecycle.Stopped
+	if g.ipLimiter != nil {
+		g.ipLimiter.stopGC()
+	}
+	if g.admission != nil {
+		g.admission.stopWorkers()
+	}
+	// New RPCs are refused straight away, while Allow RPCs in flight get up to stopDrainTimeout to
+	// complete before the server closes its connections.
+	g.setStatus(lifecycle.Stopped)
+	if g.grpcServer != nil {
+		deadline := time.Now().Add(stopDrainTimeout)
+		for g.InFlightAllows() > 0 && time.Now().Before(deadline) {
+			time.Sleep(stopDrainInterval)
+		}
+		g.grpcServer.Stop()
+	}
 }
 
 func (g *GrpcEndpoint) Allow(ctx context.Context, req *qspb.AllowRequest) (*qspb.AllowResponse, error) {
-	rsp := new(qspb.AllowResponse)
-	if invalid(req) {
+	if g.status() != lifecycle.Started {
+		return nil, grpc.Errorf(codes.Unavailable, "quota service not started")
+	}
+
+	if g.selfBucket != nil && g.selfBucket.Take(1, 0) != 0 {
+		return nil, grpc.Errorf(codes.ResourceExhausted, "too many Allow requests")
+	}
+
+	if g.ipLimiter != nil && !g.ipLimiter.allow(clientIP(ctx), time.Now()) {
+		return nil, grpc.Errorf(codes.ResourceExhausted, "too many Allow requests from this IP")
+	}
+
+	if g.admission != nil {
+		var rsp *qspb.AllowResponse
+		var err error
+		if qErr := g.admission.submit(ctx, func() { rsp, err = g.allow(ctx, req) }); qErr != nil {
+			return nil, qErr
+		}
+		return rsp, err
+	}
+
+	return g.allow(ctx, req)
+}
+
+// allow serves an Allow RPC that has been admitted.
+func (g *GrpcEndpoint) allow(ctx context.Context, req *qspb.AllowRequest) (*qspb.AllowResponse, error) {
+	if g.allowSlots != nil {
+		select {
+		case g.allowSlots <- struct{}{}:
+			defer func() { <-g.allowSlots }()
+		default:
+			return nil, grpc.Errorf(codes.ResourceExhausted, "too many concurrent Allow requests")
+		}
+	}
+
+	atomic.AddInt64(&g.inFlightAllows, 1)
+	defer atomic.AddInt64(&g.inFlightAllows, -1)
+
+	rsp := &qspb.AllowResponse{TraceId: proto.String(traceID(ctx))}
+	namespace := req.GetNamespace()
+	if namespace == "" && g.namespaceKey != "" {
+		namespace = g.namespaceFromMetadata(ctx)
+		if namespace == "" {
+			// Reported as for ER_NO_SUCH_BUCKET, since there is no namespace to find a bucket in.
+			s := qspb.AllowResponse_REJECTED
+			rsp.Status = &s
+			return rsp, nil
+		}
+	}
+
+	if req.Priority != nil {
+		namespace = g.priorityNamespace(req.GetPriority(), namespace)
+	}
+
+	// Aliases share the settings and the deduplication and coalescing keys of their namespace.
+	namespace = g.resolveNamespace(namespace)
+
+	if invalid(namespace, req) {
 		logging.Printf("Invalid request %+v", req)
 		s := qspb.AllowResponse_FAILED
 		rsp.Status = &s
@@ -77,11 +326,82 @@ func (g *GrpcEndpoint) Allow(ctx context.Context, req *qspb.AllowRequest) (*qspb
 		maxWaitMillisOverride = req.GetMaxWaitMillisOverride()
 	}
 
-	granted, wait, err := g.qs.Allow(req.GetNamespace(), req.GetName(), numTokensRequested, maxWaitMillisOverride)
+	// Retries of a request within the namespace's deduplication window get the same response.
+	var key uint64
+	window := g.dedupWindow(namespace)
+	if req.GetDryRun() {
+		// Dry runs don't take tokens, so there is nothing to deduplicate.
+		window = 0
+	}
+
+	// Buckets that use bloom filters for deduplication recognize retries of requests they granted.
+	// Since the filters can't tell a retry from a new request with the same key, such as one from
+	// another client behind the same NAT, or from a false positive, retries are still served by
+	// the bucket and charged for, rather than granted for free.
+	var bloom *bloomDedup
+	if !req.GetDryRun() {
+		bloom = g.bloomDedup(namespace, req.GetName())
+	}
+
+	if window > 0 || bloom != nil {
+		key = dedupKey(clientIP(ctx), namespace, req.GetName(), req.GetOperationType(), numTokensRequested)
+	}
+
+	if window > 0 {
+		if cached := g.dedup.get(key, window); cached != nil {
+			return cached, nil
+		}
+	}
+
+	maxWaitMillisOverride, effectiveMaxWaitMillis := g.negotiateMaxWait(ctx, namespace, req.GetName(), maxWaitMillisOverride)
+
+	var granted, burst int64
+	var wait time.Duration
+	var err error
+	var rejected bool
+	ol, operationLimiting := g.qs.(quotaservice.OperationLimiting)
+	ba, burstAccounting := g.qs.(quotaservice.BurstAccounting)
+	tr, tracing := g.qs.(quotaservice.Tracing)
+	dr, dryRunning := g.qs.(quotaservice.DryRunning)
+	dg, degradationReporting := g.qs.(quotaservice.DegradationReporting)
+	var level int32
+	if req.GetDryRun() {
+		if !dryRunning {
+			return nil, grpc.Errorf(codes.Unimplemented, "dry runs are unsupported")
+		}
+
+		burstAccounting = false
+		granted, wait, err = dr.DryRun(namespace, req.GetName(), req.GetOperationType(), numTokensRequested, maxWaitMillisOverride)
+	} else if groupWindow := g.coalesceWindow(namespace); groupWindow > 0 && req.GetGroupKey() != "" && req.GetOperationType() == "" {
+		// Requests in the same group share the outcome of taking tokens for the whole group.
+		burstAccounting = false
+		group := coalesceKey{namespace, req.GetName(), req.GetGroupKey()}
+		granted, wait, err = g.coalescer.allow(g.qs, group, numTokensRequested, groupWindow)
+		rejected = err == nil && granted == 0
+	} else if req.GetIncludeTrace() && tracing {
+		burstAccounting = false
+		var trace string
+		granted, wait, trace, err = tr.AllowWithTrace(namespace, req.GetName(), req.GetOperationType(), numTokensRequested, maxWaitMillisOverride)
+		rsp.ResolutionTrace = proto.String(trace)
+	} else if degradationReporting {
+		// The level is that of the bucket as the request was served, without looking it up again.
+		burstAccounting = burstAccounting && req.GetOperationType() == ""
+		granted, burst, level, wait, err = dg.AllowWithDegradation(namespace, req.GetName(), req.GetOperationType(), numTokensRequested, maxWaitMillisOverride)
+	} else if req.GetOperationType() != "" && operationLimiting {
+		burstAccounting = false
+		granted, wait, err = ol.AllowOperation(namespace, req.GetName(), req.GetOperationType(), numTokensRequested, maxWaitMillisOverride)
+	} else if burstAccounting {
+		granted, burst, wait, err = ba.AllowWithBurst(namespace, req.GetName(), numTokensRequested, maxWaitMillisOverride)
+	} else {
+		granted, wait, err = g.qs.Allow(namespace, req.GetName(), numTokensRequested, maxWaitMillisOverride)
+	}
 	var status qspb.AllowResponse_Status;
 
 	if err != nil {
 		if qsErr, ok := err.(quotaservice.QuotaServiceError); ok {
+			if qsErr.RejectionMessage != "" {
+				rsp.RejectionMessage = proto.String(qsErr.RejectionMessage)
+			}
 			switch qsErr.Reason {
 			case quotaservice.ER_NO_SUCH_BUCKET:
 				status = qspb.AllowResponse_REJECTED
@@ -89,11 +409,17 @@ func (g *GrpcEndpoint) Allow(ctx context.Context, req *qspb.AllowRequest) (*qspb
 				status = qspb.AllowResponse_REJECTED
 			case quotaservice.ER_TIMED_OUT_WAITING:
 				status = qspb.AllowResponse_REJECTED
+			case quotaservice.ER_NAMESPACE_LOCKED:
+				status = qspb.AllowResponse_REJECTED
+			case quotaservice.ER_SERVICE_NOT_READY:
+				status = qspb.AllowResponse_FAILED
 			}
 		} else {
 			logging.Printf("Caught error %v", err)
 			status = qspb.AllowResponse_FAILED
 		}
+	} else if rejected {
+		status = qspb.AllowResponse_REJECTED
 	} else {
 		if wait > 0 {
 			status = qspb.AllowResponse_OK_WAIT
@@ -102,12 +428,293 @@ func (g *GrpcEndpoint) Allow(ctx context.Context, req *qspb.AllowRequest) (*qspb
 		}
 		rsp.NumTokensGranted = proto.Int64(granted)
 		rsp.WaitMillis = proto.Int64(wait.Nanoseconds())
+		if clamped := g.clampTokens(namespace, numTokensRequested); clamped < numTokensRequested {
+			rsp.ClampedTokens = proto.Int64(clamped)
+		}
+		if burstAccounting {
+			rsp.BurstTokens = proto.Int64(burst)
+			rsp.SustainedTokens = proto.Int64(granted - burst)
+		}
 	}
 	rsp.Status = &status
+	if req.GetDryRun() || g.namespaceDryRun(namespace) {
+		rsp.DryRun = proto.Bool(true)
+	}
+	if level > 0 {
+		rsp.DegradationLevel = proto.Int32(level)
+	}
+	if effectiveMaxWaitMillis > -1 {
+		rsp.EffectiveMaxWaitMillis = proto.Int64(effectiveMaxWaitMillis)
+	}
+	if status == qspb.AllowResponse_REJECTED && wait > 0 {
+		setRetryAfter(ctx, wait)
+	}
+
+	if window > 0 {
+		g.dedup.put(key, rsp)
+	}
+
+	// Keys already in the filters aren't added again, so that retries don't fill them up.
+	if bloom != nil && (status == qspb.AllowResponse_OK || status == qspb.AllowResponse_OK_WAIT) && !bloom.seen(key) {
+		bloom.add(key)
+	}
 	return rsp, nil
 }
 
-func invalid(req *qspb.AllowRequest) bool {
+// HealthCheck reports this endpoint healthy if it is started and, if the quota service is
+// administrable, none of its buckets are in a bad state.
+func (g *GrpcEndpoint) HealthCheck(ctx context.Context, req *qspb.HealthCheckRequest) (*qspb.HealthCheckResponse, error) {
+	healthy := g.status() == lifecycle.Started
+	if a, ok := g.qs.(admin.Administrable); ok && healthy && a.BucketContainer() != nil {
+		healthy = a.BucketContainer().HealthReport().Healthy()
+	}
+
+	return &qspb.HealthCheckResponse{Healthy: proto.Bool(healthy)}, nil
+}
+
+// ReturnTokens takes back tokens granted but not used, if the quota service supports it.
+func (g *GrpcEndpoint) ReturnTokens(ctx context.Context, req *qspb.ReturnTokensRequest) (*qspb.ReturnTokensResponse, error) {
+	tr, ok := g.qs.(quotaservice.TokenReturning)
+	if !ok {
+		return nil, grpc.Errorf(codes.Unimplemented, "returning tokens is unsupported")
+	}
+
+	if g.status() != lifecycle.Started {
+		return nil, grpc.Errorf(codes.Unavailable, "quota service not started")
+	}
+
+	if req.GetTokens() < 1 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "tokens must be positive, was %v", req.GetTokens())
+	}
+
+	err := tr.ReturnTokens(req.GetNamespace(), req.GetName(), req.GetOperationType(), req.GetTokens())
+	if err == nil {
+		return &qspb.ReturnTokensResponse{}, nil
+	}
+
+	if qsErr, ok := err.(quotaservice.QuotaServiceError); ok && qsErr.Reason == quotaservice.ER_NO_SUCH_BUCKET {
+		return nil, grpc.Errorf(codes.NotFound, "no such bucket %v:%v", req.GetNamespace(), req.GetName())
+	}
+
+	return nil, grpc.Errorf(codes.FailedPrecondition, "unable to return tokens to %v:%v: %v", req.GetNamespace(), req.GetName(), err)
+}
+
+// ReplicateGrant applies tokens granted by a primary quota service, if this quota service supports
+// serving as a standby.
+func (g *GrpcEndpoint) ReplicateGrant(ctx context.Context, req *qspb.ReplicateGrantRequest) (*qspb.ReplicateGrantResponse, error) {
+	gr, ok := g.qs.(quotaservice.GrantReplicating)
+	if !ok {
+		return nil, grpc.Errorf(codes.Unimplemented, "replicating grants is unsupported")
+	}
+
+	if g.status() != lifecycle.Started {
+		return nil, grpc.Errorf(codes.Unavailable, "quota service not started")
+	}
+
+	if req.GetTokensGranted() < 1 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "tokens granted must be positive, was %v", req.GetTokensGranted())
+	}
+
+	err := gr.ApplyReplicatedGrant(req.GetNamespace(), req.GetName(), req.GetTokensGranted())
+	if err == nil {
+		return &qspb.ReplicateGrantResponse{}, nil
+	}
+
+	if qsErr, ok := err.(quotaservice.QuotaServiceError); ok && qsErr.Reason == quotaservice.ER_NO_SUCH_BUCKET {
+		return nil, grpc.Errorf(codes.NotFound, "no such bucket %v:%v", req.GetNamespace(), req.GetName())
+	}
+
+	return nil, grpc.Errorf(codes.FailedPrecondition, "unable to replicate grant to %v:%v: %v", req.GetNamespace(), req.GetName(), err)
+}
+
+// negotiateMaxWait works out how long a request may wait for tokens: the max wait it asked for, or
+// -1 for the bucket's wait timeout, capped by the bucket, and then by the time left before the
+// RPC's deadline, so that requests aren't granted tokens the client can no longer wait for. It
+// returns the max wait override to serve the request with, and the effective max wait in millis,
+// or -1 if the QuotaService doesn't report it. Requests past their deadline may wait 1ms, since
+// buckets treat 0 as no limit.
+func (g *GrpcEndpoint) negotiateMaxWait(ctx context.Context, namespace, name string, maxWaitMillisOverride int64) (override, effective int64) {
+	override, effective = maxWaitMillisOverride, -1
+	if mr, ok := g.qs.(quotaservice.MaxWaitReporting); ok {
+		if maxWait, found := mr.EffectiveMaxWait(namespace, name, maxWaitMillisOverride); found {
+			effective = int64(maxWait / time.Millisecond)
+		}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+
+	remaining := int64(deadline.Sub(time.Now()) / time.Millisecond)
+	if remaining < 1 {
+		remaining = 1
+	}
+
+	bound := effective
+	if bound < 0 {
+		bound = override
+	}
+
+	if bound > -1 && remaining < bound {
+		override = remaining
+		if effective > -1 {
+			effective = remaining
+		}
+	}
+
+	return
+}
+
+// setRetryAfter tells clients of a rejected request how long to wait before retrying, in whole
+// seconds rounded up, using the RetryAfterTrailer of the RPC's trailing metadata.
+func setRetryAfter(ctx context.Context, wait time.Duration) {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	if err := grpc.SetTrailer(ctx, metadata.Pairs(RetryAfterTrailer, strconv.FormatInt(seconds, 10))); err != nil {
+		logging.Printf("Unable to set %v trailer: %v", RetryAfterTrailer, err)
+	}
+}
+
+// dedupWindow returns the deduplication window of a namespace, if the quota service exposes its
+// configuration.
+func (g *GrpcEndpoint) dedupWindow(namespace string) time.Duration {
+	nsCfg := g.namespaceConfig(namespace)
+	if nsCfg == nil {
+		return 0
+	}
+
+	return time.Duration(nsCfg.DeduplicationWindowMs) * time.Millisecond
+}
+
+// coalesceWindow returns the window within which requests of a namespace with the same group key
+// are coalesced, or 0 if they aren't.
+func (g *GrpcEndpoint) coalesceWindow(namespace string) time.Duration {
+	nsCfg := g.namespaceConfig(namespace)
+	if nsCfg == nil {
+		return 0
+	}
+
+	return time.Duration(nsCfg.CoalesceWindowMs) * time.Millisecond
+}
+
+// bloomEntry holds the bloom filters of a named bucket, and the config they were sized for.
+type bloomEntry struct {
+	cfg   *configs.BucketConfig
+	dedup *bloomDedup
+}
+
+// bloomDedup returns the bloom filters remembering the requests a named bucket granted, or nil if
+// the bucket doesn't use them for deduplication. Filters are replaced when the bucket's config is,
+// such as when a namespace is renamed, or a bucket is re-created under the same name.
+func (g *GrpcEndpoint) bloomDedup(namespace, name string) *bloomDedup {
+	var cfg *configs.BucketConfig
+	if nsCfg := g.namespaceConfig(namespace); nsCfg != nil {
+		cfg = nsCfg.Buckets[name]
+	}
+
+	fqn := buckets.FullyQualifiedName(namespace, name)
+	e, ok := g.bloomDedups.Load(fqn)
+	if ok && e.(*bloomEntry).cfg == cfg {
+		return e.(*bloomEntry).dedup
+	}
+
+	if !ok && (cfg == nil || !cfg.BloomDeduplication) {
+		return nil
+	}
+
+	g.bloomLock.Lock()
+	defer g.bloomLock.Unlock()
+
+	// Another request may have replaced the entry already.
+	if e, ok := g.bloomDedups.Load(fqn); ok && e.(*bloomEntry).cfg == cfg {
+		return e.(*bloomEntry).dedup
+	}
+
+	if cfg == nil || !cfg.BloomDeduplication {
+		g.bloomDedups.Delete(fqn)
+		return nil
+	}
+
+	entry := &bloomEntry{cfg: cfg, dedup: newBloomDedup(cfg)}
+	g.bloomDedups.Store(fqn, entry)
+	return entry.dedup
+}
+
+// resolveNamespace returns the name of the namespace an alias stands for, if the quota service is
+// administrable, or the name passed in otherwise.
+func (g *GrpcEndpoint) resolveNamespace(namespace string) string {
+	a, ok := g.qs.(admin.Administrable)
+	if !ok || a.BucketContainer() == nil {
+		return namespace
+	}
+
+	return a.BucketContainer().ResolveNamespace(namespace)
+}
+
+// namespaceConfig returns the config of a namespace, or nil if it doesn't exist or the quota
+// service isn't administrable. Configs are read from the bucket container, if there is one, so
+// they follow renames.
+func (g *GrpcEndpoint) namespaceConfig(namespace string) *configs.NamespaceConfig {
+	a, ok := g.qs.(admin.Administrable)
+	if !ok {
+		return nil
+	}
+
+	if bc := a.BucketContainer(); bc != nil {
+		return bc.NamespaceConfig(namespace)
+	}
+
+	if a.Configs() == nil {
+		return nil
+	}
+
+	return a.Configs().Namespaces[namespace]
+}
+
+// clampTokens returns the number of tokens a request against a namespace is clamped to, if the
+// quota service is administrable, or the number of tokens requested otherwise.
+func (g *GrpcEndpoint) clampTokens(namespace string, tokensRequested int64) int64 {
+	a, ok := g.qs.(admin.Administrable)
+	if !ok || a.BucketContainer() == nil {
+		return tokensRequested
+	}
+
+	return a.BucketContainer().ClampTokens(namespace, tokensRequested)
+}
+
+// namespaceDryRun tells you if a namespace is in dry-run mode, if the quota service is
+// administrable.
+func (g *GrpcEndpoint) namespaceDryRun(namespace string) bool {
+	a, ok := g.qs.(admin.Administrable)
+	return ok && a.BucketContainer() != nil && a.BucketContainer().IsNamespaceDryRun(namespace)
+}
+
+// priorityNamespace returns the namespace that the service's PriorityNamespaceMap maps a priority
+// to, or namespace if the priority isn't mapped.
+func (g *GrpcEndpoint) priorityNamespace(priority int32, namespace string) string {
+	a, ok := g.qs.(admin.Administrable)
+	if !ok || a.Configs() == nil {
+		return namespace
+	}
+
+	if mapped, ok := a.Configs().PriorityNamespaceMap[int(priority)]; ok {
+		return mapped
+	}
+
+	return namespace
+}
+
+// namespaceFromMetadata returns the namespace in a request's metadata, if any.
+func (g *GrpcEndpoint) namespaceFromMetadata(ctx context.Context) string {
+	md, ok := metadata.FromContext(ctx)
+	if !ok || len(md[g.namespaceKey]) == 0 {
+		return ""
+	}
+
+	return md[g.namespaceKey][0]
+}
+
+func invalid(namespace string, req *qspb.AllowRequest) bool {
 	// Negative tokens are allowed!
-	return req.GetName() == "" || req.GetNamespace() == "" || (req.NumTokensRequested != nil && req.GetNumTokensRequested() == 0)
+	return req.GetName() == "" || namespace == "" || (req.NumTokensRequested != nil && req.GetNumTokensRequested() == 0)
 }
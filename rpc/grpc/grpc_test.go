@@ -0,0 +1,1341 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice"
+	"github.com/maniksurtani/quotaservice/admin"
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+	"github.com/maniksurtani/quotaservice/lifecycle"
+	"github.com/maniksurtani/quotaservice/metrics"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+type mockQuotaService struct{}
+
+func (m *mockQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return tokensRequested, 0, nil
+}
+
+func (m *mockQuotaService) AllowOp(namespace string, name string, operationType string, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return 1, 0, nil
+}
+
+func (m *mockQuotaService) AllowWithMeta(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64, meta map[string]string) (int64, time.Duration, error) {
+	return tokensRequested, 0, nil
+}
+
+func (m *mockQuotaService) DonateTokens(fromNamespace, toNamespace string, tokens int64) error {
+	return nil
+}
+
+var req = &qspb.AllowRequest{
+	Namespace: proto.String("n"),
+	Name:      proto.String("b")}
+
+func newEndpoint() *GrpcEndpoint {
+	g := New("localhost:0")
+	g.Init(&mockQuotaService{})
+	return g
+}
+
+func expectUnavailable(t *testing.T, g *GrpcEndpoint) {
+	rsp, err := g.Allow(context.TODO(), req)
+	if err == nil {
+		t.Fatalf("Expecting an error. Got response %v", rsp)
+	}
+
+	if grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("Expecting code %v. Was %v", codes.Unavailable, grpc.Code(err))
+	}
+}
+
+func TestAllowBeforeStart(t *testing.T) {
+	expectUnavailable(t, New("localhost:0"))
+	expectUnavailable(t, newEndpoint())
+}
+
+func TestAllowAfterStop(t *testing.T) {
+	g := newEndpoint()
+	g.Start()
+
+	rsp, err := g.Allow(context.TODO(), req)
+	if err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	if rsp.GetStatus() != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting status OK. Was %v", rsp.GetStatus())
+	}
+
+	g.Stop()
+	expectUnavailable(t, g)
+}
+
+func TestHealthCheck(t *testing.T) {
+	g := newEndpoint()
+	if rsp, _ := g.HealthCheck(context.TODO(), &qspb.HealthCheckRequest{}); rsp.GetHealthy() {
+		t.Fatalf("Not expecting an unstarted endpoint to be healthy.")
+	}
+
+	g.Start()
+	if rsp, _ := g.HealthCheck(context.TODO(), &qspb.HealthCheckRequest{}); !rsp.GetHealthy() {
+		t.Fatalf("Expecting a started endpoint to be healthy.")
+	}
+
+	g.Stop()
+	if rsp, _ := g.HealthCheck(context.TODO(), &qspb.HealthCheckRequest{}); rsp.GetHealthy() {
+		t.Fatalf("Not expecting a stopped endpoint to be healthy.")
+	}
+}
+
+func TestAllowWithKeepalive(t *testing.T) {
+	g := newEndpoint().WithKeepalive(DefaultKeepalivePeriod)
+	g.Start()
+	defer g.Stop()
+
+	if _, ok := g.listener.(*keepaliveListener); !ok {
+		t.Fatalf("Expecting a keepalive listener. Was %T", g.listener)
+	}
+
+	conn, err := grpc.Dial(g.listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Unable to connect. Error: %v", err)
+	}
+	defer conn.Close()
+
+	rsp, err := qspb.NewQuotaServiceClient(conn).Allow(context.TODO(), req)
+	if err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	if rsp.GetStatus() != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting status OK. Was %v", rsp.GetStatus())
+	}
+}
+
+// namespaceRecorder remembers the namespace of the last request.
+type namespaceRecorder struct {
+	mockQuotaService
+	namespace string
+}
+
+func (r *namespaceRecorder) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	r.namespace = namespace
+	return tokensRequested, 0, nil
+}
+
+func newTenantEndpoint() (*GrpcEndpoint, *namespaceRecorder) {
+	r := &namespaceRecorder{}
+	g := New("localhost:0").WithNamespaceFromMetadata("X-Tenant-ID")
+	g.Init(r)
+	g.Start()
+	return g, r
+}
+
+func TestNamespaceFromMetadata(t *testing.T) {
+	g, r := newTenantEndpoint()
+	defer g.Stop()
+
+	ctx := metadata.NewContext(context.TODO(), metadata.Pairs("x-tenant-id", "tenant"))
+	rsp, err := g.Allow(ctx, &qspb.AllowRequest{Name: proto.String("b")})
+	if err != nil || rsp.GetStatus() != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting status OK. Was %v, %v", rsp, err)
+	}
+
+	if r.namespace != "tenant" {
+		t.Fatalf("Expecting namespace from metadata. Was %v", r.namespace)
+	}
+}
+
+func TestExplicitNamespaceWins(t *testing.T) {
+	g, r := newTenantEndpoint()
+	defer g.Stop()
+
+	ctx := metadata.NewContext(context.TODO(), metadata.Pairs("x-tenant-id", "tenant"))
+	if _, err := g.Allow(ctx, req); err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	if r.namespace != "n" {
+		t.Fatalf("Expecting the request's namespace. Was %v", r.namespace)
+	}
+}
+
+func TestNoNamespace(t *testing.T) {
+	g, r := newTenantEndpoint()
+	defer g.Stop()
+
+	rsp, err := g.Allow(context.TODO(), &qspb.AllowRequest{Name: proto.String("b")})
+	if err != nil || rsp.GetStatus() != qspb.AllowResponse_REJECTED {
+		t.Fatalf("Expecting status REJECTED. Was %v, %v", rsp, err)
+	}
+
+	if r.namespace != "" {
+		t.Fatalf("Expecting the quota service not to be called. Was called for %v", r.namespace)
+	}
+}
+
+// dedupQuotaService counts calls, and exposes a configuration with a deduplication window.
+type dedupQuotaService struct {
+	mockQuotaService
+	cfg   *configs.ServiceConfig
+	calls int
+}
+
+func (d *dedupQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	d.calls++
+	return tokensRequested, 0, nil
+}
+
+func (d *dedupQuotaService) Metrics() metrics.Metrics                  { return nil }
+func (d *dedupQuotaService) Configs() *configs.ServiceConfig           { return d.cfg }
+func (d *dedupQuotaService) BucketContainer() *buckets.BucketContainer { return nil }
+
+func newDedupEndpoint() (*GrpcEndpoint, *dedupQuotaService, *time.Time) {
+	cfg := configs.NewDefaultServiceConfig()
+	nsCfg := configs.NewDefaultNamespaceConfig()
+	nsCfg.DeduplicationWindowMs = 1000
+	cfg.Namespaces["n"] = nsCfg
+
+	qs := &dedupQuotaService{cfg: cfg}
+	g := New("localhost:0")
+	g.Init(qs)
+	g.Start()
+
+	now := time.Now()
+	g.dedup.now = func() time.Time { return now }
+	return g, qs, &now
+}
+
+func clientContext(ip string) context.Context {
+	return peer.NewContext(context.TODO(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+}
+
+func TestDedupHit(t *testing.T) {
+	g, qs, now := newDedupEndpoint()
+	defer g.Stop()
+
+	r := &qspb.AllowRequest{Namespace: proto.String("n"), Name: proto.String("b"), NumTokensRequested: proto.Int64(5)}
+	g.Allow(clientContext("10.0.0.1"), r)
+	*now = now.Add(500 * time.Millisecond)
+	rsp, err := g.Allow(clientContext("10.0.0.1"), r)
+	if err != nil || rsp.GetNumTokensGranted() != 5 {
+		t.Fatalf("Expecting the cached response. Was %v, %v", rsp, err)
+	}
+
+	if qs.calls != 1 {
+		t.Fatalf("Expecting duplicates to consume tokens once. Consumed %v times", qs.calls)
+	}
+}
+
+func TestDedupMissPastWindow(t *testing.T) {
+	g, qs, now := newDedupEndpoint()
+	defer g.Stop()
+
+	g.Allow(clientContext("10.0.0.1"), req)
+	*now = now.Add(1001 * time.Millisecond)
+	g.Allow(clientContext("10.0.0.1"), req)
+	if qs.calls != 2 {
+		t.Fatalf("Expecting requests past the window to be treated as new. Consumed %v times", qs.calls)
+	}
+}
+
+func TestDedupDifferentTuples(t *testing.T) {
+	g, qs, _ := newDedupEndpoint()
+	defer g.Stop()
+
+	g.Allow(clientContext("10.0.0.1"), req)
+	g.Allow(clientContext("10.0.0.2"), req)
+	g.Allow(clientContext("10.0.0.1"), &qspb.AllowRequest{Namespace: proto.String("n"), Name: proto.String("other")})
+	g.Allow(clientContext("10.0.0.1"), &qspb.AllowRequest{Namespace: proto.String("n"), Name: proto.String("b"), NumTokensRequested: proto.Int64(2)})
+	if qs.calls != 4 {
+		t.Fatalf("Expecting different requests not to be deduplicated. Consumed %v times", qs.calls)
+	}
+}
+
+func TestDedupLRUEviction(t *testing.T) {
+	c := newDedupCache(2)
+	for i := uint64(1); i <= 3; i++ {
+		c.put(i, &qspb.AllowResponse{})
+	}
+
+	if c.get(1, time.Minute) != nil {
+		t.Fatal("Expecting the least recently used response to be evicted")
+	}
+
+	if c.get(3, time.Minute) == nil {
+		t.Fatal("Expecting the most recent response to be cached")
+	}
+}
+
+// blockingQuotaService blocks requests until released.
+type blockingQuotaService struct {
+	mockQuotaService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return tokensRequested, 0, nil
+}
+
+func TestMaxConcurrentAllows(t *testing.T) {
+	qs := &blockingQuotaService{started: make(chan struct{}), release: make(chan struct{})}
+	g := New("localhost:0").WithMaxConcurrentAllows(1)
+	g.Init(qs)
+	g.Start()
+	defer g.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		g.Allow(context.TODO(), req)
+		close(done)
+	}()
+	<-qs.started
+
+	if n := g.InFlightAllows(); n != 1 {
+		t.Fatalf("Expecting 1 allow in flight. Was %v", n)
+	}
+
+	if _, err := g.Allow(context.TODO(), req); grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expecting code %v. Was %v", codes.ResourceExhausted, grpc.Code(err))
+	}
+
+	close(qs.release)
+	<-done
+	if n := g.InFlightAllows(); n != 0 {
+		t.Fatalf("Expecting no allows in flight. Was %v", n)
+	}
+
+	go func() { <-qs.started }()
+	if rsp, err := g.Allow(context.TODO(), req); err != nil || rsp.GetStatus() != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting status OK once there is space. Was %v, %v", rsp, err)
+	}
+}
+
+func TestStopDrainsInFlightAllows(t *testing.T) {
+	qs := &blockingQuotaService{started: make(chan struct{}), release: make(chan struct{})}
+	g := New("localhost:0")
+	g.Init(qs)
+	g.Start()
+	addr := g.listener.Addr().String()
+
+	done := make(chan struct{})
+	go func() {
+		g.Allow(context.TODO(), req)
+		close(done)
+	}()
+	<-qs.started
+
+	stopped := make(chan struct{})
+	go func() {
+		g.Stop()
+		close(stopped)
+	}()
+
+	// New requests are refused while the one in flight completes.
+	for g.status() != lifecycle.Stopped {
+		time.Sleep(time.Millisecond)
+	}
+	expectUnavailable(t, g)
+
+	select {
+	case <-stopped:
+		t.Fatal("Expecting Stop() to wait for the allow in flight")
+	case <-time.After(5 * stopDrainInterval):
+	}
+
+	close(qs.release)
+	<-done
+	<-stopped
+
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("Expecting the server to stop listening")
+	}
+}
+
+// newAdmissionEndpoint creates an endpoint whose admission queue has a single worker, which is
+// serving a request blocked on the quota service returned, and the number of requests given queued
+// behind it. The channel returned yields the errors of those requests, once they complete.
+func newAdmissionEndpoint(maxQueue, queued int, maxWait time.Duration) (*GrpcEndpoint, *blockingQuotaService, chan error) {
+	qs := &blockingQuotaService{started: make(chan struct{}), release: make(chan struct{})}
+	g := New("localhost:0").WithAdmissionQueue(maxQueue, maxWait)
+	g.admission = newAdmissionQueue(1, maxQueue, maxWait)
+	g.Init(qs)
+	g.Start()
+
+	errs := make(chan error, queued+1)
+	allow := func() {
+		_, err := g.Allow(context.TODO(), req)
+		errs <- err
+	}
+
+	go allow()
+	<-qs.started
+	for i := 0; i < queued; i++ {
+		go allow()
+	}
+
+	for len(g.admission.queue) < queued {
+		time.Sleep(time.Millisecond)
+	}
+
+	return g, qs, errs
+}
+
+func TestAdmissionQueueDrains(t *testing.T) {
+	g, qs, errs := newAdmissionEndpoint(2, 2, time.Minute)
+	defer g.Stop()
+
+	go func() {
+		for range qs.started {
+		}
+	}()
+	close(qs.release)
+
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Expecting queued requests to be served. Was %v", err)
+		}
+	}
+	close(qs.started)
+}
+
+func TestAdmissionQueueFull(t *testing.T) {
+	g, qs, errs := newAdmissionEndpoint(1, 1, time.Minute)
+	defer g.Stop()
+
+	if _, err := g.Allow(context.TODO(), req); grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expecting code %v. Was %v", codes.ResourceExhausted, grpc.Code(err))
+	}
+
+	go func() { <-qs.started }()
+	close(qs.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Expecting admitted requests to be served. Was %v", err)
+		}
+	}
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	g, qs, errs := newAdmissionEndpoint(1, 1, 50*time.Millisecond)
+	defer g.Stop()
+
+	if err := <-errs; grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expecting the queued request to time out with code %v. Was %v", codes.ResourceExhausted, grpc.Code(err))
+	}
+
+	// The request that timed out isn't served once the worker is free.
+	close(qs.release)
+	if err := <-errs; err != nil {
+		t.Fatalf("Expecting the request being served to complete. Was %v", err)
+	}
+
+	go func() { <-qs.started }()
+	if rsp, err := g.Allow(context.TODO(), req); err != nil || rsp.GetStatus() != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting status OK once the worker is free. Was %v, %v", rsp, err)
+	}
+}
+
+func TestUniqueTraceIDs(t *testing.T) {
+	g := newEndpoint()
+	g.Start()
+	defer g.Stop()
+
+	rsp1, _ := g.Allow(context.TODO(), req)
+	rsp2, _ := g.Allow(context.TODO(), req)
+	if rsp1.GetTraceId() == "" || rsp1.GetTraceId() == rsp2.GetTraceId() {
+		t.Fatalf("Expecting unique trace IDs. Were %v and %v", rsp1.GetTraceId(), rsp2.GetTraceId())
+	}
+}
+
+func TestTraceIDFromTraceParent(t *testing.T) {
+	g := newEndpoint()
+	g.Start()
+	defer g.Stop()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := metadata.NewContext(context.TODO(), metadata.Pairs("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01"))
+	if rsp, _ := g.Allow(ctx, req); rsp.GetTraceId() != traceID {
+		t.Fatalf("Expecting trace ID %v. Was %v", traceID, rsp.GetTraceId())
+	}
+
+	ctx = metadata.NewContext(context.TODO(), metadata.Pairs("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"))
+	if rsp, _ := g.Allow(ctx, req); len(rsp.GetTraceId()) != 36 {
+		t.Fatalf("Expecting a generated UUID for an invalid traceparent. Was %v", rsp.GetTraceId())
+	}
+}
+
+// burstQuotaService grants a fixed number of burst tokens with each request.
+type burstQuotaService struct {
+	mockQuotaService
+	burst int64
+}
+
+func (b *burstQuotaService) AllowWithBurst(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, int64, time.Duration, error) {
+	return tokensRequested, b.burst, 0, nil
+}
+
+func TestBurstAndSustainedTokens(t *testing.T) {
+	g := New("localhost:0")
+	g.Init(&burstQuotaService{burst: 3})
+	g.Start()
+	defer g.Stop()
+
+	rsp, err := g.Allow(context.TODO(), &qspb.AllowRequest{
+		Namespace:          proto.String("n"),
+		Name:               proto.String("b"),
+		NumTokensRequested: proto.Int64(10)})
+	if err != nil || rsp.GetBurstTokens() != 3 || rsp.GetSustainedTokens() != 7 {
+		t.Fatalf("Expecting 3 burst and 7 sustained tokens. Was %v, %v", rsp, err)
+	}
+}
+
+func TestNoBurstAccounting(t *testing.T) {
+	g := newEndpoint()
+	g.Start()
+	defer g.Stop()
+
+	if rsp, _ := g.Allow(context.TODO(), req); rsp.BurstTokens != nil || rsp.SustainedTokens != nil {
+		t.Fatalf("Expecting no burst accounting. Was %v", rsp)
+	}
+}
+
+// degradedQuotaService reports all buckets as degraded to a fixed level, counting the requests
+// served.
+type degradedQuotaService struct {
+	mockQuotaService
+	level  int32
+	served int
+}
+
+func (d *degradedQuotaService) AllowWithDegradation(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (int64, int64, int32, time.Duration, error) {
+	d.served++
+	return tokensRequested, 0, d.level, 0, nil
+}
+
+func (d *degradedQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	d.served++
+	return tokensRequested, 0, nil
+}
+
+func TestDegradationLevel(t *testing.T) {
+	for _, level := range []int32{0, 2} {
+		qs := &degradedQuotaService{level: level}
+		g := New("localhost:0")
+		g.Init(qs)
+		g.Start()
+
+		rsp, err := g.Allow(context.TODO(), req)
+		g.Stop()
+		if err != nil || rsp.GetDegradationLevel() != level || (level == 0 && rsp.DegradationLevel != nil) {
+			t.Fatalf("Expecting degradation level %v. Was %v, %v", level, rsp, err)
+		}
+
+		// The level comes from serving the request, rather than from a second lookup.
+		if qs.served != 1 {
+			t.Fatalf("Expecting the request to be served once. Was served %v times", qs.served)
+		}
+	}
+}
+
+type tracingQuotaService struct {
+	mockQuotaService
+}
+
+func (t *tracingQuotaService) AllowWithTrace(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, string, error) {
+	return tokensRequested, 0, "found bucket " + name, nil
+}
+
+func TestResolutionTrace(t *testing.T) {
+	g := New("localhost:0")
+	g.Init(&tracingQuotaService{})
+	g.Start()
+	defer g.Stop()
+
+	rsp, err := g.Allow(context.TODO(), req)
+	if err != nil || rsp.ResolutionTrace != nil {
+		t.Fatalf("Not expecting a trace unless requested. Was %v, %v", rsp, err)
+	}
+
+	rsp, err = g.Allow(context.TODO(), &qspb.AllowRequest{
+		Namespace:    proto.String("n"),
+		Name:         proto.String("b"),
+		IncludeTrace: proto.Bool(true)})
+	if err != nil || rsp.GetStatus() != qspb.AllowResponse_OK || rsp.GetResolutionTrace() != "found bucket b" {
+		t.Fatalf("Expecting a trace. Was %v, %v", rsp, err)
+	}
+}
+
+func TestRejectionMessage(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	b := configs.NewDefaultBucketConfig()
+	b.Size = 1
+	b.FillRate = 1
+	b.MaxDebtMillis = 0
+	b.RejectionMessage = "Upgrade to premium for higher limits."
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	g := New("localhost:0")
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), g)
+	s.Start()
+	defer s.Stop()
+
+	rsp, err := g.Allow(context.TODO(), req)
+	if err != nil || rsp.GetStatus() != qspb.AllowResponse_OK || rsp.RejectionMessage != nil {
+		t.Fatalf("Expecting tokens granted without a rejection message. Was %v, %v", rsp, err)
+	}
+
+	rsp, err = g.Allow(context.TODO(), req)
+	if err != nil || rsp.GetStatus() != qspb.AllowResponse_REJECTED || rsp.GetRejectionMessage() != b.RejectionMessage {
+		t.Fatalf("Expecting a rejection with message %q. Was %v, %v", b.RejectionMessage, rsp, err)
+	}
+}
+
+// allowN makes n Allow RPCs, returning how many were rejected with codes.ResourceExhausted.
+func allowN(t *testing.T, g *GrpcEndpoint, n int) (exhausted int) {
+	for i := 0; i < n; i++ {
+		if _, err := g.Allow(context.TODO(), req); grpc.Code(err) == codes.ResourceExhausted {
+			exhausted++
+		} else if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+
+	return
+}
+
+func TestDryRun(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	b := configs.NewDefaultBucketConfig()
+	b.Size = 5
+	b.FillRate = 1
+	b.MaxDebtMillis = 0
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	g := New("localhost:0")
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), g)
+	s.Start()
+	defer s.Stop()
+
+	allow := func(dryRun bool) *qspb.AllowResponse {
+		rsp, err := g.Allow(context.TODO(), &qspb.AllowRequest{
+			Namespace:          proto.String("n"),
+			Name:               proto.String("b"),
+			NumTokensRequested: proto.Int64(5),
+			DryRun:             proto.Bool(dryRun)})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		return rsp
+	}
+
+	for i := 0; i < 3; i++ {
+		if rsp := allow(true); rsp.GetStatus() != qspb.AllowResponse_OK || rsp.GetNumTokensGranted() != 5 {
+			t.Fatalf("Expecting the dry run to report 5 tokens granted. Was %v", rsp)
+		}
+	}
+
+	// The bucket is still full after the dry runs.
+	if rsp := allow(false); rsp.GetStatus() != qspb.AllowResponse_OK || rsp.GetNumTokensGranted() != 5 {
+		t.Fatalf("Expecting 5 tokens granted. Was %v", rsp)
+	}
+
+	if rsp := allow(true); rsp.GetStatus() != qspb.AllowResponse_REJECTED {
+		t.Fatalf("Expecting the dry run to report a rejection. Was %v", rsp)
+	}
+}
+
+// priorityRecorder records the namespace of requests, and exposes a configuration with a priority
+// namespace map.
+type priorityRecorder struct {
+	namespaceRecorder
+	cfg *configs.ServiceConfig
+}
+
+func (p *priorityRecorder) Metrics() metrics.Metrics                  { return nil }
+func (p *priorityRecorder) Configs() *configs.ServiceConfig           { return p.cfg }
+func (p *priorityRecorder) BucketContainer() *buckets.BucketContainer { return nil }
+
+func TestPriorityNamespace(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.PriorityNamespaceMap = map[int]string{1: "critical", 2: "best-effort"}
+	r := &priorityRecorder{cfg: cfg}
+	g := New("localhost:0")
+	g.Init(r)
+	g.Start()
+	defer g.Stop()
+
+	for _, test := range []struct {
+		priority  *int32
+		namespace string
+	}{
+		{proto.Int32(1), "critical"},
+		{proto.Int32(2), "best-effort"},
+		// Unmapped priorities, and requests without one, are served by the namespace requested.
+		{proto.Int32(3), "n"},
+		{nil, "n"}} {
+		rsp, err := g.Allow(context.TODO(), &qspb.AllowRequest{
+			Namespace: proto.String("n"),
+			Name:      proto.String("b"),
+			Priority:  test.priority})
+		if err != nil || rsp.GetStatus() != qspb.AllowResponse_OK {
+			t.Fatalf("Expecting status OK. Was %v, %v", rsp, err)
+		}
+
+		if r.namespace != test.namespace {
+			t.Fatalf("Expecting namespace %v. Was %v", test.namespace, r.namespace)
+		}
+	}
+}
+
+// coalesceRecorder records the tokens requested by each call, and exposes a configuration with a
+// coalescing window.
+type coalesceRecorder struct {
+	mockQuotaService
+	cfg   *configs.ServiceConfig
+	calls []int64
+	sync.Mutex
+}
+
+func (c *coalesceRecorder) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.calls = append(c.calls, tokensRequested)
+	return tokensRequested, 0, nil
+}
+
+func (c *coalesceRecorder) Metrics() metrics.Metrics                  { return nil }
+func (c *coalesceRecorder) Configs() *configs.ServiceConfig           { return c.cfg }
+func (c *coalesceRecorder) BucketContainer() *buckets.BucketContainer { return nil }
+
+// allowGrouped sends concurrent requests for 1 token each, with the given group keys, and returns
+// the tokens requested by each call to the quota service, sorted.
+func allowGrouped(t *testing.T, groupKeys ...string) []int64 {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].CoalesceWindowMs = 200
+	r := &coalesceRecorder{cfg: cfg}
+	g := New("localhost:0")
+	g.Init(r)
+	g.Start()
+	defer g.Stop()
+
+	var wg sync.WaitGroup
+	for _, groupKey := range groupKeys {
+		wg.Add(1)
+		go func(groupKey string) {
+			defer wg.Done()
+			rsp, err := g.Allow(context.TODO(), &qspb.AllowRequest{
+				Namespace: proto.String("n"),
+				Name:      proto.String("b"),
+				GroupKey:  proto.String(groupKey)})
+			if err != nil || rsp.GetStatus() != qspb.AllowResponse_OK || rsp.GetNumTokensGranted() != 1 {
+				t.Errorf("Expecting 1 token granted. Was %v, %v", rsp, err)
+			}
+		}(groupKey)
+	}
+	wg.Wait()
+
+	sort.Sort(byTokens(r.calls))
+	return r.calls
+}
+
+type byTokens []int64
+
+func (b byTokens) Len() int           { return len(b) }
+func (b byTokens) Less(i, j int) bool { return b[i] < b[j] }
+func (b byTokens) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func TestCoalesceSameGroup(t *testing.T) {
+	if calls := allowGrouped(t, "x", "x", "x", "x"); len(calls) != 1 || calls[0] != 4 {
+		t.Fatalf("Expecting a single call for 4 tokens. Was %v", calls)
+	}
+}
+
+func TestCoalesceDifferentGroups(t *testing.T) {
+	if calls := allowGrouped(t, "x", "x", "y"); len(calls) != 2 || calls[0] != 1 || calls[1] != 2 {
+		t.Fatalf("Expecting a call per group. Was %v", calls)
+	}
+}
+
+func TestCoalesceWithoutGroupKey(t *testing.T) {
+	if calls := allowGrouped(t, "", "", ""); len(calls) != 3 {
+		t.Fatalf("Expecting a call per request. Was %v", calls)
+	}
+}
+
+// allowCoalesced sends n concurrent requests for 1 token each with the same group key to a quota
+// service using memory buckets, and returns how many were granted.
+func allowCoalesced(t *testing.T, nsCfg *configs.NamespaceConfig, n int) int {
+	cfg := configs.NewDefaultServiceConfig()
+	nsCfg.CoalesceWindowMs = 200
+	cfg.Namespaces["n"] = nsCfg
+
+	g := New("localhost:0")
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), g)
+	s.Start()
+	defer s.Stop()
+
+	var granted int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := g.Allow(context.TODO(), &qspb.AllowRequest{
+				Namespace: proto.String("n"),
+				Name:      proto.String("b"),
+				GroupKey:  proto.String("x")})
+			if err != nil {
+				t.Errorf("Unexpected error %v", err)
+				return
+			}
+
+			switch rsp.GetStatus() {
+			case qspb.AllowResponse_OK, qspb.AllowResponse_OK_WAIT:
+				if rsp.GetNumTokensGranted() != 1 {
+					t.Errorf("Expecting 1 token granted. Was %v", rsp)
+				}
+				atomic.AddInt32(&granted, 1)
+			case qspb.AllowResponse_REJECTED:
+			default:
+				t.Errorf("Unexpected response %v", rsp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return int(granted)
+}
+
+func TestCoalesceRateLimited(t *testing.T) {
+	nsCfg := configs.NewDefaultNamespaceConfig()
+	b := configs.NewDefaultBucketConfig()
+	b.Size = 3
+	b.FillRate = 1
+	b.MaxDebtMillis = 0
+	b.WaitTimeoutMillis = 100
+	nsCfg.Buckets["b"] = b
+
+	if granted := allowCoalesced(t, nsCfg, 4); granted != 0 {
+		t.Fatalf("Expecting the group to be rejected, since the bucket can't grant 4 tokens. Was %v granted", granted)
+	}
+}
+
+func TestCoalesceClamped(t *testing.T) {
+	nsCfg := configs.NewDefaultNamespaceConfig()
+	nsCfg.MaxTokensPerRequest = 2
+	nsCfg.Buckets["b"] = configs.NewDefaultBucketConfig()
+
+	if granted := allowCoalesced(t, nsCfg, 4); granted != 2 {
+		t.Fatalf("Expecting the 2 tokens granted to the group to be split across 2 requests. Was %v granted", granted)
+	}
+}
+
+func TestCoalesceAfterRename(t *testing.T) {
+	nsCfg := configs.NewDefaultNamespaceConfig()
+	nsCfg.CoalesceWindowMs = 200
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["old"] = nsCfg
+
+	g := New("localhost:0")
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), g)
+	s.Start()
+	defer s.Stop()
+
+	if err := s.(admin.Administrable).BucketContainer().RenameNamespace("old", "n"); err != nil {
+		t.Fatalf("Unable to rename namespace: %v", err)
+	}
+
+	if window := g.coalesceWindow("n"); window != 200*time.Millisecond {
+		t.Fatalf("Expecting the coalescing window to follow the rename. Was %v", window)
+	}
+}
+
+func TestDedupThroughAlias(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].DeduplicationWindowMs = 60000
+	b := configs.NewDefaultBucketConfig()
+	b.Size = 1
+	b.FillRate = 1
+	b.MaxDebtMillis = 0
+	cfg.Namespaces["n"].Buckets["b"] = b
+	cfg.NamespaceAliases = map[string]string{"a": "n"}
+
+	g := New("localhost:0")
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), g)
+	s.Start()
+	defer s.Stop()
+
+	// Requests through the alias and the namespace are retries of one another.
+	for _, namespace := range []string{"a", "a", "n"} {
+		r := &qspb.AllowRequest{Namespace: proto.String(namespace), Name: proto.String("b")}
+		rsp, err := g.Allow(clientContext("10.0.0.1"), r)
+		if err != nil || rsp.GetStatus() != qspb.AllowResponse_OK {
+			t.Fatalf("Expecting the request through %v to be deduplicated. Was %v, %v", namespace, rsp, err)
+		}
+	}
+}
+
+func TestBloomDedup(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	b := configs.NewDefaultBucketConfig()
+	b.Size = 2
+	b.FillRate = 1
+	b.MaxDebtMillis = 0
+	b.BloomDeduplication = true
+	b.BloomWindowMs = 1000
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	g := New("localhost:0")
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), g)
+	s.Start()
+	defer s.Stop()
+
+	now := time.Now()
+	d := g.bloomDedup("n", "b")
+	d.now = func() time.Time { return now }
+
+	status := func(ip string) qspb.AllowResponse_Status {
+		rsp, err := g.Allow(clientContext(ip), req)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		return rsp.GetStatus()
+	}
+
+	if s := status("10.0.0.1"); s != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting status OK. Was %v", s)
+	}
+
+	key := dedupKey("10.0.0.1", "n", "b", "", 1)
+	if !d.seen(key) {
+		t.Fatal("Expecting the granted request to be remembered")
+	}
+
+	// Retries are charged for, taking the last token, and aren't granted for free once the bucket
+	// is empty.
+	if s := status("10.0.0.1"); s != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting the retry to be granted. Was %v", s)
+	}
+
+	if s := status("10.0.0.1"); s != qspb.AllowResponse_REJECTED {
+		t.Fatalf("Expecting the retry to be rejected by the empty bucket. Was %v", s)
+	}
+
+	// Granted requests are forgotten within two windows.
+	now = now.Add(3 * time.Second)
+	if d.seen(key) {
+		t.Fatal("Expecting the request to be forgotten")
+	}
+}
+
+func TestBloomDedupFollowsConfig(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	b := configs.NewDefaultBucketConfig()
+	b.BloomDeduplication = true
+	b.BloomWindowMs = 1000
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	g := New("localhost:0")
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), g)
+	s.Start()
+	defer s.Stop()
+
+	d := g.bloomDedup("n", "b")
+	if d == nil || g.bloomDedup("n", "b") != d {
+		t.Fatal("Expecting the same filters for the same config")
+	}
+
+	bucketCfgs := s.(admin.Administrable).Configs().Namespaces["n"].Buckets
+	replaced := *b
+	bucketCfgs["b"] = &replaced
+	if r := g.bloomDedup("n", "b"); r == nil || r == d {
+		t.Fatal("Expecting new filters for a new config")
+	}
+
+	disabled := *b
+	disabled.BloomDeduplication = false
+	bucketCfgs["b"] = &disabled
+	if r := g.bloomDedup("n", "b"); r != nil {
+		t.Fatal("Expecting no filters once deduplication is disabled")
+	}
+}
+
+func TestBloomFilterCapped(t *testing.T) {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.FillRate = math.MaxInt64
+	cfg.BloomWindowMs = math.MaxInt64
+	cfg.BloomFPRate = 0.01
+
+	f := newBloomDedup(cfg).current
+	if f.m != maxBloomFilterBits || len(f.bits) != maxBloomFilterBits/64 {
+		t.Fatalf("Expecting the filter capped at %v bits. Was %v", maxBloomFilterBits, f.m)
+	}
+}
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	f := newBloomFilter(10000, 0.01)
+	for i := int64(0); i < 10000; i++ {
+		f.add(dedupKey("10.0.0.1", "n", "b", "", i))
+	}
+
+	for i := int64(0); i < 10000; i++ {
+		if !f.contains(dedupKey("10.0.0.1", "n", "b", "", i)) {
+			t.Fatalf("Expecting key %v to be present", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := int64(0); i < 10000; i++ {
+		if f.contains(dedupKey("10.0.0.2", "n", "b", "", i)) {
+			falsePositives++
+		}
+	}
+
+	// Allow for variance around the expected 100.
+	if falsePositives > 200 {
+		t.Fatalf("Expecting about 1%% false positives. Was %v in 10000", falsePositives)
+	}
+}
+
+func TestSelfRateLimit(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		requests, rejects int
+	}{
+		{"below limit", 3, 0},
+		{"at limit", 5, 0},
+		{"above limit", 8, 3}} {
+		// Refills are too slow to matter during the test.
+		g := New("localhost:0").WithSelfRateLimit(1, 5)
+		g.Init(&mockQuotaService{})
+		g.Start()
+
+		if exhausted := allowN(t, g, test.requests); exhausted != test.rejects {
+			t.Fatalf("%v: expecting %v requests to be rejected. Was %v", test.name, test.rejects, exhausted)
+		}
+		g.Stop()
+	}
+}
+
+func TestIPRateLimit(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		requests, rejects int
+	}{
+		{"below limit", 3, 0},
+		{"at limit", 5, 0},
+		{"above limit", 8, 3}} {
+		// Refills are too slow to matter during the test.
+		g := New("localhost:0").WithIPRateLimit(1, 5)
+		g.Init(&mockQuotaService{})
+		g.Start()
+
+		exhausted := 0
+		for i := 0; i < test.requests; i++ {
+			if _, err := g.Allow(clientContext("10.0.0.1"), req); grpc.Code(err) == codes.ResourceExhausted {
+				exhausted++
+			} else if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+		}
+
+		if exhausted != test.rejects {
+			t.Fatalf("%v: expecting %v requests to be rejected. Was %v", test.name, test.rejects, exhausted)
+		}
+
+		// Other IPs have buckets of their own.
+		if _, err := g.Allow(clientContext("10.0.0.2"), req); err != nil {
+			t.Fatalf("%v: expecting requests from another IP to be allowed. Error: %v", test.name, err)
+		}
+		g.Stop()
+	}
+}
+
+func TestIPRateLimitGC(t *testing.T) {
+	l := newIPRateLimiter(1, 1)
+	now := time.Now()
+	l.allow("10.0.0.1", now)
+	l.allow("10.0.0.2", now.Add(IPRateLimitIdleTimeout))
+
+	l.gc(now.Add(IPRateLimitIdleTimeout + time.Second))
+	if _, ok := l.buckets.Load("10.0.0.1"); ok {
+		t.Fatal("Expecting the stale IP's bucket to be garbage collected")
+	}
+
+	if _, ok := l.buckets.Load("10.0.0.2"); !ok {
+		t.Fatal("Expecting the recently seen IP's bucket to be kept")
+	}
+
+	// The stale IP starts over with a full bucket.
+	if !l.allow("10.0.0.1", now.Add(IPRateLimitIdleTimeout + time.Second)) {
+		t.Fatal("Expecting a new bucket for the stale IP")
+	}
+}
+
+// operationRecorder remembers the operation type of the last request.
+type operationRecorder struct {
+	mockQuotaService
+	operationType string
+}
+
+func (r *operationRecorder) AllowOperation(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	r.operationType = operationType
+	return tokensRequested, 0, nil
+}
+
+func TestOperationType(t *testing.T) {
+	r := &operationRecorder{}
+	g := New("localhost:0")
+	g.Init(r)
+	g.Start()
+	defer g.Stop()
+
+	rsp, err := g.Allow(context.TODO(), &qspb.AllowRequest{
+		Namespace:     proto.String("n"),
+		Name:          proto.String("b"),
+		OperationType: proto.String("write")})
+	if err != nil || rsp.GetStatus() != qspb.AllowResponse_OK || r.operationType != "write" {
+		t.Fatalf("Expecting a write to be allowed. Was %v, %v, %v", rsp, err, r.operationType)
+	}
+}
+
+// retryingQuotaService rejects all requests, asking clients to retry after a wait.
+type retryingQuotaService struct {
+	mockQuotaService
+	wait time.Duration
+}
+
+func (r *retryingQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return 0, r.wait, quotaservice.QuotaServiceError{Reason: quotaservice.ER_TIMED_OUT_WAITING}
+}
+
+func allowRemotely(t *testing.T, qs quotaservice.QuotaService) (*qspb.AllowResponse, metadata.MD) {
+	g := New("localhost:0")
+	g.Init(qs)
+	g.Start()
+	defer g.Stop()
+
+	conn, err := grpc.Dial(g.listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Unable to connect. Error: %v", err)
+	}
+	defer conn.Close()
+
+	var trailer metadata.MD
+	rsp, err := qspb.NewQuotaServiceClient(conn).Allow(context.TODO(), req, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	return rsp, trailer
+}
+
+func TestRetryAfterTrailer(t *testing.T) {
+	rsp, trailer := allowRemotely(t, &retryingQuotaService{wait: 2500 * time.Millisecond})
+	if rsp.GetStatus() != qspb.AllowResponse_REJECTED {
+		t.Fatalf("Expecting status REJECTED. Was %v", rsp.GetStatus())
+	}
+
+	if retryAfter := trailer[RetryAfterTrailer]; len(retryAfter) != 1 || retryAfter[0] != "3" {
+		t.Fatalf("Expecting to retry after 3 seconds. Was %v", trailer)
+	}
+}
+
+func TestRetryAfterTrailerFromBucket(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	b := configs.NewDefaultBucketConfig()
+	b.Size = 1
+	b.FillRate = 1
+	b.MaxDebtMillis = 0
+	b.WaitTimeoutMillis = 100
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	g := New("localhost:0")
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), g)
+	s.Start()
+	defer s.Stop()
+
+	conn, err := grpc.Dial(g.listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Unable to connect. Error: %v", err)
+	}
+	defer conn.Close()
+
+	client := qspb.NewQuotaServiceClient(conn)
+	if rsp, err := client.Allow(context.TODO(), req); err != nil || rsp.GetStatus() != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting status OK. Was %v, %v", rsp, err)
+	}
+
+	// The bucket refills a token a second.
+	var trailer metadata.MD
+	rsp, err := client.Allow(context.TODO(), req, grpc.Trailer(&trailer))
+	if err != nil || rsp.GetStatus() != qspb.AllowResponse_REJECTED {
+		t.Fatalf("Expecting status REJECTED. Was %v, %v", rsp, err)
+	}
+
+	if retryAfter := trailer[RetryAfterTrailer]; len(retryAfter) != 1 || retryAfter[0] != "1" {
+		t.Fatalf("Expecting to retry after 1 second. Was %v", trailer)
+	}
+}
+
+func TestNoRetryAfterTrailer(t *testing.T) {
+	if _, trailer := allowRemotely(t, &retryingQuotaService{}); len(trailer[RetryAfterTrailer]) != 0 {
+		t.Fatalf("Expecting no retry-after trailer without a wait. Was %v", trailer)
+	}
+
+	if _, trailer := allowRemotely(t, &mockQuotaService{}); len(trailer[RetryAfterTrailer]) != 0 {
+		t.Fatalf("Expecting no retry-after trailer for granted requests. Was %v", trailer)
+	}
+}
+
+// clampingQuotaService grants requests the tokens its bucket container clamps them to.
+type clampingQuotaService struct {
+	mockQuotaService
+	cfg *configs.ServiceConfig
+	bc  *buckets.BucketContainer
+}
+
+func (c *clampingQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return c.bc.ClampTokens(namespace, tokensRequested), 0, nil
+}
+
+func (c *clampingQuotaService) Metrics() metrics.Metrics                  { return nil }
+func (c *clampingQuotaService) Configs() *configs.ServiceConfig           { return c.cfg }
+func (c *clampingQuotaService) BucketContainer() *buckets.BucketContainer { return c.bc }
+
+func TestClampedTokens(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.GlobalMaxTokensPerRequest = 10
+	bf := memory.NewBucketFactory()
+	bf.Init(cfg)
+	g := New("localhost:0")
+	g.Init(&clampingQuotaService{cfg: cfg, bc: buckets.NewBucketContainer(cfg, bf)})
+	g.Start()
+	defer g.Stop()
+
+	rsp, err := g.Allow(context.TODO(), &qspb.AllowRequest{
+		Namespace:          proto.String("n"),
+		Name:               proto.String("b"),
+		NumTokensRequested: proto.Int64(5)})
+	if err != nil || rsp.GetNumTokensGranted() != 5 || rsp.ClampedTokens != nil {
+		t.Fatalf("Expecting 5 tokens granted without clamping. Was %v, %v", rsp, err)
+	}
+
+	rsp, err = g.Allow(context.TODO(), &qspb.AllowRequest{
+		Namespace:          proto.String("n"),
+		Name:               proto.String("b"),
+		NumTokensRequested: proto.Int64(50)})
+	if err != nil || rsp.GetNumTokensGranted() != 10 || rsp.GetClampedTokens() != 10 {
+		t.Fatalf("Expecting the request clamped to 10 tokens. Was %v, %v", rsp, err)
+	}
+}
+
+func TestDryRunReported(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	bf := memory.NewBucketFactory()
+	bf.Init(cfg)
+	bc := buckets.NewBucketContainer(cfg, bf)
+	g := New("localhost:0")
+	g.Init(&clampingQuotaService{cfg: cfg, bc: bc})
+	g.Start()
+	defer g.Stop()
+
+	if rsp, err := g.Allow(context.TODO(), req); err != nil || rsp.DryRun != nil {
+		t.Fatalf("Expecting the request not to be reported as a dry run. Was %v, %v", rsp, err)
+	}
+
+	bc.SetNamespaceDryRun("n", true)
+	if rsp, err := g.Allow(context.TODO(), req); err != nil || !rsp.GetDryRun() {
+		t.Fatalf("Expecting requests against a namespace in dry-run mode to be reported as dry runs. Was %v, %v", rsp, err)
+	}
+}
+
+// maxWaitQuotaService waits up to 1s for tokens by default, and up to 5s if requests ask to.
+type maxWaitQuotaService struct {
+	mockQuotaService
+}
+
+func (m *maxWaitQuotaService) EffectiveMaxWait(namespace string, name string, maxWaitMillisOverride int64) (time.Duration, bool) {
+	millis := int64(1000)
+	if maxWaitMillisOverride > -1 {
+		millis = maxWaitMillisOverride
+	}
+
+	if millis > 5000 {
+		millis = 5000
+	}
+
+	return time.Duration(millis) * time.Millisecond, true
+}
+
+func TestEffectiveMaxWait(t *testing.T) {
+	g := New("localhost:0")
+	g.Init(&maxWaitQuotaService{})
+	g.Start()
+	defer g.Stop()
+
+	for _, test := range []struct {
+		desc          string
+		override      int64
+		deadline      time.Duration
+		expectedRange [2]int64
+	}{
+		{"default", -1, 0, [2]int64{1000, 1000}},
+		{"request", 3000, 0, [2]int64{3000, 3000}},
+		{"cap", 8000, 0, [2]int64{5000, 5000}},
+		{"deadline", 3000, 200 * time.Millisecond, [2]int64{100, 200}},
+		{"deadline without override", -1, 200 * time.Millisecond, [2]int64{100, 200}},
+		{"default before deadline", -1, 10 * time.Second, [2]int64{1000, 1000}}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.deadline > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), test.deadline)
+		}
+
+		rsp, err := g.Allow(ctx, &qspb.AllowRequest{
+			Namespace:             proto.String("n"),
+			Name:                  proto.String("b"),
+			MaxWaitMillisOverride: proto.Int64(test.override)})
+		cancel()
+
+		if err != nil || rsp.EffectiveMaxWaitMillis == nil {
+			t.Fatalf("Expecting an effective max wait when the %v binds. Was %v, %v", test.desc, rsp, err)
+		}
+
+		if maxWait := rsp.GetEffectiveMaxWaitMillis(); maxWait < test.expectedRange[0] || maxWait > test.expectedRange[1] {
+			t.Fatalf("Expecting an effective max wait in %v when the %v binds. Was %v",
+				test.expectedRange, test.desc, maxWait)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maniksurtani/quotaservice/buckets"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// IPRateLimitIdleTimeout is how long a caller IP goes without requests before its bucket is
+// garbage collected.
+const IPRateLimitIdleTimeout = 5 * time.Minute
+
+// ipRateLimiter limits the rate of requests from each caller IP, using an in-memory token bucket
+// per IP.
+type ipRateLimiter struct {
+	bf      buckets.BucketFactory
+	cfg     *configs.BucketConfig
+	buckets sync.Map // Of *ipBucket, by IP.
+	stop    chan struct{}
+}
+
+type ipBucket struct {
+	bucket    buckets.Bucket
+	lastSeen  time.Time
+	destroyed bool
+	sync.Mutex
+}
+
+func newIPRateLimiter(rps, burst int64) *ipRateLimiter {
+	cfg := configs.NewDefaultBucketConfig()
+	cfg.FillRate = rps
+	cfg.Size = burst
+	cfg.MaxIdleMillis = -1
+	// Requests are never allowed to wait for tokens.
+	cfg.MaxDebtMillis = 0
+
+	bf := memory.NewBucketFactory()
+	bf.Init(configs.NewDefaultServiceConfig())
+	return &ipRateLimiter{bf: bf, cfg: cfg}
+}
+
+// allow takes a token from the bucket of a caller IP, creating it if needed, and returns false if
+// there are none.
+func (l *ipRateLimiter) allow(ip string, now time.Time) bool {
+	for {
+		v, ok := l.buckets.Load(ip)
+		if !ok {
+			created := &ipBucket{bucket: l.bf.NewBucket("grpc", ip, l.cfg, true), lastSeen: now}
+			if v, ok = l.buckets.LoadOrStore(ip, created); ok {
+				// Another request created the IP's bucket first.
+				created.bucket.Destroy()
+			}
+		}
+
+		b := v.(*ipBucket)
+		b.Lock()
+		if b.destroyed {
+			// Garbage collected since it was loaded. Look it up again.
+			b.Unlock()
+			continue
+		}
+
+		b.lastSeen = now
+		granted := b.bucket.Take(1, 0) == 0
+		b.Unlock()
+		return granted
+	}
+}
+
+// gc destroys the buckets of IPs not seen for IPRateLimitIdleTimeout.
+func (l *ipRateLimiter) gc(now time.Time) {
+	l.buckets.Range(func(ip, v interface{}) bool {
+		b := v.(*ipBucket)
+		b.Lock()
+		defer b.Unlock()
+
+		if now.Sub(b.lastSeen) > IPRateLimitIdleTimeout {
+			b.destroyed = true
+			l.buckets.Delete(ip)
+			b.bucket.Destroy()
+		}
+		return true
+	})
+}
+
+// start garbage collects idle buckets every minute, until stopped.
+func (l *ipRateLimiter) start() {
+	l.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				l.gc(now)
+			case <-stop:
+				return
+			}
+		}
+	}(l.stop)
+}
+
+func (l *ipRateLimiter) stopGC() {
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
@@ -0,0 +1,56 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// traceParentKey is the metadata key OpenTelemetry uses to propagate W3C trace context.
+const traceParentKey = "traceparent"
+
+// traceID returns the ID of the trace a request is part of, if the client propagated one in a W3C
+// traceparent, such as OpenTelemetry does. Otherwise a random UUID is returned.
+func traceID(ctx context.Context) string {
+	if md, ok := metadata.FromContext(ctx); ok && len(md[traceParentKey]) > 0 {
+		// version-traceid-parentid-flags
+		parts := strings.Split(md[traceParentKey][0], "-")
+		if len(parts) == 4 && validTraceID(parts[1]) {
+			return parts[1]
+		}
+	}
+
+	return newUUID()
+}
+
+func validTraceID(id string) bool {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 {
+		return false
+	}
+
+	// An all-zero trace ID is invalid.
+	for _, x := range b {
+		if x != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
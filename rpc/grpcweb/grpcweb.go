@@ -0,0 +1,175 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package grpcweb serves the quota service's gRPC API to browser-based clients, using the gRPC-Web
+// protocol over HTTP/1.1.
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice"
+	"github.com/maniksurtani/quotaservice/logging"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	qsgrpc "github.com/maniksurtani/quotaservice/rpc/grpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	dataFrame      byte = 0x00
+	trailerFrame   byte = 0x80
+	frameHeaderLen      = 5
+)
+
+// unaryMethod decodes a request, and calls a method of the QuotaService gRPC service with it.
+type unaryMethod func(ctx context.Context, srv qspb.QuotaServiceServer, req []byte) (proto.Message, error)
+
+// methods maps the paths of the gRPC methods served to their implementations.
+var methods = map[string]unaryMethod{
+	"/quotaservice.QuotaService/Allow": func(ctx context.Context, srv qspb.QuotaServiceServer, req []byte) (proto.Message, error) {
+		in := new(qspb.AllowRequest)
+		if err := proto.Unmarshal(req, in); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "unable to parse request: %v", err)
+		}
+		return srv.Allow(ctx, in)
+	},
+}
+
+// GrpcWebEndpoint serves requests from gRPC-Web clients on a separate port, using a GrpcEndpoint's
+// implementation of the QuotaService gRPC service. Both binary and base64-encoded text payloads
+// are accepted, and cross-origin requests are allowed.
+type GrpcWebEndpoint struct {
+	grpcEndpoint *qsgrpc.GrpcEndpoint
+	hostport     string
+	listener     net.Listener
+}
+
+// New creates a new GrpcWebEndpoint, listening on hostport, in the form "host:port". The
+// GrpcEndpoint also needs to be passed to the quota service, which initializes and starts it.
+func New(grpcEndpoint *qsgrpc.GrpcEndpoint, hostport string) *GrpcWebEndpoint {
+	if !strings.Contains(hostport, ":") {
+		panic(fmt.Sprintf("hostport should be in the format 'host:port', but is currently %v",
+			hostport))
+	}
+	return &GrpcWebEndpoint{grpcEndpoint: grpcEndpoint, hostport: hostport}
+}
+
+// Init does nothing, since requests are served by the GrpcEndpoint, which is initialized
+// separately.
+func (g *GrpcWebEndpoint) Init(qs quotaservice.QuotaService) {}
+
+func (g *GrpcWebEndpoint) Start() {
+	lis, err := net.Listen("tcp", g.hostport)
+	if err != nil {
+		logging.Fatalf("Cannot start gRPC-Web server on port %v. Error %v", g.hostport, err)
+		panic(fmt.Sprintf("Cannot start gRPC-Web server on port %v. Error %v", g.hostport, err))
+	}
+
+	g.listener = lis
+	go http.Serve(lis, g)
+	logging.Printf("Starting gRPC-Web server on %v", g.hostport)
+}
+
+func (g *GrpcWebEndpoint) Stop() {
+	g.listener.Close()
+}
+
+// ServeHTTP serves a single gRPC-Web request.
+func (g *GrpcWebEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" {
+		// CORS preflight.
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "content-type, x-grpc-web, x-user-agent")
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, "application/grpc-web-text")
+	if r.Method != "POST" || !strings.HasPrefix(contentType, "application/grpc-web") {
+		http.Error(w, "Not a gRPC-Web request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	method := methods[r.URL.Path]
+	if method == nil {
+		writeResponse(w, contentType, text, nil, grpc.Errorf(codes.Unimplemented, "unknown method %v", r.URL.Path))
+		return
+	}
+
+	req, err := readRequest(r, text)
+	if err != nil {
+		writeResponse(w, contentType, text, nil, grpc.Errorf(codes.InvalidArgument, "%v", err))
+		return
+	}
+
+	rsp, err := method(context.Background(), g.grpcEndpoint, req)
+	writeResponse(w, contentType, text, rsp, err)
+}
+
+// readRequest returns the request message in a gRPC-Web request's body.
+func readRequest(r *http.Request, text bool) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if text {
+		body, err = base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode base64 request: %v", err)
+		}
+	}
+
+	if len(body) < frameHeaderLen || body[0] != dataFrame {
+		return nil, fmt.Errorf("Expecting a data frame")
+	}
+
+	msgLen := binary.BigEndian.Uint32(body[1:frameHeaderLen])
+	if uint32(len(body)-frameHeaderLen) < msgLen {
+		return nil, fmt.Errorf("Request truncated")
+	}
+
+	return body[frameHeaderLen : frameHeaderLen+msgLen], nil
+}
+
+// writeResponse writes the response message, if any, followed by trailers with the call's status.
+func writeResponse(w http.ResponseWriter, contentType string, text bool, rsp proto.Message, err error) {
+	var body bytes.Buffer
+	if err == nil {
+		msg, marshalErr := proto.Marshal(rsp)
+		if marshalErr != nil {
+			err = grpc.Errorf(codes.Internal, "unable to marshal response: %v", marshalErr)
+		} else {
+			writeFrame(&body, dataFrame, msg)
+		}
+	}
+
+	trailers := fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %v\r\n", grpc.Code(err), grpc.ErrorDesc(err))
+	writeFrame(&body, trailerFrame, []byte(trailers))
+
+	w.Header().Set("Content-Type", contentType)
+	if text {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(body.Bytes())))
+	} else {
+		w.Write(body.Bytes())
+	}
+}
+
+func writeFrame(buf *bytes.Buffer, flag byte, payload []byte) {
+	var header [frameHeaderLen]byte
+	header[0] = flag
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	buf.Write(header[:])
+	buf.Write(payload)
+}
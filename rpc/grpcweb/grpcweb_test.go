@@ -0,0 +1,125 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	qsgrpc "github.com/maniksurtani/quotaservice/rpc/grpc"
+)
+
+type mockQuotaService struct{}
+
+func (m *mockQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return tokensRequested, 0, nil
+}
+
+func (m *mockQuotaService) AllowOp(namespace string, name string, operationType string, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return 1, 0, nil
+}
+
+func (m *mockQuotaService) AllowWithMeta(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64, meta map[string]string) (int64, time.Duration, error) {
+	return tokensRequested, 0, nil
+}
+
+func (m *mockQuotaService) DonateTokens(fromNamespace, toNamespace string, tokens int64) error {
+	return nil
+}
+
+func newEndpoint(t *testing.T) *GrpcWebEndpoint {
+	g := qsgrpc.New("localhost:0")
+	g.Init(&mockQuotaService{})
+	g.Start()
+
+	w := New(g, "localhost:0")
+	w.Start()
+	t.Cleanup(func() {
+		w.Stop()
+		g.Stop()
+	})
+	return w
+}
+
+// post sends a gRPC-Web text request, as a browser would, and returns the decoded response body.
+func post(t *testing.T, w *GrpcWebEndpoint, path string, req proto.Message) []byte {
+	msg, _ := proto.Marshal(req)
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	body := base64.StdEncoding.EncodeToString(append(frame, msg...))
+
+	rsp, err := http.Post("http://"+w.listener.Addr().String()+path, "application/grpc-web-text",
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unable to send request: %v", err)
+	}
+	defer rsp.Body.Close()
+
+	if ct := rsp.Header.Get("Content-Type"); ct != "application/grpc-web-text" {
+		t.Fatalf("Expecting a gRPC-Web text response. Was %v", ct)
+	}
+
+	encoded, _ := ioutil.ReadAll(rsp.Body)
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		t.Fatalf("Unable to decode response %q: %v", encoded, err)
+	}
+
+	return decoded
+}
+
+// nextFrame splits the first frame from a response body.
+func nextFrame(t *testing.T, body []byte) (flag byte, payload, rest []byte) {
+	if len(body) < 5 {
+		t.Fatalf("Expecting a frame. Was %v", body)
+	}
+
+	n := binary.BigEndian.Uint32(body[1:5])
+	return body[0], body[5 : 5+n], body[5+n:]
+}
+
+func TestAllow(t *testing.T) {
+	w := newEndpoint(t)
+	body := post(t, w, "/quotaservice.QuotaService/Allow", &qspb.AllowRequest{
+		Namespace:          proto.String("n"),
+		Name:               proto.String("b"),
+		NumTokensRequested: proto.Int64(3)})
+
+	flag, payload, body := nextFrame(t, body)
+	if flag != dataFrame {
+		t.Fatalf("Expecting a data frame. Was %v", flag)
+	}
+
+	rsp := &qspb.AllowResponse{}
+	if err := proto.Unmarshal(payload, rsp); err != nil {
+		t.Fatalf("Unable to parse response: %v", err)
+	}
+
+	if rsp.GetStatus() != qspb.AllowResponse_OK || rsp.GetNumTokensGranted() != 3 {
+		t.Fatalf("Expecting 3 tokens granted. Was %v", rsp)
+	}
+
+	flag, payload, _ = nextFrame(t, body)
+	if flag != trailerFrame || !bytes.Contains(payload, []byte("grpc-status: 0\r\n")) {
+		t.Fatalf("Expecting OK trailers. Was %q", payload)
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	w := newEndpoint(t)
+	body := post(t, w, "/quotaservice.QuotaService/Unknown", &qspb.AllowRequest{})
+
+	flag, payload, _ := nextFrame(t, body)
+	if flag != trailerFrame || !bytes.Contains(payload, []byte("grpc-status: 12\r\n")) {
+		t.Fatalf("Expecting Unimplemented trailers only. Was %q", payload)
+	}
+}
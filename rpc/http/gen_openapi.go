@@ -0,0 +1,104 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// +build ignore
+
+// gen_openapi generates openapi.json, the OpenAPI document served by HttpEndpoint, from the
+// endpoint's query parameters and the JSON tags of its response type. Run using go generate.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	qshttp "github.com/maniksurtani/quotaservice/rpc/http"
+)
+
+type param struct {
+	name, typ, description string
+	required               bool
+}
+
+// allowParams are the query parameters read by HttpEndpoint.ServeHTTP.
+var allowParams = []param{
+	{"namespace", "string", "Namespace of the bucket.", true},
+	{"name", "string", "Name of the bucket.", true},
+	{"tokens", "integer", "Number of tokens requested. Defaults to 1.", false},
+	{"max_wait_millis", "integer", "Overrides the bucket's max wait, in millis, if lower.", false}}
+
+// schemaOf describes a struct using its JSON tags.
+func schemaOf(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+
+		typ := "string"
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			typ = "integer"
+		case reflect.Bool:
+			typ = "boolean"
+		}
+		props[name] = map[string]interface{}{"type": typ}
+	}
+
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func main() {
+	var params []interface{}
+	for _, p := range allowParams {
+		params = append(params, map[string]interface{}{
+			"name":        p.name,
+			"in":          "query",
+			"required":    p.required,
+			"description": p.description,
+			"schema":      map[string]interface{}{"type": p.typ}})
+	}
+
+	jsonContent := func(schema interface{}) map[string]interface{} {
+		return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Quota service HTTP endpoint",
+			"version": "1.0.0"},
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"AllowResponse": schemaOf(reflect.TypeOf(qshttp.AllowResponse{}))}},
+		"paths": map[string]interface{}{
+			"/allow": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary":    "Requests tokens from a bucket.",
+					"parameters": params,
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "The quota decision.",
+							"content":     jsonContent(map[string]interface{}{"$ref": "#/components/schemas/AllowResponse"})},
+						"400": map[string]interface{}{"description": "Invalid request."},
+						"503": map[string]interface{}{"description": "The quota service is not started."}}}},
+			qshttp.OpenAPIPath: map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary": "Returns this document.",
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "The OpenAPI document.",
+							"content":     jsonContent(map[string]interface{}{"type": "object"})}}}}}}
+
+	b, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	if err := ioutil.WriteFile("openapi.json", append(b, '\n'), 0644); err != nil {
+		panic(err)
+	}
+}
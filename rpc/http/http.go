@@ -4,12 +4,30 @@
 package http
 
 import (
-	"github.com/maniksurtani/quotaservice/lifecycle"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
 	"github.com/maniksurtani/quotaservice"
+	"github.com/maniksurtani/quotaservice/lifecycle"
+	"github.com/maniksurtani/quotaservice/logging"
 )
 
+//go:generate go run gen_openapi.go
+
 const defaultPort = 80
 
+// OpenAPIPath is the path on which the endpoint's OpenAPI 3.0 document is served.
+const OpenAPIPath = "/openapi.json"
+
+// openAPISpec describes the endpoint, and is generated from its types by gen_openapi.go.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
 // HttpEndpoint is an HTTP-based implementation of an RPC endpoint
 type HttpEndpoint struct {
 	port          int
@@ -17,6 +35,15 @@ type HttpEndpoint struct {
 	qs            quotaservice.QuotaService
 }
 
+// AllowResponse is the JSON document returned for requests to ServeHTTP.
+type AllowResponse struct {
+	Status           string `json:"status"`
+	NumTokensGranted int64  `json:"num_tokens_granted"`
+	WaitMillis       int64  `json:"wait_millis"`
+	// RejectionMessage is the message configured on the bucket that rejected the request, if any.
+	RejectionMessage string `json:"rejection_message,omitempty"`
+}
+
 func New(port int) *HttpEndpoint {
 	return &HttpEndpoint{port: port}
 }
@@ -36,3 +63,66 @@ func (h *HttpEndpoint) Start() {
 func (h *HttpEndpoint) Stop() {
 	h.currentStatus = lifecycle.Stopped
 }
+
+// ServeHTTP services requests for tokens. The namespace and name of the bucket are passed in as
+// the query parameters namespace and name, and optionally the number of tokens requested and a
+// max wait override, in millis, as tokens and max_wait_millis. The endpoint's OpenAPI document is
+// served on OpenAPIPath.
+func (h *HttpEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == OpenAPIPath {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+		return
+	}
+
+	if h.currentStatus != lifecycle.Started {
+		http.Error(w, "quota service not started", http.StatusServiceUnavailable)
+		return
+	}
+
+	namespace := r.FormValue("namespace")
+	name := r.FormValue("name")
+	tokens, err := intParam(r, "tokens", 1)
+	if err != nil || namespace == "" || name == "" || tokens == 0 {
+		http.Error(w, fmt.Sprintf("Invalid request %v", r.URL), http.StatusBadRequest)
+		return
+	}
+
+	maxWaitMillisOverride, err := intParam(r, "max_wait_millis", -1)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request %v", r.URL), http.StatusBadRequest)
+		return
+	}
+
+	rsp := &AllowResponse{}
+	granted, wait, err := h.qs.Allow(namespace, name, tokens, maxWaitMillisOverride)
+	if err != nil {
+		if qsErr, ok := err.(quotaservice.QuotaServiceError); ok {
+			rsp.Status = "REJECTED"
+			rsp.RejectionMessage = qsErr.RejectionMessage
+		} else {
+			logging.Printf("Caught error %v", err)
+			rsp.Status = "FAILED"
+		}
+	} else {
+		if wait > 0 {
+			rsp.Status = "OK_WAIT"
+		} else {
+			rsp.Status = "OK"
+		}
+		rsp.NumTokensGranted = granted
+		rsp.WaitMillis = int64(wait / time.Millisecond)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+func intParam(r *http.Request, name string, defaultValue int64) (int64, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+
+	return strconv.ParseInt(v, 10, 64)
+}
@@ -0,0 +1,124 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maniksurtani/quotaservice"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+type mockQuotaService struct{}
+
+func (m *mockQuotaService) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return tokensRequested, 0, nil
+}
+
+func (m *mockQuotaService) AllowOp(namespace string, name string, operationType string, maxWaitMillisOverride int64) (int64, time.Duration, error) {
+	return 1, 0, nil
+}
+
+func (m *mockQuotaService) AllowWithMeta(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64, meta map[string]string) (int64, time.Duration, error) {
+	return tokensRequested, 0, nil
+}
+
+func (m *mockQuotaService) DonateTokens(fromNamespace, toNamespace string, tokens int64) error {
+	return nil
+}
+
+func allow(h *HttpEndpoint) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/allow?namespace=n&name=b&tokens=5", nil)
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAllowBeforeStart(t *testing.T) {
+	h := NewDefault()
+	h.Init(&mockQuotaService{})
+
+	if w := allow(h); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expecting status %v. Was %v", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestAllowAfterStop(t *testing.T) {
+	h := NewDefault()
+	h.Init(&mockQuotaService{})
+	h.Start()
+
+	w := allow(h)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expecting status %v. Was %v", http.StatusOK, w.Code)
+	}
+
+	rsp := &AllowResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+		t.Fatalf("Unable to parse response %v: %v", w.Body, err)
+	}
+
+	if rsp.Status != "OK" || rsp.NumTokensGranted != 5 {
+		t.Fatalf("Expecting 5 tokens granted. Was %+v", rsp)
+	}
+
+	h.Stop()
+	if w := allow(h); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expecting status %v. Was %v", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	// The document is served even before the endpoint is started.
+	h := NewDefault()
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", OpenAPIPath, nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expecting status %v. Was %v", http.StatusOK, w.Code)
+	}
+
+	spec := struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Unable to parse OpenAPI document %v: %v", w.Body, err)
+	}
+
+	if spec.OpenAPI != "3.0.0" || spec.Paths["/allow"] == nil {
+		t.Fatalf("Expecting an OpenAPI 3.0 document describing /allow. Was %+v", spec)
+	}
+}
+
+func TestRejectionMessage(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	b := configs.NewDefaultBucketConfig()
+	b.Size = 5
+	b.FillRate = 1
+	b.MaxDebtMillis = 0
+	b.RejectionMessage = "Upgrade to premium for higher limits."
+	cfg.Namespaces["n"].Buckets["b"] = b
+
+	h := NewDefault()
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), h)
+	s.Start()
+	defer s.Stop()
+
+	for _, expected := range []AllowResponse{
+		{Status: "OK", NumTokensGranted: 5},
+		{Status: "REJECTED", RejectionMessage: b.RejectionMessage}} {
+		rsp := AllowResponse{}
+		if err := json.Unmarshal(allow(h).Body.Bytes(), &rsp); err != nil || rsp != expected {
+			t.Fatalf("Expecting response %+v. Was %+v, %v", expected, rsp, err)
+		}
+	}
+}
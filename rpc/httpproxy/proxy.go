@@ -0,0 +1,126 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package httpproxy implements a reverse proxy that enforces quotas on the traffic it proxies.
+package httpproxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/maniksurtani/quotaservice"
+	"github.com/maniksurtani/quotaservice/logging"
+)
+
+// Headers the proxy can set on upstream requests, to identify the original client.
+const (
+	HeaderForwardedFor   = "X-Forwarded-For"
+	HeaderForwardedHost  = "X-Forwarded-Host"
+	HeaderForwardedProto = "X-Forwarded-Proto"
+)
+
+// RateLimitingProxy proxies requests to an upstream server, as long as the quota service grants a
+// token for each request.
+type RateLimitingProxy struct {
+	qs               quotaservice.QuotaService
+	extractNS        func(*http.Request) string
+	extractBucket    func(*http.Request) string
+	forwardedHeaders map[string]bool
+	proxy            *httputil.ReverseProxy
+}
+
+// NewRateLimitingProxy creates a proxy to target. The namespace and bucket each request is
+// counted against are extracted from the request using extractNS and extractBucket. Requests
+// that are rejected by the quota service are not proxied, and get a 429 response, or a 404 if
+// there is no such bucket. All of
+// HeaderForwardedFor, HeaderForwardedHost and HeaderForwardedProto are set on upstream requests,
+// unless changed using WithForwardedHeaders().
+func NewRateLimitingProxy(target *url.URL, qs quotaservice.QuotaService, extractNS, extractBucket func(*http.Request) string) *RateLimitingProxy {
+	p := &RateLimitingProxy{
+		qs:            qs,
+		extractNS:     extractNS,
+		extractBucket: extractBucket,
+		proxy:         httputil.NewSingleHostReverseProxy(target)}
+
+	p.WithForwardedHeaders(HeaderForwardedFor, HeaderForwardedHost, HeaderForwardedProto)
+
+	director := p.proxy.Director
+	p.proxy.Director = func(r *http.Request) {
+		host := r.Host
+		director(r)
+		p.setForwardedHeaders(r, host)
+	}
+
+	return p
+}
+
+// WithForwardedHeaders sets which of HeaderForwardedFor, HeaderForwardedHost and
+// HeaderForwardedProto are set on upstream requests. Pass no headers to set none of them.
+func (p *RateLimitingProxy) WithForwardedHeaders(headers ...string) *RateLimitingProxy {
+	p.forwardedHeaders = make(map[string]bool)
+	for _, h := range headers {
+		p.forwardedHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+
+	return p
+}
+
+func (p *RateLimitingProxy) setForwardedHeaders(r *http.Request, host string) {
+	if !p.forwardedHeaders[HeaderForwardedFor] {
+		// Stops the reverse proxy from adding the client's address.
+		r.Header[HeaderForwardedFor] = nil
+	}
+
+	if p.forwardedHeaders[HeaderForwardedHost] {
+		r.Header.Set(HeaderForwardedHost, host)
+	}
+
+	if p.forwardedHeaders[HeaderForwardedProto] {
+		if r.TLS != nil {
+			r.Header.Set(HeaderForwardedProto, "https")
+		} else {
+			r.Header.Set(HeaderForwardedProto, "http")
+		}
+	}
+}
+
+// ServeHTTP takes a token for the request, waiting if the quota service asks it to, before
+// proxying it.
+func (p *RateLimitingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, wait, err := p.qs.Allow(p.extractNS(r), p.extractBucket(r), 1, -1)
+	if err != nil {
+		if qsErr, ok := err.(quotaservice.QuotaServiceError); ok {
+			status := statusFor(qsErr.Reason)
+			http.Error(w, http.StatusText(status), status)
+		} else {
+			logging.Printf("Caught error %v", err)
+			http.Error(w, "Unable to check quota", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			// The client has gone away.
+			return
+		}
+	}
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+// statusFor returns the HTTP status of a request rejected by the quota service for reason.
+func statusFor(reason quotaservice.ErrorReason) int {
+	switch reason {
+	case quotaservice.ER_NO_SUCH_BUCKET, quotaservice.ER_NO_SUCH_OPERATION:
+		return http.StatusNotFound
+	case quotaservice.ER_SERVICE_NOT_READY:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusTooManyRequests
+	}
+}
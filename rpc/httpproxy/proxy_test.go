@@ -0,0 +1,146 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package httpproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/maniksurtani/quotaservice"
+	"github.com/maniksurtani/quotaservice/buckets/memory"
+	"github.com/maniksurtani/quotaservice/configs"
+)
+
+// captureEndpoint captures the QuotaService it is initialized with.
+type captureEndpoint struct {
+	qs quotaservice.QuotaService
+}
+
+func (e *captureEndpoint) Init(qs quotaservice.QuotaService) {
+	e.qs = qs
+}
+func (e *captureEndpoint) Start() {}
+func (e *captureEndpoint) Stop()  {}
+
+// newProxy starts an upstream server that echoes the headers it receives, and a proxy to it
+// backed by a quota service with two buckets: n:b, and n:single, which holds a single token and
+// doesn't refill for a second. Requests name their bucket using the namespace and bucket query
+// parameters.
+func newProxy(t *testing.T) (proxy *httptest.Server, upstreamHits *int) {
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		for _, h := range []string{HeaderForwardedFor, HeaderForwardedHost, HeaderForwardedProto} {
+			w.Header().Set("Echo-" + h, r.Header.Get(h))
+		}
+		w.Write([]byte("upstream"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = nil
+	cfg.Namespaces["n"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["n"].Buckets["b"] = configs.NewDefaultBucketConfig()
+	single := configs.NewDefaultBucketConfig()
+	single.Size = 1
+	single.FillRate = 1
+	single.MaxDebtMillis = 0
+	single.WaitTimeoutMillis = 1
+	cfg.Namespaces["n"].Buckets["single"] = single
+
+	e := &captureEndpoint{}
+	s := quotaservice.New(cfg, memory.NewBucketFactory(), e)
+	s.Start()
+	t.Cleanup(func() { s.Stop() })
+
+	target, _ := url.Parse(upstream.URL)
+	p := NewRateLimitingProxy(target, e.qs,
+		func(r *http.Request) string { return r.URL.Query().Get("namespace") },
+		func(r *http.Request) string { return r.URL.Query().Get("bucket") })
+
+	proxy = httptest.NewServer(p)
+	t.Cleanup(proxy.Close)
+	return proxy, &hits
+}
+
+func TestProxyApproved(t *testing.T) {
+	proxy, hits := newProxy(t)
+
+	rsp, err := http.Get(proxy.URL + "/?namespace=n&bucket=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	body, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode != http.StatusOK || string(body) != "upstream" || *hits != 1 {
+		t.Fatalf("Expecting request to be proxied. Was %v %q", rsp.StatusCode, body)
+	}
+
+	if rsp.Header.Get("Echo-" + HeaderForwardedFor) == "" || rsp.Header.Get("Echo-" + HeaderForwardedProto) != "http" {
+		t.Fatalf("Expecting forwarded headers to be set. Was %v", rsp.Header)
+	}
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	if h := rsp.Header.Get("Echo-" + HeaderForwardedHost); h != proxyURL.Host {
+		t.Fatalf("Expecting forwarded host %v. Was %v", proxyURL.Host, h)
+	}
+}
+
+// get makes a request through the proxy, returning its status.
+func get(t *testing.T, proxy *httptest.Server, bucket string) int {
+	rsp, err := http.Get(proxy.URL + "/?namespace=n&bucket=" + bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	return rsp.StatusCode
+}
+
+func TestProxyRejected(t *testing.T) {
+	proxy, hits := newProxy(t)
+
+	if status := get(t, proxy, "single"); status != http.StatusOK {
+		t.Fatalf("Expecting the first request to be proxied. Was %v", status)
+	}
+
+	if status := get(t, proxy, "single"); status != http.StatusTooManyRequests {
+		t.Fatalf("Expecting status %v once the bucket is exhausted. Was %v", http.StatusTooManyRequests, status)
+	}
+
+	if *hits != 1 {
+		t.Fatalf("Expecting rejected request not to be proxied. Upstream hit %v times", *hits)
+	}
+}
+
+func TestProxyNoSuchBucket(t *testing.T) {
+	proxy, hits := newProxy(t)
+
+	if status := get(t, proxy, "nonexistent"); status != http.StatusNotFound {
+		t.Fatalf("Expecting status %v. Was %v", http.StatusNotFound, status)
+	}
+
+	if *hits != 0 {
+		t.Fatal("Expecting request not to be proxied")
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	target, _ := url.Parse("http://upstream")
+	p := NewRateLimitingProxy(target, nil, nil, nil).WithForwardedHeaders(HeaderForwardedProto)
+
+	r := httptest.NewRequest("GET", "http://proxy/", nil)
+	p.proxy.Director(r)
+
+	if v, ok := r.Header[HeaderForwardedFor]; !ok || v != nil {
+		t.Fatalf("Expecting %v to be suppressed. Was %v", HeaderForwardedFor, r.Header)
+	}
+
+	if r.Header.Get(HeaderForwardedHost) != "" || r.Header.Get(HeaderForwardedProto) != "http" {
+		t.Fatalf("Expecting only %v to be set. Was %v", HeaderForwardedProto, r.Header)
+	}
+}
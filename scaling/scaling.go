@@ -0,0 +1,64 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package scaling signals autoscalers, such as KEDA, that the service behind a bucket needs more
+// capacity, because the bucket has been running out of tokens for a sustained period. Signals are
+// raised by a BucketContainer configured using WithScalingAdapter().
+package scaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Signal is the utilisation of a bucket, as a percentage of its size that has been taken.
+// Sustained is true while the utilisation has stayed above the scaling threshold for long enough
+// to warrant scaling, and false once it falls back below it.
+type Signal struct {
+	Namespace   string  `json:"namespace"`
+	BucketName  string  `json:"bucket"`
+	Utilisation float64 `json:"utilisation"`
+	Sustained   bool    `json:"sustained"`
+}
+
+// ScalingAdapter publishes scaling signals to an autoscaler.
+type ScalingAdapter interface {
+	Publish(s Signal) error
+}
+
+type kedaAdapter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewKEDAAdapter creates an adapter that posts each signal as JSON to httpEndpoint, such as a
+// service that KEDA's metrics-api scaler polls for the utilisation of each bucket.
+func NewKEDAAdapter(httpEndpoint string) ScalingAdapter {
+	if httpEndpoint == "" {
+		panic("KEDA endpoint should not be empty")
+	}
+
+	return &kedaAdapter{endpoint: httpEndpoint, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (k *kedaAdapter) Publish(s Signal) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := k.client.Post(k.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to publish scaling signal to %v: %v", k.endpoint, err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unable to publish scaling signal to %v: %v", k.endpoint, rsp.Status)
+	}
+
+	return nil
+}
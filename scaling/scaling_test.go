@@ -0,0 +1,41 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package scaling
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKEDAAdapterPublish(t *testing.T) {
+	var received Signal
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	s := Signal{Namespace: "n", BucketName: "b", Utilisation: 90, Sustained: true}
+	if err := NewKEDAAdapter(srv.URL).Publish(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if received != s {
+		t.Fatalf("Expecting %+v to be posted. Was %+v", s, received)
+	}
+}
+
+func TestKEDAAdapterPublishFailed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	if err := NewKEDAAdapter(srv.URL).Publish(Signal{}); err == nil {
+		t.Fatal("Expecting an error when the endpoint fails")
+	}
+}
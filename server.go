@@ -14,6 +14,8 @@ import (
 	"github.com/maniksurtani/quotaservice/metrics"
 	"time"
 	"net/http"
+	"strings"
+	"sync/atomic"
 )
 
 type Server interface {
@@ -26,6 +28,7 @@ type Server interface {
 }
 
 type server struct {
+	degradedRequests uint64 // Requests at throttling degradation levels. First, for atomic alignment.
 	cfgs            *configs.ServiceConfig
 	currentStatus   lifecycle.Status
 	stopper         *chan int
@@ -34,6 +37,8 @@ type server struct {
 	rpcEndpoints    []RpcEndpoint
 	metrics         metrics.Metrics
 	clustering      clustering.Clustering
+	delegations     *delegations
+	prefetches      *prefetches
 }
 
 // NewFromFile creates a new quotaservice server.
@@ -44,7 +49,9 @@ func New(config *configs.ServiceConfig, bucketFactory buckets.BucketFactory, rpc
 	s := &server{
 		cfgs:          config,
 		bucketFactory: bucketFactory,
-		rpcEndpoints:  rpcEndpoints}
+		rpcEndpoints:  rpcEndpoints,
+		delegations:   newDelegations(),
+		prefetches:    newPrefetches(time.Duration(config.PrefetchTTLMillis) * time.Millisecond)}
 
 	if config.MetricsEnabled {
 		s.metrics = metrics.New()
@@ -84,36 +91,503 @@ func (s *server) Stop() (bool, error) {
 		rpcServer.Stop()
 	}
 
+	s.bucketContainer.Stop()
 	return true, nil
 }
 
 func (s *server) Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error) {
-	b := s.bucketContainer.FindBucket(namespace, name)
+	b, err := s.findBucket(namespace, name, tokensRequested, nil)
+	if err != nil {
+		return
+	}
+
+	granted, _, waitTime, err = s.allow(b, namespace, name, "", s.bucketContainer.AdaptTokens(tokensRequested), maxWaitMillisOverride)
+	return
+}
+
+func (s *server) AllowOperation(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error) {
+	b, err := s.findBucket(namespace, name, tokensRequested, nil)
+	if err != nil {
+		return
+	}
+
+	granted, _, waitTime, err = s.allow(b, namespace, name, operationType, s.bucketContainer.AdaptTokens(tokensRequested), maxWaitMillisOverride)
+	return
+}
+
+func (s *server) AllowWithBurst(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (granted, burstTokens int64, waitTime time.Duration, err error) {
+	b, err := s.findBucket(namespace, name, tokensRequested, nil)
+	if err != nil {
+		return
+	}
+
+	return s.allow(b, namespace, name, "", s.bucketContainer.AdaptTokens(tokensRequested), maxWaitMillisOverride)
+}
+
+// AllowWithDegradation implements DegradationReporting.
+func (s *server) AllowWithDegradation(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted, burstTokens int64, level int32, waitTime time.Duration, err error) {
+	b, level, err := s.findDegradedBucket(namespace, name, tokensRequested, nil)
+	if err != nil {
+		return
+	}
+
+	granted, burstTokens, waitTime, err = s.allow(b, namespace, name, operationType, s.bucketContainer.AdaptTokens(tokensRequested), maxWaitMillisOverride)
+	return
+}
+
+func (s *server) AllowWithTrace(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, trace string, err error) {
+	var t strings.Builder
+	defer func() {
+		if err != nil {
+			buckets.TraceStep(&t, "returned error: %v", err)
+		}
+		trace = t.String()
+	}()
+
+	b, err := s.findBucket(namespace, name, tokensRequested, &t)
+	if err != nil {
+		return
+	}
+
+	granted, _, waitTime, err = s.allow(b, namespace, name, operationType, s.bucketContainer.AdaptTokens(tokensRequested), maxWaitMillisOverride)
+	if err == nil && waitTime > 0 {
+		buckets.TraceStep(&t, "took %v tokens;returned OK after waiting %v", granted, waitTime)
+	} else if err == nil {
+		buckets.TraceStep(&t, "took %v tokens;returned OK", granted)
+	}
+	return
+}
+
+func (s *server) AllowOp(namespace string, name string, operationType string, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error) {
+	b, err := s.findBucket(namespace, name, 0, nil)
+	if err != nil {
+		return
+	}
+
+	cost, ok := b.Config().OperationCosts[operationType]
+	if !ok {
+		s.bucketContainer.RecordEvent(namespace, name, 0, buckets.EVENT_REJECTED)
+		err = newError(fmt.Sprintf("No cost configured for operation %v on %v:%v.", operationType, namespace, name), ER_NO_SUCH_OPERATION)
+		return
+	}
+
+	if cost == 0 {
+		s.bucketContainer.RecordEvent(namespace, name, 0, buckets.EVENT_OK)
+		return
+	}
+
+	granted, _, waitTime, err = s.allow(b, namespace, name, operationType, s.bucketContainer.AdaptTokens(cost), maxWaitMillisOverride)
+	return
+}
+
+func (s *server) AllowWithMeta(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64, meta map[string]string) (granted int64, waitTime time.Duration, err error) {
+	tokensRequested = s.bucketContainer.TokenCost(namespace, name, meta, tokensRequested)
+	return s.Allow(namespace, name, tokensRequested, maxWaitMillisOverride)
+}
+
+// findBucket finds the bucket serving a request, recording a rejection if it can't be found. The
+// steps taken are recorded in trace, if it isn't nil.
+func (s *server) findBucket(namespace, name string, tokensRequested int64, trace *strings.Builder) (buckets.Bucket, error) {
+	b, _, err := s.findDegradedBucket(namespace, name, tokensRequested, trace)
+	return b, err
+}
+
+// findDegradedBucket is like findBucket, but also returns the level of the DegradationLadder the
+// bucket is at, even if the request is rejected because of it.
+func (s *server) findDegradedBucket(namespace, name string, tokensRequested int64, trace *strings.Builder) (buckets.Bucket, int32, error) {
+	b, err := s.bucketContainer.FindBucketTraced(namespace, name, trace)
+	if err == buckets.ErrNotReady {
+		s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_REJECTED)
+		return nil, 0, newError("Quota service not ready.", ER_SERVICE_NOT_READY)
+	}
+
+	if err == buckets.ErrNamespaceLocked {
+		s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_REJECTED)
+		return nil, 0, newError(fmt.Sprintf("Namespace %v is locked.", namespace), ER_NAMESPACE_LOCKED)
+	}
+
 	if b == nil {
-		err = newError(fmt.Sprintf("No such bucket %v:%v.", namespace, name), ER_NO_SUCH_BUCKET)
+		s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_REJECTED)
+		return nil, 0, newError(fmt.Sprintf("No such bucket %v:%v.", namespace, name), ER_NO_SUCH_BUCKET)
+	}
+
+	level, err := s.degrade(b, namespace, name, tokensRequested)
+	if err != nil {
+		buckets.TraceStep(trace, "bucket is degraded")
+		return nil, level, err
+	}
+
+	return b, level, nil
+}
+
+// degrade applies the action of the DegradationLadder level a bucket is at, returning the level,
+// and an error if the request is throttled or rejected.
+func (s *server) degrade(b buckets.Bucket, namespace, name string, tokensRequested int64) (int32, error) {
+	level, action := buckets.Degradation(b)
+	rejected := false
+	switch action {
+	case configs.DEGRADE_THROTTLE_50PCT:
+		rejected = s.throttle(5)
+	case configs.DEGRADE_THROTTLE_90PCT:
+		rejected = s.throttle(9)
+	case configs.DEGRADE_REJECT_NEW:
+		rejected = true
+	}
+
+	if !rejected {
+		return level, nil
+	}
+
+	s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_REJECTED)
+	return level, rejectedBy(b, newError(fmt.Sprintf("Bucket %v:%v is degraded to level %v.", namespace, name, level), ER_REJECTED))
+}
+
+// throttle tells you if a degraded request should be rejected, so that tenths out of every 10
+// requests are.
+func (s *server) throttle(tenths uint64) bool {
+	return atomic.AddUint64(&s.degradedRequests, 1) % 10 < tenths
+}
+
+// EffectiveMaxWait implements MaxWaitReporting.
+func (s *server) EffectiveMaxWait(namespace string, name string, maxWaitMillisOverride int64) (time.Duration, bool) {
+	cfg := s.bucketContainer.ServingConfig(namespace, name)
+	if cfg == nil {
+		return 0, false
+	}
+
+	return maxWait(cfg, maxWaitMillisOverride), true
+}
+
+// allow takes tokens from a bucket, from the aggregate buckets limiting its namespace, and from the
+// namespace's bucket for the type of operation, if any. The burst tokens returned are those of the
+// bucket serving the request. Requests beyond the namespace's MaxConcurrency, or made while its
+// circuit is open, are rejected, and requests for more than its MaxTokensPerRequest are granted
+// that many tokens instead. Requests against namespaces in dry-run mode are served as by DryRun().
+func (s *server) allow(b buckets.Bucket, namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted, burstTokens int64, waitTime time.Duration, err error) {
+	tokensRequested = s.bucketContainer.ClampTokens(namespace, tokensRequested)
+	if s.bucketContainer.IsNamespaceDryRun(namespace) {
+		granted, waitTime, err = s.dryRun(b, namespace, name, operationType, tokensRequested, maxWaitMillisOverride)
 		return
 	}
 
-	// Timeout
-	dur := time.Millisecond
-	if maxWaitMillisOverride > -1 && maxWaitMillisOverride < b.Config().WaitTimeoutMillis {
-		dur *= time.Duration(maxWaitMillisOverride)
-	} else {
-		dur *= time.Duration(b.Config().WaitTimeoutMillis)
+	release, err := s.bucketContainer.AcquireConcurrency(namespace)
+	if err != nil {
+		s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_REJECTED)
+		err = newError(fmt.Sprintf("Too many concurrent requests against namespace %v.", namespace), ER_REJECTED)
+		return
+	}
+	defer release()
+
+	if s.bucketContainer.EnterCircuit(namespace) != nil {
+		s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_REJECTED)
+		err = newError(fmt.Sprintf("Circuit open for namespace %v.", namespace), ER_REJECTED)
+		return
+	}
+	defer func() {
+		s.bucketContainer.ExitCircuit(namespace, circuitOutcome(err))
+	}()
+
+	dur := maxWait(b.Config(), maxWaitMillisOverride)
+	waitTime, burstTokens = take(b, tokensRequested, dur)
+	rejecting := b
+
+	// The first fallback with tokens available serves the request instead.
+	if waitTime < 0 {
+		for _, fallback := range s.bucketContainer.FallbackBuckets(b) {
+			if waitTime, burstTokens = take(fallback, tokensRequested, dur); waitTime >= 0 {
+				b = fallback
+				break
+			}
+		}
 	}
 
-	waitTime = b.Take(tokensRequested, dur)
+	// The longest wait of the bucket and its limits applies.
+	limits := s.limits(namespace, operationType)
+	if waitTime >= 0 {
+		taken := []buckets.Bucket{b}
+		for _, limit := range limits {
+			limitWaitTime := limit.Take(tokensRequested, dur)
+			if limitWaitTime < 0 {
+				// Put back what has been taken so far.
+				for _, t := range taken {
+					t.AddTokens(tokensRequested)
+				}
+				waitTime = limitWaitTime
+				rejecting = limit
+				break
+			}
+
+			taken = append(taken, limit)
+			if limitWaitTime > waitTime {
+				waitTime = limitWaitTime
+			}
+		}
+	}
+
+	// The namespace may have been locked while tokens were being taken.
+	if waitTime >= 0 && s.abortsInFlight(namespace) {
+		b.AddTokens(tokensRequested)
+		for _, limit := range limits {
+			limit.AddTokens(tokensRequested)
+		}
+
+		s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_REJECTED)
+		err = newError(fmt.Sprintf("Namespace %v was locked while in flight.", namespace), ER_NAMESPACE_LOCKED)
+		return 0, 0, 0, err
+	}
 
 	if waitTime < 0 && dur > 0 {
-		waitTime = 0
-		err = newError(fmt.Sprintf("Timed out waiting on %v:%v", namespace, name), ER_TIMED_OUT_WAITING)
+		waitTime = retryAfter(rejecting, tokensRequested)
+		burstTokens = 0
+		err = rejectedBy(rejecting, newError(fmt.Sprintf("Timed out waiting on %v:%v", namespace, name), ER_TIMED_OUT_WAITING))
+		s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_REJECTED)
 	} else {
 		granted = tokensRequested
+		if waitTime > 0 {
+			s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_OK_WAIT)
+		} else {
+			s.bucketContainer.RecordEvent(namespace, name, tokensRequested, buckets.EVENT_OK)
+		}
 	}
 
 	return
 }
 
+// circuitOutcome tells a namespace's circuit breaker whether a request was granted, rejected for
+// lack of tokens, or failed for some other reason.
+func circuitOutcome(err error) buckets.CircuitOutcome {
+	if err == nil {
+		return buckets.CIRCUIT_GRANTED
+	}
+
+	if qsErr, ok := err.(QuotaServiceError); ok && qsErr.Reason == ER_TIMED_OUT_WAITING {
+		return buckets.CIRCUIT_EXHAUSTED
+	}
+
+	return buckets.CIRCUIT_INCONCLUSIVE
+}
+
+// maxWait returns how long a request may wait for tokens from a bucket: the bucket's wait timeout,
+// unless the request overrides it, capped at the bucket's MaxWaitCapMillis if it has one, or at its
+// wait timeout otherwise.
+func maxWait(cfg *configs.BucketConfig, maxWaitMillisOverride int64) time.Duration {
+	waitCap := cfg.WaitTimeoutMillis
+	if cfg.MaxWaitCapMillis > 0 {
+		waitCap = cfg.MaxWaitCapMillis
+	}
+
+	millis := cfg.WaitTimeoutMillis
+	if maxWaitMillisOverride > -1 {
+		millis = maxWaitMillisOverride
+	}
+
+	if millis > waitCap {
+		millis = waitCap
+	}
+
+	return time.Duration(millis) * time.Millisecond
+}
+
+// limits returns the buckets that also limit requests made against a namespace: the aggregate
+// buckets of the namespace and its ancestors, and the operation's bucket, if it has one.
+func (s *server) limits(namespace, operationType string) []buckets.Bucket {
+	limits := s.bucketContainer.AggregateBuckets(namespace)
+	if opBucket := s.bucketContainer.OperationBucket(namespace, operationType); opBucket != nil {
+		limits = append(limits, opBucket)
+	}
+
+	return limits
+}
+
+// retryAfter estimates how long a request rejected by a bucket should wait before retrying: the
+// time the bucket takes to refill the tokens it is short of, or at least one token. Returns 0 if the
+// bucket doesn't count its tokens.
+func retryAfter(b buckets.Bucket, tokensRequested int64) time.Duration {
+	tc, ok := b.(buckets.TokenCounter)
+	fillRate := b.Config().FillRate
+	if !ok || fillRate < 1 {
+		return 0
+	}
+
+	short := tokensRequested - tc.AvailableTokens()
+	if short < 1 {
+		short = 1
+	}
+
+	return time.Duration(short) * time.Second / time.Duration(fillRate)
+}
+
+// rejectedBy attaches the RejectionMessage of the bucket rejecting a request to its error.
+func rejectedBy(b buckets.Bucket, err QuotaServiceError) QuotaServiceError {
+	err.RejectionMessage = b.Config().RejectionMessage
+	return err
+}
+
+// take takes tokens from a bucket, also returning how many were burst tokens if the bucket keeps
+// track of them. Buckets with TrafficShaping spread the grant over sub-batches, so the wait returned
+// is that of the first sub-batch, and none of the tokens are burst tokens.
+func take(b buckets.Bucket, tokensRequested int64, maxWaitTime time.Duration) (time.Duration, int64) {
+	if tsb, ok := b.(buckets.TrafficShapingBucket); ok && b.Config().TrafficShaping {
+		schedule := tsb.TakeShaped(tokensRequested, maxWaitTime)
+		if schedule == nil {
+			return -1, 0
+		}
+
+		return schedule[0].WaitTime, 0
+	}
+
+	if bab, ok := b.(buckets.BurstAccountingBucket); ok {
+		return bab.TakeWithBurst(tokensRequested, maxWaitTime)
+	}
+
+	return b.Take(tokensRequested, maxWaitTime), 0
+}
+
+// abortsInFlight tells you if requests in flight against a namespace, by name or alias, should be
+// aborted, since the namespace has been locked and is configured to abort in-flight requests.
+func (s *server) abortsInFlight(namespace string) bool {
+	nsCfg := s.bucketContainer.NamespaceConfig(namespace)
+	return nsCfg != nil && nsCfg.AbortInFlightOnLock && s.bucketContainer.IsNamespaceLocked(namespace)
+}
+
+func (s *server) DonateTokens(fromNamespace, toNamespace string, tokens int64) error {
+	err := s.bucketContainer.DonateTokens(fromNamespace, toNamespace, tokens)
+	if err != nil {
+		return newError(fmt.Sprintf("Unable to donate tokens from %v to %v: %v", fromNamespace, toNamespace, err), ER_REJECTED)
+	}
+
+	return nil
+}
+
+func (s *server) ReturnTokens(namespace string, name string, operationType string, tokens int64) error {
+	if tokens < 1 {
+		return fmt.Errorf("Returns need tokens. Were %v", tokens)
+	}
+
+	b, err := s.bucketContainer.FindBucket(namespace, name)
+	if err == buckets.ErrNotReady {
+		return newError("Quota service not ready.", ER_SERVICE_NOT_READY)
+	}
+
+	if err == buckets.ErrNamespaceLocked {
+		return newError(fmt.Sprintf("Namespace %v is locked.", namespace), ER_NAMESPACE_LOCKED)
+	}
+
+	if b == nil {
+		return newError(fmt.Sprintf("No such bucket %v:%v.", namespace, name), ER_NO_SUCH_BUCKET)
+	}
+
+	// Tokens go back to every bucket the grant took them from, as when allow() puts them back.
+	b.AddTokens(tokens)
+	for _, limit := range s.limits(namespace, operationType) {
+		limit.AddTokens(tokens)
+	}
+
+	return nil
+}
+
+// ApplyReplicatedGrant implements GrantReplicating. The tokens are taken from the aggregate
+// buckets limiting the namespace too, as they were on the primary.
+func (s *server) ApplyReplicatedGrant(namespace string, name string, tokens int64) error {
+	if tokens < 1 {
+		return fmt.Errorf("Replicated grants need tokens. Were %v", tokens)
+	}
+
+	b, err := s.bucketContainer.FindBucket(namespace, name)
+	if err == buckets.ErrNotReady {
+		return newError("Quota service not ready.", ER_SERVICE_NOT_READY)
+	}
+
+	if err == buckets.ErrNamespaceLocked {
+		return newError(fmt.Sprintf("Namespace %v is locked.", namespace), ER_NAMESPACE_LOCKED)
+	}
+
+	if b == nil {
+		return newError(fmt.Sprintf("No such bucket %v:%v.", namespace, name), ER_NO_SUCH_BUCKET)
+	}
+
+	b.Take(tokens, 0)
+	for _, limit := range s.bucketContainer.AggregateBuckets(namespace) {
+		limit.Take(tokens, 0)
+	}
+
+	return nil
+}
+
+// DryRun implements DryRunning. Buckets that aren't PeekingBuckets can't be dry run, so they return
+// buckets.ErrNotPeekingBucket.
+func (s *server) DryRun(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error) {
+	b, err := s.bucketContainer.FindBucket(namespace, name)
+	if err == buckets.ErrNotReady {
+		return 0, 0, newError("Quota service not ready.", ER_SERVICE_NOT_READY)
+	}
+
+	if err == buckets.ErrNamespaceLocked {
+		return 0, 0, newError(fmt.Sprintf("Namespace %v is locked.", namespace), ER_NAMESPACE_LOCKED)
+	}
+
+	if b == nil {
+		return 0, 0, newError(fmt.Sprintf("No such bucket %v:%v.", namespace, name), ER_NO_SUCH_BUCKET)
+	}
+
+	tokensRequested = s.bucketContainer.ClampTokens(namespace, s.bucketContainer.AdaptTokens(tokensRequested))
+	return s.dryRun(b, namespace, name, operationType, tokensRequested, maxWaitMillisOverride)
+}
+
+// dryRun returns how a request would be served by a bucket and its limits, without taking tokens.
+func (s *server) dryRun(b buckets.Bucket, namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error) {
+	dur := maxWait(b.Config(), maxWaitMillisOverride)
+	rejecting := b
+	if waitTime, err = peek(b, tokensRequested, dur); err != nil {
+		return
+	}
+
+	// As in allow(), the first fallback with tokens available would serve the request instead.
+	if waitTime < 0 {
+		for _, fallback := range s.bucketContainer.FallbackBuckets(b) {
+			if waitTime, err = peek(fallback, tokensRequested, dur); err != nil || waitTime >= 0 {
+				break
+			}
+		}
+	}
+
+	for _, limit := range s.limits(namespace, operationType) {
+		if waitTime < 0 || err != nil {
+			break
+		}
+
+		var limitWaitTime time.Duration
+		limitWaitTime, err = peek(limit, tokensRequested, dur)
+		if limitWaitTime < 0 {
+			rejecting = limit
+		}
+
+		if limitWaitTime < 0 || limitWaitTime > waitTime {
+			waitTime = limitWaitTime
+		}
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if waitTime < 0 {
+		return 0, 0, rejectedBy(rejecting, newError(fmt.Sprintf("Timed out waiting on %v:%v", namespace, name), ER_TIMED_OUT_WAITING))
+	}
+
+	return tokensRequested, waitTime, nil
+}
+
+// peek returns the wait time taking tokens from a bucket would return, without taking them.
+func peek(b buckets.Bucket, tokensRequested int64, maxWaitTime time.Duration) (time.Duration, error) {
+	pb, ok := b.(buckets.PeekingBucket)
+	if !ok {
+		return 0, buckets.ErrNotPeekingBucket
+	}
+
+	return pb.Peek(tokensRequested, maxWaitTime), nil
+}
+
 func (s *server) ServeAdminConsole(mux *http.ServeMux) {
 	admin.ServeAdminConsole(s, mux)
 }
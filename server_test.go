@@ -4,10 +4,16 @@
 package quotaservice
 
 import (
+	"context"
 	"testing"
+	"time"
+	"github.com/maniksurtani/quotaservice/buckets"
 	"github.com/maniksurtani/quotaservice/configs"
 	"github.com/maniksurtani/quotaservice/buckets/memory"
+	qspb "github.com/maniksurtani/quotaservice/protos"
 	"github.com/maniksurtani/quotaservice/test"
+	netcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 type dummyEndpoint struct {}
@@ -31,3 +37,834 @@ func TestValidServer(t *testing.T) {
 		t.Fatal("Expected a Metrics instance")
 	}
 }
+
+func newHierarchyServer() Server {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["product"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["product"].AggregateBucket = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["product"].AggregateBucket.Size = 20
+	cfg.Namespaces["product"].AggregateBucket.FillRate = 1
+
+	for _, nsName := range []string{"product.team", "product.other"} {
+		cfg.Namespaces[nsName] = configs.NewDefaultNamespaceConfig()
+		cfg.Namespaces[nsName].Parent = "product"
+		cfg.Namespaces[nsName].DefaultBucket = configs.NewDefaultBucketConfig()
+		cfg.Namespaces[nsName].DefaultBucket.Size = 10
+		cfg.Namespaces[nsName].DefaultBucket.FillRate = 1
+	}
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{})
+	s.Start()
+	return s
+}
+
+func TestAncestorExhaustion(t *testing.T) {
+	s := newHierarchyServer().(*server)
+	defer s.Stop()
+
+	for _, nsName := range []string{"product.team", "product.other"} {
+		if _, _, err := s.Allow(nsName, "b", 10, 1); err != nil {
+			t.Fatalf("Expecting tokens to be granted on %v. Error: %v", nsName, err)
+		}
+	}
+
+	// Borrows from the future.
+	if _, _, err := s.Allow("product.team", "b", 1, 1); err != nil {
+		t.Fatalf("Expecting tokens to be granted. Error: %v", err)
+	}
+
+	// product.other has tokens available, but its parent is exhausted.
+	if _, _, err := s.Allow("product.other", "b", 1, 1); err == nil {
+		t.Fatal("Expecting request to be rejected by the parent namespace")
+	}
+}
+
+func TestReturnTokens(t *testing.T) {
+	s := newHierarchyServer().(*server)
+	defer s.Stop()
+
+	if _, _, err := s.Allow("product.team", "b", 10, 1); err != nil {
+		t.Fatalf("Expecting tokens to be granted. Error: %v", err)
+	}
+
+	if err := s.ReturnTokens("product.team", "b", "", 10); err != nil {
+		t.Fatalf("Expecting tokens to be returned. Error: %v", err)
+	}
+
+	b, _ := s.bucketContainer.FindBucket("product.team", "b")
+	aggregate := s.bucketContainer.AggregateBuckets("product.team")[0]
+	if tokens := b.(buckets.TokenCounter).AvailableTokens(); tokens != 10 {
+		t.Fatalf("Expecting 10 tokens back in the bucket. Was %v", tokens)
+	}
+
+	if tokens := aggregate.(buckets.TokenCounter).AvailableTokens(); tokens != 20 {
+		t.Fatalf("Expecting 20 tokens back in the parent's aggregate bucket. Was %v", tokens)
+	}
+
+	if err := s.ReturnTokens("product.team", "b", "", 0); err == nil {
+		t.Fatal("Expecting an error returning no tokens")
+	}
+}
+
+func TestRejectionMessage(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].AggregateBucket = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].AggregateBucket.Size = 3
+	cfg.Namespaces["ns"].AggregateBucket.FillRate = 1
+	cfg.Namespaces["ns"].AggregateBucket.MaxDebtMillis = 0
+	cfg.Namespaces["ns"].AggregateBucket.RejectionMessage = "Contact support."
+	for _, name := range []string{"a", "b"} {
+		b := configs.NewDefaultBucketConfig()
+		b.Size = 2
+		b.FillRate = 1
+		b.MaxDebtMillis = 0
+		b.RejectionMessage = "Upgrade to premium for higher limits."
+		cfg.Namespaces["ns"].Buckets[name] = b
+	}
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	for _, test := range []struct {
+		name    string
+		message string
+	}{
+		{"a", ""},
+		{"a", ""},
+		{"a", "Upgrade to premium for higher limits."},
+		// The aggregate bucket rejects this request.
+		{"b", ""},
+		{"b", "Contact support."}} {
+		_, _, err := s.Allow("ns", test.name, 1, -1)
+		if test.message == "" && err != nil {
+			t.Fatalf("Expecting tokens to be granted. Error: %v", err)
+		}
+
+		if test.message != "" && (err == nil || err.(QuotaServiceError).RejectionMessage != test.message) {
+			t.Fatalf("Expecting rejection message %q. Was %v", test.message, err)
+		}
+	}
+}
+
+func TestDryRunHonoursAggregateBucket(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].AggregateBucket = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].AggregateBucket.Size = 2
+	cfg.Namespaces["ns"].AggregateBucket.MaxDebtMillis = 0
+	cfg.Namespaces["ns"].AggregateBucket.RejectionMessage = "Contact support."
+	cfg.Namespaces["ns"].Buckets["b"] = configs.NewDefaultBucketConfig()
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	if granted, _, err := s.DryRun("ns", "b", "", 2, -1); err != nil || granted != 2 {
+		t.Fatalf("Expecting 2 tokens granted. Was %v, %v", granted, err)
+	}
+
+	_, _, err := s.DryRun("ns", "b", "", 3, -1)
+	if err == nil || err.(QuotaServiceError).RejectionMessage != "Contact support." {
+		t.Fatalf("Expecting the aggregate bucket to reject the dry run. Was %v", err)
+	}
+}
+
+func TestIndependentChildLimits(t *testing.T) {
+	s := newHierarchyServer().(*server)
+	defer s.Stop()
+
+	s.Allow("product.team", "b", 10, 1)
+	s.Allow("product.team", "b", 1, 1)
+
+	if _, _, err := s.Allow("product.team", "b", 1, 1); err == nil {
+		t.Fatal("Expecting request to be rejected by the child namespace")
+	}
+
+	// The parent still has tokens available for other children.
+	if _, _, err := s.Allow("product.other", "b", 5, 1); err != nil {
+		t.Fatalf("Expecting tokens to be granted. Error: %v", err)
+	}
+}
+
+// onTakeBucketFactory creates memory buckets that call onTake before tokens are taken.
+type onTakeBucketFactory struct {
+	buckets.BucketFactory
+	onTake func()
+}
+
+func (bf *onTakeBucketFactory) NewBucket(namespace, bucketName string, cfg *configs.BucketConfig, dyn bool) buckets.Bucket {
+	return &onTakeBucket{bf.BucketFactory.NewBucket(namespace, bucketName, cfg, dyn), bf}
+}
+
+type onTakeBucket struct {
+	buckets.Bucket
+	factory *onTakeBucketFactory
+}
+
+func (b *onTakeBucket) Take(numTokens int64, maxWaitTime time.Duration) time.Duration {
+	if b.factory.onTake != nil {
+		b.factory.onTake()
+	}
+	return b.Bucket.Take(numTokens, maxWaitTime)
+}
+
+func newLockingServer(abortInFlight bool) (*server, *onTakeBucketFactory) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].AbortInFlightOnLock = abortInFlight
+	cfg.Namespaces["ns"].DefaultBucket = configs.NewDefaultBucketConfig()
+	bf := &onTakeBucketFactory{BucketFactory: memory.NewBucketFactory()}
+	s := New(cfg, bf, &dummyEndpoint{}).(*server)
+	s.Start()
+	return s, bf
+}
+
+func TestAllowOnLockedNamespace(t *testing.T) {
+	s, _ := newLockingServer(false)
+	defer s.Stop()
+
+	s.bucketContainer.LockNamespace("ns")
+	if _, _, err := s.Allow("ns", "b", 1, 0); err == nil || err.(QuotaServiceError).Reason != ER_NAMESPACE_LOCKED {
+		t.Fatalf("Expecting ER_NAMESPACE_LOCKED. Was %v", err)
+	}
+
+	s.bucketContainer.UnlockNamespace("ns")
+	if _, _, err := s.Allow("ns", "b", 1, 0); err != nil {
+		t.Fatalf("Expecting tokens once unlocked. Was %v", err)
+	}
+}
+
+func TestInFlightAllowDrains(t *testing.T) {
+	s, bf := newLockingServer(false)
+	defer s.Stop()
+
+	bf.onTake = func() { s.bucketContainer.LockNamespace("ns") }
+	if granted, _, err := s.Allow("ns", "b", 1, 0); err != nil || granted != 1 {
+		t.Fatalf("Expecting in-flight request to complete. Was %v, %v", granted, err)
+	}
+}
+
+func TestInFlightAllowAborts(t *testing.T) {
+	// Requests made through an alias are aborted too.
+	for _, namespace := range []string{"ns", "alias"} {
+		s, bf := newLockingServer(true)
+		if err := s.bucketContainer.AddAlias("alias", "ns"); err != nil {
+			t.Fatalf("Unable to add alias: %v", err)
+		}
+
+		bf.onTake = func() { s.bucketContainer.LockNamespace("ns") }
+		if _, _, err := s.Allow(namespace, "b", 1, 0); err == nil || err.(QuotaServiceError).Reason != ER_NAMESPACE_LOCKED {
+			t.Fatalf("Expecting in-flight request against %v to be aborted. Was %v", namespace, err)
+		}
+		s.Stop()
+	}
+}
+
+func TestInFlightAllowAbortsAfterRename(t *testing.T) {
+	s, bf := newLockingServer(true)
+	defer s.Stop()
+
+	if err := s.bucketContainer.RenameNamespace("ns", "renamed"); err != nil {
+		t.Fatalf("Unable to rename namespace: %v", err)
+	}
+
+	bf.onTake = func() { s.bucketContainer.LockNamespace("renamed") }
+	if _, _, err := s.Allow("renamed", "b", 1, 0); err == nil || err.(QuotaServiceError).Reason != ER_NAMESPACE_LOCKED {
+		t.Fatalf("Expecting in-flight request to be aborted. Was %v", err)
+	}
+}
+
+func newConcurrencyServer(maxConcurrency int64) (*server, *onTakeBucketFactory) {
+	s, bf := newLockingServer(false)
+	s.cfgs.Namespaces["ns"].MaxConcurrency = maxConcurrency
+	return s, bf
+}
+
+func TestConcurrencyAtLimit(t *testing.T) {
+	s, bf := newConcurrencyServer(2)
+	defer s.Stop()
+
+	var nestedErr error
+	bf.onTake = func() {
+		bf.onTake = nil
+		_, _, nestedErr = s.Allow("ns", "b", 1, 0)
+	}
+
+	if _, _, err := s.Allow("ns", "b", 1, 0); err != nil || nestedErr != nil {
+		t.Fatalf("Expecting both concurrent requests to be allowed. Were %v, %v", err, nestedErr)
+	}
+
+	// Slots are released once requests complete.
+	for i := 0; i < 5; i++ {
+		if _, _, err := s.Allow("ns", "b", 1, 0); err != nil {
+			t.Fatalf("Expecting sequential requests to be allowed. Was %v", err)
+		}
+	}
+}
+
+func TestConcurrencyOverLimit(t *testing.T) {
+	s, bf := newConcurrencyServer(1)
+	defer s.Stop()
+
+	var nestedErr error
+	bf.onTake = func() {
+		bf.onTake = nil
+		_, _, nestedErr = s.Allow("ns", "b", 1, 0)
+	}
+
+	if _, _, err := s.Allow("ns", "b", 1, 0); err != nil {
+		t.Fatalf("Expecting the first request to be allowed. Was %v", err)
+	}
+
+	if nestedErr == nil || nestedErr.(QuotaServiceError).Reason != ER_REJECTED {
+		t.Fatalf("Expecting ER_REJECTED for the concurrent request. Was %v", nestedErr)
+	}
+
+	if _, _, err := s.Allow("ns", "b", 1, 0); err != nil {
+		t.Fatalf("Expecting requests to be allowed once the first completes. Was %v", err)
+	}
+}
+
+func newDegradingServer() (*server, buckets.Bucket) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	b := configs.NewDefaultBucketConfig()
+	b.Size = 100
+	b.FillRate = 1
+	b.DegradationLadder = []configs.DegradationLevel{
+		{TokenThreshold: 80, Action: configs.DEGRADE_WARN},
+		{TokenThreshold: 50, Action: configs.DEGRADE_THROTTLE_50PCT},
+		{TokenThreshold: 20, Action: configs.DEGRADE_THROTTLE_90PCT},
+		{TokenThreshold: 5, Action: configs.DEGRADE_REJECT_NEW}}
+	cfg.Namespaces["ns"].Buckets["b"] = b
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+
+	bucket, _ := s.bucketContainer.FindBucket("ns", "b")
+	return s, bucket
+}
+
+func TestDegradationLadder(t *testing.T) {
+	s, b := newDegradingServer()
+	defer s.Stop()
+
+	// Tokens are taken from the bucket directly, to move down the ladder. Requests for 0 tokens
+	// don't change the level.
+	for _, test := range []struct {
+		take     int64
+		level    int32
+		rejected int
+	}{
+		{0, 0, 0},
+		{30, 1, 0},
+		{30, 2, 5},
+		{30, 3, 9},
+		{8, 4, 10}} {
+		b.Take(test.take, 0)
+
+		if _, _, level, _, _ := s.AllowWithDegradation("ns", "b", "", 0, 0); level != test.level {
+			t.Fatalf("Expecting level %v. Was %v", test.level, level)
+		}
+
+		rejected := 0
+		for i := 0; i < 10; i++ {
+			if _, _, err := s.Allow("ns", "b", 0, 0); err != nil {
+				if err.(QuotaServiceError).Reason != ER_REJECTED {
+					t.Fatalf("Expecting ER_REJECTED. Was %v", err)
+				}
+				rejected++
+			}
+		}
+
+		if rejected != test.rejected {
+			t.Fatalf("Expecting %v of 10 requests rejected at level %v. Was %v", test.rejected, test.level, rejected)
+		}
+	}
+
+	// Moving back up the ladder relaxes treatment.
+	b.AddTokens(40)
+	if _, _, level, _, _ := s.AllowWithDegradation("ns", "b", "", 0, 0); level != 2 {
+		t.Fatalf("Expecting level 2. Was %v", level)
+	}
+}
+
+func TestAllowWithTrace(t *testing.T) {
+	s, b := newDegradingServer()
+	defer s.Stop()
+
+	_, _, trace, err := s.AllowWithTrace("ns", "b", "", 1, 0)
+	if expected := "looked up namespace ns;found bucket b;took 1 tokens;returned OK"; err != nil || trace != expected {
+		t.Fatalf("Expecting trace %q. Was %q, %v", expected, trace, err)
+	}
+
+	_, _, trace, err = s.AllowWithTrace("ns", "x", "", 1, 0)
+	if expected := "looked up namespace ns;found no named bucket x;found no namespace default bucket;returned error: No such bucket ns:x."; err == nil || trace != expected {
+		t.Fatalf("Expecting trace %q. Was %q, %v", expected, trace, err)
+	}
+
+	// Moves to the bottom of the degradation ladder.
+	b.Take(97, 0)
+	_, _, trace, err = s.AllowWithTrace("ns", "b", "", 1, 0)
+	if expected := "looked up namespace ns;found bucket b;bucket is degraded;returned error: Bucket ns:b is degraded to level 4."; err == nil || trace != expected {
+		t.Fatalf("Expecting trace %q. Was %q, %v", expected, trace, err)
+	}
+}
+
+func newOperationCostServer() *server {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].DefaultBucket = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].DefaultBucket.Size = 10
+	cfg.Namespaces["ns"].DefaultBucket.FillRate = 1
+	cfg.Namespaces["ns"].DefaultBucket.OperationCosts = map[string]int64{"read": 1, "write": 5, "ping": 0}
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	return s
+}
+
+func TestAllowOp(t *testing.T) {
+	s := newOperationCostServer()
+	defer s.Stop()
+
+	if granted, _, err := s.AllowOp("ns", "b", "write", 0); err != nil || granted != 5 {
+		t.Fatalf("Expecting 5 tokens for a write. Was %v, %v", granted, err)
+	}
+
+	if granted, _, err := s.AllowOp("ns", "b", "read", 0); err != nil || granted != 1 {
+		t.Fatalf("Expecting 1 token for a read. Was %v, %v", granted, err)
+	}
+
+	// 6 tokens have been used, so another write would borrow from the future.
+	s.AllowOp("ns", "b", "write", 0)
+	if _, _, err := s.AllowOp("ns", "b", "read", 1); err == nil {
+		t.Fatal("Expecting the bucket to be exhausted")
+	}
+}
+
+func TestAllowUnknownOp(t *testing.T) {
+	s := newOperationCostServer()
+	defer s.Stop()
+
+	if _, _, err := s.AllowOp("ns", "b", "delete", 0); err == nil || err.(QuotaServiceError).Reason != ER_NO_SUCH_OPERATION {
+		t.Fatalf("Expecting ER_NO_SUCH_OPERATION. Was %v", err)
+	}
+}
+
+func TestAllowZeroCostOp(t *testing.T) {
+	s := newOperationCostServer()
+	defer s.Stop()
+
+	// Exhaust the bucket.
+	s.Allow("ns", "b", 10, 0)
+	s.Allow("ns", "b", 10, 0)
+
+	if granted, wait, err := s.AllowOp("ns", "b", "ping", 1); err != nil || granted != 0 || wait != 0 {
+		t.Fatalf("Expecting a free operation to be allowed. Was %v, %v, %v", granted, wait, err)
+	}
+}
+
+func newFallbackServer() *server {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	for _, name := range []string{"user", "account", "plan"} {
+		cfg.Namespaces["ns"].Buckets[name] = configs.NewDefaultBucketConfig()
+		cfg.Namespaces["ns"].Buckets[name].Size = 10
+		cfg.Namespaces["ns"].Buckets[name].FillRate = 1
+	}
+	cfg.Namespaces["ns"].Buckets["user"].FallbackChain = []string{"ns:account"}
+	cfg.Namespaces["ns"].Buckets["account"].FallbackChain = []string{"ns:plan"}
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	return s
+}
+
+func TestThreeLevelFallbackChain(t *testing.T) {
+	s := newFallbackServer()
+	defer s.Stop()
+
+	// Each of the 3 buckets serves 10 tokens, and borrows 1 from the future.
+	for i := 0; i < 3; i++ {
+		if _, _, err := s.Allow("ns", "user", 10, 1); err != nil {
+			t.Fatalf("Expecting request %v to be served by a fallback. Was %v", i, err)
+		}
+
+		if _, _, err := s.Allow("ns", "user", 1, 1); err != nil {
+			t.Fatalf("Expecting request %v to be served by a fallback. Was %v", i, err)
+		}
+	}
+}
+
+func TestAllFallbacksExhausted(t *testing.T) {
+	s := newFallbackServer()
+	defer s.Stop()
+
+	for _, name := range []string{"plan", "account", "user"} {
+		s.Allow("ns", name, 10, 1)
+		s.Allow("ns", name, 1, 1)
+	}
+
+	if _, _, err := s.Allow("ns", "user", 1, 1); err == nil || err.(QuotaServiceError).Reason != ER_TIMED_OUT_WAITING {
+		t.Fatalf("Expecting all fallbacks to be exhausted. Was %v", err)
+	}
+}
+
+func TestAllowWithMeta(t *testing.T) {
+	s := newOperationCostServer()
+	defer s.Stop()
+
+	s.BucketContainer().WithCostFunction(func(namespace, bucketName string, metadata map[string]string) int64 {
+		if metadata["tier"] == "free" {
+			return 5
+		}
+		return 1
+	})
+
+	if granted, _, err := s.AllowWithMeta("ns", "b", 1, 0, map[string]string{"tier": "free"}); err != nil || granted != 5 {
+		t.Fatalf("Expecting 5 tokens to be granted. Was %v, %v", granted, err)
+	}
+
+	if granted, _, err := s.AllowWithMeta("ns", "b", 2, 0, nil); err != nil || granted != 2 {
+		t.Fatalf("Expecting the tokens requested to be granted. Was %v, %v", granted, err)
+	}
+}
+
+func newOperationBucketServer() *server {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["api"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["api"].DefaultBucket = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["api"].DefaultBucket.Size = 1000
+	cfg.Namespaces["api"].OperationBuckets = map[string]*configs.BucketConfig{}
+	for op, size := range map[string]int64{"read": 5, "write": 2} {
+		opCfg := configs.NewDefaultBucketConfig()
+		opCfg.Size = size
+		opCfg.FillRate = 1
+		// Operations can't borrow tokens, so each bucket is exhausted once its tokens are used.
+		opCfg.MaxDebtMillis = 0
+		cfg.Namespaces["api"].OperationBuckets[op] = opCfg
+	}
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	return s
+}
+
+// allowOperations returns the number of single-token operations granted out of n.
+func allowOperations(s *server, operationType string, n int) (granted int) {
+	for i := 0; i < n; i++ {
+		if _, _, err := s.AllowOperation("api", "b", operationType, 1, 1); err == nil {
+			granted++
+		}
+	}
+
+	return
+}
+
+func TestOperationBucketLimits(t *testing.T) {
+	for op, limit := range map[string]int{"read": 5, "write": 2} {
+		s := newOperationBucketServer()
+		if granted := allowOperations(s, op, 10); granted != limit {
+			t.Fatalf("Expecting %v %v operations granted. Was %v", limit, op, granted)
+		}
+
+		// Tokens taken from the primary bucket for rejected operations are put back.
+		if tokens, _ := s.bucketContainer.ReadOnlyView().PeekBucket("api", "b"); tokens != int64(1000-limit) {
+			t.Fatalf("Expecting %v tokens left in the primary bucket. Was %v", 1000-limit, tokens)
+		}
+		s.Stop()
+	}
+}
+
+func TestIndependentOperationBuckets(t *testing.T) {
+	s := newOperationBucketServer()
+	defer s.Stop()
+
+	allowOperations(s, "write", 10)
+	if granted := allowOperations(s, "read", 10); granted != 5 {
+		t.Fatalf("Expecting reads to be unaffected by exhausted writes. Was %v granted", granted)
+	}
+
+	// Operations without a bucket, and requests without an operation, are only limited by the
+	// primary bucket.
+	if granted := allowOperations(s, "delete", 10); granted != 10 {
+		t.Fatalf("Expecting operations without a bucket to be granted. Was %v granted", granted)
+	}
+
+	if _, _, err := s.Allow("api", "b", 1, 1); err != nil {
+		t.Fatalf("Expecting requests without an operation to be granted. Was %v", err)
+	}
+}
+
+func TestAllowClampsTokens(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.GlobalMaxTokensPerRequest = 10
+	for _, nsName := range []string{"global", "override"} {
+		cfg.Namespaces[nsName] = configs.NewDefaultNamespaceConfig()
+		cfg.Namespaces[nsName].DefaultBucket = configs.NewDefaultBucketConfig()
+		cfg.Namespaces[nsName].DefaultBucket.Size = 1000
+	}
+	cfg.Namespaces["override"].MaxTokensPerRequest = 50
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	for _, test := range []struct {
+		namespace          string
+		requested, granted int64
+	}{
+		{"global", 5, 5},
+		{"global", 100, 10},
+		// The namespace's cap takes precedence over the global one.
+		{"override", 20, 20},
+		{"override", 100, 50}} {
+		if granted, _, err := s.Allow(test.namespace, "b", test.requested, 0); err != nil || granted != test.granted {
+			t.Fatalf("Expecting %v of %v tokens granted in %v. Was %v, %v",
+				test.granted, test.requested, test.namespace, granted, err)
+		}
+	}
+
+	// Only the tokens granted are taken.
+	if tokens, _ := s.bucketContainer.ReadOnlyView().PeekBucket("global", "b"); tokens != 985 {
+		t.Fatalf("Expecting 985 tokens left. Was %v", tokens)
+	}
+}
+
+func TestNamespaceDryRun(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].DryRun = true
+	cfg.Namespaces["ns"].Buckets["b"] = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].Buckets["b"].Size = 10
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	tokens := func() int64 {
+		tokens, _ := s.bucketContainer.ReadOnlyView().PeekBucket("ns", "b")
+		return tokens
+	}
+
+	for i := 0; i < 3; i++ {
+		if granted, _, err := s.Allow("ns", "b", 10, 0); err != nil || granted != 10 {
+			t.Fatalf("Expecting 10 tokens granted. Was %v, %v", granted, err)
+		}
+	}
+
+	if tokens() != 10 {
+		t.Fatalf("Expecting no tokens taken in dry-run mode. Had %v", tokens())
+	}
+
+	if err := s.bucketContainer.SetNamespaceDryRun("ns", false); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Allow("ns", "b", 4, 0)
+	if tokens() != 6 {
+		t.Fatalf("Expecting tokens taken once out of dry-run mode. Had %v", tokens())
+	}
+}
+
+func TestTrafficShapingSpreadsGrants(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	for _, name := range []string{"shaped", "unshaped"} {
+		cfg.Namespaces["ns"].Buckets[name] = configs.NewDefaultBucketConfig()
+		cfg.Namespaces["ns"].Buckets[name].Size = 100
+		cfg.Namespaces["ns"].Buckets[name].FillRate = 20
+	}
+	cfg.Namespaces["ns"].Buckets["shaped"].TrafficShaping = true
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	if _, burst, _, _ := s.AllowWithBurst("ns", "unshaped", 100, 0); burst != 100 {
+		t.Fatalf("Expecting the unshaped grant to be a burst. Was %v burst tokens", burst)
+	}
+
+	// The grant is spread over 5 seconds, so none of it is a burst.
+	granted, burst, wait, err := s.AllowWithBurst("ns", "shaped", 100, 0)
+	if err != nil || granted != 100 || burst != 0 || wait != 0 {
+		t.Fatalf("Expecting 100 tokens granted in sub-batches. Was %v, %v, %v, %v", granted, burst, wait, err)
+	}
+}
+
+func TestCircuitOpensOnExhaustion(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].CircuitBreakerThreshold = 2
+	cfg.Namespaces["ns"].CircuitBreakerResetTimeoutMs = 60000
+	cfg.Namespaces["ns"].Buckets["b"] = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].Buckets["b"].Size = 10
+	cfg.Namespaces["ns"].Buckets["b"].FillRate = 1
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	// Takes all tokens, and borrows one.
+	s.Allow("ns", "b", 10, 1)
+	s.Allow("ns", "b", 1, 1)
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.Allow("ns", "b", 1, 1); err == nil || err.(QuotaServiceError).Reason != ER_TIMED_OUT_WAITING {
+			t.Fatalf("Expecting request %v rejected by the bucket. Was %v", i, err)
+		}
+	}
+
+	if state := s.bucketContainer.GetCircuitState("ns"); state != buckets.CIRCUIT_OPEN {
+		t.Fatalf("Expecting the circuit to open. Was %v", state)
+	}
+
+	// Requests are rejected without checking the bucket.
+	b, _ := s.bucketContainer.FindBucket("ns", "b")
+	b.AddTokens(10)
+	before, _ := s.bucketContainer.ReadOnlyView().PeekBucket("ns", "b")
+	if _, _, err := s.Allow("ns", "b", 1, 1); err == nil || err.(QuotaServiceError).Reason != ER_REJECTED {
+		t.Fatalf("Expecting the open circuit to reject the request. Was %v", err)
+	}
+
+	if tokens, _ := s.bucketContainer.ReadOnlyView().PeekBucket("ns", "b"); tokens != before {
+		t.Fatalf("Expecting no tokens taken while the circuit is open. Had %v of %v", tokens, before)
+	}
+}
+
+func TestTakeExclusiveUnsupported(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].Buckets["b"] = configs.NewDefaultBucketConfig()
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	if _, _, _, err := s.TakeExclusive(context.Background(), "ns", "b", time.Minute); err == nil || err.(QuotaServiceError).Reason != ER_REJECTED {
+		t.Fatalf("Expecting memory buckets to reject exclusive takes. Was %v", err)
+	}
+
+	if _, _, _, err := s.TakeExclusive(context.Background(), "ns", "nonexistent", time.Minute); err == nil || err.(QuotaServiceError).Reason != ER_NO_SUCH_BUCKET {
+		t.Fatalf("Expecting ER_NO_SUCH_BUCKET. Was %v", err)
+	}
+
+	for _, lockTTL := range []time.Duration{0, time.Microsecond, -time.Minute} {
+		if _, _, _, err := s.TakeExclusive(context.Background(), "ns", "b", lockTTL); err == nil || err.(QuotaServiceError).Reason != ER_REJECTED {
+			t.Fatalf("Expecting a lock TTL of %v to be rejected. Was %v", lockTTL, err)
+		}
+	}
+
+	for _, leaseID := range []string{"", "lease", "ns/lease", "ns:b/lease"} {
+		if err := s.ReleaseExclusive(leaseID); err == nil {
+			t.Fatalf("Expecting lease %v not to be released", leaseID)
+		}
+	}
+}
+
+// standbyClient replicates grants to a standby in the same process.
+type standbyClient struct {
+	qspb.QuotaServiceClient
+	standby GrantReplicating
+}
+
+func (c *standbyClient) ReplicateGrant(ctx netcontext.Context, in *qspb.ReplicateGrantRequest, opts ...grpc.CallOption) (*qspb.ReplicateGrantResponse, error) {
+	return &qspb.ReplicateGrantResponse{}, c.standby.ApplyReplicatedGrant(in.GetNamespace(), in.GetName(), in.GetTokensGranted())
+}
+
+func TestStandbyReplication(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].Buckets["b"] = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].Buckets["b"].Size = 1000
+	cfg.Namespaces["ns"].Buckets["b"].FillRate = 1
+
+	standby := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	standby.Start()
+	defer standby.Stop()
+
+	primary := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	primary.Start()
+	defer primary.Stop()
+	primary.bucketContainer.WithStandbyReplication(&standbyClient{standby: standby}, 100)
+
+	for i := 0; i < 100; i++ {
+		if _, _, err := primary.Allow("ns", "b", 3, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peek := func(s *server) int64 {
+		tokens, _ := s.bucketContainer.ReadOnlyView().PeekBucket("ns", "b")
+		return tokens
+	}
+
+	// Grants reach the standby asynchronously. Both buckets refill slowly meanwhile.
+	deadline := time.Now().Add(2 * time.Second)
+	for peek(standby) > peek(primary)+1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if p, s := peek(primary), peek(standby); s < p-1 || s > p+1 {
+		t.Fatalf("Expecting the standby to have about %v tokens. Had %v", p, s)
+	}
+
+	if dropped := primary.bucketContainer.DroppedReplications(); dropped != 0 {
+		t.Fatalf("Expecting no grants dropped. Were %v", dropped)
+	}
+}
+
+func TestEffectiveMaxWait(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].Buckets["uncapped"] = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].Buckets["capped"] = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].Buckets["capped"].MaxWaitCapMillis = 5000
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	for _, test := range []struct {
+		bucket   string
+		override int64
+		expected time.Duration
+	}{
+		// The wait timeout applies when requests don't override it.
+		{"uncapped", -1, time.Second},
+		{"capped", -1, time.Second},
+		// Shorter waits requested always apply.
+		{"uncapped", 500, 500 * time.Millisecond},
+		{"capped", 500, 500 * time.Millisecond},
+		// Longer waits requested apply up to the cap, which is the wait timeout if unset.
+		{"uncapped", 3000, time.Second},
+		{"capped", 3000, 3 * time.Second},
+		{"capped", 8000, 5 * time.Second}} {
+		if maxWait, found := s.EffectiveMaxWait("ns", test.bucket, test.override); !found || maxWait != test.expected {
+			t.Fatalf("Expecting a max wait of %v for %v with override %v. Was %v, %v",
+				test.expected, test.bucket, test.override, maxWait, found)
+		}
+	}
+
+	if _, found := s.EffectiveMaxWait("ns", "nonexistent", -1); found {
+		t.Fatal("Expecting no max wait for a nonexistent bucket")
+	}
+}
+
+func TestEffectiveMaxWaitDoesntCreateBuckets(t *testing.T) {
+	cfg := configs.NewDefaultServiceConfig()
+	cfg.Namespaces["ns"] = configs.NewDefaultNamespaceConfig()
+	cfg.Namespaces["ns"].DynamicBucketTemplate = configs.NewDefaultBucketConfig()
+	cfg.Namespaces["ns"].DynamicBucketTemplate.WaitTimeoutMillis = 2000
+
+	s := New(cfg, memory.NewBucketFactory(), &dummyEndpoint{}).(*server)
+	s.Start()
+	defer s.Stop()
+
+	if maxWait, found := s.EffectiveMaxWait("ns", "dyn", -1); !found || maxWait != 2*time.Second {
+		t.Fatalf("Expecting the template's max wait. Was %v, %v", maxWait, found)
+	}
+
+	if s.bucketContainer.Exists("ns", "dyn") {
+		t.Fatal("Expecting no dynamic bucket to be created")
+	}
+}
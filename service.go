@@ -4,6 +4,7 @@
 package quotaservice
 
 import (
+	"context"
 	"errors"
 	"time"
 )
@@ -14,6 +15,9 @@ const (
 	ER_NO_SUCH_BUCKET ErrorReason = iota
 	ER_TIMED_OUT_WAITING
 	ER_REJECTED
+	ER_NAMESPACE_LOCKED
+	ER_NO_SUCH_OPERATION
+	ER_SERVICE_NOT_READY
 )
 
 // QuotaService is the interface used by RPC subsystems when fielding remote requests for quotas.
@@ -24,13 +28,114 @@ type QuotaService interface {
 	// reserved, and cannot be put back. Wait times will need to be below the maximum allowed wait
 	// time for that namespace and name, and this can be overridden by maxWaitMillisOverride. Set
 	// maxWaitMillisOverride to -1 if you do not wish to override, or 0 if you do not wish to wait
-	// at all.
+	// at all. Requests rejected with ER_TIMED_OUT_WAITING may return a wait time estimating how
+	// long to wait before retrying.
 	Allow(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error)
+
+	// AllowOp is like Allow, but requests the number of tokens an operation type costs, as
+	// configured in the bucket's OperationCosts. Operations that cost nothing are always granted.
+	AllowOp(namespace string, name string, operationType string, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error)
+
+	// AllowWithMeta is like Allow, but passes metadata describing the request to the cost function
+	// configured on the BucketContainer, if any, which overrides tokensRequested.
+	AllowWithMeta(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64, meta map[string]string) (granted int64, waitTime time.Duration, err error)
+
+	// DonateTokens moves tokens from one namespace's aggregate bucket to another's. The receiving
+	// namespace must be configured to accept donations from the donating namespace.
+	DonateTokens(fromNamespace, toNamespace string, tokens int64) error
+}
+
+// OperationLimiting is implemented by QuotaServices that limit types of operations, such as reads
+// and writes, using a namespace's OperationBuckets.
+type OperationLimiting interface {
+	// AllowOperation is like Allow, but the tokens must also be granted by the namespace's bucket
+	// for operationType, if it has one. The longer of the two wait times is returned.
+	AllowOperation(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error)
+}
+
+// BurstAccounting is implemented by QuotaServices that report how many of the tokens granted came
+// from those accumulated in a bucket before a request, rather than those refilled since the last
+// request.
+type BurstAccounting interface {
+	// AllowWithBurst is like Allow, but also returns how many of the tokens granted were burst
+	// tokens. The remaining tokens granted are sustained tokens.
+	AllowWithBurst(namespace string, name string, tokensRequested int64, maxWaitMillisOverride int64) (granted, burstTokens int64, waitTime time.Duration, err error)
+}
+
+// DegradationReporting is implemented by QuotaServices that report the level of a bucket's
+// DegradationLadder that requests are served at.
+type DegradationReporting interface {
+	// AllowWithDegradation is like AllowOperation, but also returns the level of the
+	// DegradationLadder that the bucket serving the request was at, numbered from 1, or 0 if none
+	// applies, and how many of the tokens granted were burst tokens, as AllowWithBurst does. The
+	// level is returned even if the request is rejected.
+	AllowWithDegradation(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted, burstTokens int64, level int32, waitTime time.Duration, err error)
+}
+
+// MaxWaitReporting is implemented by QuotaServices that report how long requests may wait for
+// tokens, once the bucket's wait timeout and cap are applied to the max wait a request asks for.
+type MaxWaitReporting interface {
+	// EffectiveMaxWait returns how long a request for namespace:name, with the given max wait
+	// override, or -1 for none, may wait for tokens. The second return value is false if no bucket
+	// serves the request.
+	EffectiveMaxWait(namespace string, name string, maxWaitMillisOverride int64) (time.Duration, bool)
+}
+
+// Tracing is implemented by QuotaServices that explain how the bucket serving a request was found,
+// for debugging unexpected rejections.
+type Tracing interface {
+	// AllowWithTrace is like Allow, but also returns the steps taken to resolve the bucket and serve
+	// the request, delimited by semicolons. If operationType is set, the tokens must also be
+	// granted by the namespace's bucket for that operation, as for OperationLimiting.
+	AllowWithTrace(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, trace string, err error)
+}
+
+// DryRunning is implemented by QuotaServices that tell you how a request would be served, without
+// taking any tokens, for pre-flight checks and dashboards.
+type DryRunning interface {
+	// DryRun returns what AllowOperation would return for the same arguments, but no tokens are
+	// taken and no events are recorded.
+	DryRun(namespace string, name string, operationType string, tokensRequested int64, maxWaitMillisOverride int64) (granted int64, waitTime time.Duration, err error)
+}
+
+// ExclusiveTaking is implemented by QuotaServices that let only one caller at a time hold a
+// token from a bucket, across all instances, such as a slot to run a scheduled job in. Only buckets
+// that implement buckets.ExclusiveBucket, such as Redis buckets, support it.
+type ExclusiveTaking interface {
+	// TakeExclusive is like Allow for a single token, but the caller also holds the bucket's lease
+	// until it calls ReleaseExclusive with the lease ID returned, or until lockTTL passes. Requests
+	// wait for a lease held by another caller until ctx is done, and are then rejected. Requests
+	// with a lockTTL under 1ms are rejected.
+	TakeExclusive(ctx context.Context, namespace string, name string, lockTTL time.Duration) (granted int64, waitTime time.Duration, leaseID string, err error)
+
+	// ReleaseExclusive releases a lease acquired using TakeExclusive.
+	ReleaseExclusive(leaseID string) error
+}
+
+// GrantReplicating is implemented by QuotaServices that can serve as a standby, applying the
+// grants replicated by a primary configured using BucketContainer.WithStandbyReplication().
+type GrantReplicating interface {
+	// ApplyReplicatedGrant takes tokens granted by the primary from the bucket serving
+	// namespace:name, without waiting for them. Tokens beyond what the bucket can lend are
+	// discarded, since the primary has already granted them.
+	ApplyReplicatedGrant(namespace string, name string, tokens int64) error
+}
+
+// TokenReturning is implemented by QuotaServices that take back tokens granted but not used, such
+// as the losing grant of a hedged request.
+type TokenReturning interface {
+	// ReturnTokens adds tokens granted by an earlier Allow request back to the bucket serving
+	// namespace:name, and to the aggregate and operation buckets that also limited the request.
+	// Tokens beyond the size of a bucket are discarded.
+	ReturnTokens(namespace string, name string, operationType string, tokens int64) error
 }
 
 type QuotaServiceError struct {
 	error
 	Reason ErrorReason
+	// RejectionMessage is the RejectionMessage configured on the bucket that rejected the request,
+	// if any, for passing on to clients.
+	RejectionMessage string
 }
 
 func (e QuotaServiceError) Error() string {
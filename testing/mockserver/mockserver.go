@@ -0,0 +1,183 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+// Package mockserver implements a mock quota service, for testing clients of the quota service
+// without running a real one. The mock is a gRPC server listening on a local port, so clients
+// written in any language can use it.
+package mockserver
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/maniksurtani/quotaservice/buckets"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// AllowFunc computes the response to an Allow request.
+type AllowFunc func(*qspb.AllowRequest) *qspb.AllowResponse
+
+// MockServer serves Allow requests with responses configured using OnAllow(). Requests for buckets
+// without a configured response are granted all the tokens requested. Health checks report the
+// server healthy unless configured otherwise using SetHealthy().
+type MockServer struct {
+	listener      net.Listener
+	grpcServer    *grpc.Server
+	handlers      map[string]AllowFunc
+	calls         map[string]int
+	returned      map[string]int64
+	replicated    map[string]int64
+	unhealthy     bool
+	healthLatency time.Duration
+	sync.Mutex
+}
+
+// NewMockServer starts a mock server on a local port, which is stopped when the test completes.
+func NewMockServer(t testing.TB) *MockServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start mock quota service. Error %v", err)
+	}
+
+	m := &MockServer{
+		listener:   lis,
+		grpcServer: grpc.NewServer(),
+		handlers:   make(map[string]AllowFunc),
+		calls:      make(map[string]int),
+		returned:   make(map[string]int64),
+		replicated: make(map[string]int64)}
+	qspb.RegisterQuotaServiceServer(m.grpcServer, m)
+	go m.grpcServer.Serve(lis)
+	t.Cleanup(m.Stop)
+	return m
+}
+
+// Addr returns the host:port the mock server listens on.
+func (m *MockServer) Addr() string {
+	return m.listener.Addr().String()
+}
+
+// Stop stops the mock server.
+func (m *MockServer) Stop() {
+	m.grpcServer.Stop()
+}
+
+// OnAllow configures the response to Allow requests for a bucket.
+func (m *MockServer) OnAllow(namespace, bucket string, fn AllowFunc) {
+	m.Lock()
+	defer m.Unlock()
+	m.handlers[buckets.FullyQualifiedName(namespace, bucket)] = fn
+}
+
+// AllCallCount returns the number of Allow requests made for a bucket.
+func (m *MockServer) AllCallCount(namespace, bucket string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.calls[buckets.FullyQualifiedName(namespace, bucket)]
+}
+
+// ReturnedTokens returns the number of tokens returned to a bucket.
+func (m *MockServer) ReturnedTokens(namespace, bucket string) int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.returned[buckets.FullyQualifiedName(namespace, bucket)]
+}
+
+// ReplicatedTokens returns the number of tokens granted by a primary that were replicated to a
+// bucket.
+func (m *MockServer) ReplicatedTokens(namespace, bucket string) int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.replicated[buckets.FullyQualifiedName(namespace, bucket)]
+}
+
+// SetHealthy configures the health reported by health checks.
+func (m *MockServer) SetHealthy(healthy bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.unhealthy = !healthy
+}
+
+// SetHealthCheckLatency delays responses to health checks by latency, to simulate a slow server.
+func (m *MockServer) SetHealthCheckLatency(latency time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.healthLatency = latency
+}
+
+// HealthCheck implements qspb.QuotaServiceServer.
+func (m *MockServer) HealthCheck(ctx context.Context, req *qspb.HealthCheckRequest) (*qspb.HealthCheckResponse, error) {
+	m.Lock()
+	healthy, latency := !m.unhealthy, m.healthLatency
+	m.Unlock()
+
+	time.Sleep(latency)
+	return &qspb.HealthCheckResponse{Healthy: proto.Bool(healthy)}, nil
+}
+
+// ReturnTokens implements qspb.QuotaServiceServer.
+func (m *MockServer) ReturnTokens(ctx context.Context, req *qspb.ReturnTokensRequest) (*qspb.ReturnTokensResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.returned[buckets.FullyQualifiedName(req.GetNamespace(), req.GetName())] += req.GetTokens()
+	return &qspb.ReturnTokensResponse{}, nil
+}
+
+// ReplicateGrant implements qspb.QuotaServiceServer.
+func (m *MockServer) ReplicateGrant(ctx context.Context, req *qspb.ReplicateGrantRequest) (*qspb.ReplicateGrantResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.replicated[buckets.FullyQualifiedName(req.GetNamespace(), req.GetName())] += req.GetTokensGranted()
+	return &qspb.ReplicateGrantResponse{}, nil
+}
+
+// Allow implements qspb.QuotaServiceServer.
+func (m *MockServer) Allow(ctx context.Context, req *qspb.AllowRequest) (*qspb.AllowResponse, error) {
+	fqn := buckets.FullyQualifiedName(req.GetNamespace(), req.GetName())
+	m.Lock()
+	m.calls[fqn]++
+	fn := m.handlers[fqn]
+	m.Unlock()
+
+	if fn == nil {
+		fn = Granted(0)
+	}
+
+	return fn(req), nil
+}
+
+// Granted returns an AllowFunc that grants all the tokens requested, after waitMillis.
+func Granted(waitMillis int64) AllowFunc {
+	return func(req *qspb.AllowRequest) *qspb.AllowResponse {
+		status := qspb.AllowResponse_OK
+		if waitMillis > 0 {
+			status = qspb.AllowResponse_OK_WAIT
+		}
+
+		return &qspb.AllowResponse{
+			Status:           &status,
+			NumTokensGranted: proto.Int64(tokensRequested(req)),
+			WaitMillis:       proto.Int64(waitMillis)}
+	}
+}
+
+// Rejected returns an AllowFunc that rejects all requests.
+func Rejected() AllowFunc {
+	return func(req *qspb.AllowRequest) *qspb.AllowResponse {
+		status := qspb.AllowResponse_REJECTED
+		return &qspb.AllowResponse{Status: &status}
+	}
+}
+
+func tokensRequested(req *qspb.AllowRequest) int64 {
+	if req.NumTokensRequested == nil {
+		return 1
+	}
+
+	return req.GetNumTokensRequested()
+}
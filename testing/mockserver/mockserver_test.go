@@ -0,0 +1,89 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/maniksurtani/quotaservice/master/LICENSE
+
+package mockserver
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	qspb "github.com/maniksurtani/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func allow(t *testing.T, m *MockServer, namespace, bucket string, tokens int64) *qspb.AllowResponse {
+	conn, err := grpc.Dial(m.Addr(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Unable to connect. Error: %v", err)
+	}
+	defer conn.Close()
+
+	rsp, err := qspb.NewQuotaServiceClient(conn).Allow(context.TODO(), &qspb.AllowRequest{
+		Namespace:          proto.String(namespace),
+		Name:               proto.String(bucket),
+		NumTokensRequested: proto.Int64(tokens)})
+	if err != nil {
+		t.Fatalf("Not expecting an error. Was %v", err)
+	}
+
+	return rsp
+}
+
+func TestDefaultGrant(t *testing.T) {
+	m := NewMockServer(t)
+	rsp := allow(t, m, "n", "b", 5)
+	if rsp.GetStatus() != qspb.AllowResponse_OK || rsp.GetNumTokensGranted() != 5 {
+		t.Fatalf("Expecting 5 tokens granted. Was %v", rsp)
+	}
+
+	if c := m.AllCallCount("n", "b"); c != 1 {
+		t.Fatalf("Expecting 1 call. Was %v", c)
+	}
+}
+
+func TestConfiguredGrant(t *testing.T) {
+	m := NewMockServer(t)
+	m.OnAllow("n", "b", Granted(100))
+
+	rsp := allow(t, m, "n", "b", 2)
+	if rsp.GetStatus() != qspb.AllowResponse_OK_WAIT || rsp.GetWaitMillis() != 100 {
+		t.Fatalf("Expecting a wait of 100 millis. Was %v", rsp)
+	}
+}
+
+func TestSimulatedRejection(t *testing.T) {
+	m := NewMockServer(t)
+	m.OnAllow("n", "limited", Rejected())
+
+	for i := 0; i < 3; i++ {
+		if rsp := allow(t, m, "n", "limited", 1); rsp.GetStatus() != qspb.AllowResponse_REJECTED {
+			t.Fatalf("Expecting status REJECTED. Was %v", rsp)
+		}
+	}
+
+	if rsp := allow(t, m, "n", "other", 1); rsp.GetStatus() != qspb.AllowResponse_OK {
+		t.Fatalf("Expecting other buckets to be granted. Was %v", rsp)
+	}
+
+	if c := m.AllCallCount("n", "limited"); c != 3 {
+		t.Fatalf("Expecting 3 calls. Was %v", c)
+	}
+}
+
+func TestCustomResponse(t *testing.T) {
+	m := NewMockServer(t)
+	m.OnAllow("n", "b", func(req *qspb.AllowRequest) *qspb.AllowResponse {
+		// Grant at most 10 tokens.
+		status := qspb.AllowResponse_OK
+		granted := req.GetNumTokensRequested()
+		if granted > 10 {
+			granted = 10
+		}
+		return &qspb.AllowResponse{Status: &status, NumTokensGranted: proto.Int64(granted)}
+	})
+
+	if rsp := allow(t, m, "n", "b", 50); rsp.GetNumTokensGranted() != 10 {
+		t.Fatalf("Expecting 10 tokens granted. Was %v", rsp)
+	}
+}